@@ -0,0 +1,107 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// attacher-loadgen creates and deletes synthetic PersistentVolumes and
+// VolumeAttachments and reports attach and detach throughput and latency.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/loadgen"
+)
+
+var (
+	kubeconfig  = flag.String("kubeconfig", "", "Path to the kubeconfig file. $KUBECONFIG or ~/.kube/config is used by default.")
+	kubeContext = flag.String("context", "", "Name of the context in the kubeconfig to use instead of its current context.")
+
+	driver  = flag.String("driver", "", "Name of the CSI driver of the created PersistentVolumes and VolumeAttachments.")
+	nodes   = flag.String("nodes", "", "Comma separated list of nodes to attach to, round robin.")
+	count   = flag.Int("count", 100, "Number of VolumeAttachments to create.")
+	rate    = flag.Float64("rate", 10, "Number of VolumeAttachments created per second.")
+	detach  = flag.Bool("detach", false, "Delete each VolumeAttachment when it's attached and measure detach too.")
+	timeout = flag.Duration("timeout", 5*time.Minute, "How long to wait for the VolumeAttachments after the last one was created.")
+	runID   = flag.String("run-id", "", "ID of the run in the names and labels of the created objects. Current time is used by default.")
+
+	version = "unknown"
+)
+
+func main() {
+	klog.InitFlags(nil)
+	flag.Set("logtostderr", "true")
+	flag.Parse()
+	klog.Infof("Version: %s", version)
+
+	config := loadgen.Config{
+		Driver:  *driver,
+		Count:   *count,
+		Rate:    *rate,
+		Detach:  *detach,
+		Timeout: *timeout,
+		RunID:   *runID,
+	}
+	if *nodes != "" {
+		config.Nodes = strings.Split(*nodes, ",")
+	}
+	if err := config.Validate(); err != nil {
+		klog.Error(err.Error())
+		os.Exit(2)
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = *kubeconfig
+	restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: *kubeContext}).ClientConfig()
+	if err != nil {
+		klog.Errorf("Failed to load kubeconfig: %v", err)
+		os.Exit(1)
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		klog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Stop creating objects and clean up on SIGINT / SIGTERM.
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	result, err := loadgen.Run(ctx, client, config)
+	if err != nil {
+		klog.Error(err.Error())
+		os.Exit(1)
+	}
+	result.Print(os.Stdout)
+	if result.Attached < result.Created || (config.Detach && result.Detached < result.Created) {
+		fmt.Fprintf(os.Stderr, "Not all VolumeAttachments were processed\n")
+		os.Exit(1)
+	}
+}
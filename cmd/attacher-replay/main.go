@@ -0,0 +1,170 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// attacher-replay replays VolumeAttachment, PersistentVolume, Node and
+// CSINode events recorded by csi-attacher -record-events against a fake API
+// server and an in-process attacher.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kubernetes-csi/csi-lib-utils/connection"
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/controller"
+	"github.com/kubernetes-csi/external-attacher/pkg/mockcsi"
+	"github.com/kubernetes-csi/external-attacher/pkg/replay"
+)
+
+// Handlers that process the replayed events.
+const (
+	handlerTrivial = "trivial"
+	handlerMock    = "mock"
+)
+
+var (
+	events   = flag.String("events", "", "File with events recorded by csi-attacher -record-events.")
+	handler  = flag.String("handler", handlerMock, "Handler of the replayed VolumeAttachments: \"mock\" (the CSI handler with an in-process mock CSI driver) or \"trivial\" (marks VolumeAttachments as attached).")
+	driver   = flag.String("driver", "", "Name of the CSI driver whose VolumeAttachments are processed. Defaults to the attacher of the first recorded VolumeAttachment.")
+	interval = flag.Duration("interval", 100*time.Millisecond, "Time to wait after each replayed event.")
+	settle   = flag.Duration("settle", 2*time.Second, "Time to wait after the last event before the result is printed.")
+	timeout  = flag.Duration("timeout", 15*time.Second, "Timeout of ControllerPublish and ControllerUnpublish calls of the mock handler.")
+	errRate  = flag.Float64("mock-csi-error-rate", 0, "Probability from 0 to 1 that ControllerPublish or ControllerUnpublish of the mock CSI driver fails.")
+
+	version = "unknown"
+)
+
+func main() {
+	klog.InitFlags(nil)
+	flag.Set("logtostderr", "true")
+	flag.Parse()
+	klog.Infof("Version: %s", version)
+	if err := run(); err != nil {
+		klog.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	if *events == "" {
+		return fmt.Errorf("option -events is required")
+	}
+	file, err := os.Open(*events)
+	if err != nil {
+		return err
+	}
+	recorded, err := replay.ReadEvents(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	name := *driver
+	if name == "" {
+		if name, err = firstAttacher(recorded); err != nil {
+			return err
+		}
+	}
+	klog.Infof("Replaying %d events of CSI driver %q", len(recorded), name)
+
+	cluster := replay.NewCluster()
+	factory := informers.NewSharedInformerFactory(cluster.Client, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Each event is processed by a single worker before the next one is
+	// replayed, to keep the order of the recording.
+	var runController func()
+	switch *handler {
+	case handlerTrivial:
+		ctrl := controller.NewCSIAttachController(
+			cluster.Client,
+			name,
+			controller.NewTrivialHandler(cluster.Client),
+			factory.Storage().V1beta1().VolumeAttachments(),
+			factory.Core().V1().PersistentVolumes(),
+			workqueue.DefaultControllerRateLimiter(),
+			workqueue.DefaultControllerRateLimiter(),
+			0,
+			nil,
+		)
+		runController = func() { ctrl.Run(1, ctx.Done()) }
+	case handlerMock:
+		dir, err := ioutil.TempDir("", "attacher-replay-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		mock := mockcsi.NewDriver(mockcsi.Options{Name: name, ErrorRate: *errRate})
+		if err := mock.Start(filepath.Join(dir, "csi.sock")); err != nil {
+			return err
+		}
+		defer mock.Stop()
+		conn, err := connection.Connect(mock.Address())
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		options := controller.DefaultOptions()
+		options.WorkerThreads = 1
+		options.Timeout = *timeout
+		d, err := controller.NewDriver(ctx, cluster.Client, factory, conn, options)
+		if err != nil {
+			return err
+		}
+		runController = func() { d.Run(ctx) }
+	default:
+		return fmt.Errorf("option -handler must be %q or %q", handlerMock, handlerTrivial)
+	}
+
+	factory.Start(ctx.Done())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runController()
+	}()
+	if err := cluster.Replay(recorded, *interval, ctx.Done()); err != nil {
+		return err
+	}
+	time.Sleep(*settle)
+	cancel()
+	<-done
+	return cluster.PrintResult(os.Stdout)
+}
+
+// firstAttacher returns the attacher of the first recorded VolumeAttachment.
+func firstAttacher(events []replay.Event) (string, error) {
+	for _, event := range events {
+		if event.Kind != replay.KindVolumeAttachment {
+			continue
+		}
+		obj, err := event.Decode()
+		if err != nil {
+			return "", err
+		}
+		return obj.(*storage.VolumeAttachment).Spec.Attacher, nil
+	}
+	return "", fmt.Errorf("no VolumeAttachment recorded, use -driver")
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// attacherctl inspects VolumeAttachments handled by the external-attacher.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/inspect"
+)
+
+const usage = `Usage: %s [options] <command>
+
+Commands:
+  list [-driver <name>]  List VolumeAttachments with their age, state, error class, retries and node.
+  timeline <name>        Show the timeline of a VolumeAttachment reconstructed from its status,
+                         annotations and events.
+
+Options:
+`
+
+var (
+	kubeconfig  = flag.String("kubeconfig", "", "Path to the kubeconfig file. $KUBECONFIG or ~/.kube/config is used by default.")
+	kubeContext = flag.String("context", "", "Name of the context in the kubeconfig to use instead of its current context.")
+
+	version = "unknown"
+)
+
+func main() {
+	klog.InitFlags(nil)
+	flag.Set("logtostderr", "true")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	command, args := flag.Arg(0), flag.Args()[1:]
+	switch command {
+	case "list":
+		os.Exit(runList(args))
+	case "timeline":
+		os.Exit(runTimeline(args))
+	case "version":
+		fmt.Println(version)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func newClient() (kubernetes.Interface, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = *kubeconfig
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: *kubeContext}).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %v", err)
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+func runList(args []string) int {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	driver := flags.String("driver", "", "Name of the CSI driver. VolumeAttachments of all drivers are listed by default.")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	client, err := newClient()
+	if err != nil {
+		klog.Error(err.Error())
+		return 1
+	}
+	attachments, err := inspect.ListAttachments(client, *driver, time.Now())
+	if err != nil {
+		klog.Error(err.Error())
+		return 1
+	}
+	if err := inspect.PrintAttachments(os.Stdout, attachments); err != nil {
+		klog.Error(err.Error())
+		return 1
+	}
+	return 0
+}
+
+func runTimeline(args []string) int {
+	flags := flag.NewFlagSet("timeline", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s timeline <name>\n", os.Args[0])
+		return 2
+	}
+
+	client, err := newClient()
+	if err != nil {
+		klog.Error(err.Error())
+		return 1
+	}
+	entries, err := inspect.Timeline(client, flags.Arg(0))
+	if err != nil {
+		klog.Error(err.Error())
+		return 1
+	}
+	if err := inspect.PrintTimeline(os.Stdout, entries); err != nil {
+		klog.Error(err.Error())
+		return 1
+	}
+	return 0
+}
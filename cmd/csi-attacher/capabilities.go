@@ -0,0 +1,209 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"k8s.io/klog"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
+	"github.com/kubernetes-csi/external-attacher/pkg/controller"
+)
+
+// driverInfo is the output of the capabilities subcommand.
+type driverInfo struct {
+	Name                   string            `json:"name"`
+	VendorVersion          string            `json:"vendorVersion"`
+	Manifest               map[string]string `json:"manifest,omitempty"`
+	PluginCapabilities     []string          `json:"pluginCapabilities"`
+	ControllerCapabilities []string          `json:"controllerCapabilities"`
+	// Attacher are the capabilities as used by the attacher.
+	Attacher controller.DriverCapabilities `json:"attacher"`
+}
+
+// runCapabilities runs "csi-attacher capabilities": it prints information
+// about the CSI driver and exits.
+func runCapabilities(args []string) int {
+	flags := flag.NewFlagSet("capabilities", flag.ContinueOnError)
+	klog.InitFlags(flags)
+	flags.Set("logtostderr", "true")
+	address := flags.String("csi-address", csiEndpoint(), "Address of the CSI driver socket. Defaults to $"+csiEndpointEnv+" or "+defaultCSIAddress+".")
+	timeout := flags.Duration("timeout", 15*time.Second, "Timeout of connecting to the driver and of each call.")
+	output := flags.String("output", "table", "Output format: \"table\" or \"json\".")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s capabilities [options]\n\nPrints information about the CSI driver and exits.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitConfigError
+	}
+	if *output != "table" && *output != "json" {
+		klog.Errorf("option -output must be \"table\" or \"json\"")
+		return exitConfigError
+	}
+
+	conn, err := connectWithTimeout(*address, *timeout)
+	if err != nil {
+		klog.Error(err.Error())
+		return exitCSIError
+	}
+	defer conn.Close()
+
+	info, err := getDriverInfo(conn, *timeout)
+	if err != nil {
+		klog.Errorf("CSI driver at %q: %v", *address, err)
+		return exitCSIError
+	}
+	if *output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(info)
+	} else {
+		err = info.print(os.Stdout)
+	}
+	if err != nil {
+		klog.Error(err.Error())
+		return exitError
+	}
+	return 0
+}
+
+// connectWithTimeout connects to the CSI driver, attacher.Connect waits
+// forever.
+func connectWithTimeout(address string, timeout time.Duration) (*grpc.ClientConn, error) {
+	type result struct {
+		conn *grpc.ClientConn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := attacher.Connect(address, nil)
+		done <- result{conn, err}
+	}()
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("timed out connecting to CSI driver at %q", address)
+	}
+}
+
+func getDriverInfo(conn *grpc.ClientConn, timeout time.Duration) (*driverInfo, error) {
+	identity := csi.NewIdentityClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	pluginInfo, err := identity.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("GetPluginInfo failed: %v", err)
+	}
+	info := &driverInfo{
+		Name:                   pluginInfo.Name,
+		VendorVersion:          pluginInfo.VendorVersion,
+		Manifest:               pluginInfo.Manifest,
+		PluginCapabilities:     []string{},
+		ControllerCapabilities: []string{},
+	}
+
+	pluginCaps, err := identity.GetPluginCapabilities(ctx, &csi.GetPluginCapabilitiesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("GetPluginCapabilities failed: %v", err)
+	}
+	controllerService := false
+	for _, c := range pluginCaps.Capabilities {
+		switch {
+		case c.GetService() != nil:
+			info.PluginCapabilities = append(info.PluginCapabilities, c.GetService().Type.String())
+			controllerService = controllerService || c.GetService().Type == csi.PluginCapability_Service_CONTROLLER_SERVICE
+		case c.GetVolumeExpansion() != nil:
+			info.PluginCapabilities = append(info.PluginCapabilities, "VOLUME_EXPANSION_"+c.GetVolumeExpansion().Type.String())
+		}
+	}
+
+	if controllerService {
+		controllerCaps, err := csi.NewControllerClient(conn).ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+		if err != nil {
+			return nil, fmt.Errorf("ControllerGetCapabilities failed: %v", err)
+		}
+		for _, c := range controllerCaps.Capabilities {
+			if c.GetRpc() != nil {
+				info.ControllerCapabilities = append(info.ControllerCapabilities, c.GetRpc().Type.String())
+			}
+		}
+	}
+
+	info.Attacher, err = controller.GetDriverCapabilities(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// print writes the information as a table.
+func (info *driverInfo) print(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", info.Name)
+	fmt.Fprintf(w, "Vendor version:\t%s\n", info.VendorVersion)
+	keys := make([]string, 0, len(info.Manifest))
+	for key := range info.Manifest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "Manifest %s:\t%s\n", key, info.Manifest[key])
+	}
+	printList(w, "Plugin capabilities:", info.PluginCapabilities)
+	printList(w, "Controller capabilities:", info.ControllerCapabilities)
+
+	handler := info.Attacher.Handler
+	switch {
+	case !info.Attacher.ControllerService:
+		handler += " (no CONTROLLER_SERVICE plugin capability)"
+	case !info.Attacher.PublishUnpublish:
+		handler += " (no PUBLISH_UNPUBLISH_VOLUME controller capability)"
+	default:
+		handler += " (calls ControllerPublishVolume and ControllerUnpublishVolume)"
+	}
+	fmt.Fprintf(w, "Attacher handler:\t%s\n", handler)
+	fmt.Fprintf(w, "Read-only attach:\t%v\n", info.Attacher.PublishReadOnly)
+	return w.Flush()
+}
+
+func printList(w io.Writer, title string, items []string) {
+	if len(items) == 0 {
+		fmt.Fprintf(w, "%s\t<none>\n", title)
+		return
+	}
+	for i, item := range items {
+		if i == 0 {
+			fmt.Fprintf(w, "%s\t%s\n", title, item)
+		} else {
+			fmt.Fprintf(w, "\t%s\n", item)
+		}
+	}
+}
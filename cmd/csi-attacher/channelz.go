@@ -0,0 +1,45 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/channelz/service"
+	"k8s.io/klog"
+)
+
+// serveChannelz serves the gRPC channelz service at a TCP address, so the
+// connections to CSI drivers can be inspected with grpcdebug. It turns on
+// channelz and it must be called before the connections are created,
+// otherwise they are not tracked.
+func serveChannelz(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer()
+	service.RegisterChannelzServiceToServer(server)
+	go func() {
+		klog.Infof("channelz listening at %q", address)
+		if err := server.Serve(listener); err != nil {
+			klog.Fatalf("Failed to serve channelz at %q: %s", address, err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	// terminationLogPath is the default terminationMessagePath of
+	// Kubernetes containers.
+	terminationLogPath = "/dev/termination-log"
+	// terminationLogSize is the size of termination messages kept by the
+	// kubelet.
+	terminationLogSize = 4096
+	// crashDumpStateTimeout is how long the dump waits for the state of the
+	// controllers. Locks may be held by the panicking goroutine.
+	crashDumpStateTimeout = time.Second
+)
+
+// crashDump is written when the attacher panics.
+type crashDump struct {
+	Time  time.Time `json:"time"`
+	Panic string    `json:"panic"`
+	Stack string    `json:"stack"`
+	// State is nil when it could not be collected in
+	// crashDumpStateTimeout.
+	State *attacherState `json:"state"`
+}
+
+// crashDumper writes a gzip-compressed JSON crashDump when a goroutine that
+// runs utilruntime.HandleCrash panics.
+type crashDumper struct {
+	// path is a file or a directory for dumps, empty disables the file.
+	path string
+	// terminationLog writes the dump also base64-encoded to
+	// terminationLogPath.
+	terminationLog bool
+	state          func() attacherState
+	once           sync.Once
+}
+
+// handlePanic is a utilruntime.PanicHandlers function.
+func (d *crashDumper) handlePanic(r interface{}) {
+	d.once.Do(func() {
+		dump := crashDump{
+			Time:  time.Now(),
+			Panic: fmt.Sprint(r),
+			Stack: string(debug.Stack()),
+			State: collectState(d.state, crashDumpStateTimeout),
+		}
+		if d.path != "" {
+			if path, err := d.write(dump); err != nil {
+				klog.Errorf("Failed to write crash dump: %v", err)
+			} else {
+				klog.Errorf("Crash dump written to %s", path)
+			}
+		}
+		if d.terminationLog {
+			if err := writeTerminationLog(terminationLogPath, dump); err != nil {
+				klog.Errorf("Failed to write crash dump to %s: %v", terminationLogPath, err)
+			}
+		}
+	})
+}
+
+// write writes the dump to d.path or to a new file in it when it's a
+// directory, so dumps of previous crashes are kept.
+func (d *crashDumper) write(dump crashDump) (string, error) {
+	path := d.path
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, fmt.Sprintf("csi-attacher-crash-%s.json.gz", dump.Time.UTC().Format("20060102T150405Z")))
+	}
+	data, err := encodeCrashDump(dump)
+	if err != nil {
+		return "", err
+	}
+	return path, ioutil.WriteFile(path, data, 0600)
+}
+
+// writeTerminationLog writes the dump base64-encoded, leaving out the
+// least useful parts until it fits into a termination message.
+func writeTerminationLog(path string, dump crashDump) error {
+	shrink := []func(){
+		func() {
+			if dump.State == nil {
+				return
+			}
+			state := *dump.State
+			state.Drivers = append([]driverState(nil), state.Drivers...)
+			for i := range state.Drivers {
+				state.Drivers[i].RecentSyncs = nil
+			}
+			dump.State = &state
+		},
+		func() { dump.State = nil },
+		func() {
+			if len(dump.Stack) > terminationLogSize/2 {
+				dump.Stack = dump.Stack[:terminationLogSize/2]
+			}
+		},
+	}
+	var encoded string
+	for i := 0; ; i++ {
+		data, err := encodeCrashDump(dump)
+		if err != nil {
+			return err
+		}
+		encoded = base64.StdEncoding.EncodeToString(data)
+		if len(encoded) <= terminationLogSize || i == len(shrink) {
+			break
+		}
+		shrink[i]()
+	}
+	return ioutil.WriteFile(path, []byte(encoded), 0644)
+}
+
+func encodeCrashDump(dump crashDump) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(writer).Encode(dump); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// collectState returns the state or nil when it's not available in timeout.
+func collectState(state func() attacherState, timeout time.Duration) *attacherState {
+	result := make(chan *attacherState, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				result <- nil
+			}
+		}()
+		s := state()
+		result <- &s
+	}()
+	select {
+	case s := <-result:
+		return s
+	case <-time.After(timeout):
+		return nil
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/klog"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/controller"
+)
+
+// attacherState is the response of /debug/attacher.
+type attacherState struct {
+	Drivers []driverState `json:"drivers"`
+	// Connecting are addresses of sockets in -csi-address-dir that are
+	// being connected to.
+	Connecting []string `json:"connecting"`
+}
+
+type driverState struct {
+	Address string `json:"address"`
+	controller.DriverState
+}
+
+// serveDebug writes internal state of controllers of all drivers as JSON.
+func (s *driverSet) serveDebug(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	state := s.state()
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(state); err != nil {
+		klog.Errorf("Failed to write /debug/attacher response: %v", err)
+	}
+}
+
+// state returns internal state of controllers of all drivers.
+func (s *driverSet) state() attacherState {
+	s.lock.Lock()
+	state := attacherState{
+		Drivers:    make([]driverState, 0, len(s.drivers)),
+		Connecting: make([]string, 0, len(s.connecting)),
+	}
+	for address, d := range s.drivers {
+		state.Drivers = append(state.Drivers, driverState{Address: address, DriverState: d.ctrl.State()})
+	}
+	for address := range s.connecting {
+		state.Connecting = append(state.Connecting, address)
+	}
+	s.lock.Unlock()
+	sort.Slice(state.Drivers, func(i, j int) bool { return state.Drivers[i].Driver < state.Drivers[j].Driver })
+	sort.Strings(state.Connecting)
+	return state
+}
+
+// reconcileHandler serves /debug/reconcile, which clears backoff of a
+// VolumeAttachment and processes it now. Requests must have the bearer
+// token from tokenFile, the file is read again for each request.
+func (s *driverSet) reconcileHandler(tokenFile string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := checkToken(r, tokenFile); err != nil {
+			klog.Warningf("Rejected /debug/reconcile request from %s: %v", r.RemoteAddr, err)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		name := r.URL.Query().Get("volumeattachment")
+		if name == "" {
+			http.Error(w, "parameter volumeattachment is required", http.StatusBadRequest)
+			return
+		}
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		for _, d := range s.drivers {
+			err := d.ctrl.Reconcile(name)
+			switch {
+			case err == nil:
+				w.WriteHeader(http.StatusAccepted)
+				fmt.Fprintf(w, "VolumeAttachment %s of %s enqueued\n", name, d.name)
+				return
+			case err == controller.ErrOtherAttacher:
+				continue
+			case apierrs.IsNotFound(err):
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		http.Error(w, fmt.Sprintf("VolumeAttachment %s is not handled by this attacher", name), http.StatusNotFound)
+	}
+}
+
+// checkToken checks that the request has the bearer token from tokenFile.
+func checkToken(r *http.Request, tokenFile string) error {
+	data, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return fmt.Errorf("token file %s is empty", tokenFile)
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return fmt.Errorf("missing bearer token")
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+		return fmt.Errorf("invalid bearer token")
+	}
+	return nil
+}
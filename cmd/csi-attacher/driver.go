@@ -0,0 +1,403 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"github.com/kubernetes-csi/csi-lib-utils/rpc"
+	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
+	"github.com/kubernetes-csi/external-attacher/pkg/attacherconfig"
+	"github.com/kubernetes-csi/external-attacher/pkg/controller"
+	"github.com/kubernetes-csi/external-attacher/pkg/csiproxy"
+	"google.golang.org/grpc"
+)
+
+// csiDriver is a CSI driver served by the attacher.
+type csiDriver struct {
+	address  string
+	name     string
+	conn     *grpc.ClientConn
+	ctrl     *controller.Driver
+	handover *controller.StateHandover
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// connectDriver connects to the CSI driver at given address and creates its
+// controller.
+func connectDriver(address string, clientset kubernetes.Interface, factory informers.SharedInformerFactory, options controller.Options) (*csiDriver, error) {
+	csiConn, err := connectCSI(address, options.RedactPublishContextKeys, options.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	driver, err := newCSIDriver(address, csiConn, clientset, factory, options)
+	if err != nil {
+		csiConn.Close()
+		return nil, err
+	}
+	return driver, nil
+}
+
+// connectCSI connects to the CSI driver at given address and waits until it
+// is ready.
+func connectCSI(address string, redactedKeys []string, timeout time.Duration) (*grpc.ClientConn, error) {
+	csiConn, err := attacher.Connect(address, redactedKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rpc.ProbeForever(csiConn, timeout)
+	if err != nil {
+		csiConn.Close()
+		return nil, err
+	}
+	return csiConn, nil
+}
+
+// connectFailover connects to the CSI driver at primary address with failover
+// to backup address and waits until it is ready.
+func connectFailover(primary, backup string, failoverTimeout time.Duration, redactedKeys []string, timeout time.Duration) (*grpc.ClientConn, *attacher.Failover, error) {
+	failover, err := attacher.NewFailover(primary, backup, failoverTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	csiConn, err := attacher.ConnectFailover(failover, redactedKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = rpc.ProbeForever(csiConn, timeout)
+	if err != nil {
+		csiConn.Close()
+		return nil, nil, err
+	}
+	return csiConn, failover, nil
+}
+
+// connectProxy connects to the CSI driver behind a proxy at given endpoint and
+// waits until it is ready.
+func connectProxy(endpoint string, options csiproxy.Options, timeout time.Duration) (*grpc.ClientConn, error) {
+	csiConn, err := csiproxy.Connect(endpoint, options)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rpc.ProbeForever(csiConn, timeout)
+	if err != nil {
+		csiConn.Close()
+		return nil, err
+	}
+	return csiConn, nil
+}
+
+// newCSIDriver creates the controller of a connected CSI driver.
+func newCSIDriver(address string, csiConn *grpc.ClientConn, clientset kubernetes.Interface, factory informers.SharedInformerFactory, options controller.Options) (*csiDriver, error) {
+	ctrl, err := controller.NewDriver(context.Background(), clientset, factory, csiConn, options)
+	if err != nil {
+		return nil, fmt.Errorf("CSI driver at %q: %v", address, err)
+	}
+	klog.V(2).Infof("CSI driver name at %q: %q", address, ctrl.Name())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &csiDriver{
+		address: address,
+		name:    ctrl.Name(),
+		conn:    csiConn,
+		ctrl:    ctrl,
+		ctx:     ctx,
+		cancel:  cancel,
+	}, nil
+}
+
+// stop stops the controller of the driver. It can be called several times.
+func (d *csiDriver) stop() {
+	d.cancel()
+}
+
+// apply applies settings that can be changed while the controller runs.
+func (d *csiDriver) apply(settings attacherconfig.Settings) {
+	d.ctrl.SetTimeout(settings.Timeout)
+	d.ctrl.SetRetryIntervals(settings.RetryIntervalStart, settings.RetryIntervalMax)
+}
+
+// run runs the controller of the driver with given settings until it is
+// stopped, restoring and saving its state when warm standby is enabled.
+func (d *csiDriver) run(settings attacherconfig.Settings, snapshotInterval time.Duration) {
+	d.apply(settings)
+	d.ctrl.SetWorkerThreads(settings.WorkerThreads)
+	if d.handover != nil {
+		if err := d.handover.Restore(); err != nil {
+			klog.Errorf("Failed to restore state of the previous leader of %q: %v", d.name, err)
+		}
+		go d.handover.Run(snapshotInterval, d.ctx.Done())
+	}
+	if err := d.ctrl.Run(d.ctx); err != nil {
+		klog.Error(err.Error())
+	}
+	if d.handover != nil {
+		// Save the final state after operations in progress finished.
+		if err := d.handover.Save(); err != nil {
+			klog.Errorf("Failed to save state of %q for the next leader: %v", d.name, err)
+		}
+	}
+}
+
+// driverSet is the set of CSI drivers served by the attacher. Drivers given by
+// -csi-address are added at startup, drivers found in -csi-address-dir are
+// added and removed while the attacher runs.
+type driverSet struct {
+	clientset        kubernetes.Interface
+	factory          informers.SharedInformerFactory
+	options          controller.Options
+	setup            func(driver *csiDriver)
+	settings         func(driverName string) attacherconfig.Settings
+	snapshotInterval time.Duration
+
+	lock sync.Mutex
+	// drivers are all added drivers, indexed by address.
+	drivers map[string]*csiDriver
+	// connecting are addresses found in the directory that are being
+	// connected to.
+	connecting map[string]bool
+	stopCh     <-chan struct{}
+	wg         sync.WaitGroup
+	// paused is true in maintenance mode.
+	paused bool
+}
+
+// newDriverSet returns a new driverSet. Controllers of drivers found in the
+// directory get options, setup prepares each added driver before its
+// controller starts, settings returns runtime settings of a driver.
+func newDriverSet(clientset kubernetes.Interface, factory informers.SharedInformerFactory, options controller.Options, setup func(driver *csiDriver), settings func(driverName string) attacherconfig.Settings, snapshotInterval time.Duration) *driverSet {
+	return &driverSet{
+		clientset:        clientset,
+		factory:          factory,
+		options:          options,
+		setup:            setup,
+		settings:         settings,
+		snapshotInterval: snapshotInterval,
+		drivers:          map[string]*csiDriver{},
+		connecting:       map[string]bool{},
+	}
+}
+
+// add adds a connected driver and starts its controller when the set is
+// already running. It fails when the same driver is already served on another
+// address.
+func (s *driverSet) add(driver *csiDriver) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, d := range s.drivers {
+		if d.name == driver.name {
+			return fmt.Errorf("CSI driver %q is served on both %q and %q", driver.name, d.address, driver.address)
+		}
+	}
+	s.setup(driver)
+	s.drivers[driver.address] = driver
+	if s.stopCh != nil {
+		s.start(driver)
+	}
+	return nil
+}
+
+// names returns sorted names of all drivers.
+func (s *driverSet) names() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	names := make([]string, 0, len(s.drivers))
+	for _, d := range s.drivers {
+		names = append(names, d.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ready returns an error when a circuit breaker of any driver pauses CSI
+// calls.
+func (s *driverSet) ready() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, d := range s.drivers {
+		if err := d.ctrl.Ready(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// live returns an error when workers of any driver are stalled.
+func (s *driverSet) live() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, d := range s.drivers {
+		if err := d.ctrl.Live(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// capabilities returns capabilities of the driver with given name.
+func (s *driverSet) capabilities(driverName string) (controller.DriverCapabilities, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, d := range s.drivers {
+		if d.name == driverName {
+			return d.ctrl.Capabilities(), true
+		}
+	}
+	return controller.DriverCapabilities{}, false
+}
+
+// run starts controllers of all drivers. After stopCh is closed, it waits
+// until all controllers finished.
+func (s *driverSet) run(stopCh <-chan struct{}) {
+	s.lock.Lock()
+	s.stopCh = stopCh
+	for _, d := range s.drivers {
+		s.start(d)
+	}
+	s.lock.Unlock()
+
+	<-stopCh
+	s.wg.Wait()
+}
+
+// start runs the controller of a driver in the background. It must be called
+// with s.lock held.
+func (s *driverSet) start(driver *csiDriver) {
+	select {
+	case <-s.stopCh:
+		// The attacher is shutting down.
+		driver.conn.Close()
+		return
+	default:
+	}
+
+	driver.ctrl.SetPaused(s.paused)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-s.stopCh:
+				driver.stop()
+			case <-done:
+			}
+		}()
+		klog.Infof("Starting controller of CSI driver %q at %q", driver.name, driver.address)
+		settings := s.settings(driver.name)
+		klog.V(2).Infof("Settings of CSI driver %q: %+v", driver.name, settings)
+		driver.run(settings, s.snapshotInterval)
+		klog.Infof("Stopped controller of CSI driver %q at %q", driver.name, driver.address)
+		driver.conn.Close()
+	}()
+}
+
+// onSocketAdded connects to a socket found in the directory in the background
+// and adds its driver.
+func (s *driverSet) onSocketAdded(address string) {
+	s.lock.Lock()
+	s.connecting[address] = true
+	s.lock.Unlock()
+
+	go func() {
+		driver, err := connectDriver(address, s.clientset, s.factory, s.options)
+		s.lock.Lock()
+		wanted := s.connecting[address]
+		delete(s.connecting, address)
+		s.lock.Unlock()
+		if err != nil {
+			klog.Errorf("Failed to connect to CSI driver at %q: %v", address, err)
+			return
+		}
+		if !wanted {
+			// The socket disappeared in the meantime.
+			driver.conn.Close()
+			return
+		}
+		if err := s.add(driver); err != nil {
+			klog.Error(err.Error())
+			driver.conn.Close()
+		}
+	}()
+}
+
+// onSocketRemoved stops the controller of a driver whose socket disappeared
+// from the directory.
+func (s *driverSet) onSocketRemoved(address string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.connecting, address)
+	if driver, found := s.drivers[address]; found {
+		klog.Infof("Socket of CSI driver %q at %q disappeared, stopping its controller", driver.name, address)
+		delete(s.drivers, address)
+		driver.stop()
+	}
+}
+
+// applySettings applies changed settings to a running driver.
+func (s *driverSet) applySettings(driverName string, settings attacherconfig.Settings) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, d := range s.drivers {
+		if d.name == driverName {
+			klog.Infof("Applying settings of CSI driver %q: %+v. Change of worker threads is applied when the controller of the driver starts.", driverName, settings)
+			d.apply(settings)
+		}
+	}
+}
+
+// applyAll applies the current settings to all drivers.
+func (s *driverSet) applyAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, d := range s.drivers {
+		d.apply(s.settings(d.name))
+	}
+}
+
+// setPaused pauses or resumes controllers of all drivers.
+func (s *driverSet) setPaused(paused bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.paused = paused
+	for _, d := range s.drivers {
+		d.ctrl.SetPaused(paused)
+	}
+}
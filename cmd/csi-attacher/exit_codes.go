@@ -0,0 +1,36 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// Exit codes of the attacher, documented in README.md. Orchestration and
+// alerting use them to tell a misconfigured attacher from a broken
+// environment, do not renumber them.
+const (
+	// exitError is any other error.
+	exitError = 1
+	// exitConfigError is an invalid command line option or kubeconfig. The
+	// flag package uses the same code for unknown options.
+	exitConfigError = 2
+	// exitKubeAPIError is a failure to reach the Kubernetes API server or
+	// to list the objects the attacher needs.
+	exitKubeAPIError = 3
+	// exitCSIError is a failure to connect to a CSI driver or to get its
+	// name and capabilities.
+	exitCSIError = 4
+	// exitLeaderElectionLost is a loss of the leader election lease.
+	exitLeaderElectionLost = 5
+)
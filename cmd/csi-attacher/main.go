@@ -18,24 +18,50 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/util/workqueue"
+	k8sleaderelection "k8s.io/client-go/tools/leaderelection"
 	"k8s.io/klog"
 
-	"github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/kubernetes-csi/csi-lib-utils/connection"
-	"github.com/kubernetes-csi/csi-lib-utils/leaderelection"
 	"github.com/kubernetes-csi/csi-lib-utils/rpc"
+	"github.com/kubernetes-csi/external-attacher/pkg/admission"
 	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
+	"github.com/kubernetes-csi/external-attacher/pkg/attacherconfig"
 	"github.com/kubernetes-csi/external-attacher/pkg/controller"
+	"github.com/kubernetes-csi/external-attacher/pkg/csiproxy"
+	"github.com/kubernetes-csi/external-attacher/pkg/discovery"
+	"github.com/kubernetes-csi/external-attacher/pkg/fencing"
+	"github.com/kubernetes-csi/external-attacher/pkg/healthz"
+	"github.com/kubernetes-csi/external-attacher/pkg/hooks"
+	"github.com/kubernetes-csi/external-attacher/pkg/leaderelection"
+	"github.com/kubernetes-csi/external-attacher/pkg/logging"
+	"github.com/kubernetes-csi/external-attacher/pkg/metrics"
+	"github.com/kubernetes-csi/external-attacher/pkg/mockcsi"
+	"github.com/kubernetes-csi/external-attacher/pkg/policy"
+	"github.com/kubernetes-csi/external-attacher/pkg/replay"
+	"github.com/kubernetes-csi/external-attacher/pkg/runtimeconfig"
+	"github.com/kubernetes-csi/external-attacher/pkg/servingcert"
+	"github.com/kubernetes-csi/external-attacher/pkg/sharding"
+	"github.com/kubernetes-csi/external-attacher/pkg/watchdog"
 	"google.golang.org/grpc"
 )
 
@@ -44,174 +70,1159 @@ const (
 	// Default timeout of short CSI calls like GetPluginInfo
 	csiTimeout = time.Second
 
+	defaultCSIAddress = "/run/csi/socket"
+	// Environment variable with the default CSI address, as used by other
+	// sidecars.
+	csiEndpointEnv = "CSI_ENDPOINT"
+
+	// Interval of scanning -csi-address-dir for new and removed sockets.
+	socketDirScanPeriod = 5 * time.Second
+
 	leaderElectionTypeLeases     = "leases"
 	leaderElectionTypeConfigMaps = "configmaps"
+	leaderElectionTypeMigrate    = "migrate"
+
+	cacheSyncFailurePolicyExit  = "exit"
+	cacheSyncFailurePolicyRetry = "retry"
 )
 
 // Command line flags
 var (
 	kubeconfig    = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Required only when running out of cluster.")
-	resync        = flag.Duration("resync", 10*time.Minute, "Resync interval of the controller.")
-	csiAddress    = flag.String("csi-address", "/run/csi/socket", "Address of the CSI driver socket.")
+	resync        = flag.Duration("resync", 10*time.Minute, "Resync interval of the controller. 0 disables periodic resync.")
+	csiAddressDir = flag.String("csi-address-dir", "", "Directory with sockets of CSI drivers, e.g. /run/csi. Drivers whose sockets appear in the directory or in its subdirectories are served until their sockets disappear. Can be combined with -csi-address.")
 	showVersion   = flag.Bool("version", false, "Show version.")
 	timeout       = flag.Duration("timeout", 15*time.Second, "Timeout for waiting for attaching or detaching the volume.")
 	workerThreads = flag.Uint("worker-threads", 10, "Number of attacher worker threads")
 
+	maxWorkerThreads    = flag.Uint("max-worker-threads", 0, "Maximum number of VolumeAttachment workers. When it's greater than -worker-threads, workers are scaled between -worker-threads and this number: added while VolumeAttachments wait in the queue and removed when CSI calls get slower than -worker-latency-target or when they are idle. Disabled by default.")
+	workerLatencyTarget = flag.Duration("worker-latency-target", 5*time.Second, "Mean duration of ControllerPublish and ControllerUnpublish calls above which workers scaled by -max-worker-threads are removed.")
+	apiWriters          = flag.Uint("api-writers", 0, "Number of goroutines that save results of ControllerPublish and ControllerUnpublish to the API server, so VolumeAttachment workers make the next CSI call without waiting for the API server. 0 saves the results in the VolumeAttachment workers.")
+
+	workloadKubeconfig = flag.String("workload-kubeconfig", "", "Absolute path to the kubeconfig file of the cluster with VolumeAttachments, PersistentVolumes and Nodes, when it's not the cluster where the attacher runs (e.g. a hosted control plane). Leader election, its state and configuration of the attacher stay in the cluster of -kubeconfig or in-cluster config.")
+	kubeconfigContext  = flag.String("kubeconfig-context", "", "Name of the context in -kubeconfig to use instead of its current context.")
+
+	cacheSyncTimeout       = flag.Duration("cache-sync-timeout", time.Minute, "Timeout of waiting for informer caches to sync at startup. 0 means wait forever.")
+	cacheSyncFailurePolicy = flag.String("cache-sync-failure-policy", cacheSyncFailurePolicyRetry, "What to do when informer caches can't sync in --cache-sync-timeout: \"exit\" or \"retry\" (keep waiting and report not ready).")
+
+	startupAPITimeout = flag.Duration("startup-api-timeout", time.Minute, "How long to retry at startup when the Kubernetes API server or its storage.k8s.io API is not available, while reporting not ready. 0 checks the API only once.")
+
+	safetySweepInterval = flag.Duration("safety-sweep-interval", 0, "Interval of re-queuing VolumeAttachments and PersistentVolumes that are not fully reconciled (not attached, being deleted or with an error). Useful with --resync=0. 0 disables the sweep.")
+
 	retryIntervalStart = flag.Duration("retry-interval-start", time.Second, "Initial retry interval of failed create volume or deletion. It doubles with each failure, up to retry-interval-max.")
 	retryIntervalMax   = flag.Duration("retry-interval-max", 5*time.Minute, "Maximum retry interval of failed create volume or deletion.")
 
-	enableLeaderElection    = flag.Bool("leader-election", false, "Enable leader election.")
-	leaderElectionNamespace = flag.String("leader-election-namespace", "", "Namespace where the leader election resource lives. Defaults to the pod namespace if not set.")
+	csiProxyEndpoint  = flag.String("csi-proxy-endpoint", "", "Address (\"<host>:<port>\") of an authenticated gRPC proxy in front of the CSI controller service. The connection uses TLS. It can be combined with -csi-address and -csi-address-dir.")
+	csiProxyCAFile    = flag.String("csi-proxy-ca-file", "", "CA bundle that verifies the certificate of -csi-proxy-endpoint. System CAs are used when empty.")
+	csiProxyCertFile  = flag.String("csi-proxy-cert-file", "", "Client certificate for mutual TLS with -csi-proxy-endpoint. Read again for each new connection.")
+	csiProxyKeyFile   = flag.String("csi-proxy-key-file", "", "Key of -csi-proxy-cert-file.")
+	csiProxyTokenFile = flag.String("csi-proxy-token-file", "", "File with a bearer token sent to -csi-proxy-endpoint with each call. Read again for each call.")
+
+	csiFailoverTimeout = flag.Duration("csi-failover-timeout", 30*time.Second, "Time for which connecting to the active endpoint of a -csi-address with a backup (<primary>,<backup>) must fail before the attacher switches to the other endpoint.")
+
+	enableAttacherConfig = flag.Bool("attacher-config-crd", false, "Watch CSIAttacherConfig objects with per-driver runtime configuration. Their fields override -timeout, -retry-interval-start, -retry-interval-max and -worker-threads. The CSIAttacherConfig CRD must be installed.")
+
+	runtimeConfigMap = flag.String("runtime-config-configmap", "", "Name of ConfigMap (\"<name>\" in the pod namespace or \"<namespace>/<name>\") with configuration applied without a restart: logLevel, retryIntervalStart, retryIntervalMax, kubeAPIMinWriteQPS, kubeAPIMaxWriteQPS and maintenance.")
+
+	enableLeaderElection        = flag.Bool("leader-election", false, "Enable leader election.")
+	leaderElectionType          = flag.String("leader-election-type", leaderElectionTypeLeases, "The type of leader election lock: \"leases\", \"configmaps\" or \"migrate\" (hold both ConfigMap and Lease locks during migration from configmaps to leases).")
+	leaderElectionIdentity      = flag.String("leader-election-identity", "", "Unique identity of this replica in leader election, -sharding or -volume-attachment-claims. Defaults to POD_NAME environment variable (populated from the Downward API) or to the host name.")
+	leaderElectionLockName      = flag.String("leader-election-lock-name", "", "Name of the leader election lock. Defaults to \"external-attacher-leader-<driver name>\". With -sharding or -volume-attachment-claims, it is the name of the group of replicas that share VolumeAttachments.")
+	leaderElectionNamespace     = flag.String("leader-election-namespace", "", "Namespace where the leader election resource lives. Defaults to the pod namespace if not set.")
+	leaderElectionLeaseDuration = flag.Duration("leader-election-lease-duration", 15*time.Second, "Duration, in seconds, that non-leader candidates will wait to force acquire leadership. Defaults to 15 seconds.")
+	leaderElectionRenewDeadline = flag.Duration("leader-election-renew-deadline", 10*time.Second, "Duration, in seconds, that the acting leader will retry refreshing leadership before giving up. Defaults to 10 seconds.")
+	leaderElectionRetryPeriod   = flag.Duration("leader-election-retry-period", 5*time.Second, "Duration, in seconds, the LeaderElector clients should wait between tries of actions. Defaults to 5 seconds.")
+
+	standbyMetrics = flag.Bool("standby-metrics", false, "With -leader-election, start informers also on replicas that are not the leader, so they export metrics derived from the informer caches (e.g. csi_attacher_volumeattachments). It costs API server watches and memory on standby replicas.")
+
+	warmStandby           = flag.Bool("warm-standby", false, "With -leader-election, fill informer caches on replicas that are not the leader and hand over backoff of failed VolumeAttachments and PersistentVolumes to the next leader using a ConfigMap in -leader-election-namespace.")
+	stateSnapshotInterval = flag.Duration("state-snapshot-interval", 30*time.Second, "With -warm-standby, interval of saving backoff of failed objects for the next leader.")
+
+	enableSharding = flag.Bool("sharding", false, "Enable active-active mode. All replicas process VolumeAttachments, each replica its own subset. Replicas find each other using Lease objects in -leader-election-namespace, -leader-election-lease-duration and -leader-election-retry-period apply. Can't be used together with -leader-election.")
+	enableClaims   = flag.Bool("volume-attachment-claims", false, "Enable active-active mode where any replica processes a VolumeAttachment after it claims it with a short-lived Lease object in -leader-election-namespace. Claims of a crashed replica expire after -leader-election-lease-duration. Can't be used together with -leader-election or -sharding.")
+
+	kubeAPIQPS         = flag.Float64("kube-api-qps", 5, "QPS to use while communicating with the kubernetes apiserver. Defaults to 5.0.")
+	kubeAPIBurst       = flag.Int("kube-api-burst", 10, "Burst to use while communicating with the kubernetes apiserver. Defaults to 10.")
+	kubeAPIMinWriteQPS = flag.Float64("kube-api-min-write-qps", 0.5, "Minimal QPS of writes to the kubernetes apiserver. Writes are slowed down to this rate when the apiserver is unhealthy. Defaults to 0.5.")
+
+	logSamplingThreshold = flag.Int("log-sampling-threshold", 0, "Number of attach and detach errors with the same error class logged per minute before only one of each 100 is logged. 0 disables sampling.")
+	loggingFormat        = flag.String("logging-format", logging.FormatText, "Format of logs: \"text\" (klog) or \"json\" (one JSON object per line with keys ts, level, caller, msg and, when applicable, driver, volumeattachment, pv, node, op, correlationID and durationMs). Logs are written to stderr in both formats.")
+
+	redactPublishContextKeys = flag.String("redact-publish-context-keys", "", "Comma separated list of PublishContext keys whose values are replaced by \"***stripped***\" in ControllerPublish responses logged at -v=5 and in VolumeAttachments recorded by -record-events.")
+	excludeRedactedKeys      = flag.Bool("exclude-redacted-keys", false, "Do not save -redact-publish-context-keys in attachment metadata of VolumeAttachments. Use only for keys that the node plugin does not need, kubelet gets PublishContext only from the attachment metadata.")
+
+	policyWebhookURL           = flag.String("policy-webhook-url", "", "https:// URL of a webhook that decides whether each ControllerPublish and ControllerUnpublish may proceed: \"allow\", \"deny\" or \"defer\". Disabled by default.")
+	policyWebhookCAFile        = flag.String("policy-webhook-ca-file", "", "CA bundle that verifies the certificate of -policy-webhook-url. System CAs are used by default.")
+	policyWebhookCertFile      = flag.String("policy-webhook-cert-file", "", "Client certificate for mutual TLS with -policy-webhook-url. It is read again for each new connection.")
+	policyWebhookKeyFile       = flag.String("policy-webhook-key-file", "", "Private key of -policy-webhook-cert-file.")
+	policyWebhookTimeout       = flag.Duration("policy-webhook-timeout", 10*time.Second, "Timeout of each call of -policy-webhook-url.")
+	policyWebhookFailurePolicy = flag.String("policy-webhook-failure-policy", policy.FailurePolicyFail, "What happens when -policy-webhook-url fails or times out: \"fail\" fails the operation and retries it with exponential backoff, \"ignore\" lets it proceed.")
+
+	allowedSecretNamespaces = flag.String("allowed-secret-namespaces", "", "Comma separated list of namespaces from which controllerPublishSecretRef secrets of PVs are read. Attach and detach of volumes with secrets in other namespaces fail. All namespaces are allowed by default.")
+
+	failureSummaryInterval = flag.Duration("failure-summary-interval", 0, "Interval of logging a summary of failing VolumeAttachments grouped by node and error class. 0 disables the summary.")
+	failureSummaryEvents   = flag.Bool("failure-summary-events", false, "Emit the failure summary also as an event on the CSIDriver object.")
+
+	stuckAttachThreshold     = flag.Duration("stuck-attach-threshold", 0, "Time after which a VolumeAttachment that is not attached and not deleted is reported as stuck by an AttachStuck event and the csi_attacher_stuck_volumeattachments metric. 0 disables the check.")
+	fencingOutOfServiceTaint = flag.Bool("fencing-out-of-service-taint", false, "Detach volumes that are still in use without waiting for -detach-unmount-wait when their Node has taint "+fencing.OutOfServiceTaint+". Requires -detach-unmount-wait.")
+	forceDetachOnUnreadyNode = flag.Duration("force-detach-on-unready-node", 0, "Detach volumes that are still in use without waiting for -detach-unmount-wait when their Node has been NotReady for this time, e.g. after a node crash in clusters without non-graceful node shutdown. Requires -detach-unmount-wait. 0 disables force detach.")
+	volumeTimeoutAnnotations = flag.Bool("volume-timeout-annotations", false, "Honor annotation "+controller.TimeoutAnnotation+" of VolumeAttachments, PersistentVolumes and StorageClasses, which overrides -timeout for ControllerPublish and ControllerUnpublish of their volumes. StorageClasses are watched.")
+	publishParameters        = flag.Bool("publish-parameters", false, "Pass StorageClass parameters with prefix "+controller.PublishParameterPrefix+" to ControllerPublish in volume_context, without the prefix. StorageClasses are watched.")
+	publishAsBlock           = flag.Bool("publish-as-block", false, "Publish volumes with volumeMode Filesystem to ControllerPublish with a block VolumeCapability, without fsType and mount flags, for drivers that attach only block devices. Annotation "+controller.PublishAsBlockAnnotation+" of PersistentVolumes overrides it.")
+	republishInterval        = flag.Duration("republish-interval", 0, "Interval of calling ControllerPublish again for attached volumes, also after the attacher starts. When the driver returns a different PublishContext, the attachment metadata of the VolumeAttachment is updated and an AttachmentMetadataUpdated event is emitted. 0 disables it.")
+	skipUnchangedRepublish   = flag.Bool("skip-unchanged-republish", false, "Skip ControllerPublish of -republish-interval when its inputs except secrets did not change since the last successful call, as recorded in annotation "+controller.PublishInputsHashAnnotation+" of the VolumeAttachment. Requires -republish-interval.")
+	disablePVFinalizer       = flag.Bool("disable-pv-finalizer", false, "Don't add the finalizer of the attacher to PersistentVolumes of attached volumes, for clusters where another component protects PersistentVolumes from deletion. Finalizers added before are still removed after detach.")
+	skipAttachAnnotation     = flag.Bool("skip-attach-annotation", false, "Mark VolumeAttachments with annotation "+controller.SkipAttachAnnotation+"=true, or whose PersistentVolume has it, as attached without calling ControllerPublish, for volumes attached out of band. Their detach does not call ControllerUnpublish.")
+	nodeAttachSoftLimit      = flag.Int("node-attach-soft-limit", 0, "Number of volumes of the driver attached to a node above which each successful attach to the node is reported by a NodeAttachSoftLimitExceeded event and the csi_attacher_node_attach_soft_limit_exceeded_total metric. Attaches over the limit proceed. 0 disables the reports.")
+	repairDrift              = flag.Bool("repair-drift", false, "Mark a VolumeAttachment as detached when ControllerUnpublish fails with NOT_FOUND, i.e. the volume or the node does not exist in the storage backend anymore, and emit a DriftRepaired event. Detach of such volumes is retried forever by default.")
+	slowOperationThreshold   = flag.Duration("slow-operation-threshold", 0, "Duration after which a successful ControllerPublish or ControllerUnpublish call is reported as slow by a SlowAttach or SlowDetach event and the csi_attacher_slow_operations_total metric. 0 disables the reports.")
+
+	circuitBreakerThreshold = flag.Int("circuit-breaker-threshold", 0, "Number of consecutive ControllerPublish and ControllerUnpublish calls failing with UNAVAILABLE, DEADLINE_EXCEEDED, INTERNAL or UNKNOWN after which the calls are paused for -circuit-breaker-cooldown. The attacher is not ready on /readyz while the calls are paused. 0 disables the circuit breaker.")
+	circuitBreakerCooldown  = flag.Duration("circuit-breaker-cooldown", time.Minute, "Time for which the circuit breaker pauses CSI calls. After it, one call probes the driver and the calls resume when it succeeds.")
+
+	workqueueStallTimeout = flag.Duration("workqueue-stall-timeout", 0, "Time after which workers are reported as stalled when objects are queued, but no worker processed any object. Stalled workers fail /livez and stacks of all goroutines are logged. Must be longer than the longest attach or detach. 0 disables the check.")
+
+	lastErrorAnnotation = flag.Bool("last-error-annotation", false, "Save attach and detach errors also as JSON in csi.alpha.kubernetes.io/last-error annotation of VolumeAttachments.")
+	progressAnnotations = flag.Bool("progress-annotations", false, "Save times when a VolumeAttachment was queued, ControllerPublish started and finished and the attached status was saved in csi.alpha.kubernetes.io/queued-at, publish-started-at, publish-finished-at and status-updated-at annotations.")
+
+	pvcEvents   = flag.Bool("pvc-events", false, "Emit events about attach and detach also on PersistentVolumeClaims bound to the volumes, not only on VolumeAttachments.")
+	eventsLevel = flag.String("events-level", string(controller.EventsNormal), "Events to emit: \"none\" (no events, permission to create events is not needed), \"errors-only\" (warnings), \"normal\" (also AttachSucceeded) or \"verbose\" (also AttachStarted).")
+
+	accessModePolicy = flag.String("access-mode-policy", string(controller.AccessModeStrict), "How access modes of PersistentVolumes are translated to the single access mode of ControllerPublish: \"strict\" (PersistentVolumes with both ReadOnlyMany and ReadWriteOnce are rejected) or \"most-permissive\" (they are published as MULTI_NODE_SINGLE_WRITER). ReadWriteMany wins over the other modes with both policies.")
+
+	metricsStorageClasses    = flag.String("metrics-storage-classes", "", "Comma separated list of StorageClasses whose names are used in the storageclass label of metrics. Volumes of other StorageClasses are labeled \"other\". By default, the first -metrics-max-storage-classes StorageClasses seen are used.")
+	metricsMaxStorageClasses = flag.Int("metrics-max-storage-classes", 20, "Number of StorageClasses used in the storageclass label of metrics when -metrics-storage-classes is empty. Volumes of StorageClasses seen later are labeled \"other\".")
+
+	nodeIDSource      = flag.String("node-id-source", string(controller.NodeIDFromCSINode), "Where IDs of nodes in the CSI driver are found: \"csinode\" (CSINode objects and csi.volume.kubernetes.io/nodeid annotation of Nodes, set by kubelet), \"annotation\" (only the annotation of Nodes) or \"file\" (-node-id-mapping-file).")
+	nodeIDMappingFile = flag.String("node-id-mapping-file", "", "JSON file with IDs of nodes in the CSI driver by node name, e.g. {\"node1\": \"id-1\"}. Required with -node-id-source=file. The file is read again when it changes.")
+
+	trivialAttachLatency             = flag.Duration("trivial-attach-latency", 0, "Testing only: mean latency added to each attach of drivers without ControllerPublish.")
+	trivialAttachLatencyDistribution = flag.String("trivial-attach-latency-distribution", controller.LatencyConstant, "Testing only: distribution of -trivial-attach-latency: \"constant\", \"uniform\" (between 0 and twice the mean) or \"exponential\".")
+	trivialAttachErrorRate           = flag.Float64("trivial-attach-error-rate", 0, "Testing only: probability from 0 to 1 that an attach of drivers without ControllerPublish fails.")
+
+	injectCSIErrorRate = flag.Float64("inject-csi-error-rate", 0, "Testing only: probability from 0 to 1 that a ControllerPublish or ControllerUnpublish call fails with Unavailable before it is sent to the CSI driver.")
+	injectCSIDelay     = flag.Duration("inject-csi-delay", 0, "Testing only: delay of each ControllerPublish and ControllerUnpublish call before it is sent to the CSI driver.")
+
+	mockCSI               = flag.Bool("mock-csi", false, "Testing only: serve an in-process mock CSI driver with ControllerPublish instead of connecting to -csi-address.")
+	mockCSIName           = flag.String("mock-csi-name", mockcsi.DefaultName, "Testing only: name of the -mock-csi driver.")
+	mockCSIPublishContext = flag.String("mock-csi-publish-context", "", "Testing only: comma separated key=value pairs returned by ControllerPublish of the -mock-csi driver.")
+	mockCSIReadOnly       = flag.Bool("mock-csi-readonly", false, "Testing only: the -mock-csi driver supports read-only ControllerPublish.")
+	mockCSIRequireSecrets = flag.Bool("mock-csi-require-secrets", false, "Testing only: the -mock-csi driver fails ControllerPublish and ControllerUnpublish without secrets.")
+	mockCSILatency        = flag.Duration("mock-csi-latency", 0, "Testing only: latency of ControllerPublish and ControllerUnpublish of the -mock-csi driver.")
+	mockCSIErrorRate      = flag.Float64("mock-csi-error-rate", 0, "Testing only: probability from 0 to 1 that ControllerPublish or ControllerUnpublish of the -mock-csi driver fails.")
+
+	recordEvents = flag.String("record-events", "", "File to append VolumeAttachment, PersistentVolume, Node and CSINode events observed by the attacher to, for attacher-replay. Recording is disabled by default.")
+
+	dryRun = flag.Bool("dry-run", false, "Log ControllerPublish and ControllerUnpublish requests instead of sending them to the CSI driver and send all Kubernetes API writes with dryRun=All, so no object is changed.")
+
+	preAttachHook  = flag.String("pre-attach-hook", "", "Executable that runs before each ControllerPublish, with the VolumeAttachment context as JSON on stdin and in CSI_ATTACHER_* environment variables. The attach fails when the command fails.")
+	postDetachHook = flag.String("post-detach-hook", "", "Executable that runs after each successful ControllerUnpublish, with the same input as -pre-attach-hook. Its failures are only reported.")
+	hookTimeout    = flag.Duration("hook-timeout", 30*time.Second, "Timeout of -pre-attach-hook and -post-detach-hook commands.")
+
+	detachUnmountWait = flag.Duration("detach-unmount-wait", 0, "Maximum time to wait before ControllerUnpublish until the volume is not in volumesInUse of the Node status, i.e. kubelet unmounted it. The volume is detached anyway after this time or when the VolumeAttachment has annotation "+controller.ForceDetachAnnotation+": \"true\". 0 disables the check.")
+
+	vaLabelSelector = flag.String("va-label-selector", "", "Label selector of VolumeAttachments processed by this attacher, e.g. `rollout=green`. Empty selects all VolumeAttachments.")
+	pvLabelSelector = flag.String("pv-label-selector", "", "Label selector of PersistentVolumes processed by this attacher. VolumeAttachments of other PersistentVolumes are not processed either. Empty selects all PersistentVolumes.")
+
+	watchNodes     = flag.Bool("watch-nodes", true, "Watch Nodes and CSINodes to find IDs of nodes in the CSI drivers. When false, they are got from the API server on each attach and the attacher needs only permission to get them.")
+	readConfigMaps = flag.Bool("read-configmaps", true, "Allow features that read ConfigMaps. When false, -runtime-config-configmap and -warm-standby are ignored and -leader-election-type must be \"leases\", so the attacher needs no permissions for ConfigMaps.")
+
+	prioritizeDrainingNodes = flag.Bool("prioritize-draining-nodes", false, "Detach volumes from nodes that are being drained (cordoned, with a NoExecute taint or with annotation "+controller.DrainingAnnotation+"=true) before processing other VolumeAttachments. Requires -watch-nodes.")
+	prioritizeByState       = flag.Bool("prioritize-by-state", false, "Process VolumeAttachments that are being deleted first, then the ones that are not attached and the attached ones last, instead of in the order they were queued, e.g. after the attacher becomes the leader.")
+
+	rbacCheck = flag.String("rbac-check", rbacCheckWarn, "Check RBAC permissions with SelfSubjectAccessReviews at startup: \"warn\" logs the missing permissions, \"fail\" also exits when a required permission is missing, \"off\" skips the check.")
+
+	watchdogInterval = flag.Duration("watchdog-interval", time.Minute, "Interval of sampling the number of goroutines and the heap size of the attacher, exported by the csi_attacher_goroutines and csi_attacher_heap_alloc_bytes metrics. 0 disables the watchdog.")
+	watchdogWindow   = flag.Duration("watchdog-window", time.Hour, "Time over which the watchdog computes the trend of goroutines and heap size and looks for sustained growth.")
+	watchdogGrowth   = flag.Float64("watchdog-growth", 0.5, "Sustained relative growth of goroutines or heap size in -watchdog-window that is logged as a possible leak, e.g. 0.5 for 50%.")
+
+	crashDumpPath           = flag.String("crash-dump-path", "", "File or directory where a gzip-compressed JSON dump of queues, operations in progress and recent syncs is written when the attacher panics. In a directory, each dump gets a new file. Disabled by default.")
+	crashDumpTerminationLog = flag.Bool("crash-dump-termination-log", false, "Write the crash dump also base64-encoded to "+terminationLogPath+", leaving out recent syncs and the state when it does not fit into 4096 bytes.")
+
+	debugTokenFile = flag.String("debug-token-file", "", "File with a bearer token that enables POST /debug/reconcile on -http-endpoint. The file is read again for each request.")
+
+	httpEndpoint = flag.String("http-endpoint", "", "The TCP network address where the HTTP server for diagnostics, including metrics, will listen (example: `:8080`). The default is empty string, which means the server is disabled.")
+	metricsPath  = flag.String("metrics-path", "/metrics", "The HTTP path where prometheus metrics will be exposed. Default is `/metrics`.")
+
+	channelzAddress = flag.String("channelz-address", "", "The TCP network address where the gRPC channelz service for inspection of connections to CSI drivers with grpcdebug will listen (example: `localhost:9090`). The service has no authentication. Disabled by default.")
+
+	httpTLSCertFile = flag.String("http-tls-cert-file", "", "File with the PEM encoded certificate (chain) of -http-endpoint. When set together with -http-tls-key-file, the endpoint is served over HTTPS and both files are loaded again when they change.")
+	httpTLSKeyFile  = flag.String("http-tls-key-file", "", "File with the PEM encoded private key of -http-tls-cert-file.")
+
+	admissionWebhook = flag.Bool("admission-webhook", false, "Serve a validating admission webhook for VolumeAttachments of the served drivers at path "+admission.Path+" of -http-endpoint, which must be served over HTTPS. It rejects VolumeAttachments with invalid sources, unknown Nodes and read-only volumes of drivers that can't publish them read-only.")
 )
 
 var (
 	version = "unknown"
 )
 
+// csiAddresses are addresses of sockets of all CSI drivers served by the
+// attacher.
+var csiAddresses stringSliceFlag
+
+// attachQuotas are quotas of attached volumes in form
+// <kind>/<name>=<limit>.
+var attachQuotas stringSliceFlag
+
+// fencingResources are custom resources of fencing operators in form
+// <resource>.<group>/<version>=<field path> or well-known names.
+var fencingResources stringSliceFlag
+
+func init() {
+	flag.Var(&csiAddresses, "csi-address", "Address of the CSI driver socket as a path, unix://<path> or tcp://<host>:<port>, e.g. unix:@csi for an abstract socket or tcp://[::1]:9000. Add a backup address of the same driver after a comma (<primary>,<backup>) to fail over to it when the primary fails for -csi-failover-timeout. Repeat the option to serve several CSI drivers by one attacher. Defaults to $"+csiEndpointEnv+" or "+defaultCSIAddress+".")
+	flag.Var(&attachQuotas, "attach-quota", "Maximum number of volumes of a driver attached at the same time, per StorageClass (storageclass/<name>=<limit>) or per namespace of their PVCs (namespace/<name>=<limit>). Attaches over a quota wait until other volumes are detached. Repeat the option for more quotas.")
+	flag.Var(&fencingResources, "fencing-resource", "Custom resource of a fencing or maintenance operator whose objects fence the node named in a field, as <resource>.<group>/<version>=<field path> or \"nodemaintenance\" for the Medik8s NodeMaintenance. Volumes of fenced nodes are detached without waiting for -detach-unmount-wait. Repeat the option for more resources. Requires -detach-unmount-wait.")
+}
+
 type leaderElection interface {
-	Run() error
+	Run(ctx context.Context) error
 	WithNamespace(namespace string)
+	WithIdentity(identity string)
+	WithLeaseDuration(leaseDuration time.Duration)
+	WithRenewDeadline(renewDeadline time.Duration)
+	WithRetryPeriod(retryPeriod time.Duration)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "capabilities" {
+		os.Exit(runCapabilities(os.Args[2:]))
+	}
+
 	klog.InitFlags(nil)
 	flag.Set("logtostderr", "true")
+	flag.Usage = usage
 	flag.Parse()
 
+	switch *loggingFormat {
+	case logging.FormatText:
+	case logging.FormatJSON:
+		// klog writes all lines to the INFO output when it does not log
+		// to stderr.
+		flag.Set("logtostderr", "false")
+		flag.Set("alsologtostderr", "false")
+		flag.Set("stderrthreshold", "FATAL")
+		klog.SetOutputBySeverity("INFO", logging.NewJSONWriter(os.Stderr))
+		for _, severity := range []string{"WARNING", "ERROR", "FATAL"} {
+			klog.SetOutputBySeverity(severity, ioutil.Discard)
+		}
+	default:
+		klog.Errorf("option -logging-format must be %q or %q", logging.FormatText, logging.FormatJSON)
+		os.Exit(exitConfigError)
+	}
+
 	if *showVersion {
 		fmt.Println(os.Args[0], version)
 		return
 	}
 	klog.Infof("Version: %s", version)
 
+	watchdogConfig := watchdog.Config{Interval: *watchdogInterval, Window: *watchdogWindow, Growth: *watchdogGrowth}
+	if *watchdogInterval > 0 {
+		if err := watchdogConfig.Validate(); err != nil {
+			klog.Errorf("invalid watchdog options: %v", err)
+			os.Exit(exitConfigError)
+		}
+	}
+
+	if *crashDumpPath != "" {
+		if info, err := os.Stat(*crashDumpPath); err != nil || !info.IsDir() {
+			if _, err := os.Stat(filepath.Dir(*crashDumpPath)); err != nil {
+				klog.Errorf("invalid option -crash-dump-path: %v", err)
+				os.Exit(exitConfigError)
+			}
+		}
+	}
+
 	// Create the client config. Use kubeconfig if given, otherwise assume in-cluster.
-	config, err := buildConfig(*kubeconfig)
+	if *kubeconfigContext != "" && *kubeconfig == "" {
+		klog.Error("option -kubeconfig-context requires -kubeconfig")
+		os.Exit(exitConfigError)
+	}
+	config, err := buildConfig(*kubeconfig, *kubeconfigContext)
+	if err != nil {
+		klog.Error(err.Error())
+		os.Exit(exitConfigError)
+	}
+
+	config.QPS = (float32)(*kubeAPIQPS)
+	config.Burst = *kubeAPIBurst
+	// Slow down writes of all workers together when the API server is unhealthy.
+	writeLimiter := controller.NewAdaptiveWriteLimiter(*kubeAPIMinWriteQPS, *kubeAPIQPS, *kubeAPIBurst)
+	// VolumeAttachments and objects they refer to are in the workload
+	// cluster. Leader election and configuration of the attacher are in the
+	// cluster where the attacher runs. Both are the same cluster unless
+	// -workload-kubeconfig is set.
+	workloadConfig, err := workloadClientConfig(config, *workloadKubeconfig, writeLimiter)
 	if err != nil {
 		klog.Error(err.Error())
-		os.Exit(1)
+		os.Exit(exitConfigError)
+	}
+	if *dryRun {
+		// The API server validates all writes, but does not persist them.
+		// A dry-run Lease is never saved, so the attacher would always
+		// think it's the leader; leader election is skipped instead.
+		klog.Warning("Dry run: no CSI ControllerPublish / ControllerUnpublish calls are sent and no API objects are changed")
+		workloadConfig.WrapTransport = dryRunWrapper(workloadConfig.WrapTransport)
+		config.WrapTransport = dryRunWrapper(config.WrapTransport)
 	}
 
 	if *workerThreads == 0 {
 		klog.Error("option -worker-threads must be greater than zero")
-		os.Exit(1)
+		os.Exit(exitConfigError)
 	}
 
-	clientset, err := kubernetes.NewForConfig(config)
+	level, err := controller.ParseEventsLevel(*eventsLevel)
 	if err != nil {
-		klog.Error(err.Error())
-		os.Exit(1)
+		klog.Errorf("invalid option -events-level: %v", err)
+		os.Exit(exitConfigError)
+	}
+	modePolicy, err := controller.ParseAccessModePolicy(*accessModePolicy)
+	if err != nil {
+		klog.Errorf("invalid option -access-mode-policy: %v", err)
+		os.Exit(exitConfigError)
+	}
+	idSource, err := controller.ParseNodeIDSource(*nodeIDSource)
+	if err != nil {
+		klog.Errorf("invalid option -node-id-source: %v", err)
+		os.Exit(exitConfigError)
+	}
+	var idMapping *controller.NodeIDMapping
+	if idSource == controller.NodeIDFromFile {
+		if *nodeIDMappingFile == "" {
+			klog.Errorf("option -node-id-source=%s requires -node-id-mapping-file", idSource)
+			os.Exit(exitConfigError)
+		}
+		if idMapping, err = controller.NewNodeIDMapping(*nodeIDMappingFile); err != nil {
+			klog.Errorf("invalid option -node-id-mapping-file: %v", err)
+			os.Exit(exitConfigError)
+		}
+	} else if *nodeIDMappingFile != "" {
+		klog.Errorf("option -node-id-mapping-file requires -node-id-source=%s", controller.NodeIDFromFile)
+		os.Exit(exitConfigError)
+	}
+
+	trivialFaults := controller.Faults{
+		Latency:             *trivialAttachLatency,
+		LatencyDistribution: *trivialAttachLatencyDistribution,
+		ErrorRate:           *trivialAttachErrorRate,
+	}
+	if err := trivialFaults.Validate(); err != nil {
+		klog.Errorf("invalid options -trivial-attach-*: %v", err)
+		os.Exit(exitConfigError)
+	}
+
+	csiFaults := controller.Faults{
+		Latency:   *injectCSIDelay,
+		ErrorRate: *injectCSIErrorRate,
+	}
+	if err := csiFaults.Validate(); err != nil {
+		klog.Errorf("invalid options -inject-csi-*: %v", err)
+		os.Exit(exitConfigError)
+	}
+	if csiFaults.Enabled() {
+		klog.Warningf("Injecting faults into CSI calls: delay %s, error rate %v", csiFaults.Latency, csiFaults.ErrorRate)
+	}
+
+	var redactedKeys []string
+	if *redactPublishContextKeys != "" {
+		redactedKeys = strings.Split(*redactPublishContextKeys, ",")
+	}
+	var secretNamespaces []string
+	if *allowedSecretNamespaces != "" {
+		secretNamespaces = strings.Split(*allowedSecretNamespaces, ",")
+	}
+	if *metricsMaxStorageClasses < 0 {
+		klog.Errorf("invalid option -metrics-max-storage-classes: %d is negative", *metricsMaxStorageClasses)
+		os.Exit(exitConfigError)
+	}
+	var metricsClasses []string
+	if *metricsStorageClasses != "" {
+		metricsClasses = strings.Split(*metricsStorageClasses, ",")
+	}
+	storageClassLabels := controller.NewStorageClassLabels(metricsClasses, *metricsMaxStorageClasses)
+
+	if *cacheSyncFailurePolicy != cacheSyncFailurePolicyExit && *cacheSyncFailurePolicy != cacheSyncFailurePolicyRetry {
+		klog.Errorf("option -cache-sync-failure-policy must be %q or %q", cacheSyncFailurePolicyExit, cacheSyncFailurePolicyRetry)
+		os.Exit(exitConfigError)
+	}
+
+	haModes := 0
+	for _, enabled := range []bool{*enableLeaderElection, *enableSharding, *enableClaims} {
+		if enabled {
+			haModes++
+		}
+	}
+	if haModes > 1 {
+		klog.Error("only one of options -leader-election, -sharding and -volume-attachment-claims can be used")
+		os.Exit(exitConfigError)
+	}
+	if *enableSharding || *enableClaims {
+		if err := validateLeaderElectionTiming(*leaderElectionLeaseDuration, *leaderElectionRenewDeadline, *leaderElectionRetryPeriod); err != nil {
+			klog.Error(err.Error())
+			os.Exit(exitConfigError)
+		}
+	}
+	switch *rbacCheck {
+	case rbacCheckOff, rbacCheckWarn, rbacCheckFail:
+	default:
+		klog.Errorf("option -rbac-check must be %q, %q or %q", rbacCheckOff, rbacCheckWarn, rbacCheckFail)
+		os.Exit(exitConfigError)
+	}
+	if !*readConfigMaps {
+		if *enableLeaderElection && *leaderElectionType != leaderElectionTypeLeases {
+			klog.Errorf("option -leader-election-type must be %q with -read-configmaps=false", leaderElectionTypeLeases)
+			os.Exit(exitConfigError)
+		}
+		if *warmStandby {
+			klog.Warning("Ignoring option -warm-standby with -read-configmaps=false, backoff of failed objects is not handed over to the next leader")
+			*warmStandby = false
+		}
+		if *runtimeConfigMap != "" {
+			klog.Warning("Ignoring option -runtime-config-configmap with -read-configmaps=false, configuration from the command line is used")
+			*runtimeConfigMap = ""
+		}
+	}
+	if *enableLeaderElection {
+		switch *leaderElectionType {
+		case leaderElectionTypeLeases, leaderElectionTypeConfigMaps, leaderElectionTypeMigrate:
+		default:
+			klog.Errorf("option -leader-election-type must be %q, %q or %q", leaderElectionTypeLeases, leaderElectionTypeConfigMaps, leaderElectionTypeMigrate)
+			os.Exit(exitConfigError)
+		}
+		if err := validateLeaderElectionTiming(*leaderElectionLeaseDuration, *leaderElectionRenewDeadline, *leaderElectionRetryPeriod); err != nil {
+			klog.Error(err.Error())
+			os.Exit(exitConfigError)
+		}
 	}
 
-	factory := informers.NewSharedInformerFactory(clientset, *resync)
-	var handler controller.Handler
-	// Connect to CSI.
-	csiConn, err := connection.Connect(*csiAddress)
+	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		klog.Error(err.Error())
-		os.Exit(1)
+		os.Exit(exitConfigError)
 	}
-
-	err = rpc.ProbeForever(csiConn, *timeout)
+	workloadClientset, err := kubernetes.NewForConfig(workloadConfig)
 	if err != nil {
 		klog.Error(err.Error())
-		os.Exit(1)
+		os.Exit(exitConfigError)
+	}
+	if *workloadKubeconfig != "" {
+		klog.Infof("Processing VolumeAttachments in workload cluster %s", workloadConfig.Host)
 	}
 
-	// Find driver name.
-	ctx, cancel := context.WithTimeout(context.Background(), csiTimeout)
-	defer cancel()
-	csiAttacher, err := rpc.GetDriverName(ctx, csiConn)
-	if err != nil {
+	if *watchdogInterval > 0 {
+		go watchdog.New(watchdogConfig).Run(wait.NeverStop)
+	}
+
+	if (*httpTLSCertFile == "") != (*httpTLSKeyFile == "") {
+		klog.Error("options -http-tls-cert-file and -http-tls-key-file must be used together")
+		os.Exit(exitConfigError)
+	}
+	if *admissionWebhook && *httpTLSCertFile == "" {
+		klog.Error("option -admission-webhook requires -http-tls-cert-file and -http-tls-key-file")
+		os.Exit(exitConfigError)
+	}
+	var certReloader *servingcert.Reloader
+	if *httpTLSCertFile != "" {
+		if *httpEndpoint == "" {
+			klog.Error("option -http-tls-cert-file requires -http-endpoint")
+			os.Exit(exitConfigError)
+		}
+		certReloader, err = servingcert.NewReloader(*httpTLSCertFile, *httpTLSKeyFile)
+		if err != nil {
+			klog.Error(err.Error())
+			os.Exit(exitConfigError)
+		}
+	}
+
+	readyz := healthz.NewHandler()
+	livez := healthz.NewHandler()
+	var mux *http.ServeMux
+	if *httpEndpoint != "" {
+		mux = http.NewServeMux()
+		mux.Handle(*metricsPath, metrics.Handler())
+		mux.Handle("/readyz", readyz)
+		mux.Handle("/livez", livez)
+		server := &http.Server{Addr: *httpEndpoint, Handler: mux}
+		go func() {
+			var err error
+			if certReloader != nil {
+				klog.Infof("ServeMux listening at %q with TLS", *httpEndpoint)
+				server.TLSConfig = certReloader.TLSConfig()
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				klog.Infof("ServeMux listening at %q", *httpEndpoint)
+				err = server.ListenAndServe()
+			}
+			if err != nil {
+				klog.Fatalf("Failed to start HTTP server at specified address (%q) and metrics path (%q): %s", *httpEndpoint, *metricsPath, err)
+			}
+		}()
+	}
+	if *channelzAddress != "" {
+		if err := serveChannelz(*channelzAddress); err != nil {
+			klog.Errorf("Failed to start channelz at %q: %s", *channelzAddress, err)
+			os.Exit(exitConfigError)
+		}
+	}
+
+	// The API server may be briefly unavailable right after the control
+	// plane starts.
+	readyz.AddCheck("kube-api", func() error {
+		return errors.New("waiting for the Kubernetes API server")
+	})
+	if err := controller.WaitForAPI(workloadClientset.Discovery(), *startupAPITimeout, nil); err != nil {
 		klog.Error(err.Error())
-		os.Exit(1)
+		os.Exit(exitKubeAPIError)
+	}
+	readyz.RemoveCheck("kube-api")
+
+	factory := informers.NewSharedInformerFactory(workloadClientset, *resync)
+	informersSynced := map[string]cache.InformerSynced{
+		"VolumeAttachment": factory.Storage().V1beta1().VolumeAttachments().Informer().HasSynced,
+		"PersistentVolume": factory.Core().V1().PersistentVolumes().Informer().HasSynced,
+	}
+	if *recordEvents != "" {
+		// The file is closed when the process exits.
+		file, err := os.OpenFile(*recordEvents, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			klog.Errorf("failed to open -record-events file: %v", err)
+			os.Exit(exitConfigError)
+		}
+		replay.NewRecorder(file, redactedKeys).Register(factory)
+		informersSynced["Node"] = factory.Core().V1().Nodes().Informer().HasSynced
+		informersSynced["CSINode"] = factory.Storage().V1beta1().CSINodes().Informer().HasSynced
+		klog.Infof("Recording events to %s", *recordEvents)
+	}
+	if *mockCSI {
+		if len(csiAddresses) > 0 || *csiAddressDir != "" || *csiProxyEndpoint != "" {
+			klog.Error("option -mock-csi can't be used with -csi-address, -csi-address-dir or -csi-proxy-endpoint")
+			os.Exit(exitConfigError)
+		}
+		address, err := startMockCSI()
+		if err != nil {
+			klog.Error(err.Error())
+			os.Exit(exitCSIError)
+		}
+		csiAddresses = stringSliceFlag{address}
+	}
+	if len(csiAddresses) == 0 && *csiAddressDir == "" && *csiProxyEndpoint == "" {
+		csiAddresses = stringSliceFlag{csiEndpoint()}
+	}
+	for _, address := range csiAddresses {
+		endpoints := strings.Split(address, ",")
+		if len(endpoints) > 2 {
+			klog.Errorf("option -csi-address: %q has more than one backup address", address)
+			os.Exit(exitConfigError)
+		}
+		for _, endpoint := range endpoints {
+			if _, _, err := attacher.ParseEndpoint(endpoint); err != nil {
+				klog.Errorf("option -csi-address: %v", err)
+				os.Exit(exitConfigError)
+			}
+		}
+	}
+	if *csiFailoverTimeout <= 0 {
+		klog.Error("option -csi-failover-timeout must be positive")
+		os.Exit(exitConfigError)
+	}
+	var csiConns []*grpc.ClientConn
+	// failovers of csiConns, nil for drivers without a backup address.
+	var failovers []*attacher.Failover
+	for _, address := range csiAddresses {
+		var csiConn *grpc.ClientConn
+		var failover *attacher.Failover
+		var err error
+		if endpoints := strings.Split(address, ","); len(endpoints) == 2 {
+			csiConn, failover, err = connectFailover(endpoints[0], endpoints[1], *csiFailoverTimeout, redactedKeys, *timeout)
+		} else {
+			csiConn, err = connectCSI(address, redactedKeys, *timeout)
+		}
+		if err != nil {
+			klog.Error(err.Error())
+			os.Exit(exitCSIError)
+		}
+		csiConns = append(csiConns, csiConn)
+		failovers = append(failovers, failover)
+	}
+	if *csiProxyEndpoint != "" {
+		csiConn, err := connectProxy(*csiProxyEndpoint, csiproxy.Options{
+			CAFile:    *csiProxyCAFile,
+			CertFile:  *csiProxyCertFile,
+			KeyFile:   *csiProxyKeyFile,
+			TokenFile: *csiProxyTokenFile,
+
+			RedactPublishContextKeys: redactedKeys,
+		}, *timeout)
+		if err != nil {
+			klog.Error(err.Error())
+			os.Exit(exitCSIError)
+		}
+		csiAddresses = append(csiAddresses, *csiProxyEndpoint)
+		csiConns = append(csiConns, csiConn)
+		failovers = append(failovers, nil)
+	}
+	if *csiAddressDir != "" {
+		// Drivers found later may need the CSI handler, its informers must
+		// be started with the others.
+		if *watchNodes {
+			informersSynced["Node"] = factory.Core().V1().Nodes().Informer().HasSynced
+			informersSynced["CSINode"] = factory.Storage().V1beta1().CSINodes().Informer().HasSynced
+		}
+		if *volumeTimeoutAnnotations || *publishParameters {
+			informersSynced["StorageClass"] = factory.Storage().V1().StorageClasses().Informer().HasSynced
+		}
+		informersSynced["CSIDriver"] = factory.Storage().V1beta1().CSIDrivers().Informer().HasSynced
+	}
+	// The first driver names the locks shared by replicas of the attacher.
+	var csiAttacher string
+	if len(csiConns) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), csiTimeout)
+		csiAttacher, err = rpc.GetDriverName(ctx, csiConns[0])
+		cancel()
+		if err != nil {
+			klog.Errorf("failed to get name of CSI driver at %q: %v", csiAddresses[0], err)
+			os.Exit(exitCSIError)
+		}
+	} else if haModes > 0 && *leaderElectionLockName == "" {
+		klog.Error("option -leader-election-lock-name is required when -csi-address-dir is used without -csi-address together with -leader-election, -sharding or -volume-attachment-claims")
+		os.Exit(exitConfigError)
+	}
+
+	// shard is the controller.Shard used in active-active modes, it must run
+	// for the whole lifetime of the controller.
+	var shard interface {
+		controller.Shard
+		Run(ctx context.Context)
+	}
+	if *enableSharding || *enableClaims {
+		identity, err := getIdentity(*leaderElectionIdentity)
+		if err != nil {
+			klog.Error(err.Error())
+			os.Exit(exitError)
+		}
+		namespace := *leaderElectionNamespace
+		if namespace == "" {
+			namespace = leaderelection.InClusterNamespace()
+		}
+		if *enableSharding {
+			shard = sharding.NewMembership(clientset, namespace, getLockName(*leaderElectionLockName, "external-attacher-shard-", csiAttacher), identity, *leaderElectionLeaseDuration, *leaderElectionRetryPeriod)
+		} else {
+			// Keep claims of VolumeAttachments for the whole attach / detach
+			// and some time after.
+			idleTimeout := *timeout + *leaderElectionLeaseDuration
+			shard = sharding.NewClaims(clientset, namespace, getLockName(*leaderElectionLockName, "external-attacher-claim-", csiAttacher), identity, *leaderElectionLeaseDuration, *leaderElectionRetryPeriod, idleTimeout)
+		}
+	}
+
+	var policyChecker policy.Checker
+	if *policyWebhookURL != "" {
+		client, err := policy.NewClient(policy.Options{
+			URL:           *policyWebhookURL,
+			CAFile:        *policyWebhookCAFile,
+			CertFile:      *policyWebhookCertFile,
+			KeyFile:       *policyWebhookKeyFile,
+			Timeout:       *policyWebhookTimeout,
+			FailurePolicy: *policyWebhookFailurePolicy,
+		})
+		if err != nil {
+			klog.Error(err.Error())
+			os.Exit(exitConfigError)
+		}
+		policyChecker = client
+		klog.Infof("Checking attach and detach with policy webhook %s", *policyWebhookURL)
 	}
-	klog.V(2).Infof("CSI driver name: %q", csiAttacher)
 
-	supportsService, err := supportsPluginControllerService(ctx, csiConn)
+	var hookRunner hooks.Runner
+	commands := &hooks.Commands{PreAttach: *preAttachHook, PostDetach: *postDetachHook, Timeout: *hookTimeout}
+	if !commands.IsEmpty() {
+		if err := commands.Validate(); err != nil {
+			klog.Error(err.Error())
+			os.Exit(exitConfigError)
+		}
+		hookRunner = commands
+	}
+
+	quotas, err := controller.ParseAttachQuotas(attachQuotas)
 	if err != nil {
 		klog.Error(err.Error())
-		os.Exit(1)
+		os.Exit(exitConfigError)
 	}
-	if !supportsService {
-		handler = controller.NewTrivialHandler(clientset)
-		klog.V(2).Infof("CSI driver does not support Plugin Controller Service, using trivial handler")
-	} else {
-		// Find out if the driver supports attach/detach.
-		supportsAttach, supportsReadOnly, err := supportsControllerPublish(ctx, csiConn)
+	var vaSelector, pvSelector labels.Selector
+	if *vaLabelSelector != "" {
+		if vaSelector, err = labels.Parse(*vaLabelSelector); err != nil {
+			klog.Errorf("invalid option -va-label-selector: %v", err)
+			os.Exit(exitConfigError)
+		}
+		klog.Infof("Processing only VolumeAttachments with labels %s", vaSelector)
+	}
+	if *pvLabelSelector != "" {
+		if pvSelector, err = labels.Parse(*pvLabelSelector); err != nil {
+			klog.Errorf("invalid option -pv-label-selector: %v", err)
+			os.Exit(exitConfigError)
+		}
+		klog.Infof("Processing only PersistentVolumes with labels %s", pvSelector)
+	}
+	var resources []fencing.Resource
+	for _, value := range fencingResources {
+		resource, err := fencing.ParseResource(value)
 		if err != nil {
-			klog.Error(err.Error())
-			os.Exit(1)
-		}
-		if supportsAttach {
-			pvLister := factory.Core().V1().PersistentVolumes().Lister()
-			nodeLister := factory.Core().V1().Nodes().Lister()
-			vaLister := factory.Storage().V1beta1().VolumeAttachments().Lister()
-			csiNodeLister := factory.Storage().V1beta1().CSINodes().Lister()
-			attacher := attacher.NewAttacher(csiConn)
-			handler = controller.NewCSIHandler(clientset, csiAttacher, attacher, pvLister, nodeLister, csiNodeLister, vaLister, timeout, supportsReadOnly)
-			klog.V(2).Infof("CSI driver supports ControllerPublishUnpublish, using real CSI handler")
+			klog.Errorf("invalid option -fencing-resource: %v", err)
+			os.Exit(exitConfigError)
+		}
+		resources = append(resources, resource)
+	}
+	var fencingWatcher *fencing.Watcher
+	var fencingChecker fencing.Checker
+	if *fencingOutOfServiceTaint || len(resources) > 0 {
+		fencingWatcher = fencing.NewWatcher(*fencingOutOfServiceTaint)
+		for _, resource := range resources {
+			// Fencing objects refer to nodes of the workload cluster.
+			lw, err := fencing.NewListWatch(workloadConfig, resource)
+			if err != nil {
+				klog.Error(err.Error())
+				os.Exit(exitConfigError)
+			}
+			fencingWatcher.AddResource(resource, lw, *resync)
+		}
+		informersSynced["Fencing"] = fencingWatcher.HasSynced
+		fencingChecker = fencingWatcher
+	}
+
+	// Each driver has its own controller with its own queues, all of them
+	// share the informers.
+	driverOptions := controller.Options{
+		Timeout:             *timeout,
+		RetryIntervalStart:  *retryIntervalStart,
+		RetryIntervalMax:    *retryIntervalMax,
+		WorkerThreads:       int(*workerThreads),
+		SafetySweepInterval: *safetySweepInterval,
+		Shard:               shard,
+		VASelector:          vaSelector,
+		PVSelector:          pvSelector,
+		PVCEvents:           *pvcEvents,
+		EventsLevel:         level,
+		OnDemandNodes:       !*watchNodes,
+
+		RedactPublishContextKeys: redactedKeys,
+		ExcludeRedactedKeys:      *excludeRedactedKeys,
+		Policy:                   policyChecker,
+		AttachQuotas:             quotas,
+		VolumeTimeoutAnnotations: *volumeTimeoutAnnotations,
+		PublishParameters:        *publishParameters,
+		PublishAsBlock:           *publishAsBlock,
+		AccessModePolicy:         modePolicy,
+		RepublishInterval:        *republishInterval,
+		SkipUnchangedRepublish:   *skipUnchangedRepublish,
+		SkipAttachAnnotation:     *skipAttachAnnotation,
+		DisablePVFinalizer:       *disablePVFinalizer,
+		NodeIDSource:             idSource,
+		NodeIDMapping:            idMapping,
+		NodeAttachSoftLimit:      *nodeAttachSoftLimit,
+		PrioritizeDrainingNodes:  *prioritizeDrainingNodes,
+		PrioritizeByState:        *prioritizeByState,
+		Hooks:                    hookRunner,
+		DetachUnmountWait:        *detachUnmountWait,
+		ForceDetachOnUnreadyNode: *forceDetachOnUnreadyNode,
+		Fencing:                  fencingChecker,
+		RepairDrift:              *repairDrift,
+		CircuitBreakerThreshold:  *circuitBreakerThreshold,
+		MaxWorkerThreads:         int(*maxWorkerThreads),
+		WorkerLatencyTarget:      *workerLatencyTarget,
+		APIWriters:               int(*apiWriters),
+		CircuitBreakerCooldown:   *circuitBreakerCooldown,
+		StallThreshold:           *workqueueStallTimeout,
+		AllowedSecretNamespaces:  secretNamespaces,
+		FailureSummaryInterval:   *failureSummaryInterval,
+		FailureSummaryEvents:     *failureSummaryEvents,
+		LogSamplingThreshold:     *logSamplingThreshold,
+		StuckAttachThreshold:     *stuckAttachThreshold,
+		SlowOperationThreshold:   *slowOperationThreshold,
+		StorageClassLabels:       storageClassLabels,
+		LastErrorAnnotation:      *lastErrorAnnotation,
+		ProgressAnnotations:      *progressAnnotations,
+		TrivialHandlerFaults:     trivialFaults,
+		CSIFaults:                csiFaults,
+		DryRun:                   *dryRun,
+	}
+	if err := driverOptions.Validate(); err != nil {
+		klog.Errorf("invalid options: %v", err)
+		os.Exit(exitConfigError)
+	}
+	if *rbacCheck != rbacCheckOff {
+		leaseNamespace := *leaderElectionNamespace
+		if leaseNamespace == "" {
+			leaseNamespace = leaderelection.InClusterNamespace()
+		}
+		runtimeConfigNamespace, _, _ := cache.SplitMetaNamespaceKey(*runtimeConfigMap)
+		if runtimeConfigNamespace == "" {
+			runtimeConfigNamespace = leaderelection.InClusterNamespace()
+		}
+		workloadPermissions := append(controller.RequiredPermissions(driverOptions), fencingPermissions(resources)...)
+		permissions := configPermissions(leaseNamespace, runtimeConfigNamespace)
+		var ok bool
+		if *workloadKubeconfig != "" {
+			ok = checkPermissions(workloadClientset, " in the workload cluster", workloadPermissions)
+			ok = checkPermissions(clientset, " in the cluster of -kubeconfig", permissions) && ok
 		} else {
-			handler = controller.NewTrivialHandler(clientset)
-			klog.V(2).Infof("CSI driver does not support ControllerPublishUnpublish, using trivial handler")
+			ok = checkPermissions(clientset, "", append(workloadPermissions, permissions...))
+		}
+		if !ok && *rbacCheck == rbacCheckFail {
+			os.Exit(exitKubeAPIError)
+		}
+	}
+	var staticDrivers []*csiDriver
+	for i, csiConn := range csiConns {
+		driver, err := newCSIDriver(csiAddresses[i], csiConn, workloadClientset, factory, driverOptions)
+		if err != nil {
+			klog.Error(err.Error())
+			os.Exit(exitCSIError)
+		}
+		if failovers[i] != nil {
+			failovers[i].OnSwitch(driver.ctrl.EndpointSwitched)
+		}
+		staticDrivers = append(staticDrivers, driver)
+		for kind, hasSynced := range driver.ctrl.InformersSynced() {
+			informersSynced[kind] = hasSynced
+		}
+	}
+	perDriverState := len(staticDrivers) > 1 || *csiAddressDir != ""
+	setupDriver := func(driver *csiDriver) {
+		if *enableLeaderElection && *warmStandby {
+			namespace := *leaderElectionNamespace
+			if namespace == "" {
+				namespace = leaderelection.InClusterNamespace()
+			}
+			name := getLockName(*leaderElectionLockName, "external-attacher-leader-", csiAttacher)
+			if perDriverState {
+				name += "-" + driver.name
+			}
+			vaRateLimiter, pvRateLimiter := driver.ctrl.RateLimiters()
+			driver.handover = controller.NewStateHandover(clientset, namespace, name+"-state", vaRateLimiter, pvRateLimiter)
+		}
+	}
+	defaultSettings := attacherconfig.Settings{
+		Timeout:            *timeout,
+		RetryIntervalStart: *retryIntervalStart,
+		RetryIntervalMax:   *retryIntervalMax,
+		WorkerThreads:      int(*workerThreads),
+	}
+	var configWatcher *attacherconfig.Watcher
+	if *enableAttacherConfig {
+		configClient, err := attacherconfig.NewRESTClient(config)
+		if err != nil {
+			klog.Error(err.Error())
+			os.Exit(exitConfigError)
+		}
+		configWatcher = attacherconfig.NewWatcher(attacherconfig.NewListWatch(configClient), *resync, defaultSettings)
+		informersSynced["CSIAttacherConfig"] = configWatcher.HasSynced
+	}
+	settings := newRuntimeSettings(defaultSettings, *kubeAPIMinWriteQPS, *kubeAPIQPS, writeLimiter, configWatcher)
+	drivers := newDriverSet(workloadClientset, factory, driverOptions, setupDriver, settings.get, *stateSnapshotInterval)
+	settings.drivers = drivers
+	if *circuitBreakerThreshold > 0 {
+		readyz.AddCheck("csi-circuit-breaker", drivers.ready)
+	}
+	if *workqueueStallTimeout > 0 {
+		livez.AddCheck("workqueue-stall", drivers.live)
+	}
+	if *crashDumpPath != "" || *crashDumpTerminationLog {
+		dumper := &crashDumper{path: *crashDumpPath, terminationLog: *crashDumpTerminationLog, state: drivers.state}
+		utilruntime.PanicHandlers = append(utilruntime.PanicHandlers, dumper.handlePanic)
+		// Workers and informers run utilruntime.HandleCrash, this covers
+		// panics of the main goroutine.
+		defer utilruntime.HandleCrash()
+	}
+	if mux != nil {
+		mux.HandleFunc("/debug/attacher", drivers.serveDebug)
+		if *debugTokenFile != "" {
+			mux.HandleFunc("/debug/reconcile", drivers.reconcileHandler(*debugTokenFile))
+		}
+		if *admissionWebhook {
+			// VolumeAttachments are in the workload cluster, its API
+			// server calls the webhook.
+			mux.Handle(admission.Path, admission.NewValidator(workloadClientset, drivers.capabilities, modePolicy))
+		}
+	}
+	if configWatcher != nil {
+		configWatcher.OnChange(drivers.applySettings)
+	}
+	var runtimeConfigWatcher *runtimeconfig.Watcher
+	if *runtimeConfigMap != "" {
+		namespace, name, err := cache.SplitMetaNamespaceKey(*runtimeConfigMap)
+		if err != nil {
+			klog.Errorf("invalid option -runtime-config-configmap: %v", err)
+			os.Exit(exitConfigError)
+		}
+		if namespace == "" {
+			namespace = leaderelection.InClusterNamespace()
+		}
+		runtimeConfigWatcher = runtimeconfig.NewWatcher(clientset, namespace, name, *resync)
+		runtimeConfigWatcher.OnChange(settings.apply)
+		informersSynced["RuntimeConfigMap"] = runtimeConfigWatcher.HasSynced
+	}
+	for _, driver := range staticDrivers {
+		if err := drivers.add(driver); err != nil {
+			klog.Error(err.Error())
+			os.Exit(exitConfigError)
 		}
 	}
 
-	ctrl := controller.NewCSIAttachController(
-		clientset,
-		csiAttacher,
-		handler,
-		factory.Storage().V1beta1().VolumeAttachments(),
-		factory.Core().V1().PersistentVolumes(),
-		workqueue.NewItemExponentialFailureRateLimiter(*retryIntervalStart, *retryIntervalMax),
-		workqueue.NewItemExponentialFailureRateLimiter(*retryIntervalStart, *retryIntervalMax),
-	)
+	metrics.MustRegister(controller.NewVolumeAttachmentStateMetric(drivers.names, factory.Storage().V1beta1().VolumeAttachments(), factory.Core().V1().PersistentVolumes().Lister(), storageClassLabels))
 
 	run := func(ctx context.Context) {
 		stopCh := ctx.Done()
 		factory.Start(stopCh)
-		ctrl.Run(int(*workerThreads), stopCh)
+		if configWatcher != nil {
+			go configWatcher.Run(stopCh)
+		}
+		if fencingWatcher != nil {
+			go fencingWatcher.Run(stopCh)
+		}
+		if !waitForCacheSync(informersSynced, readyz, stopCh) {
+			return
+		}
+		socketDirDone := make(chan struct{})
+		if *csiAddressDir != "" {
+			socketDir := discovery.NewSocketDir(*csiAddressDir, socketDirScanPeriod, drivers.onSocketAdded, drivers.onSocketRemoved)
+			go func() {
+				socketDir.Run(stopCh)
+				close(socketDirDone)
+			}()
+		} else {
+			close(socketDirDone)
+		}
+		drivers.run(stopCh)
+		<-socketDirDone
 	}
 
-	if !*enableLeaderElection {
-		run(context.TODO())
+	// Finish operations in progress and release leadership on SIGTERM, so a
+	// standby replica takes over immediately.
+	runCtx, shutdown := context.WithCancel(context.Background())
+	if runtimeConfigWatcher != nil {
+		// Apply the configuration also on replicas that are not the leader.
+		go runtimeConfigWatcher.Run(runCtx.Done())
+	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigCh
+		klog.Infof("Received %s, shutting down", sig)
+		shutdown()
+	}()
+
+	if shard != nil {
+		shardCtx, stopShard := context.WithCancel(context.Background())
+		shardDone := make(chan struct{})
+		go func() {
+			shard.Run(shardCtx)
+			close(shardDone)
+		}()
+		run(runCtx)
+		// Hand over objects to other replicas after operations in progress
+		// finished.
+		stopShard()
+		<-shardDone
+	} else if !*enableLeaderElection {
+		run(runCtx)
+	} else if *dryRun {
+		klog.Info("Dry run: skipping leader election, running alongside the leader")
+		run(runCtx)
 	} else {
 		// Name of config map with leader election lock
-		lockName := "external-attacher-leader-" + csiAttacher
-		le := leaderelection.NewLeaderElection(clientset, lockName, run)
+		lockName := getLockName(*leaderElectionLockName, "external-attacher-leader-", csiAttacher)
+		var le leaderElection
+		switch *leaderElectionType {
+		case leaderElectionTypeConfigMaps:
+			le = leaderelection.NewLeaderElectionWithConfigMaps(clientset, lockName, run)
+		case leaderElectionTypeMigrate:
+			le = leaderelection.NewLeaderElectionWithConfigMapsAndLeases(clientset, lockName, run)
+		default:
+			le = leaderelection.NewLeaderElection(clientset, lockName, run)
+		}
 
 		if *leaderElectionNamespace != "" {
 			le.WithNamespace(*leaderElectionNamespace)
 		}
+		identity, err := getIdentity(*leaderElectionIdentity)
+		if err != nil {
+			klog.Error(err.Error())
+			os.Exit(exitError)
+		}
+		klog.Infof("Leader election identity: %s", identity)
+		le.WithIdentity(identity)
+		le.WithLeaseDuration(*leaderElectionLeaseDuration)
+		le.WithRenewDeadline(*leaderElectionRenewDeadline)
+		le.WithRetryPeriod(*leaderElectionRetryPeriod)
 
-		if err := le.Run(); err != nil {
-			klog.Fatalf("failed to initialize leader election: %v", err)
+		if *standbyMetrics || *warmStandby {
+			// Fill the informer caches while waiting for the leadership.
+			factory.Start(runCtx.Done())
+		}
+
+		if err := le.Run(runCtx); err != nil {
+			klog.Errorf("leader election failed: %v", err)
+			if err == leaderelection.ErrLeadershipLost {
+				os.Exit(exitLeaderElectionLost)
+			}
+			os.Exit(exitError)
 		}
 	}
 }
 
-func buildConfig(kubeconfig string) (*rest.Config, error) {
-	if kubeconfig != "" {
-		return clientcmd.BuildConfigFromFlags("", kubeconfig)
+// csiEndpoint returns the default address of the CSI driver: $CSI_ENDPOINT
+// or the default socket.
+func csiEndpoint() string {
+	if endpoint := os.Getenv(csiEndpointEnv); endpoint != "" {
+		return endpoint
 	}
-	return rest.InClusterConfig()
+	return defaultCSIAddress
 }
 
-func supportsControllerPublish(ctx context.Context, csiConn *grpc.ClientConn) (supportsControllerPublish bool, supportsPublishReadOnly bool, err error) {
-	caps, err := rpc.GetControllerCapabilities(ctx, csiConn)
-	if err != nil {
-		return false, false, err
+// getIdentity returns identity of this replica: the identity given on the
+// command line, the pod name or the host name.
+func getIdentity(identity string) (string, error) {
+	if identity != "" {
+		return identity, nil
 	}
+	if podName := os.Getenv("POD_NAME"); podName != "" {
+		return podName, nil
+	}
+	return os.Hostname()
+}
 
-	supportsControllerPublish = caps[csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME]
-	supportsPublishReadOnly = caps[csi.ControllerServiceCapability_RPC_PUBLISH_READONLY]
-	return supportsControllerPublish, supportsPublishReadOnly, nil
+// getLockName returns the name of a lock shared by replicas of the attacher: the
+// name given on the command line or the default one derived from the driver.
+func getLockName(name, prefix, driverName string) string {
+	if name != "" {
+		return name
+	}
+	return prefix + driverName
 }
 
-func supportsPluginControllerService(ctx context.Context, csiConn *grpc.ClientConn) (bool, error) {
-	caps, err := rpc.GetPluginCapabilities(ctx, csiConn)
-	if err != nil {
-		return false, err
+// validateLeaderElectionTiming checks the leader election timing the same way
+// as client-go leader election does, so misconfiguration is reported as an
+// error instead of a panic.
+func validateLeaderElectionTiming(leaseDuration, renewDeadline, retryPeriod time.Duration) error {
+	if retryPeriod <= 0 {
+		return fmt.Errorf("option -leader-election-retry-period must be greater than zero")
 	}
+	if leaseDuration <= renewDeadline {
+		return fmt.Errorf("option -leader-election-lease-duration (%s) must be greater than -leader-election-renew-deadline (%s)", leaseDuration, renewDeadline)
+	}
+	if renewDeadline <= time.Duration(k8sleaderelection.JitterFactor*float64(retryPeriod)) {
+		return fmt.Errorf("option -leader-election-renew-deadline (%s) must be greater than %.1f * -leader-election-retry-period (%s)", renewDeadline, k8sleaderelection.JitterFactor, retryPeriod)
+	}
+	return nil
+}
+
+// waitForCacheSync waits for informer caches, applying the configured
+// failure policy. The attacher reports not ready until the caches are synced.
+// It returns false when stopCh was closed before the caches synced.
+func waitForCacheSync(informers map[string]cache.InformerSynced, readyz *healthz.Handler, stopCh <-chan struct{}) bool {
+	var synced int32
+	readyz.AddCheck("informer-sync", func() error {
+		if atomic.LoadInt32(&synced) == 0 {
+			return errors.New("informer caches are not synced")
+		}
+		return nil
+	})
+
+	for {
+		unsynced := controller.WaitForCacheSync(informers, *cacheSyncTimeout, stopCh)
+		if len(unsynced) == 0 {
+			atomic.StoreInt32(&synced, 1)
+			return true
+		}
+		select {
+		case <-stopCh:
+			return false
+		default:
+		}
+		if *cacheSyncFailurePolicy == cacheSyncFailurePolicyExit {
+			klog.Errorf("Timed out waiting for caches of %v to sync. Check that the attacher has RBAC permissions to list and watch them.", unsynced)
+			os.Exit(exitKubeAPIError)
+		}
+		klog.Warningf("Timed out waiting for caches of %v to sync, still waiting. Check that the attacher has RBAC permissions to list and watch them.", unsynced)
+	}
+}
+
+// startMockCSI starts the -mock-csi driver and returns the address of its
+// socket.
+func startMockCSI() (string, error) {
+	options := mockcsi.Options{
+		Name:           *mockCSIName,
+		PublishContext: map[string]string{},
+		ReadOnly:       *mockCSIReadOnly,
+		RequireSecrets: *mockCSIRequireSecrets,
+		Latency:        *mockCSILatency,
+		ErrorRate:      *mockCSIErrorRate,
+	}
+	if *mockCSIPublishContext != "" {
+		for _, pair := range strings.Split(*mockCSIPublishContext, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return "", fmt.Errorf("invalid option -mock-csi-publish-context: %q is not key=value", pair)
+			}
+			options.PublishContext[kv[0]] = kv[1]
+		}
+	}
+	driver := mockcsi.NewDriver(options)
+	address := filepath.Join(os.TempDir(), fmt.Sprintf("csi-attacher-mock-%d.sock", os.Getpid()))
+	if err := driver.Start(address); err != nil {
+		return "", err
+	}
+	return address, nil
+}
 
-	return caps[csi.PluginCapability_Service_CONTROLLER_SERVICE], nil
+// stringSliceFlag is a command line flag that can be repeated.
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func buildConfig(kubeconfig, kubeContext string) (*rest.Config, error) {
+	if kubeconfig != "" {
+		return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig},
+			&clientcmd.ConfigOverrides{CurrentContext: kubeContext}).ClientConfig()
+	}
+	return rest.InClusterConfig()
+}
+
+// workloadClientConfig returns client config of the workload cluster: a copy
+// of config, or config loaded from workloadKubeconfig when it's set. Only its
+// writes are limited by writeLimiter, so leader election, sharding and state
+// handover in the cluster of config are not slowed down together with
+// workers when the API server is unhealthy.
+func workloadClientConfig(config *rest.Config, workloadKubeconfig string, writeLimiter *controller.AdaptiveWriteLimiter) (*rest.Config, error) {
+	workloadConfig := rest.CopyConfig(config)
+	if workloadKubeconfig != "" {
+		var err error
+		workloadConfig, err = clientcmd.BuildConfigFromFlags("", workloadKubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		workloadConfig.QPS = config.QPS
+		workloadConfig.Burst = config.Burst
+	}
+	workloadConfig.WrapTransport = writeLimiter.WrapTransport
+	return workloadConfig, nil
+}
+
+// dryRunWrapper adds controller.DryRunTransport under the transport wrapper
+// wrap.
+func dryRunWrapper(wrap func(http.RoundTripper) http.RoundTripper) func(http.RoundTripper) http.RoundTripper {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		rt = controller.DryRunTransport(rt)
+		if wrap != nil {
+			rt = wrap(rt)
+		}
+		return rt
+	}
 }
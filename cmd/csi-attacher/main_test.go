@@ -0,0 +1,74 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/controller"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestWorkloadClientConfigLimitsOnlyWorkloadWrites(t *testing.T) {
+	// All requests fail with 503, each one that goes through the limiter
+	// halves its rate.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	config := &rest.Config{Host: server.URL}
+	limiter := controller.NewAdaptiveWriteLimiter(1, 100, 100)
+	workloadConfig, err := workloadClientConfig(config, "", limiter)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.WrapTransport != nil {
+		t.Errorf("expected config of leader election without transport wrapper")
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	workloadClientset, err := kubernetes.NewForConfig(workloadConfig)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lease := &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Name: "external-attacher-leader", Namespace: "default"}}
+	if _, err := clientset.CoordinationV1().Leases("default").Create(lease); err == nil {
+		t.Fatalf("expected Lease write to fail")
+	}
+	if qps := limiter.CurrentQPS(); qps != 100 {
+		t.Errorf("expected Lease write to skip the limiter, got %v QPS", qps)
+	}
+
+	va := &storage.VolumeAttachment{ObjectMeta: metav1.ObjectMeta{Name: "va1"}}
+	if _, err := workloadClientset.StorageV1beta1().VolumeAttachments().Create(va); err == nil {
+		t.Fatalf("expected VolumeAttachment write to fail")
+	}
+	if qps := limiter.CurrentQPS(); qps != 50 {
+		t.Errorf("expected VolumeAttachment write to go through the limiter, got %v QPS", qps)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/apis/attacher/v1alpha1"
+	"github.com/kubernetes-csi/external-attacher/pkg/attacherconfig"
+	"github.com/kubernetes-csi/external-attacher/pkg/controller"
+	"github.com/kubernetes-csi/external-attacher/pkg/fencing"
+)
+
+// RBAC self-check modes.
+const (
+	rbacCheckOff  = "off"
+	rbacCheckWarn = "warn"
+	rbacCheckFail = "fail"
+)
+
+// configPermissions returns permissions needed in the cluster of
+// -kubeconfig: leader election, active-active modes and configuration.
+// leaseNamespace is the namespace of leader election and sharding objects,
+// runtimeConfigNamespace the namespace of -runtime-config-configmap.
+func configPermissions(leaseNamespace, runtimeConfigNamespace string) []controller.Permission {
+	var permissions []controller.Permission
+	add := func(group, resource, namespace, reason string, verbs ...string) {
+		for _, verb := range verbs {
+			permissions = append(permissions, controller.Permission{
+				Verb:      verb,
+				Group:     group,
+				Resource:  resource,
+				Namespace: namespace,
+				Reason:    reason,
+			})
+		}
+	}
+	if *enableLeaderElection {
+		if *leaderElectionType != leaderElectionTypeConfigMaps {
+			add("coordination.k8s.io", "leases", leaseNamespace, "leader election", "get", "create", "update")
+		}
+		if *leaderElectionType != leaderElectionTypeLeases {
+			add("", "configmaps", leaseNamespace, "leader election", "get", "create", "update")
+		}
+		if *warmStandby {
+			add("", "configmaps", leaseNamespace, "-warm-standby", "get", "create", "update")
+		}
+	}
+	if *enableSharding {
+		add("coordination.k8s.io", "leases", leaseNamespace, "-sharding", "get", "list", "create", "update", "delete")
+	}
+	if *enableClaims {
+		add("coordination.k8s.io", "leases", leaseNamespace, "-volume-attachment-claims", "get", "create", "update", "delete")
+	}
+	if *runtimeConfigMap != "" {
+		add("", "configmaps", runtimeConfigNamespace, "-runtime-config-configmap", "list", "watch")
+	}
+	if *enableAttacherConfig {
+		add(v1alpha1.GroupName, attacherconfig.Resource, "", "-attacher-config-crd", "list", "watch")
+	}
+	return permissions
+}
+
+// fencingPermissions returns permissions needed in the workload cluster
+// to watch fencing resources.
+func fencingPermissions(resources []fencing.Resource) []controller.Permission {
+	var permissions []controller.Permission
+	for _, resource := range resources {
+		for _, verb := range []string{"list", "watch"} {
+			permissions = append(permissions, controller.Permission{
+				Verb:     verb,
+				Group:    resource.Group,
+				Resource: resource.Resource,
+				Reason:   "-fencing-resource",
+			})
+		}
+	}
+	return permissions
+}
+
+// checkPermissions logs permissions the attacher is missing. cluster
+// describes the cluster of client in the log, e.g. " in the workload
+// cluster", empty with one cluster. It returns false when a required
+// permission is missing.
+func checkPermissions(client kubernetes.Interface, cluster string, permissions []controller.Permission) bool {
+	denied, err := controller.CheckPermissions(client, permissions)
+	if err != nil {
+		klog.Warningf("Skipping the RBAC check%s: %v", cluster, err)
+		return true
+	}
+	if len(denied) == 0 {
+		klog.V(2).Infof("RBAC check%s passed", cluster)
+		return true
+	}
+	if !controller.HasRequired(denied) {
+		klog.Warningf("The attacher is missing optional RBAC permissions%s:\n%s", cluster, controller.PermissionsReport(denied))
+		return true
+	}
+	klog.Errorf("The attacher is missing RBAC permissions%s, its requests will fail with Forbidden errors:\n%s", cluster, controller.PermissionsReport(denied))
+	return false
+}
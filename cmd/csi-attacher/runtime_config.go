@@ -0,0 +1,118 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"strconv"
+	"sync"
+
+	"k8s.io/klog"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/attacherconfig"
+	"github.com/kubernetes-csi/external-attacher/pkg/controller"
+	"github.com/kubernetes-csi/external-attacher/pkg/runtimeconfig"
+)
+
+// runtimeSettings provides Settings of drivers. They are based on the command
+// line, overridden by -runtime-config-configmap and by CSIAttacherConfig
+// objects.
+type runtimeSettings struct {
+	flagDefaults  attacherconfig.Settings
+	logLevel      string
+	minWriteQPS   float64
+	maxWriteQPS   float64
+	writeLimiter  *controller.AdaptiveWriteLimiter
+	configWatcher *attacherconfig.Watcher
+	drivers       *driverSet
+
+	lock     sync.Mutex
+	defaults attacherconfig.Settings
+}
+
+// newRuntimeSettings returns a new runtimeSettings. configWatcher is nil when
+// CSIAttacherConfig objects are not watched.
+func newRuntimeSettings(flagDefaults attacherconfig.Settings, minWriteQPS, maxWriteQPS float64, writeLimiter *controller.AdaptiveWriteLimiter, configWatcher *attacherconfig.Watcher) *runtimeSettings {
+	logLevel := ""
+	if v := flag.Lookup("v"); v != nil {
+		logLevel = v.Value.String()
+	}
+	return &runtimeSettings{
+		flagDefaults:  flagDefaults,
+		logLevel:      logLevel,
+		minWriteQPS:   minWriteQPS,
+		maxWriteQPS:   maxWriteQPS,
+		writeLimiter:  writeLimiter,
+		configWatcher: configWatcher,
+		defaults:      flagDefaults,
+	}
+}
+
+// get returns the current Settings of a driver.
+func (r *runtimeSettings) get(driverName string) attacherconfig.Settings {
+	if r.configWatcher != nil {
+		return r.configWatcher.Get(driverName)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.defaults
+}
+
+// apply applies configuration from the runtime ConfigMap. Values missing in
+// the ConfigMap are reset to the command line values.
+func (r *runtimeSettings) apply(config runtimeconfig.Config) {
+	logLevel := r.logLevel
+	if config.LogLevel != nil {
+		logLevel = strconv.Itoa(*config.LogLevel)
+	}
+	if err := flag.Set("v", logLevel); err != nil {
+		klog.Errorf("Failed to set log level %s: %v", logLevel, err)
+	}
+
+	defaults := r.flagDefaults
+	if config.RetryIntervalStart != nil {
+		defaults.RetryIntervalStart = *config.RetryIntervalStart
+	}
+	if config.RetryIntervalMax != nil {
+		defaults.RetryIntervalMax = *config.RetryIntervalMax
+	}
+	if defaults.RetryIntervalMax < defaults.RetryIntervalStart {
+		defaults.RetryIntervalMax = defaults.RetryIntervalStart
+	}
+	r.lock.Lock()
+	r.defaults = defaults
+	r.lock.Unlock()
+	if r.configWatcher != nil {
+		r.configWatcher.SetDefaults(defaults)
+	}
+
+	minQPS, maxQPS := r.minWriteQPS, r.maxWriteQPS
+	if config.MinWriteQPS != nil {
+		minQPS = *config.MinWriteQPS
+	}
+	if config.MaxWriteQPS != nil && *config.MaxWriteQPS < maxQPS {
+		// Writes can't be faster than the client allows.
+		maxQPS = *config.MaxWriteQPS
+	}
+	r.writeLimiter.SetLimits(minQPS, maxQPS)
+
+	klog.Infof("Applied runtime configuration: log level %s, retry intervals %s-%s, API server writes %.2f-%.2f QPS, maintenance %t", logLevel, defaults.RetryIntervalStart, defaults.RetryIntervalMax, minQPS, maxQPS, config.Maintenance)
+	if r.drivers != nil {
+		r.drivers.applyAll()
+		r.drivers.setPaused(config.Maintenance)
+	}
+}
@@ -0,0 +1,259 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package admission implements a validating admission webhook that rejects
+// VolumeAttachments which the attacher could never attach, so users see the
+// error when they create the object instead of in its status later.
+package admission
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	csitranslationlib "k8s.io/csi-translation-lib"
+	"k8s.io/klog"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/controller"
+	"github.com/kubernetes-csi/external-attacher/pkg/metrics"
+)
+
+// Path is the path of the webhook on the HTTP endpoint.
+const Path = "/admission/volumeattachments"
+
+// maxRequestSize limits the size of an AdmissionReview read from the API
+// server.
+const maxRequestSize = 3 * 1024 * 1024
+
+// Results of reviews.
+const (
+	resultAllowed = "allowed"
+	resultDenied  = "denied"
+	resultError   = "error"
+)
+
+var reviewsTotal = metrics.NewCounterVec(
+	metrics.Namespace+"_admission_reviews_total",
+	"Number of VolumeAttachments reviewed by the admission webhook, by driver and result.",
+	"driver", "result")
+
+func init() {
+	metrics.MustRegister(reviewsTotal)
+}
+
+// admissionReview is the subset of admission.k8s.io AdmissionReview used by
+// the webhook. It is the same in v1beta1 and v1.
+type admissionReview struct {
+	APIVersion string             `json:"apiVersion,omitempty"`
+	Kind       string             `json:"kind,omitempty"`
+	Request    *admissionRequest  `json:"request,omitempty"`
+	Response   *admissionResponse `json:"response,omitempty"`
+}
+
+type admissionRequest struct {
+	UID       types.UID       `json:"uid"`
+	Operation string          `json:"operation"`
+	Object    json.RawMessage `json:"object,omitempty"`
+}
+
+type admissionResponse struct {
+	UID     types.UID      `json:"uid"`
+	Allowed bool           `json:"allowed"`
+	Result  *metav1.Status `json:"status,omitempty"`
+}
+
+// CapabilitiesFunc returns capabilities of a CSI driver served by the
+// attacher. ok is false for other drivers.
+type CapabilitiesFunc func(driverName string) (caps controller.DriverCapabilities, ok bool)
+
+// Validator validates VolumeAttachments of drivers served by the attacher.
+// VolumeAttachments of other drivers are allowed.
+type Validator struct {
+	client           kubernetes.Interface
+	capabilities     CapabilitiesFunc
+	accessModePolicy controller.AccessModePolicy
+}
+
+// NewValidator returns a Validator that gets PersistentVolumes and Nodes
+// from the API server. Unlike informers, the API server always has objects
+// created right before the VolumeAttachment. accessModePolicy must be the
+// policy of the attacher.
+func NewValidator(client kubernetes.Interface, capabilities CapabilitiesFunc, accessModePolicy controller.AccessModePolicy) *Validator {
+	return &Validator{client: client, capabilities: capabilities, accessModePolicy: accessModePolicy}
+}
+
+// ServeHTTP handles an AdmissionReview of a VolumeAttachment. It responds
+// with an error status when the review itself fails, the API server then
+// applies the failurePolicy of the webhook.
+func (v *Validator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	review := &admissionReview{}
+	if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+		http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	response, err := v.review(review.Request)
+	if err != nil {
+		klog.Errorf("Admission review %s failed: %v", review.Request.UID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	review.Request = nil
+	review.Response = response
+	data, err := json.Marshal(review)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// review returns the response to an admission request. Only creation is
+// validated, the spec of VolumeAttachments is immutable.
+func (v *Validator) review(req *admissionRequest) (*admissionResponse, error) {
+	response := &admissionResponse{UID: req.UID, Allowed: true}
+	if req.Operation != "CREATE" {
+		return response, nil
+	}
+	va := &storage.VolumeAttachment{}
+	if err := json.Unmarshal(req.Object, va); err != nil {
+		return nil, fmt.Errorf("failed to decode VolumeAttachment: %v", err)
+	}
+	caps, ok := v.capabilities(va.Spec.Attacher)
+	if !ok {
+		return response, nil
+	}
+
+	problems, err := v.Validate(va, caps)
+	if err != nil {
+		reviewsTotal.WithLabelValues(va.Spec.Attacher, resultError).Inc()
+		return nil, err
+	}
+	if len(problems) == 0 {
+		reviewsTotal.WithLabelValues(va.Spec.Attacher, resultAllowed).Inc()
+		return response, nil
+	}
+	reviewsTotal.WithLabelValues(va.Spec.Attacher, resultDenied).Inc()
+	msg := fmt.Sprintf("VolumeAttachment %q can't be attached by %s: %s", va.Name, va.Spec.Attacher, strings.Join(problems, "; "))
+	klog.V(2).Info(msg)
+	response.Allowed = false
+	response.Result = &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Reason:  metav1.StatusReasonInvalid,
+		Code:    http.StatusUnprocessableEntity,
+		Message: msg,
+	}
+	return response, nil
+}
+
+// Validate returns reasons why va of a driver with caps can't be attached.
+// It returns an error when va can't be validated.
+func (v *Validator) Validate(va *storage.VolumeAttachment, caps controller.DriverCapabilities) ([]string, error) {
+	var problems []string
+
+	pvSpec, problem, err := v.getPVSpec(va)
+	if err != nil {
+		return nil, err
+	}
+	if problem != "" {
+		problems = append(problems, problem)
+	} else {
+		problems = append(problems, validateSource(va.Spec.Attacher, pvSpec, caps, v.accessModePolicy)...)
+	}
+
+	if _, err := v.client.CoreV1().Nodes().Get(va.Spec.NodeName, metav1.GetOptions{}); err != nil {
+		if !apierrs.IsNotFound(err) {
+			return nil, fmt.Errorf("failed to get Node %q: %v", va.Spec.NodeName, err)
+		}
+		problems = append(problems, fmt.Sprintf("Node %q does not exist", va.Spec.NodeName))
+	}
+	return problems, nil
+}
+
+// getPVSpec returns the spec of the volume of va, translated to CSI for
+// migrated in-tree volumes. problem is set when va has no valid source.
+func (v *Validator) getPVSpec(va *storage.VolumeAttachment) (spec *v1.PersistentVolumeSpec, problem string, err error) {
+	source := va.Spec.Source
+	switch {
+	case source.PersistentVolumeName != nil && source.InlineVolumeSpec != nil:
+		return nil, "both InlineVolumeSpec and PersistentVolumeName specified in source", nil
+	case source.InlineVolumeSpec != nil:
+		return source.InlineVolumeSpec, "", nil
+	case source.PersistentVolumeName == nil:
+		return nil, "neither InlineVolumeSpec nor PersistentVolumeName specified in source", nil
+	}
+
+	pv, err := v.client.CoreV1().PersistentVolumes().Get(*source.PersistentVolumeName, metav1.GetOptions{})
+	if err != nil {
+		if apierrs.IsNotFound(err) {
+			return nil, fmt.Sprintf("PersistentVolume %q does not exist", *source.PersistentVolumeName), nil
+		}
+		return nil, "", fmt.Errorf("failed to get PersistentVolume %q: %v", *source.PersistentVolumeName, err)
+	}
+	if pv.DeletionTimestamp != nil {
+		return nil, fmt.Sprintf("PersistentVolume %q is marked for deletion", pv.Name), nil
+	}
+	if csitranslationlib.IsPVMigratable(pv) {
+		pv, err = csitranslationlib.TranslateInTreePVToCSI(pv)
+		if err != nil {
+			return nil, fmt.Sprintf("failed to translate in-tree PersistentVolume %q to CSI: %v", *source.PersistentVolumeName, err), nil
+		}
+	}
+	return &pv.Spec, "", nil
+}
+
+// validateSource returns reasons why the volume with pvSpec can't be
+// attached by driver with caps and accessModePolicy.
+func validateSource(driver string, pvSpec *v1.PersistentVolumeSpec, caps controller.DriverCapabilities, accessModePolicy controller.AccessModePolicy) []string {
+	csiSource := pvSpec.CSI
+	if csiSource == nil {
+		return []string{"volume source is not CSI"}
+	}
+	var problems []string
+	if csiSource.Driver != driver {
+		problems = append(problems, fmt.Sprintf("volume belongs to driver %s", csiSource.Driver))
+	}
+	if csiSource.VolumeHandle == "" {
+		problems = append(problems, "volume handle is empty")
+	}
+	if _, err := controller.GetVolumeCapabilitiesWithPolicy(pvSpec, accessModePolicy); err != nil {
+		problems = append(problems, err.Error())
+	}
+	// The attacher publishes read-only volumes read-write when the driver
+	// can't publish them read-only.
+	if csiSource.ReadOnly && caps.PublishUnpublish && !caps.PublishReadOnly {
+		problems = append(problems, "volume is read-only, but the driver does not support read-only ControllerPublish")
+	}
+	return problems
+}
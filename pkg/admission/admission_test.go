@@ -0,0 +1,312 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admission
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/controller"
+)
+
+const testDriver = "csi/test"
+
+func pv(name string, modify func(pv *v1.PersistentVolume)) *v1.PersistentVolume {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:       testDriver,
+					VolumeHandle: "vol-1",
+				},
+			},
+		},
+	}
+	if modify != nil {
+		modify(pv)
+	}
+	return pv
+}
+
+func va(pvName *string, inline *v1.PersistentVolumeSpec) *storage.VolumeAttachment {
+	return &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va1"},
+		Spec: storage.VolumeAttachmentSpec{
+			Attacher: testDriver,
+			NodeName: "node1",
+			Source: storage.VolumeAttachmentSource{
+				PersistentVolumeName: pvName,
+				InlineVolumeSpec:     inline,
+			},
+		},
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestValidate(t *testing.T) {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+	publish := controller.DriverCapabilities{ControllerService: true, PublishUnpublish: true, Handler: "csi"}
+	readOnlyPV := pv("pv-ro", func(pv *v1.PersistentVolume) { pv.Spec.CSI.ReadOnly = true })
+	// ReadOnlyMany and ReadWriteOnce can't be translated to CSI.
+	invalidModesPV := pv("pv-modes", func(pv *v1.PersistentVolume) {
+		pv.Spec.AccessModes = []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany, v1.ReadWriteOnce}
+	})
+	otherDriverPV := pv("pv-other", func(pv *v1.PersistentVolume) { pv.Spec.CSI.Driver = "csi/other" })
+	deletedPV := pv("pv-deleted", func(pv *v1.PersistentVolume) {
+		now := metav1.Now()
+		pv.DeletionTimestamp = &now
+	})
+	nfsPV := pv("pv-nfs", func(pv *v1.PersistentVolume) {
+		pv.Spec.PersistentVolumeSource = v1.PersistentVolumeSource{NFS: &v1.NFSVolumeSource{Server: "nfs", Path: "/"}}
+	})
+
+	tests := []struct {
+		name     string
+		va       *storage.VolumeAttachment
+		caps     controller.DriverCapabilities
+		objects  []runtime.Object
+		policy   controller.AccessModePolicy
+		problems []string
+	}{
+		{
+			name:    "valid PV",
+			va:      va(strPtr("pv1"), nil),
+			caps:    publish,
+			objects: []runtime.Object{pv("pv1", nil), node},
+		},
+		{
+			name:    "valid inline volume",
+			va:      va(nil, &pv("inline", nil).Spec),
+			caps:    publish,
+			objects: []runtime.Object{node},
+		},
+		{
+			name:     "unknown node and PV",
+			va:       va(strPtr("pv1"), nil),
+			caps:     publish,
+			problems: []string{`PersistentVolume "pv1" does not exist`, `Node "node1" does not exist`},
+		},
+		{
+			name:     "no source",
+			va:       va(nil, nil),
+			caps:     publish,
+			objects:  []runtime.Object{node},
+			problems: []string{"neither InlineVolumeSpec nor PersistentVolumeName specified in source"},
+		},
+		{
+			name:     "both sources",
+			va:       va(strPtr("pv1"), &pv("inline", nil).Spec),
+			caps:     publish,
+			objects:  []runtime.Object{pv("pv1", nil), node},
+			problems: []string{"both InlineVolumeSpec and PersistentVolumeName specified in source"},
+		},
+		{
+			name:     "PV marked for deletion",
+			va:       va(strPtr("pv-deleted"), nil),
+			caps:     publish,
+			objects:  []runtime.Object{deletedPV, node},
+			problems: []string{`PersistentVolume "pv-deleted" is marked for deletion`},
+		},
+		{
+			name:     "not CSI",
+			va:       va(strPtr("pv-nfs"), nil),
+			caps:     publish,
+			objects:  []runtime.Object{nfsPV, node},
+			problems: []string{"volume source is not CSI"},
+		},
+		{
+			name:     "other driver",
+			va:       va(strPtr("pv-other"), nil),
+			caps:     publish,
+			objects:  []runtime.Object{otherDriverPV, node},
+			problems: []string{"volume belongs to driver csi/other"},
+		},
+		{
+			name: "empty inline volume handle",
+			va: va(nil, &pv("inline", func(pv *v1.PersistentVolume) {
+				pv.Spec.CSI.VolumeHandle = ""
+			}).Spec),
+			caps:     publish,
+			objects:  []runtime.Object{node},
+			problems: []string{"volume handle is empty"},
+		},
+		{
+			name:     "invalid access modes",
+			va:       va(strPtr("pv-modes"), nil),
+			caps:     publish,
+			objects:  []runtime.Object{invalidModesPV, node},
+			problems: []string{"CSI does not support ReadOnlyMany and ReadWriteOnce on the same PersistentVolume"},
+		},
+		{
+			name:    "access modes with most-permissive policy",
+			va:      va(strPtr("pv-modes"), nil),
+			caps:    publish,
+			objects: []runtime.Object{invalidModesPV, node},
+			policy:  controller.AccessModeMostPermissive,
+		},
+		{
+			name:     "read-only without PUBLISH_READONLY",
+			va:       va(strPtr("pv-ro"), nil),
+			caps:     publish,
+			objects:  []runtime.Object{readOnlyPV, node},
+			problems: []string{"volume is read-only, but the driver does not support read-only ControllerPublish"},
+		},
+		{
+			name: "read-only with PUBLISH_READONLY",
+			va:   va(strPtr("pv-ro"), nil),
+			caps: controller.DriverCapabilities{
+				ControllerService: true,
+				PublishUnpublish:  true,
+				PublishReadOnly:   true,
+				Handler:           "csi",
+			},
+			objects: []runtime.Object{readOnlyPV, node},
+		},
+		{
+			name:    "read-only without ControllerPublish",
+			va:      va(strPtr("pv-ro"), nil),
+			caps:    controller.DriverCapabilities{Handler: "trivial"},
+			objects: []runtime.Object{readOnlyPV, node},
+		},
+	}
+	for _, test := range tests {
+		validator := NewValidator(fake.NewSimpleClientset(test.objects...), nil, test.policy)
+		problems, err := validator.Validate(test.va, test.caps)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if strings.Join(problems, "\n") != strings.Join(test.problems, "\n") {
+			t.Errorf("%s: expected problems %q, got %q", test.name, test.problems, problems)
+		}
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	capabilities := func(driverName string) (controller.DriverCapabilities, bool) {
+		return controller.DriverCapabilities{Handler: "trivial"}, driverName == testDriver
+	}
+	client := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})
+	server := httptest.NewServer(NewValidator(client, capabilities, controller.AccessModeStrict))
+	defer server.Close()
+
+	otherDriver := va(nil, nil)
+	otherDriver.Spec.Attacher = "csi/other"
+
+	tests := []struct {
+		name       string
+		operation  string
+		va         *storage.VolumeAttachment
+		statusCode int
+		allowed    bool
+		message    string
+	}{
+		{
+			name:       "valid",
+			operation:  "CREATE",
+			va:         va(nil, &pv("inline", nil).Spec),
+			statusCode: http.StatusOK,
+			allowed:    true,
+		},
+		{
+			name:       "invalid",
+			operation:  "CREATE",
+			va:         va(nil, nil),
+			statusCode: http.StatusOK,
+			message:    `VolumeAttachment "va1" can't be attached by csi/test: neither InlineVolumeSpec nor PersistentVolumeName specified in source`,
+		},
+		{
+			name:       "update",
+			operation:  "UPDATE",
+			va:         va(nil, nil),
+			statusCode: http.StatusOK,
+			allowed:    true,
+		},
+		{
+			name:       "other driver",
+			operation:  "CREATE",
+			va:         otherDriver,
+			statusCode: http.StatusOK,
+			allowed:    true,
+		},
+		{
+			name:       "no request",
+			statusCode: http.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		review := admissionReview{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"}
+		if test.va != nil {
+			object, err := json.Marshal(test.va)
+			if err != nil {
+				t.Fatal(err)
+			}
+			review.Request = &admissionRequest{UID: "uid-1", Operation: test.operation, Object: object}
+		}
+		body, err := json.Marshal(review)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(server.URL+Path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", test.name, err)
+		}
+		result := admissionReview{}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if resp.StatusCode != test.statusCode {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.statusCode, resp.StatusCode)
+			continue
+		}
+		if test.statusCode != http.StatusOK {
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: invalid response: %v", test.name, err)
+			continue
+		}
+		if result.APIVersion != review.APIVersion || result.Kind != review.Kind || result.Response == nil || result.Response.UID != "uid-1" {
+			t.Errorf("%s: unexpected response %+v", test.name, result)
+			continue
+		}
+		if result.Response.Allowed != test.allowed {
+			t.Errorf("%s: expected allowed %v, got %v", test.name, test.allowed, result.Response.Allowed)
+		}
+		var message string
+		if result.Response.Result != nil {
+			message = result.Response.Result.Message
+		}
+		if message != test.message {
+			t.Errorf("%s: expected message %q, got %q", test.name, test.message, message)
+		}
+	}
+}
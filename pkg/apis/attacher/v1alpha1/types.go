@@ -0,0 +1,79 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// CSIAttacherConfig is runtime configuration of the external-attacher for one
+// CSI driver. Its name is the name of the driver. CSIAttacherConfig is
+// cluster-scoped. Fields that are not set use values from the command line
+// of the external-attacher.
+type CSIAttacherConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// Standard object metadata.
+	// More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#metadata
+	// +optional
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// Specification of the configuration.
+	Spec CSIAttacherConfigSpec `json:"spec"`
+}
+
+// CSIAttacherConfigSpec is the specification of CSIAttacherConfig.
+type CSIAttacherConfigSpec struct {
+	// Timeout of ControllerPublish and ControllerUnpublish calls.
+	// Changes are applied to new calls.
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+
+	// Initial retry interval of failed attach or detach. It doubles with
+	// each failure, up to RetryIntervalMax. Changes are applied to new
+	// failures.
+	// +optional
+	RetryIntervalStart *metav1.Duration `json:"retryIntervalStart,omitempty"`
+
+	// Maximum retry interval of failed attach or detach.
+	// +optional
+	RetryIntervalMax *metav1.Duration `json:"retryIntervalMax,omitempty"`
+
+	// Number of worker threads of the driver. Changes are applied when the
+	// controller of the driver starts.
+	// +optional
+	WorkerThreads *int32 `json:"workerThreads,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// CSIAttacherConfigList is a collection of CSIAttacherConfig objects.
+type CSIAttacherConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// Standard list metadata
+	// More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#metadata
+	// +optional
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	// Items is the list of CSIAttacherConfig
+	Items []CSIAttacherConfig `json:"items"`
+}
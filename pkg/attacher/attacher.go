@@ -18,8 +18,13 @@ package attacher
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/connection"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 
 	"google.golang.org/grpc"
@@ -89,13 +94,127 @@ func (a *attacher) Detach(ctx context.Context, volumeID string, nodeID string, s
 	return err
 }
 
-func logGRPC(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
-	klog.V(5).Infof("GRPC call: %s", method)
-	klog.V(5).Infof("GRPC request: %s", protosanitizer.StripSecrets(req))
-	err := invoker(ctx, method, req, reply, cc, opts...)
-	klog.V(5).Infof("GRPC response: %s", protosanitizer.StripSecrets(reply))
-	klog.V(5).Infof("GRPC error: %v", err)
-	return err
+// RedactedValue replaces values that must not be logged, it is the same as
+// used by protosanitizer for secrets.
+const RedactedValue = "***stripped***"
+
+// ParseEndpoint parses address of a CSI driver in the formats of
+// CSI_ENDPOINT used by other sidecars: "unix://<path>", "unix:<path>",
+// "tcp://<host>:<port>", a filesystem path or "<host>:<port>". IPv6 hosts
+// must be in brackets, e.g. "[::1]:9000". Paths starting with "@" are
+// sockets in the abstract namespace, e.g. "unix:@csi". It returns the network
+// ("unix" or "tcp") and the address in the network.
+func ParseEndpoint(endpoint string) (string, string, error) {
+	network, address := "tcp", endpoint
+	if i := strings.Index(endpoint, "://"); i >= 0 {
+		network, address = strings.ToLower(endpoint[:i]), endpoint[i+len("://"):]
+		if network != "unix" && network != "tcp" {
+			return "", "", fmt.Errorf("invalid CSI endpoint %q: unsupported scheme %q, use unix:// or tcp://", endpoint, network)
+		}
+	} else if strings.HasPrefix(strings.ToLower(endpoint), "unix:") {
+		network, address = "unix", endpoint[len("unix:"):]
+	} else if strings.HasPrefix(endpoint, "/") || strings.HasPrefix(endpoint, "@") {
+		network = "unix"
+	}
+	if address == "" {
+		return "", "", fmt.Errorf("invalid CSI endpoint %q: empty address", endpoint)
+	}
+	if network == "tcp" {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return "", "", fmt.Errorf("invalid CSI endpoint %q: %v", endpoint, err)
+		}
+	}
+	return network, address, nil
+}
+
+// Connect connects to a CSI driver at address like connection.Connect. The
+// address is parsed by ParseEndpoint. CSI messages are logged at level 5
+// without secrets and without values of PublishContext keys in redactedKeys.
+func Connect(address string, redactedKeys []string) (*grpc.ClientConn, error) {
+	network, address, err := ParseEndpoint(address)
+	if err != nil {
+		return nil, err
+	}
+	if len(redactedKeys) == 0 {
+		if network == "unix" {
+			address = "unix://" + address
+		}
+		return connection.Connect(address)
+	}
+
+	dialOptions := []grpc.DialOption{
+		grpc.WithInsecure(),                   // Don't use TLS, it's usually local Unix domain socket in a container.
+		grpc.WithBackoffMaxDelay(time.Second), // Retry every second after failure.
+		grpc.WithBlock(),                      // Block until connection succeeds.
+		grpc.WithUnaryInterceptor(LogGRPC(redactedKeys)),
+	}
+	if network == "unix" {
+		path := address
+		dialOptions = append(dialOptions, grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", path, timeout)
+		}))
+		address = "unix://" + path
+	}
+
+	klog.Infof("Connecting to %s", address)
+	return grpc.Dial(address, dialOptions...)
+}
+
+// LogGRPC returns a gRPC unary interceptor that logs CSI messages at level 5
+// like connection.LogGRPC. In addition to secrets, it removes values of
+// PublishContext keys in redactedKeys from ControllerPublish responses.
+func LogGRPC(redactedKeys []string) grpc.UnaryClientInterceptor {
+	redacted := make(map[string]bool, len(redactedKeys))
+	for _, key := range redactedKeys {
+		redacted[key] = true
+	}
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		klog.V(5).Infof("GRPC call: %s", method)
+		klog.V(5).Infof("GRPC request: %s", protosanitizer.StripSecrets(req))
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if rsp, ok := reply.(*csi.ControllerPublishVolumeResponse); ok && bool(klog.V(5)) {
+			reply = redactPublishContext(rsp, redacted)
+		}
+		klog.V(5).Infof("GRPC response: %s", protosanitizer.StripSecrets(reply))
+		klog.V(5).Infof("GRPC error: %v", err)
+		return err
+	}
+}
+
+// redactPublishContext returns a copy of rsp with values of redacted
+// PublishContext keys replaced.
+func redactPublishContext(rsp *csi.ControllerPublishVolumeResponse, redacted map[string]bool) *csi.ControllerPublishVolumeResponse {
+	if rsp == nil || len(redacted) == 0 {
+		return rsp
+	}
+	return &csi.ControllerPublishVolumeResponse{
+		PublishContext: redactMap(rsp.PublishContext, redacted),
+	}
+}
+
+// RedactPublishContext returns a copy of publishContext with values of
+// redactedKeys replaced by RedactedValue, e.g. for logging attachment
+// metadata of VolumeAttachments.
+func RedactPublishContext(publishContext map[string]string, redactedKeys []string) map[string]string {
+	redacted := make(map[string]bool, len(redactedKeys))
+	for _, key := range redactedKeys {
+		redacted[key] = true
+	}
+	return redactMap(publishContext, redacted)
+}
+
+func redactMap(publishContext map[string]string, redacted map[string]bool) map[string]string {
+	if publishContext == nil {
+		return nil
+	}
+	out := make(map[string]string, len(publishContext))
+	for key, value := range publishContext {
+		if redacted[key] {
+			value = RedactedValue
+		}
+		out[key] = value
+	}
+	return out
 }
 
 // isFinished returns true if given error represents final error of an
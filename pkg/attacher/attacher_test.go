@@ -17,12 +17,15 @@ limitations under the License.
 package attacher
 
 import (
+	"bytes"
 	"context"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -33,6 +36,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/klog"
 )
 
 const (
@@ -380,3 +384,173 @@ func TestDetachAttach(t *testing.T) {
 		}
 	}
 }
+
+func TestConnectRedactedKeys(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, drv, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer drv.Stop()
+	csiConn.Close()
+
+	// Capture klog output at level 5.
+	flags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(flags)
+	flags.Set("logtostderr", "false")
+	flags.Set("v", "5")
+	var out bytes.Buffer
+	klog.SetOutput(&out)
+	defer func() {
+		flags.Set("logtostderr", "true")
+		flags.Set("v", "0")
+		klog.SetOutput(os.Stderr)
+	}()
+
+	conn, err := Connect(drv.Address(), []string{"chap"})
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	publishContext := map[string]string{
+		"iqn":  "iqn.2019-10.com.example:target",
+		"chap": "chap-secret",
+	}
+	controllerServer.EXPECT().ControllerPublishVolume(gomock.Any(), gomock.Any()).Return(&csi.ControllerPublishVolumeResponse{PublishContext: publishContext}, nil).Times(1)
+	info, _, err := NewAttacher(conn).Attach(context.Background(), "vol", false, "node", nil, nil, map[string]string{"password": "secret"})
+	if err != nil {
+		t.Fatalf("Attach failed: %v", err)
+	}
+	klog.Flush()
+
+	// The caller gets full PublishContext, logs don't.
+	if !reflect.DeepEqual(info, publishContext) {
+		t.Errorf("expected PublishContext %+v, got %+v", publishContext, info)
+	}
+	logs := out.String()
+	if !strings.Contains(logs, "iqn.2019-10.com.example:target") {
+		t.Errorf("expected logged PublishContext, got:\n%s", logs)
+	}
+	for _, secret := range []string{"chap-secret", "password\":\"secret"} {
+		if strings.Contains(logs, secret) {
+			t.Errorf("secret %q found in logs:\n%s", secret, logs)
+		}
+	}
+}
+
+func TestRedactPublishContext(t *testing.T) {
+	publishContext := map[string]string{
+		"iqn":  "iqn.2019-10.com.example:target",
+		"chap": "chap-secret",
+	}
+	redacted := RedactPublishContext(publishContext, []string{"chap", "missing"})
+	expected := map[string]string{
+		"iqn":  "iqn.2019-10.com.example:target",
+		"chap": RedactedValue,
+	}
+	if !reflect.DeepEqual(redacted, expected) {
+		t.Errorf("expected %+v, got %+v", expected, redacted)
+	}
+	if publishContext["chap"] != "chap-secret" {
+		t.Errorf("original PublishContext was changed: %+v", publishContext)
+	}
+	if RedactPublishContext(nil, []string{"chap"}) != nil {
+		t.Errorf("expected nil for nil PublishContext")
+	}
+}
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint        string
+		expectedNetwork string
+		expectedAddress string
+		expectError     bool
+	}{
+		{endpoint: "/run/csi/socket", expectedNetwork: "unix", expectedAddress: "/run/csi/socket"},
+		{endpoint: "unix:///run/csi/socket", expectedNetwork: "unix", expectedAddress: "/run/csi/socket"},
+		{endpoint: "UNIX:///run/csi/socket", expectedNetwork: "unix", expectedAddress: "/run/csi/socket"},
+		{endpoint: "tcp://127.0.0.1:9000", expectedNetwork: "tcp", expectedAddress: "127.0.0.1:9000"},
+		{endpoint: "csi-driver:9000", expectedNetwork: "tcp", expectedAddress: "csi-driver:9000"},
+		{endpoint: "unix:/run/csi/socket", expectedNetwork: "unix", expectedAddress: "/run/csi/socket"},
+		{endpoint: "unix:@csi", expectedNetwork: "unix", expectedAddress: "@csi"},
+		{endpoint: "unix://@csi", expectedNetwork: "unix", expectedAddress: "@csi"},
+		{endpoint: "@csi", expectedNetwork: "unix", expectedAddress: "@csi"},
+		{endpoint: "[::1]:9000", expectedNetwork: "tcp", expectedAddress: "[::1]:9000"},
+		{endpoint: "tcp://[fd00::1]:9000", expectedNetwork: "tcp", expectedAddress: "[fd00::1]:9000"},
+		{endpoint: "", expectError: true},
+		{endpoint: "unix://", expectError: true},
+		{endpoint: "unix:", expectError: true},
+		{endpoint: "http://csi-driver:9000", expectError: true},
+		{endpoint: "csi-driver", expectError: true},
+		{endpoint: "::1:9000", expectError: true},
+	}
+	for _, test := range tests {
+		network, address, err := ParseEndpoint(test.endpoint)
+		if test.expectError {
+			if err == nil {
+				t.Errorf("%q: expected error, got none", test.endpoint)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.endpoint, err)
+			continue
+		}
+		if network != test.expectedNetwork || address != test.expectedAddress {
+			t.Errorf("%q: expected %s %q, got %s %q", test.endpoint, test.expectedNetwork, test.expectedAddress, network, address)
+		}
+	}
+}
+
+func TestConnectEndpoints(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		address string
+		// endpoint returns the endpoint for the address of the listener.
+		endpoint func(address string) string
+	}{
+		{
+			name:     "abstract unix socket",
+			network:  "unix",
+			address:  fmt.Sprintf("@external-attacher-test-%d", os.Getpid()),
+			endpoint: func(address string) string { return "unix:" + address },
+		},
+		{
+			name:     "IPv6",
+			network:  "tcp",
+			address:  "[::1]:0",
+			endpoint: func(address string) string { return "tcp://" + address },
+		},
+	}
+	for _, test := range tests {
+		for _, redactedKeys := range [][]string{nil, {"chap"}} {
+			mockController := gomock.NewController(t)
+			identityServer := driver.NewMockIdentityServer(mockController)
+			drv := driver.NewMockCSIDriver(&driver.MockCSIDriverServers{Identity: identityServer})
+			if err := drv.StartOnAddress(test.network, test.address); err != nil {
+				// IPv6 may be disabled on the host.
+				t.Logf("%s: skipping, can't listen: %v", test.name, err)
+				mockController.Finish()
+				continue
+			}
+			endpoint := test.endpoint(drv.Address())
+
+			conn, err := Connect(endpoint, redactedKeys)
+			if err != nil {
+				t.Errorf("%s: failed to connect to %q: %v", test.name, endpoint, err)
+			} else {
+				identityServer.EXPECT().Probe(gomock.Any(), gomock.Any()).Return(&csi.ProbeResponse{}, nil).Times(1)
+				if _, err := csi.NewIdentityClient(conn).Probe(context.Background(), &csi.ProbeRequest{}); err != nil {
+					t.Errorf("%s: Probe at %q failed: %v", test.name, endpoint, err)
+				}
+				conn.Close()
+			}
+			drv.Stop()
+			mockController.Finish()
+		}
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package attacher
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"k8s.io/klog"
+)
+
+// Failover dials a CSI driver at a primary endpoint and switches to a backup
+// endpoint when all dials of the active endpoint fail for longer than a
+// timeout, e.g. with active / passive controller pods of the driver. It
+// switches back the same way when the backup fails.
+type Failover struct {
+	endpoints [2]string
+	networks  [2]string
+	addresses [2]string
+	timeout   time.Duration
+	now       func() time.Time
+
+	lock   sync.Mutex
+	active int
+	// failingSince is the time of the first failed dial of the active
+	// endpoint after the last successful one, zero when the last dial
+	// succeeded.
+	failingSince time.Time
+	onSwitch     func(from, to string)
+}
+
+// NewFailover returns a failover between primary and backup endpoints in a
+// format accepted by ParseEndpoint. It switches to the other endpoint when
+// dials fail for timeout.
+func NewFailover(primary, backup string, timeout time.Duration) (*Failover, error) {
+	f := &Failover{
+		endpoints: [2]string{primary, backup},
+		timeout:   timeout,
+		now:       time.Now,
+	}
+	for i, endpoint := range f.endpoints {
+		network, address, err := ParseEndpoint(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		f.networks[i], f.addresses[i] = network, address
+	}
+	return f, nil
+}
+
+// Active returns the endpoint that is dialed now.
+func (f *Failover) Active() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.endpoints[f.active]
+}
+
+// OnSwitch sets a function that is called with the old and the new endpoint
+// after each switch.
+func (f *Failover) OnSwitch(onSwitch func(from, to string)) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.onSwitch = onSwitch
+}
+
+// dial is the dialer of the gRPC connection, it ignores the target.
+func (f *Failover) dial(_ string, timeout time.Duration) (net.Conn, error) {
+	f.lock.Lock()
+	active := f.active
+	f.lock.Unlock()
+
+	conn, err := net.DialTimeout(f.networks[active], f.addresses[active], timeout)
+
+	f.lock.Lock()
+	if err == nil || active != f.active {
+		if err == nil {
+			f.failingSince = time.Time{}
+		}
+		f.lock.Unlock()
+		return conn, err
+	}
+	now := f.now()
+	if f.failingSince.IsZero() {
+		f.failingSince = now
+	}
+	if now.Sub(f.failingSince) < f.timeout {
+		f.lock.Unlock()
+		return nil, err
+	}
+	from, to := f.endpoints[active], f.endpoints[1-active]
+	f.active = 1 - active
+	f.failingSince = time.Time{}
+	onSwitch := f.onSwitch
+	f.lock.Unlock()
+
+	klog.Warningf("CSI endpoint %s failed for %s, switching to %s: %v", from, f.timeout, to, err)
+	if onSwitch != nil {
+		onSwitch(from, to)
+	}
+	return nil, err
+}
+
+// ConnectFailover connects to a CSI driver through failover like Connect.
+func ConnectFailover(f *Failover, redactedKeys []string) (*grpc.ClientConn, error) {
+	dialOptions := []grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithBackoffMaxDelay(time.Second), // Retry every second after failure.
+		grpc.WithBlock(),                      // Block until connection succeeds.
+		grpc.WithUnaryInterceptor(LogGRPC(redactedKeys)),
+		grpc.WithDialer(f.dial),
+	}
+	// The target is used only as authority of the calls.
+	target := f.addresses[0]
+	if f.networks[0] == "unix" {
+		target = "unix://" + target
+	}
+	klog.Infof("Connecting to %s with failover to %s", f.endpoints[0], f.endpoints[1])
+	conn, err := grpc.Dial(target, dialOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s or %s: %v", f.endpoints[0], f.endpoints[1], err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package attacher
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-csi/csi-test/driver"
+)
+
+func TestFailoverDial(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	primary := filepath.Join(tmpdir, "primary.sock")
+	backup := filepath.Join(tmpdir, "backup.sock")
+	listener, err := net.Listen("unix", backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	f, err := NewFailover(primary, "unix://"+backup, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2019, 10, 14, 12, 0, 0, 0, time.UTC)
+	f.now = func() time.Time { return now }
+	var switches []string
+	f.OnSwitch(func(from, to string) { switches = append(switches, from+" -> "+to) })
+
+	// Failures shorter than the timeout don't switch.
+	for i := 0; i < 2; i++ {
+		if _, err := f.dial("", time.Second); err == nil {
+			t.Fatalf("expected dial of the missing primary socket to fail")
+		}
+		now = now.Add(30 * time.Second)
+	}
+	if active := f.Active(); active != primary {
+		t.Errorf("expected active primary before the timeout, got %s", active)
+	}
+
+	// The third failure is a minute after the first one.
+	if _, err := f.dial("", time.Second); err == nil {
+		t.Fatalf("expected dial of the missing primary socket to fail")
+	}
+	if active := f.Active(); active != "unix://"+backup {
+		t.Errorf("expected active backup after the timeout, got %s", active)
+	}
+	conn, err := f.dial("", time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial the backup: %v", err)
+	}
+	conn.Close()
+	expected := primary + " -> unix://" + backup
+	if len(switches) != 1 || switches[0] != expected {
+		t.Errorf("expected switch %q, got %q", expected, switches)
+	}
+}
+
+func TestConnectFailover(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController := gomock.NewController(t)
+	defer mockController.Finish()
+	identityServer := driver.NewMockIdentityServer(mockController)
+	drv := driver.NewMockCSIDriver(&driver.MockCSIDriverServers{Identity: identityServer})
+	if err := drv.StartOnAddress("unix", filepath.Join(tmpdir, "backup.sock")); err != nil {
+		t.Fatal(err)
+	}
+	defer drv.Stop()
+
+	// The primary socket does not exist, the connection switches to the
+	// backup right after the first failure.
+	f, err := NewFailover(filepath.Join(tmpdir, "primary.sock"), drv.Address(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ConnectFailover(f, nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	identityServer.EXPECT().Probe(gomock.Any(), gomock.Any()).Return(&csi.ProbeResponse{}, nil).Times(1)
+	if _, err := csi.NewIdentityClient(conn).Probe(context.Background(), &csi.ProbeRequest{}); err != nil {
+		t.Errorf("Probe failed: %v", err)
+	}
+}
+
+func TestNewFailoverInvalidEndpoint(t *testing.T) {
+	if _, err := NewFailover("/run/csi/socket", "http://csi-driver:9000", time.Minute); err == nil {
+		t.Errorf("expected error, got none")
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package attacherconfig watches CSIAttacherConfig objects with per-driver
+// runtime configuration of the external-attacher.
+package attacherconfig
+
+import (
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/apis/attacher/v1alpha1"
+)
+
+// Resource is the name of the CSIAttacherConfig resource.
+const Resource = "csiattacherconfigs"
+
+// Settings are runtime settings of one CSI driver.
+type Settings struct {
+	Timeout            time.Duration
+	RetryIntervalStart time.Duration
+	RetryIntervalMax   time.Duration
+	WorkerThreads      int
+}
+
+// Merge returns s overridden by fields set in config. Invalid fields are
+// ignored.
+func (s Settings) Merge(config *v1alpha1.CSIAttacherConfig) Settings {
+	if config == nil {
+		return s
+	}
+	spec := config.Spec
+	if d, ok := positiveDuration(config.Name, "timeout", spec.Timeout); ok {
+		s.Timeout = d
+	}
+	if d, ok := positiveDuration(config.Name, "retryIntervalStart", spec.RetryIntervalStart); ok {
+		s.RetryIntervalStart = d
+	}
+	if d, ok := positiveDuration(config.Name, "retryIntervalMax", spec.RetryIntervalMax); ok {
+		s.RetryIntervalMax = d
+	}
+	if s.RetryIntervalMax < s.RetryIntervalStart {
+		s.RetryIntervalMax = s.RetryIntervalStart
+	}
+	if spec.WorkerThreads != nil {
+		if *spec.WorkerThreads > 0 {
+			s.WorkerThreads = int(*spec.WorkerThreads)
+		} else {
+			klog.Errorf("CSIAttacherConfig %s: ignoring workerThreads %d, it must be greater than zero", config.Name, *spec.WorkerThreads)
+		}
+	}
+	return s
+}
+
+func positiveDuration(name, field string, d *metav1.Duration) (time.Duration, bool) {
+	if d == nil {
+		return 0, false
+	}
+	if d.Duration <= 0 {
+		klog.Errorf("CSIAttacherConfig %s: ignoring %s %s, it must be greater than zero", name, field, d.Duration)
+		return 0, false
+	}
+	return d.Duration, true
+}
+
+// NewRESTClient returns a client of CSIAttacherConfig objects.
+func NewRESTClient(config *rest.Config) (*rest.RESTClient, error) {
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	config = rest.CopyConfig(config)
+	config.GroupVersion = &v1alpha1.SchemeGroupVersion
+	config.APIPath = "/apis"
+	config.ContentType = runtime.ContentTypeJSON
+	config.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: serializer.NewCodecFactory(scheme)}
+	return rest.RESTClientFor(config)
+}
+
+// Watcher watches CSIAttacherConfig objects and provides effective Settings
+// of drivers.
+type Watcher struct {
+	informer cache.SharedIndexInformer
+
+	lock     sync.Mutex
+	defaults Settings
+}
+
+// NewWatcher returns a new Watcher of CSIAttacherConfig objects listed by lw.
+// Drivers without CSIAttacherConfig use defaults.
+func NewWatcher(lw cache.ListerWatcher, resync time.Duration, defaults Settings) *Watcher {
+	return &Watcher{
+		informer: cache.NewSharedIndexInformer(lw, &v1alpha1.CSIAttacherConfig{}, resync, cache.Indexers{}),
+		defaults: defaults,
+	}
+}
+
+// NewListWatch returns ListerWatcher of all CSIAttacherConfig objects.
+func NewListWatch(client cache.Getter) cache.ListerWatcher {
+	return cache.NewListWatchFromClient(client, Resource, metav1.NamespaceAll, fields.Everything())
+}
+
+// Run runs the informer of CSIAttacherConfig objects until stopCh is closed.
+func (w *Watcher) Run(stopCh <-chan struct{}) {
+	w.informer.Run(stopCh)
+}
+
+// HasSynced returns true when the informer cache is synced.
+func (w *Watcher) HasSynced() bool {
+	return w.informer.HasSynced()
+}
+
+// SetDefaults changes Settings of drivers without CSIAttacherConfig and
+// values of fields that are not set in CSIAttacherConfig.
+func (w *Watcher) SetDefaults(defaults Settings) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.defaults = defaults
+}
+
+// Get returns effective Settings of a driver.
+func (w *Watcher) Get(driverName string) Settings {
+	w.lock.Lock()
+	defaults := w.defaults
+	w.lock.Unlock()
+
+	obj, found, err := w.informer.GetStore().GetByKey(driverName)
+	if err != nil || !found {
+		return defaults
+	}
+	return defaults.Merge(obj.(*v1alpha1.CSIAttacherConfig))
+}
+
+// OnChange adds a function that is called with effective Settings of a
+// driver whose CSIAttacherConfig was created, updated or deleted. It must be
+// called before Run.
+func (w *Watcher) OnChange(handler func(driverName string, settings Settings)) {
+	changed := func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		config, ok := obj.(*v1alpha1.CSIAttacherConfig)
+		if !ok {
+			return
+		}
+		handler(config.Name, w.Get(config.Name))
+	}
+	w.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    changed,
+		UpdateFunc: func(old, new interface{}) { changed(new) },
+		DeleteFunc: changed,
+	})
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package attacherconfig
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/apis/attacher/v1alpha1"
+)
+
+var defaults = Settings{
+	Timeout:            15 * time.Second,
+	RetryIntervalStart: time.Second,
+	RetryIntervalMax:   5 * time.Minute,
+	WorkerThreads:      10,
+}
+
+func duration(d time.Duration) *metav1.Duration {
+	return &metav1.Duration{Duration: d}
+}
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+func config(name string, spec v1alpha1.CSIAttacherConfigSpec) *v1alpha1.CSIAttacherConfig {
+	return &v1alpha1.CSIAttacherConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       spec,
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   *v1alpha1.CSIAttacherConfig
+		expected Settings
+	}{
+		{
+			name:     "no config",
+			expected: defaults,
+		},
+		{
+			name:     "empty config",
+			config:   config("driver", v1alpha1.CSIAttacherConfigSpec{}),
+			expected: defaults,
+		},
+		{
+			name: "all fields",
+			config: config("driver", v1alpha1.CSIAttacherConfigSpec{
+				Timeout:            duration(time.Minute),
+				RetryIntervalStart: duration(2 * time.Second),
+				RetryIntervalMax:   duration(time.Minute),
+				WorkerThreads:      int32Ptr(3),
+			}),
+			expected: Settings{
+				Timeout:            time.Minute,
+				RetryIntervalStart: 2 * time.Second,
+				RetryIntervalMax:   time.Minute,
+				WorkerThreads:      3,
+			},
+		},
+		{
+			name: "invalid fields",
+			config: config("driver", v1alpha1.CSIAttacherConfigSpec{
+				Timeout:       duration(-time.Second),
+				WorkerThreads: int32Ptr(0),
+			}),
+			expected: defaults,
+		},
+		{
+			name: "max interval shorter than start",
+			config: config("driver", v1alpha1.CSIAttacherConfigSpec{
+				RetryIntervalStart: duration(10 * time.Minute),
+			}),
+			expected: Settings{
+				Timeout:            15 * time.Second,
+				RetryIntervalStart: 10 * time.Minute,
+				RetryIntervalMax:   10 * time.Minute,
+				WorkerThreads:      10,
+			},
+		},
+	}
+	for _, test := range tests {
+		if settings := defaults.Merge(test.config); settings != test.expected {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, settings)
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	watcher := watch.NewFake()
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return &v1alpha1.CSIAttacherConfigList{
+				Items: []v1alpha1.CSIAttacherConfig{*config("a", v1alpha1.CSIAttacherConfigSpec{WorkerThreads: int32Ptr(1)})},
+			}, nil
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return watcher, nil
+		},
+	}
+	w := NewWatcher(lw, 0, defaults)
+	changes := make(chan string, 10)
+	w.OnChange(func(driverName string, settings Settings) {
+		changes <- driverName
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go w.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, w.HasSynced) {
+		t.Fatal("cache not synced")
+	}
+	expectChange := func(driverName string) {
+		select {
+		case name := <-changes:
+			if name != driverName {
+				t.Errorf("expected change of %q, got %q", driverName, name)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for change of %q", driverName)
+		}
+	}
+	expectChange("a")
+
+	if settings := w.Get("a"); settings.WorkerThreads != 1 {
+		t.Errorf("expected 1 worker of driver a, got %d", settings.WorkerThreads)
+	}
+	if settings := w.Get("b"); settings != defaults {
+		t.Errorf("expected defaults for driver b, got %+v", settings)
+	}
+
+	watcher.Add(config("b", v1alpha1.CSIAttacherConfigSpec{Timeout: duration(time.Minute)}))
+	expectChange("b")
+	if settings := w.Get("b"); settings.Timeout != time.Minute {
+		t.Errorf("expected timeout of driver b 1m, got %s", settings.Timeout)
+	}
+
+	newDefaults := defaults
+	newDefaults.RetryIntervalMax = 10 * time.Minute
+	w.SetDefaults(newDefaults)
+	if settings := w.Get("b"); settings.Timeout != time.Minute || settings.RetryIntervalMax != 10*time.Minute {
+		t.Errorf("expected new defaults merged with config of driver b, got %+v", settings)
+	}
+	w.SetDefaults(defaults)
+
+	watcher.Delete(config("a", v1alpha1.CSIAttacherConfigSpec{}))
+	expectChange("a")
+	if settings := w.Get("a"); settings != defaults {
+		t.Errorf("expected defaults for deleted config of driver a, got %+v", settings)
+	}
+}
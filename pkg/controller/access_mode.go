@@ -0,0 +1,44 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+)
+
+// AccessModePolicy selects how access modes of a PV are translated to the
+// single access mode of the VolumeCapability passed to ControllerPublish.
+// ReadWriteMany wins over the other modes with all policies.
+type AccessModePolicy string
+
+const (
+	// AccessModeStrict rejects PVs with both ReadOnlyMany and
+	// ReadWriteOnce, no CSI access mode is exactly the same.
+	AccessModeStrict AccessModePolicy = "strict"
+	// AccessModeMostPermissive publishes PVs with both ReadOnlyMany and
+	// ReadWriteOnce as MULTI_NODE_SINGLE_WRITER, which allows both usages.
+	AccessModeMostPermissive AccessModePolicy = "most-permissive"
+)
+
+// ParseAccessModePolicy parses an AccessModePolicy.
+func ParseAccessModePolicy(policy string) (AccessModePolicy, error) {
+	switch p := AccessModePolicy(policy); p {
+	case AccessModeStrict, AccessModeMostPermissive:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid access mode policy %q: must be %q or %q", policy, AccessModeStrict, AccessModeMostPermissive)
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestParseAccessModePolicy(t *testing.T) {
+	for _, policy := range []string{"strict", "most-permissive"} {
+		if p, err := ParseAccessModePolicy(policy); err != nil || string(p) != policy {
+			t.Errorf("%s: got %q, %v", policy, p, err)
+		}
+	}
+	if _, err := ParseAccessModePolicy("loose"); err == nil {
+		t.Errorf("expected error for invalid policy")
+	}
+}
+
+func TestGetVolumeCapabilitiesWithPolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		modes        []v1.PersistentVolumeAccessMode
+		policy       AccessModePolicy
+		expectedMode csi.VolumeCapability_AccessMode_Mode
+		expectError  bool
+	}{
+		{
+			name:        "ROX+RWO strict",
+			modes:       []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany, v1.ReadWriteOnce},
+			policy:      AccessModeStrict,
+			expectError: true,
+		},
+		{
+			name:         "ROX+RWO most permissive",
+			modes:        []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany, v1.ReadWriteOnce},
+			policy:       AccessModeMostPermissive,
+			expectedMode: csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+		},
+		{
+			name:         "RWX+ROX+RWO most permissive",
+			modes:        []v1.PersistentVolumeAccessMode{v1.ReadWriteMany, v1.ReadOnlyMany, v1.ReadWriteOnce},
+			policy:       AccessModeMostPermissive,
+			expectedMode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+		},
+		{
+			name:         "ROX most permissive",
+			modes:        []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany},
+			policy:       AccessModeMostPermissive,
+			expectedMode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		},
+		{
+			name:         "RWO most permissive",
+			modes:        []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			policy:       AccessModeMostPermissive,
+			expectedMode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+		{
+			name:        "no modes most permissive",
+			policy:      AccessModeMostPermissive,
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		pv := pv()
+		pv.Spec.AccessModes = test.modes
+		capability, err := GetVolumeCapabilitiesWithPolicy(&pv.Spec, test.policy)
+		if test.expectError {
+			if err == nil {
+				t.Errorf("%s: expected error, got none", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		expected := createMountCapability(defaultFSType, test.expectedMode, nil)
+		if !reflect.DeepEqual(capability, expected) {
+			t.Errorf("%s: expected capability %+v, got %+v", test.name, expected, capability)
+		}
+	}
+}
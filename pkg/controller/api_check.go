@@ -0,0 +1,88 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/discovery"
+	"k8s.io/klog"
+)
+
+const (
+	apiCheckBackoffStart = time.Second
+	apiCheckBackoffMax   = 30 * time.Second
+)
+
+// storageGroupVersion is the API version of VolumeAttachments used by the
+// attacher.
+var storageGroupVersion = storage.SchemeGroupVersion.String()
+
+// CheckAPI returns an error when the API server does not serve
+// VolumeAttachments.
+func CheckAPI(client discovery.DiscoveryInterface) error {
+	resources, err := client.ServerResourcesForGroupVersion(storageGroupVersion)
+	if err != nil {
+		return fmt.Errorf("%s API is not available: %v", storageGroupVersion, err)
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Name == "volumeattachments" {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s API does not serve volumeattachments", storageGroupVersion)
+}
+
+// WaitForAPI checks the API server with CheckAPI until it serves
+// VolumeAttachments, at most for the given timeout (0 means check once).
+// The API server is often briefly unavailable right after a control plane
+// starts. Checks are retried with exponential backoff. It returns the last
+// error when the API is still not available after the timeout or when
+// stopCh is closed.
+func WaitForAPI(client discovery.DiscoveryInterface, timeout time.Duration, stopCh <-chan struct{}) error {
+	return waitForAPI(client, clock.RealClock{}, timeout, apiCheckBackoffStart, apiCheckBackoffMax, stopCh)
+}
+
+func waitForAPI(client discovery.DiscoveryInterface, clock clock.Clock, timeout, backoff, maxBackoff time.Duration, stopCh <-chan struct{}) error {
+	deadline := clock.Now().Add(timeout)
+	for {
+		err := CheckAPI(client)
+		if err == nil {
+			return nil
+		}
+		remaining := deadline.Sub(clock.Now())
+		if remaining <= 0 {
+			return err
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+		klog.Warningf("Waiting for the Kubernetes API server, retrying in %s: %v", backoff, err)
+		select {
+		case <-stopCh:
+			return err
+		case <-clock.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func storageResources(names ...string) []*metav1.APIResourceList {
+	list := &metav1.APIResourceList{GroupVersion: "storage.k8s.io/v1beta1"}
+	for _, name := range names {
+		list.APIResources = append(list.APIResources, metav1.APIResource{Name: name})
+	}
+	return []*metav1.APIResourceList{list}
+}
+
+func TestCheckAPI(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources []*metav1.APIResourceList
+		valid     bool
+	}{
+		{
+			name:      "served",
+			resources: storageResources("csinodes", "volumeattachments"),
+			valid:     true,
+		},
+		{
+			name: "missing group",
+		},
+		{
+			name:      "missing resource",
+			resources: storageResources("csinodes"),
+		},
+	}
+	for _, test := range tests {
+		client := fake.NewSimpleClientset()
+		client.Fake.Resources = test.resources
+		err := CheckAPI(client.Discovery())
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected error, got none", test.name)
+		}
+	}
+}
+
+// flakyDiscovery fails the first checks like an API server that is starting.
+type flakyDiscovery struct {
+	discovery.DiscoveryInterface
+	failures int
+	checks   int
+}
+
+func (d *flakyDiscovery) ServerResourcesForGroupVersion(groupVersion string) (*metav1.APIResourceList, error) {
+	d.checks++
+	if d.checks <= d.failures {
+		return nil, errors.New("connection refused")
+	}
+	return d.DiscoveryInterface.ServerResourcesForGroupVersion(groupVersion)
+}
+
+func TestWaitForAPI(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.Fake.Resources = storageResources("volumeattachments")
+	d := &flakyDiscovery{DiscoveryInterface: client.Discovery(), failures: 2}
+	if err := waitForAPI(d, clock.RealClock{}, 10*time.Second, time.Millisecond, 2*time.Millisecond, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if d.checks != 3 {
+		t.Errorf("expected 3 checks, got %d", d.checks)
+	}
+}
+
+func TestWaitForAPITimeout(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	d := &flakyDiscovery{DiscoveryInterface: client.Discovery(), failures: 100}
+	start := time.Date(2019, 10, 14, 12, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(start)
+	done := make(chan error)
+	go func() {
+		done <- waitForAPI(d, fakeClock, time.Minute, time.Second, 30*time.Second, nil)
+	}()
+
+	// Advance the clock by a second whenever waitForAPI waits.
+	for {
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("expected error, got none")
+			}
+			// Checks at 0s, 1s, 3s, 7s, 15s, 31s and at the timeout.
+			if d.checks != 7 {
+				t.Errorf("expected 7 checks, got %d", d.checks)
+			}
+			if elapsed := fakeClock.Since(start); elapsed != time.Minute {
+				t.Errorf("expected to wait for the timeout, returned after %s", elapsed)
+			}
+			return
+		default:
+			if fakeClock.HasWaiters() {
+				fakeClock.Step(time.Second)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/klog"
+)
+
+// Stages of processing of VolumeAttachments.
+const (
+	stageCSI      = "csi"
+	stageAPIWrite = "api_write"
+)
+
+// errWriteQueued is returned by syncAttach and syncDetach when the result of
+// their CSI call is saved by the API writers.
+var errWriteQueued = errors.New("saving of the result is queued")
+
+// errWritersStopped is passed to done of a write that was not queued because
+// the API writers stopped.
+var errWritersStopped = errors.New("API writers stopped")
+
+// apiWriter is a bounded pool of goroutines that save results of
+// ControllerPublish and ControllerUnpublish to the API server. VolumeAttachment
+// workers hand the writes over through a channel and process the next
+// VolumeAttachment, so a slow API server does not hold CSI calls and slow CSI
+// calls don't hold the writes. The channel is as long as the pool, workers
+// wait when it's full.
+type apiWriter struct {
+	driver  string
+	writers int
+	jobs    chan *writeJob
+	clock   clock.Clock
+	// stopCh is closed when the writers stop.
+	stopCh <-chan struct{}
+	// running are the writers that did not finish yet.
+	running sync.WaitGroup
+
+	lock sync.Mutex
+	// pending are names of VolumeAttachments with a queued or running
+	// write, with true when they need processing after it.
+	pending map[string]bool
+}
+
+type writeJob struct {
+	vaName string
+	write  func() error
+	done   func(err error, requeue bool)
+	queued time.Time
+}
+
+func newAPIWriter(driver string, writers int, clk clock.Clock) *apiWriter {
+	return &apiWriter{
+		driver:  driver,
+		writers: writers,
+		jobs:    make(chan *writeJob, writers),
+		clock:   clk,
+		pending: map[string]bool{},
+	}
+}
+
+// submit queues write of VolumeAttachment vaName. done is called with its
+// result and requeue true when the VolumeAttachment was synced during the
+// write. It waits while the queue is full.
+func (w *apiWriter) submit(vaName string, write func() error, done func(err error, requeue bool)) {
+	w.lock.Lock()
+	w.pending[vaName] = false
+	w.lock.Unlock()
+
+	select {
+	case w.jobs <- &writeJob{vaName: vaName, write: write, done: done, queued: w.clock.Now()}:
+		pipelineQueueLength.WithLabelValues(w.driver, stageAPIWrite).Set(float64(len(w.jobs)))
+	case <-w.stopCh:
+		// The next leader processes the VolumeAttachment again.
+		klog.V(4).Infof("API writers stopped, dropping write of %q", vaName)
+		w.lock.Lock()
+		delete(w.pending, vaName)
+		w.lock.Unlock()
+		done(errWritersStopped, true)
+	}
+}
+
+// busy returns true when VolumeAttachment vaName has a queued or running
+// write. done of the write then gets requeue true.
+func (w *apiWriter) busy(vaName string) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, found := w.pending[vaName]; !found {
+		return false
+	}
+	w.pending[vaName] = true
+	return true
+}
+
+// run starts the writers. When stopCh is closed, they save the queued
+// results and stop. It must be called before the first submit.
+func (w *apiWriter) run(stopCh <-chan struct{}) {
+	w.stopCh = stopCh
+	for i := 0; i < w.writers; i++ {
+		w.running.Add(1)
+		go func() {
+			defer w.running.Done()
+			for {
+				select {
+				case job := <-w.jobs:
+					w.process(job)
+				case <-stopCh:
+					w.drain()
+					return
+				}
+			}
+		}()
+	}
+}
+
+// wait waits until the writers stop and saves results that were queued
+// after they stopped. It must be called after the VolumeAttachment workers
+// finished.
+func (w *apiWriter) wait() {
+	w.running.Wait()
+	w.drain()
+}
+
+// drain saves all queued results.
+func (w *apiWriter) drain() {
+	for {
+		select {
+		case job := <-w.jobs:
+			w.process(job)
+		default:
+			return
+		}
+	}
+}
+
+func (w *apiWriter) process(job *writeJob) {
+	pipelineQueueLength.WithLabelValues(w.driver, stageAPIWrite).Set(float64(len(w.jobs)))
+	apiWriteQueueWait.WithLabelValues(w.driver).Observe(w.clock.Since(job.queued).Seconds())
+	err := job.write()
+
+	w.lock.Lock()
+	requeue := w.pending[job.vaName]
+	delete(w.pending, job.vaName)
+	w.lock.Unlock()
+
+	job.done(err, requeue)
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"testing"
+
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	core "k8s.io/client-go/testing"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
+)
+
+func apiWriterHandlerFactory(client kubernetes.Interface, informerFactory informers.SharedInformerFactory, csi attacher.Attacher) Handler {
+	handler := csiHandlerFactory(client, informerFactory, csi)
+	writer := newAPIWriter(testAttacherName, 1, clock.RealClock{})
+	// The writers of each test case run until the end of the tests.
+	writer.run(make(chan struct{}))
+	handler.(*csiHandler).apiWriter = writer
+	return handler
+}
+
+func TestAPIWriter(t *testing.T) {
+	w := newAPIWriter("csi/api-writer", 1, clock.RealClock{})
+	mockErr := errors.New("mock error")
+	var gotErr error
+	var gotRequeue bool
+	w.submit("va", func() error { return mockErr }, func(err error, requeue bool) {
+		gotErr, gotRequeue = err, requeue
+	})
+	if w.busy("other") {
+		t.Errorf("expected VolumeAttachment without a write not to be busy")
+	}
+	if !w.busy("va") {
+		t.Errorf("expected VolumeAttachment with a queued write to be busy")
+	}
+	if length := pipelineQueueLength.WithLabelValues("csi/api-writer", stageAPIWrite).Value(); length != 1 {
+		t.Errorf("expected api_write queue length 1, got %v", length)
+	}
+
+	waits := apiWriteQueueWait.WithLabelValues("csi/api-writer").Count()
+	w.process(<-w.jobs)
+	if gotErr != mockErr {
+		t.Errorf("expected error %v, got %v", mockErr, gotErr)
+	}
+	if !gotRequeue {
+		t.Errorf("expected requeue of VolumeAttachment synced during its write")
+	}
+	if w.busy("va") {
+		t.Errorf("expected VolumeAttachment not to be busy after its write")
+	}
+	if count := apiWriteQueueWait.WithLabelValues("csi/api-writer").Count() - waits; count != 1 {
+		t.Errorf("expected 1 observed wait, got %d", count)
+	}
+
+	w.submit("va", func() error { return nil }, func(err error, requeue bool) {
+		gotErr, gotRequeue = err, requeue
+	})
+	w.process(<-w.jobs)
+	if gotErr != nil || gotRequeue {
+		t.Errorf("expected success without requeue, got error %v and requeue %v", gotErr, gotRequeue)
+	}
+}
+
+func TestAPIWriterStopped(t *testing.T) {
+	w := newAPIWriter("csi/api-writer-stopped", 1, clock.RealClock{})
+	stopCh := make(chan struct{})
+	close(stopCh)
+	w.stopCh = stopCh
+	// The queue is full.
+	w.jobs <- &writeJob{vaName: "queued", write: func() error { return nil }, done: func(error, bool) {}}
+
+	var gotErr error
+	var gotRequeue bool
+	w.submit("va", func() error { return nil }, func(err error, requeue bool) {
+		gotErr, gotRequeue = err, requeue
+	})
+	if gotErr != errWritersStopped || !gotRequeue {
+		t.Errorf("expected error %v with requeue, got error %v and requeue %v", errWritersStopped, gotErr, gotRequeue)
+	}
+	if w.busy("va") {
+		t.Errorf("expected VolumeAttachment with a dropped write not to be busy")
+	}
+}
+
+func TestAPIWriterDrainsOnStop(t *testing.T) {
+	w := newAPIWriter("csi/api-writer-drain", 1, clock.RealClock{})
+	written := false
+	var gotErr error
+	w.submit("va", func() error {
+		written = true
+		return nil
+	}, func(err error, requeue bool) {
+		gotErr = err
+	})
+
+	stopCh := make(chan struct{})
+	close(stopCh)
+	w.run(stopCh)
+	w.wait()
+	if !written || gotErr != nil {
+		t.Errorf("expected the queued result to be saved on stop, got written %v and error %v", written, gotErr)
+	}
+	if w.busy("va") {
+		t.Errorf("expected VolumeAttachment not to be busy after its write")
+	}
+}
+
+func TestCSIHandlerAPIWriters(t *testing.T) {
+	vaGroupResourceVersion := schema.GroupVersionResource{
+		Group:    storage.GroupName,
+		Version:  "v1beta1",
+		Resource: "volumeattachments",
+	}
+	var noMetadata map[string]string
+	var noAttrs map[string]string
+	var noSecrets map[string]string
+	var success error
+	var readWrite = false
+	var notDetached = false
+	var ignored = false
+
+	tests := []testCase{
+		{
+			name:           "attach -> status saved by API writer",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        va(false, "", nil),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false, "", nil),
+						va(false, fin, ann))),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false, fin, ann),
+						va(true, fin, ann))),
+			},
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, noMetadata, 0},
+			},
+		},
+		{
+			name:           "detach -> finalizer removed by API writer",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        deleted(va(true, fin, ann)),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(deleted(va(true, fin, ann)),
+						deleted(va(false, "", ann)))),
+			},
+			expectedCSICalls: []csiCall{
+				{"detach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, ignored, noMetadata, 0},
+			},
+		},
+	}
+	runTests(t, apiWriterHandlerFactory, tests)
+}
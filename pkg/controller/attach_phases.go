@@ -0,0 +1,302 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	csitranslationlib "k8s.io/csi-translation-lib"
+	"k8s.io/klog"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/hooks"
+	"github.com/kubernetes-csi/external-attacher/pkg/logging"
+	"github.com/kubernetes-csi/external-attacher/pkg/policy"
+)
+
+// Phases of an attach, in the order in which they run.
+const (
+	// phaseResolvePV gets the volume source, its attributes, capabilities
+	// and secrets.
+	phaseResolvePV = "resolve_pv"
+	// phaseResolveNode gets the node ID and checks the attach policy.
+	phaseResolveNode = "resolve_node"
+	// phaseAddFinalizers saves the PV finalizer, the VolumeAttachment
+	// finalizer and the node ID annotation.
+	phaseAddFinalizers = "add_finalizers"
+	// phasePublish calls ControllerPublish.
+	phasePublish = "publish"
+	// phaseWriteStatus marks the VolumeAttachment as attached.
+	phaseWriteStatus = "write_status"
+)
+
+// attachState is passed from one phase of an attach to the next one.
+type attachState struct {
+	va *storage.VolumeAttachment
+	// pv is the PV of the VolumeAttachment as stored in the API server,
+	// nil for inline volumes.
+	pv *v1.PersistentVolume
+	// policyPV is pv translated to CSI when it was migrated.
+	policyPV  *v1.PersistentVolume
+	csiSource *v1.CSIPersistentVolumeSource
+
+	volumeHandle string
+	readOnly     bool
+	attributes   map[string]string
+	capabilities *csi.VolumeCapability
+	secrets      map[string]string
+	nodeID       string
+
+	// publishContext is returned by ControllerPublish.
+	publishContext map[string]string
+}
+
+// runPhase runs a phase of an attach of va and records its duration and
+// result.
+func (h *csiHandler) runPhase(va *storage.VolumeAttachment, phase string, run func() error) error {
+	start := h.clock.Now()
+	err := run()
+	duration := h.clock.Since(start)
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	attachPhaseDuration.WithLabelValues(h.attacherName, phase, result).Observe(duration.Seconds())
+	if klog.V(4) {
+		klog.Infof("Attach phase %s of %q finished: %s%s", phase, va.Name, result, h.logFields(va, "attach", logging.KeyPhase, phase, logging.KeyDurationMs, duration))
+	}
+	return err
+}
+
+// csiAttach runs the phases of an attach up to ControllerPublish. It returns
+// their state also on error, with the VolumeAttachment as saved by the
+// phases.
+func (h *csiHandler) csiAttach(va *storage.VolumeAttachment) (*attachState, error) {
+	klog.V(4).Infof("Starting attach operation for %q", va.Name)
+	state := &attachState{va: va}
+	phases := []struct {
+		name string
+		run  func(*attachState) error
+	}{
+		{phaseResolvePV, h.resolvePV},
+		{phaseResolveNode, h.resolveNode},
+		{phaseAddFinalizers, h.addAttachFinalizers},
+		{phasePublish, h.publish},
+	}
+	for _, phase := range phases {
+		err := h.runPhase(state.va, phase.name, func() error { return phase.run(state) })
+		if err != nil {
+			return state, err
+		}
+	}
+	return state, nil
+}
+
+// resolvePV gets the CSI source of the volume and everything that is passed
+// to ControllerPublish except the node ID, checks node affinity of the PV and
+// admits the attach by quotas. Check as much as possible before adding VA
+// finalizer - it would block deletion of VA on error.
+func (h *csiHandler) resolvePV(state *attachState) error {
+	if err := h.resolveVolume(state); err != nil {
+		return err
+	}
+	if state.pv != nil {
+		if err := h.checkNodeAffinity(state.va, state.pv); err != nil {
+			return err
+		}
+		if h.quotas != nil {
+			if err := h.quotas.admit(state.va, state.pv); err != nil {
+				return err
+			}
+		}
+	}
+	var err error
+	state.secrets, err = h.getCredentialsFromPV(state.csiSource)
+	return err
+}
+
+// resolveVolume is resolvePV without secrets, node affinity and quotas. It
+// has no side effects, so it can be used also to compute inputs of
+// ControllerPublish.
+func (h *csiHandler) resolveVolume(state *attachState) error {
+	va := state.va
+	var pvSpec *v1.PersistentVolumeSpec
+	if va.Spec.Source.PersistentVolumeName != nil {
+		if va.Spec.Source.InlineVolumeSpec != nil {
+			return errors.New("both InlineCSIVolumeSource and PersistentVolumeName specified in VA source")
+		}
+		pv, err := h.pvLister.Get(*va.Spec.Source.PersistentVolumeName)
+		if err != nil {
+			return err
+		}
+		// Refuse to attach volumes that are marked for deletion.
+		if pv.DeletionTimestamp != nil {
+			return fmt.Errorf("PersistentVolume %q is marked for deletion", pv.Name)
+		}
+		state.pv = pv
+
+		if csitranslationlib.IsPVMigratable(pv) {
+			pv, err = csitranslationlib.TranslateInTreePVToCSI(pv)
+			if err != nil {
+				return fmt.Errorf("failed to translate in tree pv to CSI: %v", err)
+			}
+		}
+
+		// Both csiSource and pvSpec could be translated here if the PV was
+		// migrated
+		state.csiSource, err = getCSISource(pv)
+		if err != nil {
+			return err
+		}
+
+		pvSpec = &pv.Spec
+		state.policyPV = pv
+	} else if va.Spec.Source.InlineVolumeSpec != nil {
+		if va.Spec.Source.InlineVolumeSpec.CSI != nil {
+			state.csiSource = va.Spec.Source.InlineVolumeSpec.CSI
+		} else {
+			return errors.New("inline volume spec contains nil CSI source")
+		}
+
+		pvSpec = va.Spec.Source.InlineVolumeSpec
+	} else {
+		return errors.New("neither InlineCSIVolumeSource nor PersistentVolumeName specified in VA source")
+	}
+
+	attributes, err := GetVolumeAttributes(state.csiSource)
+	if err != nil {
+		return err
+	}
+	state.attributes = h.addPublishParameters(va, state.policyPV, attributes)
+
+	state.volumeHandle, state.readOnly, err = GetVolumeHandle(state.csiSource)
+	if err != nil {
+		return err
+	}
+	if !h.supportsPublishReadOnly {
+		// "CO MUST set this field to false if SP does not have the
+		// PUBLISH_READONLY controller capability"
+		state.readOnly = false
+	}
+
+	state.capabilities, err = h.getPublishCapability(va, state.policyPV, pvSpec)
+	return err
+}
+
+// resolveNode gets the node ID, checks the attach policy and detaches the
+// volume from the old ID when the node ID changed.
+func (h *csiHandler) resolveNode(state *attachState) error {
+	nodeID, err := h.getNodeID(h.attacherName, state.va.Spec.NodeName, nil)
+	if err != nil {
+		return err
+	}
+	state.nodeID = nodeID
+	if err := h.checkPolicy(state.va, policy.OperationAttach, state.policyPV, state.csiSource, nodeID); err != nil {
+		return err
+	}
+	state.va, err = h.detachFromChangedNodeID(state.va, state.policyPV, state.volumeHandle, nodeID, state.secrets)
+	return err
+}
+
+// addAttachFinalizers saves the PV finalizer and the VolumeAttachment
+// finalizer with the node ID annotation.
+func (h *csiHandler) addAttachFinalizers(state *attachState) error {
+	if state.pv != nil && !h.disablePVFinalizer {
+		if _, err := h.addPVFinalizer(state.pv); err != nil {
+			return wrapError("could not add PersistentVolume finalizer", err)
+		}
+	}
+
+	originalVA := state.va
+	va, finalizerAdded := h.prepareVAFinalizer(originalVA)
+	va, nodeIDAdded := h.prepareVANodeID(va, state.nodeID)
+	if finalizerAdded || nodeIDAdded {
+		var err error
+		if va, err = h.patchVA(originalVA, va); err != nil {
+			return wrapError("could not save VolumeAttachment", err)
+		}
+	}
+	state.va = va
+	return nil
+}
+
+// publish runs the pre-attach hook and calls ControllerPublish.
+func (h *csiHandler) publish(state *attachState) error {
+	va := state.va
+	// After the finalizer is saved, so the post-detach hook runs also when
+	// the attach fails.
+	if err := h.runHook(hooks.PreAttach, va, state.csiSource, state.nodeID, state.readOnly); err != nil {
+		return err
+	}
+	if err := h.controllerPublish(state); err != nil {
+		return err
+	}
+	h.checkNodeSoftLimit(va)
+	return nil
+}
+
+// controllerPublish calls ControllerPublish with the resolved state when the
+// circuit breaker allows it and saves the returned PublishContext in state.
+func (h *csiHandler) controllerPublish(state *attachState) error {
+	va := state.va
+	token, err := h.breaker.allow()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(withCorrelationID(context.Background(), h.correlationID(va)), h.volumeTimeout(va, state.policyPV))
+	defer cancel()
+	// We're not interested in `detached` return value, the controller will
+	// issue Detach to be sure the volume is really detached.
+	start := h.clock.Now()
+	publishInfo, _, err := h.attacher.Attach(ctx, state.volumeHandle, state.readOnly, state.nodeID, state.capabilities, state.attributes, state.secrets)
+	h.observeOperation("attach", state.policyPV, h.clock.Since(start), err)
+	h.recordCSIResult(token, err)
+	if err != nil {
+		return h.explainPublishConflict(va, err)
+	}
+	h.checkSlowOperation(va, "attach", state.volumeHandle, h.clock.Since(start))
+
+	state.publishContext = publishInfo
+	return nil
+}
+
+// writeStatus marks the VolumeAttachment of state as attached with its
+// PublishContext after ControllerPublish started at publishStarted and
+// finished at publishFinished.
+func (h *csiHandler) writeStatus(state *attachState, publishStarted, publishFinished time.Time) error {
+	va := state.va
+	metadata := h.excludeMetadata(va, state.publishContext)
+	var annotations map[string]string
+	if h.progressAnnotations {
+		annotations = h.attachProgress(va, publishStarted, publishFinished, h.clock.Now())
+	}
+	if h.skipUnchangedRepublish {
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[PublishInputsHashAnnotation] = publishInputsHash(state)
+	}
+	if _, err := markAsAttached(h.client, va, metadata, annotations); err != nil {
+		return wrapError("failed to mark as attached", err)
+	}
+	return nil
+}
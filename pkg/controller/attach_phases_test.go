@@ -0,0 +1,70 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+func TestRunPhase(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	h := &csiHandler{attacherName: "csi/phases", clock: fakeClock}
+	v := va(false, "", nil)
+
+	err := h.runPhase(v, phasePublish, func() error {
+		fakeClock.Step(2 * time.Second)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	mockErr := errors.New("mock error")
+	if err := h.runPhase(v, phaseWriteStatus, func() error { return mockErr }); err != mockErr {
+		t.Errorf("expected error %v, got %v", mockErr, err)
+	}
+
+	for _, labels := range [][]string{
+		{"csi/phases", phasePublish, "success"},
+		{"csi/phases", phaseWriteStatus, "error"},
+	} {
+		if count := attachPhaseDuration.WithLabelValues(labels...).Count(); count != 1 {
+			t.Errorf("expected 1 observation with labels %v, got %d", labels, count)
+		}
+	}
+}
+
+func TestCSIAttachStopsAtFailedPhase(t *testing.T) {
+	h := &csiHandler{attacherName: "csi/failed-phase", clock: clock.RealClock{}}
+	_, err := h.csiAttach(vaWithNoPVReferenceNorInlineVolumeSpec(va(false, "", nil)))
+	if err == nil {
+		t.Fatalf("expected error, got none")
+	}
+	if count := attachPhaseDuration.WithLabelValues("csi/failed-phase", phaseResolvePV, "error").Count(); count != 1 {
+		t.Errorf("expected failed %s, got %d observations", phaseResolvePV, count)
+	}
+	for _, phase := range []string{phaseResolveNode, phaseAddFinalizers, phasePublish} {
+		for _, result := range []string{"success", "error"} {
+			if count := attachPhaseDuration.WithLabelValues("csi/failed-phase", phase, result).Count(); count != 0 {
+				t.Errorf("expected no %s after the failed phase, got %d observations", phase, count)
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/metrics"
+)
+
+// sliWindows are the sliding windows of the attach SLI.
+var sliWindows = []struct {
+	name   string
+	length time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"30m", 30 * time.Minute},
+	{"6h", 6 * time.Hour},
+}
+
+const (
+	// sliBucket is the resolution of the windows.
+	sliBucket = 10 * time.Second
+	// sliBuckets is the number of buckets of the longest window.
+	sliBuckets = int(6 * time.Hour / sliBucket)
+)
+
+// attachSLI counts attach attempts of all drivers of the process.
+var attachSLI = newSLICounter()
+
+// sliCounter counts attempts and successes of each driver in buckets of
+// sliBucket in a ring that covers the longest window.
+type sliCounter struct {
+	lock    sync.Mutex
+	drivers map[string]*[sliBuckets]sliCount
+}
+
+type sliCount struct {
+	// bucket is the index of the bucket since the epoch that the counts
+	// belong to.
+	bucket    int64
+	attempts  float64
+	successes float64
+}
+
+func newSLICounter() *sliCounter {
+	return &sliCounter{drivers: map[string]*[sliBuckets]sliCount{}}
+}
+
+// record counts an attempt of driver at now.
+func (c *sliCounter) record(driver string, now time.Time, success bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ring, found := c.drivers[driver]
+	if !found {
+		ring = &[sliBuckets]sliCount{}
+		c.drivers[driver] = ring
+	}
+	bucket := now.UnixNano() / int64(sliBucket)
+	count := &ring[bucket%int64(sliBuckets)]
+	if count.bucket != bucket {
+		*count = sliCount{bucket: bucket}
+	}
+	count.attempts++
+	if success {
+		count.successes++
+	}
+}
+
+// sum returns attempts and successes of driver in window ending at now.
+// It must be called with c.lock held.
+func (c *sliCounter) sum(driver string, window time.Duration, now time.Time) (attempts, successes float64) {
+	ring := c.drivers[driver]
+	last := now.UnixNano() / int64(sliBucket)
+	for bucket := last - int64(window/sliBucket) + 1; bucket <= last; bucket++ {
+		if count := ring[bucket%int64(sliBuckets)]; count.bucket == bucket {
+			attempts += count.attempts
+			successes += count.successes
+		}
+	}
+	return attempts, successes
+}
+
+// values returns attempts partitioned by driver, window and result and
+// success ratios partitioned by driver and window at now. Windows without
+// attempts have no ratio.
+func (c *sliCounter) values(now time.Time) (attempts, ratios []metrics.LabeledValue) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var drivers []string
+	for driver := range c.drivers {
+		drivers = append(drivers, driver)
+	}
+	sort.Strings(drivers)
+	for _, driver := range drivers {
+		for _, window := range sliWindows {
+			total, successes := c.sum(driver, window.length, now)
+			attempts = append(attempts,
+				metrics.LabeledValue{LabelValues: []string{driver, window.name, "success"}, Value: successes},
+				metrics.LabeledValue{LabelValues: []string{driver, window.name, "error"}, Value: total - successes})
+			if total > 0 {
+				ratios = append(ratios, metrics.LabeledValue{LabelValues: []string{driver, window.name}, Value: successes / total})
+			}
+		}
+	}
+	return attempts, ratios
+}
+
+var (
+	// attachSLIAttempts and attachSLIRatio report attachSLI.
+	attachSLIAttempts = metrics.NewGaugeVecFunc(
+		metrics.Namespace+"_attach_sli_attempts",
+		"Number of attach attempts of the driver in the last window (\"5m\", \"30m\" or \"6h\"), partitioned by result (\"success\" or \"error\"). Attaches that wait, e.g. for quota or for the driver on the node, are not attempts.",
+		func() []metrics.LabeledValue {
+			attempts, _ := attachSLI.values(time.Now())
+			return attempts
+		},
+		"driver", "window", "result")
+	attachSLIRatio = metrics.NewGaugeVecFunc(
+		metrics.Namespace+"_attach_sli_success_ratio",
+		"Ratio of successful attach attempts of the driver in the last window (\"5m\", \"30m\" or \"6h\"). Not reported for windows without attempts.",
+		func() []metrics.LabeledValue {
+			_, ratios := attachSLI.values(time.Now())
+			return ratios
+		},
+		"driver", "window")
+)
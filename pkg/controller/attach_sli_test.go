@@ -0,0 +1,71 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/metrics"
+)
+
+func TestSLICounter(t *testing.T) {
+	c := newSLICounter()
+	start := time.Date(2019, 10, 14, 12, 0, 0, 0, time.UTC)
+	c.record("csi/a", start.Add(-7*time.Hour), false)
+	c.record("csi/a", start.Add(-2*time.Hour), false)
+	c.record("csi/a", start.Add(-10*time.Minute), true)
+	c.record("csi/a", start.Add(-time.Minute), true)
+	c.record("csi/a", start, false)
+	c.record("csi/b", start.Add(-time.Hour), true)
+
+	attempts, ratios := c.values(start)
+	expectedAttempts := []metrics.LabeledValue{
+		{LabelValues: []string{"csi/a", "5m", "success"}, Value: 1},
+		{LabelValues: []string{"csi/a", "5m", "error"}, Value: 1},
+		{LabelValues: []string{"csi/a", "30m", "success"}, Value: 2},
+		{LabelValues: []string{"csi/a", "30m", "error"}, Value: 1},
+		{LabelValues: []string{"csi/a", "6h", "success"}, Value: 2},
+		{LabelValues: []string{"csi/a", "6h", "error"}, Value: 2},
+		{LabelValues: []string{"csi/b", "5m", "success"}, Value: 0},
+		{LabelValues: []string{"csi/b", "5m", "error"}, Value: 0},
+		{LabelValues: []string{"csi/b", "30m", "success"}, Value: 0},
+		{LabelValues: []string{"csi/b", "30m", "error"}, Value: 0},
+		{LabelValues: []string{"csi/b", "6h", "success"}, Value: 1},
+		{LabelValues: []string{"csi/b", "6h", "error"}, Value: 0},
+	}
+	if !reflect.DeepEqual(attempts, expectedAttempts) {
+		t.Errorf("expected attempts %+v, got %+v", expectedAttempts, attempts)
+	}
+	expectedRatios := []metrics.LabeledValue{
+		{LabelValues: []string{"csi/a", "5m"}, Value: 0.5},
+		{LabelValues: []string{"csi/a", "30m"}, Value: 2.0 / 3},
+		{LabelValues: []string{"csi/a", "6h"}, Value: 0.5},
+		{LabelValues: []string{"csi/b", "6h"}, Value: 1},
+	}
+	if !reflect.DeepEqual(ratios, expectedRatios) {
+		t.Errorf("expected ratios %+v, got %+v", expectedRatios, ratios)
+	}
+
+	// A bucket of the ring is reused after the longest window.
+	later := start.Add(6 * time.Hour)
+	c.record("csi/a", later, true)
+	if total, successes := c.sum("csi/a", 6*time.Hour, later); total != 1 || successes != 1 {
+		t.Errorf("expected 1 successful attempt after the window, got %v of %v", successes, total)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// BackoffState is backoff of a single work item.
+type BackoffState struct {
+	Key       string    `json:"key"`
+	Failures  int       `json:"failures"`
+	NotBefore time.Time `json:"notBefore"`
+}
+
+// BackoffRateLimiter does baseDelay*2^<num-failures> limit, like
+// workqueue.ItemExponentialFailureRateLimiter. In addition, its state can be
+// saved and restored in another process, so a new leader continues with
+// the retry schedule of the previous one.
+type BackoffRateLimiter struct {
+	lock      sync.Mutex
+	failures  map[interface{}]int
+	notBefore map[interface{}]time.Time
+	// postponed are items restored from a snapshot that were not processed
+	// yet.
+	postponed map[interface{}]time.Time
+
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	clock     clock.Clock
+}
+
+var _ workqueue.RateLimiter = &BackoffRateLimiter{}
+
+// NewBackoffRateLimiter returns a new BackoffRateLimiter.
+func NewBackoffRateLimiter(baseDelay time.Duration, maxDelay time.Duration) *BackoffRateLimiter {
+	return NewBackoffRateLimiterWithClock(baseDelay, maxDelay, clock.RealClock{})
+}
+
+// NewBackoffRateLimiterWithClock returns a new BackoffRateLimiter that
+// computes backoff deadlines from given clock.
+func NewBackoffRateLimiterWithClock(baseDelay time.Duration, maxDelay time.Duration, clock clock.Clock) *BackoffRateLimiter {
+	return &BackoffRateLimiter{
+		failures:  map[interface{}]int{},
+		notBefore: map[interface{}]time.Time{},
+		postponed: map[interface{}]time.Time{},
+		baseDelay: baseDelay,
+		maxDelay:  maxDelay,
+		clock:     clock,
+	}
+}
+
+func (r *BackoffRateLimiter) When(item interface{}) time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	exp := r.failures[item]
+	r.failures[item] = r.failures[item] + 1
+
+	// The backoff is capped such that 'calculated' value never overflows.
+	delay := r.maxDelay
+	backoff := float64(r.baseDelay.Nanoseconds()) * math.Pow(2, float64(exp))
+	if backoff <= math.MaxInt64 && time.Duration(backoff) < r.maxDelay {
+		delay = time.Duration(backoff)
+	}
+	r.notBefore[item] = r.clock.Now().Add(delay)
+	delete(r.postponed, item)
+	return delay
+}
+
+func (r *BackoffRateLimiter) NumRequeues(item interface{}) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.failures[item]
+}
+
+func (r *BackoffRateLimiter) Forget(item interface{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.failures, item)
+	delete(r.notBefore, item)
+	delete(r.postponed, item)
+}
+
+// SetDelays changes the initial and maximum delay. Items that already failed
+// get the new delays on their next failure.
+func (r *BackoffRateLimiter) SetDelays(baseDelay time.Duration, maxDelay time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.baseDelay = baseDelay
+	r.maxDelay = maxDelay
+}
+
+// Postponed returns how long processing of an item restored from a snapshot
+// should wait. It returns 0 for items that were not restored, items whose
+// backoff already expired and for items that were already processed.
+func (r *BackoffRateLimiter) Postponed(item interface{}) time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	notBefore, found := r.postponed[item]
+	if !found {
+		return 0
+	}
+	delay := notBefore.Sub(r.clock.Now())
+	if delay <= 0 {
+		delete(r.postponed, item)
+		return 0
+	}
+	return delay
+}
+
+// Snapshot returns backoff of all failed items, sorted by key. Only items
+// with string keys are included.
+func (r *BackoffRateLimiter) Snapshot() []BackoffState {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	states := make([]BackoffState, 0, len(r.failures))
+	for item, failures := range r.failures {
+		key, ok := item.(string)
+		if !ok {
+			continue
+		}
+		states = append(states, BackoffState{Key: key, Failures: failures, NotBefore: r.notBefore[item]})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Key < states[j].Key })
+	return states
+}
+
+// Restore restores backoff of items from a snapshot. Items that already
+// failed in this process are not overwritten.
+func (r *BackoffRateLimiter) Restore(states []BackoffState) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, state := range states {
+		if _, found := r.failures[state.Key]; found {
+			continue
+		}
+		r.failures[state.Key] = state.Failures
+		r.notBefore[state.Key] = state.NotBefore
+		r.postponed[state.Key] = state.NotBefore
+	}
+}
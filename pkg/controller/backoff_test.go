@@ -0,0 +1,86 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+func TestBackoffRateLimiter(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := NewBackoffRateLimiterWithClock(time.Second, 5*time.Second, clock.NewFakeClock(now))
+
+	for i, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if delay := r.When("va"); delay != expected {
+			t.Errorf("failure %d: expected delay %s, got %s", i, expected, delay)
+		}
+	}
+	if n := r.NumRequeues("va"); n != 5 {
+		t.Errorf("expected 5 requeues, got %d", n)
+	}
+	r.When("other")
+
+	expected := []BackoffState{
+		{Key: "other", Failures: 1, NotBefore: now.Add(time.Second)},
+		{Key: "va", Failures: 5, NotBefore: now.Add(5 * time.Second)},
+	}
+	if snapshot := r.Snapshot(); !reflect.DeepEqual(snapshot, expected) {
+		t.Errorf("unexpected snapshot: %+v", snapshot)
+	}
+
+	r.Forget("va")
+	if n := r.NumRequeues("va"); n != 0 {
+		t.Errorf("expected 0 requeues after Forget, got %d", n)
+	}
+}
+
+func TestBackoffRateLimiterRestore(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := NewBackoffRateLimiterWithClock(time.Second, time.Minute, clock.NewFakeClock(now))
+	r.When("local")
+
+	r.Restore([]BackoffState{
+		{Key: "restored", Failures: 3, NotBefore: now.Add(10 * time.Second)},
+		{Key: "expired", Failures: 2, NotBefore: now.Add(-time.Second)},
+		{Key: "local", Failures: 10, NotBefore: now.Add(time.Hour)},
+	})
+
+	if delay := r.Postponed("restored"); delay != 10*time.Second {
+		t.Errorf("expected restored item to be postponed by 10s, got %s", delay)
+	}
+	if delay := r.Postponed("expired"); delay != 0 {
+		t.Errorf("expected expired item not to be postponed, got %s", delay)
+	}
+	if delay := r.Postponed("local"); delay != 0 {
+		t.Errorf("expected local item not to be overwritten, got %s", delay)
+	}
+	if n := r.NumRequeues("local"); n != 1 {
+		t.Errorf("expected local item not to be overwritten, got %d requeues", n)
+	}
+
+	// The retry schedule continues where the previous leader stopped.
+	if delay := r.When("restored"); delay != 8*time.Second {
+		t.Errorf("expected delay 8s, got %s", delay)
+	}
+	if delay := r.Postponed("restored"); delay != 0 {
+		t.Errorf("expected processed item not to be postponed, got %s", delay)
+	}
+}
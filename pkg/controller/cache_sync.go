@@ -0,0 +1,58 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+)
+
+const cacheSyncPollPeriod = 100 * time.Millisecond
+
+// WaitForCacheSync waits until all given informers are synced, at most for the
+// given timeout (0 means no timeout). It returns sorted names of informers
+// that have not synced in time, typically because the attacher is missing
+// RBAC permissions to list or watch the objects. An empty result means that
+// all caches are synced.
+func WaitForCacheSync(informers map[string]cache.InformerSynced, timeout time.Duration, stopCh <-chan struct{}) []string {
+	unsynced := func() []string {
+		var names []string
+		for name, synced := range informers {
+			if !synced() {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	start := time.Now()
+	wait.PollImmediateUntil(cacheSyncPollPeriod, func() (bool, error) {
+		if len(unsynced()) == 0 {
+			return true, nil
+		}
+		if timeout > 0 && time.Since(start) >= timeout {
+			// Give up
+			return true, nil
+		}
+		return false, nil
+	}, stopCh)
+	return unsynced()
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestWaitForCacheSync(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	// Simulate missing RBAC for CSINodes
+	client.PrependReactor("list", "csinodes", func(action core.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("csinodes.storage.k8s.io is forbidden")
+	})
+	factory := informers.NewSharedInformerFactory(client, 0)
+	synced := map[string]cache.InformerSynced{
+		"PersistentVolume": factory.Core().V1().PersistentVolumes().Informer().HasSynced,
+		"VolumeAttachment": factory.Storage().V1beta1().VolumeAttachments().Informer().HasSynced,
+		"CSINode":          factory.Storage().V1beta1().CSINodes().Informer().HasSynced,
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	factory.Start(stopCh)
+
+	unsynced := WaitForCacheSync(synced, 500*time.Millisecond, stopCh)
+	expected := []string{"CSINode"}
+	if !reflect.DeepEqual(unsynced, expected) {
+		t.Errorf("expected unsynced informers %v, got %v", expected, unsynced)
+	}
+}
+
+func TestWaitForCacheSyncAllSynced(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.PersistentVolume{})
+	factory := informers.NewSharedInformerFactory(client, 0)
+	synced := map[string]cache.InformerSynced{
+		"PersistentVolume": factory.Core().V1().PersistentVolumes().Informer().HasSynced,
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	factory.Start(stopCh)
+
+	if unsynced := WaitForCacheSync(synced, 0, stopCh); len(unsynced) != 0 {
+		t.Errorf("expected all informers to be synced, got %v", unsynced)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/klog"
+)
+
+// halfOpenRetryInterval is the delay of operations that wait while another
+// call probes whether the driver recovered.
+const halfOpenRetryInterval = time.Second
+
+// circuitOpenError is returned instead of a CSI call while the circuit
+// breaker of the driver is open. The operation is retried after the given
+// delay and it is not reported as attach / detach failure.
+type circuitOpenError struct {
+	msg        string
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return e.msg
+}
+
+// getCircuitOpen returns the delay after which an operation stopped by the
+// circuit breaker should be retried.
+func getCircuitOpen(err error) (time.Duration, bool) {
+	for _, e := range errorChain(err) {
+		if c, ok := e.(*circuitOpenError); ok {
+			return c.retryAfter, true
+		}
+	}
+	return 0, false
+}
+
+// circuitBreaker stops ControllerPublish and ControllerUnpublish calls after
+// consecutive failures that indicate a crashed driver or storage backend, so
+// it is not hammered by calls that can't succeed. After a cooldown, one call
+// probes the driver: the breaker closes when the call succeeds and it opens
+// again for another cooldown when it fails. A nil breaker allows all calls.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	clock     clock.Clock
+
+	lock      sync.Mutex
+	failures  int       // consecutive
+	openedAt  time.Time // zero when the breaker is closed
+	probing   bool      // a call probes the driver after the cooldown
+	probe     uint64    // token of the last probe
+	lastError string
+}
+
+// newCircuitBreaker returns a breaker that opens after threshold consecutive
+// failures, nil when threshold is 0.
+func newCircuitBreaker(threshold int, cooldown time.Duration, clock clock.Clock) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, clock: clock}
+}
+
+// allow returns nil when a CSI call may be sent to the driver and
+// circuitOpenError otherwise. The returned token must be passed to record
+// with the result of the call, it is not 0 for the call that probes the
+// driver after the cooldown.
+func (b *circuitBreaker) allow() (uint64, error) {
+	if b == nil {
+		return 0, nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.openedAt.IsZero() {
+		return 0, nil
+	}
+	if remaining := b.openedAt.Add(b.cooldown).Sub(b.clock.Now()); remaining > 0 {
+		return 0, &circuitOpenError{
+			msg:        fmt.Sprintf("circuit breaker is open after %d consecutive CSI failures, retrying after %s: %s", b.failures, remaining.Round(time.Second), b.lastError),
+			retryAfter: remaining,
+		}
+	}
+	if b.probing {
+		return 0, &circuitOpenError{msg: "circuit breaker is open, waiting for a probe of the CSI driver", retryAfter: halfOpenRetryInterval}
+	}
+	b.probing = true
+	b.probe++
+	return b.probe, nil
+}
+
+// record records the result of a CSI call allowed by allow with token. It
+// returns true when the breaker opened or closed. Results of calls that
+// started before the breaker opened don't end the probe.
+func (b *circuitBreaker) record(token uint64, err error) (opened, closed bool) {
+	if b == nil {
+		return false, false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	wasOpen, probe := !b.openedAt.IsZero(), b.probing && token == b.probe
+	if probe {
+		b.probing = false
+	}
+	if !isDriverFailure(err) {
+		// The driver responded.
+		b.failures = 0
+		b.openedAt = time.Time{}
+		b.probing = false
+		return false, wasOpen
+	}
+	b.failures++
+	b.lastError = err.Error()
+	if wasOpen {
+		if probe {
+			b.openedAt = b.clock.Now()
+		}
+		return false, false
+	}
+	if b.failures >= b.threshold {
+		b.openedAt = b.clock.Now()
+		return true, false
+	}
+	return false, false
+}
+
+// check returns an error while the breaker is open.
+func (b *circuitBreaker) check() error {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.openedAt.IsZero() {
+		return nil
+	}
+	return fmt.Errorf("circuit breaker is open since %s after %d consecutive CSI failures: %s", b.openedAt.Format(time.RFC3339), b.failures, b.lastError)
+}
+
+// isDriverFailure returns true when err of a CSI call indicates that the
+// driver or its storage backend does not work at all, not that the call was
+// wrong.
+func isDriverFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown:
+		return true
+	}
+	return false
+}
+
+// recordCSIResult records the result of a CSI call allowed with token in the
+// circuit breaker and reports its transitions by a log message, metric and
+// event on the CSIDriver object.
+func (h *csiHandler) recordCSIResult(token uint64, err error) {
+	opened, closed := h.breaker.record(token, err)
+	switch {
+	case opened:
+		klog.Warningf("Circuit breaker of CSI driver %q opened, CSI calls are paused for %s: %s", h.attacherName, h.breaker.cooldown, err)
+		circuitBreakerOpen.WithLabelValues(h.attacherName).Set(1)
+		h.recordDriverEvent(v1.EventTypeWarning, CircuitBreakerOpened, "ControllerPublish and ControllerUnpublish paused for %s after %d consecutive failures: %s", h.breaker.cooldown, h.breaker.threshold, err)
+	case closed:
+		klog.Infof("Circuit breaker of CSI driver %q closed", h.attacherName)
+		circuitBreakerOpen.WithLabelValues(h.attacherName).Set(0)
+		h.recordDriverEvent(v1.EventTypeNormal, CircuitBreakerClosed, "CSI driver recovered, ControllerPublish and ControllerUnpublish resumed")
+	}
+}
+
+// recordDriverEvent emits an event on the CSIDriver object of the driver.
+func (h *csiHandler) recordDriverEvent(eventType, reason, messageFmt string, args ...interface{}) {
+	if h.eventRecorder == nil {
+		return
+	}
+	if h.eventFilter != nil && !h.eventFilter.allow(eventType, reason) {
+		klog.V(4).Infof("Not emitting event %s on CSIDriver %q: %s", reason, h.attacherName, fmt.Sprintf(messageFmt, args...))
+		return
+	}
+	h.eventRecorder.Eventf(csiDriverRef(h.client, h.attacherName), eventType, reason, messageFmt, args...)
+}
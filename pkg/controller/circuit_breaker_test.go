@@ -0,0 +1,163 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	b := newCircuitBreaker(2, time.Minute, fakeClock)
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+
+	if opened, _ := b.record(0, unavailable); opened {
+		t.Errorf("expected the breaker to stay closed after one failure")
+	}
+	if _, closed := b.record(0, status.Error(codes.InvalidArgument, "bad volume")); closed {
+		t.Errorf("expected no transition of a closed breaker")
+	}
+	// InvalidArgument reset the consecutive failures.
+	b.record(0, unavailable)
+	token, err := b.allow()
+	if err != nil || token != 0 {
+		t.Errorf("expected calls to be allowed without a probe, got %v %v", token, err)
+	}
+	if opened, _ := b.record(token, errors.New("timeout")); !opened {
+		t.Fatalf("expected the breaker to open after two failures")
+	}
+	if err := b.check(); err == nil {
+		t.Errorf("expected an open breaker to fail the check")
+	}
+
+	_, err = b.allow()
+	if delay, open := getCircuitOpen(err); !open || delay != time.Minute {
+		t.Errorf("expected calls to wait for a minute, got %v", err)
+	}
+
+	// After the cooldown, a single call probes the driver.
+	fakeClock.Step(time.Minute)
+	probe, err := b.allow()
+	if err != nil {
+		t.Fatalf("expected a probe, got %v", err)
+	}
+	_, err = b.allow()
+	if delay, open := getCircuitOpen(err); !open || delay != halfOpenRetryInterval {
+		t.Errorf("expected other calls to wait for the probe, got %v", err)
+	}
+	b.record(probe, unavailable)
+	_, err = b.allow()
+	if delay, open := getCircuitOpen(err); !open || delay != time.Minute {
+		t.Errorf("expected another cooldown after a failed probe, got %v", err)
+	}
+
+	fakeClock.Step(time.Minute)
+	probe, err = b.allow()
+	if err != nil {
+		t.Fatalf("expected a probe, got %v", err)
+	}
+	if _, closed := b.record(probe, nil); !closed {
+		t.Errorf("expected the breaker to close after a successful probe")
+	}
+	if err := b.check(); err != nil {
+		t.Errorf("expected a closed breaker to pass the check, got %v", err)
+	}
+	if _, err := b.allow(); err != nil {
+		t.Errorf("expected calls to be allowed, got %v", err)
+	}
+
+	var disabled *circuitBreaker
+	if _, err := disabled.allow(); err != nil {
+		t.Errorf("expected a nil breaker to allow calls, got %v", err)
+	}
+	if opened, _ := disabled.record(0, unavailable); opened {
+		t.Errorf("expected a nil breaker to stay closed")
+	}
+}
+
+func TestCircuitBreakerLateResult(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	b := newCircuitBreaker(1, time.Minute, fakeClock)
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+
+	// Two calls are in flight when the first one opens the breaker.
+	first, _ := b.allow()
+	second, _ := b.allow()
+	if opened, _ := b.record(first, unavailable); !opened {
+		t.Fatalf("expected the breaker to open")
+	}
+
+	fakeClock.Step(time.Minute)
+	probe, err := b.allow()
+	if err != nil {
+		t.Fatalf("expected a probe, got %v", err)
+	}
+	// The late failure of the second call neither ends the probe nor
+	// restarts the cooldown.
+	b.record(second, unavailable)
+	_, err = b.allow()
+	if delay, open := getCircuitOpen(err); !open || delay != halfOpenRetryInterval {
+		t.Errorf("expected calls to wait for the probe, got %v", err)
+	}
+	if _, closed := b.record(probe, nil); !closed {
+		t.Errorf("expected the breaker to close after a successful probe")
+	}
+}
+
+func openCircuitHandlerFactory(client kubernetes.Interface, informerFactory informers.SharedInformerFactory, csi attacher.Attacher) Handler {
+	handler := csiHandlerFactory(client, informerFactory, csi)
+	breaker := newCircuitBreaker(1, time.Hour, clock.RealClock{})
+	breaker.record(0, status.Error(codes.Unavailable, "connection refused"))
+	handler.(*csiHandler).breaker = breaker
+	return handler
+}
+
+func TestCSIHandlerCircuitOpen(t *testing.T) {
+	tests := []testCase{
+		{
+			name:           "attach with open circuit breaker -> no CSI call",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        va(false, fin, ann),
+		},
+		{
+			name:           "detach with open circuit breaker -> no CSI call",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        deleted(va(true, fin, ann)),
+		},
+		{
+			name:           "changed node ID with open circuit breaker -> no detach from old ID",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        va(true, fin, map[string]string{vaNodeIDAnnotation: "oldNodeID"}),
+			expectedEvents: []string{
+				"Normal AttachStarted Attaching volume to node node1",
+				"Warning NodeIDChanged ID of node node1 in CSI driver csi/test changed from oldNodeID to nodeID1, detaching volume from the old ID",
+			},
+		},
+	}
+	runTests(t, openCircuitHandlerFactory, tests)
+}
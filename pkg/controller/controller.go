@@ -17,7 +17,10 @@ limitations under the License.
 package controller
 
 import (
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"k8s.io/klog"
 
@@ -25,6 +28,9 @@ import (
 	storage "k8s.io/api/storage/v1beta1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
 	coreinformers "k8s.io/client-go/informers/core/v1"
 	storageinformers "k8s.io/client-go/informers/storage/v1beta1"
@@ -36,6 +42,8 @@ import (
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/logging"
 )
 
 // CSIAttachController is a controller that attaches / detaches CSI volumes using provided Handler interface
@@ -44,13 +52,70 @@ type CSIAttachController struct {
 	attacherName  string
 	handler       Handler
 	eventRecorder record.EventRecorder
-	vaQueue       workqueue.RateLimitingInterface
-	pvQueue       workqueue.RateLimitingInterface
+	// clock is the source of time of the queues and the history.
+	clock clock.Clock
+	// correlationIDs are IDs of VolumeAttachments in logs, events and CSI
+	// calls.
+	correlationIDs *CorrelationIDs
+	// history are the recent syncs of the workers.
+	history       *syncHistory
+	vaQueue       *deferringQueue
+	pvQueue       *deferringQueue
+	vaRateLimiter workqueue.RateLimiter
+	pvRateLimiter workqueue.RateLimiter
 
 	vaLister       storagelisters.VolumeAttachmentLister
 	vaListerSynced cache.InformerSynced
 	pvLister       corelisters.PersistentVolumeLister
 	pvListerSynced cache.InformerSynced
+
+	// safetySweepInterval is the period of re-queuing VolumeAttachments
+	// and PersistentVolumes that wait for an action. 0 disables the sweep.
+	safetySweepInterval time.Duration
+
+	// shard limits the objects processed by this controller. nil means all
+	// objects are processed.
+	shard Shard
+	// vaSelector and pvSelector limit the processed objects by their
+	// labels, nil selects all objects.
+	vaSelector labels.Selector
+	pvSelector labels.Selector
+
+	pauseLock sync.Mutex
+	paused    bool
+	// pausedVAs and pausedPVs are keys taken from the queues while the
+	// controller was paused.
+	pausedVAs sets.String
+	pausedPVs sets.String
+
+	// stuckVAs are names of VolumeAttachments that were reported as stuck
+	// by the last checkStuck.
+	stuckVAs sets.String
+
+	// workerScaler limits the number of VolumeAttachment workers that run
+	// at the same time. nil runs all workers.
+	workerScaler *workerScaler
+	// processed is the number of objects the workers finished processing,
+	// accessed atomically.
+	processed uint64
+
+	// drainingDetach returns true for VolumeAttachments that wait for
+	// detach from a draining node. nil when draining nodes are not
+	// prioritized.
+	drainingDetach func(va *storage.VolumeAttachment) bool
+	// orderByState processes detaches, then attaches and then attached
+	// VolumeAttachments.
+	orderByState bool
+}
+
+// Shard decides which VolumeAttachments and PersistentVolumes are processed by
+// a controller when several controllers are active at the same time.
+type Shard interface {
+	// Owns returns true if the object with given name should be processed.
+	Owns(name string) bool
+	// OnChange adds a function that is called when the set of owned
+	// objects may have changed.
+	OnChange(handler func())
 }
 
 // Handler is responsible for handling VolumeAttachment events from informer.
@@ -69,8 +134,20 @@ type Handler interface {
 	SyncNewOrUpdatedPersistentVolume(pv *v1.PersistentVolume)
 }
 
+// TimeoutSetter is implemented by handlers whose timeout of CSI calls can be
+// changed while the controller runs.
+type TimeoutSetter interface {
+	SetTimeout(timeout time.Duration)
+}
+
+// EventRecorderSetter is implemented by handlers that emit events. The
+// controller gives them its recorder when it is created.
+type EventRecorderSetter interface {
+	SetEventRecorder(recorder record.EventRecorder)
+}
+
 // NewCSIAttachController returns a new *CSIAttachController
-func NewCSIAttachController(client kubernetes.Interface, attacherName string, handler Handler, volumeAttachmentInformer storageinformers.VolumeAttachmentInformer, pvInformer coreinformers.PersistentVolumeInformer, vaRateLimiter, paRateLimiter workqueue.RateLimiter) *CSIAttachController {
+func NewCSIAttachController(client kubernetes.Interface, attacherName string, handler Handler, volumeAttachmentInformer storageinformers.VolumeAttachmentInformer, pvInformer coreinformers.PersistentVolumeInformer, vaRateLimiter, paRateLimiter workqueue.RateLimiter, safetySweepInterval time.Duration, shard Shard) *CSIAttachController {
 	broadcaster := record.NewBroadcaster()
 	broadcaster.StartRecordingToSink(&corev1.EventSinkImpl{Interface: client.CoreV1().Events(v1.NamespaceAll)})
 	var eventRecorder record.EventRecorder
@@ -81,8 +158,18 @@ func NewCSIAttachController(client kubernetes.Interface, attacherName string, ha
 		attacherName:  attacherName,
 		handler:       handler,
 		eventRecorder: eventRecorder,
-		vaQueue:       workqueue.NewNamedRateLimitingQueue(vaRateLimiter, "csi-attacher-va"),
-		pvQueue:       workqueue.NewNamedRateLimitingQueue(paRateLimiter, "csi-attacher-pv"),
+		clock:         clock.RealClock{},
+		vaQueue:       newDeferringQueue(workqueue.NewNamedRateLimitingQueue(vaRateLimiter, "csi-attacher-va"), clock.RealClock{}),
+		pvQueue:       newDeferringQueue(workqueue.NewNamedRateLimitingQueue(paRateLimiter, "csi-attacher-pv"), clock.RealClock{}),
+		vaRateLimiter: vaRateLimiter,
+		pvRateLimiter: paRateLimiter,
+
+		safetySweepInterval: safetySweepInterval,
+		shard:               shard,
+		pausedVAs:           sets.NewString(),
+		pausedPVs:           sets.NewString(),
+		correlationIDs:      NewCorrelationIDs(),
+		history:             newSyncHistory(clock.RealClock{}),
 	}
 
 	volumeAttachmentInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
@@ -101,33 +188,70 @@ func NewCSIAttachController(client kubernetes.Interface, attacherName string, ha
 	ctrl.pvLister = pvInformer.Lister()
 	ctrl.pvListerSynced = pvInformer.Informer().HasSynced
 	ctrl.handler.Init(ctrl.vaQueue, ctrl.pvQueue)
+	if setter, ok := ctrl.handler.(EventRecorderSetter); ok {
+		setter.SetEventRecorder(eventRecorder)
+	}
+	if setter, ok := ctrl.handler.(CorrelationIDsSetter); ok {
+		setter.SetCorrelationIDs(ctrl.correlationIDs)
+	}
+
+	if shard != nil {
+		shard.OnChange(ctrl.enqueueAll)
+	}
 
 	return ctrl
 }
 
 // Run starts CSI attacher and listens on channel events
 func (ctrl *CSIAttachController) Run(workers int, stopCh <-chan struct{}) {
-	defer ctrl.vaQueue.ShutDown()
-	defer ctrl.pvQueue.ShutDown()
-
 	klog.Infof("Starting CSI attacher")
 	defer klog.Infof("Shutting CSI attacher")
 
 	if !cache.WaitForCacheSync(stopCh, ctrl.vaListerSynced, ctrl.pvListerSynced) {
 		klog.Errorf("Cannot sync caches")
+		ctrl.vaQueue.ShutDown()
+		ctrl.pvQueue.ShutDown()
 		return
 	}
+	var wg sync.WaitGroup
+	ctrl.workerScaler.start(workers)
+	for i := 0; i < ctrl.workerScaler.workers(workers); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait.Until(ctrl.syncVA, 0, stopCh)
+		}()
+	}
 	for i := 0; i < workers; i++ {
-		go wait.Until(ctrl.syncVA, 0, stopCh)
-		go wait.Until(ctrl.syncPV, 0, stopCh)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait.Until(ctrl.syncPV, 0, stopCh)
+		}()
+	}
+	if ctrl.workerScaler != nil {
+		go wait.Until(func() {
+			ctrl.workerScaler.scale(ctrl.vaQueue.Len())
+		}, workerScaleInterval, stopCh)
+	}
+	if ctrl.safetySweepInterval > 0 {
+		go wait.Until(ctrl.safetySweep, ctrl.safetySweepInterval, stopCh)
 	}
 
 	<-stopCh
+	// Let the workers finish operations in progress, so the next leader does
+	// not start with half-finished attach / detach.
+	klog.V(2).Infof("Waiting for workers to finish")
+	ctrl.vaQueue.ShutDown()
+	ctrl.pvQueue.ShutDown()
+	ctrl.workerScaler.stop()
+	wg.Wait()
 }
 
 // vaAdded reacts to a VolumeAttachment creation
 func (ctrl *CSIAttachController) vaAdded(obj interface{}) {
 	va := obj.(*storage.VolumeAttachment)
+	klog.V(5).Infof("VolumeAttachment %q added%s", va.Name, logging.KV(logging.KeyCorrelationID, ctrl.correlationIDs.Get(va.Name)))
 	ctrl.vaQueue.Add(va.Name)
 }
 
@@ -142,9 +266,22 @@ func (ctrl *CSIAttachController) vaUpdated(old, new interface{}) {
 	}
 }
 
+// setClock replaces the source of time of the controller. It must be called
+// before Run.
+func (ctrl *CSIAttachController) setClock(clk clock.Clock) {
+	ctrl.clock = clk
+	ctrl.correlationIDs.clock = clk
+	ctrl.history.clock = clk
+	ctrl.vaQueue.clock = clk
+	ctrl.pvQueue.clock = clk
+}
+
 // vaDeleted reacts to a VolumeAttachment deleted
 func (ctrl *CSIAttachController) vaDeleted(obj interface{}) {
 	va := obj.(*storage.VolumeAttachment)
+	if va != nil {
+		ctrl.correlationIDs.Forget(va.Name)
+	}
 	if va != nil && va.Spec.Source.PersistentVolumeName != nil {
 		// Enqueue PV sync event - it will evaluate and remove finalizer
 		ctrl.pvQueue.Add(*va.Spec.Source.PersistentVolumeName)
@@ -159,27 +296,51 @@ func (ctrl *CSIAttachController) pvAdded(obj interface{}) {
 
 // pvUpdated reacts to a PV update
 func (ctrl *CSIAttachController) pvUpdated(old, new interface{}) {
+	oldPV := old.(*v1.PersistentVolume)
 	pv := new.(*v1.PersistentVolume)
 	ctrl.pvQueue.Add(pv.Name)
+	if ctrl.pvSelector != nil && !labels.Equals(oldPV.Labels, pv.Labels) {
+		ctrl.enqueueVAsOfPV(pv.Name)
+	}
 }
 
 // syncVA deals with one key off the queue.  It returns false when it's time to quit.
 func (ctrl *CSIAttachController) syncVA() {
+	if !ctrl.workerScaler.acquire() {
+		return
+	}
+	defer ctrl.workerScaler.release()
 	key, quit := ctrl.vaQueue.Get()
 	if quit {
 		return
 	}
 	defer ctrl.vaQueue.Done(key)
+	defer ctrl.markProcessed()
 
 	vaName := key.(string)
-	klog.V(4).Infof("Started VA processing %q", vaName)
+	if ctrl.park(ctrl.pausedVAs, vaName) {
+		return
+	}
+	if !ctrl.owns(vaName) {
+		klog.V(5).Infof("Skipping VA %q owned by another shard", vaName)
+		ctrl.vaQueue.Forget(key)
+		return
+	}
+	if delay := postponed(ctrl.vaRateLimiter, key); delay > 0 {
+		klog.V(4).Infof("Postponing VA %q by %s, restored backoff of the previous leader", vaName, delay)
+		ctrl.vaQueue.AddAfter(key, delay)
+		return
+	}
+	klog.V(4).Infof("Started VA processing %q%s", vaName, logging.KV(logging.KeyCorrelationID, ctrl.correlationIDs.Get(vaName)))
 
 	// get VolumeAttachment to process
 	va, err := ctrl.vaLister.Get(vaName)
 	if err != nil {
 		if apierrs.IsNotFound(err) {
 			// VolumeAttachment was deleted in the meantime, ignore.
+			// Forget it, it may have been deferred.
 			klog.V(3).Infof("VA %q deleted, ignoring", vaName)
+			ctrl.vaQueue.Forget(key)
 			return
 		}
 		klog.Errorf("Error getting VolumeAttachment %q: %v", vaName, err)
@@ -190,7 +351,14 @@ func (ctrl *CSIAttachController) syncVA() {
 		klog.V(4).Infof("Skipping VolumeAttachment %s for attacher %s", va.Name, va.Spec.Attacher)
 		return
 	}
+	if !ctrl.selectsVA(va) {
+		klog.V(5).Infof("Skipping VA %q not matching label selectors", vaName)
+		return
+	}
+	// Not deferred, a sync that panics stays unfinished in the history.
+	finished := ctrl.history.start("VolumeAttachment", vaName)
 	ctrl.handler.SyncNewOrUpdatedVolumeAttachment(va)
+	finished()
 }
 
 // syncPV deals with one key off the queue.  It returns false when it's time to quit.
@@ -200,8 +368,22 @@ func (ctrl *CSIAttachController) syncPV() {
 		return
 	}
 	defer ctrl.pvQueue.Done(key)
+	defer ctrl.markProcessed()
 
 	pvName := key.(string)
+	if ctrl.park(ctrl.pausedPVs, pvName) {
+		return
+	}
+	if !ctrl.owns(pvName) {
+		klog.V(5).Infof("Skipping PV %q owned by another shard", pvName)
+		ctrl.pvQueue.Forget(key)
+		return
+	}
+	if delay := postponed(ctrl.pvRateLimiter, key); delay > 0 {
+		klog.V(4).Infof("Postponing PV %q by %s, restored backoff of the previous leader", pvName, delay)
+		ctrl.pvQueue.AddAfter(key, delay)
+		return
+	}
 	klog.V(4).Infof("Started PV processing %q", pvName)
 
 	// get PV to process
@@ -209,20 +391,134 @@ func (ctrl *CSIAttachController) syncPV() {
 	if err != nil {
 		if apierrs.IsNotFound(err) {
 			// PV was deleted in the meantime, ignore.
+			// Forget it, it may have been deferred.
 			klog.V(3).Infof("PV %q deleted, ignoring", pvName)
+			ctrl.pvQueue.Forget(key)
 			return
 		}
 		klog.Errorf("Error getting PersistentVolume %q: %v", pvName, err)
 		ctrl.pvQueue.AddRateLimited(pvName)
 		return
 	}
+	if !ctrl.selectsPV(pv) {
+		klog.V(5).Infof("Skipping PV %q not matching label selector", pvName)
+		return
+	}
+	finished := ctrl.history.start("PersistentVolume", pvName)
 	ctrl.handler.SyncNewOrUpdatedPersistentVolume(pv)
+	finished()
+}
+
+// SetPaused pauses or resumes processing of VolumeAttachments and
+// PersistentVolumes. Operations in progress are finished, objects that need
+// processing while the controller is paused are processed after it resumes.
+func (ctrl *CSIAttachController) SetPaused(paused bool) {
+	ctrl.pauseLock.Lock()
+	defer ctrl.pauseLock.Unlock()
+
+	if ctrl.paused == paused {
+		return
+	}
+	ctrl.paused = paused
+	if paused {
+		klog.Infof("Pausing CSI attacher %s", ctrl.attacherName)
+		return
+	}
+	klog.Infof("Resuming CSI attacher %s with %d VolumeAttachments and %d PersistentVolumes to process", ctrl.attacherName, ctrl.pausedVAs.Len(), ctrl.pausedPVs.Len())
+	for _, key := range ctrl.pausedVAs.UnsortedList() {
+		ctrl.vaQueue.Add(key)
+		ctrl.pausedVAs.Delete(key)
+	}
+	for _, key := range ctrl.pausedPVs.UnsortedList() {
+		ctrl.pvQueue.Add(key)
+		ctrl.pausedPVs.Delete(key)
+	}
+}
+
+// ErrOtherAttacher is returned by Reconcile for VolumeAttachments of another
+// attacher.
+var ErrOtherAttacher = errors.New("VolumeAttachment belongs to another attacher")
+
+// Reconcile clears backoff of the VolumeAttachment with given name and
+// enqueues it to be processed now.
+func (ctrl *CSIAttachController) Reconcile(vaName string) error {
+	va, err := ctrl.vaLister.Get(vaName)
+	if err != nil {
+		return err
+	}
+	if va.Spec.Attacher != ctrl.attacherName {
+		return ErrOtherAttacher
+	}
+	klog.Infof("Reconciling VolumeAttachment %q on request, %d failures forgotten", vaName, ctrl.vaQueue.NumRequeues(vaName))
+	ctrl.vaQueue.Forget(vaName)
+	ctrl.vaQueue.Add(vaName)
+	return nil
+}
+
+// queueStates returns state of the VolumeAttachment and PersistentVolume
+// queues, without backoff of their items.
+func (ctrl *CSIAttachController) queueStates() (paused bool, vaQueue, pvQueue QueueState) {
+	ctrl.pauseLock.Lock()
+	defer ctrl.pauseLock.Unlock()
+
+	vaQueue = QueueState{Length: ctrl.vaQueue.Len(), Paused: ctrl.pausedVAs.List()}
+	pvQueue = QueueState{Length: ctrl.pvQueue.Len(), Paused: ctrl.pausedPVs.List()}
+	return ctrl.paused, vaQueue, pvQueue
+}
+
+// park remembers a key taken from a queue when the controller is paused.
+func (ctrl *CSIAttachController) park(parked sets.String, key string) bool {
+	ctrl.pauseLock.Lock()
+	defer ctrl.pauseLock.Unlock()
+
+	if !ctrl.paused {
+		return false
+	}
+	klog.V(5).Infof("Paused, postponing processing of %q", key)
+	parked.Insert(key)
+	return true
+}
+
+// postponed returns how long processing of an item should wait for backoff
+// restored from the previous leader.
+func postponed(rateLimiter workqueue.RateLimiter, item interface{}) time.Duration {
+	if p, ok := rateLimiter.(interface {
+		Postponed(item interface{}) time.Duration
+	}); ok {
+		return p.Postponed(item)
+	}
+	return 0
+}
+
+// owns returns true if the object with given name should be processed by this
+// controller.
+func (ctrl *CSIAttachController) owns(name string) bool {
+	return ctrl.shard == nil || ctrl.shard.Owns(name)
+}
+
+// enqueueAll enqueues all VolumeAttachments and PersistentVolumes, so objects
+// that became owned by this controller are processed.
+func (ctrl *CSIAttachController) enqueueAll() {
+	vas, err := ctrl.vaLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list VolumeAttachments: %v", err)
+	}
+	for _, va := range vas {
+		ctrl.vaQueue.Add(va.Name)
+	}
+	pvs, err := ctrl.pvLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list PersistentVolumes: %v", err)
+	}
+	for _, pv := range pvs {
+		ctrl.pvQueue.Add(pv.Name)
+	}
 }
 
 // shouldEnqueueVAChange checks if a changed VolumeAttachment should be enqueued.
-// It filters out changes in Status.Attach/DetachError - these were posted by the controller
-// just few moments ago. If they were enqueued, Attach()/Detach() would be called again,
-// breaking exponential backoff.
+// It filters out changes in Status.Attach/DetachError and LastErrorAnnotation - these were
+// posted by the controller just few moments ago. If they were enqueued, Attach()/Detach()
+// would be called again, breaking exponential backoff.
 func shouldEnqueueVAChange(old, new *storage.VolumeAttachment) bool {
 	if old.ResourceVersion == new.ResourceVersion {
 		// This is most probably periodic sync, enqueue it
@@ -237,11 +533,78 @@ func shouldEnqueueVAChange(old, new *storage.VolumeAttachment) bool {
 	sanitized.ResourceVersion = old.ResourceVersion
 	sanitized.Status.AttachError = old.Status.AttachError
 	sanitized.Status.DetachError = old.Status.DetachError
+	if lastError, found := old.Annotations[LastErrorAnnotation]; found {
+		if sanitized.Annotations == nil {
+			sanitized.Annotations = map[string]string{}
+		}
+		sanitized.Annotations[LastErrorAnnotation] = lastError
+	} else {
+		delete(sanitized.Annotations, LastErrorAnnotation)
+	}
 
 	if equality.Semantic.DeepEqual(old, sanitized) {
-		// The objects are the same except Status.Attach/DetachError.
+		// The objects are the same except Status.Attach/DetachError and
+		// LastErrorAnnotation.
 		// Don't enqueue them.
 		return false
 	}
 	return true
 }
+
+// safetySweep enqueues VolumeAttachments and PersistentVolumes that still wait
+// for an action of this attacher, i.e. VAs that are not attached, are being
+// deleted or have an error and PVs that are being deleted and have our
+// finalizer. Unlike informer resync, it does not touch objects that are fully
+// reconciled. Objects that are already waiting for a retry with exponential
+// backoff or that were deferred (e.g. waiting for a quota or Retry-After of
+// the API server) are skipped, they will be processed when the wait expires.
+func (ctrl *CSIAttachController) safetySweep() {
+	vas, err := ctrl.vaLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Safety sweep: failed to list VolumeAttachments: %s", err)
+		return
+	}
+	vaCount := 0
+	for _, va := range vas {
+		if va.Spec.Attacher != ctrl.attacherName || !vaNeedsSync(va) {
+			continue
+		}
+		if ctrl.vaQueue.NumRequeues(va.Name) > 0 || ctrl.vaQueue.deferred(va.Name) {
+			continue
+		}
+		ctrl.vaQueue.Add(va.Name)
+		vaCount++
+	}
+
+	pvs, err := ctrl.pvLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Safety sweep: failed to list PersistentVolumes: %s", err)
+		return
+	}
+	finalizer := GetFinalizerName(ctrl.attacherName)
+	pvCount := 0
+	for _, pv := range pvs {
+		if pv.DeletionTimestamp == nil || !hasFinalizer(pv.Finalizers, finalizer) {
+			continue
+		}
+		if ctrl.pvQueue.NumRequeues(pv.Name) > 0 || ctrl.pvQueue.deferred(pv.Name) {
+			continue
+		}
+		ctrl.pvQueue.Add(pv.Name)
+		pvCount++
+	}
+	klog.V(4).Infof("Safety sweep: enqueued %d VolumeAttachments and %d PersistentVolumes", vaCount, pvCount)
+}
+
+// vaNeedsSync returns true if the VolumeAttachment is not fully reconciled.
+func vaNeedsSync(va *storage.VolumeAttachment) bool {
+	if va.DeletionTimestamp != nil {
+		// Waiting for detach
+		return true
+	}
+	if !va.Status.Attached {
+		// Waiting for attach
+		return true
+	}
+	return va.Status.AttachError != nil || va.Status.DetachError != nil
+}
@@ -18,9 +18,17 @@ package controller
 
 import (
 	"testing"
+	"time"
 
+	v1 "k8s.io/api/core/v1"
 	storage "k8s.io/api/storage/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/workqueue"
 )
 
 func TestShouldEnqueueVAChange(t *testing.T) {
@@ -71,6 +79,14 @@ func TestShouldEnqueueVAChange(t *testing.T) {
 		Time:    metav1.Time{},
 	}
 
+	va2ChangedAttachErrorAndLastError := va2ChangedAttachError.DeepCopy()
+	va2ChangedAttachErrorAndLastError.Annotations = map[string]string{LastErrorAnnotation: `{"operation":"attach","count":1}`}
+
+	va3ChangedAttachErrorAndLastError := va2ChangedAttachErrorAndLastError.DeepCopy()
+	va3ChangedAttachErrorAndLastError.ResourceVersion = "3"
+	va3ChangedAttachErrorAndLastError.Status.AttachError.Message = "mock error3"
+	va3ChangedAttachErrorAndLastError.Annotations[LastErrorAnnotation] = `{"operation":"attach","count":2}`
+
 	tests := []struct {
 		name           string
 		oldVA, newVA   *storage.VolumeAttachment
@@ -118,6 +134,18 @@ func TestShouldEnqueueVAChange(t *testing.T) {
 			newVA:          va2ChangedDetachError,
 			expectedResult: false,
 		},
+		{
+			name:           "added attachError and last error annotation",
+			oldVA:          va1,
+			newVA:          va2ChangedAttachErrorAndLastError,
+			expectedResult: false,
+		},
+		{
+			name:           "changed attachError and last error annotation",
+			oldVA:          va2ChangedAttachErrorAndLastError,
+			newVA:          va3ChangedAttachErrorAndLastError,
+			expectedResult: false,
+		},
 	}
 
 	for _, test := range tests {
@@ -129,3 +157,305 @@ func TestShouldEnqueueVAChange(t *testing.T) {
 		})
 	}
 }
+
+func TestSafetySweep(t *testing.T) {
+	attached := va(true, fin, ann)
+	attached.Name = "attached"
+	pending := va(false, fin, ann)
+	pending.Name = "pending"
+	detaching := deleted(va(true, fin, ann))
+	detaching.Name = "detaching"
+	failed := vaWithDetachError(va(true, fin, ann), "mock error")
+	failed.Name = "failed"
+	otherDriver := createVolumeAttachment("other/driver", testPVName, testNodeName, false, "", nil)
+	otherDriver.Name = "other"
+	backoff := va(false, fin, ann)
+	backoff.Name = "backoff"
+
+	deletedPV := pvDeleted(pvWithFinalizer())
+	deletedPV.Name = "deleted"
+	deletedPVNoFinalizer := pvDeleted(pv())
+	deletedPVNoFinalizer.Name = "deleted-no-finalizer"
+
+	client := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(client, 0)
+	vaInformer := factory.Storage().V1beta1().VolumeAttachments()
+	pvInformer := factory.Core().V1().PersistentVolumes()
+	for _, obj := range []*storage.VolumeAttachment{attached, pending, detaching, failed, otherDriver, backoff} {
+		vaInformer.Informer().GetStore().Add(obj)
+	}
+	for _, obj := range []*v1.PersistentVolume{pvWithFinalizer(), deletedPV, deletedPVNoFinalizer} {
+		pvInformer.Informer().GetStore().Add(obj)
+	}
+
+	handler := NewTrivialHandler(client)
+	ctrl := NewCSIAttachController(client, testAttacherName, handler, vaInformer, pvInformer, workqueue.DefaultControllerRateLimiter(), workqueue.DefaultControllerRateLimiter(), time.Minute, nil)
+	// Simulate a VA that waits for exponential backoff
+	ctrl.vaQueue.AddRateLimited(backoff.Name)
+
+	ctrl.safetySweep()
+
+	expectedVAs := sets.NewString("pending", "detaching", "failed")
+	gotVAs := sets.NewString()
+	for ctrl.vaQueue.Len() > 0 {
+		key, _ := ctrl.vaQueue.Get()
+		gotVAs.Insert(key.(string))
+		ctrl.vaQueue.Done(key)
+	}
+	if !gotVAs.Equal(expectedVAs) {
+		t.Errorf("expected VAs %v to be enqueued, got %v", expectedVAs.List(), gotVAs.List())
+	}
+
+	if ctrl.pvQueue.Len() != 1 {
+		t.Fatalf("expected 1 PV to be enqueued, got %d", ctrl.pvQueue.Len())
+	}
+	key, _ := ctrl.pvQueue.Get()
+	if key.(string) != "deleted" {
+		t.Errorf("expected PV \"deleted\" to be enqueued, got %q", key)
+	}
+}
+
+func TestSafetySweepSkipsDeferred(t *testing.T) {
+	deferred := va(false, fin, ann)
+	deferred.Name = "deferred"
+
+	client := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(client, 0)
+	vaInformer := factory.Storage().V1beta1().VolumeAttachments()
+	pvInformer := factory.Core().V1().PersistentVolumes()
+	vaInformer.Informer().GetStore().Add(deferred)
+
+	handler := NewTrivialHandler(client)
+	ctrl := NewCSIAttachController(client, testAttacherName, handler, vaInformer, pvInformer, workqueue.DefaultControllerRateLimiter(), workqueue.DefaultControllerRateLimiter(), time.Minute, nil)
+	// Simulate a VA that waits for a quota
+	ctrl.vaQueue.AddAfter(deferred.Name, time.Hour)
+
+	ctrl.safetySweep()
+	if l := ctrl.vaQueue.Len(); l != 0 {
+		t.Errorf("expected deferred VA not to be enqueued, got queue length %d", l)
+	}
+
+	// Successfully processed, e.g. after an update of the VA
+	ctrl.vaQueue.Forget(deferred.Name)
+	ctrl.safetySweep()
+	if l := ctrl.vaQueue.Len(); l != 1 {
+		t.Errorf("expected forgotten VA to be enqueued, got queue length %d", l)
+	}
+}
+
+func TestDeferredDeleted(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(client, 0)
+	vaInformer := factory.Storage().V1beta1().VolumeAttachments()
+	pvInformer := factory.Core().V1().PersistentVolumes()
+
+	handler := &recordingHandler{vas: sets.NewString(), pvs: sets.NewString()}
+	ctrl := NewCSIAttachController(client, testAttacherName, handler, vaInformer, pvInformer, workqueue.DefaultControllerRateLimiter(), workqueue.DefaultControllerRateLimiter(), 0, nil)
+	fakeClock := clock.NewFakeClock(time.Now())
+	ctrl.setClock(fakeClock)
+
+	ctrl.vaQueue.AddAfter("deferred", time.Hour)
+	if !ctrl.vaQueue.deferred("deferred") {
+		t.Errorf("expected VA to be deferred")
+	}
+	fakeClock.Step(time.Hour)
+	if ctrl.vaQueue.deferred("deferred") {
+		t.Errorf("expected VA not to be deferred after the delay of the controller clock")
+	}
+
+	// The VAs and PVs were deleted while deferred.
+	ctrl.vaQueue.AddAfter("deleted", time.Hour)
+	ctrl.vaQueue.Add("deleted")
+	ctrl.syncVA()
+	ctrl.pvQueue.AddAfter("deleted", time.Hour)
+	ctrl.pvQueue.Add("deleted")
+	ctrl.syncPV()
+	if l := len(ctrl.vaQueue.deadlines); l != 0 {
+		t.Errorf("expected deleted VA to be forgotten, got %d deferred VAs", l)
+	}
+	if l := len(ctrl.pvQueue.deadlines); l != 0 {
+		t.Errorf("expected deleted PV to be forgotten, got %d deferred PVs", l)
+	}
+}
+
+type fakeShard struct {
+	owned    sets.String
+	onChange []func()
+}
+
+func (s *fakeShard) Owns(name string) bool {
+	return s.owned.Has(name)
+}
+
+func (s *fakeShard) OnChange(handler func()) {
+	s.onChange = append(s.onChange, handler)
+}
+
+type recordingHandler struct {
+	vas sets.String
+	pvs sets.String
+}
+
+func (h *recordingHandler) Init(vaQueue workqueue.RateLimitingInterface, pvQueue workqueue.RateLimitingInterface) {
+}
+
+func (h *recordingHandler) SyncNewOrUpdatedVolumeAttachment(va *storage.VolumeAttachment) {
+	h.vas.Insert(va.Name)
+}
+
+func (h *recordingHandler) SyncNewOrUpdatedPersistentVolume(pv *v1.PersistentVolume) {
+	h.pvs.Insert(pv.Name)
+}
+
+func TestShard(t *testing.T) {
+	mine := va(false, "", nil)
+	mine.Name = "mine"
+	theirs := va(false, "", nil)
+	theirs.Name = "theirs"
+	minePV := pv()
+	minePV.Name = "mine"
+	theirPV := pv()
+	theirPV.Name = "theirs"
+
+	client := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(client, 0)
+	vaInformer := factory.Storage().V1beta1().VolumeAttachments()
+	pvInformer := factory.Core().V1().PersistentVolumes()
+	vaInformer.Informer().GetStore().Add(mine)
+	vaInformer.Informer().GetStore().Add(theirs)
+	pvInformer.Informer().GetStore().Add(minePV)
+	pvInformer.Informer().GetStore().Add(theirPV)
+
+	shard := &fakeShard{owned: sets.NewString("mine")}
+	handler := &recordingHandler{vas: sets.NewString(), pvs: sets.NewString()}
+	ctrl := NewCSIAttachController(client, testAttacherName, handler, vaInformer, pvInformer, workqueue.DefaultControllerRateLimiter(), workqueue.DefaultControllerRateLimiter(), 0, shard)
+	if len(shard.onChange) != 1 {
+		t.Fatalf("expected the controller to watch shard changes")
+	}
+
+	// Ownership changed
+	shard.onChange[0]()
+	for ctrl.vaQueue.Len() > 0 {
+		ctrl.syncVA()
+	}
+	for ctrl.pvQueue.Len() > 0 {
+		ctrl.syncPV()
+	}
+
+	if !handler.vas.Equal(sets.NewString("mine")) {
+		t.Errorf("expected only VA \"mine\" to be processed, got %v", handler.vas.List())
+	}
+	if !handler.pvs.Equal(sets.NewString("mine")) {
+		t.Errorf("expected only PV \"mine\" to be processed, got %v", handler.pvs.List())
+	}
+}
+
+func TestRestoredBackoff(t *testing.T) {
+	restored := va(false, "", nil)
+	restored.Name = "restored"
+
+	client := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(client, 0)
+	vaInformer := factory.Storage().V1beta1().VolumeAttachments()
+	pvInformer := factory.Core().V1().PersistentVolumes()
+	vaInformer.Informer().GetStore().Add(restored)
+
+	vaLimiter := NewBackoffRateLimiter(time.Second, time.Minute)
+	vaLimiter.Restore([]BackoffState{{Key: "restored", Failures: 3, NotBefore: time.Now().Add(time.Hour)}})
+	handler := &recordingHandler{vas: sets.NewString(), pvs: sets.NewString()}
+	ctrl := NewCSIAttachController(client, testAttacherName, handler, vaInformer, pvInformer, vaLimiter, workqueue.DefaultControllerRateLimiter(), 0, nil)
+
+	ctrl.vaQueue.Add("restored")
+	ctrl.syncVA()
+	if handler.vas.Len() != 0 {
+		t.Errorf("expected VA with restored backoff not to be processed, got %v", handler.vas.List())
+	}
+	if ctrl.vaQueue.Len() != 0 {
+		t.Errorf("expected VA with restored backoff to wait, got %d items in the queue", ctrl.vaQueue.Len())
+	}
+}
+
+func TestPause(t *testing.T) {
+	paused := va(false, "", nil)
+	paused.Name = "paused"
+	pausedPV := pv()
+	pausedPV.Name = "paused"
+
+	client := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(client, 0)
+	vaInformer := factory.Storage().V1beta1().VolumeAttachments()
+	pvInformer := factory.Core().V1().PersistentVolumes()
+	vaInformer.Informer().GetStore().Add(paused)
+	pvInformer.Informer().GetStore().Add(pausedPV)
+
+	handler := &recordingHandler{vas: sets.NewString(), pvs: sets.NewString()}
+	ctrl := NewCSIAttachController(client, testAttacherName, handler, vaInformer, pvInformer, workqueue.DefaultControllerRateLimiter(), workqueue.DefaultControllerRateLimiter(), 0, nil)
+
+	ctrl.SetPaused(true)
+	ctrl.vaQueue.Add("paused")
+	ctrl.pvQueue.Add("paused")
+	ctrl.syncVA()
+	ctrl.syncPV()
+	if handler.vas.Len() != 0 || handler.pvs.Len() != 0 {
+		t.Errorf("expected nothing processed while paused, got VAs %v, PVs %v", handler.vas.List(), handler.pvs.List())
+	}
+	if ctrl.vaQueue.Len() != 0 || ctrl.pvQueue.Len() != 0 {
+		t.Errorf("expected paused objects not to be re-queued, got %d VAs and %d PVs", ctrl.vaQueue.Len(), ctrl.pvQueue.Len())
+	}
+
+	ctrl.SetPaused(false)
+	for ctrl.vaQueue.Len() > 0 {
+		ctrl.syncVA()
+	}
+	for ctrl.pvQueue.Len() > 0 {
+		ctrl.syncPV()
+	}
+	if !handler.vas.Equal(sets.NewString("paused")) || !handler.pvs.Equal(sets.NewString("paused")) {
+		t.Errorf("expected paused objects processed after resume, got VAs %v, PVs %v", handler.vas.List(), handler.pvs.List())
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	failed := va(false, "", nil)
+	other := va(false, "", nil)
+	other.Name = "other"
+	other.Spec.Attacher = "other-attacher"
+
+	client := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(client, 0)
+	vaInformer := factory.Storage().V1beta1().VolumeAttachments()
+	pvInformer := factory.Core().V1().PersistentVolumes()
+	vaInformer.Informer().GetStore().Add(failed)
+	vaInformer.Informer().GetStore().Add(other)
+
+	vaLimiter := NewBackoffRateLimiter(time.Minute, time.Hour)
+	handler := &recordingHandler{vas: sets.NewString(), pvs: sets.NewString()}
+	ctrl := NewCSIAttachController(client, testAttacherName, handler, vaInformer, pvInformer, vaLimiter, workqueue.DefaultControllerRateLimiter(), 0, nil)
+
+	// The VolumeAttachment failed and waits for its backoff.
+	ctrl.vaQueue.AddRateLimited(failed.Name)
+	if ctrl.vaQueue.Len() != 0 {
+		t.Fatalf("expected the failed VolumeAttachment to wait for backoff")
+	}
+
+	if err := ctrl.Reconcile(failed.Name); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ctrl.vaQueue.NumRequeues(failed.Name) != 0 {
+		t.Errorf("expected backoff to be cleared, got %d requeues", ctrl.vaQueue.NumRequeues(failed.Name))
+	}
+	if ctrl.vaQueue.Len() != 1 {
+		t.Fatalf("expected the VolumeAttachment in the queue, got queue length %d", ctrl.vaQueue.Len())
+	}
+	ctrl.syncVA()
+	if !handler.vas.Equal(sets.NewString(failed.Name)) {
+		t.Errorf("expected %s processed, got %v", failed.Name, handler.vas.List())
+	}
+
+	if err := ctrl.Reconcile(other.Name); err != ErrOtherAttacher {
+		t.Errorf("expected ErrOtherAttacher, got %v", err)
+	}
+	if err := ctrl.Reconcile("missing"); !apierrs.IsNotFound(err) {
+		t.Errorf("expected NotFound error, got %v", err)
+	}
+}
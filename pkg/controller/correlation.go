@@ -0,0 +1,111 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+const (
+	// CorrelationIDAnnotation is the annotation of events with the
+	// correlation ID of their VolumeAttachment.
+	CorrelationIDAnnotation = "csi.alpha.kubernetes.io/correlation-id"
+	// CorrelationIDMetadataKey is the gRPC metadata key of CSI calls with
+	// the correlation ID of their VolumeAttachment.
+	CorrelationIDMetadataKey = "x-correlation-id"
+)
+
+// CorrelationIDs assigns a random ID to each VolumeAttachment when it first
+// enters the queue. The ID is included in logs, events and CSI calls about
+// the VolumeAttachment until it is deleted, so they can be put together to a
+// timeline. IDs are not persisted, a VolumeAttachment gets a new ID when the
+// attacher restarts or another replica becomes the leader.
+type CorrelationIDs struct {
+	lock sync.Mutex
+	ids  map[string]string
+	// queued are times when the IDs were assigned.
+	queued map[string]time.Time
+	clock  clock.Clock
+}
+
+// CorrelationIDsSetter is implemented by handlers that use correlation IDs.
+// The controller gives them its IDs when it is created.
+type CorrelationIDsSetter interface {
+	SetCorrelationIDs(ids *CorrelationIDs)
+}
+
+// NewCorrelationIDs returns empty CorrelationIDs.
+func NewCorrelationIDs() *CorrelationIDs {
+	return &CorrelationIDs{ids: map[string]string{}, queued: map[string]time.Time{}, clock: clock.RealClock{}}
+}
+
+// Get returns the ID of the VolumeAttachment with given name. It assigns a
+// new ID when the VolumeAttachment does not have one.
+func (c *CorrelationIDs) Get(vaName string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	id, found := c.ids[vaName]
+	if !found {
+		id = newCorrelationID()
+		c.ids[vaName] = id
+		c.queued[vaName] = c.clock.Now()
+	}
+	return id
+}
+
+// QueuedAt returns when the VolumeAttachment with given name got its ID, i.e.
+// when it first entered the queue of this attacher. It returns false when the
+// VolumeAttachment does not have an ID.
+func (c *CorrelationIDs) QueuedAt(vaName string) (time.Time, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	queued, found := c.queued[vaName]
+	return queued, found
+}
+
+// Forget removes the ID of a deleted VolumeAttachment.
+func (c *CorrelationIDs) Forget(vaName string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.ids, vaName)
+	delete(c.queued, vaName)
+}
+
+func newCorrelationID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		// crypto/rand does not fail on supported platforms.
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// withCorrelationID adds the correlation ID to gRPC metadata of calls made
+// with the returned context.
+func withCorrelationID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, CorrelationIDMetadataKey, id)
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+func TestCorrelationIDs(t *testing.T) {
+	now := time.Date(2019, 10, 14, 12, 0, 0, 0, time.UTC)
+	ids := NewCorrelationIDs()
+	ids.clock = clock.NewFakeClock(now)
+	id := ids.Get("va1")
+	if len(id) != 16 {
+		t.Errorf("expected ID with 16 characters, got %q", id)
+	}
+	if again := ids.Get("va1"); again != id {
+		t.Errorf("expected the same ID %q, got %q", id, again)
+	}
+	if other := ids.Get("va2"); other == id {
+		t.Errorf("expected a different ID for va2, got %q", other)
+	}
+
+	if queued, found := ids.QueuedAt("va1"); !found || !queued.Equal(now) {
+		t.Errorf("expected queue time %s of va1, got %s", now, queued)
+	}
+
+	ids.Forget("va1")
+	if _, found := ids.QueuedAt("va1"); found {
+		t.Errorf("expected no queue time after Forget")
+	}
+	if recreated := ids.Get("va1"); recreated == id {
+		t.Errorf("expected a new ID after Forget, got %q", recreated)
+	}
+}
+
+func TestWithCorrelationID(t *testing.T) {
+	ctx := withCorrelationID(context.Background(), "1234")
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if ids := md.Get(CorrelationIDMetadataKey); len(ids) != 1 || ids[0] != "1234" {
+		t.Errorf("expected correlation ID 1234 in metadata, got %v", ids)
+	}
+
+	ctx = withCorrelationID(context.Background(), "")
+	if _, found := metadata.FromOutgoingContext(ctx); found {
+		t.Errorf("expected no metadata without correlation ID")
+	}
+}
@@ -20,19 +20,31 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"k8s.io/klog"
 
 	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
+	"github.com/kubernetes-csi/external-attacher/pkg/fencing"
+	"github.com/kubernetes-csi/external-attacher/pkg/hooks"
+	"github.com/kubernetes-csi/external-attacher/pkg/logging"
+	"github.com/kubernetes-csi/external-attacher/pkg/policy"
+	"google.golang.org/grpc/status"
 	v1 "k8s.io/api/core/v1"
 	storage "k8s.io/api/storage/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/kubernetes"
 	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
 	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	csitranslationlib "k8s.io/csi-translation-lib"
 )
@@ -49,11 +61,101 @@ type csiHandler struct {
 	csiNodeLister           storagelisters.CSINodeLister
 	vaLister                storagelisters.VolumeAttachmentLister
 	vaQueue, pvQueue        workqueue.RateLimitingInterface
-	timeout                 time.Duration
+	timeout                 int64 // time.Duration of CSI calls, accessed atomically
 	supportsPublishReadOnly bool
+	eventRecorder           record.EventRecorder
+	pvcEvents               bool // emit events also on PVCs bound to the volumes
+	eventFilter             *eventFilter
+	correlationIDs          *CorrelationIDs
+	logSampler              *logging.Sampler // nil logs all errors
+	operations              operations       // in progress
+	// slowOperationThreshold is the duration of successful CSI calls after
+	// which they are reported as slow. 0 disables the reports.
+	slowOperationThreshold time.Duration
+	lastErrorAnnotation    bool // save errors also in LastErrorAnnotation
+	progressAnnotations    bool // save times of attach phases in annotations
+	// storageClassLabels are values of the storageclass label of the
+	// operation duration metric.
+	storageClassLabels *StorageClassLabels
+	// allowedSecretNamespaces are namespaces from which secrets of PVs are
+	// read. nil allows all namespaces.
+	allowedSecretNamespaces sets.String
+	// excludedMetadataKeys are PublishContext keys that are not saved in
+	// attachment metadata of VolumeAttachments.
+	excludedMetadataKeys []string
+	// policy decides whether attach and detach may proceed. nil allows
+	// all operations.
+	policy policy.Checker
+	// quotas limit attached volumes per StorageClass and namespace. nil
+	// disables the limits.
+	quotas *quotaTracker
+	// hooks run commands before attach and after detach. nil runs no
+	// hooks.
+	hooks hooks.Runner
+	// unmountWait is how long detach waits until the volume is not in
+	// volumesInUse of its node. 0 detaches without waiting.
+	unmountWait time.Duration
+	// unreadyNodeGracePeriod is how long a node must be NotReady until
+	// its volumes are detached without waiting for unmount. 0 waits also
+	// for NotReady nodes.
+	unreadyNodeGracePeriod time.Duration
+	// notRegisteredBackoff is the backoff of VolumeAttachments whose
+	// driver is not registered on their node yet.
+	notRegisteredBackoff workqueue.RateLimiter
+	// volumeTimeouts honors TimeoutAnnotation of VolumeAttachments, PVs
+	// and StorageClasses from scLister.
+	volumeTimeouts bool
+	// publishParameters passes parameters of StorageClasses from scLister
+	// with PublishParameterPrefix to ControllerPublish.
+	publishParameters bool
+	scLister          storagelistersv1.StorageClassLister
+	// forcePublishAsBlock publishes filesystem volumes with a block
+	// VolumeCapability unless their PV has PublishAsBlockAnnotation.
+	forcePublishAsBlock bool
+	// accessModePolicy translates access modes of PVs to the access mode
+	// of ControllerPublish.
+	accessModePolicy AccessModePolicy
+	// republishInterval is the interval of publishing attached volumes
+	// again to refresh their attachment metadata. 0 disables it.
+	republishInterval time.Duration
+	// skipUnchangedRepublish skips publishing attached volumes again when
+	// the inputs of ControllerPublish did not change.
+	skipUnchangedRepublish bool
+	// publishTimes are times of the last publish of attached volumes, by
+	// VolumeAttachment name.
+	publishTimesLock sync.Mutex
+	publishTimes     map[string]time.Time
+	// nodeIDSource selects where IDs of nodes are found, nodeIDMapping is
+	// used with NodeIDFromFile.
+	nodeIDSource  NodeIDSource
+	nodeIDMapping *NodeIDMapping
+	// nodeAttachSoftLimit is the number of volumes attached to a node
+	// above which attaches are reported. 0 disables the reports.
+	nodeAttachSoftLimit int
+	// disablePVFinalizer does not add the finalizer of the attacher to
+	// PVs. Finalizers that are already present are still removed.
+	disablePVFinalizer bool
+	// repairDrift marks volumes as detached when ControllerUnpublish
+	// reports that they don't exist in the storage backend.
+	repairDrift bool
+	// fencing finds fenced nodes, whose volumes are detached without
+	// waiting for unmount. nil treats no node as fenced.
+	fencing fencing.Checker
+	// breaker pauses CSI calls after consecutive failures of the driver.
+	// nil never pauses them.
+	breaker *circuitBreaker
+	// workerScaler gets durations of CSI calls. nil ignores them.
+	workerScaler *workerScaler
+	// apiWriter saves results of attaches and detaches. nil saves them in
+	// the VolumeAttachment workers.
+	apiWriter *apiWriter
+	clock     clock.Clock
 }
 
 var _ Handler = &csiHandler{}
+var _ TimeoutSetter = &csiHandler{}
+var _ EventRecorderSetter = &csiHandler{}
+var _ CorrelationIDsSetter = &csiHandler{}
 
 // NewCSIHandler creates a new CSIHandler.
 func NewCSIHandler(
@@ -75,11 +177,42 @@ func NewCSIHandler(
 		nodeLister:              nodeLister,
 		csiNodeLister:           csiNodeLister,
 		vaLister:                vaLister,
-		timeout:                 *timeout,
+		timeout:                 int64(*timeout),
 		supportsPublishReadOnly: supportsPublishReadOnly,
+		clock:                   clock.RealClock{},
+		notRegisteredBackoff:    workqueue.NewItemExponentialFailureRateLimiter(notRegisteredRetryStart, notRegisteredRetryMax),
 	}
 }
 
+func (h *csiHandler) SetTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&h.timeout, int64(timeout))
+}
+
+func (h *csiHandler) SetEventRecorder(recorder record.EventRecorder) {
+	h.eventRecorder = recorder
+}
+
+func (h *csiHandler) SetCorrelationIDs(ids *CorrelationIDs) {
+	h.correlationIDs = ids
+}
+
+// correlationID returns the correlation ID of va, or an empty string when the
+// handler has no correlation IDs.
+func (h *csiHandler) correlationID(va *storage.VolumeAttachment) string {
+	if h.correlationIDs == nil {
+		return ""
+	}
+	return h.correlationIDs.Get(va.Name)
+}
+
+func (h *csiHandler) inFlight() []Operation {
+	return h.operations.list()
+}
+
+func (h *csiHandler) getTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&h.timeout))
+}
+
 func (h *csiHandler) Init(vaQueue workqueue.RateLimitingInterface, pvQueue workqueue.RateLimitingInterface) {
 	h.vaQueue = vaQueue
 	h.pvQueue = pvQueue
@@ -87,53 +220,182 @@ func (h *csiHandler) Init(vaQueue workqueue.RateLimitingInterface, pvQueue workq
 
 func (h *csiHandler) SyncNewOrUpdatedVolumeAttachment(va *storage.VolumeAttachment) {
 	klog.V(4).Infof("CSIHandler: processing VA %q", va.Name)
+	if h.apiWriter != nil {
+		pipelineQueueLength.WithLabelValues(h.attacherName, stageCSI).Set(float64(h.vaQueue.Len()))
+		if h.apiWriter.busy(va.Name) {
+			klog.V(4).Infof("Result of %q is being saved, processing it after the write", va.Name)
+			return
+		}
+	}
 
 	var err error
+	op := "attach"
 	if va.DeletionTimestamp == nil {
 		err = h.syncAttach(va)
 	} else {
+		op = "detach"
 		err = h.syncDetach(va)
 	}
+	if err == errWriteQueued {
+		return
+	}
+	h.finishSync(va, op, err)
+}
+
+// finishSync retries a failed attach or detach of va with backoff or resets
+// the backoff after success.
+func (h *csiHandler) finishSync(va *storage.VolumeAttachment, op string, err error) {
 	if err != nil {
+		if isQuotaExceeded(err) {
+			klog.V(2).Infof("Attach of %q waits for quota, retrying after %s: %s", va.Name, quotaRetryInterval, err)
+			h.vaQueue.AddAfter(va.Name, quotaRetryInterval)
+			return
+		}
+		if isDriverNotRegistered(err) {
+			delay := h.notRegisteredBackoff.When(va.Name)
+			klog.V(2).Infof("Processing of %q waits for driver registration, retrying after %s: %s", va.Name, delay, err)
+			driverNotRegisteredTotal.WithLabelValues(h.attacherName, op).Inc()
+			h.vaQueue.AddAfter(va.Name, delay)
+			return
+		}
+		if delay, deferred := getDeferral(err); deferred {
+			klog.V(2).Infof("Processing of %q deferred for %s: %s", va.Name, delay, err)
+			h.vaQueue.AddAfter(va.Name, delay)
+			return
+		}
+		if delay, open := getCircuitOpen(err); open {
+			// The breaker reports itself, don't log each VolumeAttachment.
+			klog.V(4).Infof("Processing of %q paused by circuit breaker for %s: %s", va.Name, delay, err)
+			h.vaQueue.AddAfter(va.Name, delay)
+			return
+		}
+		if delay, throttled := getRetryAfter(err); throttled {
+			// The API server asked us to slow down, honor its Retry-After.
+			klog.V(2).Infof("API server throttled processing of %q, retrying after %s: %s", va.Name, delay, err)
+			apiThrottledTotal.WithLabelValues(resourceVolumeAttachments).Inc()
+			h.vaQueue.AddAfter(va.Name, delay)
+			return
+		}
 		// Re-queue with exponential backoff
-		klog.V(2).Infof("Error processing %q: %s", va.Name, err)
+		if h.logSampler.Allow(ErrorClass(err.Error())) {
+			klog.V(2).Infof("Error processing %q: %s%s", va.Name, err, h.logFields(va, op))
+		}
 		h.vaQueue.AddRateLimited(va.Name)
 		return
 	}
 	// The operation has finished successfully, reset exponential backoff
 	h.vaQueue.Forget(va.Name)
+	h.notRegisteredBackoff.Forget(va.Name)
 	klog.V(4).Infof("CSIHandler: finished processing %q", va.Name)
 }
 
 func (h *csiHandler) syncAttach(va *storage.VolumeAttachment) error {
-	if va.Status.Attached {
+	if va.Status.Attached && !h.nodeIDChanged(va) {
+		if h.shouldRepublish(va) {
+			if h.skipUnchangedRepublish && h.publishInputsUnchanged(va) {
+				klog.V(4).Infof("Inputs of ControllerPublish of %q did not change, skipping it", va.Name)
+				republishSkippedTotal.WithLabelValues(h.attacherName).Inc()
+				h.published(va.Name)
+				return nil
+			}
+			return h.refreshAttachmentMetadata(va)
+		}
 		// Volume is attached, there is nothing to be done.
 		klog.V(4).Infof("%q is already attached", va.Name)
 		return nil
 	}
 
+	defer h.operations.start(va.Name, "attach", h.clock.Now())()
+
 	// Attach and report any error
-	klog.V(2).Infof("Attaching %q", va.Name)
-	va, metadata, err := h.csiAttach(va)
+	klog.V(2).Infof("Attaching %q%s", va.Name, h.logFields(va, "attach"))
+	start := h.clock.Now()
+	h.recordEvent(va, v1.EventTypeNormal, AttachStarted, "Attaching volume to node %s", va.Spec.NodeName)
+	state, err := h.csiAttach(va)
+	va = state.va
 	if err != nil {
-		var saveErr error
-		va, saveErr = h.saveAttachError(va, err)
-		if saveErr != nil {
-			// Just log it, propagate the attach error.
-			klog.V(2).Infof("Failed to save attach error to %q: %s", va.Name, saveErr.Error())
+		if isQuotaExceeded(err) {
+			h.recordEvent(va, v1.EventTypeWarning, AttachQuotaExceeded, "Attach of volume to node %s waits: %s", va.Spec.NodeName, err)
+		} else if _, deferred := getDeferral(err); deferred {
+			h.recordEvent(va, v1.EventTypeNormal, AttachDeferred, "Attach of volume to node %s deferred: %s", va.Spec.NodeName, err)
+		} else if _, open := getCircuitOpen(err); open {
+			// Reported once by the breaker.
+		} else if _, throttled := getRetryAfter(err); !throttled {
+			if isDriverNotRegistered(err) {
+				h.recordEvent(va, v1.EventTypeWarning, DriverNotRegisteredOnNode, "Attach of volume to node %s waits: %s", va.Spec.NodeName, err)
+			} else if isInvalidNodeID(err) {
+				attachSLI.record(h.attacherName, h.clock.Now(), false)
+				h.recordEvent(va, v1.EventTypeWarning, InvalidNodeID, "Failed to attach volume to node %s: %s", va.Spec.NodeName, err)
+			} else {
+				attachSLI.record(h.attacherName, h.clock.Now(), false)
+				h.recordEvent(va, v1.EventTypeWarning, AttachFailed, "Failed to attach volume to node %s: %s", va.Spec.NodeName, err)
+			}
+			var saveErr error
+			va, saveErr = h.saveAttachError(va, err)
+			if saveErr != nil {
+				// Just log it, propagate the attach error.
+				klog.V(2).Infof("Failed to save attach error to %q: %s", va.Name, saveErr.Error())
+			}
 		}
 		// Add context to the error for logging
-		err := fmt.Errorf("failed to attach: %s", err)
-		return err
+		return wrapError("failed to attach", err)
 	}
-	klog.V(2).Infof("Attached %q", va.Name)
+	publishFinished := h.clock.Now()
+	klog.V(2).Infof("Attached %q%s", va.Name, h.logFields(va, "attach", logging.KeyDurationMs, publishFinished.Sub(start)))
+
+	return h.writeResult(va, "attach", func() error {
+		// Mark as attached
+		err := h.runPhase(va, phaseWriteStatus, func() error {
+			return h.writeStatus(state, start, publishFinished)
+		})
+		if err != nil {
+			return err
+		}
+		h.published(va.Name)
+		attachSLI.record(h.attacherName, h.clock.Now(), true)
+		h.recordEvent(va, v1.EventTypeNormal, AttachSucceeded, "Attached volume to node %s", va.Spec.NodeName)
+		klog.V(4).Infof("Fully attached %q", va.Name)
+		return nil
+	})
+}
+
+// writeResult saves the result of a successful CSI call of operation op with
+// va by write. With API writers, it returns errWriteQueued and the writers
+// finish the sync of va.
+func (h *csiHandler) writeResult(va *storage.VolumeAttachment, op string, write func() error) error {
+	if h.apiWriter == nil {
+		return write()
+	}
+	h.apiWriter.submit(va.Name, write, func(err error, requeue bool) {
+		h.finishSync(va, op, err)
+		// A failed write is retried with backoff.
+		if requeue && err == nil {
+			h.vaQueue.Add(va.Name)
+		}
+	})
+	return errWriteQueued
+}
 
-	// Mark as attached
-	if _, err := markAsAttached(h.client, va, metadata); err != nil {
-		return fmt.Errorf("failed to mark as attached: %s", err)
+// excludeMetadata returns a copy of PublishContext of va without the
+// excluded keys.
+func (h *csiHandler) excludeMetadata(va *storage.VolumeAttachment, metadata map[string]string) map[string]string {
+	if len(h.excludedMetadataKeys) == 0 || len(metadata) == 0 {
+		return metadata
+	}
+	excluded := sets.NewString(h.excludedMetadataKeys...)
+	filtered := make(map[string]string, len(metadata))
+	var dropped []string
+	for key, value := range metadata {
+		if excluded.Has(key) {
+			dropped = append(dropped, key)
+			continue
+		}
+		filtered[key] = value
+	}
+	if len(dropped) > 0 {
+		klog.V(4).Infof("Not saving PublishContext keys %v in attachment metadata of %q", dropped, va.Name)
 	}
-	klog.V(4).Infof("Fully attached %q", va.Name)
-	return nil
+	return filtered
 }
 
 func (h *csiHandler) syncDetach(va *storage.VolumeAttachment) error {
@@ -143,22 +405,89 @@ func (h *csiHandler) syncDetach(va *storage.VolumeAttachment) error {
 		return nil
 	}
 
+	defer h.operations.start(va.Name, "detach", h.clock.Now())()
+
 	// Detach and report any error
-	klog.V(2).Infof("Detaching %q", va.Name)
-	va, err := h.csiDetach(va)
+	klog.V(2).Infof("Detaching %q%s", va.Name, h.logFields(va, "detach"))
+	start := h.clock.Now()
+	va, saveDetached, err := h.csiDetach(va)
 	if err != nil {
+		return h.detachFailed(va, err)
+	}
+	lastError := detachErrorClass(va)
+	return h.writeResult(va, "detach", func() error {
+		va, err := saveDetached()
+		if err != nil {
+			return h.detachFailed(va, err)
+		}
+		if va.DeletionTimestamp != nil {
+			detachLatency.WithLabelValues(h.attacherName, lastError).Observe(h.clock.Since(va.DeletionTimestamp.Time).Seconds())
+		}
+		h.forgetPublished(va.Name)
+		klog.V(2).Infof("Fully detached %q%s", va.Name, h.logFields(va, "detach", logging.KeyDurationMs, h.clock.Since(start)))
+		return nil
+	})
+}
+
+// detachErrorClass returns the ErrorClass of the last failed detach of va,
+// "OK" when no detach failed.
+func detachErrorClass(va *storage.VolumeAttachment) string {
+	if va.Status.DetachError == nil {
+		return "OK"
+	}
+	return ErrorClass(va.Status.DetachError.Message)
+}
+
+// detachFailed reports a failed detach of va and returns the error for
+// logging.
+func (h *csiHandler) detachFailed(va *storage.VolumeAttachment, err error) error {
+
+	if _, deferred := getDeferral(err); deferred {
+		h.recordEvent(va, v1.EventTypeNormal, DetachDeferred, "Detach of volume from node %s deferred: %s", va.Spec.NodeName, err)
+	} else if _, open := getCircuitOpen(err); open {
+		// Reported once by the breaker.
+	} else if _, throttled := getRetryAfter(err); !throttled {
+		if isDriverNotRegistered(err) {
+			h.recordEvent(va, v1.EventTypeWarning, DriverNotRegisteredOnNode, "Detach of volume from node %s waits: %s", va.Spec.NodeName, err)
+		} else if isInvalidNodeID(err) {
+			h.recordEvent(va, v1.EventTypeWarning, InvalidNodeID, "Failed to detach volume from node %s: %s", va.Spec.NodeName, err)
+		} else {
+			h.recordEvent(va, v1.EventTypeWarning, DetachFailed, "Failed to detach volume from node %s: %s", va.Spec.NodeName, err)
+		}
 		var saveErr error
 		va, saveErr = h.saveDetachError(va, err)
 		if saveErr != nil {
 			// Just log it, propagate the detach error.
 			klog.V(2).Infof("Failed to save detach error to %q: %s", va.Name, saveErr.Error())
 		}
-		// Add context to the error for logging
-		err := fmt.Errorf("failed to detach: %s", err)
-		return err
 	}
-	klog.V(4).Infof("Fully detached %q", va.Name)
-	return nil
+	// Add context to the error for logging
+	return wrapError("failed to detach", err)
+}
+
+// logFields returns structured fields of an operation with a VolumeAttachment
+// for log messages.
+func (h *csiHandler) logFields(va *storage.VolumeAttachment, op string, keysAndValues ...interface{}) string {
+	pvName := ""
+	if va.Spec.Source.PersistentVolumeName != nil {
+		pvName = *va.Spec.Source.PersistentVolumeName
+	}
+	fields := []interface{}{
+		logging.KeyDriver, h.attacherName,
+		logging.KeyVolumeAttachment, va.Name,
+		logging.KeyPV, pvName,
+	}
+	if claim := h.getClaim(va); claim != nil {
+		fields = append(fields, logging.KeyPVC, claim.Namespace+"/"+claim.Name)
+	}
+	fields = append(fields,
+		logging.KeyNode, va.Spec.NodeName,
+		logging.KeyOperation, op,
+	)
+	if id := h.correlationID(va); id != "" {
+		fields = append(fields, logging.KeyCorrelationID, id)
+	}
+	return logging.KV(append(fields, keysAndValues...)...)
 }
 
 func (h *csiHandler) prepareVAFinalizer(va *storage.VolumeAttachment) (newVA *storage.VolumeAttachment, modified bool) {
@@ -245,13 +574,11 @@ func getCSISource(pv *v1.PersistentVolume) (*v1.CSIPersistentVolumeSource, error
 	return nil, fmt.Errorf("pv contained non-csi source that was not migrated")
 }
 
-func (h *csiHandler) csiAttach(va *storage.VolumeAttachment) (*storage.VolumeAttachment, map[string]string, error) {
-	klog.V(4).Infof("Starting attach operation for %q", va.Name)
-	// Check as much as possible before adding VA finalizer - it would block
-	// deletion of VA on error.
-
+// csiDetach calls ControllerUnpublish for va. On success, it returns a
+// function that marks va as detached.
+func (h *csiHandler) csiDetach(va *storage.VolumeAttachment) (*storage.VolumeAttachment, func() (*storage.VolumeAttachment, error), error) {
 	var csiSource *v1.CSIPersistentVolumeSource
-	var pvSpec *v1.PersistentVolumeSpec
+	var policyPV *v1.PersistentVolume
 	if va.Spec.Source.PersistentVolumeName != nil {
 		if va.Spec.Source.InlineVolumeSpec != nil {
 			return va, nil, errors.New("both InlineCSIVolumeSource and PersistentVolumeName specified in VA source")
@@ -260,152 +587,127 @@ func (h *csiHandler) csiAttach(va *storage.VolumeAttachment) (*storage.VolumeAtt
 		if err != nil {
 			return va, nil, err
 		}
-		// Refuse to attach volumes that are marked for deletion.
-		if pv.DeletionTimestamp != nil {
-			return va, nil, fmt.Errorf("PersistentVolume %q is marked for deletion", pv.Name)
-		}
-		pv, err = h.addPVFinalizer(pv)
-		if err != nil {
-			return va, nil, fmt.Errorf("could not add PersistentVolume finalizer: %s", err)
-		}
-
 		if csitranslationlib.IsPVMigratable(pv) {
 			pv, err = csitranslationlib.TranslateInTreePVToCSI(pv)
 			if err != nil {
 				return va, nil, fmt.Errorf("failed to translate in tree pv to CSI: %v", err)
 			}
 		}
-
-		// Both csiSource and pvSpec could be translated here if the PV was
-		// migrated
 		csiSource, err = getCSISource(pv)
 		if err != nil {
 			return va, nil, err
 		}
-
-		pvSpec = &pv.Spec
+		policyPV = pv
 	} else if va.Spec.Source.InlineVolumeSpec != nil {
 		if va.Spec.Source.InlineVolumeSpec.CSI != nil {
 			csiSource = va.Spec.Source.InlineVolumeSpec.CSI
 		} else {
 			return va, nil, errors.New("inline volume spec contains nil CSI source")
 		}
-
-		pvSpec = va.Spec.Source.InlineVolumeSpec
 	} else {
 		return va, nil, errors.New("neither InlineCSIVolumeSource nor PersistentVolumeName specified in VA source")
 	}
 
-	attributes, err := GetVolumeAttributes(csiSource)
+	volumeHandle, _, err := GetVolumeHandle(csiSource)
 	if err != nil {
 		return va, nil, err
 	}
-
-	volumeHandle, readOnly, err := GetVolumeHandle(csiSource)
+	secrets, err := h.getCredentialsFromPV(csiSource)
 	if err != nil {
 		return va, nil, err
 	}
-	if !h.supportsPublishReadOnly {
-		// "CO MUST set this field to false if SP does not have the
-		// PUBLISH_READONLY controller capability"
-		readOnly = false
-	}
 
-	volumeCapabilities, err := GetVolumeCapabilities(pvSpec)
+	nodeID, err := h.getNodeID(h.attacherName, va.Spec.NodeName, va)
 	if err != nil {
 		return va, nil, err
 	}
-	secrets, err := h.getCredentialsFromPV(csiSource)
-	if err != nil {
+	if oldID, changed, err := h.changedNodeID(va, "detach", nodeID); err != nil {
 		return va, nil, err
+	} else if changed {
+		// The volume is published to the old ID.
+		nodeID = oldID
 	}
-
-	nodeID, err := h.getNodeID(h.attacherName, va.Spec.NodeName, nil)
-	if err != nil {
+	if err := h.checkUnmounted(va, csiSource); err != nil {
 		return va, nil, err
 	}
-
-	originalVA := va
-	va, finalizerAdded := h.prepareVAFinalizer(va)
-	va, nodeIDAdded := h.prepareVANodeID(va, nodeID)
-
-	if finalizerAdded || nodeIDAdded {
-		if va, err = h.patchVA(originalVA, va); err != nil {
-			return originalVA, nil, fmt.Errorf("could not save VolumeAttachment: %s", err)
-		}
+	if err := h.checkPolicy(va, policy.OperationDetach, policyPV, csiSource, nodeID); err != nil {
+		return va, nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
-	defer cancel()
-	// We're not interested in `detached` return value, the controller will
-	// issue Detach to be sure the volume is really detached.
-	publishInfo, _, err := h.attacher.Attach(ctx, volumeHandle, readOnly, nodeID, volumeCapabilities, attributes, secrets)
-	if err != nil {
+	duration, err := h.controllerUnpublish(va, policyPV, volumeHandle, nodeID, secrets)
+	if err != nil && !h.detachDrifted(va, err) {
+		// The volume may not be fully detached. Save the error and try again
+		// after backoff.
 		return va, nil, err
 	}
+	if err == nil {
+		h.checkSlowOperation(va, "detach", volumeHandle, duration)
+	}
+	klog.V(4).Infof("Detached %q", va.Name)
 
-	return va, publishInfo, nil
-}
-
-func (h *csiHandler) csiDetach(va *storage.VolumeAttachment) (*storage.VolumeAttachment, error) {
-	var csiSource *v1.CSIPersistentVolumeSource
-	if va.Spec.Source.PersistentVolumeName != nil {
-		if va.Spec.Source.InlineVolumeSpec != nil {
-			return va, errors.New("both InlineCSIVolumeSource and PersistentVolumeName specified in VA source")
+	return va, func() (*storage.VolumeAttachment, error) {
+		if va, err := markAsDetached(h.client, va); err != nil {
+			return va, wrapError("could not mark as detached", err)
 		}
-		pv, err := h.pvLister.Get(*va.Spec.Source.PersistentVolumeName)
-		if err != nil {
-			return va, err
-		}
-		if csitranslationlib.IsPVMigratable(pv) {
-			pv, err = csitranslationlib.TranslateInTreePVToCSI(pv)
-			if err != nil {
-				return va, fmt.Errorf("failed to translate in tree pv to CSI: %v", err)
-			}
-		}
-		csiSource, err = getCSISource(pv)
-		if err != nil {
-			return va, err
-		}
-	} else if va.Spec.Source.InlineVolumeSpec != nil {
-		if va.Spec.Source.InlineVolumeSpec.CSI != nil {
-			csiSource = va.Spec.Source.InlineVolumeSpec.CSI
-		} else {
-			return va, errors.New("inline volume spec contains nil CSI source")
+		// The volume is detached, a failed hook can't hold the
+		// VolumeAttachment.
+		if err := h.runHook(hooks.PostDetach, va, csiSource, nodeID, false); err != nil {
+			klog.Warningf("Post-detach hook of %q failed: %s", va.Name, err)
+			h.recordEvent(va, v1.EventTypeWarning, PostDetachHookFailed, "Hook after detach of volume from node %s failed: %s", va.Spec.NodeName, err)
 		}
-	} else {
-		return va, errors.New("neither InlineCSIVolumeSource nor PersistentVolumeName specified in VA source")
-	}
-
-	volumeHandle, _, err := GetVolumeHandle(csiSource)
-	if err != nil {
-		return va, err
-	}
-	secrets, err := h.getCredentialsFromPV(csiSource)
-	if err != nil {
-		return va, err
-	}
+		return va, nil
+	}, nil
+}
 
-	nodeID, err := h.getNodeID(h.attacherName, va.Spec.NodeName, va)
+// controllerUnpublish calls ControllerUnpublish of volumeHandle from nodeID
+// when the circuit breaker allows it, with the timeout of the volume of va
+// with PV pv. It records the result and returns the duration of the call.
+func (h *csiHandler) controllerUnpublish(va *storage.VolumeAttachment, pv *v1.PersistentVolume, volumeHandle, nodeID string, secrets map[string]string) (time.Duration, error) {
+	token, err := h.breaker.allow()
 	if err != nil {
-		return va, err
+		return 0, err
 	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	ctx, cancel := context.WithTimeout(withCorrelationID(context.Background(), h.correlationID(va)), h.volumeTimeout(va, pv))
 	defer cancel()
+	start := h.clock.Now()
 	err = h.attacher.Detach(ctx, volumeHandle, nodeID, secrets)
-	if err != nil {
-		// The volume may not be fully detached. Save the error and try again
-		// after backoff.
-		return va, err
-	}
-	klog.V(2).Infof("Detached %q", va.Name)
+	duration := h.clock.Since(start)
+	h.observeOperation("detach", pv, duration, err)
+	h.recordCSIResult(token, err)
+	return duration, err
+}
 
-	if va, err := markAsDetached(h.client, va); err != nil {
-		return va, fmt.Errorf("could not mark as detached: %s", err)
+// checkSlowOperation reports a successful attach or detach of volumeHandle
+// that took longer than the slow operation threshold by a warning event and
+// metric, so degrading storage backends are spotted before calls time out.
+func (h *csiHandler) checkSlowOperation(va *storage.VolumeAttachment, op, volumeHandle string, duration time.Duration) {
+	if h.slowOperationThreshold <= 0 || duration <= h.slowOperationThreshold {
+		return
+	}
+	slowOperationsTotal.WithLabelValues(h.attacherName, op).Inc()
+	klog.Warningf("Slow %s of %q%s", op, va.Name, h.logFields(va, op, logging.KeyDurationMs, duration))
+	if op == "attach" {
+		h.recordEvent(va, v1.EventTypeWarning, SlowAttach, "ControllerPublish of volume %s to node %s took %s", volumeHandle, va.Spec.NodeName, duration.Round(time.Millisecond))
+	} else {
+		h.recordEvent(va, v1.EventTypeWarning, SlowDetach, "ControllerUnpublish of volume %s from node %s took %s", volumeHandle, va.Spec.NodeName, duration.Round(time.Millisecond))
 	}
+}
 
-	return va, nil
+// observeOperation records the duration and the error code of a
+// ControllerPublish or ControllerUnpublish call of a volume with PV pv, nil
+// for inline volumes.
+func (h *csiHandler) observeOperation(op string, pv *v1.PersistentVolume, duration time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+		method := "ControllerPublishVolume"
+		if op == "detach" {
+			method = "ControllerUnpublishVolume"
+		}
+		operationErrorsTotal.WithLabelValues(method, status.Code(err).String()).Inc()
+	}
+	operationDuration.WithLabelValues(h.attacherName, h.storageClassLabels.pvValue(pv), op, result).Observe(duration.Seconds())
+	h.workerScaler.observe(duration)
 }
 
 func (h *csiHandler) saveAttachError(va *storage.VolumeAttachment, err error) (*storage.VolumeAttachment, error) {
@@ -413,7 +715,10 @@ func (h *csiHandler) saveAttachError(va *storage.VolumeAttachment, err error) (*
 	clone := va.DeepCopy()
 	clone.Status.AttachError = &storage.VolumeError{
 		Message: err.Error(),
-		Time:    metav1.Now(),
+		Time:    metav1.NewTime(h.clock.Now()),
+	}
+	if h.lastErrorAnnotation {
+		setLastError(clone, "attach", err.Error(), clone.Status.AttachError.Time)
 	}
 
 	var newVa *storage.VolumeAttachment
@@ -429,7 +734,10 @@ func (h *csiHandler) saveDetachError(va *storage.VolumeAttachment, err error) (*
 	clone := va.DeepCopy()
 	clone.Status.DetachError = &storage.VolumeError{
 		Message: err.Error(),
-		Time:    metav1.Now(),
+		Time:    metav1.NewTime(h.clock.Now()),
+	}
+	if h.lastErrorAnnotation {
+		setLastError(clone, "detach", err.Error(), clone.Status.DetachError.Time)
 	}
 
 	var newVa *storage.VolumeAttachment
@@ -500,6 +808,12 @@ func (h *csiHandler) SyncNewOrUpdatedPersistentVolume(pv *v1.PersistentVolume) {
 	clone.Finalizers = newFinalizers
 
 	if _, err = h.patchPV(pv, clone); err != nil {
+		if delay, throttled := throttledByAPIServer(err); throttled {
+			klog.V(2).Infof("API server throttled finalizer removal from PV %q, retrying after %s", pv.Name, delay)
+			apiThrottledTotal.WithLabelValues(resourcePersistentVolumes).Inc()
+			h.pvQueue.AddAfter(pv.Name, delay)
+			return
+		}
 		klog.Errorf("Failed to remove finalizer from PV %q: %s", pv.Name, err.Error())
 		h.pvQueue.AddRateLimited(pv.Name)
 		return
@@ -519,10 +833,13 @@ func (h *csiHandler) getCredentialsFromPV(csiSource *v1.CSIPersistentVolumeSourc
 	if secretRef == nil {
 		return nil, nil
 	}
+	if h.allowedSecretNamespaces != nil && !h.allowedSecretNamespaces.Has(secretRef.Namespace) {
+		return nil, fmt.Errorf("secret \"%s/%s\" is not in an allowed secret namespace: %s", secretRef.Namespace, secretRef.Name, strings.Join(h.allowedSecretNamespaces.List(), ", "))
+	}
 
 	secret, err := h.client.CoreV1().Secrets(secretRef.Namespace).Get(secretRef.Name, metav1.GetOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("failed to load secret \"%s/%s\": %s", secretRef.Namespace, secretRef.Name, err)
+		return nil, wrapError(fmt.Sprintf("failed to load secret \"%s/%s\"", secretRef.Namespace, secretRef.Name), err)
 	}
 	credentials := map[string]string{}
 	for key, value := range secret.Data {
@@ -532,27 +849,39 @@ func (h *csiHandler) getCredentialsFromPV(csiSource *v1.CSIPersistentVolumeSourc
 	return credentials, nil
 }
 
-// getNodeID finds node ID from Node API object. If caller wants, it can find
-// node ID stored in VolumeAttachment annotation.
+// getNodeID finds node ID from Node API object and checks that it is valid.
+// If caller wants, it can find node ID stored in VolumeAttachment
+// annotation.
 func (h *csiHandler) getNodeID(driver string, nodeName string, va *storage.VolumeAttachment) (string, error) {
-	// Try to find CSINode first.
-	csiNode, err := h.csiNodeLister.Get(nodeName)
-	if err == nil {
-		if nodeID, found := GetNodeIDFromCSINode(driver, csiNode); found {
-			klog.V(4).Infof("Found NodeID %s in CSINode %s", nodeID, nodeName)
+	nodeID, err := h.findNodeID(driver, nodeName, va)
+	if err != nil {
+		return "", err
+	}
+	if err := validateNodeID(driver, nodeName, nodeID); err != nil {
+		return "", err
+	}
+	return nodeID, nil
+}
+
+func (h *csiHandler) findNodeID(driver string, nodeName string, va *storage.VolumeAttachment) (string, error) {
+	switch h.nodeIDSource {
+	case NodeIDFromFile:
+		return h.findNodeIDInMapping(nodeName, va)
+	case NodeIDFromAnnotation:
+		// Only the Node annotation.
+	default:
+		// Try to find CSINode first.
+		if nodeID, found := h.findNodeIDInCSINode(driver, nodeName); found {
 			return nodeID, nil
 		}
-		klog.V(4).Infof("CSINode %s does not contain driver %s", nodeName, driver)
-		// CSINode exists, but does not have the requested driver.
-		// Fall through to Node annotation.
-	} else {
-		// Can't get CSINode, fall through to Node annotation.
-		klog.V(4).Infof("Can't get CSINode %s: %s", nodeName, err)
 	}
 
 	// Check Node annotation.
 	node, err := h.nodeLister.Get(nodeName)
 	if err == nil {
+		if !hasNodeIDAnnotation(driver, node) {
+			return "", newDriverNotRegisteredError(driver, nodeName)
+		}
 		return GetNodeIDFromNode(driver, node)
 	}
 
@@ -568,6 +897,23 @@ func (h *csiHandler) getNodeID(driver string, nodeName string, va *storage.Volum
 	return "", err
 }
 
+func (h *csiHandler) findNodeIDInCSINode(driver string, nodeName string) (string, bool) {
+	csiNode, err := h.csiNodeLister.Get(nodeName)
+	if err == nil {
+		if nodeID, found := GetNodeIDFromCSINode(driver, csiNode); found {
+			klog.V(4).Infof("Found NodeID %s in CSINode %s", nodeID, nodeName)
+			return nodeID, true
+		}
+		klog.V(4).Infof("CSINode %s does not contain driver %s", nodeName, driver)
+		// CSINode exists, but does not have the requested driver.
+		// Fall through to Node annotation.
+	} else {
+		// Can't get CSINode, fall through to Node annotation.
+		klog.V(4).Infof("Can't get CSINode %s: %s", nodeName, err)
+	}
+	return "", false
+}
+
 func (h *csiHandler) patchVA(va, clone *storage.VolumeAttachment) (*storage.VolumeAttachment, error) {
 	patch, err := createMergePatch(va, clone)
 	if err != nil {
@@ -19,6 +19,7 @@ package controller
 import (
 	"errors"
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
@@ -31,8 +32,10 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
 	core "k8s.io/client-go/testing"
 	"k8s.io/klog"
 )
@@ -197,6 +200,12 @@ func nodeWithoutAnnotations() *v1.Node {
 	return n
 }
 
+func nodeWithMalformedAnnotation() *v1.Node {
+	n := node()
+	n.Annotations = map[string]string{nodeIDAnnotation: "nope"}
+	return n
+}
+
 func csiNode() *storage.CSINode {
 	return &storage.CSINode{
 		ObjectMeta: metav1.ObjectMeta{
@@ -299,6 +308,10 @@ func TestCSIHandler(t *testing.T) {
 			expectedCSICalls: []csiCall{
 				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, noMetadata, 0},
 			},
+			expectedEvents: []string{
+				"Normal AttachStarted Attaching volume to node node1",
+				"Normal AttachSucceeded Attached volume to node node1",
+			},
 		},
 		{
 			name:           "VolumeAttachment with InlineVolumeSpec -> successful attachment",
@@ -574,6 +587,50 @@ func TestCSIHandler(t *testing.T) {
 				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, noMetadata, 0},
 			},
 		},
+		{
+			name:           "PV finalizer throttled by API server -> retried without saving error",
+			initialObjects: []runtime.Object{pv(), node()},
+			updatedVA:      va(false, "", nil),
+			reactors: []reaction{
+				{
+					verb:     "patch",
+					resource: "persistentvolumes",
+					reactor: func(t *testing.T) core.ReactionFunc {
+						i := 0
+						return func(core.Action) (bool, runtime.Object, error) {
+							i++
+							if i < 2 {
+								// Update is throttled once
+								return true, nil, apierrors.NewTooManyRequests("Mock throttling", 1)
+							}
+							return false, nil, nil
+						}
+					},
+				},
+			},
+			expectedActions: []core.Action{
+				// PV Finalizer - throttled, no error is saved to VA
+				core.NewPatchAction(pvGroupResourceVersion, metav1.NamespaceNone, testPVName,
+					types.MergePatchType, patch(pv(), pvWithFinalizer())),
+				// Second PV Finalizer after Retry-After - succeeds
+				core.NewPatchAction(pvGroupResourceVersion, metav1.NamespaceNone, testPVName,
+					types.MergePatchType, patch(pv(), pvWithFinalizer())),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, "" /*finalizer*/, nil /* annotations */),
+						va(false /*attached*/, fin, ann))),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, fin, ann),
+						va(true /*attached*/, fin, ann))),
+			},
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, noMetadata, 0},
+			},
+			additionalCheck: func(t *testing.T, test testCase) {
+				if apiThrottledTotal.WithLabelValues(resourceVolumeAttachments).Value() == 0 {
+					t.Errorf("Test %q: expected throttled counter to be incremented", test.name)
+				}
+			},
+		},
 		{
 			name:             "already attached volume -> ignored",
 			initialObjects:   []runtime.Object{pvWithFinalizer(), node()},
@@ -802,6 +859,12 @@ func TestCSIHandler(t *testing.T) {
 				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, fmt.Errorf("mock error"), notDetached, noMetadata, 0},
 				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, noMetadata, 0},
 			},
+			expectedEvents: []string{
+				"Normal AttachStarted Attaching volume to node node1",
+				"Warning AttachFailed Failed to attach volume to node node1: mock error",
+				"Normal AttachStarted Attaching volume to node node1",
+				"Normal AttachSucceeded Attached volume to node node1",
+			},
 		},
 		{
 			name:           "CSI attach times out -> controller retries",
@@ -822,23 +885,41 @@ func TestCSIHandler(t *testing.T) {
 			},
 		},
 		{
-			name:           "Node without annotations -> error",
+			name:           "Node without annotations -> waits for driver registration",
 			initialObjects: []runtime.Object{pvWithFinalizer(), nodeWithoutAnnotations()},
 			addedVA:        va(false, fin, ann),
 			expectedActions: []core.Action{
 				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
 					types.MergePatchType, patch(va(false /*attached*/, fin, ann),
-						vaWithAttachError(va(false, fin, ann), "node \"node1\" has no NodeID annotation"))),
+						vaWithAttachError(va(false, fin, ann), "CSI driver csi/test is not registered on node node1"))),
+			},
+			expectedEvents: []string{
+				"Normal AttachStarted Attaching volume to node node1",
+				"Warning DriverNotRegisteredOnNode Attach of volume to node node1 waits: CSI driver csi/test is not registered on node node1",
 			},
 		},
 		{
-			name:           "CSINode exists without the driver, Node without annotations -> error",
+			name:           "CSINode exists without the driver, Node without annotations -> waits for driver registration",
 			initialObjects: []runtime.Object{pvWithFinalizer(), nodeWithoutAnnotations(), csiNodeEmpty()},
 			addedVA:        va(false, fin, ann),
 			expectedActions: []core.Action{
 				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
 					types.MergePatchType, patch(va(false /*attached*/, fin, ann),
-						vaWithAttachError(va(false, fin, ann), "node \"node1\" has no NodeID annotation"))),
+						vaWithAttachError(va(false, fin, ann), "CSI driver csi/test is not registered on node node1"))),
+			},
+		},
+		{
+			name:           "Node with malformed annotation -> error",
+			initialObjects: []runtime.Object{pvWithFinalizer(), nodeWithMalformedAnnotation()},
+			addedVA:        va(false, fin, ann),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, fin, ann),
+						vaWithAttachError(va(false, fin, ann), "cannot parse NodeID annotation on node \"node1\": invalid character 'o' in literal null (expecting 'u')"))),
+			},
+			expectedEvents: []string{
+				"Normal AttachStarted Attaching volume to node node1",
+				"Warning AttachFailed Failed to attach volume to node node1: cannot parse NodeID annotation on node \"node1\": invalid character 'o' in literal null (expecting 'u')",
 			},
 		},
 		{
@@ -990,6 +1071,9 @@ func TestCSIHandler(t *testing.T) {
 				{"detach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, fmt.Errorf("mock error"), ignored, noMetadata, 0},
 				{"detach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, ignored, noMetadata, 0},
 			},
+			expectedEvents: []string{
+				"Warning DetachFailed Failed to detach volume from node node1: mock error",
+			},
 		},
 		{
 			name:           "CSI detach times out -> controller retries",
@@ -1103,7 +1187,7 @@ func TestCSIHandler(t *testing.T) {
 			},
 		},
 		{
-			name:           "VolumeAttachment marked for deletion -> node is preferred over VA annotation for NodeID",
+			name:           "VolumeAttachment marked for deletion -> VA annotation is preferred over changed node ID",
 			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
 			addedVA:        deleted(va(true, fin, map[string]string{vaNodeIDAnnotation: "annotatedNodeID"})),
 			expectedActions: []core.Action{
@@ -1112,7 +1196,7 @@ func TestCSIHandler(t *testing.T) {
 						deleted(va(false /*attached*/, "", map[string]string{vaNodeIDAnnotation: "annotatedNodeID"})))),
 			},
 			expectedCSICalls: []csiCall{
-				{"detach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, detached, noMetadata, 0},
+				{"detach", testVolumeHandle, "annotatedNodeID", noAttrs, noSecrets, readWrite, success, detached, noMetadata, 0},
 			},
 		},
 		{
@@ -1315,3 +1399,283 @@ func TestCSIHandlerReadOnly(t *testing.T) {
 	}
 	runTests(t, csiHandlerFactoryNoReadOnly, tests)
 }
+
+func TestCSIHandlerAllowedSecretNamespaces(t *testing.T) {
+	vaGroupResourceVersion := schema.GroupVersionResource{
+		Group:    storage.GroupName,
+		Version:  "v1beta1",
+		Resource: "volumeattachments",
+	}
+	secretGroupResourceVersion := schema.GroupVersionResource{
+		Group:    v1.GroupName,
+		Version:  "v1",
+		Resource: "secrets",
+	}
+	var noMetadata map[string]string
+	var noAttrs map[string]string
+	var notDetached = false
+	var success error
+	var readWrite = false
+
+	factory := func(allowed ...string) handlerFactory {
+		return func(client kubernetes.Interface, informerFactory informers.SharedInformerFactory, csi attacher.Attacher) Handler {
+			handler := csiHandlerFactory(client, informerFactory, csi)
+			handler.(*csiHandler).allowedSecretNamespaces = sets.NewString(allowed...)
+			return handler
+		}
+	}
+
+	runTests(t, factory("default"), []testCase{
+		{
+			name:           "secret in allowed namespace -> successful attachment",
+			initialObjects: []runtime.Object{pvWithSecret(pvWithFinalizer(), "secret"), node(), secret()},
+			updatedVA:      va(false, "", nil),
+			expectedActions: []core.Action{
+				core.NewGetAction(secretGroupResourceVersion, "default", "secret"),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, "" /*finalizer*/, nil /* annotations */),
+						va(false /*attached*/, fin, ann))),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, fin, ann),
+						va(true /*attached*/, fin, ann))),
+			},
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, noAttrs, map[string]string{"foo": "bar"}, readWrite, success, notDetached, noMetadata, 0},
+			},
+		},
+	})
+	runTests(t, factory("kube-system", "storage"), []testCase{
+		{
+			name:           "secret in other namespace -> error without reading the secret",
+			initialObjects: []runtime.Object{pvWithSecret(pvWithFinalizer(), "secret"), node(), secret()},
+			updatedVA:      va(false, "", nil),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, "", nil),
+						vaWithAttachError(va(false, "", nil), "secret \"default/secret\" is not in an allowed secret namespace: kube-system, storage"))),
+			},
+			expectedCSICalls: []csiCall{},
+		},
+		{
+			name:           "detach with secret in other namespace -> error without reading the secret",
+			initialObjects: []runtime.Object{pvWithSecret(pvWithFinalizer(), "secret"), node(), secret()},
+			addedVA:        deleted(va(true, fin, ann)),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(deleted(va(true, fin, ann)),
+						deleted(vaWithDetachError(va(true, fin, ann),
+							"secret \"default/secret\" is not in an allowed secret namespace: kube-system, storage")))),
+			},
+			expectedCSICalls: []csiCall{},
+		},
+	})
+}
+
+func TestCSIHandlerExcludedMetadataKeys(t *testing.T) {
+	vaGroupResourceVersion := schema.GroupVersionResource{
+		Group:    storage.GroupName,
+		Version:  "v1beta1",
+		Resource: "volumeattachments",
+	}
+	var noAttrs map[string]string
+	var noSecrets map[string]string
+	var notDetached = false
+	var success error
+	var readWrite = false
+
+	factory := func(client kubernetes.Interface, informerFactory informers.SharedInformerFactory, csi attacher.Attacher) Handler {
+		handler := csiHandlerFactory(client, informerFactory, csi)
+		handler.(*csiHandler).excludedMetadataKeys = []string{"chap"}
+		return handler
+	}
+	runTests(t, factory, []testCase{
+		{
+			name:           "excluded keys are not saved in metadata",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        va(false, "", nil),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, "", nil), va(false /*attached*/, fin, ann))),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, fin, ann),
+						vaWithMetadata(va(true, fin, ann), map[string]string{"iqn": "target"}))),
+			},
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, map[string]string{"iqn": "target", "chap": "secret"}, 0},
+			},
+		},
+	})
+}
+
+func TestCheckSlowOperation(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		op        string
+		duration  time.Duration
+		expected  []string
+	}{
+		{
+			name:     "disabled",
+			op:       "attach",
+			duration: time.Hour,
+		},
+		{
+			name:      "fast attach",
+			threshold: time.Minute,
+			op:        "attach",
+			duration:  time.Second,
+		},
+		{
+			name:      "slow attach",
+			threshold: time.Minute,
+			op:        "attach",
+			duration:  90 * time.Second,
+			expected:  []string{"Warning SlowAttach ControllerPublish of volume " + testVolumeHandle + " to node node1 took 1m30s"},
+		},
+		{
+			name:      "slow detach",
+			threshold: time.Minute,
+			op:        "detach",
+			duration:  2 * time.Minute,
+			expected:  []string{"Warning SlowDetach ControllerUnpublish of volume " + testVolumeHandle + " from node node1 took 2m0s"},
+		},
+	}
+	for _, test := range tests {
+		recorder := newAnnotatedRecorder(10)
+		h := &csiHandler{
+			eventRecorder:          recorder,
+			slowOperationThreshold: test.threshold,
+		}
+		counter := slowOperationsTotal.WithLabelValues("", test.op)
+		before := counter.Value()
+
+		h.checkSlowOperation(va(false, "", nil), test.op, testVolumeHandle, test.duration)
+		close(recorder.Events)
+		var events []string
+		for event := range recorder.Events {
+			events = append(events, event)
+		}
+		if !reflect.DeepEqual(test.expected, events) {
+			t.Errorf("%s: expected events %q, got %q", test.name, test.expected, events)
+		}
+		if increase := counter.Value() - before; increase != float64(len(test.expected)) {
+			t.Errorf("%s: expected metric increase %d, got %v", test.name, len(test.expected), increase)
+		}
+	}
+}
+
+func TestLogFields(t *testing.T) {
+	boundPV := pv()
+	boundPV.Spec.ClaimRef = &v1.ObjectReference{Namespace: "ns", Name: "claim"}
+
+	tests := []struct {
+		name     string
+		pv       *v1.PersistentVolume
+		expected string
+	}{
+		{
+			name:     "bound PV",
+			pv:       boundPV,
+			expected: ` driver="csi/test" volumeattachment="pv1-node1" pv="pv1" pvc="ns/claim" node="node1" op="attach"`,
+		},
+		{
+			name:     "unbound PV",
+			pv:       pv(),
+			expected: ` driver="csi/test" volumeattachment="pv1-node1" pv="pv1" node="node1" op="attach"`,
+		},
+		{
+			name:     "missing PV",
+			expected: ` driver="csi/test" volumeattachment="pv1-node1" pv="pv1" node="node1" op="attach"`,
+		},
+	}
+	for _, test := range tests {
+		factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+		pvInformer := factory.Core().V1().PersistentVolumes()
+		if test.pv != nil {
+			pvInformer.Informer().GetStore().Add(test.pv)
+		}
+		h := &csiHandler{attacherName: testAttacherName, pvLister: pvInformer.Lister()}
+		if fields := h.logFields(va(false, "", nil), "attach"); fields != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, fields)
+		}
+	}
+}
+
+func TestDetachLatency(t *testing.T) {
+	vaGroupResourceVersion := schema.GroupVersionResource{
+		Group:    storage.GroupName,
+		Version:  "v1beta1",
+		Resource: "volumeattachments",
+	}
+	var noMetadata map[string]string
+	var noAttrs map[string]string
+	var noSecrets map[string]string
+	var success error
+	var readWrite = false
+	var ignored = false
+	timedOut := "rpc error: code = DeadlineExceeded desc = timed out"
+	before := detachLatency.WithLabelValues(testAttacherName, "DeadlineExceeded").Count()
+
+	tests := []testCase{
+		{
+			name:           "detach after a failed detach -> latency observed with its error class",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        deleted(vaWithDetachError(va(true, fin, ann), timedOut)),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(deleted(vaWithDetachError(va(true, fin, ann), timedOut)),
+						deleted(va(false, "", ann)))),
+			},
+			expectedCSICalls: []csiCall{
+				{"detach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, ignored, noMetadata, 0},
+			},
+		},
+	}
+	runTests(t, csiHandlerFactory, tests)
+	if count := detachLatency.WithLabelValues(testAttacherName, "DeadlineExceeded").Count() - before; count != 1 {
+		t.Errorf("expected 1 observed detach with last error DeadlineExceeded, got %d", count)
+	}
+	if class := detachErrorClass(deleted(va(true, fin, ann))); class != "OK" {
+		t.Errorf("expected error class OK without detach error, got %s", class)
+	}
+}
+
+func TestCSIHandlerDisablePVFinalizer(t *testing.T) {
+	vaGroupResourceVersion := schema.GroupVersionResource{
+		Group:    storage.GroupName,
+		Version:  "v1beta1",
+		Resource: "volumeattachments",
+	}
+	var noMetadata map[string]string
+	var noAttrs map[string]string
+	var noSecrets map[string]string
+	var success error
+	var readWrite = false
+	var notDetached = false
+	factory := func(client kubernetes.Interface, informerFactory informers.SharedInformerFactory, csi attacher.Attacher) Handler {
+		handler := csiHandlerFactory(client, informerFactory, csi)
+		handler.(*csiHandler).disablePVFinalizer = true
+		return handler
+	}
+
+	tests := []testCase{
+		{
+			name:           "PV without finalizer -> attached without PV finalizer",
+			initialObjects: []runtime.Object{pv(), node()},
+			updatedVA:      va(false, "", nil),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false, "", nil),
+						va(false, fin, ann))),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false, fin, ann),
+						va(true, fin, ann))),
+			},
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, noMetadata, 0},
+			},
+		},
+	}
+	runTests(t, factory, tests)
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	storageinformers "k8s.io/client-go/informers/storage/v1beta1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+)
+
+// csiDriverHandler is a handler that honors spec.attachRequired of the
+// CSIDriver object of the driver. VolumeAttachments are handled by the CSI
+// handler when attach is required (also when there is no CSIDriver object)
+// and by the trivial handler otherwise. VolumeAttachments that were already
+// attached by the CSI handler stay with the CSI handler, so they are
+// properly detached. All VolumeAttachments of the driver are re-queued when
+// attachRequired changes, no restart is needed. With skipAttachAnnotation,
+// VolumeAttachments with SkipAttachAnnotation are handled by the trivial
+// handler too.
+type csiDriverHandler struct {
+	driverName      string
+	csiHandler      Handler
+	trivialHandler  Handler
+	csiDriverLister storagelisters.CSIDriverLister
+	vaLister        storagelisters.VolumeAttachmentLister
+	vaQueue         workqueue.RateLimitingInterface
+	// skipAttachAnnotation honors SkipAttachAnnotation of VolumeAttachments
+	// and PVs from pvLister.
+	skipAttachAnnotation bool
+	pvLister             corelisters.PersistentVolumeLister
+
+	lock sync.Mutex
+	// attachRequired is the last seen attachRequired of the driver.
+	attachRequired bool
+}
+
+var _ Handler = &csiDriverHandler{}
+var _ TimeoutSetter = &csiDriverHandler{}
+var _ EventRecorderSetter = &csiDriverHandler{}
+var _ CorrelationIDsSetter = &csiDriverHandler{}
+
+// NewCSIDriverHandler returns a new Handler that switches between csiHandler
+// and trivialHandler based on CSIDriver object of the driver.
+func NewCSIDriverHandler(driverName string, csiHandler, trivialHandler Handler, csiDriverInformer storageinformers.CSIDriverInformer, vaLister storagelisters.VolumeAttachmentLister) Handler {
+	h := &csiDriverHandler{
+		driverName:      driverName,
+		csiHandler:      csiHandler,
+		trivialHandler:  trivialHandler,
+		csiDriverLister: csiDriverInformer.Lister(),
+		vaLister:        vaLister,
+		attachRequired:  true,
+	}
+	csiDriverInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    h.csiDriverChanged,
+		UpdateFunc: func(old, new interface{}) { h.csiDriverChanged(new) },
+		DeleteFunc: h.csiDriverChanged,
+	})
+	return h
+}
+
+func (h *csiDriverHandler) Init(vaQueue workqueue.RateLimitingInterface, pvQueue workqueue.RateLimitingInterface) {
+	h.vaQueue = vaQueue
+	h.csiHandler.Init(vaQueue, pvQueue)
+	h.trivialHandler.Init(vaQueue, pvQueue)
+}
+
+func (h *csiDriverHandler) SetTimeout(timeout time.Duration) {
+	if setter, ok := h.csiHandler.(TimeoutSetter); ok {
+		setter.SetTimeout(timeout)
+	}
+}
+
+func (h *csiDriverHandler) SetEventRecorder(recorder record.EventRecorder) {
+	if setter, ok := h.csiHandler.(EventRecorderSetter); ok {
+		setter.SetEventRecorder(recorder)
+	}
+}
+
+func (h *csiDriverHandler) SetCorrelationIDs(ids *CorrelationIDs) {
+	if setter, ok := h.csiHandler.(CorrelationIDsSetter); ok {
+		setter.SetCorrelationIDs(ids)
+	}
+}
+
+func (h *csiDriverHandler) inFlight() []Operation {
+	if lister, ok := h.csiHandler.(inFlightLister); ok {
+		return lister.inFlight()
+	}
+	return nil
+}
+
+func (h *csiDriverHandler) SyncNewOrUpdatedVolumeAttachment(va *storage.VolumeAttachment) {
+	if (!h.isAttachRequired() || h.skipAttach(va)) && !hasFinalizer(va.Finalizers, GetFinalizerName(h.driverName)) {
+		h.trivialHandler.SyncNewOrUpdatedVolumeAttachment(va)
+		return
+	}
+	h.csiHandler.SyncNewOrUpdatedVolumeAttachment(va)
+}
+
+func (h *csiDriverHandler) SyncNewOrUpdatedPersistentVolume(pv *v1.PersistentVolume) {
+	// Finalizers of PVs are added only by the CSI handler, it must remove
+	// them even when attach is not required any longer.
+	h.csiHandler.SyncNewOrUpdatedPersistentVolume(pv)
+}
+
+// isAttachRequired returns attachRequired of the CSIDriver object of the
+// driver. Attach is required when there is no CSIDriver object.
+func (h *csiDriverHandler) isAttachRequired() bool {
+	csiDriver, err := h.csiDriverLister.Get(h.driverName)
+	if err != nil {
+		if !apierrs.IsNotFound(err) {
+			klog.Errorf("Failed to get CSIDriver %s: %v", h.driverName, err)
+		}
+		return true
+	}
+	if csiDriver.Spec.AttachRequired == nil {
+		return true
+	}
+	return *csiDriver.Spec.AttachRequired
+}
+
+// csiDriverChanged re-queues all VolumeAttachments of the driver when
+// attachRequired of the driver changed.
+func (h *csiDriverHandler) csiDriverChanged(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	csiDriver, ok := obj.(*storage.CSIDriver)
+	if !ok || csiDriver.Name != h.driverName {
+		return
+	}
+
+	attachRequired := h.isAttachRequired()
+	h.lock.Lock()
+	changed := attachRequired != h.attachRequired
+	h.attachRequired = attachRequired
+	h.lock.Unlock()
+	if !changed || h.vaQueue == nil {
+		return
+	}
+
+	klog.Infof("CSIDriver %s changed attachRequired to %t, re-queuing its VolumeAttachments", h.driverName, attachRequired)
+	vas, err := h.vaLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list VolumeAttachments: %v", err)
+		return
+	}
+	for _, va := range vas {
+		if va.Spec.Attacher == h.driverName {
+			h.vaQueue.Add(va.Name)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestCSIDriverHandler(t *testing.T) {
+	plain := va(false, "", nil)
+	plain.Name = "plain"
+	attached := va(true, fin, ann)
+	attached.Name = "attached"
+	other := createVolumeAttachment("other-attacher", testPVName, testNodeName, false, "", nil)
+	other.Name = "other"
+
+	client := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(client, 0)
+	vaInformer := factory.Storage().V1beta1().VolumeAttachments()
+	csiDriverInformer := factory.Storage().V1beta1().CSIDrivers()
+	for _, va := range []*storage.VolumeAttachment{plain, attached, other} {
+		vaInformer.Informer().GetStore().Add(va)
+	}
+
+	csiHandler := &recordingHandler{vas: sets.NewString(), pvs: sets.NewString()}
+	trivialHandler := &recordingHandler{vas: sets.NewString(), pvs: sets.NewString()}
+	h := NewCSIDriverHandler(testAttacherName, csiHandler, trivialHandler, csiDriverInformer, vaInformer.Lister()).(*csiDriverHandler)
+	vaQueue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer vaQueue.ShutDown()
+	h.Init(vaQueue, workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()))
+
+	sync := func() {
+		csiHandler.vas, trivialHandler.vas = sets.NewString(), sets.NewString()
+		for _, va := range []*storage.VolumeAttachment{plain, attached} {
+			h.SyncNewOrUpdatedVolumeAttachment(va)
+		}
+	}
+	queued := func() sets.String {
+		s := sets.NewString()
+		for vaQueue.Len() > 0 {
+			key, _ := vaQueue.Get()
+			s.Insert(key.(string))
+			vaQueue.Done(key)
+		}
+		return s
+	}
+
+	// No CSIDriver: attach is required.
+	sync()
+	if !csiHandler.vas.Equal(sets.NewString("plain", "attached")) || trivialHandler.vas.Len() != 0 {
+		t.Errorf("without CSIDriver: expected all VAs handled by the CSI handler, got csi %v, trivial %v", csiHandler.vas.List(), trivialHandler.vas.List())
+	}
+
+	// CSIDriver with attachRequired=false appears.
+	attachRequired := false
+	csiDriver := &storage.CSIDriver{
+		ObjectMeta: metav1.ObjectMeta{Name: testAttacherName},
+		Spec:       storage.CSIDriverSpec{AttachRequired: &attachRequired},
+	}
+	csiDriverInformer.Informer().GetStore().Add(csiDriver)
+	h.csiDriverChanged(csiDriver)
+	if q := queued(); !q.Equal(sets.NewString("plain", "attached")) {
+		t.Errorf("attachRequired changed: expected VAs of the driver re-queued, got %v", q.List())
+	}
+	sync()
+	if !csiHandler.vas.Equal(sets.NewString("attached")) || !trivialHandler.vas.Equal(sets.NewString("plain")) {
+		t.Errorf("attachRequired=false: expected only attached VA handled by the CSI handler, got csi %v, trivial %v", csiHandler.vas.List(), trivialHandler.vas.List())
+	}
+
+	// Unrelated update does not re-queue anything.
+	h.csiDriverChanged(csiDriver)
+	if q := queued(); q.Len() != 0 {
+		t.Errorf("no change: expected no VAs re-queued, got %v", q.List())
+	}
+
+	// CSIDriver is deleted.
+	csiDriverInformer.Informer().GetStore().Delete(csiDriver)
+	h.csiDriverChanged(csiDriver)
+	if q := queued(); !q.Equal(sets.NewString("plain", "attached")) {
+		t.Errorf("CSIDriver deleted: expected VAs of the driver re-queued, got %v", q.List())
+	}
+	sync()
+	if !csiHandler.vas.Equal(sets.NewString("plain", "attached")) || trivialHandler.vas.Len() != 0 {
+		t.Errorf("CSIDriver deleted: expected all VAs handled by the CSI handler, got csi %v, trivial %v", csiHandler.vas.List(), trivialHandler.vas.List())
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DriverState is a snapshot of the internal state of the controller of one
+// driver, for debugging.
+type DriverState struct {
+	Driver       string             `json:"driver"`
+	Capabilities DriverCapabilities `json:"capabilities"`
+	Paused       bool               `json:"paused"`
+	// AttachRequired is attachRequired of the CSIDriver object, nil when
+	// the handler does not use it.
+	AttachRequired        *bool       `json:"attachRequired,omitempty"`
+	VolumeAttachmentQueue QueueState  `json:"volumeAttachmentQueue"`
+	PersistentVolumeQueue QueueState  `json:"persistentVolumeQueue"`
+	InFlight              []Operation `json:"inFlight"`
+	// RecentSyncs are the last syncs of VolumeAttachments and
+	// PersistentVolumes, the oldest first.
+	RecentSyncs []SyncRecord `json:"recentSyncs"`
+}
+
+// DriverCapabilities are capabilities of the driver found when its
+// controller was created.
+type DriverCapabilities struct {
+	ControllerService bool `json:"controllerService"`
+	PublishUnpublish  bool `json:"publishUnpublish"`
+	PublishReadOnly   bool `json:"publishReadOnly"`
+	// Handler is "csi" when the controller calls ControllerPublish and
+	// "trivial" when it only marks VolumeAttachments as attached.
+	Handler string `json:"handler"`
+}
+
+// QueueState is the state of a work queue.
+type QueueState struct {
+	// Length is the number of items waiting for a worker, without items
+	// waiting for their backoff.
+	Length int `json:"length"`
+	// Paused are items taken from the queue while the controller was
+	// paused.
+	Paused []string `json:"paused,omitempty"`
+	// Backoff are failed items with their retry count and the earliest
+	// time of their next retry.
+	Backoff []BackoffState `json:"backoff"`
+}
+
+// Operation is an attach or detach in progress.
+type Operation struct {
+	VolumeAttachment string    `json:"volumeAttachment"`
+	Operation        string    `json:"op"`
+	Started          time.Time `json:"started"`
+}
+
+// inFlightLister is implemented by handlers that track operations in
+// progress.
+type inFlightLister interface {
+	inFlight() []Operation
+}
+
+// operations tracks attach and detach operations in progress.
+type operations struct {
+	lock       sync.Mutex
+	operations map[string]Operation
+}
+
+// start records the start of an operation at given time and returns a
+// function that records its end.
+func (o *operations) start(vaName, op string, now time.Time) func() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.operations == nil {
+		o.operations = map[string]Operation{}
+	}
+	o.operations[vaName] = Operation{VolumeAttachment: vaName, Operation: op, Started: now}
+	return func() {
+		o.lock.Lock()
+		defer o.lock.Unlock()
+		delete(o.operations, vaName)
+	}
+}
+
+// list returns operations in progress, the oldest first.
+func (o *operations) list() []Operation {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	list := make([]Operation, 0, len(o.operations))
+	for _, op := range o.operations {
+		list = append(list, op)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Started.Equal(list[j].Started) {
+			return list[i].Started.Before(list[j].Started)
+		}
+		return list[i].VolumeAttachment < list[j].VolumeAttachment
+	})
+	return list
+}
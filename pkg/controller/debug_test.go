@@ -0,0 +1,49 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOperations(t *testing.T) {
+	var o operations
+	if list := o.list(); len(list) != 0 {
+		t.Errorf("expected no operations, got %+v", list)
+	}
+
+	doneAttach := o.start("va1", "attach", time.Now())
+	doneDetach := o.start("va2", "detach", time.Now())
+	list := o.list()
+	if len(list) != 2 {
+		t.Fatalf("expected 2 operations, got %+v", list)
+	}
+	if list[0].VolumeAttachment != "va1" || list[0].Operation != "attach" || list[1].VolumeAttachment != "va2" || list[1].Operation != "detach" {
+		t.Errorf("unexpected operations %+v", list)
+	}
+
+	doneAttach()
+	list = o.list()
+	if len(list) != 1 || list[0].VolumeAttachment != "va2" {
+		t.Errorf("expected only va2 in progress, got %+v", list)
+	}
+	doneDetach()
+	if list := o.list(); len(list) != 0 {
+		t.Errorf("expected no operations, got %+v", list)
+	}
+}
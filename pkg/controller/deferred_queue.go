@@ -0,0 +1,81 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// deferringQueue is a rate limiting work queue that remembers items added by
+// AddAfter until their delay expires or they are forgotten. Handlers use
+// AddAfter for waits that are not failures (quota, policy deferral, circuit
+// breaker, Retry-After of the API server), so such items are not counted by
+// NumRequeues and the safety sweep must skip them by deferred.
+type deferringQueue struct {
+	workqueue.RateLimitingInterface
+	clock clock.Clock
+
+	lock sync.Mutex
+	// deadlines are the times when deferred items are added to the queue.
+	deadlines map[interface{}]time.Time
+}
+
+var _ workqueue.RateLimitingInterface = &deferringQueue{}
+
+func newDeferringQueue(queue workqueue.RateLimitingInterface, clk clock.Clock) *deferringQueue {
+	return &deferringQueue{
+		RateLimitingInterface: queue,
+		clock:                 clk,
+		deadlines:             map[interface{}]time.Time{},
+	}
+}
+
+func (q *deferringQueue) AddAfter(item interface{}, duration time.Duration) {
+	if duration > 0 {
+		q.lock.Lock()
+		q.deadlines[item] = q.clock.Now().Add(duration)
+		q.lock.Unlock()
+	}
+	q.RateLimitingInterface.AddAfter(item, duration)
+}
+
+func (q *deferringQueue) Forget(item interface{}) {
+	q.lock.Lock()
+	delete(q.deadlines, item)
+	q.lock.Unlock()
+	q.RateLimitingInterface.Forget(item)
+}
+
+// deferred returns true when item was added by AddAfter and its delay has not
+// expired yet.
+func (q *deferringQueue) deferred(item interface{}) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	deadline, found := q.deadlines[item]
+	if !found {
+		return false
+	}
+	if !q.clock.Now().Before(deadline) {
+		delete(q.deadlines, item)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/apimachinery/pkg/labels"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// DrainingAnnotation with value "true" marks a Node as being drained, e.g. by
+// cluster upgrade tools that don't cordon nodes.
+const DrainingAnnotation = "csi.alpha.kubernetes.io/draining"
+
+// isDraining returns true when pods are being evicted from node: it's marked
+// by DrainingAnnotation, it's cordoned, as kubectl drain does first, or it has
+// a NoExecute taint.
+func isDraining(node *v1.Node) bool {
+	if node.Annotations[DrainingAnnotation] == "true" || node.Spec.Unschedulable {
+		return true
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Effect == v1.TaintEffectNoExecute {
+			return true
+		}
+	}
+	return false
+}
+
+// prioritizeDrainingNodes makes the controller process detaches from draining
+// nodes before other VolumeAttachments, so the drain of a node does not wait
+// behind attaches and detaches of the whole cluster. It must be called before
+// Run.
+func (ctrl *CSIAttachController) prioritizeDrainingNodes(nodeInformer coreinformers.NodeInformer) {
+	nodeLister := nodeInformer.Lister()
+	ctrl.drainingDetach = func(va *storage.VolumeAttachment) bool {
+		if va.DeletionTimestamp == nil {
+			return false
+		}
+		node, err := nodeLister.Get(va.Spec.NodeName)
+		return err == nil && isDraining(node)
+	}
+	ctrl.usePriorityQueue()
+
+	nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if node := obj.(*v1.Node); isDraining(node) {
+				ctrl.enqueueDetachesOfNode(node.Name)
+			}
+		},
+		UpdateFunc: func(old, new interface{}) {
+			if node := new.(*v1.Node); isDraining(node) && !isDraining(old.(*v1.Node)) {
+				ctrl.enqueueDetachesOfNode(node.Name)
+			}
+		},
+	})
+}
+
+// enqueueDetachesOfNode queues VolumeAttachments of nodeName that wait for
+// detach. Queued ones move ahead of the other VolumeAttachments.
+func (ctrl *CSIAttachController) enqueueDetachesOfNode(nodeName string) {
+	vas, err := ctrl.vaLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list VolumeAttachments of draining node %q: %v", nodeName, err)
+		return
+	}
+	count := 0
+	for _, va := range vas {
+		if va.Spec.Attacher != ctrl.attacherName || va.Spec.NodeName != nodeName || va.DeletionTimestamp == nil {
+			continue
+		}
+		ctrl.vaQueue.Add(va.Name)
+		count++
+	}
+	if count > 0 {
+		klog.V(2).Infof("Node %q is draining, prioritizing detach of %d volumes", nodeName, count)
+	}
+}
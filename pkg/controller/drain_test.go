@@ -0,0 +1,123 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestIsDraining(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(node *v1.Node)
+		draining bool
+	}{
+		{
+			name:   "ready node",
+			modify: func(node *v1.Node) {},
+		},
+		{
+			name:     "cordoned",
+			modify:   func(node *v1.Node) { node.Spec.Unschedulable = true },
+			draining: true,
+		},
+		{
+			name: "NoExecute taint",
+			modify: func(node *v1.Node) {
+				node.Spec.Taints = []v1.Taint{{Key: "node.kubernetes.io/unreachable", Effect: v1.TaintEffectNoExecute}}
+			},
+			draining: true,
+		},
+		{
+			name: "NoSchedule taint",
+			modify: func(node *v1.Node) {
+				node.Spec.Taints = []v1.Taint{{Key: "dedicated", Effect: v1.TaintEffectNoSchedule}}
+			},
+		},
+		{
+			name:     "annotation",
+			modify:   func(node *v1.Node) { node.Annotations[DrainingAnnotation] = "true" },
+			draining: true,
+		},
+	}
+	for _, test := range tests {
+		node := node()
+		test.modify(node)
+		if draining := isDraining(node); draining != test.draining {
+			t.Errorf("%s: expected draining %v, got %v", test.name, test.draining, draining)
+		}
+	}
+}
+
+func TestPrioritizeDrainingNodes(t *testing.T) {
+	attach := createVolumeAttachment(testAttacherName, "attach", testNodeName, false, "", nil)
+	detach := deleted(createVolumeAttachment(testAttacherName, "detach", "node2", true, fin, nil))
+	drainedDetach := deleted(createVolumeAttachment(testAttacherName, "drained", testNodeName, true, fin, nil))
+	drained := node()
+	drained.Spec.Unschedulable = true
+
+	client := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(client, 0)
+	vaInformer := factory.Storage().V1beta1().VolumeAttachments()
+	pvInformer := factory.Core().V1().PersistentVolumes()
+	nodeInformer := factory.Core().V1().Nodes()
+	for _, va := range []interface{}{attach, detach, drainedDetach} {
+		vaInformer.Informer().GetStore().Add(va)
+	}
+
+	handler := &recordingHandler{vas: sets.NewString(), pvs: sets.NewString()}
+	ctrl := NewCSIAttachController(client, testAttacherName, handler, vaInformer, pvInformer, workqueue.DefaultControllerRateLimiter(), workqueue.DefaultControllerRateLimiter(), 0, nil)
+	ctrl.prioritizeDrainingNodes(nodeInformer)
+	for _, name := range []string{attach.Name, detach.Name, drainedDetach.Name} {
+		ctrl.vaQueue.Add(name)
+	}
+
+	// The node starts draining while the VolumeAttachments are queued.
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go nodeInformer.Informer().Run(stopCh)
+	if _, err := client.CoreV1().Nodes().Create(drained); err != nil {
+		t.Fatalf("failed to create node: %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := nodeInformer.Lister().Get(testNodeName); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node not in the informer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The informer calls the event handler after it updates its store.
+	time.Sleep(100 * time.Millisecond)
+
+	first, _ := ctrl.vaQueue.Get()
+	if first != drainedDetach.Name {
+		t.Errorf("expected detach from draining node %q first, got %v", drainedDetach.Name, first)
+	}
+	if ctrl.vaQueue.Len() != 2 {
+		t.Errorf("expected 2 other queued VolumeAttachments, got %d", ctrl.vaQueue.Len())
+	}
+}
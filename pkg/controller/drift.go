@@ -0,0 +1,41 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/klog"
+)
+
+// detachDrifted returns true when err of ControllerUnpublish shows that the
+// volume of va is not published to its node, although va still has the
+// finalizer of the attacher. ControllerUnpublish fails with NOT_FOUND when
+// the volume or the node no longer exist in the storage backend, e.g. after
+// they were deleted there. Without repairDrift, such a VolumeAttachment
+// would fail to detach forever.
+func (h *csiHandler) detachDrifted(va *storage.VolumeAttachment, err error) bool {
+	if !h.repairDrift || status.Code(err) != codes.NotFound {
+		return false
+	}
+	klog.Warningf("Volume of %q is not published to node %q in the CSI driver, marking it as detached: %s", va.Name, va.Spec.NodeName, err)
+	h.recordEvent(va, v1.EventTypeWarning, DriftRepaired, "Volume is not published to node %s in the CSI driver, marking it as detached: %s", va.Spec.NodeName, err)
+	driftRepairedTotal.WithLabelValues(h.attacherName, "detach").Inc()
+	return true
+}
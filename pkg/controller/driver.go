@@ -0,0 +1,758 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/rpc"
+	"google.golang.org/grpc"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
+	"github.com/kubernetes-csi/external-attacher/pkg/fencing"
+	"github.com/kubernetes-csi/external-attacher/pkg/hooks"
+	"github.com/kubernetes-csi/external-attacher/pkg/logging"
+	"github.com/kubernetes-csi/external-attacher/pkg/policy"
+)
+
+// Timeout of short CSI calls like GetPluginInfo.
+const csiTimeout = time.Second
+
+// Options are options of the attach controller of one CSI driver.
+type Options struct {
+	// Timeout of ControllerPublish and ControllerUnpublish calls.
+	Timeout time.Duration
+	// RetryIntervalStart is the initial retry interval of failed objects.
+	// It doubles with each failure, up to RetryIntervalMax.
+	RetryIntervalStart time.Duration
+	RetryIntervalMax   time.Duration
+	// WorkerThreads is the number of workers of each queue.
+	WorkerThreads int
+	// SafetySweepInterval is the period of re-queuing objects that wait
+	// for an action. 0 disables the sweep.
+	SafetySweepInterval time.Duration
+	// Shard limits the objects processed by the controller when several
+	// controllers of the driver are active. nil processes all objects.
+	Shard Shard
+	// VASelector and PVSelector limit the processed VolumeAttachments and
+	// PersistentVolumes by their labels, e.g. to run several attachers of
+	// the same driver during a blue / green rollout. VolumeAttachments of
+	// PersistentVolumes that don't match PVSelector are not processed
+	// either. nil selects all objects.
+	VASelector labels.Selector
+	PVSelector labels.Selector
+	// PVCEvents emits attach and detach events also on PVCs bound to the
+	// volumes, not only on VolumeAttachments.
+	PVCEvents bool
+	// EventsLevel selects which events are emitted.
+	EventsLevel EventsLevel
+	// OnDemandNodes gets Nodes and CSINodes from the API server when the
+	// controller needs an ID of a node instead of watching them. The
+	// controller then needs only permission to get them.
+	OnDemandNodes bool
+	// PrioritizeDrainingNodes processes detaches from nodes that are
+	// being drained before other VolumeAttachments. It watches Nodes and
+	// can't be used with OnDemandNodes.
+	PrioritizeDrainingNodes bool
+	// PrioritizeByState processes VolumeAttachments that are being deleted
+	// first, then the unattached ones and the attached ones last, so
+	// detaches and attaches finish first after the controller starts.
+	PrioritizeByState bool
+	// Policy decides whether attach and detach of volumes may proceed, e.g.
+	// a policy.Client of an external webhook. nil allows all operations.
+	Policy policy.Checker
+	// DetachUnmountWait is how long detach waits until the volume is no
+	// longer in volumesInUse of the node, for drivers with
+	// ControllerPublish. Volumes with ForceDetachAnnotation and volumes of
+	// deleted nodes are detached immediately. 0 disables the check.
+	DetachUnmountWait time.Duration
+	// ForceDetachOnUnreadyNode detaches volumes in use without waiting for
+	// DetachUnmountWait when their node has been NotReady for this time,
+	// e.g. after the node crashed. 0 waits also for NotReady nodes.
+	ForceDetachOnUnreadyNode time.Duration
+	// Fencing finds nodes that are fenced by fencing or maintenance
+	// operators. Their volumes are detached without waiting for
+	// DetachUnmountWait. nil treats no node as fenced.
+	Fencing fencing.Checker
+	// VolumeTimeoutAnnotations honors TimeoutAnnotation of
+	// VolumeAttachments, PVs and StorageClasses, which overrides Timeout
+	// for their volumes. It watches StorageClasses.
+	VolumeTimeoutAnnotations bool
+	// PublishParameters passes StorageClass parameters with
+	// PublishParameterPrefix to ControllerPublish of their volumes in
+	// volume_context. It watches StorageClasses.
+	PublishParameters bool
+	// PublishAsBlock publishes filesystem volumes with a block
+	// VolumeCapability, for drivers that attach only block devices.
+	// PublishAsBlockAnnotation of PVs overrides it.
+	PublishAsBlock bool
+	// AccessModePolicy selects how access modes of PVs are translated to
+	// the access mode passed to ControllerPublish.
+	AccessModePolicy AccessModePolicy
+	// RepublishInterval is the interval of calling ControllerPublish again
+	// for attached volumes, to update their attachment metadata when the
+	// driver returns a different PublishContext. Attached volumes are
+	// published again also after the attacher starts. 0 disables it.
+	RepublishInterval time.Duration
+	// SkipUnchangedRepublish skips ControllerPublish of RepublishInterval
+	// when its inputs except secrets did not change since the last
+	// successful one, as recorded in PublishInputsHashAnnotation.
+	SkipUnchangedRepublish bool
+	// SkipAttachAnnotation handles VolumeAttachments with
+	// SkipAttachAnnotation, or with a PV with the annotation, like drivers
+	// without ControllerPublish: they are marked as attached without any
+	// CSI call.
+	SkipAttachAnnotation bool
+	// DisablePVFinalizer does not add the finalizer of the attacher to PVs
+	// of attached volumes, for clusters where another component protects
+	// PVs. The attacher still removes its finalizers added before.
+	DisablePVFinalizer bool
+	// NodeIDSource selects where IDs of nodes in the driver are found.
+	NodeIDSource NodeIDSource
+	// NodeIDMapping has IDs of nodes with NodeIDSource NodeIDFromFile.
+	NodeIDMapping *NodeIDMapping
+	// NodeAttachSoftLimit is the number of volumes of the driver attached
+	// to a node above which successful attaches are reported by a warning
+	// event and metric. Attaches over the limit still proceed. 0 disables
+	// the reports.
+	NodeAttachSoftLimit int
+	// CircuitBreakerThreshold is the number of consecutive ControllerPublish
+	// and ControllerUnpublish calls failing with UNAVAILABLE,
+	// DEADLINE_EXCEEDED, INTERNAL or UNKNOWN after which the calls are
+	// paused for CircuitBreakerCooldown. Then one call probes the driver,
+	// the calls resume when it succeeds. 0 disables the circuit breaker.
+	CircuitBreakerThreshold int
+	CircuitBreakerCooldown  time.Duration
+	// MaxWorkerThreads enables scaling of the number of VolumeAttachment
+	// workers that run at the same time between WorkerThreads and
+	// MaxWorkerThreads, when it's greater than WorkerThreads. Workers are
+	// added while VolumeAttachments wait in the queue and removed when the
+	// mean duration of CSI calls exceeds WorkerLatencyTarget or when they
+	// are idle.
+	MaxWorkerThreads    int
+	WorkerLatencyTarget time.Duration
+	// APIWriters is the number of goroutines that save results of
+	// ControllerPublish and ControllerUnpublish to the API server, so
+	// VolumeAttachment workers make the next CSI call without waiting for
+	// the API server. 0 saves the results in the VolumeAttachment workers.
+	APIWriters int
+	// RepairDrift marks VolumeAttachments as detached when
+	// ControllerUnpublish fails with NOT_FOUND, i.e. the volume or the node
+	// no longer exist in the storage backend.
+	RepairDrift bool
+	// Hooks run commands before ControllerPublish and after
+	// ControllerUnpublish. They don't run in dry run mode and for drivers
+	// without ControllerPublish. nil runs no hooks.
+	Hooks hooks.Runner
+	// AttachQuotas limit the number of volumes attached at the same time
+	// per StorageClass and per namespace of their PVCs. Attaches over a
+	// quota wait until other volumes are detached. Drivers without
+	// ControllerPublish ignore the quotas.
+	AttachQuotas AttachQuotas
+	// AllowedSecretNamespaces are namespaces from which controller publish
+	// secrets of PVs are read. Attach and detach of volumes with secrets in
+	// other namespaces fail. Empty allows all namespaces.
+	AllowedSecretNamespaces []string
+	// RedactPublishContextKeys are PublishContext keys whose values are not
+	// logged. The caller passes them also to attacher.Connect.
+	RedactPublishContextKeys []string
+	// ExcludeRedactedKeys leaves RedactPublishContextKeys also out of
+	// attachment metadata of VolumeAttachments, so the values never reach
+	// the API server. Only keys that the node plugin does not need can be
+	// excluded, kubelet passes the metadata to NodeStage and NodePublish.
+	ExcludeRedactedKeys bool
+	// FailureSummaryInterval is the period of logging a summary of failing
+	// VolumeAttachments. 0 disables the summary.
+	FailureSummaryInterval time.Duration
+	// FailureSummaryEvents emits the summary also as an event on the
+	// CSIDriver object.
+	FailureSummaryEvents bool
+	// LogSamplingThreshold is the number of attach and detach errors of the
+	// same class logged per minute before the errors are sampled. 0
+	// disables sampling.
+	LogSamplingThreshold int
+	// StuckAttachThreshold is the time after which a VolumeAttachment that
+	// is not attached and not deleted is reported as stuck. 0 disables the
+	// check.
+	StuckAttachThreshold time.Duration
+	// StallThreshold is the time after which workers are reported as
+	// stalled when objects wait in the queues, but no object was processed.
+	// It must be longer than the longest attach or detach. 0 disables the
+	// check.
+	StallThreshold time.Duration
+	// SlowOperationThreshold is the duration after which a successful
+	// ControllerPublish or ControllerUnpublish is reported as slow. 0
+	// disables the reports.
+	SlowOperationThreshold time.Duration
+	// StorageClassLabels are values of the storageclass label of metrics
+	// of the driver. The caller passes them also to
+	// NewVolumeAttachmentStateMetric. nil labels all volumes with an empty
+	// StorageClass.
+	StorageClassLabels *StorageClassLabels
+	// LastErrorAnnotation saves attach and detach errors also in
+	// LastErrorAnnotation of VolumeAttachments.
+	LastErrorAnnotation bool
+	// ProgressAnnotations saves times of attach phases in annotations of
+	// VolumeAttachments together with the attached status.
+	ProgressAnnotations bool
+	// TrivialHandlerFaults simulate latency and errors of attach in the
+	// handler of drivers without ControllerPublish, for scale and chaos
+	// tests.
+	TrivialHandlerFaults Faults
+	// CSIFaults delay and fail ControllerPublish and ControllerUnpublish
+	// calls before they are sent to the CSI driver, for chaos tests of the
+	// attacher with a real driver.
+	CSIFaults Faults
+	// DryRun logs ControllerPublish and ControllerUnpublish requests
+	// instead of sending them to the CSI driver. API objects are left
+	// unchanged only when the client sends writes through DryRunTransport.
+	DryRun bool
+	// Clock is the source of time of backoff, timestamps and stuck
+	// detection. Tests and simulations can use a fake clock. nil means the
+	// real clock.
+	Clock clock.Clock
+}
+
+// DefaultOptions returns the defaults of the external-attacher command.
+func DefaultOptions() Options {
+	return Options{
+		Timeout:            15 * time.Second,
+		RetryIntervalStart: time.Second,
+		RetryIntervalMax:   5 * time.Minute,
+		WorkerThreads:      10,
+		EventsLevel:        EventsNormal,
+		AccessModePolicy:   AccessModeStrict,
+		NodeIDSource:       NodeIDFromCSINode,
+		// Used only with CircuitBreakerThreshold and MaxWorkerThreads,
+		// respectively.
+		CircuitBreakerCooldown: time.Minute,
+		WorkerLatencyTarget:    5 * time.Second,
+	}
+}
+
+// Validate returns an error when the options can't be used.
+func (o Options) Validate() error {
+	if o.Timeout <= 0 {
+		return fmt.Errorf("timeout must be greater than zero")
+	}
+	if o.RetryIntervalStart <= 0 {
+		return fmt.Errorf("retry interval start must be greater than zero")
+	}
+	if o.RetryIntervalMax < o.RetryIntervalStart {
+		return fmt.Errorf("retry interval max (%s) must not be shorter than retry interval start (%s)", o.RetryIntervalMax, o.RetryIntervalStart)
+	}
+	if o.WorkerThreads <= 0 {
+		return fmt.Errorf("worker threads must be greater than zero")
+	}
+	if o.SafetySweepInterval < 0 {
+		return fmt.Errorf("safety sweep interval must not be negative")
+	}
+	if o.FailureSummaryInterval < 0 {
+		return fmt.Errorf("failure summary interval must not be negative")
+	}
+	if o.LogSamplingThreshold < 0 {
+		return fmt.Errorf("log sampling threshold must not be negative")
+	}
+	if o.StuckAttachThreshold < 0 {
+		return fmt.Errorf("stuck attach threshold must not be negative")
+	}
+	if o.StallThreshold < 0 {
+		return fmt.Errorf("stall threshold must not be negative")
+	}
+	if o.SlowOperationThreshold < 0 {
+		return fmt.Errorf("slow operation threshold must not be negative")
+	}
+	if err := o.TrivialHandlerFaults.Validate(); err != nil {
+		return err
+	}
+	if err := o.CSIFaults.Validate(); err != nil {
+		return err
+	}
+	if _, err := ParseEventsLevel(string(o.EventsLevel)); err != nil {
+		return err
+	}
+	if _, err := ParseAccessModePolicy(string(o.AccessModePolicy)); err != nil {
+		return err
+	}
+	if _, err := ParseNodeIDSource(string(o.NodeIDSource)); err != nil {
+		return err
+	}
+	if (o.NodeIDSource == NodeIDFromFile) != (o.NodeIDMapping != nil) {
+		return fmt.Errorf("node ID mapping must be set exactly with node ID source %q", NodeIDFromFile)
+	}
+	if o.ExcludeRedactedKeys && len(o.RedactPublishContextKeys) == 0 {
+		return fmt.Errorf("excluding redacted keys from attachment metadata requires redacted PublishContext keys")
+	}
+	if o.RepublishInterval < 0 {
+		return fmt.Errorf("republish interval must not be negative, got %s", o.RepublishInterval)
+	}
+	if o.SkipUnchangedRepublish && o.RepublishInterval == 0 {
+		return fmt.Errorf("skipping unchanged republish requires republish interval")
+	}
+	if o.DetachUnmountWait < 0 {
+		return fmt.Errorf("detach unmount wait must not be negative, got %s", o.DetachUnmountWait)
+	}
+	if o.ForceDetachOnUnreadyNode < 0 {
+		return fmt.Errorf("force detach on unready node must not be negative, got %s", o.ForceDetachOnUnreadyNode)
+	}
+	if o.ForceDetachOnUnreadyNode > 0 && o.DetachUnmountWait == 0 {
+		return fmt.Errorf("force detach on unready node requires detach unmount wait")
+	}
+	if o.PrioritizeDrainingNodes && o.OnDemandNodes {
+		return fmt.Errorf("prioritizing draining nodes requires a Node informer, it can't be used with on-demand nodes")
+	}
+	if o.MaxWorkerThreads > o.WorkerThreads && o.WorkerLatencyTarget <= 0 {
+		return fmt.Errorf("worker latency target must be greater than zero")
+	}
+	if o.APIWriters < 0 {
+		return fmt.Errorf("API writers must not be negative, got %d", o.APIWriters)
+	}
+	if o.CircuitBreakerThreshold < 0 {
+		return fmt.Errorf("circuit breaker threshold must not be negative, got %d", o.CircuitBreakerThreshold)
+	}
+	if o.CircuitBreakerThreshold > 0 && o.CircuitBreakerCooldown <= 0 {
+		return fmt.Errorf("circuit breaker cooldown must be greater than zero")
+	}
+	if o.NodeAttachSoftLimit < 0 {
+		return fmt.Errorf("node attach soft limit must not be negative, got %d", o.NodeAttachSoftLimit)
+	}
+	if o.Fencing != nil && o.DetachUnmountWait == 0 {
+		return fmt.Errorf("fencing requires detach unmount wait")
+	}
+	for _, limits := range []map[string]int{o.AttachQuotas.StorageClasses, o.AttachQuotas.Namespaces} {
+		for name, limit := range limits {
+			if limit < 0 {
+				return fmt.Errorf("invalid attach quota of %q: %d is negative", name, limit)
+			}
+		}
+	}
+	for _, namespace := range o.AllowedSecretNamespaces {
+		if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+			return fmt.Errorf("invalid allowed secret namespace %q: %s", namespace, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// watchesStorageClasses returns true when the CSI handler needs
+// StorageClasses.
+func (o Options) watchesStorageClasses() bool {
+	return o.VolumeTimeoutAnnotations || o.PublishParameters
+}
+
+// clockOrDefault returns Clock, the real clock when it's not set.
+func (o Options) clockOrDefault() clock.Clock {
+	if o.Clock == nil {
+		return clock.RealClock{}
+	}
+	return o.Clock
+}
+
+// Driver is the attach controller of one CSI driver. It can be embedded in
+// other binaries: it uses only the given clients and informers and reports
+// all errors to the caller.
+type Driver struct {
+	name          string
+	capabilities  DriverCapabilities
+	handler       Handler
+	ctrl          *CSIAttachController
+	vaRateLimiter *BackoffRateLimiter
+	pvRateLimiter *BackoffRateLimiter
+	synced        map[string]cache.InformerSynced
+
+	failureSummaryInterval time.Duration
+	failureSummaryEvents   bool
+	stuckAttachThreshold   time.Duration
+	logSampler             *logging.Sampler
+	breaker                *circuitBreaker
+	workerScaler           *workerScaler
+	apiWriter              *apiWriter     // nil saves results in workers
+	stall                  *stallWatchdog // nil disables the check
+	clock                  clock.Clock
+
+	lock    sync.Mutex
+	workers int
+}
+
+// NewDriver returns the attach controller of the CSI driver connected by
+// conn. It asks the driver for its name and capabilities, drivers without
+// ControllerPublish get a controller that only marks VolumeAttachments as
+// attached. The new controller registers event handlers of informers from
+// factory, the caller starts the factory after NewDriver and it owns conn.
+func NewDriver(ctx context.Context, client kubernetes.Interface, factory informers.SharedInformerFactory, conn *grpc.ClientConn, options Options) (*Driver, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, csiTimeout)
+	defer cancel()
+	name, err := rpc.GetDriverName(ctx, conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get CSI driver name: %v", err)
+	}
+	klog.V(2).Infof("CSI driver name: %q", name)
+
+	clk := options.clockOrDefault()
+	d := &Driver{
+		name:          name,
+		vaRateLimiter: NewBackoffRateLimiterWithClock(options.RetryIntervalStart, options.RetryIntervalMax, clk),
+		pvRateLimiter: NewBackoffRateLimiterWithClock(options.RetryIntervalStart, options.RetryIntervalMax, clk),
+		synced: map[string]cache.InformerSynced{
+			"VolumeAttachment": factory.Storage().V1beta1().VolumeAttachments().Informer().HasSynced,
+			"PersistentVolume": factory.Core().V1().PersistentVolumes().Informer().HasSynced,
+		},
+		failureSummaryInterval: options.FailureSummaryInterval,
+		failureSummaryEvents:   options.FailureSummaryEvents,
+		stuckAttachThreshold:   options.StuckAttachThreshold,
+		workers:                options.WorkerThreads,
+		clock:                  clk,
+	}
+	if options.StallThreshold > 0 {
+		d.stall = &stallWatchdog{threshold: options.StallThreshold}
+	}
+	if options.LogSamplingThreshold > 0 {
+		d.logSampler = logging.NewSampler(options.LogSamplingThreshold, time.Minute)
+	}
+	d.breaker = newCircuitBreaker(options.CircuitBreakerThreshold, options.CircuitBreakerCooldown, clk)
+	d.workerScaler = newWorkerScaler(name, options.WorkerThreads, options.MaxWorkerThreads, options.WorkerLatencyTarget)
+	if options.APIWriters > 0 {
+		d.apiWriter = newAPIWriter(name, options.APIWriters, clk)
+	}
+	d.handler, d.capabilities, err = newHandler(ctx, name, client, factory, conn, options, d.logSampler, d.breaker, d.workerScaler, d.apiWriter)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := d.handler.(*csiDriverHandler); ok {
+		if !options.OnDemandNodes {
+			d.synced["Node"] = factory.Core().V1().Nodes().Informer().HasSynced
+			d.synced["CSINode"] = factory.Storage().V1beta1().CSINodes().Informer().HasSynced
+		}
+		if options.watchesStorageClasses() {
+			d.synced["StorageClass"] = factory.Storage().V1().StorageClasses().Informer().HasSynced
+		}
+		d.synced["CSIDriver"] = factory.Storage().V1beta1().CSIDrivers().Informer().HasSynced
+	}
+
+	d.ctrl = NewCSIAttachController(
+		client,
+		name,
+		d.handler,
+		factory.Storage().V1beta1().VolumeAttachments(),
+		factory.Core().V1().PersistentVolumes(),
+		d.vaRateLimiter,
+		d.pvRateLimiter,
+		options.SafetySweepInterval,
+		options.Shard,
+	)
+	d.ctrl.setClock(clk)
+	d.ctrl.vaSelector = options.VASelector
+	d.ctrl.workerScaler = d.workerScaler
+	if options.PrioritizeDrainingNodes {
+		d.synced["Node"] = factory.Core().V1().Nodes().Informer().HasSynced
+		d.ctrl.prioritizeDrainingNodes(factory.Core().V1().Nodes())
+	}
+	if options.PrioritizeByState {
+		d.ctrl.prioritizeByState()
+	}
+	d.ctrl.pvSelector = options.PVSelector
+	if options.EventsLevel == EventsNone {
+		// Also events of the controller, e.g. AttachStuck.
+		d.ctrl.eventRecorder = discardRecorder{}
+	}
+	return d, nil
+}
+
+// GetDriverCapabilities asks the CSI driver for capabilities that decide
+// which handler its controller uses.
+func GetDriverCapabilities(ctx context.Context, conn *grpc.ClientConn) (DriverCapabilities, error) {
+	caps := DriverCapabilities{Handler: "trivial"}
+	pluginCaps, err := rpc.GetPluginCapabilities(ctx, conn)
+	if err != nil {
+		return caps, err
+	}
+	if !pluginCaps[csi.PluginCapability_Service_CONTROLLER_SERVICE] {
+		return caps, nil
+	}
+	caps.ControllerService = true
+
+	// Find out if the driver supports attach/detach.
+	controllerCaps, err := rpc.GetControllerCapabilities(ctx, conn)
+	if err != nil {
+		return caps, err
+	}
+	caps.PublishReadOnly = controllerCaps[csi.ControllerServiceCapability_RPC_PUBLISH_READONLY]
+	if controllerCaps[csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME] {
+		caps.PublishUnpublish = true
+		caps.Handler = "csi"
+	}
+	return caps, nil
+}
+
+// newHandler returns a handler of the driver based on its capabilities.
+func newHandler(ctx context.Context, name string, client kubernetes.Interface, factory informers.SharedInformerFactory, conn *grpc.ClientConn, options Options, logSampler *logging.Sampler, breaker *circuitBreaker, scaler *workerScaler, writer *apiWriter) (Handler, DriverCapabilities, error) {
+	caps, err := GetDriverCapabilities(ctx, conn)
+	if err != nil {
+		return nil, caps, err
+	}
+	if !caps.ControllerService {
+		klog.V(2).Infof("CSI driver %q does not support Plugin Controller Service, using trivial handler", name)
+		return newTrivialHandler(client, options), caps, nil
+	}
+	if !caps.PublishUnpublish {
+		klog.V(2).Infof("CSI driver %q does not support ControllerPublishUnpublish, using trivial handler", name)
+		return newTrivialHandler(client, options), caps, nil
+	}
+
+	pvLister := factory.Core().V1().PersistentVolumes().Lister()
+	var nodeLister corelisters.NodeLister = &onDemandNodeLister{client: client}
+	var csiNodeLister storagelisters.CSINodeLister = &onDemandCSINodeLister{client: client}
+	if !options.OnDemandNodes {
+		nodeLister = factory.Core().V1().Nodes().Lister()
+		csiNodeLister = factory.Storage().V1beta1().CSINodes().Lister()
+	}
+	vaLister := factory.Storage().V1beta1().VolumeAttachments().Lister()
+	csiAttacher := newFaultyAttacher(attacher.NewAttacher(conn), options.CSIFaults, options.clockOrDefault(), time.Now().UnixNano())
+	if options.DryRun {
+		csiAttacher = &dryRunAttacher{driverName: name}
+	}
+	handler := NewCSIHandler(client, name, csiAttacher, pvLister, nodeLister, csiNodeLister, vaLister, &options.Timeout, caps.PublishReadOnly)
+	handler.(*csiHandler).pvcEvents = options.PVCEvents
+	handler.(*csiHandler).eventFilter = newEventFilter(options.EventsLevel)
+	handler.(*csiHandler).logSampler = logSampler
+	handler.(*csiHandler).slowOperationThreshold = options.SlowOperationThreshold
+	handler.(*csiHandler).storageClassLabels = options.StorageClassLabels
+	handler.(*csiHandler).lastErrorAnnotation = options.LastErrorAnnotation
+	handler.(*csiHandler).progressAnnotations = options.ProgressAnnotations
+	handler.(*csiHandler).clock = options.clockOrDefault()
+	handler.(*csiHandler).policy = options.Policy
+	if !options.DryRun {
+		handler.(*csiHandler).hooks = options.Hooks
+	}
+	handler.(*csiHandler).unmountWait = options.DetachUnmountWait
+	handler.(*csiHandler).unreadyNodeGracePeriod = options.ForceDetachOnUnreadyNode
+	handler.(*csiHandler).fencing = options.Fencing
+	handler.(*csiHandler).repairDrift = options.RepairDrift
+	handler.(*csiHandler).disablePVFinalizer = options.DisablePVFinalizer
+	handler.(*csiHandler).breaker = breaker
+	handler.(*csiHandler).workerScaler = scaler
+	handler.(*csiHandler).apiWriter = writer
+	handler.(*csiHandler).nodeAttachSoftLimit = options.NodeAttachSoftLimit
+	handler.(*csiHandler).volumeTimeouts = options.VolumeTimeoutAnnotations
+	handler.(*csiHandler).publishParameters = options.PublishParameters
+	handler.(*csiHandler).forcePublishAsBlock = options.PublishAsBlock
+	handler.(*csiHandler).accessModePolicy = options.AccessModePolicy
+	handler.(*csiHandler).republishInterval = options.RepublishInterval
+	handler.(*csiHandler).skipUnchangedRepublish = options.SkipUnchangedRepublish
+	handler.(*csiHandler).nodeIDSource = options.NodeIDSource
+	handler.(*csiHandler).nodeIDMapping = options.NodeIDMapping
+	if options.watchesStorageClasses() {
+		handler.(*csiHandler).scLister = factory.Storage().V1().StorageClasses().Lister()
+	}
+	if !options.AttachQuotas.IsEmpty() {
+		handler.(*csiHandler).quotas = newQuotaTracker(options.AttachQuotas, name, vaLister, pvLister, options.clockOrDefault())
+	}
+	if options.ExcludeRedactedKeys {
+		handler.(*csiHandler).excludedMetadataKeys = options.RedactPublishContextKeys
+	}
+	if len(options.AllowedSecretNamespaces) > 0 {
+		handler.(*csiHandler).allowedSecretNamespaces = sets.NewString(options.AllowedSecretNamespaces...)
+	}
+	klog.V(2).Infof("CSI driver %q supports ControllerPublishUnpublish, using real CSI handler", name)
+	// Honor attachRequired of the CSIDriver object, it may change while the
+	// controller runs.
+	driverHandler := NewCSIDriverHandler(name, handler, newTrivialHandler(client, options), factory.Storage().V1beta1().CSIDrivers(), vaLister)
+	driverHandler.(*csiDriverHandler).skipAttachAnnotation = options.SkipAttachAnnotation
+	driverHandler.(*csiDriverHandler).pvLister = pvLister
+	return driverHandler, caps, nil
+}
+
+// newTrivialHandler returns a trivial handler with faults from options.
+func newTrivialHandler(client kubernetes.Interface, options Options) Handler {
+	handler := NewTrivialHandler(client)
+	handler.(*trivialHandler).faults = newFaultInjector(options.TrivialHandlerFaults, options.clockOrDefault(), time.Now().UnixNano())
+	handler.(*trivialHandler).clock = options.clockOrDefault()
+	return handler
+}
+
+// Name returns the name of the CSI driver.
+func (d *Driver) Name() string {
+	return d.name
+}
+
+// Capabilities returns capabilities of the CSI driver found at startup.
+func (d *Driver) Capabilities() DriverCapabilities {
+	return d.capabilities
+}
+
+// InformersSynced returns HasSynced functions of all informers used by the
+// controller, indexed by the kind of their objects.
+func (d *Driver) InformersSynced() map[string]cache.InformerSynced {
+	synced := make(map[string]cache.InformerSynced, len(d.synced))
+	for kind, hasSynced := range d.synced {
+		synced[kind] = hasSynced
+	}
+	return synced
+}
+
+// Ready returns an error while the circuit breaker of the driver pauses
+// CSI calls.
+func (d *Driver) Ready() error {
+	if err := d.breaker.check(); err != nil {
+		return fmt.Errorf("CSI driver %q: %v", d.name, err)
+	}
+	return nil
+}
+
+// EndpointSwitched records that the connection to the driver switched from
+// one CSI endpoint to another one.
+func (d *Driver) EndpointSwitched(from, to string) {
+	endpointFailoversTotal.WithLabelValues(d.name, to).Inc()
+	d.ctrl.eventRecorder.Eventf(csiDriverRef(d.ctrl.client, d.name), v1.EventTypeWarning, CSIEndpointFailover, "Connection to CSI endpoint %s failed, switched to %s", from, to)
+}
+
+// Live returns an error while workers of the controller are stalled.
+func (d *Driver) Live() error {
+	if d.stall == nil {
+		return nil
+	}
+	if err := d.stall.stalled(); err != nil {
+		return fmt.Errorf("CSI driver %q: %v", d.name, err)
+	}
+	return nil
+}
+
+// State returns a snapshot of the internal state of the controller, for
+// debugging.
+func (d *Driver) State() DriverState {
+	state := DriverState{
+		Driver:       d.name,
+		Capabilities: d.capabilities,
+		InFlight:     []Operation{},
+	}
+	state.Paused, state.VolumeAttachmentQueue, state.PersistentVolumeQueue = d.ctrl.queueStates()
+	state.VolumeAttachmentQueue.Backoff = d.vaRateLimiter.Snapshot()
+	state.PersistentVolumeQueue.Backoff = d.pvRateLimiter.Snapshot()
+	if h, ok := d.handler.(*csiDriverHandler); ok {
+		attachRequired := h.isAttachRequired()
+		state.AttachRequired = &attachRequired
+	}
+	if lister, ok := d.handler.(inFlightLister); ok {
+		state.InFlight = append(state.InFlight, lister.inFlight()...)
+	}
+	state.RecentSyncs = d.ctrl.history.list()
+	return state
+}
+
+// Reconcile clears backoff of a VolumeAttachment and processes it now, see
+// CSIAttachController.Reconcile.
+func (d *Driver) Reconcile(vaName string) error {
+	return d.ctrl.Reconcile(vaName)
+}
+
+// RateLimiters returns rate limiters of the VolumeAttachment and
+// PersistentVolume queues, e.g. to hand over their state to another
+// replica with StateHandover.
+func (d *Driver) RateLimiters() (vaRateLimiter, pvRateLimiter *BackoffRateLimiter) {
+	return d.vaRateLimiter, d.pvRateLimiter
+}
+
+// SetTimeout changes the timeout of ControllerPublish and
+// ControllerUnpublish calls.
+func (d *Driver) SetTimeout(timeout time.Duration) {
+	if setter, ok := d.handler.(TimeoutSetter); ok {
+		setter.SetTimeout(timeout)
+	}
+}
+
+// SetRetryIntervals changes retry intervals of failed objects.
+func (d *Driver) SetRetryIntervals(start, max time.Duration) {
+	d.vaRateLimiter.SetDelays(start, max)
+	d.pvRateLimiter.SetDelays(start, max)
+}
+
+// SetWorkerThreads changes the number of workers used by the next Run.
+func (d *Driver) SetWorkerThreads(workers int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.workers = workers
+}
+
+// SetPaused pauses or resumes processing of objects, see
+// CSIAttachController.SetPaused.
+func (d *Driver) SetPaused(paused bool) {
+	d.ctrl.SetPaused(paused)
+}
+
+// Run waits for the informer caches and runs the controller until ctx is
+// cancelled. Operations in progress are finished before Run returns. It
+// returns an error when ctx was cancelled before the caches synced.
+func (d *Driver) Run(ctx context.Context) error {
+	if !cache.WaitForCacheSync(ctx.Done(), d.informersSynced()...) {
+		return fmt.Errorf("informer caches of CSI driver %q did not sync", d.name)
+	}
+	d.lock.Lock()
+	workers := d.workers
+	d.lock.Unlock()
+	if d.logSampler != nil {
+		go wait.Until(d.logSampler.Flush, time.Minute, ctx.Done())
+	}
+	if d.failureSummaryInterval > 0 {
+		go wait.Until(func() {
+			d.ctrl.reportFailures(d.failureSummaryEvents)
+		}, d.failureSummaryInterval, ctx.Done())
+	}
+	if d.stuckAttachThreshold > 0 {
+		go wait.Until(func() {
+			d.ctrl.checkStuck(d.stuckAttachThreshold, d.clock.Now())
+		}, stuckCheckInterval(d.stuckAttachThreshold), ctx.Done())
+	}
+	if d.apiWriter != nil {
+		d.apiWriter.run(ctx.Done())
+		defer d.apiWriter.wait()
+	}
+	if d.stall != nil {
+		defer d.stall.reset()
+		go wait.Until(d.checkStall, stallCheckInterval(d.stall.threshold), ctx.Done())
+	}
+	d.ctrl.Run(workers, ctx.Done())
+	return nil
+}
+
+func (d *Driver) informersSynced() []cache.InformerSynced {
+	var synced []cache.InformerSynced
+	for _, hasSynced := range d.synced {
+		synced = append(synced, hasSynced)
+	}
+	return synced
+}
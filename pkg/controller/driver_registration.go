@@ -0,0 +1,77 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// notRegisteredRetryStart and notRegisteredRetryMax bound the backoff
+	// of VolumeAttachments whose node has no registered driver. It is
+	// shorter than the regular backoff, registration usually takes only
+	// a few seconds after a node joins the cluster.
+	notRegisteredRetryStart = time.Second
+	notRegisteredRetryMax   = 30 * time.Second
+)
+
+// driverNotRegisteredError is returned when neither CSINode nor Node
+// annotation of a node contain the ID of the node in the driver, i.e.
+// kubelet did not register the driver on the node yet. The operation is
+// retried with its own backoff.
+type driverNotRegisteredError struct {
+	msg string
+}
+
+func (e *driverNotRegisteredError) Error() string {
+	return e.msg
+}
+
+// isDriverNotRegistered returns true when an operation waits for
+// registration of the driver on its node.
+func isDriverNotRegistered(err error) bool {
+	for _, e := range errorChain(err) {
+		if _, ok := e.(*driverNotRegisteredError); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func newDriverNotRegisteredError(driver, nodeName string) error {
+	return &driverNotRegisteredError{msg: fmt.Sprintf("CSI driver %s is not registered on node %s", driver, nodeName)}
+}
+
+// hasNodeIDAnnotation returns false when the NodeID annotation of node
+// does not exist or does not contain driver. A malformed annotation counts
+// as existing, GetNodeIDFromNode reports it.
+func hasNodeIDAnnotation(driver string, node *v1.Node) bool {
+	nodeIDJSON, ok := node.Annotations[nodeIDAnnotation]
+	if !ok {
+		return false
+	}
+	var nodeIDs map[string]string
+	if err := json.Unmarshal([]byte(nodeIDJSON), &nodeIDs); err != nil {
+		return true
+	}
+	_, ok = nodeIDs[driver]
+	return ok
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	core "k8s.io/client-go/testing"
+)
+
+func TestHasNodeIDAnnotation(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    bool
+	}{
+		{
+			name: "no annotation",
+		},
+		{
+			name:        "driver annotated",
+			annotations: map[string]string{nodeIDAnnotation: `{"csi/test":"MyNodeID"}`},
+			expected:    true,
+		},
+		{
+			name:        "other driver annotated",
+			annotations: map[string]string{nodeIDAnnotation: `{"csi/other":"MyNodeID"}`},
+		},
+		{
+			name:        "malformed annotation",
+			annotations: map[string]string{nodeIDAnnotation: "nope"},
+			expected:    true,
+		},
+	}
+	for _, test := range tests {
+		node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: testNodeName, Annotations: test.annotations}}
+		if found := hasNodeIDAnnotation(testAttacherName, node); found != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, found)
+		}
+	}
+}
+
+func TestWrapDriverNotRegisteredError(t *testing.T) {
+	err := wrapError("failed to detach", newDriverNotRegisteredError(testAttacherName, testNodeName))
+	if !isDriverNotRegistered(err) {
+		t.Errorf("expected driver not registered error, got %v", err)
+	}
+	if expected := "failed to detach: CSI driver csi/test is not registered on node node1"; err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+}
+
+func TestCSIHandlerDriverNotRegistered(t *testing.T) {
+	vaGroupResourceVersion := schema.GroupVersionResource{
+		Group:    storage.GroupName,
+		Version:  "v1beta1",
+		Resource: "volumeattachments",
+	}
+	tests := []testCase{
+		{
+			name:           "detach with driver not registered -> waits without CSI call",
+			initialObjects: []runtime.Object{pvWithFinalizer(), nodeWithoutAnnotations()},
+			addedVA:        deleted(va(true, fin, nil)),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(deleted(va(true, fin, nil)),
+						deleted(vaWithDetachError(va(true, fin, nil), "CSI driver csi/test is not registered on node node1")))),
+			},
+			expectedEvents: []string{
+				"Warning DriverNotRegisteredOnNode Detach of volume from node node1 waits: CSI driver csi/test is not registered on node node1",
+			},
+		},
+	}
+	runTests(t, csiHandlerFactory, tests)
+}
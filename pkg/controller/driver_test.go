@@ -0,0 +1,394 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-csi/csi-lib-utils/connection"
+	"github.com/kubernetes-csi/csi-test/driver"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/fencing"
+)
+
+func TestOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(o *Options)
+		valid  bool
+	}{
+		{
+			name:   "defaults",
+			modify: func(o *Options) {},
+			valid:  true,
+		},
+		{
+			name:   "zero timeout",
+			modify: func(o *Options) { o.Timeout = 0 },
+		},
+		{
+			name:   "zero retry interval",
+			modify: func(o *Options) { o.RetryIntervalStart = 0 },
+		},
+		{
+			name:   "max retry interval shorter than start",
+			modify: func(o *Options) { o.RetryIntervalMax = o.RetryIntervalStart / 2 },
+		},
+		{
+			name:   "zero workers",
+			modify: func(o *Options) { o.WorkerThreads = 0 },
+		},
+		{
+			name:   "negative safety sweep",
+			modify: func(o *Options) { o.SafetySweepInterval = -time.Second },
+		},
+		{
+			name:   "negative failure summary interval",
+			modify: func(o *Options) { o.FailureSummaryInterval = -time.Minute },
+		},
+		{
+			name:   "negative log sampling threshold",
+			modify: func(o *Options) { o.LogSamplingThreshold = -1 },
+		},
+		{
+			name:   "negative stuck attach threshold",
+			modify: func(o *Options) { o.StuckAttachThreshold = -time.Minute },
+		},
+		{
+			name:   "negative slow operation threshold",
+			modify: func(o *Options) { o.SlowOperationThreshold = -time.Second },
+		},
+		{
+			name:   "invalid trivial handler error rate",
+			modify: func(o *Options) { o.TrivialHandlerFaults.ErrorRate = 1.5 },
+		},
+		{
+			name:   "negative injected CSI delay",
+			modify: func(o *Options) { o.CSIFaults.Latency = -time.Second },
+		},
+		{
+			name:   "invalid events level",
+			modify: func(o *Options) { o.EventsLevel = "all" },
+		},
+		{
+			name:   "invalid access mode policy",
+			modify: func(o *Options) { o.AccessModePolicy = "" },
+		},
+		{
+			name:   "node ID source file without mapping",
+			modify: func(o *Options) { o.NodeIDSource = NodeIDFromFile },
+		},
+		{
+			name:   "node ID mapping without source file",
+			modify: func(o *Options) { o.NodeIDMapping = &NodeIDMapping{} },
+		},
+		{
+			name:   "excluded redacted keys without keys",
+			modify: func(o *Options) { o.ExcludeRedactedKeys = true },
+		},
+		{
+			name: "excluded redacted keys",
+			modify: func(o *Options) {
+				o.ExcludeRedactedKeys = true
+				o.RedactPublishContextKeys = []string{"chap"}
+			},
+			valid: true,
+		},
+		{
+			name: "attach quotas",
+			modify: func(o *Options) {
+				o.AttachQuotas = AttachQuotas{StorageClasses: map[string]int{"gold": 10}, Namespaces: map[string]int{"tenant-a": 0}}
+			},
+			valid: true,
+		},
+		{
+			name:   "negative attach quota",
+			modify: func(o *Options) { o.AttachQuotas = AttachQuotas{Namespaces: map[string]int{"tenant-a": -1}} },
+		},
+		{
+			name:   "negative republish interval",
+			modify: func(o *Options) { o.RepublishInterval = -time.Hour },
+		},
+		{
+			name:   "skip unchanged republish without republish interval",
+			modify: func(o *Options) { o.SkipUnchangedRepublish = true },
+		},
+		{
+			name:   "negative detach unmount wait",
+			modify: func(o *Options) { o.DetachUnmountWait = -time.Minute },
+		},
+		{
+			name: "force detach on unready node",
+			modify: func(o *Options) {
+				o.DetachUnmountWait = 10 * time.Minute
+				o.ForceDetachOnUnreadyNode = 5 * time.Minute
+			},
+			valid: true,
+		},
+		{
+			name:   "force detach on unready node without unmount wait",
+			modify: func(o *Options) { o.ForceDetachOnUnreadyNode = 5 * time.Minute },
+		},
+		{
+			name: "prioritize draining nodes with on-demand nodes",
+			modify: func(o *Options) {
+				o.PrioritizeDrainingNodes = true
+				o.OnDemandNodes = true
+			},
+		},
+		{
+			name: "max worker threads without latency target",
+			modify: func(o *Options) {
+				o.MaxWorkerThreads = 50
+				o.WorkerLatencyTarget = 0
+			},
+		},
+		{
+			name:   "max worker threads",
+			modify: func(o *Options) { o.MaxWorkerThreads = 50 },
+			valid:  true,
+		},
+		{
+			name:   "negative API writers",
+			modify: func(o *Options) { o.APIWriters = -1 },
+		},
+		{
+			name:   "negative circuit breaker threshold",
+			modify: func(o *Options) { o.CircuitBreakerThreshold = -1 },
+		},
+		{
+			name: "circuit breaker without cooldown",
+			modify: func(o *Options) {
+				o.CircuitBreakerThreshold = 5
+				o.CircuitBreakerCooldown = 0
+			},
+		},
+		{
+			name:   "circuit breaker",
+			modify: func(o *Options) { o.CircuitBreakerThreshold = 5 },
+			valid:  true,
+		},
+		{
+			name:   "negative stall threshold",
+			modify: func(o *Options) { o.StallThreshold = -time.Minute },
+		},
+		{
+			name:   "negative node attach soft limit",
+			modify: func(o *Options) { o.NodeAttachSoftLimit = -1 },
+		},
+		{
+			name:   "fencing without unmount wait",
+			modify: func(o *Options) { o.Fencing = fencing.NewWatcher(true) },
+		},
+		{
+			name:   "allowed secret namespaces",
+			modify: func(o *Options) { o.AllowedSecretNamespaces = []string{"kube-system", "storage"} },
+			valid:  true,
+		},
+		{
+			name:   "invalid allowed secret namespace",
+			modify: func(o *Options) { o.AllowedSecretNamespaces = []string{"kube-system", ""} },
+		},
+	}
+	for _, test := range tests {
+		options := DefaultOptions()
+		test.modify(&options)
+		err := options.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected error, got none", test.name)
+		}
+	}
+}
+
+func TestNewDriver(t *testing.T) {
+	controllerService := &csi.PluginCapability{
+		Type: &csi.PluginCapability_Service_{
+			Service: &csi.PluginCapability_Service{
+				Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+			},
+		},
+	}
+	publish := &csi.ControllerServiceCapability{
+		Type: &csi.ControllerServiceCapability_Rpc{
+			Rpc: &csi.ControllerServiceCapability_RPC{
+				Type: csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+			},
+		},
+	}
+
+	tests := []struct {
+		name              string
+		pluginCaps        []*csi.PluginCapability
+		controllerCaps    []*csi.ControllerServiceCapability
+		onDemandNodes     bool
+		expectedInformers []string
+		expectedCaps      DriverCapabilities
+	}{
+		{
+			name:              "no controller service",
+			expectedInformers: []string{"PersistentVolume", "VolumeAttachment"},
+			expectedCaps:      DriverCapabilities{Handler: "trivial"},
+		},
+		{
+			name:              "no ControllerPublish",
+			pluginCaps:        []*csi.PluginCapability{controllerService},
+			expectedInformers: []string{"PersistentVolume", "VolumeAttachment"},
+			expectedCaps:      DriverCapabilities{ControllerService: true, Handler: "trivial"},
+		},
+		{
+			name:              "ControllerPublish",
+			pluginCaps:        []*csi.PluginCapability{controllerService},
+			controllerCaps:    []*csi.ControllerServiceCapability{publish},
+			expectedInformers: []string{"CSIDriver", "CSINode", "Node", "PersistentVolume", "VolumeAttachment"},
+			expectedCaps:      DriverCapabilities{ControllerService: true, PublishUnpublish: true, Handler: "csi"},
+		},
+		{
+			name:              "ControllerPublish with on-demand nodes",
+			pluginCaps:        []*csi.PluginCapability{controllerService},
+			controllerCaps:    []*csi.ControllerServiceCapability{publish},
+			onDemandNodes:     true,
+			expectedInformers: []string{"CSIDriver", "PersistentVolume", "VolumeAttachment"},
+			expectedCaps:      DriverCapabilities{ControllerService: true, PublishUnpublish: true, Handler: "csi"},
+		},
+	}
+	for _, test := range tests {
+		func() {
+			tmpdir, err := ioutil.TempDir("", "external-attacher-test-")
+			if err != nil {
+				t.Fatalf("Cannot create temporary directory: %s", err)
+			}
+			defer os.RemoveAll(tmpdir)
+
+			mockController := gomock.NewController(t)
+			defer mockController.Finish()
+			identityServer := driver.NewMockIdentityServer(mockController)
+			controllerServer := driver.NewMockControllerServer(mockController)
+			drv := driver.NewMockCSIDriver(&driver.MockCSIDriverServers{
+				Identity:   identityServer,
+				Controller: controllerServer,
+			})
+			drv.StartOnAddress("unix", filepath.Join(tmpdir, "csi.sock"))
+			defer drv.Stop()
+			conn, err := connection.Connect(drv.Address())
+			if err != nil {
+				t.Fatalf("%s: failed to connect: %v", test.name, err)
+			}
+			defer conn.Close()
+
+			identityServer.EXPECT().GetPluginInfo(gomock.Any(), gomock.Any()).Return(&csi.GetPluginInfoResponse{Name: "csi/test"}, nil)
+			identityServer.EXPECT().GetPluginCapabilities(gomock.Any(), gomock.Any()).Return(&csi.GetPluginCapabilitiesResponse{Capabilities: test.pluginCaps}, nil)
+			if test.pluginCaps != nil {
+				controllerServer.EXPECT().ControllerGetCapabilities(gomock.Any(), gomock.Any()).Return(&csi.ControllerGetCapabilitiesResponse{Capabilities: test.controllerCaps}, nil)
+			}
+
+			client := fake.NewSimpleClientset()
+			factory := informers.NewSharedInformerFactory(client, 0)
+			options := DefaultOptions()
+			options.OnDemandNodes = test.onDemandNodes
+			d, err := NewDriver(context.Background(), client, factory, conn, options)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", test.name, err)
+			}
+			if d.Name() != "csi/test" {
+				t.Errorf("%s: expected name csi/test, got %q", test.name, d.Name())
+			}
+			var informers []string
+			for kind := range d.InformersSynced() {
+				informers = append(informers, kind)
+			}
+			sort.Strings(informers)
+			if len(informers) != len(test.expectedInformers) {
+				t.Fatalf("%s: expected informers %v, got %v", test.name, test.expectedInformers, informers)
+			}
+			for i := range informers {
+				if informers[i] != test.expectedInformers[i] {
+					t.Errorf("%s: expected informers %v, got %v", test.name, test.expectedInformers, informers)
+					break
+				}
+			}
+
+			if caps := d.Capabilities(); caps != test.expectedCaps {
+				t.Errorf("%s: expected capabilities %+v, got %+v", test.name, test.expectedCaps, caps)
+			}
+			state := d.State()
+			if state.Capabilities != test.expectedCaps {
+				t.Errorf("%s: expected capabilities %+v, got %+v", test.name, test.expectedCaps, state.Capabilities)
+			}
+			if (state.AttachRequired != nil) != (test.expectedCaps.Handler == "csi") {
+				t.Errorf("%s: unexpected attachRequired %v", test.name, state.AttachRequired)
+			}
+
+			// Run stops when the informers are stopped.
+			ctx, cancel := context.WithCancel(context.Background())
+			factory.Start(ctx.Done())
+			done := make(chan error)
+			go func() { done <- d.Run(ctx) }()
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("%s: Run did not stop", test.name)
+			}
+		}()
+	}
+}
+
+func TestNewDriverInvalidOptions(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(client, 0)
+	options := DefaultOptions()
+	options.WorkerThreads = 0
+	if _, err := NewDriver(context.Background(), client, factory, nil, options); err == nil {
+		t.Errorf("expected error, got none")
+	}
+}
+
+func TestEndpointSwitched(t *testing.T) {
+	recorder := record.NewFakeRecorder(1)
+	d := &Driver{
+		name: testAttacherName,
+		ctrl: &CSIAttachController{
+			client:        fake.NewSimpleClientset(),
+			attacherName:  testAttacherName,
+			eventRecorder: recorder,
+		},
+	}
+	d.EndpointSwitched("/run/csi/primary.sock", "/run/csi/backup.sock")
+	expected := "Warning CSIEndpointFailover Connection to CSI endpoint /run/csi/primary.sock failed, switched to /run/csi/backup.sock"
+	select {
+	case event := <-recorder.Events:
+		if event != expected {
+			t.Errorf("expected event %q, got %q", expected, event)
+		}
+	default:
+		t.Errorf("expected event %q, got none", expected)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"k8s.io/klog"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
+)
+
+// dryRunAttacher logs ControllerPublish and ControllerUnpublish requests
+// instead of sending them to the CSI driver. Secrets are not logged.
+type dryRunAttacher struct {
+	driverName string
+}
+
+var _ attacher.Attacher = &dryRunAttacher{}
+
+func (a *dryRunAttacher) Attach(ctx context.Context, volumeID string, readOnly bool, nodeID string, caps *csi.VolumeCapability, attributes, secrets map[string]string) (map[string]string, bool, error) {
+	req := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           nodeID,
+		VolumeCapability: caps,
+		Readonly:         readOnly,
+		VolumeContext:    attributes,
+		Secrets:          secrets,
+	}
+	klog.Infof("Dry run: not sending ControllerPublishVolume to CSI driver %q: %s", a.driverName, protosanitizer.StripSecrets(req))
+	return nil, false, nil
+}
+
+func (a *dryRunAttacher) Detach(ctx context.Context, volumeID string, nodeID string, secrets map[string]string) error {
+	req := &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: volumeID,
+		NodeId:   nodeID,
+		Secrets:  secrets,
+	}
+	klog.Infof("Dry run: not sending ControllerUnpublishVolume to CSI driver %q: %s", a.driverName, protosanitizer.StripSecrets(req))
+	return nil
+}
+
+// DryRunTransport returns RoundTripper that sends write requests through rt
+// with dryRun=All: the API server validates and admits them, but does not
+// persist any change. It can be used as rest.Config.WrapTransport.
+func DryRunTransport(rt http.RoundTripper) http.RoundTripper {
+	return &dryRunRoundTripper{rt: rt}
+}
+
+type dryRunRoundTripper struct {
+	rt http.RoundTripper
+}
+
+var _ http.RoundTripper = &dryRunRoundTripper{}
+
+func (r *dryRunRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isWrite(req.Method) {
+		return r.rt.RoundTrip(req)
+	}
+	// RoundTripper must not modify the request.
+	dryRun := new(http.Request)
+	*dryRun = *req
+	url := *req.URL
+	query := url.Query()
+	query.Set("dryRun", "All")
+	url.RawQuery = query.Encode()
+	dryRun.URL = &url
+	return r.rt.RoundTrip(dryRun)
+}
+
+func (r *dryRunRoundTripper) WrappedRoundTripper() http.RoundTripper {
+	return r.rt
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestDryRunTransport(t *testing.T) {
+	rt := DryRunTransport(&fakeRoundTripper{code: http.StatusOK})
+	tests := []struct {
+		method   string
+		url      string
+		expected string
+	}{
+		{http.MethodGet, "https://apiserver/api/v1/persistentvolumes/pv1", ""},
+		{http.MethodPatch, "https://apiserver/api/v1/persistentvolumes/pv1", "dryRun=All"},
+		{http.MethodPost, "https://apiserver/api/v1/namespaces/default/events?timeout=10s", "dryRun=All&timeout=10s"},
+		{http.MethodDelete, "https://apiserver/apis/storage.k8s.io/v1beta1/volumeattachments/va1", "dryRun=All"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, test.url, nil)
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s %s: unexpected error: %v", test.method, test.url, err)
+		}
+		if query := resp.Request.URL.RawQuery; query != test.expected {
+			t.Errorf("%s %s: expected query %q, got %q", test.method, test.url, test.expected, query)
+		}
+		if req.URL.String() != test.url {
+			t.Errorf("%s %s: original request was modified to %s", test.method, test.url, req.URL)
+		}
+	}
+}
+
+func TestDryRunAttacher(t *testing.T) {
+	a := &dryRunAttacher{driverName: "csi/test"}
+	metadata, detached, err := a.Attach(context.Background(), "vol", false, "node", nil, map[string]string{"foo": "bar"}, map[string]string{"password": "secret"})
+	if err != nil || detached || metadata != nil {
+		t.Errorf("expected a successful attach without metadata, got %v, %v, %v", metadata, detached, err)
+	}
+	if err := a.Detach(context.Background(), "vol", "node", nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
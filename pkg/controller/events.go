@@ -0,0 +1,213 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/time/rate"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/metrics"
+)
+
+// Reasons of events emitted by the CSI handler.
+const (
+	AttachStarted               = "AttachStarted"
+	AttachSucceeded             = "AttachSucceeded"
+	AttachFailed                = "AttachFailed"
+	DetachFailed                = "DetachFailed"
+	AttachDeferred              = "AttachDeferred"
+	DetachDeferred              = "DetachDeferred"
+	AttachQuotaExceeded         = "AttachQuotaExceeded"
+	PostDetachHookFailed        = "PostDetachHookFailed"
+	DetachInUse                 = "DetachInUse"
+	ForceDetach                 = "ForceDetach"
+	DriverNotRegisteredOnNode   = "DriverNotRegisteredOnNode"
+	InvalidNodeID               = "InvalidNodeID"
+	NodeIDChanged               = "NodeIDChanged"
+	DriftRepaired               = "DriftRepaired"
+	NodeAttachSoftLimitExceeded = "NodeAttachSoftLimitExceeded"
+	SlowAttach                  = "SlowAttach"
+	SlowDetach                  = "SlowDetach"
+	AttachmentMetadataUpdated   = "AttachmentMetadataUpdated"
+	CircuitBreakerOpened        = "CircuitBreakerOpened"
+	CircuitBreakerClosed        = "CircuitBreakerClosed"
+	CSIEndpointFailover         = "CSIEndpointFailover"
+)
+
+// EventsLevel selects which events are emitted.
+type EventsLevel string
+
+const (
+	// EventsNone emits no events, the attacher then does not need
+	// permissions to create events.
+	EventsNone EventsLevel = "none"
+	// EventsErrorsOnly emits only warnings.
+	EventsErrorsOnly EventsLevel = "errors-only"
+	// EventsNormal emits warnings and AttachSucceeded.
+	EventsNormal EventsLevel = "normal"
+	// EventsVerbose emits all events, including AttachStarted.
+	EventsVerbose EventsLevel = "verbose"
+)
+
+// ParseEventsLevel parses an EventsLevel.
+func ParseEventsLevel(level string) (EventsLevel, error) {
+	switch l := EventsLevel(level); l {
+	case EventsNone, EventsErrorsOnly, EventsNormal, EventsVerbose:
+		return l, nil
+	}
+	return "", fmt.Errorf("invalid events level %q: must be %q, %q, %q or %q", level, EventsNone, EventsErrorsOnly, EventsNormal, EventsVerbose)
+}
+
+const (
+	// Warnings with the same reason are limited to warningBurst at once and
+	// then to one per 1/warningQPS seconds, across all objects.
+	warningBurst = 20
+	warningQPS   = 0.1
+)
+
+// eventsSuppressedTotal counts events dropped by the rate limit of warnings.
+var eventsSuppressedTotal = metrics.NewCounterVec(
+	metrics.Namespace+"_events_suppressed_total",
+	"Number of events that were not emitted because too many events with the same reason were emitted recently.",
+	"reason")
+
+func init() {
+	metrics.MustRegister(eventsSuppressedTotal)
+}
+
+// eventFilter decides which events are emitted. Events are filtered by
+// level and warnings are rate limited by reason across all objects, so a
+// storage outage that fails thousands of VolumeAttachments at once doesn't
+// flood the API server with near-identical events. Repeated events of a
+// single object are aggregated by the event broadcaster.
+type eventFilter struct {
+	level EventsLevel
+
+	lock     sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func newEventFilter(level EventsLevel) *eventFilter {
+	return &eventFilter{
+		level:    level,
+		limiters: map[string]*rate.Limiter{},
+	}
+}
+
+// allow returns true when an event should be emitted.
+func (f *eventFilter) allow(eventType, reason string) bool {
+	if f.level == EventsNone {
+		return false
+	}
+	if eventType != v1.EventTypeWarning {
+		switch f.level {
+		case EventsErrorsOnly:
+			return false
+		case EventsNormal:
+			return reason != AttachStarted
+		}
+		return true
+	}
+
+	f.lock.Lock()
+	limiter, found := f.limiters[reason]
+	if !found {
+		limiter = rate.NewLimiter(warningQPS, warningBurst)
+		f.limiters[reason] = limiter
+	}
+	f.lock.Unlock()
+	if !limiter.Allow() {
+		eventsSuppressedTotal.WithLabelValues(reason).Inc()
+		return false
+	}
+	return true
+}
+
+// recordEvent emits an event on a VolumeAttachment and, with PVC events
+// enabled, on the PVC bound to its PV. Events on the VolumeAttachment name the
+// PVC, so failures can be traced to the application.
+func (h *csiHandler) recordEvent(va *storage.VolumeAttachment, eventType, reason, messageFmt string, args ...interface{}) {
+	if h.eventRecorder == nil {
+		return
+	}
+	if h.eventFilter != nil && !h.eventFilter.allow(eventType, reason) {
+		klog.V(4).Infof("Not emitting event %s on %q: %s", reason, va.Name, fmt.Sprintf(messageFmt, args...))
+		return
+	}
+	var annotations map[string]string
+	if id := h.correlationID(va); id != "" {
+		annotations = map[string]string{CorrelationIDAnnotation: id}
+	}
+	claim := h.getClaim(va)
+	if claim == nil {
+		h.eventRecorder.AnnotatedEventf(va, annotations, eventType, reason, messageFmt, args...)
+		return
+	}
+	vaArgs := append(append([]interface{}{}, args...), claim.Namespace, claim.Name)
+	h.eventRecorder.AnnotatedEventf(va, annotations, eventType, reason, messageFmt+" (PersistentVolumeClaim %s/%s)", vaArgs...)
+
+	if !h.pvcEvents {
+		return
+	}
+	ref := &v1.ObjectReference{
+		Kind:       "PersistentVolumeClaim",
+		APIVersion: "v1",
+		Namespace:  claim.Namespace,
+		Name:       claim.Name,
+		UID:        claim.UID,
+	}
+	h.eventRecorder.AnnotatedEventf(ref, annotations, eventType, reason, messageFmt, args...)
+}
+
+// getClaim returns the reference to the PVC bound to the PV of va, nil for
+// inline volumes, unbound and unknown PVs.
+func (h *csiHandler) getClaim(va *storage.VolumeAttachment) *v1.ObjectReference {
+	if va.Spec.Source.PersistentVolumeName == nil || h.pvLister == nil {
+		return nil
+	}
+	pv, err := h.pvLister.Get(*va.Spec.Source.PersistentVolumeName)
+	if err != nil {
+		klog.V(5).Infof("Can't find PVC of %q: %v", va.Name, err)
+		return nil
+	}
+	return pv.Spec.ClaimRef
+}
+
+// discardRecorder is a record.EventRecorder that drops all events, for
+// EventsNone.
+type discardRecorder struct{}
+
+var _ record.EventRecorder = discardRecorder{}
+
+func (discardRecorder) Event(object runtime.Object, eventtype, reason, message string) {}
+
+func (discardRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+}
+
+func (discardRecorder) PastEventf(object runtime.Object, timestamp metav1.Time, eventtype, reason, messageFmt string, args ...interface{}) {
+}
+
+func (discardRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+}
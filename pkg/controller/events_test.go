@@ -0,0 +1,221 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// annotatedRecorder is a FakeRecorder that formats annotated events like
+// other events and remembers their annotations.
+type annotatedRecorder struct {
+	*record.FakeRecorder
+
+	lock        sync.Mutex
+	annotations []map[string]string
+}
+
+func newAnnotatedRecorder(bufferSize int) *annotatedRecorder {
+	return &annotatedRecorder{FakeRecorder: record.NewFakeRecorder(bufferSize)}
+}
+
+func (r *annotatedRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.lock.Lock()
+	r.annotations = append(r.annotations, annotations)
+	r.lock.Unlock()
+	r.Eventf(object, eventtype, reason, messageFmt, args...)
+}
+
+func TestRecordEvent(t *testing.T) {
+	boundPV := pv()
+	boundPV.Spec.ClaimRef = &v1.ObjectReference{Namespace: "ns", Name: "claim"}
+
+	tests := []struct {
+		name      string
+		pv        *v1.PersistentVolume
+		pvcEvents bool
+		// correlationID is the ID of the VolumeAttachment, empty when the
+		// handler has no correlation IDs.
+		correlationID string
+		expected      []string
+	}{
+		{
+			name:     "VolumeAttachment only",
+			pv:       boundPV,
+			expected: []string{"Normal AttachStarted Attaching volume to node node1 (PersistentVolumeClaim ns/claim)"},
+		},
+		{
+			name:      "bound PVC",
+			pv:        boundPV,
+			pvcEvents: true,
+			expected: []string{
+				"Normal AttachStarted Attaching volume to node node1 (PersistentVolumeClaim ns/claim)",
+				"Normal AttachStarted Attaching volume to node node1",
+			},
+		},
+		{
+			name:      "unbound PV",
+			pv:        pv(),
+			pvcEvents: true,
+			expected:  []string{"Normal AttachStarted Attaching volume to node node1"},
+		},
+		{
+			name:      "missing PV",
+			pvcEvents: true,
+			expected:  []string{"Normal AttachStarted Attaching volume to node node1"},
+		},
+		{
+			name:          "correlation ID",
+			pv:            boundPV,
+			pvcEvents:     true,
+			correlationID: "1234",
+			expected: []string{
+				"Normal AttachStarted Attaching volume to node node1 (PersistentVolumeClaim ns/claim)",
+				"Normal AttachStarted Attaching volume to node node1",
+			},
+		},
+	}
+	for _, test := range tests {
+		client := fake.NewSimpleClientset()
+		factory := informers.NewSharedInformerFactory(client, 0)
+		pvInformer := factory.Core().V1().PersistentVolumes()
+		if test.pv != nil {
+			pvInformer.Informer().GetStore().Add(test.pv)
+		}
+		recorder := newAnnotatedRecorder(10)
+		h := &csiHandler{
+			pvLister:      pvInformer.Lister(),
+			eventRecorder: recorder,
+			pvcEvents:     test.pvcEvents,
+		}
+		if test.correlationID != "" {
+			h.correlationIDs = NewCorrelationIDs()
+			h.correlationIDs.ids[testPVName+"-"+testNodeName] = test.correlationID
+		}
+
+		h.recordEvent(va(false, "", nil), v1.EventTypeNormal, AttachStarted, "Attaching volume to node %s", testNodeName)
+		close(recorder.Events)
+		var events []string
+		for event := range recorder.Events {
+			events = append(events, event)
+		}
+		if !reflect.DeepEqual(test.expected, events) {
+			t.Errorf("%s: expected events %q, got %q", test.name, test.expected, events)
+		}
+		for _, annotations := range recorder.annotations {
+			if id := annotations[CorrelationIDAnnotation]; id != test.correlationID {
+				t.Errorf("%s: expected correlation ID %q, got %q", test.name, test.correlationID, id)
+			}
+		}
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	tests := []struct {
+		level    EventsLevel
+		expected map[string]bool
+	}{
+		{
+			level: EventsNone,
+			expected: map[string]bool{
+				AttachStarted:   false,
+				AttachSucceeded: false,
+				AttachFailed:    false,
+			},
+		},
+		{
+			level: EventsErrorsOnly,
+			expected: map[string]bool{
+				AttachStarted:   false,
+				AttachSucceeded: false,
+				AttachFailed:    true,
+			},
+		},
+		{
+			level: EventsNormal,
+			expected: map[string]bool{
+				AttachStarted:   false,
+				AttachSucceeded: true,
+				AttachFailed:    true,
+			},
+		},
+		{
+			level: EventsVerbose,
+			expected: map[string]bool{
+				AttachStarted:   true,
+				AttachSucceeded: true,
+				AttachFailed:    true,
+			},
+		},
+	}
+	for _, test := range tests {
+		f := newEventFilter(test.level)
+		for reason, expected := range test.expected {
+			eventType := v1.EventTypeNormal
+			if reason == AttachFailed {
+				eventType = v1.EventTypeWarning
+			}
+			if allowed := f.allow(eventType, reason); allowed != expected {
+				t.Errorf("level %s: expected %s allowed %t, got %t", test.level, reason, expected, allowed)
+			}
+		}
+	}
+}
+
+func TestEventFilterRateLimit(t *testing.T) {
+	f := newEventFilter(EventsNormal)
+	for i := 0; i < warningBurst; i++ {
+		if !f.allow(v1.EventTypeWarning, AttachFailed) {
+			t.Fatalf("warning %d suppressed within the burst", i)
+		}
+	}
+	suppressed := eventsSuppressedTotal.WithLabelValues(AttachFailed).Value()
+	if f.allow(v1.EventTypeWarning, AttachFailed) {
+		t.Errorf("expected warning over the burst to be suppressed")
+	}
+	if value := eventsSuppressedTotal.WithLabelValues(AttachFailed).Value(); value != suppressed+1 {
+		t.Errorf("expected %v suppressed events, got %v", suppressed+1, value)
+	}
+	// Other reasons have their own limit.
+	if !f.allow(v1.EventTypeWarning, DetachFailed) {
+		t.Errorf("expected DetachFailed to be allowed")
+	}
+	// Normal events are not limited.
+	if !f.allow(v1.EventTypeNormal, AttachSucceeded) {
+		t.Errorf("expected AttachSucceeded to be allowed")
+	}
+}
+
+func TestParseEventsLevel(t *testing.T) {
+	for _, level := range []string{"errors-only", "normal", "verbose"} {
+		if l, err := ParseEventsLevel(level); err != nil || string(l) != level {
+			t.Errorf("%s: got %q, %v", level, l, err)
+		}
+	}
+	if _, err := ParseEventsLevel("all"); err == nil {
+		t.Errorf("expected error for invalid level")
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	// FailureSummary is the reason of events that summarize failing
+	// VolumeAttachments.
+	FailureSummary = "FailureSummary"
+
+	// otherErrorClass is the class of errors that are not gRPC errors.
+	otherErrorClass = "Other"
+	// driverNotRegisteredErrorClass is the class of errors of nodes where
+	// the driver is not registered.
+	driverNotRegisteredErrorClass = "DriverNotRegistered"
+	// summaryEventGroups is the number of the largest groups listed in a
+	// summary event.
+	summaryEventGroups = 5
+)
+
+// grpcCode finds the code of a gRPC error in its message, e.g.
+// "rpc error: code = DeadlineExceeded desc = context deadline exceeded".
+var grpcCode = regexp.MustCompile(`rpc error: code = (\w+)`)
+
+// driverNotRegistered finds errors of newDriverNotRegisteredError.
+var driverNotRegistered = regexp.MustCompile(`CSI driver \S+ is not registered on node`)
+
+// failureGroup are failing VolumeAttachments on one node with the same class
+// of errors.
+type failureGroup struct {
+	node  string
+	class string
+	count int
+}
+
+func (g failureGroup) String() string {
+	return fmt.Sprintf("%d VolumeAttachments failing on node %q with %s", g.count, g.node, g.class)
+}
+
+// ErrorClass returns the gRPC code of an error message saved in a
+// VolumeAttachment, "DriverNotRegistered" when the driver is not registered
+// on the node or "Other" when the error does not come from the CSI driver.
+func ErrorClass(message string) string {
+	if match := grpcCode.FindStringSubmatch(message); match != nil {
+		return match[1]
+	}
+	if driverNotRegistered.MatchString(message) {
+		return driverNotRegisteredErrorClass
+	}
+	return otherErrorClass
+}
+
+// failureGroups groups VolumeAttachments of the controller with attach or
+// detach errors by node and error class, the largest groups first.
+func (ctrl *CSIAttachController) failureGroups() ([]failureGroup, error) {
+	vas, err := ctrl.vaLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	counts := map[failureGroup]int{}
+	for _, va := range vas {
+		if va.Spec.Attacher != ctrl.attacherName || !ctrl.owns(va.Name) || !ctrl.selectsVA(va) {
+			continue
+		}
+		var vaErr *storage.VolumeError
+		if va.Status.DetachError != nil {
+			vaErr = va.Status.DetachError
+		} else if va.Status.AttachError != nil {
+			vaErr = va.Status.AttachError
+		} else {
+			continue
+		}
+		counts[failureGroup{node: va.Spec.NodeName, class: ErrorClass(vaErr.Message)}]++
+	}
+
+	groups := make([]failureGroup, 0, len(counts))
+	for group, count := range counts {
+		group.count = count
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].count != groups[j].count {
+			return groups[i].count > groups[j].count
+		}
+		if groups[i].node != groups[j].node {
+			return groups[i].node < groups[j].node
+		}
+		return groups[i].class < groups[j].class
+	})
+	return groups, nil
+}
+
+// reportFailures logs a summary of failing VolumeAttachments. With events,
+// it emits also one event with the largest groups on the CSIDriver object.
+func (ctrl *CSIAttachController) reportFailures(events bool) {
+	groups, err := ctrl.failureGroups()
+	if err != nil {
+		klog.Errorf("Failure summary: failed to list VolumeAttachments: %s", err)
+		return
+	}
+	if len(groups) == 0 {
+		klog.V(4).Infof("Failure summary: no failing VolumeAttachments of %s", ctrl.attacherName)
+		return
+	}
+
+	total := 0
+	for _, group := range groups {
+		total += group.count
+	}
+	klog.Warningf("Failure summary: %d VolumeAttachments of %s failing", total, ctrl.attacherName)
+	for _, group := range groups {
+		klog.Warningf("Failure summary: %s", group)
+	}
+
+	if !events {
+		return
+	}
+	var messages []string
+	for i, group := range groups {
+		if i == summaryEventGroups {
+			messages = append(messages, fmt.Sprintf("%d more groups", len(groups)-i))
+			break
+		}
+		messages = append(messages, group.String())
+	}
+	ctrl.eventRecorder.Eventf(csiDriverRef(ctrl.client, ctrl.attacherName), v1.EventTypeWarning, FailureSummary, "%d VolumeAttachments failing: %s", total, strings.Join(messages, "; "))
+}
+
+// csiDriverRef returns a reference to the CSIDriver object of the driver
+// with given name. The object does not need to exist.
+func csiDriverRef(client kubernetes.Interface, name string) *v1.ObjectReference {
+	ref := &v1.ObjectReference{
+		Kind:       "CSIDriver",
+		APIVersion: "storage.k8s.io/v1beta1",
+		Name:       name,
+	}
+	if csiDriver, err := client.StorageV1beta1().CSIDrivers().Get(name, metav1.GetOptions{}); err == nil {
+		ref.UID = csiDriver.UID
+	}
+	return ref
+}
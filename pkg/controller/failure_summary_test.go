@@ -0,0 +1,129 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func failingVA(name, attacher, node string, attachError, detachError string) *storage.VolumeAttachment {
+	va := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: storage.VolumeAttachmentSpec{
+			Attacher: attacher,
+			NodeName: node,
+		},
+	}
+	if attachError != "" {
+		va.Status.AttachError = &storage.VolumeError{Message: attachError}
+	}
+	if detachError != "" {
+		va.Status.DetachError = &storage.VolumeError{Message: detachError}
+	}
+	return va
+}
+
+func TestErrorClass(t *testing.T) {
+	tests := map[string]string{
+		"rpc error: code = DeadlineExceeded desc = context deadline exceeded":   "DeadlineExceeded",
+		"could not save VolumeAttachment: rpc error: code = Internal desc = x":  "Internal",
+		"node \"node1\" has no NodeID annotation":                               "Other",
+		"failed to attach: CSI driver csi/test is not registered on node node1": "DriverNotRegistered",
+	}
+	for message, expected := range tests {
+		if class := ErrorClass(message); class != expected {
+			t.Errorf("%q: expected class %s, got %s", message, expected, class)
+		}
+	}
+}
+
+func TestReportFailures(t *testing.T) {
+	timeout := "rpc error: code = DeadlineExceeded desc = context deadline exceeded"
+	vas := []*storage.VolumeAttachment{
+		failingVA("va1", testAttacherName, "node1", timeout, ""),
+		failingVA("va2", testAttacherName, "node1", timeout, ""),
+		failingVA("va3", testAttacherName, "node2", timeout, ""),
+		// Detach error wins over attach error.
+		failingVA("va4", testAttacherName, "node2", timeout, "rpc error: code = NotFound desc = no node"),
+		failingVA("va5", testAttacherName, "node2", "", ""),
+		failingVA("va6", "other-attacher", "node1", timeout, ""),
+	}
+	for i := 0; i < summaryEventGroups+1; i++ {
+		node := fmt.Sprintf("node-%d", i+3)
+		vas = append(vas, failingVA("va-"+node, testAttacherName, node, "missing NodeID", ""))
+	}
+
+	client := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(client, 0)
+	vaInformer := factory.Storage().V1beta1().VolumeAttachments()
+	for _, va := range vas {
+		vaInformer.Informer().GetStore().Add(va)
+	}
+	recorder := record.NewFakeRecorder(10)
+	ctrl := &CSIAttachController{
+		client:        client,
+		attacherName:  testAttacherName,
+		eventRecorder: recorder,
+		vaLister:      vaInformer.Lister(),
+	}
+
+	groups, err := ctrl.failureGroups()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []failureGroup{
+		{node: "node1", class: "DeadlineExceeded", count: 2},
+		{node: "node-3", class: "Other", count: 1},
+		{node: "node-4", class: "Other", count: 1},
+		{node: "node-5", class: "Other", count: 1},
+		{node: "node-6", class: "Other", count: 1},
+		{node: "node-7", class: "Other", count: 1},
+		{node: "node-8", class: "Other", count: 1},
+		{node: "node2", class: "DeadlineExceeded", count: 1},
+		{node: "node2", class: "NotFound", count: 1},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("expected groups %+v, got %+v", expected, groups)
+	}
+
+	ctrl.reportFailures(false)
+	if len(recorder.Events) != 0 {
+		t.Errorf("expected no events, got %d", len(recorder.Events))
+	}
+	ctrl.reportFailures(true)
+	close(recorder.Events)
+	var events []string
+	for event := range recorder.Events {
+		events = append(events, event)
+	}
+	expectedEvents := []string{
+		`Warning FailureSummary 10 VolumeAttachments failing: 2 VolumeAttachments failing on node "node1" with DeadlineExceeded; ` +
+			`1 VolumeAttachments failing on node "node-3" with Other; 1 VolumeAttachments failing on node "node-4" with Other; ` +
+			`1 VolumeAttachments failing on node "node-5" with Other; 1 VolumeAttachments failing on node "node-6" with Other; 4 more groups`,
+	}
+	if !reflect.DeepEqual(events, expectedEvents) {
+		t.Errorf("expected events %q, got %q", expectedEvents, events)
+	}
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+// Latency distributions of injected faults.
+const (
+	LatencyConstant    = "constant"
+	LatencyUniform     = "uniform"
+	LatencyExponential = "exponential"
+)
+
+// errInjected is the error of operations failed by fault injection.
+var errInjected = errors.New("injected error")
+
+// Faults configure simulated latency and errors of attach operations, for
+// scale and chaos tests without a real driver or against a real driver.
+type Faults struct {
+	// Latency is the mean latency added to each operation.
+	Latency time.Duration
+	// LatencyDistribution is the distribution of the latency:
+	// LatencyConstant, LatencyUniform (between 0 and 2 * Latency) or
+	// LatencyExponential. LatencyConstant is used when empty.
+	LatencyDistribution string
+	// ErrorRate is the probability that an operation fails, from 0 to 1.
+	ErrorRate float64
+}
+
+// Enabled returns true when the faults add any latency or errors.
+func (f Faults) Enabled() bool {
+	return f.Latency > 0 || f.ErrorRate > 0
+}
+
+// Validate returns an error when the faults can't be used.
+func (f Faults) Validate() error {
+	if f.Latency < 0 {
+		return fmt.Errorf("injected latency must not be negative")
+	}
+	switch f.LatencyDistribution {
+	case "", LatencyConstant, LatencyUniform, LatencyExponential:
+	default:
+		return fmt.Errorf("invalid latency distribution %q: must be %q, %q or %q", f.LatencyDistribution, LatencyConstant, LatencyUniform, LatencyExponential)
+	}
+	if f.ErrorRate < 0 || f.ErrorRate > 1 {
+		return fmt.Errorf("injected error rate must be between 0 and 1")
+	}
+	return nil
+}
+
+// faultInjector draws latencies and errors of Faults. A nil injector injects
+// nothing.
+type faultInjector struct {
+	faults Faults
+	clock  clock.Clock
+
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+// newFaultInjector returns an injector of faults that waits for latencies on
+// given clock, nil when the faults are not enabled.
+func newFaultInjector(faults Faults, clock clock.Clock, seed int64) *faultInjector {
+	if !faults.Enabled() {
+		return nil
+	}
+	return &faultInjector{faults: faults, clock: clock, rand: rand.New(rand.NewSource(seed))}
+}
+
+// latency returns the latency to add to the next operation.
+func (f *faultInjector) latency() time.Duration {
+	if f == nil || f.faults.Latency <= 0 {
+		return 0
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch f.faults.LatencyDistribution {
+	case LatencyUniform:
+		return time.Duration(f.rand.Int63n(int64(2 * f.faults.Latency)))
+	case LatencyExponential:
+		return time.Duration(f.rand.ExpFloat64() * float64(f.faults.Latency))
+	}
+	return f.faults.Latency
+}
+
+// fail returns true when the next operation should fail.
+func (f *faultInjector) fail() bool {
+	if f == nil || f.faults.ErrorRate <= 0 {
+		return false
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.rand.Float64() < f.faults.ErrorRate
+}
+
+// inject sleeps for the next latency and returns errInjected when the
+// operation should fail.
+func (f *faultInjector) inject() error {
+	if delay := f.latency(); delay > 0 {
+		f.clock.Sleep(delay)
+	}
+	if f.fail() {
+		return errInjected
+	}
+	return nil
+}
+
+// injectContext is inject for calls with a context: the latency ends early
+// when ctx is done and the injected error is a gRPC Unavailable error, like
+// a driver that is temporarily unreachable.
+func (f *faultInjector) injectContext(ctx context.Context) error {
+	if delay := f.latency(); delay > 0 {
+		timer := f.clock.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+		}
+	}
+	if f.fail() {
+		return status.Error(codes.Unavailable, errInjected.Error())
+	}
+	return nil
+}
+
+// faultyAttacher delays and fails calls of a CSI attacher before they are
+// sent to the driver.
+type faultyAttacher struct {
+	attacher.Attacher
+	faults *faultInjector
+}
+
+var _ attacher.Attacher = &faultyAttacher{}
+
+// newFaultyAttacher returns a with faults, a itself when they are not
+// enabled.
+func newFaultyAttacher(a attacher.Attacher, faults Faults, clock clock.Clock, seed int64) attacher.Attacher {
+	injector := newFaultInjector(faults, clock, seed)
+	if injector == nil {
+		return a
+	}
+	return &faultyAttacher{Attacher: a, faults: injector}
+}
+
+func (a *faultyAttacher) Attach(ctx context.Context, volumeID string, readOnly bool, nodeID string, caps *csi.VolumeCapability, attributes, secrets map[string]string) (map[string]string, bool, error) {
+	if err := a.faults.injectContext(ctx); err != nil {
+		// The volume may be attached by an earlier call, the attach is
+		// not final.
+		return nil, false, err
+	}
+	return a.Attacher.Attach(ctx, volumeID, readOnly, nodeID, caps, attributes, secrets)
+}
+
+func (a *faultyAttacher) Detach(ctx context.Context, volumeID string, nodeID string, secrets map[string]string) error {
+	if err := a.faults.injectContext(ctx); err != nil {
+		return err
+	}
+	return a.Attacher.Detach(ctx, volumeID, nodeID, secrets)
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+func TestFaultsValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		faults Faults
+		valid  bool
+	}{
+		{
+			name:  "none",
+			valid: true,
+		},
+		{
+			name:   "all",
+			faults: Faults{Latency: time.Second, LatencyDistribution: LatencyExponential, ErrorRate: 0.1},
+			valid:  true,
+		},
+		{
+			name:   "negative latency",
+			faults: Faults{Latency: -time.Second},
+		},
+		{
+			name:   "invalid distribution",
+			faults: Faults{Latency: time.Second, LatencyDistribution: "normal"},
+		},
+		{
+			name:   "error rate over 1",
+			faults: Faults{ErrorRate: 2},
+		},
+	}
+	for _, test := range tests {
+		err := test.faults.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected error, got none", test.name)
+		}
+	}
+}
+
+func TestFaultInjector(t *testing.T) {
+	if f := newFaultInjector(Faults{}, clock.RealClock{}, 1); f != nil {
+		t.Errorf("expected no injector without faults")
+	}
+	var none *faultInjector
+	if none.latency() != 0 || none.fail() {
+		t.Errorf("nil injector injected a fault")
+	}
+
+	const samples = 10000
+	mean := 100 * time.Millisecond
+	for _, distribution := range []string{LatencyConstant, LatencyUniform, LatencyExponential} {
+		f := newFaultInjector(Faults{Latency: mean, LatencyDistribution: distribution}, clock.RealClock{}, 1)
+		var total time.Duration
+		for i := 0; i < samples; i++ {
+			latency := f.latency()
+			if latency < 0 || distribution == LatencyUniform && latency >= 2*mean {
+				t.Fatalf("%s: latency %s out of range", distribution, latency)
+			}
+			total += latency
+		}
+		if average := total / samples; average < 90*time.Millisecond || average > 110*time.Millisecond {
+			t.Errorf("%s: expected average latency around %s, got %s", distribution, mean, average)
+		}
+	}
+
+	f := newFaultInjector(Faults{ErrorRate: 0.25}, clock.RealClock{}, 1)
+	failures := 0
+	for i := 0; i < samples; i++ {
+		if f.inject() != nil {
+			failures++
+		}
+	}
+	if failures < samples/5 || failures > samples*3/10 {
+		t.Errorf("expected about %d failures, got %d", samples/4, failures)
+	}
+}
+
+// countingAttacher counts calls that reached the CSI driver.
+type countingAttacher struct {
+	attaches, detaches int
+}
+
+func (a *countingAttacher) Attach(ctx context.Context, volumeID string, readOnly bool, nodeID string, caps *csi.VolumeCapability, attributes, secrets map[string]string) (map[string]string, bool, error) {
+	a.attaches++
+	return nil, false, nil
+}
+
+func (a *countingAttacher) Detach(ctx context.Context, volumeID string, nodeID string, secrets map[string]string) error {
+	a.detaches++
+	return nil
+}
+
+func TestFaultyAttacher(t *testing.T) {
+	csiAttacher := &countingAttacher{}
+	if a := newFaultyAttacher(csiAttacher, Faults{}, clock.RealClock{}, 1); a != csiAttacher {
+		t.Errorf("expected the attacher itself without faults")
+	}
+
+	a := newFaultyAttacher(csiAttacher, Faults{ErrorRate: 1}, clock.RealClock{}, 1)
+	if _, detached, err := a.Attach(context.Background(), "vol", false, "node", nil, nil, nil); status.Code(err) != codes.Unavailable || detached {
+		t.Errorf("expected not final Unavailable error, got detached=%v, %v", detached, err)
+	}
+	if err := a.Detach(context.Background(), "vol", "node", nil); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable error, got %v", err)
+	}
+	if csiAttacher.attaches != 0 || csiAttacher.detaches != 0 {
+		t.Errorf("failed calls reached the driver: %+v", csiAttacher)
+	}
+
+	// The delay ends with the context.
+	a = newFaultyAttacher(csiAttacher, Faults{Latency: time.Hour}, clock.RealClock{}, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := a.Attach(ctx, "vol", false, "node", nil, nil, nil); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded error, got %v", err)
+	}
+
+	a = newFaultyAttacher(csiAttacher, Faults{Latency: time.Millisecond}, clock.RealClock{}, 1)
+	if _, _, err := a.Attach(context.Background(), "vol", false, "node", nil, nil, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := a.Detach(context.Background(), "vol", "node", nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if csiAttacher.attaches != 1 || csiAttacher.detaches != 1 {
+		t.Errorf("expected delayed calls to reach the driver, got %+v", csiAttacher)
+	}
+}
+
+func TestFaultInjectorClock(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Date(2019, 10, 14, 12, 0, 0, 0, time.UTC))
+	f := newFaultInjector(Faults{Latency: time.Hour}, fakeClock, 1)
+	done := make(chan error)
+	go func() { done <- f.injectContext(context.Background()) }()
+
+	for !fakeClock.HasWaiters() {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatalf("injected latency ended before the clock advanced")
+	default:
+	}
+	fakeClock.Step(time.Hour)
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -72,6 +72,8 @@ type testCase struct {
 	expectedActions []core.Action
 	// List of expected CSI calls
 	expectedCSICalls []csiCall
+	// Optional list of expected events, checked only when set.
+	expectedEvents []string
 	// Function to perform additional checks after the test finishes
 	additionalCheck func(t *testing.T, test testCase)
 }
@@ -177,7 +179,13 @@ func runTests(t *testing.T, handlerFactory handlerFactory, tests []testCase) {
 		// Construct controller
 		csiConnection := &fakeCSIConnection{t: t, calls: test.expectedCSICalls}
 		handler := handlerFactory(client, informers, csiConnection)
-		ctrl := NewCSIAttachController(client, testAttacherName, handler, vaInformer, pvInformer, workqueue.DefaultControllerRateLimiter(), workqueue.DefaultControllerRateLimiter())
+		ctrl := NewCSIAttachController(client, testAttacherName, handler, vaInformer, pvInformer, workqueue.DefaultControllerRateLimiter(), workqueue.DefaultControllerRateLimiter(), 0 /* no safety sweep */, nil)
+		// Collect events instead of creating them through the client, so
+		// they don't show up in client actions.
+		recorder := newAnnotatedRecorder(100)
+		if setter, ok := handler.(EventRecorderSetter); ok {
+			setter.SetEventRecorder(recorder)
+		}
 
 		// Start the test by enqueueing the right event
 		if test.addedVA != nil {
@@ -283,6 +291,17 @@ func runTests(t *testing.T, handlerFactory handlerFactory, tests []testCase) {
 			}
 		}
 
+		if test.expectedEvents != nil {
+			var events []string
+			close(recorder.Events)
+			for event := range recorder.Events {
+				events = append(events, event)
+			}
+			if !reflect.DeepEqual(test.expectedEvents, events) {
+				t.Errorf("Test %q: expected events %q, got %q", test.name, test.expectedEvents, events)
+			}
+		}
+
 		if test.additionalCheck != nil {
 			test.additionalCheck(t, test)
 		}
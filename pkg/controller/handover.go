@@ -0,0 +1,147 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	// handoverDataKey is the ConfigMap key with the snapshot.
+	handoverDataKey = "backoff"
+	// maxHandoverItems limits the size of the snapshot, so it fits into a
+	// ConfigMap. Items with the most failures are saved.
+	maxHandoverItems = 5000
+)
+
+// handoverSnapshot is the content of the handover ConfigMap.
+type handoverSnapshot struct {
+	VolumeAttachments []BackoffState `json:"va,omitempty"`
+	PersistentVolumes []BackoffState `json:"pv,omitempty"`
+	SavedAt           time.Time      `json:"savedAt"`
+}
+
+// StateHandover periodically saves backoff of failed VolumeAttachments and
+// PersistentVolumes of the leader to a ConfigMap, so the next leader can
+// continue with the same retry schedule instead of retrying all failed
+// objects at once.
+type StateHandover struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	vaLimiter *BackoffRateLimiter
+	pvLimiter *BackoffRateLimiter
+}
+
+// NewStateHandover returns a new StateHandover that stores the state in
+// ConfigMap namespace/name.
+func NewStateHandover(client kubernetes.Interface, namespace, name string, vaLimiter, pvLimiter *BackoffRateLimiter) *StateHandover {
+	return &StateHandover{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		vaLimiter: vaLimiter,
+		pvLimiter: pvLimiter,
+	}
+}
+
+// Restore loads the state saved by the previous leader.
+func (h *StateHandover) Restore() error {
+	cm, err := h.client.CoreV1().ConfigMaps(h.namespace).Get(h.name, metav1.GetOptions{})
+	if err != nil {
+		if apierrs.IsNotFound(err) {
+			klog.V(2).Infof("No state to restore in ConfigMap %s/%s", h.namespace, h.name)
+			return nil
+		}
+		return err
+	}
+	snapshot := &handoverSnapshot{}
+	if err := json.Unmarshal([]byte(cm.Data[handoverDataKey]), snapshot); err != nil {
+		return fmt.Errorf("failed to parse ConfigMap %s/%s: %v", h.namespace, h.name, err)
+	}
+	h.vaLimiter.Restore(snapshot.VolumeAttachments)
+	h.pvLimiter.Restore(snapshot.PersistentVolumes)
+	klog.Infof("Restored backoff of %d VolumeAttachments and %d PersistentVolumes saved at %s", len(snapshot.VolumeAttachments), len(snapshot.PersistentVolumes), snapshot.SavedAt)
+	return nil
+}
+
+// Save saves the current state.
+func (h *StateHandover) Save() error {
+	snapshot := &handoverSnapshot{
+		VolumeAttachments: limitHandoverItems(h.vaLimiter.Snapshot()),
+		PersistentVolumes: limitHandoverItems(h.pvLimiter.Snapshot()),
+		SavedAt:           time.Now(),
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	configMaps := h.client.CoreV1().ConfigMaps(h.namespace)
+	cm, err := configMaps.Get(h.name, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      h.name,
+				Namespace: h.namespace,
+			},
+			Data: map[string]string{handoverDataKey: string(data)},
+		}
+		_, err = configMaps.Create(cm)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	cm = cm.DeepCopy()
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[handoverDataKey] = string(data)
+	_, err = configMaps.Update(cm)
+	return err
+}
+
+// Run saves the state every interval until stopCh is closed.
+func (h *StateHandover) Run(interval time.Duration, stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := h.Save(); err != nil {
+			klog.Errorf("Failed to save state to ConfigMap %s/%s: %v", h.namespace, h.name, err)
+		}
+	}, interval, stopCh)
+}
+
+func limitHandoverItems(states []BackoffState) []BackoffState {
+	if len(states) <= maxHandoverItems {
+		return states
+	}
+	// Prefer items with the longest backoff, they would hurt the most if
+	// retried too early.
+	sorted := append([]BackoffState(nil), states...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Failures > sorted[j].Failures })
+	return sorted[:maxHandoverItems]
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestStateHandover(t *testing.T) {
+	client := fake.NewSimpleClientset()
+
+	// The first leader
+	vaLimiter := NewBackoffRateLimiter(time.Minute, time.Hour)
+	pvLimiter := NewBackoffRateLimiter(time.Minute, time.Hour)
+	vaLimiter.When("va1")
+	vaLimiter.When("va1")
+	pvLimiter.When("pv1")
+	leader := NewStateHandover(client, "default", "state", vaLimiter, pvLimiter)
+	if err := leader.Save(); err != nil {
+		t.Fatalf("failed to save state: %s", err)
+	}
+	// Update of existing ConfigMap
+	vaLimiter.When("va2")
+	if err := leader.Save(); err != nil {
+		t.Fatalf("failed to save state: %s", err)
+	}
+
+	// The next leader
+	newVALimiter := NewBackoffRateLimiter(time.Minute, time.Hour)
+	newPVLimiter := NewBackoffRateLimiter(time.Minute, time.Hour)
+	next := NewStateHandover(client, "default", "state", newVALimiter, newPVLimiter)
+	if err := next.Restore(); err != nil {
+		t.Fatalf("failed to restore state: %s", err)
+	}
+	if n := newVALimiter.NumRequeues("va1"); n != 2 {
+		t.Errorf("expected 2 restored failures of va1, got %d", n)
+	}
+	if n := newVALimiter.NumRequeues("va2"); n != 1 {
+		t.Errorf("expected 1 restored failure of va2, got %d", n)
+	}
+	if n := newPVLimiter.NumRequeues("pv1"); n != 1 {
+		t.Errorf("expected 1 restored failure of pv1, got %d", n)
+	}
+	if delay := newVALimiter.Postponed("va1"); delay <= time.Minute {
+		t.Errorf("expected va1 to be postponed by more than a minute, got %s", delay)
+	}
+}
+
+func TestStateHandoverNoState(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	h := NewStateHandover(client, "default", "state", NewBackoffRateLimiter(time.Second, time.Minute), NewBackoffRateLimiter(time.Second, time.Minute))
+	if err := h.Restore(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,45 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/hooks"
+)
+
+// runHook runs hook of va with volume csiSource on node with nodeID.
+func (h *csiHandler) runHook(hook string, va *storage.VolumeAttachment, csiSource *v1.CSIPersistentVolumeSource, nodeID string, readOnly bool) error {
+	if h.hooks == nil {
+		return nil
+	}
+	event := &hooks.Event{
+		Hook:             hook,
+		Driver:           h.attacherName,
+		VolumeAttachment: va.Name,
+		VolumeHandle:     csiSource.VolumeHandle,
+		ReadOnly:         readOnly,
+		VolumeAttributes: csiSource.VolumeAttributes,
+		Node:             va.Spec.NodeName,
+		NodeID:           nodeID,
+	}
+	if va.Spec.Source.PersistentVolumeName != nil {
+		event.PersistentVolume = *va.Spec.Source.PersistentVolumeName
+	}
+	return h.hooks.Run(event)
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	core "k8s.io/client-go/testing"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
+	"github.com/kubernetes-csi/external-attacher/pkg/hooks"
+)
+
+// fakeHooks fails hooks in errors and remembers all events.
+type fakeHooks struct {
+	errors map[string]error
+
+	lock   sync.Mutex
+	events []*hooks.Event
+}
+
+func (f *fakeHooks) Run(event *hooks.Event) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.events = append(f.events, event)
+	return f.errors[event.Hook]
+}
+
+func (f *fakeHooks) ran() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var ran []string
+	for _, event := range f.events {
+		ran = append(ran, event.Hook)
+	}
+	return ran
+}
+
+func hooksHandlerFactory(runner hooks.Runner) handlerFactory {
+	return func(client kubernetes.Interface, informerFactory informers.SharedInformerFactory, csi attacher.Attacher) Handler {
+		handler := csiHandlerFactory(client, informerFactory, csi)
+		handler.(*csiHandler).hooks = runner
+		return handler
+	}
+}
+
+func TestCSIHandlerHooks(t *testing.T) {
+	vaGroupResourceVersion := schema.GroupVersionResource{
+		Group:    storage.GroupName,
+		Version:  "v1beta1",
+		Resource: "volumeattachments",
+	}
+	var noMetadata map[string]string
+	var noAttrs map[string]string
+	var noSecrets map[string]string
+	var notDetached = false
+	var success error
+	var readWrite = false
+
+	expectHooks := func(runner *fakeHooks, expected ...string) func(t *testing.T, test testCase) {
+		return func(t *testing.T, test testCase) {
+			ran := runner.ran()
+			if len(ran) != len(expected) {
+				t.Errorf("Test %q: expected hooks %v, got %v", test.name, expected, ran)
+				return
+			}
+			for i := range ran {
+				if ran[i] != expected[i] {
+					t.Errorf("Test %q: expected hooks %v, got %v", test.name, expected, ran)
+					return
+				}
+			}
+			event := runner.events[0]
+			if event.VolumeAttachment != testPVName+"-"+testNodeName || event.PersistentVolume != testPVName || event.VolumeHandle != testVolumeHandle || event.NodeID != testNodeID {
+				t.Errorf("Test %q: unexpected hook event %+v", test.name, event)
+			}
+		}
+	}
+
+	attachHooks := &fakeHooks{}
+	runTests(t, hooksHandlerFactory(attachHooks), []testCase{
+		{
+			name:           "pre-attach hook -> successful attachment",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        va(false, "", nil),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, "", nil), va(false /*attached*/, fin, ann))),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, fin, ann), va(true /*attached*/, fin, ann))),
+			},
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, noMetadata, 0},
+			},
+			additionalCheck: expectHooks(attachHooks, hooks.PreAttach),
+		},
+	})
+
+	failedAttachHooks := &fakeHooks{errors: map[string]error{hooks.PreAttach: errors.New("pre-attach hook failed: exit status 1")}}
+	runTests(t, hooksHandlerFactory(failedAttachHooks), []testCase{
+		{
+			name:           "failed pre-attach hook -> error without CSI call",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        va(false, "", nil),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, "", nil), va(false /*attached*/, fin, ann))),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, fin, ann),
+						vaWithAttachError(va(false, fin, ann), "pre-attach hook failed: exit status 1"))),
+			},
+			expectedCSICalls: []csiCall{},
+			additionalCheck:  expectHooks(failedAttachHooks, hooks.PreAttach),
+		},
+	})
+
+	failedDetachHooks := &fakeHooks{errors: map[string]error{hooks.PostDetach: errors.New("post-detach hook failed: exit status 1")}}
+	runTests(t, hooksHandlerFactory(failedDetachHooks), []testCase{
+		{
+			name:           "failed post-detach hook -> successful detach",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        deleted(va(true, fin, ann)),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(deleted(va(true, fin, ann)),
+						deleted(va(false /*attached*/, "", ann)))),
+			},
+			expectedCSICalls: []csiCall{
+				{"detach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, noMetadata, 0},
+			},
+			expectedEvents: []string{
+				"Warning PostDetachHookFailed Hook after detach of volume from node node1 failed: post-detach hook failed: exit status 1",
+			},
+			additionalCheck: expectHooks(failedDetachHooks, hooks.PostDetach),
+		},
+	})
+}
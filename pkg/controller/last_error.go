@@ -0,0 +1,94 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// LastErrorAnnotation is the annotation of VolumeAttachments with the most
+// recent attach or detach error as JSON encoded LastError.
+const LastErrorAnnotation = "csi.alpha.kubernetes.io/last-error"
+
+// messageHashLength is the number of hex digits of the SHA-256 hash of error
+// messages in LastError.
+const messageHashLength = 16
+
+// LastError describes the most recent attach or detach error of a
+// VolumeAttachment, so tools can classify and aggregate errors without
+// parsing their messages.
+type LastError struct {
+	// Operation is "attach" or "detach".
+	Operation string `json:"operation"`
+	// Code is the gRPC code of the error, "Other" when the error does not
+	// come from the CSI driver.
+	Code string `json:"code"`
+	// MessageHash is a prefix of the SHA-256 hash of the error message.
+	MessageHash string `json:"messageHash"`
+	// FirstSeen and LastSeen are the times of the first and the last error
+	// in a row with the same operation, code and message.
+	FirstSeen metav1.Time `json:"firstSeen"`
+	LastSeen  metav1.Time `json:"lastSeen"`
+	// Count is the number of errors in a row with the same operation, code
+	// and message.
+	Count int `json:"count"`
+}
+
+func messageHash(message string) string {
+	hash := sha256.Sum256([]byte(message))
+	return hex.EncodeToString(hash[:])[:messageHashLength]
+}
+
+// setLastError saves an error of op into the last error annotation of va.
+// It counts the error as a repetition of the previous one when the
+// operation, code and message are the same.
+func setLastError(va *storage.VolumeAttachment, op, message string, now metav1.Time) {
+	lastError := LastError{
+		Operation:   op,
+		Code:        ErrorClass(message),
+		MessageHash: messageHash(message),
+		FirstSeen:   now,
+		LastSeen:    now,
+		Count:       1,
+	}
+	var previous LastError
+	if value, found := va.Annotations[LastErrorAnnotation]; found {
+		if err := json.Unmarshal([]byte(value), &previous); err != nil {
+			klog.V(4).Infof("Ignoring invalid %s annotation of %q: %s", LastErrorAnnotation, va.Name, err)
+		} else if previous.Operation == lastError.Operation && previous.Code == lastError.Code && previous.MessageHash == lastError.MessageHash {
+			lastError.FirstSeen = previous.FirstSeen
+			lastError.Count = previous.Count + 1
+		}
+	}
+
+	value, err := json.Marshal(lastError)
+	if err != nil {
+		// Cannot happen, the struct has only strings, times and numbers.
+		klog.Errorf("Failed to encode last error of %q: %s", va.Name, err)
+		return
+	}
+	if va.Annotations == nil {
+		va.Annotations = map[string]string{}
+	}
+	va.Annotations[LastErrorAnnotation] = string(value)
+}
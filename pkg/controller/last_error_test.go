@@ -0,0 +1,85 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSetLastError(t *testing.T) {
+	timeout := "rpc error: code = DeadlineExceeded desc = context deadline exceeded"
+	t1 := metav1.NewTime(time.Date(2019, 10, 14, 12, 0, 0, 0, time.UTC))
+	t2 := metav1.NewTime(t1.Add(time.Minute))
+	t3 := metav1.NewTime(t1.Add(2 * time.Minute))
+
+	obj := va(false, "", nil)
+	setLastError(obj, "attach", timeout, t1)
+	setLastError(obj, "attach", timeout, t2)
+	expected := `{"operation":"attach","code":"DeadlineExceeded","messageHash":"` + messageHash(timeout) + `","firstSeen":"2019-10-14T12:00:00Z","lastSeen":"2019-10-14T12:01:00Z","count":2}`
+	if value := obj.Annotations[LastErrorAnnotation]; value != expected {
+		t.Errorf("expected annotation %s, got %s", expected, value)
+	}
+
+	// A different error starts a new count.
+	setLastError(obj, "detach", timeout, t3)
+	var lastError LastError
+	if err := json.Unmarshal([]byte(obj.Annotations[LastErrorAnnotation]), &lastError); err != nil {
+		t.Fatalf("invalid annotation: %v", err)
+	}
+	if lastError.Operation != "detach" || lastError.Count != 1 || !lastError.FirstSeen.Equal(&t3) {
+		t.Errorf("expected a new detach error, got %+v", lastError)
+	}
+
+	// Invalid annotations are overwritten.
+	obj.Annotations[LastErrorAnnotation] = "{"
+	setLastError(obj, "attach", "missing NodeID", t1)
+	if err := json.Unmarshal([]byte(obj.Annotations[LastErrorAnnotation]), &lastError); err != nil {
+		t.Fatalf("invalid annotation: %v", err)
+	}
+	if lastError.Code != otherErrorClass || lastError.Count != 1 {
+		t.Errorf("expected a new error, got %+v", lastError)
+	}
+}
+
+func TestSaveAttachErrorLastErrorAnnotation(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		obj := va(false, "", nil)
+		now := time.Date(2019, 10, 14, 12, 0, 0, 0, time.UTC)
+		h := &csiHandler{
+			client:              fake.NewSimpleClientset(obj),
+			lastErrorAnnotation: enabled,
+			clock:               clock.NewFakeClock(now),
+		}
+		saved, err := h.saveAttachError(obj, errors.New("rpc error: code = Internal desc = failed"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, found := saved.Annotations[LastErrorAnnotation]; found != enabled {
+			t.Errorf("enabled=%v: unexpected annotations %v", enabled, saved.Annotations)
+		}
+		if saved.Status.AttachError == nil || !saved.Status.AttachError.Time.Time.Equal(now) {
+			t.Errorf("enabled=%v: expected attach error at %s in status, got %+v", enabled, now, saved.Status.AttachError)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"github.com/kubernetes-csi/external-attacher/pkg/metrics"
+)
+
+const (
+	resourceVolumeAttachments = "volumeattachments"
+	resourcePersistentVolumes = "persistentvolumes"
+)
+
+var (
+	// apiThrottledTotal counts work items that were postponed because the
+	// API server responded with 429 Too Many Requests.
+	apiThrottledTotal = metrics.NewCounterVec(
+		metrics.Namespace+"_apiserver_throttled_total",
+		"Number of work items postponed because the API server asked the attacher to retry after a delay.",
+		"resource")
+
+	// apiRequestErrorsTotal counts failed API server requests.
+	apiRequestErrorsTotal = metrics.NewCounterVec(
+		metrics.Namespace+"_apiserver_request_errors_total",
+		"Number of failed API server requests, partitioned by HTTP method and status code (\"timeout\" when the request timed out without a response, \"error\" when no response was received for other reasons).",
+		"method", "code")
+
+	// apiWriteQPSLimit is the current limit of API server writes per second.
+	apiWriteQPSLimit = metrics.NewGaugeVec(
+		metrics.Namespace+"_apiserver_write_qps_limit",
+		"Current limit of API server writes per second, lowered when the API server is unhealthy.")
+
+	// stuckVolumeAttachments is the number of VolumeAttachments that wait
+	// for attach longer than the stuck attach threshold.
+	stuckVolumeAttachments = metrics.NewGaugeVec(
+		metrics.Namespace+"_stuck_volumeattachments",
+		"Number of VolumeAttachments that are not attached and not deleted longer than the stuck attach threshold.",
+		"driver")
+
+	// slowOperationsTotal counts ControllerPublish and ControllerUnpublish
+	// calls that succeeded after the slow operation threshold.
+	slowOperationsTotal = metrics.NewCounterVec(
+		metrics.Namespace+"_slow_operations_total",
+		"Number of successful ControllerPublish (operation=\"attach\") and ControllerUnpublish (operation=\"detach\") calls that took longer than the slow operation threshold, partitioned by driver.",
+		"driver", "operation")
+
+	// operationDuration is the duration of ControllerPublish and
+	// ControllerUnpublish calls.
+	operationDuration = metrics.NewHistogramVec(
+		metrics.Namespace+"_operation_duration_seconds",
+		"Duration of ControllerPublish (operation=\"attach\") and ControllerUnpublish (operation=\"detach\") calls, partitioned by driver, StorageClass of the volume and result (\"success\" or \"error\").",
+		metrics.DefBuckets,
+		"driver", "storageclass", "operation", "result")
+
+	// attachPhaseDuration observes phases of attaches.
+	attachPhaseDuration = metrics.NewHistogramVec(
+		metrics.Namespace+"_attach_phase_duration_seconds",
+		"Duration of phases of attaches (phase=\"resolve_pv\", \"resolve_node\", \"add_finalizers\", \"publish\" or \"write_status\"), partitioned by driver and result (\"success\" or \"error\"). An attach stops at the first failed phase.",
+		metrics.DefBuckets,
+		"driver", "phase", "result")
+
+	// detachLatency observes time from deletion of VolumeAttachments to
+	// removal of their finalizer.
+	detachLatency = metrics.NewHistogramVec(
+		metrics.Namespace+"_detach_latency_seconds",
+		"Time from deletionTimestamp of VolumeAttachments of the driver to removal of their finalizer after a successful detach, partitioned by error class of the last failed detach before it (\"OK\" when none failed).",
+		[]float64{1, 5, 10, 30, 60, 120, 300, 600, 1200, 1800, 3600},
+		"driver", "last_error")
+
+	// pipelineQueueLength is the number of VolumeAttachments waiting for
+	// each stage of processing with API writers.
+	pipelineQueueLength = metrics.NewGaugeVec(
+		metrics.Namespace+"_pipeline_queue_length",
+		"Number of VolumeAttachments of the driver waiting for a stage of processing with API writers: stage=\"csi\" for CSI calls by the VolumeAttachment workers and stage=\"api_write\" for saving their results by the API writers.",
+		"driver", "stage")
+
+	// apiWriteQueueWait observes how long results of CSI calls wait for an
+	// API writer.
+	apiWriteQueueWait = metrics.NewHistogramVec(
+		metrics.Namespace+"_api_write_queue_wait_seconds",
+		"Time results of ControllerPublish and ControllerUnpublish calls of the driver waited for an API writer.",
+		metrics.DefBuckets,
+		"driver")
+
+	// republishSkippedTotal counts skipped ControllerPublish calls of
+	// attached volumes whose inputs did not change.
+	republishSkippedTotal = metrics.NewCounterVec(
+		metrics.Namespace+"_republish_skipped_total",
+		"Number of ControllerPublish calls of attached volumes of the driver skipped because their inputs did not change since the last call.",
+		"driver")
+
+	// operationErrorsTotal counts failed ControllerPublish and
+	// ControllerUnpublish calls.
+	operationErrorsTotal = metrics.NewCounterVec(
+		metrics.Namespace+"_operation_errors_total",
+		"Number of failed ControllerPublishVolume and ControllerUnpublishVolume calls, partitioned by CSI method and gRPC status code, e.g. \"DeadlineExceeded\", \"InvalidArgument\" or \"ResourceExhausted\".",
+		"method", "grpc_code")
+
+	// endpointFailoversTotal counts switches between the primary and the
+	// backup CSI endpoint of a driver.
+	endpointFailoversTotal = metrics.NewCounterVec(
+		metrics.Namespace+"_csi_endpoint_failovers_total",
+		"Number of switches of the driver connection to its other CSI endpoint, by the endpoint that is active after the switch.",
+		"driver", "endpoint")
+
+	// circuitBreakerOpen is 1 while the circuit breaker of a driver is
+	// open.
+	circuitBreakerOpen = metrics.NewGaugeVec(
+		metrics.Namespace+"_circuit_breaker_open",
+		"1 while ControllerPublish and ControllerUnpublish calls of the driver are paused by the circuit breaker, 0 otherwise.",
+		"driver")
+
+	// workerThreads is the number of VolumeAttachment workers allowed to
+	// run at the same time by the worker scaler.
+	workerThreads = metrics.NewGaugeVec(
+		metrics.Namespace+"_worker_threads",
+		"Number of VolumeAttachment workers of the driver allowed to process objects at the same time, scaled between -worker-threads and -max-worker-threads.",
+		"driver")
+
+	// workqueueStallsTotal counts detected stalls of the workers.
+	workqueueStallsTotal = metrics.NewCounterVec(
+		metrics.Namespace+"_workqueue_stalls_total",
+		"Number of times objects were queued, but no worker of the driver processed any object for longer than the stall threshold.",
+		"driver")
+
+	// quotaExceededTotal counts attaches that wait because they would
+	// exceed an attach quota.
+	quotaExceededTotal = metrics.NewCounterVec(
+		metrics.Namespace+"_attach_quota_exceeded_total",
+		"Number of attaches postponed because they would exceed an attach quota, partitioned by driver, kind (\"storageclass\" or \"namespace\") and name of the quota.",
+		"driver", "kind", "name")
+
+	// driverNotRegisteredTotal is the number of attaches and detaches
+	// postponed because the driver is not registered on the node.
+	driverNotRegisteredTotal = metrics.NewCounterVec(
+		metrics.Namespace+"_driver_not_registered_total",
+		"Number of attaches (operation=\"attach\") and detaches (operation=\"detach\") postponed because the CSI driver is not registered on the node yet, partitioned by driver.",
+		"driver", "operation")
+
+	// nodeIDChangedTotal is the number of attaches and detaches that found
+	// a volume published to an old ID of its node.
+	nodeIDChangedTotal = metrics.NewCounterVec(
+		metrics.Namespace+"_node_id_changed_total",
+		"Number of attaches (operation=\"attach\") and detaches (operation=\"detach\") that detached a volume from an old ID of its node after the CSI driver registered the node with a new ID, partitioned by driver.",
+		"driver", "operation")
+
+	// driftRepairedTotal is the number of VolumeAttachments whose status
+	// disagreed with the CSI driver and was corrected.
+	driftRepairedTotal = metrics.NewCounterVec(
+		metrics.Namespace+"_drift_repaired_total",
+		"Number of VolumeAttachments whose status disagreed with the CSI driver and was corrected, partitioned by driver and operation.",
+		"driver", "operation")
+
+	// nodeSoftLimitExceededTotal counts attaches after which a node has
+	// more volumes attached than the soft limit.
+	nodeSoftLimitExceededTotal = metrics.NewCounterVec(
+		metrics.Namespace+"_node_attach_soft_limit_exceeded_total",
+		"Number of successful attaches after which the node has more volumes of the CSI driver attached than the soft limit, partitioned by driver.",
+		"driver")
+)
+
+func init() {
+	metrics.MustRegister(apiThrottledTotal, apiRequestErrorsTotal, apiWriteQPSLimit, stuckVolumeAttachments, slowOperationsTotal, operationDuration, attachPhaseDuration, attachSLIAttempts, attachSLIRatio, detachLatency, pipelineQueueLength, apiWriteQueueWait, republishSkippedTotal, operationErrorsTotal, endpointFailoversTotal, circuitBreakerOpen, workerThreads, workqueueStallsTotal, quotaExceededTotal, driverNotRegisteredTotal, nodeIDChangedTotal, driftRepairedTotal, nodeSoftLimitExceededTotal)
+}
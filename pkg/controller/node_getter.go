@@ -0,0 +1,91 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+)
+
+// onDemandNodeLister is a NodeLister that gets Nodes from the API server
+// instead of an informer, so the attacher needs only permission to get
+// Nodes and does not keep all Nodes of the cluster in memory. The handler
+// gets a Node only when it looks for an ID of the node.
+type onDemandNodeLister struct {
+	client kubernetes.Interface
+}
+
+var _ corelisters.NodeLister = &onDemandNodeLister{}
+
+func (l *onDemandNodeLister) List(selector labels.Selector) ([]*v1.Node, error) {
+	list, err := l.client.CoreV1().Nodes().List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]*v1.Node, 0, len(list.Items))
+	for i := range list.Items {
+		nodes = append(nodes, &list.Items[i])
+	}
+	return nodes, nil
+}
+
+func (l *onDemandNodeLister) ListWithPredicate(predicate corelisters.NodeConditionPredicate) ([]*v1.Node, error) {
+	nodes, err := l.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var filtered []*v1.Node
+	for _, node := range nodes {
+		if predicate(node) {
+			filtered = append(filtered, node)
+		}
+	}
+	return filtered, nil
+}
+
+func (l *onDemandNodeLister) Get(name string) (*v1.Node, error) {
+	return l.client.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+}
+
+// onDemandCSINodeLister is a CSINodeLister that gets CSINodes from the API
+// server, like onDemandNodeLister.
+type onDemandCSINodeLister struct {
+	client kubernetes.Interface
+}
+
+var _ storagelisters.CSINodeLister = &onDemandCSINodeLister{}
+
+func (l *onDemandCSINodeLister) List(selector labels.Selector) ([]*storage.CSINode, error) {
+	list, err := l.client.StorageV1beta1().CSINodes().List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	csiNodes := make([]*storage.CSINode, 0, len(list.Items))
+	for i := range list.Items {
+		csiNodes = append(csiNodes, &list.Items[i])
+	}
+	return csiNodes, nil
+}
+
+func (l *onDemandCSINodeLister) Get(name string) (*storage.CSINode, error) {
+	return l.client.StorageV1beta1().CSINodes().Get(name, metav1.GetOptions{})
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestOnDemandNodeListers(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2"}},
+		&storage.CSINode{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+	)
+	nodeLister := &onDemandNodeLister{client: client}
+	csiNodeLister := &onDemandCSINodeLister{client: client}
+
+	node, err := nodeLister.Get("node1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if node.Name != "node1" {
+		t.Errorf("expected node1, got %s", node.Name)
+	}
+	if _, err := nodeLister.Get("node3"); !apierrors.IsNotFound(err) {
+		t.Errorf("expected NotFound, got %v", err)
+	}
+	nodes, err := nodeLister.List(labels.Everything())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(nodes) != 2 {
+		t.Errorf("expected 2 nodes, got %d", len(nodes))
+	}
+	nodes, err = nodeLister.ListWithPredicate(func(node *v1.Node) bool { return node.Name == "node2" })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(nodes) != 1 || nodes[0].Name != "node2" {
+		t.Errorf("expected node2, got %v", nodes)
+	}
+
+	if _, err := csiNodeLister.Get("node1"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := csiNodeLister.Get("node2"); !apierrors.IsNotFound(err) {
+		t.Errorf("expected NotFound, got %v", err)
+	}
+	csiNodes, err := csiNodeLister.List(labels.Everything())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(csiNodes) != 1 {
+		t.Errorf("expected 1 CSINode, got %d", len(csiNodes))
+	}
+}
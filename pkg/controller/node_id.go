@@ -0,0 +1,75 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxNodeIDLength is the maximum size of a node ID in bytes allowed by the
+// CSI spec.
+const maxNodeIDLength = 256
+
+// invalidNodeIDError is returned when the node ID published by a driver
+// can't be passed to ControllerPublish or ControllerUnpublish.
+type invalidNodeIDError struct {
+	msg string
+}
+
+func (e *invalidNodeIDError) Error() string {
+	return e.msg
+}
+
+// isInvalidNodeID returns true when an operation failed because of an
+// invalid node ID.
+func isInvalidNodeID(err error) bool {
+	for _, e := range errorChain(err) {
+		if _, ok := e.(*invalidNodeIDError); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validateNodeID returns invalidNodeIDError when nodeID of nodeName in
+// driver is empty, longer than the CSI spec allows, is not valid UTF-8 or
+// contains control characters. Such IDs come from a broken driver or a
+// corrupted CSINode or annotation.
+func validateNodeID(driver, nodeName, nodeID string) error {
+	problem := ""
+	switch {
+	case nodeID == "":
+		problem = "it is empty"
+	case len(nodeID) > maxNodeIDLength:
+		problem = fmt.Sprintf("it has %d bytes, the CSI spec allows at most %d", len(nodeID), maxNodeIDLength)
+	case !utf8.ValidString(nodeID):
+		problem = fmt.Sprintf("%q is not valid UTF-8", nodeID)
+	default:
+		for _, r := range nodeID {
+			if unicode.IsControl(r) {
+				problem = fmt.Sprintf("%q contains control characters", nodeID)
+				break
+			}
+		}
+	}
+	if problem == "" {
+		return nil
+	}
+	return &invalidNodeIDError{msg: fmt.Sprintf("invalid ID of node %s in CSI driver %s: %s", nodeName, driver, problem)}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/klog"
+)
+
+// changedNodeID returns the node ID that ControllerPublish of va used, when
+// it differs from nodeID, the current ID of the node in the driver. The node
+// registered again with a new ID, e.g. after it was re-imaged, and the volume
+// is still published to the old ID. The change is reported by a warning event
+// and metric.
+func (h *csiHandler) changedNodeID(va *storage.VolumeAttachment, op, nodeID string) (string, bool, error) {
+	oldID, found := va.Annotations[vaNodeIDAnnotation]
+	if !found || oldID == nodeID || !h.hasVAFinalizer(va) {
+		return "", false, nil
+	}
+	if err := validateNodeID(h.attacherName, va.Spec.NodeName, oldID); err != nil {
+		return "", false, err
+	}
+	nodeIDChangedTotal.WithLabelValues(h.attacherName, op).Inc()
+	klog.Warningf("ID of node %q in CSI driver %q changed from %q to %q, detaching %q from the old ID", va.Spec.NodeName, h.attacherName, oldID, nodeID, va.Name)
+	h.recordEvent(va, v1.EventTypeWarning, NodeIDChanged, "ID of node %s in CSI driver %s changed from %s to %s, detaching volume from the old ID", va.Spec.NodeName, h.attacherName, oldID, nodeID)
+	return oldID, true, nil
+}
+
+// nodeIDChanged returns true when va is attached to a node ID that is not the
+// current ID of its node. Errors of getting the current ID are left to the
+// attach.
+func (h *csiHandler) nodeIDChanged(va *storage.VolumeAttachment) bool {
+	oldID, found := va.Annotations[vaNodeIDAnnotation]
+	if !found {
+		return false
+	}
+	nodeID, err := h.getNodeID(h.attacherName, va.Spec.NodeName, nil)
+	return err == nil && nodeID != oldID
+}
+
+// detachFromChangedNodeID calls ControllerUnpublish of volumeHandle with the
+// old node ID when the ID of the node of va changed, so the attach publishes
+// the volume again with nodeID. pv is the PV of the volume, nil for inline
+// volumes. It returns va with nodeID in its annotation
+// and without attached status, so a failed attach is retried.
+func (h *csiHandler) detachFromChangedNodeID(va *storage.VolumeAttachment, pv *v1.PersistentVolume, volumeHandle, nodeID string, secrets map[string]string) (*storage.VolumeAttachment, error) {
+	oldID, changed, err := h.changedNodeID(va, "attach", nodeID)
+	if err != nil || !changed {
+		return va, err
+	}
+
+	// NOT_FOUND: the old node does not exist in the storage backend, the
+	// volume can't be published to it.
+	if _, err := h.controllerUnpublish(va, pv, volumeHandle, oldID, secrets); err != nil && status.Code(err) != codes.NotFound {
+		return va, wrapError("could not detach volume from old node ID "+oldID, err)
+	}
+	klog.V(2).Infof("Detached %q from old node ID %q", va.Name, oldID)
+
+	clone := va.DeepCopy()
+	clone.Annotations[vaNodeIDAnnotation] = nodeID
+	clone.Status.Attached = false
+	clone.Status.AttachmentMetadata = nil
+	newVA, err := h.patchVA(va, clone)
+	if err != nil {
+		return va, wrapError("could not save VolumeAttachment", err)
+	}
+	return newVA, nil
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	core "k8s.io/client-go/testing"
+)
+
+func TestCSIHandlerNodeIDChanged(t *testing.T) {
+	vaGroupResourceVersion := schema.GroupVersionResource{
+		Group:    storage.GroupName,
+		Version:  "v1beta1",
+		Resource: "volumeattachments",
+	}
+	var noMetadata map[string]string
+	var noAttrs map[string]string
+	var noSecrets map[string]string
+	var success error
+	var readWrite = false
+	var notDetached = false
+	var ignored = false // the value is irrelevant for given call
+	oldAnn := map[string]string{vaNodeIDAnnotation: "oldNodeID"}
+	detachErr := "could not detach volume from old node ID oldNodeID: rpc error: code = Internal desc = backend unavailable"
+
+	tests := []testCase{
+		{
+			name:           "attached VolumeAttachment with changed node ID -> detached from old ID and attached to new ID",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        va(true, fin, oldAnn),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(true, fin, oldAnn),
+						va(false, fin, ann))),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false, fin, ann),
+						va(true, fin, ann))),
+			},
+			expectedCSICalls: []csiCall{
+				{"detach", testVolumeHandle, "oldNodeID", noAttrs, noSecrets, readWrite, success, ignored, noMetadata, 0},
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, noMetadata, 0},
+			},
+			expectedEvents: []string{
+				"Normal AttachStarted Attaching volume to node node1",
+				"Warning NodeIDChanged ID of node node1 in CSI driver csi/test changed from oldNodeID to nodeID1, detaching volume from the old ID",
+				"Normal AttachSucceeded Attached volume to node node1",
+			},
+		},
+		{
+			name:           "old node ID not found in the storage backend -> attached to new ID",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        va(true, fin, oldAnn),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(true, fin, oldAnn),
+						va(false, fin, ann))),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false, fin, ann),
+						va(true, fin, ann))),
+			},
+			expectedCSICalls: []csiCall{
+				{"detach", testVolumeHandle, "oldNodeID", noAttrs, noSecrets, readWrite, status.Error(codes.NotFound, "node not found"), ignored, noMetadata, 0},
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, noMetadata, 0},
+			},
+		},
+		{
+			name:           "detach from old node ID fails -> controller retries",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        va(true, fin, oldAnn),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(true, fin, oldAnn),
+						vaWithAttachError(va(true, fin, oldAnn), detachErr))),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(vaWithAttachError(va(true, fin, oldAnn), detachErr),
+						vaWithAttachError(va(false, fin, ann), detachErr))),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(vaWithAttachError(va(false, fin, ann), detachErr),
+						va(true, fin, ann))),
+			},
+			expectedCSICalls: []csiCall{
+				{"detach", testVolumeHandle, "oldNodeID", noAttrs, noSecrets, readWrite, status.Error(codes.Internal, "backend unavailable"), ignored, noMetadata, 0},
+				{"detach", testVolumeHandle, "oldNodeID", noAttrs, noSecrets, readWrite, success, ignored, noMetadata, 0},
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, noMetadata, 0},
+			},
+		},
+		{
+			name:           "VolumeAttachment marked for deletion with changed node ID -> detached from old ID",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        deleted(va(true, fin, oldAnn)),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(deleted(va(true, fin, oldAnn)),
+						deleted(va(false, "", oldAnn)))),
+			},
+			expectedCSICalls: []csiCall{
+				{"detach", testVolumeHandle, "oldNodeID", noAttrs, noSecrets, readWrite, success, ignored, noMetadata, 0},
+			},
+			expectedEvents: []string{
+				"Warning NodeIDChanged ID of node node1 in CSI driver csi/test changed from oldNodeID to nodeID1, detaching volume from the old ID",
+			},
+		},
+	}
+	runTests(t, csiHandlerFactory, tests)
+}
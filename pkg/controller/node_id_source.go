@@ -0,0 +1,132 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/klog"
+)
+
+// NodeIDSource selects where the CSI handler finds IDs of nodes in the
+// driver.
+type NodeIDSource string
+
+const (
+	// NodeIDFromCSINode finds node IDs in CSINode objects and, for nodes
+	// without them, in the csi.volume.kubernetes.io/nodeid annotation of
+	// Nodes. Kubelet sets both when the node plugin registers.
+	NodeIDFromCSINode NodeIDSource = "csinode"
+	// NodeIDFromAnnotation finds node IDs only in the annotation of Nodes,
+	// e.g. set by an administrator on nodes without the node plugin.
+	NodeIDFromAnnotation NodeIDSource = "annotation"
+	// NodeIDFromFile finds node IDs in a NodeIDMapping.
+	NodeIDFromFile NodeIDSource = "file"
+)
+
+// ParseNodeIDSource parses a NodeIDSource.
+func ParseNodeIDSource(source string) (NodeIDSource, error) {
+	switch s := NodeIDSource(source); s {
+	case NodeIDFromCSINode, NodeIDFromAnnotation, NodeIDFromFile:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid node ID source %q: must be %q, %q or %q", source, NodeIDFromCSINode, NodeIDFromAnnotation, NodeIDFromFile)
+}
+
+// NodeIDMapping maps node names to IDs of the nodes in the driver. The
+// mapping is a JSON object in a file, e.g. {"node1": "id-1"}. The file is
+// read again when it changes, e.g. when it's in a mounted ConfigMap; an
+// invalid new version is logged and the previous one is used.
+type NodeIDMapping struct {
+	path string
+
+	lock    sync.Mutex
+	modTime time.Time
+	ids     map[string]string
+}
+
+// NewNodeIDMapping returns a NodeIDMapping read from file path.
+func NewNodeIDMapping(path string) (*NodeIDMapping, error) {
+	m := &NodeIDMapping{path: path}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.load(info.ModTime()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Path returns the path of the mapping file.
+func (m *NodeIDMapping) Path() string {
+	return m.path
+}
+
+// Get returns the ID of node nodeName.
+func (m *NodeIDMapping) Get(nodeName string) (string, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if info, err := os.Stat(m.path); err != nil {
+		klog.Warningf("Using previous node ID mapping, can't read %s: %v", m.path, err)
+	} else if !info.ModTime().Equal(m.modTime) {
+		if err := m.load(info.ModTime()); err != nil {
+			klog.Warningf("Using previous node ID mapping: %v", err)
+		}
+	}
+	nodeID, found := m.ids[nodeName]
+	return nodeID, found
+}
+
+// load reads the mapping file, modified at modTime. m.lock must be held or
+// m not shared yet.
+func (m *NodeIDMapping) load(modTime time.Time) error {
+	data, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+	var ids map[string]string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return fmt.Errorf("invalid node ID mapping file %s: %v", m.path, err)
+	}
+	klog.V(2).Infof("Loaded IDs of %d nodes from %s", len(ids), m.path)
+	m.ids = ids
+	m.modTime = modTime
+	return nil
+}
+
+// findNodeIDInMapping returns the ID of node nodeName from nodeIDMapping.
+// Nodes removed from the mapping are detached with the ID in the annotation
+// of va.
+func (h *csiHandler) findNodeIDInMapping(nodeName string, va *storage.VolumeAttachment) (string, error) {
+	if nodeID, found := h.nodeIDMapping.Get(nodeName); found {
+		klog.V(4).Infof("Found NodeID %s of node %s in %s", nodeID, nodeName, h.nodeIDMapping.Path())
+		return nodeID, nil
+	}
+	if va != nil {
+		if nodeID, found := va.Annotations[vaNodeIDAnnotation]; found {
+			return nodeID, nil
+		}
+	}
+	return "", fmt.Errorf("node %s is not in node ID mapping file %s", nodeName, h.nodeIDMapping.Path())
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestParseNodeIDSource(t *testing.T) {
+	for _, source := range []string{"csinode", "annotation", "file"} {
+		if s, err := ParseNodeIDSource(source); err != nil || string(s) != source {
+			t.Errorf("%s: got %q, %v", source, s, err)
+		}
+	}
+	if _, err := ParseNodeIDSource("node"); err == nil {
+		t.Errorf("expected error for invalid source")
+	}
+}
+
+func TestNodeIDMapping(t *testing.T) {
+	dir, err := ioutil.TempDir("", "external-attacher-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "node-ids.json")
+	write := func(content string, modTime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+
+	if _, err := NewNodeIDMapping(path); err == nil {
+		t.Errorf("missing file: expected error, got none")
+	}
+	write("node1: id-1", now)
+	if _, err := NewNodeIDMapping(path); err == nil {
+		t.Errorf("invalid file: expected error, got none")
+	}
+
+	write(`{"node1": "id-1"}`, now)
+	m, err := NewNodeIDMapping(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id, found := m.Get("node1"); !found || id != "id-1" {
+		t.Errorf("expected id-1, got %q, %v", id, found)
+	}
+	if id, found := m.Get("node2"); found {
+		t.Errorf("expected node2 not found, got %q", id)
+	}
+
+	// Changes are loaded.
+	write(`{"node1": "id-1", "node2": "id-2"}`, now.Add(time.Minute))
+	if id, found := m.Get("node2"); !found || id != "id-2" {
+		t.Errorf("after change: expected id-2, got %q, %v", id, found)
+	}
+
+	// Invalid changes are ignored.
+	write(`{"node1": `, now.Add(2*time.Minute))
+	if id, found := m.Get("node2"); !found || id != "id-2" {
+		t.Errorf("after invalid change: expected id-2, got %q, %v", id, found)
+	}
+}
+
+func TestFindNodeIDWithSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "external-attacher-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "node-ids.json")
+	if err := ioutil.WriteFile(path, []byte(`{"node1": "fileID"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mapping, err := NewNodeIDMapping(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csiNodeWithID := csiNode()
+	csiNodeWithID.Spec.Drivers[0].NodeID = "csiNodeID"
+	annotatedVA := va(true, fin, map[string]string{vaNodeIDAnnotation: "vaID"})
+
+	tests := []struct {
+		name        string
+		source      NodeIDSource
+		nodeName    string
+		va          bool
+		expectedID  string
+		expectError bool
+	}{
+		{
+			name:       "CSINode",
+			source:     NodeIDFromCSINode,
+			nodeName:   testNodeName,
+			expectedID: "csiNodeID",
+		},
+		{
+			name:       "annotation",
+			source:     NodeIDFromAnnotation,
+			nodeName:   testNodeName,
+			expectedID: testNodeID,
+		},
+		{
+			name:       "file",
+			source:     NodeIDFromFile,
+			nodeName:   testNodeName,
+			expectedID: "fileID",
+		},
+		{
+			name:        "node not in file",
+			source:      NodeIDFromFile,
+			nodeName:    "node2",
+			expectError: true,
+		},
+		{
+			name:       "node not in file, VA annotation",
+			source:     NodeIDFromFile,
+			nodeName:   "node2",
+			va:         true,
+			expectedID: "vaID",
+		},
+	}
+	for _, test := range tests {
+		nodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		nodeIndexer.Add(node())
+		csiNodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		csiNodeIndexer.Add(csiNodeWithID)
+		h := &csiHandler{
+			nodeLister:    corelisters.NewNodeLister(nodeIndexer),
+			csiNodeLister: storagelisters.NewCSINodeLister(csiNodeIndexer),
+			nodeIDSource:  test.source,
+			nodeIDMapping: mapping,
+		}
+		attachment := annotatedVA
+		if !test.va {
+			attachment = nil
+		}
+		nodeID, err := h.getNodeID(testAttacherName, test.nodeName, attachment)
+		if test.expectError {
+			if err == nil {
+				t.Errorf("%s: expected error, got none", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if nodeID != test.expectedID {
+			t.Errorf("%s: expected node ID %q, got %q", test.name, test.expectedID, nodeID)
+		}
+	}
+}
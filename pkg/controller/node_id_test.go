@@ -0,0 +1,113 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	core "k8s.io/client-go/testing"
+)
+
+func TestValidateNodeID(t *testing.T) {
+	tests := []struct {
+		nodeID      string
+		expectedErr string
+	}{
+		{nodeID: "MyNodeID"},
+		{nodeID: "projects/p/zones/europe-west1-b/instances/node-1"},
+		{nodeID: strings.Repeat("a", 256)},
+		{
+			nodeID:      "",
+			expectedErr: "invalid ID of node node1 in CSI driver csi/test: it is empty",
+		},
+		{
+			nodeID:      strings.Repeat("a", 257),
+			expectedErr: "invalid ID of node node1 in CSI driver csi/test: it has 257 bytes, the CSI spec allows at most 256",
+		},
+		{
+			nodeID:      "node\xff",
+			expectedErr: `invalid ID of node node1 in CSI driver csi/test: "node\xff" is not valid UTF-8`,
+		},
+		{
+			nodeID:      "node-1\n",
+			expectedErr: `invalid ID of node node1 in CSI driver csi/test: "node-1\n" contains control characters`,
+		},
+	}
+	for _, test := range tests {
+		err := validateNodeID(testAttacherName, testNodeName, test.nodeID)
+		if test.expectedErr == "" {
+			if err != nil {
+				t.Errorf("%q: unexpected error: %v", test.nodeID, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.expectedErr {
+			t.Errorf("%q: expected error %q, got %v", test.nodeID, test.expectedErr, err)
+		}
+		if !isInvalidNodeID(err) {
+			t.Errorf("%q: expected invalid node ID error, got %T", test.nodeID, err)
+		}
+	}
+}
+
+func TestCSIHandlerInvalidNodeID(t *testing.T) {
+	vaGroupResourceVersion := schema.GroupVersionResource{
+		Group:    storage.GroupName,
+		Version:  "v1beta1",
+		Resource: "volumeattachments",
+	}
+	invalidCSINode := csiNode()
+	invalidCSINode.Spec.Drivers[0].NodeID = "node-1\n"
+	invalidMessage := `invalid ID of node node1 in CSI driver csi/test: "node-1\n" contains control characters`
+
+	tests := []testCase{
+		{
+			name:           "attach with invalid node ID -> error without CSI call",
+			initialObjects: []runtime.Object{pvWithFinalizer(), nodeWithoutAnnotations(), invalidCSINode},
+			addedVA:        va(false, "", nil),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, "", nil),
+						vaWithAttachError(va(false, "", nil), invalidMessage))),
+			},
+			expectedEvents: []string{
+				"Normal AttachStarted Attaching volume to node node1",
+				"Warning InvalidNodeID Failed to attach volume to node node1: " + invalidMessage,
+			},
+		},
+		{
+			name:           "detach with invalid annotated node ID -> error without CSI call",
+			initialObjects: []runtime.Object{pvWithFinalizer()},
+			addedVA:        deleted(va(true, fin, map[string]string{vaNodeIDAnnotation: strings.Repeat("a", 300)})),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(deleted(va(true, fin, map[string]string{vaNodeIDAnnotation: strings.Repeat("a", 300)})),
+						deleted(vaWithDetachError(va(true, fin, map[string]string{vaNodeIDAnnotation: strings.Repeat("a", 300)}), "invalid ID of node node1 in CSI driver csi/test: it has 300 bytes, the CSI spec allows at most 256")))),
+			},
+			expectedEvents: []string{
+				"Warning InvalidNodeID Failed to detach volume from node node1: invalid ID of node node1 in CSI driver csi/test: it has 300 bytes, the CSI spec allows at most 256",
+			},
+		},
+	}
+	runTests(t, csiHandlerFactory, tests)
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+)
+
+// checkNodeSoftLimit reports an attach of va that brought the number of
+// volumes of the driver attached to its node over the soft limit by a
+// warning event and metric. Unlike the attach limit in CSINode, the soft
+// limit does not block the attach: it gives early warning when the driver
+// reports a wrong limit and the storage backend will reject attaches soon.
+func (h *csiHandler) checkNodeSoftLimit(va *storage.VolumeAttachment) {
+	if h.nodeAttachSoftLimit <= 0 {
+		return
+	}
+	attached, err := h.attachedToNode(va)
+	if err != nil {
+		klog.Warningf("Failed to check soft attach limit of node %q: %v", va.Spec.NodeName, err)
+		return
+	}
+	if attached <= h.nodeAttachSoftLimit {
+		return
+	}
+	nodeSoftLimitExceededTotal.WithLabelValues(h.attacherName).Inc()
+	klog.Warningf("Node %q has %d volumes attached, more than the soft limit %d", va.Spec.NodeName, attached, h.nodeAttachSoftLimit)
+	h.recordEvent(va, v1.EventTypeWarning, NodeAttachSoftLimitExceeded, "Node %s has %d volumes of CSI driver %s attached, more than the soft limit %d", va.Spec.NodeName, attached, h.attacherName, h.nodeAttachSoftLimit)
+}
+
+// attachedToNode returns the number of volumes of the driver attached to the
+// node of va, including va. The informer may not show the attach of va yet.
+func (h *csiHandler) attachedToNode(va *storage.VolumeAttachment) (int, error) {
+	vas, err := h.vaLister.List(labels.Everything())
+	if err != nil {
+		return 0, err
+	}
+	finalizer := GetFinalizerName(h.attacherName)
+	attached := 1
+	for _, other := range vas {
+		if other.Name == va.Name || other.Spec.Attacher != h.attacherName || other.Spec.NodeName != va.Spec.NodeName {
+			continue
+		}
+		if other.Status.Attached || hasFinalizer(other.Finalizers, finalizer) {
+			attached++
+		}
+	}
+	return attached, nil
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	storage "k8s.io/api/storage/v1beta1"
+	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestCheckNodeSoftLimit(t *testing.T) {
+	attached := createVolumeAttachment(testAttacherName, "pv1", testNodeName, true, fin, nil)
+	attaching := createVolumeAttachment(testAttacherName, "pv2", testNodeName, false, fin, nil)
+	notAttached := createVolumeAttachment(testAttacherName, "pv3", testNodeName, false, "", nil)
+	otherNode := createVolumeAttachment(testAttacherName, "pv4", "node2", true, fin, nil)
+	otherDriver := createVolumeAttachment("csi/other", "pv5", testNodeName, true, "external-attacher/csi-other", nil)
+	va := createVolumeAttachment(testAttacherName, "pv6", testNodeName, false, "", nil)
+
+	tests := []struct {
+		name          string
+		limit         int
+		vas           []*storage.VolumeAttachment
+		expectedEvent string
+	}{
+		{
+			name:  "disabled",
+			limit: 0,
+			vas:   []*storage.VolumeAttachment{attached, attaching},
+		},
+		{
+			name:  "at the limit",
+			limit: 3,
+			vas:   []*storage.VolumeAttachment{attached, attaching, notAttached, otherNode, otherDriver},
+		},
+		{
+			name:          "over the limit",
+			limit:         2,
+			vas:           []*storage.VolumeAttachment{attached, attaching, notAttached, otherNode, otherDriver, va},
+			expectedEvent: "Warning NodeAttachSoftLimitExceeded Node node1 has 3 volumes of CSI driver csi/test attached, more than the soft limit 2",
+		},
+	}
+	for _, test := range tests {
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		for _, va := range test.vas {
+			indexer.Add(va)
+		}
+		recorder := newAnnotatedRecorder(10)
+		h := &csiHandler{
+			attacherName:        testAttacherName,
+			vaLister:            storagelisters.NewVolumeAttachmentLister(indexer),
+			eventRecorder:       recorder,
+			nodeAttachSoftLimit: test.limit,
+		}
+		h.checkNodeSoftLimit(va)
+
+		var event string
+		select {
+		case event = <-recorder.Events:
+		default:
+		}
+		if event != test.expectedEvent {
+			t.Errorf("%s: expected event %q, got %q", test.name, test.expectedEvent, event)
+		}
+	}
+}
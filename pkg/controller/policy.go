@@ -0,0 +1,78 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/policy"
+)
+
+// checkPolicy asks the policy webhook whether op of va may proceed. It
+// returns an error when the operation is denied or deferred, or when the
+// webhook failed. pv is nil for inline volumes.
+func (h *csiHandler) checkPolicy(va *storage.VolumeAttachment, op string, pv *v1.PersistentVolume, csiSource *v1.CSIPersistentVolumeSource, nodeID string) error {
+	if h.policy == nil {
+		return nil
+	}
+	review := &policy.Review{
+		Operation:        op,
+		Driver:           h.attacherName,
+		VolumeAttachment: va.Name,
+		VolumeHandle:     csiSource.VolumeHandle,
+		ReadOnly:         csiSource.ReadOnly,
+		VolumeAttributes: csiSource.VolumeAttributes,
+		Node: policy.Node{
+			Name: va.Spec.NodeName,
+			ID:   nodeID,
+		},
+	}
+	if pv != nil {
+		review.PersistentVolume = &policy.PersistentVolume{
+			Name:             pv.Name,
+			Labels:           pv.Labels,
+			StorageClassName: pv.Spec.StorageClassName,
+		}
+		if claim := pv.Spec.ClaimRef; claim != nil {
+			review.PersistentVolume.ClaimNamespace = claim.Namespace
+			review.PersistentVolume.ClaimName = claim.Name
+		}
+	}
+	if node, err := h.nodeLister.Get(va.Spec.NodeName); err == nil {
+		review.Node.Labels = node.Labels
+	}
+
+	ctx := withCorrelationID(context.Background(), h.correlationID(va))
+	decision, err := h.policy.Check(ctx, review)
+	if err != nil {
+		return err
+	}
+	switch decision.Decision {
+	case policy.Deny:
+		return fmt.Errorf("%s denied by policy webhook: %s", op, decision.Reason)
+	case policy.Defer:
+		return &deferredError{
+			msg:        fmt.Sprintf("%s deferred by policy webhook: %s", op, decision.Reason),
+			retryAfter: decision.RetryAfter(),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
+	"github.com/kubernetes-csi/external-attacher/pkg/policy"
+)
+
+// fakePolicy returns decision for all reviews and remembers them.
+type fakePolicy struct {
+	decision *policy.Decision
+	err      error
+
+	lock    sync.Mutex
+	reviews []*policy.Review
+}
+
+func (p *fakePolicy) Check(ctx context.Context, review *policy.Review) (*policy.Decision, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.reviews = append(p.reviews, review)
+	return p.decision, p.err
+}
+
+func policyHandlerFactory(checker policy.Checker) handlerFactory {
+	return func(client kubernetes.Interface, informerFactory informers.SharedInformerFactory, csi attacher.Attacher) Handler {
+		handler := csiHandlerFactory(client, informerFactory, csi)
+		handler.(*csiHandler).policy = checker
+		return handler
+	}
+}
+
+func TestCSIHandlerPolicy(t *testing.T) {
+	vaGroupResourceVersion := schema.GroupVersionResource{
+		Group:    storage.GroupName,
+		Version:  "v1beta1",
+		Resource: "volumeattachments",
+	}
+	var noMetadata map[string]string
+	var noAttrs map[string]string
+	var noSecrets map[string]string
+	var notDetached = false
+	var success error
+	var readWrite = false
+
+	runTests(t, policyHandlerFactory(&fakePolicy{decision: &policy.Decision{Decision: policy.Allow}}), []testCase{
+		{
+			name:           "allowed attach -> successful attachment",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        va(false, "", nil),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, "", nil), va(false /*attached*/, fin, ann))),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, fin, ann), va(true /*attached*/, fin, ann))),
+			},
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, noMetadata, 0},
+			},
+		},
+	})
+	runTests(t, policyHandlerFactory(&fakePolicy{decision: &policy.Decision{Decision: policy.Deny, Reason: "no unencrypted volumes"}}), []testCase{
+		{
+			name:           "denied attach -> error without CSI call",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        va(false, "", nil),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, "", nil),
+						vaWithAttachError(va(false, "", nil), "attach denied by policy webhook: no unencrypted volumes"))),
+			},
+			expectedCSICalls: []csiCall{},
+		},
+		{
+			name:           "denied detach -> error without CSI call",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        deleted(va(true, fin, ann)),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(deleted(va(true, fin, ann)),
+						deleted(vaWithDetachError(va(true, fin, ann), "detach denied by policy webhook: no unencrypted volumes")))),
+			},
+			expectedCSICalls: []csiCall{},
+		},
+	})
+	runTests(t, policyHandlerFactory(&fakePolicy{decision: &policy.Decision{Decision: policy.Defer, Reason: "node is draining"}}), []testCase{
+		{
+			name:             "deferred attach -> no error and no CSI call",
+			initialObjects:   []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:          va(false, "", nil),
+			expectedActions:  []core.Action{},
+			expectedCSICalls: []csiCall{},
+		},
+	})
+	runTests(t, policyHandlerFactory(&fakePolicy{err: errors.New("policy webhook failed: timeout")}), []testCase{
+		{
+			name:           "failed webhook -> error without CSI call",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        va(false, "", nil),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, "", nil),
+						vaWithAttachError(va(false, "", nil), "policy webhook failed: timeout"))),
+			},
+			expectedCSICalls: []csiCall{},
+		},
+	})
+}
+
+func TestCheckPolicyReview(t *testing.T) {
+	checker := &fakePolicy{decision: &policy.Decision{Decision: policy.Defer, RetryAfterSeconds: 5}}
+	pv := pvWithAttributes(pv(), map[string]string{"encrypted": "false"})
+	pv.Labels = map[string]string{"tier": "gold"}
+	pv.Spec.StorageClassName = "fast"
+	pv.Spec.ClaimRef = &v1.ObjectReference{Namespace: "ns1", Name: "claim1"}
+	n := node()
+	n.Labels = map[string]string{"zone": "a"}
+	h := &csiHandler{attacherName: testAttacherName, policy: checker, nodeLister: &onDemandNodeLister{client: fake.NewSimpleClientset(n)}}
+
+	err := h.checkPolicy(va(false, "", nil), policy.OperationAttach, pv, pv.Spec.CSI, testNodeID)
+	if delay, deferred := getDeferral(wrapError("failed to attach", err)); !deferred || delay != 5*time.Second {
+		t.Errorf("expected deferral by 5s, got %v", err)
+	}
+	if len(checker.reviews) != 1 {
+		t.Fatalf("expected 1 review, got %d", len(checker.reviews))
+	}
+	review := checker.reviews[0]
+	if review.Operation != policy.OperationAttach || review.Driver != testAttacherName || review.VolumeHandle != testVolumeHandle {
+		t.Errorf("unexpected review %+v", review)
+	}
+	if review.VolumeAttributes["encrypted"] != "false" {
+		t.Errorf("expected volume attributes, got %v", review.VolumeAttributes)
+	}
+	expectedPV := policy.PersistentVolume{Name: testPVName, Labels: map[string]string{"tier": "gold"}, StorageClassName: "fast", ClaimNamespace: "ns1", ClaimName: "claim1"}
+	if review.PersistentVolume == nil || review.PersistentVolume.Name != expectedPV.Name || review.PersistentVolume.Labels["tier"] != "gold" ||
+		review.PersistentVolume.StorageClassName != expectedPV.StorageClassName || review.PersistentVolume.ClaimNamespace != expectedPV.ClaimNamespace || review.PersistentVolume.ClaimName != expectedPV.ClaimName {
+		t.Errorf("expected PV %+v, got %+v", expectedPV, review.PersistentVolume)
+	}
+	if review.Node.Name != testNodeName || review.Node.ID != testNodeID || review.Node.Labels["zone"] != "a" {
+		t.Errorf("unexpected node %+v", review.Node)
+	}
+}
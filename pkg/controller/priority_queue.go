@@ -0,0 +1,230 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+// priorityQueue is a rate limiting work queue that hands out items by their
+// priority level, lower levels first, and items of the same level in the
+// order they were added. Like the queues of client-go, it holds each item
+// only once and never hands out an item that is being processed. Priority
+// of an item is decided when it's added. Adding a queued item that got a
+// lower level moves it ahead.
+type priorityQueue struct {
+	rateLimiter workqueue.RateLimiter
+	priority    func(item interface{}) int
+
+	lock sync.Mutex
+	cond *sync.Cond
+	// levels are queued items of each priority level in the order they are
+	// handed out.
+	levels [][]interface{}
+	// dirty are items that need processing, with their level.
+	dirty map[interface{}]int
+	// processing are items handed out and not done yet.
+	processing map[interface{}]bool
+	// waiting are items added by AddAfter that wait for their delay, each
+	// with a single timer.
+	waiting      map[interface{}]*waitingItem
+	shuttingDown bool
+}
+
+// waitingItem is an item waiting in priorityQueue for its delay.
+type waitingItem struct {
+	readyAt time.Time
+	timer   *time.Timer
+}
+
+var _ workqueue.RateLimitingInterface = &priorityQueue{}
+
+// newPriorityQueue returns a queue with the given number of levels. priority
+// must return a level from 0 to levels-1.
+func newPriorityQueue(rateLimiter workqueue.RateLimiter, levels int, priority func(item interface{}) int) *priorityQueue {
+	q := &priorityQueue{
+		rateLimiter: rateLimiter,
+		priority:    priority,
+		levels:      make([][]interface{}, levels),
+		dirty:       map[interface{}]int{},
+		processing:  map[interface{}]bool{},
+		waiting:     map[interface{}]*waitingItem{},
+	}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+func (q *priorityQueue) Add(item interface{}) {
+	// Outside of the lock, priority may read listers.
+	level := q.priority(item)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.shuttingDown {
+		return
+	}
+	if oldLevel, found := q.dirty[item]; found {
+		if level < oldLevel {
+			q.dirty[item] = level
+			if !q.processing[item] {
+				q.levels[oldLevel] = removeItem(q.levels[oldLevel], item)
+				q.levels[level] = append(q.levels[level], item)
+			}
+		}
+		return
+	}
+	q.dirty[item] = level
+	if q.processing[item] {
+		// Done queues it.
+		return
+	}
+	q.push(item, level)
+}
+
+// push queues item. It must be called with q.lock held.
+func (q *priorityQueue) push(item interface{}, level int) {
+	q.levels[level] = append(q.levels[level], item)
+	q.cond.Signal()
+}
+
+// removeItem returns items without item.
+func removeItem(items []interface{}, item interface{}) []interface{} {
+	for i := range items {
+		if items[i] == item {
+			return append(items[:i], items[i+1:]...)
+		}
+	}
+	return items
+}
+
+// len returns the number of queued items. It must be called with q.lock
+// held.
+func (q *priorityQueue) len() int {
+	count := 0
+	for _, items := range q.levels {
+		count += len(items)
+	}
+	return count
+}
+
+func (q *priorityQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.len()
+}
+
+func (q *priorityQueue) Get() (interface{}, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for q.len() == 0 && !q.shuttingDown {
+		q.cond.Wait()
+	}
+	for level, items := range q.levels {
+		if len(items) == 0 {
+			continue
+		}
+		item := items[0]
+		q.levels[level] = items[1:]
+		q.processing[item] = true
+		delete(q.dirty, item)
+		return item, false
+	}
+	// Shutting down and empty.
+	return nil, true
+}
+
+func (q *priorityQueue) Done(item interface{}) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.processing, item)
+	if level, found := q.dirty[item]; found {
+		q.push(item, level)
+	}
+}
+
+func (q *priorityQueue) ShutDown() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.shuttingDown = true
+	for item, w := range q.waiting {
+		w.timer.Stop()
+		delete(q.waiting, item)
+	}
+	q.cond.Broadcast()
+}
+
+func (q *priorityQueue) ShuttingDown() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.shuttingDown
+}
+
+// AddAfter adds item after delay. Like the delaying queue of client-go, an
+// item that is already waiting is added at the earlier of both times.
+func (q *priorityQueue) AddAfter(item interface{}, delay time.Duration) {
+	if q.ShuttingDown() {
+		return
+	}
+	if delay <= 0 {
+		q.Add(item)
+		return
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.shuttingDown {
+		return
+	}
+	readyAt := time.Now().Add(delay)
+	if old, found := q.waiting[item]; found {
+		if !readyAt.Before(old.readyAt) {
+			return
+		}
+		old.timer.Stop()
+	}
+	w := &waitingItem{readyAt: readyAt}
+	w.timer = time.AfterFunc(delay, func() { q.ready(item, w) })
+	q.waiting[item] = w
+}
+
+// ready adds item when its delay in w expired and w was not replaced by
+// another AddAfter in the meantime.
+func (q *priorityQueue) ready(item interface{}, w *waitingItem) {
+	q.lock.Lock()
+	if q.waiting[item] != w {
+		q.lock.Unlock()
+		return
+	}
+	delete(q.waiting, item)
+	q.lock.Unlock()
+	q.Add(item)
+}
+
+func (q *priorityQueue) AddRateLimited(item interface{}) {
+	q.AddAfter(item, q.rateLimiter.When(item))
+}
+
+func (q *priorityQueue) Forget(item interface{}) {
+	q.rateLimiter.Forget(item)
+}
+
+func (q *priorityQueue) NumRequeues(item interface{}) int {
+	return q.rateLimiter.NumRequeues(item)
+}
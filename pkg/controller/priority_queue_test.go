@@ -0,0 +1,141 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	urgentItems := sets.NewString("urgent")
+	q := newPriorityQueue(workqueue.DefaultControllerRateLimiter(), 2, func(item interface{}) int {
+		if urgentItems.Has(item.(string)) {
+			return 0
+		}
+		return 1
+	})
+
+	q.Add("a")
+	q.Add("b")
+	q.Add("urgent")
+	q.Add("a")
+	if q.Len() != 3 {
+		t.Errorf("expected 3 queued items, got %d", q.Len())
+	}
+
+	// b becomes urgent while queued.
+	urgentItems.Insert("b")
+	q.Add("b")
+
+	var got []string
+	for q.Len() > 0 {
+		item, _ := q.Get()
+		got = append(got, item.(string))
+	}
+	expected := []string{"urgent", "b", "a"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected items %v, got %v", expected, got)
+	}
+
+	// Items added while processing are queued when they're done.
+	q.Add("a")
+	if q.Len() != 0 {
+		t.Errorf("expected item in processing not to be queued, got %d items", q.Len())
+	}
+	for _, item := range got {
+		q.Done(item)
+	}
+	if item, _ := q.Get(); item != "a" {
+		t.Errorf("expected item a after Done, got %v", item)
+	}
+	q.Done("a")
+
+	q.AddAfter("later", 10*time.Millisecond)
+	if item, _ := q.Get(); item != "later" {
+		t.Errorf("expected delayed item, got %v", item)
+	}
+	q.Done("later")
+
+	q.ShutDown()
+	q.Add("a")
+	if _, shutdown := q.Get(); !shutdown {
+		t.Errorf("expected shutdown")
+	}
+}
+
+func TestPriorityQueueAddAfter(t *testing.T) {
+	q := newPriorityQueue(workqueue.DefaultControllerRateLimiter(), 1, func(item interface{}) int { return 0 })
+	defer q.ShutDown()
+
+	// Repeated requeues share a single timer with the earliest delay.
+	q.AddAfter("a", time.Hour)
+	q.AddAfter("a", 10*time.Millisecond)
+	q.AddAfter("a", time.Hour)
+	q.AddAfter("b", time.Hour)
+	q.lock.Lock()
+	waiting := len(q.waiting)
+	q.lock.Unlock()
+	if waiting != 2 {
+		t.Errorf("expected 2 waiting items, got %d", waiting)
+	}
+
+	if item, _ := q.Get(); item != "a" {
+		t.Errorf("expected item a after the earliest delay, got %v", item)
+	}
+	q.Done("a")
+	q.lock.Lock()
+	_, found := q.waiting["a"]
+	q.lock.Unlock()
+	if found {
+		t.Errorf("expected added item a not to wait")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if q.Len() != 0 {
+		t.Errorf("expected replaced timers not to add items, got %d items", q.Len())
+	}
+}
+
+func TestPriorityQueueLevels(t *testing.T) {
+	levels := map[string]int{"a": 2, "b": 1, "c": 0, "d": 2}
+	q := newPriorityQueue(workqueue.DefaultControllerRateLimiter(), 3, func(item interface{}) int {
+		return levels[item.(string)]
+	})
+	for _, item := range []string{"a", "b", "c", "d"} {
+		q.Add(item)
+	}
+	// d moved up, b can't move down.
+	levels["d"] = 1
+	q.Add("d")
+	levels["b"] = 2
+	q.Add("b")
+
+	var got []string
+	for q.Len() > 0 {
+		item, _ := q.Get()
+		got = append(got, item.(string))
+		q.Done(item)
+	}
+	expected := []string{"c", "b", "d", "a"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected items %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	storage "k8s.io/api/storage/v1beta1"
+)
+
+// Annotations of VolumeAttachments with times of attach phases, saved with
+// the attached status. The times are in RFC 3339 format with fractional
+// seconds.
+const (
+	// QueuedAtAnnotation is when the VolumeAttachment first entered the
+	// queue of the attacher.
+	QueuedAtAnnotation = "csi.alpha.kubernetes.io/queued-at"
+	// PublishStartedAtAnnotation is when the attacher started the last
+	// attempt to attach the volume.
+	PublishStartedAtAnnotation = "csi.alpha.kubernetes.io/publish-started-at"
+	// PublishFinishedAtAnnotation is when ControllerPublish succeeded.
+	PublishFinishedAtAnnotation = "csi.alpha.kubernetes.io/publish-finished-at"
+	// StatusUpdatedAtAnnotation is when the attacher saved the attached
+	// status.
+	StatusUpdatedAtAnnotation = "csi.alpha.kubernetes.io/status-updated-at"
+)
+
+func formatProgressTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// attachProgress returns annotations with times of attach phases of va. The
+// queue time is omitted when it's not known.
+func (h *csiHandler) attachProgress(va *storage.VolumeAttachment, publishStarted, publishFinished, statusUpdated time.Time) map[string]string {
+	annotations := map[string]string{
+		PublishStartedAtAnnotation:  formatProgressTime(publishStarted),
+		PublishFinishedAtAnnotation: formatProgressTime(publishFinished),
+		StatusUpdatedAtAnnotation:   formatProgressTime(statusUpdated),
+	}
+	if h.correlationIDs != nil {
+		if queued, found := h.correlationIDs.QueuedAt(va.Name); found {
+			annotations[QueuedAtAnnotation] = formatProgressTime(queued)
+		}
+	}
+	return annotations
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAttachProgress(t *testing.T) {
+	start := time.Date(2019, 10, 14, 12, 0, 0, 0, time.UTC)
+	finished := start.Add(1500 * time.Millisecond)
+	updated := finished.Add(20 * time.Millisecond)
+	expected := map[string]string{
+		PublishStartedAtAnnotation:  "2019-10-14T12:00:00Z",
+		PublishFinishedAtAnnotation: "2019-10-14T12:00:01.5Z",
+		StatusUpdatedAtAnnotation:   "2019-10-14T12:00:01.52Z",
+	}
+
+	h := &csiHandler{}
+	obj := va(false, "", nil)
+	if annotations := h.attachProgress(obj, start, finished, updated); !reflect.DeepEqual(annotations, expected) {
+		t.Errorf("without correlation IDs: expected %v, got %v", expected, annotations)
+	}
+
+	h.correlationIDs = NewCorrelationIDs()
+	h.correlationIDs.Get(obj.Name)
+	queued, _ := h.correlationIDs.QueuedAt(obj.Name)
+	expected[QueuedAtAnnotation] = formatProgressTime(queued)
+	if annotations := h.attachProgress(obj, start, finished, updated); !reflect.DeepEqual(annotations, expected) {
+		t.Errorf("with correlation IDs: expected %v, got %v", expected, annotations)
+	}
+}
+
+func TestMarkAsAttachedAnnotations(t *testing.T) {
+	obj := va(false, fin, nil)
+	client := fake.NewSimpleClientset(obj)
+	annotations := map[string]string{StatusUpdatedAtAnnotation: "2019-10-14T12:00:00Z"}
+	attached, err := markAsAttached(client, obj, map[string]string{"foo": "bar"}, annotations)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !attached.Status.Attached {
+		t.Errorf("expected attached status")
+	}
+	if value := attached.Annotations[StatusUpdatedAtAnnotation]; value != "2019-10-14T12:00:00Z" {
+		t.Errorf("expected annotation %s, got %q", StatusUpdatedAtAnnotation, value)
+	}
+	if obj.Annotations != nil {
+		t.Errorf("original VolumeAttachment was modified: %v", obj.Annotations)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+)
+
+// explainPublishConflict adds the nodes and VolumeAttachments that the volume
+// of va is attached to to a FAILED_PRECONDITION error of ControllerPublish.
+// Drivers return it when a volume that can't be published to more nodes is
+// published to another one, typically while it's being detached from a node
+// where its previous pod ran. The returned error has the same code.
+func (h *csiHandler) explainPublishConflict(va *storage.VolumeAttachment, err error) error {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.FailedPrecondition {
+		return err
+	}
+	vas, listErr := h.vaLister.List(labels.Everything())
+	if listErr != nil {
+		klog.V(4).Infof("Can't find VolumeAttachments conflicting with %q: %v", va.Name, listErr)
+		return err
+	}
+	var conflicts []string
+	for _, other := range vas {
+		if other.Name == va.Name || other.Spec.Attacher != va.Spec.Attacher || other.Spec.NodeName == va.Spec.NodeName {
+			continue
+		}
+		if !other.Status.Attached || !sameVolume(va, other) {
+			continue
+		}
+		conflict := fmt.Sprintf("node %s via VolumeAttachment %s", other.Spec.NodeName, other.Name)
+		if other.DeletionTimestamp != nil {
+			conflict += " (being detached)"
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	if len(conflicts) == 0 {
+		return err
+	}
+	return status.Errorf(st.Code(), "%s: volume is already attached to %s", st.Message(), strings.Join(conflicts, ", "))
+}
+
+// sameVolume returns true when VolumeAttachments a and b attach the same PV or
+// the same inline volume.
+func sameVolume(a, b *storage.VolumeAttachment) bool {
+	if a.Spec.Source.PersistentVolumeName != nil {
+		return b.Spec.Source.PersistentVolumeName != nil && *a.Spec.Source.PersistentVolumeName == *b.Spec.Source.PersistentVolumeName
+	}
+	aSpec, bSpec := a.Spec.Source.InlineVolumeSpec, b.Spec.Source.InlineVolumeSpec
+	if aSpec == nil || bSpec == nil || aSpec.CSI == nil || bSpec.CSI == nil {
+		return false
+	}
+	return aSpec.CSI.VolumeHandle == bSpec.CSI.VolumeHandle
+}
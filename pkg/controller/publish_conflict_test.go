@@ -0,0 +1,146 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestExplainPublishConflict(t *testing.T) {
+	inline := func(name, nodeName, handle string) *storage.VolumeAttachment {
+		va := createVolumeAttachment(testAttacherName, name, nodeName, true, fin, nil)
+		pv := pv()
+		pv.Spec.CSI.VolumeHandle = handle
+		va.Spec.Source = storage.VolumeAttachmentSource{InlineVolumeSpec: &pv.Spec}
+		return va
+	}
+	detaching := deleted(createVolumeAttachment(testAttacherName, testPVName, "node3", true, fin, nil))
+	otherAttacher := createVolumeAttachment("csi/other", testPVName, "node2", true, fin, nil)
+	notAttached := createVolumeAttachment(testAttacherName, testPVName, "node2", false, fin, nil)
+	otherPV := createVolumeAttachment(testAttacherName, "pv2", "node2", true, fin, nil)
+	failedPrecondition := status.Error(codes.FailedPrecondition, "volume is published to another node")
+
+	tests := []struct {
+		name     string
+		va       *storage.VolumeAttachment
+		vas      []*storage.VolumeAttachment
+		err      error
+		expected string
+	}{
+		{
+			name:     "attached to another node",
+			va:       va(false, fin, ann),
+			vas:      []*storage.VolumeAttachment{createVolumeAttachment(testAttacherName, testPVName, "node2", true, fin, nil)},
+			err:      failedPrecondition,
+			expected: "rpc error: code = FailedPrecondition desc = volume is published to another node: volume is already attached to node node2 via VolumeAttachment pv1-node2",
+		},
+		{
+			name:     "being detached from another node",
+			va:       va(false, fin, ann),
+			vas:      []*storage.VolumeAttachment{detaching},
+			err:      failedPrecondition,
+			expected: "rpc error: code = FailedPrecondition desc = volume is published to another node: volume is already attached to node node3 via VolumeAttachment pv1-node3 (being detached)",
+		},
+		{
+			name:     "inline volume",
+			va:       inline("inline", testNodeName, "vol-1"),
+			vas:      []*storage.VolumeAttachment{inline("other", "node2", "vol-1"), inline("third", "node3", "vol-2")},
+			err:      failedPrecondition,
+			expected: "rpc error: code = FailedPrecondition desc = volume is published to another node: volume is already attached to node node2 via VolumeAttachment other-node2",
+		},
+		{
+			name:     "no conflicting VolumeAttachment",
+			va:       va(false, fin, ann),
+			vas:      []*storage.VolumeAttachment{otherAttacher, notAttached, otherPV},
+			err:      failedPrecondition,
+			expected: failedPrecondition.Error(),
+		},
+		{
+			name:     "other error",
+			va:       va(false, fin, ann),
+			vas:      []*storage.VolumeAttachment{createVolumeAttachment(testAttacherName, testPVName, "node2", true, fin, nil)},
+			err:      errors.New("mock error"),
+			expected: "mock error",
+		},
+	}
+	for _, test := range tests {
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		indexer.Add(test.va)
+		for _, va := range test.vas {
+			indexer.Add(va)
+		}
+		h := &csiHandler{vaLister: storagelisters.NewVolumeAttachmentLister(indexer)}
+		err := h.explainPublishConflict(test.va, test.err)
+		if err.Error() != test.expected {
+			t.Errorf("%s: expected error %q, got %q", test.name, test.expected, err.Error())
+		}
+		if status.Code(err) != status.Code(test.err) {
+			t.Errorf("%s: expected code %s, got %s", test.name, status.Code(test.err), status.Code(err))
+		}
+	}
+}
+
+func TestCSIHandlerPublishConflict(t *testing.T) {
+	vaGroupResourceVersion := schema.GroupVersionResource{
+		Group:    storage.GroupName,
+		Version:  "v1beta1",
+		Resource: "volumeattachments",
+	}
+	var noMetadata map[string]string
+	var noAttrs map[string]string
+	var noSecrets map[string]string
+	var readWrite = false
+	var notDetached = false
+	failedPrecondition := status.Error(codes.FailedPrecondition, "volume is published to another node")
+	explained := "rpc error: code = FailedPrecondition desc = volume is published to another node: volume is already attached to node node2 via VolumeAttachment pv1-node2"
+
+	tests := []testCase{
+		{
+			name:           "publish fails with FAILED_PRECONDITION -> error names the other node",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node(), createVolumeAttachment(testAttacherName, testPVName, "node2", true, fin, nil)},
+			addedVA:        va(false, "", nil),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false, "", nil),
+						va(false, fin, ann))),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false, fin, ann),
+						vaWithAttachError(va(false, fin, ann), explained))),
+			},
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, failedPrecondition, notDetached, noMetadata, 0},
+			},
+			expectedEvents: []string{
+				"Normal AttachStarted Attaching volume to node node1",
+				"Warning AttachFailed Failed to attach volume to node node1: " + explained,
+			},
+		},
+	}
+	runTests(t, csiHandlerFactory, tests)
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/klog"
+)
+
+// shouldRepublish returns true when the attached volume of va was not
+// published by this attacher for republishInterval, e.g. since the attacher
+// started.
+func (h *csiHandler) shouldRepublish(va *storage.VolumeAttachment) bool {
+	if h.republishInterval == 0 {
+		return false
+	}
+	h.publishTimesLock.Lock()
+	defer h.publishTimesLock.Unlock()
+	last, found := h.publishTimes[va.Name]
+	return !found || h.clock.Since(last) >= h.republishInterval
+}
+
+// published remembers that the volume of VolumeAttachment vaName was
+// published and its PublishContext saved.
+func (h *csiHandler) published(vaName string) {
+	if h.republishInterval == 0 {
+		return
+	}
+	h.publishTimesLock.Lock()
+	defer h.publishTimesLock.Unlock()
+	if h.publishTimes == nil {
+		h.publishTimes = map[string]time.Time{}
+	}
+	h.publishTimes[vaName] = h.clock.Now()
+}
+
+// forgetPublished forgets VolumeAttachment vaName after detach.
+func (h *csiHandler) forgetPublished(vaName string) {
+	h.publishTimesLock.Lock()
+	defer h.publishTimesLock.Unlock()
+	delete(h.publishTimes, vaName)
+}
+
+// refreshAttachmentMetadata publishes the attached volume of va again and
+// saves the returned PublishContext when it differs from the attachment
+// metadata. Kubelet stages the volume with the metadata, stale values, e.g.
+// after the driver was upgraded or the backend moved the volume, break
+// mounts. Errors of ControllerPublish are only logged, the volume stays
+// attached with the old metadata. The volume is already attached, so only
+// ControllerPublish is called, without hooks, attach policy, quotas and
+// detach from a changed node ID.
+func (h *csiHandler) refreshAttachmentMetadata(va *storage.VolumeAttachment) error {
+	klog.V(4).Infof("Publishing attached %q again", va.Name)
+	state, err := h.republish(va)
+	if err != nil {
+		klog.Warningf("Failed to publish attached %q again: %v", va.Name, err)
+		return nil
+	}
+	metadata := h.excludeMetadata(va, state.publishContext)
+	var annotations map[string]string
+	if h.skipUnchangedRepublish {
+		if hash := publishInputsHash(state); va.Annotations[PublishInputsHashAnnotation] != hash {
+			annotations = map[string]string{PublishInputsHashAnnotation: hash}
+		}
+	}
+	if (len(metadata) == 0 && len(va.Status.AttachmentMetadata) == 0) || reflect.DeepEqual(metadata, va.Status.AttachmentMetadata) {
+		klog.V(4).Infof("PublishContext of %q did not change", va.Name)
+		if annotations != nil {
+			if _, err := markAsAttached(h.client, va, va.Status.AttachmentMetadata, annotations); err != nil {
+				return wrapError("failed to save inputs of ControllerPublish", err)
+			}
+		}
+		h.published(va.Name)
+		return nil
+	}
+	klog.V(2).Infof("PublishContext of %q changed, updating attachment metadata", va.Name)
+	if _, err := markAsAttached(h.client, va, metadata, annotations); err != nil {
+		return wrapError("failed to update attachment metadata", err)
+	}
+	h.published(va.Name)
+	h.recordEvent(va, v1.EventTypeNormal, AttachmentMetadataUpdated, "Updated attachment metadata of volume on node %s, the CSI driver returned a different PublishContext", va.Spec.NodeName)
+	return nil
+}
+
+// republish calls ControllerPublish of the attached volume of va again.
+func (h *csiHandler) republish(va *storage.VolumeAttachment) (*attachState, error) {
+	state := &attachState{va: va}
+	if err := h.resolveVolume(state); err != nil {
+		return nil, err
+	}
+	var err error
+	state.secrets, err = h.getCredentialsFromPV(state.csiSource)
+	if err != nil {
+		return nil, err
+	}
+	state.nodeID, err = h.getNodeID(h.attacherName, va.Spec.NodeName, nil)
+	if err != nil {
+		return nil, err
+	}
+	return state, h.controllerPublish(state)
+}
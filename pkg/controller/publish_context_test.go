@@ -0,0 +1,168 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	core "k8s.io/client-go/testing"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
+	"github.com/kubernetes-csi/external-attacher/pkg/hooks"
+	"github.com/kubernetes-csi/external-attacher/pkg/policy"
+)
+
+func republishHandlerFactory(client kubernetes.Interface, informerFactory informers.SharedInformerFactory, csi attacher.Attacher) Handler {
+	handler := csiHandlerFactory(client, informerFactory, csi)
+	handler.(*csiHandler).republishInterval = time.Hour
+	return handler
+}
+
+func TestShouldRepublish(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	h := &csiHandler{republishInterval: time.Hour, clock: fakeClock}
+	attached := va(true, fin, ann)
+
+	if !h.shouldRepublish(attached) {
+		t.Errorf("expected republish of a volume not published since start")
+	}
+	h.published(attached.Name)
+	fakeClock.Step(30 * time.Minute)
+	if h.shouldRepublish(attached) {
+		t.Errorf("expected no republish before the interval")
+	}
+	fakeClock.Step(30 * time.Minute)
+	if !h.shouldRepublish(attached) {
+		t.Errorf("expected republish after the interval")
+	}
+	h.published(attached.Name)
+	h.forgetPublished(attached.Name)
+	if !h.shouldRepublish(attached) {
+		t.Errorf("expected republish of a forgotten volume")
+	}
+
+	disabled := &csiHandler{clock: fakeClock}
+	if disabled.shouldRepublish(attached) {
+		t.Errorf("expected no republish when disabled")
+	}
+}
+
+func TestCSIHandlerRepublish(t *testing.T) {
+	vaGroupResourceVersion := schema.GroupVersionResource{
+		Group:    storage.GroupName,
+		Version:  "v1beta1",
+		Resource: "volumeattachments",
+	}
+	var noAttrs map[string]string
+	var noSecrets map[string]string
+	var success error
+	var readWrite = false
+	var notDetached = false
+	oldMetadata := map[string]string{"device": "/dev/sda"}
+	newMetadata := map[string]string{"device": "/dev/sdb"}
+
+	tests := []testCase{
+		{
+			name:           "PublishContext changed -> attachment metadata updated",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        vaWithMetadata(va(true, fin, ann), oldMetadata),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(vaWithMetadata(va(true, fin, ann), oldMetadata),
+						vaWithMetadata(va(true, fin, ann), newMetadata))),
+			},
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, newMetadata, 0},
+			},
+			expectedEvents: []string{
+				"Normal AttachmentMetadataUpdated Updated attachment metadata of volume on node node1, the CSI driver returned a different PublishContext",
+			},
+		},
+		{
+			name:           "PublishContext not changed -> no update",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        vaWithMetadata(va(true, fin, ann), oldMetadata),
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, oldMetadata, 0},
+			},
+		},
+		{
+			name:           "publish fails -> volume stays attached",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        vaWithMetadata(va(true, fin, ann), oldMetadata),
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, errors.New("mock error"), notDetached, nil, 0},
+			},
+		},
+	}
+	runTests(t, republishHandlerFactory, tests)
+}
+
+func TestCSIHandlerRepublishSkipsHooksAndPolicy(t *testing.T) {
+	vaGroupResourceVersion := schema.GroupVersionResource{
+		Group:    storage.GroupName,
+		Version:  "v1beta1",
+		Resource: "volumeattachments",
+	}
+	var noAttrs map[string]string
+	var noSecrets map[string]string
+	var success error
+	var readWrite = false
+	var notDetached = false
+	oldMetadata := map[string]string{"device": "/dev/sda"}
+	newMetadata := map[string]string{"device": "/dev/sdb"}
+
+	runner := &fakeHooks{errors: map[string]error{hooks.PreAttach: errors.New("mock hook error")}}
+	checker := &fakePolicy{decision: &policy.Decision{Decision: policy.Deny, Reason: "no unencrypted volumes"}}
+	factory := func(client kubernetes.Interface, informerFactory informers.SharedInformerFactory, csi attacher.Attacher) Handler {
+		handler := republishHandlerFactory(client, informerFactory, csi)
+		handler.(*csiHandler).hooks = runner
+		handler.(*csiHandler).policy = checker
+		return handler
+	}
+	runTests(t, factory, []testCase{
+		{
+			name:           "republish with failing hook and denying policy -> attachment metadata updated",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        vaWithMetadata(va(true, fin, ann), oldMetadata),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(vaWithMetadata(va(true, fin, ann), oldMetadata),
+						vaWithMetadata(va(true, fin, ann), newMetadata))),
+			},
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, newMetadata, 0},
+			},
+		},
+	})
+	if ran := runner.ran(); len(ran) != 0 {
+		t.Errorf("expected no hooks on republish, got %v", ran)
+	}
+	if len(checker.reviews) != 0 {
+		t.Errorf("expected no policy reviews on republish, got %d", len(checker.reviews))
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/klog"
+)
+
+// PublishInputsHashAnnotation is a hash of the inputs of the last successful
+// ControllerPublish of a VolumeAttachment, except secrets.
+const PublishInputsHashAnnotation = "csi.alpha.kubernetes.io/publish-inputs-hash"
+
+// publishInputs are the inputs of ControllerPublish that are hashed.
+type publishInputs struct {
+	VolumeHandle string            `json:"volumeHandle"`
+	NodeID       string            `json:"nodeID"`
+	ReadOnly     bool              `json:"readOnly"`
+	Capability   string            `json:"capability"`
+	Attributes   map[string]string `json:"attributes"`
+}
+
+// publishInputsHash returns the hash of the inputs of ControllerPublish
+// resolved in state.
+func publishInputsHash(state *attachState) string {
+	inputs := publishInputs{
+		VolumeHandle: state.volumeHandle,
+		NodeID:       state.nodeID,
+		ReadOnly:     state.readOnly,
+		Capability:   state.capabilities.String(),
+		Attributes:   state.attributes,
+	}
+	// Marshaling of strings, bools and a map with sorted keys can't fail.
+	data, _ := json.Marshal(inputs)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
+
+// publishInputsUnchanged returns true when ControllerPublish of attached va
+// would get the same inputs as its last one, so it can be skipped. The inputs
+// are resolved from informer caches, without reading secrets.
+func (h *csiHandler) publishInputsUnchanged(va *storage.VolumeAttachment) bool {
+	hash, found := va.Annotations[PublishInputsHashAnnotation]
+	if !found {
+		return false
+	}
+	state := &attachState{va: va}
+	if err := h.resolveVolume(state); err != nil {
+		klog.V(4).Infof("Can't resolve inputs of ControllerPublish of %q: %v", va.Name, err)
+		return false
+	}
+	nodeID, err := h.getNodeID(h.attacherName, va.Spec.NodeName, nil)
+	if err != nil {
+		klog.V(4).Infof("Can't resolve node ID of ControllerPublish of %q: %v", va.Name, err)
+		return false
+	}
+	state.nodeID = nodeID
+	return publishInputsHash(state) == hash
+}
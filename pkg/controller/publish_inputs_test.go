@@ -0,0 +1,167 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	core "k8s.io/client-go/testing"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
+)
+
+func skipUnchangedRepublishHandlerFactory(client kubernetes.Interface, informerFactory informers.SharedInformerFactory, csi attacher.Attacher) Handler {
+	handler := republishHandlerFactory(client, informerFactory, csi)
+	handler.(*csiHandler).skipUnchangedRepublish = true
+	return handler
+}
+
+// testPublishInputsHash returns the hash of the inputs of ControllerPublish
+// of pv() to node().
+func testPublishInputsHash(t *testing.T) string {
+	capability, err := GetVolumeCapabilities(&pv().Spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return publishInputsHash(&attachState{
+		volumeHandle: testVolumeHandle,
+		nodeID:       testNodeID,
+		capabilities: capability,
+	})
+}
+
+func vaWithPublishInputsHash(va *storage.VolumeAttachment, hash string) *storage.VolumeAttachment {
+	annotations := map[string]string{}
+	for k, v := range va.Annotations {
+		annotations[k] = v
+	}
+	annotations[PublishInputsHashAnnotation] = hash
+	va.Annotations = annotations
+	return va
+}
+
+func TestPublishInputsHash(t *testing.T) {
+	capability := createMountCapability("ext4", csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, nil)
+	state := func() *attachState {
+		return &attachState{
+			volumeHandle: testVolumeHandle,
+			nodeID:       testNodeID,
+			capabilities: capability,
+			attributes:   map[string]string{"a": "1", "b": "2"},
+		}
+	}
+	hash := publishInputsHash(state())
+	if again := publishInputsHash(state()); again != hash {
+		t.Errorf("expected stable hash %s, got %s", hash, again)
+	}
+
+	changes := map[string]func(*attachState){
+		"node ID":    func(s *attachState) { s.nodeID = "node2" },
+		"read only":  func(s *attachState) { s.readOnly = true },
+		"attributes": func(s *attachState) { s.attributes["a"] = "3" },
+		"capabilities": func(s *attachState) {
+			s.capabilities = createBlockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+		},
+	}
+	for name, change := range changes {
+		changed := state()
+		change(changed)
+		if publishInputsHash(changed) == hash {
+			t.Errorf("%s: expected a different hash", name)
+		}
+	}
+	// Secrets are not hashed.
+	withSecrets := state()
+	withSecrets.secrets = map[string]string{"password": "secret"}
+	if publishInputsHash(withSecrets) != hash {
+		t.Errorf("expected secrets not to change the hash")
+	}
+}
+
+func TestCSIHandlerSkipUnchangedRepublish(t *testing.T) {
+	vaGroupResourceVersion := schema.GroupVersionResource{
+		Group:    storage.GroupName,
+		Version:  "v1beta1",
+		Resource: "volumeattachments",
+	}
+	var noAttrs map[string]string
+	var noSecrets map[string]string
+	var success error
+	var readWrite = false
+	var notDetached = false
+	metadata := map[string]string{"device": "/dev/sda"}
+	hash := testPublishInputsHash(t)
+
+	tests := []testCase{
+		{
+			name:           "inputs not changed -> ControllerPublish skipped",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        vaWithPublishInputsHash(vaWithMetadata(va(true, fin, ann), metadata), hash),
+		},
+		{
+			name:           "inputs changed -> ControllerPublish called and hash saved",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        vaWithPublishInputsHash(vaWithMetadata(va(true, fin, ann), metadata), "stale"),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(vaWithPublishInputsHash(vaWithMetadata(va(true, fin, ann), metadata), "stale"),
+						vaWithPublishInputsHash(vaWithMetadata(va(true, fin, ann), metadata), hash))),
+			},
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, metadata, 0},
+			},
+		},
+		{
+			name:           "no hash -> ControllerPublish called and hash saved",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        vaWithMetadata(va(true, fin, ann), metadata),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(vaWithMetadata(va(true, fin, ann), metadata),
+						vaWithPublishInputsHash(vaWithMetadata(va(true, fin, ann), metadata), hash))),
+			},
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, metadata, 0},
+			},
+		},
+		{
+			name:           "attach -> hash saved",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        va(false, fin, ann),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false, fin, ann),
+						vaWithPublishInputsHash(vaWithMetadata(va(true, fin, ann), metadata), hash))),
+			},
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, metadata, 0},
+			},
+		},
+	}
+	runTests(t, skipUnchangedRepublishHandlerFactory, tests)
+	if count := republishSkippedTotal.WithLabelValues(testAttacherName).Value(); count != 1 {
+		t.Errorf("expected 1 skipped republish, got %v", count)
+	}
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/klog"
+)
+
+// PublishParameterPrefix is the prefix of StorageClass parameters that are
+// passed to ControllerPublish in volume_context without the prefix, e.g.
+// parameter "attacher.csi.kubernetes.io/publish-param-queueDepth" as
+// "queueDepth".
+const PublishParameterPrefix = "attacher.csi.kubernetes.io/publish-param-"
+
+// addPublishParameters returns attributes of the volume of va with the
+// publish parameters of the StorageClass of pv. Attributes of the PV win over
+// parameters with the same key. pv is nil for inline volumes, which have no
+// StorageClass.
+func (h *csiHandler) addPublishParameters(va *storage.VolumeAttachment, pv *v1.PersistentVolume, attributes map[string]string) map[string]string {
+	if !h.publishParameters || pv == nil || pv.Spec.StorageClassName == "" {
+		return attributes
+	}
+	class, err := h.scLister.Get(pv.Spec.StorageClassName)
+	if err != nil {
+		klog.V(4).Infof("Can't get StorageClass %q of %q: %v", pv.Spec.StorageClassName, va.Name, err)
+		return attributes
+	}
+	var merged map[string]string
+	for key, value := range class.Parameters {
+		if !strings.HasPrefix(key, PublishParameterPrefix) || key == PublishParameterPrefix {
+			continue
+		}
+		key = strings.TrimPrefix(key, PublishParameterPrefix)
+		if _, found := attributes[key]; found {
+			klog.V(4).Infof("Not passing parameter %q of StorageClass %q to ControllerPublish of %q, the PV has the same volume attribute", key, class.Name, va.Name)
+			continue
+		}
+		if merged == nil {
+			// The attributes are in the informer cache.
+			merged = make(map[string]string, len(attributes)+1)
+			for k, v := range attributes {
+				merged[k] = v
+			}
+		}
+		merged[key] = value
+	}
+	if merged == nil {
+		return attributes
+	}
+	return merged
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestAddPublishParameters(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	indexer.Add(&storagev1.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "tuned"},
+		Parameters: map[string]string{
+			PublishParameterPrefix + "queueDepth": "64",
+			PublishParameterPrefix + "multipath":  "true",
+			PublishParameterPrefix:                "empty key",
+			"type":                                "ssd",
+		},
+	})
+	indexer.Add(&storagev1.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "plain"},
+		Parameters: map[string]string{"type": "ssd"},
+	})
+
+	tests := []struct {
+		name         string
+		disabled     bool
+		storageClass string
+		inline       bool
+		attributes   map[string]string
+		expected     map[string]string
+	}{
+		{
+			name:         "parameters",
+			storageClass: "tuned",
+			attributes:   map[string]string{"foo": "bar"},
+			expected:     map[string]string{"foo": "bar", "queueDepth": "64", "multipath": "true"},
+		},
+		{
+			name:         "PV attribute wins",
+			storageClass: "tuned",
+			attributes:   map[string]string{"queueDepth": "8"},
+			expected:     map[string]string{"queueDepth": "8", "multipath": "true"},
+		},
+		{
+			name:         "no publish parameters",
+			storageClass: "plain",
+			attributes:   map[string]string{"foo": "bar"},
+			expected:     map[string]string{"foo": "bar"},
+		},
+		{
+			name:         "missing StorageClass",
+			storageClass: "missing",
+			expected:     nil,
+		},
+		{
+			name:       "inline volume",
+			inline:     true,
+			attributes: map[string]string{"foo": "bar"},
+			expected:   map[string]string{"foo": "bar"},
+		},
+		{
+			name:         "disabled",
+			disabled:     true,
+			storageClass: "tuned",
+			expected:     nil,
+		},
+	}
+	for _, test := range tests {
+		h := &csiHandler{
+			publishParameters: !test.disabled,
+			scLister:          storagelistersv1.NewStorageClassLister(indexer),
+		}
+		volume := pv()
+		volume.Spec.StorageClassName = test.storageClass
+		if test.inline {
+			volume = nil
+		}
+		var original map[string]string
+		if test.attributes != nil {
+			original = map[string]string{}
+			for k, v := range test.attributes {
+				original[k] = v
+			}
+		}
+		attributes := h.addPublishParameters(va(false, "", nil), volume, test.attributes)
+		if !reflect.DeepEqual(attributes, test.expected) {
+			t.Errorf("%s: expected attributes %v, got %v", test.name, test.expected, attributes)
+		}
+		if !reflect.DeepEqual(test.attributes, original) {
+			t.Errorf("%s: attributes of the PV changed to %v", test.name, test.attributes)
+		}
+	}
+}
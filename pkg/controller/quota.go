@@ -0,0 +1,244 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+)
+
+const (
+	// quotaRetryInterval is the delay before a VolumeAttachment that
+	// exceeds a quota is checked again.
+	quotaRetryInterval = 10 * time.Second
+	// quotaReservationTTL is how long an admitted attach counts against
+	// its quotas before the informer shows the finalizer of its
+	// VolumeAttachment.
+	quotaReservationTTL = time.Minute
+)
+
+// Kinds of attach quotas.
+const (
+	QuotaStorageClass = "storageclass"
+	QuotaNamespace    = "namespace"
+)
+
+// AttachQuotas are maximum numbers of volumes attached at the same time,
+// per StorageClass and per namespace of the PVC bound to the volume.
+type AttachQuotas struct {
+	StorageClasses map[string]int
+	Namespaces     map[string]int
+}
+
+// IsEmpty returns true when there is no quota.
+func (q AttachQuotas) IsEmpty() bool {
+	return len(q.StorageClasses) == 0 && len(q.Namespaces) == 0
+}
+
+// ParseAttachQuotas parses quotas in form "storageclass/<name>=<limit>" and
+// "namespace/<name>=<limit>".
+func ParseAttachQuotas(values []string) (AttachQuotas, error) {
+	quotas := AttachQuotas{StorageClasses: map[string]int{}, Namespaces: map[string]int{}}
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		kindName := strings.SplitN(parts[0], "/", 2)
+		if len(parts) != 2 || len(kindName) != 2 || kindName[1] == "" {
+			return AttachQuotas{}, fmt.Errorf("invalid attach quota %q, expected <kind>/<name>=<limit>", value)
+		}
+		limit, err := strconv.Atoi(parts[1])
+		if err != nil || limit < 0 {
+			return AttachQuotas{}, fmt.Errorf("invalid limit of attach quota %q: must be a non-negative integer", value)
+		}
+		switch kindName[0] {
+		case QuotaStorageClass:
+			quotas.StorageClasses[kindName[1]] = limit
+		case QuotaNamespace:
+			quotas.Namespaces[kindName[1]] = limit
+		default:
+			return AttachQuotas{}, fmt.Errorf("invalid kind of attach quota %q, expected %q or %q", value, QuotaStorageClass, QuotaNamespace)
+		}
+	}
+	return quotas, nil
+}
+
+// quotaExceededError is returned when an attach waits until a quota has
+// room. The attach is retried after quotaRetryInterval and it is not
+// reported as attach failure.
+type quotaExceededError struct {
+	msg string
+}
+
+func (e *quotaExceededError) Error() string {
+	return e.msg
+}
+
+// isQuotaExceeded returns true when an attach waits for a quota.
+func isQuotaExceeded(err error) bool {
+	for _, e := range errorChain(err) {
+		if _, ok := e.(*quotaExceededError); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// quotaTracker admits attaches of volumes within AttachQuotas. A volume
+// counts against quotas from its admission until its VolumeAttachment loses
+// the finalizer of the attacher, i.e. until it is detached.
+type quotaTracker struct {
+	quotas       AttachQuotas
+	attacherName string
+	vaLister     storagelisters.VolumeAttachmentLister
+	pvLister     corelisters.PersistentVolumeLister
+	clock        clock.Clock
+
+	// lock serializes admissions, so concurrent workers don't exceed a
+	// quota.
+	lock sync.Mutex
+	// reservations are admitted VolumeAttachments whose finalizer may not
+	// be in the informer yet, with the time of their admission.
+	reservations map[string]reservation
+}
+
+// reservation is an admitted attach of a PersistentVolume.
+type reservation struct {
+	pvName string
+	time   time.Time
+}
+
+func newQuotaTracker(quotas AttachQuotas, attacherName string, vaLister storagelisters.VolumeAttachmentLister, pvLister corelisters.PersistentVolumeLister, clock clock.Clock) *quotaTracker {
+	return &quotaTracker{
+		quotas:       quotas,
+		attacherName: attacherName,
+		vaLister:     vaLister,
+		pvLister:     pvLister,
+		clock:        clock,
+		reservations: map[string]reservation{},
+	}
+}
+
+// admit returns quotaExceededError when the attach of pv by va would exceed
+// a quota of its StorageClass or namespace. VolumeAttachments with the
+// finalizer of the attacher are already counted and always admitted.
+func (t *quotaTracker) admit(va *storage.VolumeAttachment, pv *v1.PersistentVolume) error {
+	if hasFinalizer(va.Finalizers, GetFinalizerName(t.attacherName)) {
+		return nil
+	}
+	keys := t.quotaKeys(pv)
+	if len(keys) == 0 {
+		return nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	attached, err := t.attachedVolumes(va.Name)
+	if err != nil {
+		return err
+	}
+	used := map[quotaKey]int{}
+	for _, pvName := range attached {
+		other, err := t.pvLister.Get(pvName)
+		if err != nil {
+			// Deleted PVs don't count.
+			continue
+		}
+		for _, key := range t.quotaKeys(other) {
+			used[key]++
+		}
+	}
+	for _, key := range keys {
+		if used[key] >= key.limit {
+			quotaExceededTotal.WithLabelValues(t.attacherName, key.kind, key.name).Inc()
+			return &quotaExceededError{msg: fmt.Sprintf("attach quota of %s %q exceeded, %d of %d volumes are attached", key.kind, key.name, used[key], key.limit)}
+		}
+	}
+	t.reservations[va.Name] = reservation{pvName: pv.Name, time: t.clock.Now()}
+	return nil
+}
+
+// quotaKey identifies a quota.
+type quotaKey struct {
+	kind, name string
+	limit      int
+}
+
+// quotaKeys returns quotas that apply to pv.
+func (t *quotaTracker) quotaKeys(pv *v1.PersistentVolume) []quotaKey {
+	var keys []quotaKey
+	if limit, ok := t.quotas.StorageClasses[pv.Spec.StorageClassName]; ok && pv.Spec.StorageClassName != "" {
+		keys = append(keys, quotaKey{kind: QuotaStorageClass, name: pv.Spec.StorageClassName, limit: limit})
+	}
+	if pv.Spec.ClaimRef != nil {
+		if limit, ok := t.quotas.Namespaces[pv.Spec.ClaimRef.Namespace]; ok {
+			keys = append(keys, quotaKey{kind: QuotaNamespace, name: pv.Spec.ClaimRef.Namespace, limit: limit})
+		}
+	}
+	return keys
+}
+
+// attachedVolumes returns names of PVs of VolumeAttachments other than
+// vaName that count against quotas. It must be called with t.lock held.
+func (t *quotaTracker) attachedVolumes(vaName string) ([]string, error) {
+	vas, err := t.vaLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	finalizer := GetFinalizerName(t.attacherName)
+	volumes := map[string]string{}
+	for _, va := range vas {
+		if va.Spec.Attacher != t.attacherName || va.Name == vaName || va.Spec.Source.PersistentVolumeName == nil {
+			continue
+		}
+		if hasFinalizer(va.Finalizers, finalizer) || va.Status.Attached {
+			volumes[va.Name] = *va.Spec.Source.PersistentVolumeName
+			// The informer caught up with the admission.
+			delete(t.reservations, va.Name)
+		}
+	}
+	now := t.clock.Now()
+	for name, r := range t.reservations {
+		if name == vaName {
+			continue
+		}
+		if now.Sub(r.time) > quotaReservationTTL {
+			// The attach failed before the finalizer was added or
+			// the VolumeAttachment was deleted.
+			delete(t.reservations, name)
+			continue
+		}
+		if _, found := volumes[name]; !found {
+			volumes[name] = r.pvName
+		}
+	}
+
+	pvNames := make([]string, 0, len(volumes))
+	for _, pvName := range volumes {
+		pvNames = append(pvNames, pvName)
+	}
+	return pvNames, nil
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1beta1"
+	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
+)
+
+func TestParseAttachQuotas(t *testing.T) {
+	quotas, err := ParseAttachQuotas([]string{"storageclass/gold=10", "namespace/tenant-a=3", "namespace/tenant-b=0"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(quotas.StorageClasses) != 1 || quotas.StorageClasses["gold"] != 10 {
+		t.Errorf("unexpected StorageClass quotas %v", quotas.StorageClasses)
+	}
+	if len(quotas.Namespaces) != 2 || quotas.Namespaces["tenant-a"] != 3 || quotas.Namespaces["tenant-b"] != 0 {
+		t.Errorf("unexpected namespace quotas %v", quotas.Namespaces)
+	}
+
+	for _, value := range []string{"gold=10", "storageclass/=1", "storageclass/gold", "storageclass/gold=-1", "storageclass/gold=many", "pvc/data=1"} {
+		if _, err := ParseAttachQuotas([]string{value}); err == nil {
+			t.Errorf("%s: expected error, got none", value)
+		}
+	}
+	if quotas, err := ParseAttachQuotas(nil); err != nil || !quotas.IsEmpty() {
+		t.Errorf("expected empty quotas, got %+v, %v", quotas, err)
+	}
+}
+
+func quotaPV(name, storageClass, namespace string) *v1.PersistentVolume {
+	pv := pv()
+	pv.Name = name
+	pv.Spec.StorageClassName = storageClass
+	if namespace != "" {
+		pv.Spec.ClaimRef = &v1.ObjectReference{Namespace: namespace, Name: name}
+	}
+	return pv
+}
+
+func quotaVA(pvName, finalizers string) *storage.VolumeAttachment {
+	return createVolumeAttachment(testAttacherName, pvName, testNodeName, false, finalizers, nil)
+}
+
+func TestQuotaTracker(t *testing.T) {
+	pvIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	vaIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, pv := range []*v1.PersistentVolume{
+		quotaPV("gold-1", "gold", "tenant-a"),
+		quotaPV("gold-2", "gold", "tenant-b"),
+		quotaPV("gold-3", "gold", "tenant-b"),
+		quotaPV("silver-1", "silver", "tenant-a"),
+		quotaPV("silver-2", "silver", "tenant-a"),
+	} {
+		pvIndexer.Add(pv)
+	}
+	attached := quotaVA("gold-1", fin)
+	otherDriver := quotaVA("gold-2", "external-attacher/csi-other")
+	otherDriver.Spec.Attacher = "csi/other"
+	vaIndexer.Add(attached)
+	vaIndexer.Add(otherDriver)
+
+	fakeClock := clock.NewFakeClock(time.Now())
+	quotas := AttachQuotas{StorageClasses: map[string]int{"gold": 2}, Namespaces: map[string]int{"tenant-a": 2}}
+	tracker := newQuotaTracker(quotas, testAttacherName, storagelisters.NewVolumeAttachmentLister(vaIndexer), corelisters.NewPersistentVolumeLister(pvIndexer), fakeClock)
+	admit := func(pvName string) error {
+		pv, err := tracker.pvLister.Get(pvName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tracker.admit(quotaVA(pvName, ""), pv)
+	}
+
+	// gold-1 is attached, VolumeAttachments of other drivers don't count.
+	if err := admit("gold-2"); err != nil {
+		t.Errorf("gold-2: unexpected error: %v", err)
+	}
+	// gold-2 is reserved even though the informer does not have its
+	// finalizer yet.
+	err := admit("gold-3")
+	if !isQuotaExceeded(err) {
+		t.Fatalf("gold-3: expected exceeded quota, got %v", err)
+	}
+	expected := `attach quota of storageclass "gold" exceeded, 2 of 2 volumes are attached`
+	if err.Error() != expected {
+		t.Errorf("gold-3: expected error %q, got %q", expected, err)
+	}
+	// A retry of an admitted attach is admitted.
+	if err := admit("gold-2"); err != nil {
+		t.Errorf("gold-2 retry: unexpected error: %v", err)
+	}
+	// The volume with the finalizer keeps its place.
+	if err := tracker.admit(attached, quotaPV("gold-1", "gold", "tenant-a")); err != nil {
+		t.Errorf("gold-1: unexpected error: %v", err)
+	}
+
+	// tenant-a has gold-1 attached.
+	if err := admit("silver-1"); err != nil {
+		t.Errorf("silver-1: unexpected error: %v", err)
+	}
+	if err := admit("silver-2"); !isQuotaExceeded(err) {
+		t.Errorf("silver-2: expected exceeded quota, got %v", err)
+	}
+
+	// Reservations of attaches that never got the finalizer expire.
+	fakeClock.Step(quotaReservationTTL + time.Second)
+	if err := admit("gold-3"); err != nil {
+		t.Errorf("gold-3 after expiration: unexpected error: %v", err)
+	}
+
+	// Detached volumes free their place.
+	vaIndexer.Delete(attached)
+	if err := admit("silver-2"); err != nil {
+		t.Errorf("silver-2 after detach: unexpected error: %v", err)
+	}
+}
+
+func quotaHandlerFactory(quotas AttachQuotas) handlerFactory {
+	return func(client kubernetes.Interface, informerFactory informers.SharedInformerFactory, csi attacher.Attacher) Handler {
+		handler := csiHandlerFactory(client, informerFactory, csi)
+		h := handler.(*csiHandler)
+		h.quotas = newQuotaTracker(quotas, testAttacherName, h.vaLister, h.pvLister, clock.RealClock{})
+		return handler
+	}
+}
+
+func TestResolveVolumeDoesNotAdmit(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+	informerFactory.Core().V1().PersistentVolumes().Informer().GetStore().Add(quotaPV("gold-1", "gold", ""))
+	h := quotaHandlerFactory(AttachQuotas{StorageClasses: map[string]int{"gold": 1}})(client, informerFactory, nil).(*csiHandler)
+
+	// Inputs of ControllerPublish are resolved without a reservation.
+	if err := h.resolveVolume(&attachState{va: quotaVA("gold-1", "")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(h.quotas.reservations) != 0 {
+		t.Errorf("expected no reservation after resolveVolume, got %v", h.quotas.reservations)
+	}
+
+	if err := h.resolvePV(&attachState{va: quotaVA("gold-1", "")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(h.quotas.reservations) != 1 {
+		t.Errorf("expected a reservation after resolvePV, got %v", h.quotas.reservations)
+	}
+}
+
+func TestWrapQuotaExceededError(t *testing.T) {
+	err := wrapError("failed to attach", &quotaExceededError{msg: `attach quota of storageclass "gold" exceeded, 2 of 2 volumes are attached`})
+	if !isQuotaExceeded(err) {
+		t.Errorf("expected quota exceeded error, got %v", err)
+	}
+	if expected := `failed to attach: attach quota of storageclass "gold" exceeded, 2 of 2 volumes are attached`; err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+}
+
+func TestCSIHandlerAttachQuotas(t *testing.T) {
+	vaGroupResourceVersion := schema.GroupVersionResource{
+		Group:    storage.GroupName,
+		Version:  "v1beta1",
+		Resource: "volumeattachments",
+	}
+	goldPV := pvWithFinalizer()
+	goldPV.Spec.StorageClassName = "gold"
+
+	runTests(t, quotaHandlerFactory(AttachQuotas{StorageClasses: map[string]int{"gold": 0}}), []testCase{
+		{
+			name:             "attach over quota -> waits without CSI call",
+			initialObjects:   []runtime.Object{goldPV, node()},
+			addedVA:          va(false, "", nil),
+			expectedActions:  []core.Action{},
+			expectedCSICalls: []csiCall{},
+			expectedEvents: []string{
+				"Normal AttachStarted Attaching volume to node node1",
+				`Warning AttachQuotaExceeded Attach of volume to node node1 waits: attach quota of storageclass "gold" exceeded, 0 of 0 volumes are attached`,
+			},
+		},
+		{
+			name:           "attach in progress -> not limited",
+			initialObjects: []runtime.Object{goldPV, node()},
+			addedVA:        va(false, fin, ann),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false /*attached*/, fin, ann), va(true /*attached*/, fin, ann))),
+			},
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, nil, nil, false, nil, false, nil, 0},
+			},
+		},
+	})
+}
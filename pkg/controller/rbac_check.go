@@ -0,0 +1,162 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"fmt"
+
+	authorization "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Permission is an API request the attacher needs to be allowed to make.
+type Permission struct {
+	Verb     string
+	Group    string
+	Resource string
+	// Namespace of namespaced resources, empty for cluster scoped ones or
+	// for all namespaces.
+	Namespace string
+	// Name limits the permission to one object.
+	Name string
+	// Reason is what the attacher needs the permission for.
+	Reason string
+	// Optional permissions are needed only by some PVs or drivers, the
+	// attacher works without them otherwise.
+	Optional bool
+}
+
+func (p Permission) String() string {
+	resource := p.Resource
+	if p.Group != "" {
+		resource += "." + p.Group
+	}
+	if p.Name != "" {
+		resource += " " + p.Name
+	}
+	if p.Namespace != "" {
+		resource += " in namespace " + p.Namespace
+	}
+	return fmt.Sprintf("%s %s", p.Verb, resource)
+}
+
+// RequiredPermissions returns permissions of controllers created with given
+// options in the cluster with VolumeAttachments.
+func RequiredPermissions(options Options) []Permission {
+	var permissions []Permission
+	add := func(group, resource, namespace, reason string, optional bool, verbs ...string) {
+		for _, verb := range verbs {
+			permissions = append(permissions, Permission{
+				Verb:      verb,
+				Group:     group,
+				Resource:  resource,
+				Namespace: namespace,
+				Reason:    reason,
+				Optional:  optional,
+			})
+		}
+	}
+	// The status of VolumeAttachments is patched together with their
+	// finalizers through the main resource.
+	add("storage.k8s.io", "volumeattachments", "", "watching VolumeAttachments and saving their finalizers and status", false, "get", "list", "watch", "update", "patch")
+	add("", "persistentvolumes", "", "watching PVs and saving their finalizers", false, "get", "list", "watch", "update", "patch")
+	nodeVerbs := []string{"get", "list", "watch"}
+	if options.OnDemandNodes {
+		nodeVerbs = []string{"get"}
+	}
+	add("", "nodes", "", "finding IDs of nodes in the CSI driver", false, nodeVerbs...)
+	add("storage.k8s.io", "csinodes", "", "finding IDs of nodes in the CSI driver", false, nodeVerbs...)
+	add("storage.k8s.io", "csidrivers", "", "reading attachRequired of CSIDriver objects", false, "get", "list", "watch")
+	if options.watchesStorageClasses() {
+		add("storage.k8s.io", "storageclasses", "", "reading timeout annotations and publish parameters of StorageClasses", false, "get", "list", "watch")
+	}
+	// Events of cluster scoped VolumeAttachments are in the default
+	// namespace, events of PVCs in their namespaces.
+	eventsNamespace := metav1.NamespaceDefault
+	if options.PVCEvents {
+		eventsNamespace = ""
+	}
+	if options.EventsLevel != EventsNone {
+		add("", "events", eventsNamespace, "emitting events", false, "create", "patch")
+	}
+	if len(options.AllowedSecretNamespaces) == 0 {
+		add("", "secrets", "", "reading controllerPublishSecretRef of PVs", true, "get")
+	}
+	for _, namespace := range options.AllowedSecretNamespaces {
+		add("", "secrets", namespace, "reading controllerPublishSecretRef of PVs", true, "get")
+	}
+	return permissions
+}
+
+// CheckPermissions asks the API server with SelfSubjectAccessReviews
+// whether the attacher is allowed to make the requests and returns the
+// permissions that are denied.
+func CheckPermissions(client kubernetes.Interface, permissions []Permission) ([]Permission, error) {
+	var denied []Permission
+	for _, p := range permissions {
+		review := &authorization.SelfSubjectAccessReview{
+			Spec: authorization.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorization.ResourceAttributes{
+					Verb:      p.Verb,
+					Group:     p.Group,
+					Resource:  p.Resource,
+					Namespace: p.Namespace,
+					Name:      p.Name,
+				},
+			},
+		}
+		result, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(review)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check permission to %s: %v", p, err)
+		}
+		if !result.Status.Allowed {
+			denied = append(denied, p)
+		}
+	}
+	return denied, nil
+}
+
+// PermissionsReport describes denied permissions, one per line, required
+// ones first.
+func PermissionsReport(denied []Permission) string {
+	var buf bytes.Buffer
+	for _, optional := range []bool{false, true} {
+		for _, p := range denied {
+			if p.Optional != optional {
+				continue
+			}
+			kind := "missing"
+			if optional {
+				kind = "missing (optional)"
+			}
+			fmt.Fprintf(&buf, "  %s: %s, needed for %s\n", kind, p, p.Reason)
+		}
+	}
+	return buf.String()
+}
+
+// HasRequired returns true when any of the permissions is not optional.
+func HasRequired(permissions []Permission) bool {
+	for _, p := range permissions {
+		if !p.Optional {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"testing"
+
+	authorization "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+)
+
+// reviewReactor allows all requests except the denied resources.
+func reviewReactor(denied ...string) core.ReactionFunc {
+	return func(action core.Action) (bool, runtime.Object, error) {
+		review := action.(core.CreateAction).GetObject().(*authorization.SelfSubjectAccessReview)
+		review.Status.Allowed = true
+		for _, resource := range denied {
+			if review.Spec.ResourceAttributes.Resource == resource {
+				review.Status.Allowed = false
+			}
+		}
+		return true, review, nil
+	}
+}
+
+func TestCheckPermissions(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "selfsubjectaccessreviews", reviewReactor("csinodes", "secrets"))
+
+	denied, err := CheckPermissions(client, RequiredPermissions(DefaultOptions()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(denied) != 4 {
+		t.Fatalf("expected 3 denied csinodes permissions and 1 secrets permission, got %v", denied)
+	}
+	if !HasRequired(denied) {
+		t.Errorf("expected denied required permissions")
+	}
+	expected := "  missing: get csinodes.storage.k8s.io, needed for finding IDs of nodes in the CSI driver\n" +
+		"  missing: list csinodes.storage.k8s.io, needed for finding IDs of nodes in the CSI driver\n" +
+		"  missing: watch csinodes.storage.k8s.io, needed for finding IDs of nodes in the CSI driver\n" +
+		"  missing (optional): get secrets, needed for reading controllerPublishSecretRef of PVs\n"
+	if report := PermissionsReport(denied); report != expected {
+		t.Errorf("expected report\n%s\ngot\n%s", expected, report)
+	}
+	if HasRequired(denied[3:]) {
+		t.Errorf("expected only optional permissions")
+	}
+}
+
+func TestCheckPermissionsError(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action core.Action) (bool, runtime.Object, error) {
+		// The fake client panics on a nil object.
+		return true, &authorization.SelfSubjectAccessReview{}, errors.New("mock error")
+	})
+	if _, err := CheckPermissions(client, RequiredPermissions(DefaultOptions())); err == nil {
+		t.Errorf("expected error, got none")
+	}
+}
+
+func TestRequiredPermissionsEvents(t *testing.T) {
+	options := DefaultOptions()
+	for _, pvcEvents := range []bool{false, true} {
+		options.PVCEvents = pvcEvents
+		for _, p := range RequiredPermissions(options) {
+			if p.Resource != "events" {
+				continue
+			}
+			if pvcEvents && p.Namespace != "" {
+				t.Errorf("expected events in all namespaces with PVC events, got %s", p)
+			}
+			if !pvcEvents && p.Namespace != "default" {
+				t.Errorf("expected events in the default namespace, got %s", p)
+			}
+		}
+	}
+}
+
+func TestRequiredPermissionsLeastPrivilege(t *testing.T) {
+	options := DefaultOptions()
+	options.EventsLevel = EventsNone
+	options.OnDemandNodes = true
+	for _, p := range RequiredPermissions(options) {
+		switch p.Resource {
+		case "events":
+			t.Errorf("expected no events permission with events level none, got %s", p)
+		case "nodes", "csinodes":
+			if p.Verb != "get" {
+				t.Errorf("expected only get of nodes with on-demand nodes, got %s", p)
+			}
+		}
+	}
+}
+
+func TestRequiredPermissionsAllowedSecretNamespaces(t *testing.T) {
+	options := DefaultOptions()
+	options.AllowedSecretNamespaces = []string{"kube-system", "storage"}
+	var namespaces []string
+	for _, p := range RequiredPermissions(options) {
+		if p.Resource == "secrets" {
+			namespaces = append(namespaces, p.Namespace)
+		}
+	}
+	if len(namespaces) != 2 || namespaces[0] != "kube-system" || namespaces[1] != "storage" {
+		t.Errorf("expected secrets in kube-system and storage, got %v", namespaces)
+	}
+}
+
+func TestRequiredPermissionsVolumeTimeoutAnnotations(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		options := DefaultOptions()
+		options.VolumeTimeoutAnnotations = enabled
+		var verbs []string
+		for _, p := range RequiredPermissions(options) {
+			if p.Resource == "storageclasses" {
+				verbs = append(verbs, p.Verb)
+			}
+		}
+		if enabled && len(verbs) != 3 {
+			t.Errorf("expected get, list and watch of storageclasses, got %v", verbs)
+		}
+		if !enabled && len(verbs) != 0 {
+			t.Errorf("expected no storageclasses permission, got %v", verbs)
+		}
+	}
+}
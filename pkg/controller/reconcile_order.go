@@ -0,0 +1,66 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+// Priority levels of VolumeAttachments in the queue of the controller.
+const (
+	priorityDrainingDetach = iota
+	priorityDetach
+	priorityAttach
+	priorityAttached
+	priorityLevels
+)
+
+// prioritizeByState makes the controller process VolumeAttachments that are
+// being deleted first, then the ones that are not attached and the attached
+// ones last, instead of in the order they were queued. After the controller
+// starts, e.g. after a leader failover, the queue holds all
+// VolumeAttachments and detaches and attaches that pods wait for finish
+// before the verification of the attached ones. It must be called before Run.
+func (ctrl *CSIAttachController) prioritizeByState() {
+	ctrl.orderByState = true
+	ctrl.usePriorityQueue()
+}
+
+// usePriorityQueue replaces the VolumeAttachment queue by a priorityQueue
+// with vaPriority.
+func (ctrl *CSIAttachController) usePriorityQueue() {
+	ctrl.vaQueue = newDeferringQueue(newPriorityQueue(ctrl.vaRateLimiter, priorityLevels, ctrl.vaPriority), ctrl.clock)
+	ctrl.handler.Init(ctrl.vaQueue, ctrl.pvQueue)
+}
+
+// vaPriority returns the priority level of a queued VolumeAttachment.
+func (ctrl *CSIAttachController) vaPriority(item interface{}) int {
+	va, err := ctrl.vaLister.Get(item.(string))
+	if err != nil {
+		// Deleted, there's little to do.
+		return priorityAttached
+	}
+	if ctrl.drainingDetach != nil && ctrl.drainingDetach(va) {
+		return priorityDrainingDetach
+	}
+	switch {
+	case !ctrl.orderByState:
+		return priorityAttached
+	case va.DeletionTimestamp != nil:
+		return priorityDetach
+	case !va.Status.Attached:
+		return priorityAttach
+	default:
+		return priorityAttached
+	}
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestPrioritizeByState(t *testing.T) {
+	attached := createVolumeAttachment(testAttacherName, "attached", testNodeName, true, fin, nil)
+	attach := createVolumeAttachment(testAttacherName, "attach", testNodeName, false, "", nil)
+	detach := deleted(createVolumeAttachment(testAttacherName, "detach", testNodeName, true, fin, nil))
+	drainedDetach := deleted(createVolumeAttachment(testAttacherName, "drained", "node2", true, fin, nil))
+
+	client := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(client, 0)
+	vaInformer := factory.Storage().V1beta1().VolumeAttachments()
+	pvInformer := factory.Core().V1().PersistentVolumes()
+	for _, va := range []interface{}{attached, attach, detach, drainedDetach} {
+		vaInformer.Informer().GetStore().Add(va)
+	}
+
+	handler := &recordingHandler{vas: sets.NewString(), pvs: sets.NewString()}
+	ctrl := NewCSIAttachController(client, testAttacherName, handler, vaInformer, pvInformer, workqueue.DefaultControllerRateLimiter(), workqueue.DefaultControllerRateLimiter(), 0, nil)
+	ctrl.drainingDetach = func(va *storage.VolumeAttachment) bool {
+		return va.DeletionTimestamp != nil && va.Spec.NodeName == "node2"
+	}
+	ctrl.prioritizeByState()
+	for _, name := range []string{attached.Name, attach.Name, detach.Name, drainedDetach.Name, "missing"} {
+		ctrl.vaQueue.Add(name)
+	}
+
+	var got []string
+	for ctrl.vaQueue.Len() > 0 {
+		item, _ := ctrl.vaQueue.Get()
+		got = append(got, item.(string))
+		ctrl.vaQueue.Done(item)
+	}
+	expected := []string{drainedDetach.Name, detach.Name, attach.Name, attached.Name, "missing"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected order %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+)
+
+// selectsVA returns true when va matches the VolumeAttachment selector of the
+// controller and its PersistentVolume matches the PersistentVolume selector.
+// VolumeAttachments created by Kubernetes have no labels, so the
+// PersistentVolume selector is usually what scopes them.
+func (ctrl *CSIAttachController) selectsVA(va *storage.VolumeAttachment) bool {
+	if ctrl.vaSelector != nil && !ctrl.vaSelector.Matches(labels.Set(va.Labels)) {
+		return false
+	}
+	if ctrl.pvSelector == nil || va.Spec.Source.PersistentVolumeName == nil {
+		return true
+	}
+	pv, err := ctrl.pvLister.Get(*va.Spec.Source.PersistentVolumeName)
+	if err != nil {
+		// Without its PV, the VolumeAttachment can't be attached or
+		// detached by any attacher.
+		klog.V(4).Infof("Cannot get PV %q of VA %q to match label selector: %v", *va.Spec.Source.PersistentVolumeName, va.Name, err)
+		return false
+	}
+	return ctrl.selectsPV(pv)
+}
+
+// selectsPV returns true when pv matches the PersistentVolume selector of the
+// controller.
+func (ctrl *CSIAttachController) selectsPV(pv *v1.PersistentVolume) bool {
+	return ctrl.pvSelector == nil || ctrl.pvSelector.Matches(labels.Set(pv.Labels))
+}
+
+// enqueueVAsOfPV enqueues VolumeAttachments of a PersistentVolume whose
+// labels changed, so they are processed by the controller that selects them
+// now.
+func (ctrl *CSIAttachController) enqueueVAsOfPV(pvName string) {
+	vas, err := ctrl.vaLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list VolumeAttachments: %v", err)
+		return
+	}
+	for _, va := range vas {
+		if va.Spec.Source.PersistentVolumeName != nil && *va.Spec.Source.PersistentVolumeName == pvName {
+			ctrl.vaQueue.Add(va.Name)
+		}
+	}
+}
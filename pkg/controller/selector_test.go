@@ -0,0 +1,157 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestLabelSelectors(t *testing.T) {
+	newPV := func(name string, lbls map[string]string) *v1.PersistentVolume {
+		pv := pv()
+		pv.Name = name
+		pv.Labels = lbls
+		return pv
+	}
+	newVA := func(name, pvName string, lbls map[string]string) *storage.VolumeAttachment {
+		va := createVolumeAttachment(testAttacherName, pvName, testNodeName, false, "", nil)
+		va.Name = name
+		va.Labels = lbls
+		return va
+	}
+	green := map[string]string{"rollout": "green"}
+	pvs := []*v1.PersistentVolume{newPV("green", green), newPV("blue", nil)}
+	inline := vaWithInlineSpec(newVA("inline", "", nil))
+	vas := []*storage.VolumeAttachment{
+		newVA("green", "green", nil),
+		newVA("blue", "blue", nil),
+		newVA("green-labeled", "green", green),
+		newVA("missing-pv", "missing", nil),
+		inline,
+	}
+
+	tests := []struct {
+		name        string
+		vaSelector  string
+		pvSelector  string
+		expectedVAs []string
+		expectedPVs []string
+	}{
+		{
+			name:        "no selectors",
+			expectedVAs: []string{"blue", "green", "green-labeled", "inline", "missing-pv"},
+			expectedPVs: []string{"blue", "green"},
+		},
+		{
+			name:        "PV selector",
+			pvSelector:  "rollout=green",
+			expectedVAs: []string{"green", "green-labeled", "inline"},
+			expectedPVs: []string{"green"},
+		},
+		{
+			name:        "PV selector without label",
+			pvSelector:  "!rollout",
+			expectedVAs: []string{"blue", "inline"},
+			expectedPVs: []string{"blue"},
+		},
+		{
+			name:        "VA selector",
+			vaSelector:  "rollout=green",
+			expectedVAs: []string{"green-labeled"},
+			expectedPVs: []string{"blue", "green"},
+		},
+	}
+	for _, test := range tests {
+		client := fake.NewSimpleClientset()
+		factory := informers.NewSharedInformerFactory(client, 0)
+		vaInformer := factory.Storage().V1beta1().VolumeAttachments()
+		pvInformer := factory.Core().V1().PersistentVolumes()
+		for _, va := range vas {
+			vaInformer.Informer().GetStore().Add(va)
+		}
+		for _, pv := range pvs {
+			pvInformer.Informer().GetStore().Add(pv)
+		}
+		handler := &recordingHandler{vas: sets.NewString(), pvs: sets.NewString()}
+		ctrl := NewCSIAttachController(client, testAttacherName, handler, vaInformer, pvInformer, workqueue.DefaultControllerRateLimiter(), workqueue.DefaultControllerRateLimiter(), 0, nil)
+		if test.vaSelector != "" {
+			selector, err := labels.Parse(test.vaSelector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctrl.vaSelector = selector
+		}
+		if test.pvSelector != "" {
+			selector, err := labels.Parse(test.pvSelector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctrl.pvSelector = selector
+		}
+
+		ctrl.enqueueAll()
+		for ctrl.vaQueue.Len() > 0 {
+			ctrl.syncVA()
+		}
+		for ctrl.pvQueue.Len() > 0 {
+			ctrl.syncPV()
+		}
+		if !handler.vas.Equal(sets.NewString(test.expectedVAs...)) {
+			t.Errorf("%s: expected VAs %v to be processed, got %v", test.name, test.expectedVAs, handler.vas.List())
+		}
+		if !handler.pvs.Equal(sets.NewString(test.expectedPVs...)) {
+			t.Errorf("%s: expected PVs %v to be processed, got %v", test.name, test.expectedPVs, handler.pvs.List())
+		}
+	}
+}
+
+func TestLabelSelectorPVRelabeled(t *testing.T) {
+	oldPV := pv()
+	newPV := oldPV.DeepCopy()
+	newPV.Labels = map[string]string{"rollout": "green"}
+	newPV.ResourceVersion = "2"
+
+	client := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(client, 0)
+	vaInformer := factory.Storage().V1beta1().VolumeAttachments()
+	pvInformer := factory.Core().V1().PersistentVolumes()
+	vaInformer.Informer().GetStore().Add(va(false, "", nil))
+	handler := &recordingHandler{vas: sets.NewString(), pvs: sets.NewString()}
+	ctrl := NewCSIAttachController(client, testAttacherName, handler, vaInformer, pvInformer, workqueue.DefaultControllerRateLimiter(), workqueue.DefaultControllerRateLimiter(), 0, nil)
+	ctrl.pvSelector = labels.SelectorFromSet(labels.Set{"rollout": "green"})
+
+	// Unchanged labels enqueue only the PV.
+	ctrl.pvUpdated(oldPV, oldPV)
+	if ctrl.vaQueue.Len() != 0 {
+		t.Errorf("expected no VA to be enqueued, got %d", ctrl.vaQueue.Len())
+	}
+	ctrl.pvUpdated(oldPV, newPV)
+	if ctrl.vaQueue.Len() != 1 {
+		t.Fatalf("expected VA of the relabeled PV to be enqueued, got %d", ctrl.vaQueue.Len())
+	}
+	if key, _ := ctrl.vaQueue.Get(); key.(string) != testPVName+"-"+testNodeName {
+		t.Errorf("expected VA %q to be enqueued, got %q", testPVName+"-"+testNodeName, key)
+	}
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/klog"
+)
+
+// SkipAttachAnnotation is the VolumeAttachment and PersistentVolume
+// annotation that marks a volume as attached out of band, e.g. by a system
+// that configures the storage fabric. Its VolumeAttachments are then handled
+// by the trivial handler, without ControllerPublish and ControllerUnpublish.
+const SkipAttachAnnotation = "csi.alpha.kubernetes.io/skip-attach"
+
+// skipAttach returns true when va or its PV has SkipAttachAnnotation "true".
+func (h *csiDriverHandler) skipAttach(va *storage.VolumeAttachment) bool {
+	if !h.skipAttachAnnotation {
+		return false
+	}
+	if va.Annotations[SkipAttachAnnotation] == "true" {
+		klog.V(4).Infof("%q has annotation %s, skipping attach", va.Name, SkipAttachAnnotation)
+		return true
+	}
+	if va.Spec.Source.PersistentVolumeName == nil {
+		return false
+	}
+	pv, err := h.pvLister.Get(*va.Spec.Source.PersistentVolumeName)
+	if err != nil {
+		// The CSI handler reports missing PVs.
+		return false
+	}
+	if pv.Annotations[SkipAttachAnnotation] == "true" {
+		klog.V(4).Infof("PersistentVolume %q of %q has annotation %s, skipping attach", pv.Name, va.Name, SkipAttachAnnotation)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCSIDriverHandlerSkipAttach(t *testing.T) {
+	skipAnn := map[string]string{SkipAttachAnnotation: "true"}
+	plain := va(false, "", nil)
+	plain.Name = "plain"
+	annotated := va(false, "", skipAnn)
+	annotated.Name = "annotated"
+	invalid := va(false, "", map[string]string{SkipAttachAnnotation: "yes"})
+	invalid.Name = "invalid"
+	annotatedPV := createVolumeAttachment(testAttacherName, "pv-skip", testNodeName, false, "", nil)
+	// A volume attached by the CSI handler before it got the annotation is
+	// still detached by the CSI handler.
+	attached := va(true, fin, skipAnn)
+	attached.Name = "attached"
+	skipPV := pv()
+	skipPV.Name = "pv-skip"
+	skipPV.Annotations = skipAnn
+
+	tests := []struct {
+		name            string
+		enabled         bool
+		expectedCSI     []string
+		expectedTrivial []string
+	}{
+		{
+			name:        "disabled",
+			expectedCSI: []string{"annotated", "attached", "invalid", "plain", "pv-skip-node1"},
+		},
+		{
+			name:            "enabled",
+			enabled:         true,
+			expectedCSI:     []string{"attached", "invalid", "plain"},
+			expectedTrivial: []string{"annotated", "pv-skip-node1"},
+		},
+	}
+	for _, test := range tests {
+		client := fake.NewSimpleClientset()
+		factory := informers.NewSharedInformerFactory(client, 0)
+		factory.Core().V1().PersistentVolumes().Informer().GetStore().Add(skipPV)
+		csiHandler := &recordingHandler{vas: sets.NewString(), pvs: sets.NewString()}
+		trivialHandler := &recordingHandler{vas: sets.NewString(), pvs: sets.NewString()}
+		h := NewCSIDriverHandler(testAttacherName, csiHandler, trivialHandler, factory.Storage().V1beta1().CSIDrivers(), factory.Storage().V1beta1().VolumeAttachments().Lister()).(*csiDriverHandler)
+		h.skipAttachAnnotation = test.enabled
+		h.pvLister = factory.Core().V1().PersistentVolumes().Lister()
+
+		for _, va := range []*storage.VolumeAttachment{plain, annotated, invalid, annotatedPV, attached} {
+			h.SyncNewOrUpdatedVolumeAttachment(va)
+		}
+		if !csiHandler.vas.Equal(sets.NewString(test.expectedCSI...)) || !trivialHandler.vas.Equal(sets.NewString(test.expectedTrivial...)) {
+			t.Errorf("%s: expected csi %v, trivial %v, got csi %v, trivial %v", test.name, test.expectedCSI, test.expectedTrivial, csiHandler.vas.List(), trivialHandler.vas.List())
+		}
+	}
+}
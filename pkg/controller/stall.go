@@ -0,0 +1,111 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// maxStallCheckInterval is the longest period of checking whether workers
+// are stalled.
+const maxStallCheckInterval = 10 * time.Second
+
+// stallCheckInterval returns the period of checking for stalled workers
+// with given threshold.
+func stallCheckInterval(threshold time.Duration) time.Duration {
+	if interval := threshold / 4; interval < maxStallCheckInterval {
+		return interval
+	}
+	return maxStallCheckInterval
+}
+
+// stallWatchdog detects a wedged controller: objects wait in its queues, but
+// no worker finished processing of any object for longer than a threshold,
+// e.g. because all workers are stuck in a deadlock.
+type stallWatchdog struct {
+	threshold time.Duration
+
+	lock sync.Mutex
+	// processed is the number of processed objects at progressAt.
+	processed  uint64
+	progressAt time.Time
+	// err describes the stall, nil when the workers are not stalled.
+	err error
+}
+
+// check records the number of queued objects and the number of processed
+// objects at time now. It returns true when the workers became stalled.
+func (w *stallWatchdog) check(queued int, processed uint64, now time.Time) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if queued == 0 || processed != w.processed || w.progressAt.IsZero() {
+		w.processed = processed
+		w.progressAt = now
+		w.err = nil
+		return false
+	}
+	stalledFor := now.Sub(w.progressAt)
+	if stalledFor <= w.threshold {
+		return false
+	}
+	wasStalled := w.err != nil
+	w.err = fmt.Errorf("%d objects are queued, but no object was processed for %s", queued, stalledFor.Round(time.Second))
+	return !wasStalled
+}
+
+// stalled returns an error while the workers are stalled.
+func (w *stallWatchdog) stalled() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.err
+}
+
+// reset forgets the progress, e.g. when the controller stops.
+func (w *stallWatchdog) reset() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.processed = 0
+	w.progressAt = time.Time{}
+	w.err = nil
+}
+
+// markProcessed records that a worker finished processing of an object,
+// whatever the result.
+func (ctrl *CSIAttachController) markProcessed() {
+	atomic.AddUint64(&ctrl.processed, 1)
+}
+
+// checkStall checks whether workers of the driver are stalled. When they
+// become stalled, it logs stacks of all goroutines, so the cause can be
+// found after the attacher is restarted by its liveness probe.
+func (d *Driver) checkStall() {
+	vaQueued, pvQueued := d.ctrl.vaQueue.Len(), d.ctrl.pvQueue.Len()
+	if !d.stall.check(vaQueued+pvQueued, atomic.LoadUint64(&d.ctrl.processed), d.clock.Now()) {
+		return
+	}
+	workqueueStallsTotal.WithLabelValues(d.name).Inc()
+	var stacks bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&stacks, 2)
+	klog.Errorf("Workers of CSI driver %q are stalled: %v (%d VolumeAttachments, %d PersistentVolumes queued). Goroutines:\n%s", d.name, d.stall.stalled(), vaQueued, pvQueued, stacks.String())
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStallCheckInterval(t *testing.T) {
+	if interval := stallCheckInterval(20 * time.Second); interval != 5*time.Second {
+		t.Errorf("expected 5s, got %s", interval)
+	}
+	if interval := stallCheckInterval(10 * time.Minute); interval != maxStallCheckInterval {
+		t.Errorf("expected %s, got %s", maxStallCheckInterval, interval)
+	}
+}
+
+func TestStallWatchdog(t *testing.T) {
+	w := &stallWatchdog{threshold: time.Minute}
+	now := time.Date(2019, 10, 14, 12, 0, 0, 0, time.UTC)
+	expectStalled := func(stalled bool) {
+		t.Helper()
+		if err := w.stalled(); (err != nil) != stalled {
+			t.Errorf("expected stalled %t, got error %v", stalled, err)
+		}
+	}
+
+	// Empty queues are never stalled.
+	w.check(0, 0, now)
+	if w.check(0, 0, now.Add(time.Hour)) {
+		t.Errorf("expected empty queues not to stall")
+	}
+	expectStalled(false)
+
+	// Queued objects without progress stall after the threshold.
+	now = now.Add(time.Hour)
+	if w.check(3, 0, now.Add(30*time.Second)) {
+		t.Errorf("expected no stall before the threshold")
+	}
+	if !w.check(3, 0, now.Add(2*time.Minute)) {
+		t.Errorf("expected stall after the threshold")
+	}
+	expectStalled(true)
+	// The stall is reported only once.
+	if w.check(3, 0, now.Add(3*time.Minute)) {
+		t.Errorf("expected the stall to be reported once")
+	}
+	expectStalled(true)
+
+	// Progress clears the stall.
+	now = now.Add(3 * time.Minute)
+	if w.check(3, 1, now) {
+		t.Errorf("expected progress to clear the stall")
+	}
+	expectStalled(false)
+	if w.check(2, 1, now.Add(30*time.Second)) {
+		t.Errorf("expected no stall before the threshold")
+	}
+
+	w.reset()
+	expectStalled(false)
+}
+
+func TestDriverLive(t *testing.T) {
+	d := &Driver{name: "csi/test"}
+	if err := d.Live(); err != nil {
+		t.Errorf("expected live without stall check, got %v", err)
+	}
+	d.stall = &stallWatchdog{threshold: time.Minute}
+	now := time.Now()
+	d.stall.check(1, 0, now)
+	d.stall.check(1, 0, now.Add(2*time.Minute))
+	if err := d.Live(); err == nil {
+		t.Errorf("expected stalled driver not to be live")
+	}
+}
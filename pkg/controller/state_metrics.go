@@ -0,0 +1,131 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sort"
+
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/apimachinery/pkg/labels"
+	storageinformers "k8s.io/client-go/informers/storage/v1beta1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/metrics"
+)
+
+// States of VolumeAttachments reported by NewVolumeAttachmentStateMetric.
+const (
+	vaStateAttached    = "attached"
+	vaStateAttaching   = "attaching"
+	vaStateAttachError = "attach_error"
+	vaStateDetaching   = "detaching"
+	vaStateDetachError = "detach_error"
+)
+
+var vaStates = []string{vaStateAttached, vaStateAttaching, vaStateAttachError, vaStateDetaching, vaStateDetachError}
+
+// NewVolumeAttachmentStateMetric returns a metric with number of
+// VolumeAttachments of each of the attachers returned by attacherNames in each
+// state, computed from the informer cache on each scrape. Nothing is reported
+// until the cache is synced. VolumeAttachments are partitioned also by
+// StorageClass of their PV from pvLister, with values from classes.
+func NewVolumeAttachmentStateMetric(attacherNames func() []string, informer storageinformers.VolumeAttachmentInformer, pvLister corelisters.PersistentVolumeLister, classes *StorageClassLabels) *metrics.GaugeVecFunc {
+	lister := informer.Lister()
+	synced := informer.Informer().HasSynced
+	return metrics.NewGaugeVecFunc(
+		metrics.Namespace+"_volumeattachments",
+		"Number of VolumeAttachments handled by the attacher in each state, partitioned by StorageClass of the volume, as seen by the informer cache.",
+		func() []metrics.LabeledValue {
+			if !synced() {
+				return nil
+			}
+			vas, err := lister.List(labels.Everything())
+			if err != nil {
+				klog.Errorf("Failed to list VolumeAttachments: %v", err)
+				return nil
+			}
+			names := attacherNames()
+			// Counts by attacher, StorageClass and state.
+			counts := map[string]map[string]map[string]float64{}
+			for _, name := range names {
+				counts[name] = map[string]map[string]float64{}
+			}
+			for _, va := range vas {
+				c, found := counts[va.Spec.Attacher]
+				if !found {
+					continue
+				}
+				class := vaStorageClass(va, pvLister, classes)
+				if c[class] == nil {
+					c[class] = map[string]float64{}
+				}
+				c[class][VolumeAttachmentState(va)]++
+			}
+			var values []metrics.LabeledValue
+			for _, name := range names {
+				if len(counts[name]) == 0 {
+					// Report zeros of attachers without VolumeAttachments.
+					counts[name][""] = map[string]float64{}
+				}
+				var classNames []string
+				for class := range counts[name] {
+					classNames = append(classNames, class)
+				}
+				sort.Strings(classNames)
+				for _, class := range classNames {
+					for _, state := range vaStates {
+						values = append(values, metrics.LabeledValue{LabelValues: []string{name, class, state}, Value: counts[name][class][state]})
+					}
+				}
+			}
+			return values
+		},
+		"attacher", "storageclass", "state")
+}
+
+// vaStorageClass returns the storageclass label value of va. VolumeAttachments
+// of inline volumes and of PVs that are not in pvLister have an empty value.
+func vaStorageClass(va *storage.VolumeAttachment, pvLister corelisters.PersistentVolumeLister, classes *StorageClassLabels) string {
+	if va.Spec.Source.PersistentVolumeName == nil {
+		return ""
+	}
+	pv, err := pvLister.Get(*va.Spec.Source.PersistentVolumeName)
+	if err != nil {
+		return ""
+	}
+	return classes.pvValue(pv)
+}
+
+// VolumeAttachmentState returns the state of va reported by
+// NewVolumeAttachmentStateMetric: "attached", "attaching", "attach_error",
+// "detaching" or "detach_error".
+func VolumeAttachmentState(va *storage.VolumeAttachment) string {
+	if va.DeletionTimestamp != nil {
+		if va.Status.DetachError != nil {
+			return vaStateDetachError
+		}
+		return vaStateDetaching
+	}
+	if va.Status.Attached {
+		return vaStateAttached
+	}
+	if va.Status.AttachError != nil {
+		return vaStateAttachError
+	}
+	return vaStateAttaching
+}
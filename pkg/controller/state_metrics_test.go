@@ -0,0 +1,104 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/metrics"
+)
+
+func TestVolumeAttachmentStateMetric(t *testing.T) {
+	var objs []runtime.Object
+	for i, va := range []*storage.VolumeAttachment{
+		va(true, fin, ann),
+		va(true, fin, ann),
+		va(false, "", nil),
+		vaWithAttachError(va(false, "", nil), "mock error"),
+		deleted(va(true, fin, ann)),
+		vaWithDetachError(deleted(va(true, fin, ann)), "mock error"),
+		createVolumeAttachment("other-attacher", testPVName, testNodeName, true, "", nil),
+		createVolumeAttachment(testAttacherName, "silver-pv", testNodeName, true, "", nil),
+	} {
+		va.Name = fmt.Sprintf("va-%d", i)
+		objs = append(objs, va)
+	}
+	gold := pv()
+	gold.Spec.StorageClassName = "gold"
+	silver := pv()
+	silver.Name = "silver-pv"
+	silver.Spec.StorageClassName = "silver"
+	objs = append(objs, gold, silver)
+
+	client := fake.NewSimpleClientset(objs...)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	informer := factory.Storage().V1beta1().VolumeAttachments()
+	pvLister := factory.Core().V1().PersistentVolumes().Lister()
+	classes := NewStorageClassLabels([]string{"gold"}, 0)
+	metric := NewVolumeAttachmentStateMetric(func() []string { return []string{testAttacherName, "other-attacher", "idle-attacher"} }, informer, pvLister, classes)
+	r := metrics.NewRegistry()
+	r.MustRegister(metric)
+
+	// Nothing is reported before the cache is synced.
+	expected := `# HELP csi_attacher_volumeattachments Number of VolumeAttachments handled by the attacher in each state, partitioned by StorageClass of the volume, as seen by the informer cache.
+# TYPE csi_attacher_volumeattachments gauge
+`
+	buf := &bytes.Buffer{}
+	r.WriteText(buf)
+	if buf.String() != expected {
+		t.Errorf("unexpected output before sync:\n%s", buf.String())
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	factory.Start(stopCh)
+	factory.WaitForCacheSync(stopCh)
+
+	expected += `csi_attacher_volumeattachments{attacher="csi/test",storageclass="gold",state="attach_error"} 1
+csi_attacher_volumeattachments{attacher="csi/test",storageclass="gold",state="attached"} 2
+csi_attacher_volumeattachments{attacher="csi/test",storageclass="gold",state="attaching"} 1
+csi_attacher_volumeattachments{attacher="csi/test",storageclass="gold",state="detach_error"} 1
+csi_attacher_volumeattachments{attacher="csi/test",storageclass="gold",state="detaching"} 1
+csi_attacher_volumeattachments{attacher="csi/test",storageclass="other",state="attach_error"} 0
+csi_attacher_volumeattachments{attacher="csi/test",storageclass="other",state="attached"} 1
+csi_attacher_volumeattachments{attacher="csi/test",storageclass="other",state="attaching"} 0
+csi_attacher_volumeattachments{attacher="csi/test",storageclass="other",state="detach_error"} 0
+csi_attacher_volumeattachments{attacher="csi/test",storageclass="other",state="detaching"} 0
+csi_attacher_volumeattachments{attacher="idle-attacher",storageclass="",state="attach_error"} 0
+csi_attacher_volumeattachments{attacher="idle-attacher",storageclass="",state="attached"} 0
+csi_attacher_volumeattachments{attacher="idle-attacher",storageclass="",state="attaching"} 0
+csi_attacher_volumeattachments{attacher="idle-attacher",storageclass="",state="detach_error"} 0
+csi_attacher_volumeattachments{attacher="idle-attacher",storageclass="",state="detaching"} 0
+csi_attacher_volumeattachments{attacher="other-attacher",storageclass="gold",state="attach_error"} 0
+csi_attacher_volumeattachments{attacher="other-attacher",storageclass="gold",state="attached"} 1
+csi_attacher_volumeattachments{attacher="other-attacher",storageclass="gold",state="attaching"} 0
+csi_attacher_volumeattachments{attacher="other-attacher",storageclass="gold",state="detach_error"} 0
+csi_attacher_volumeattachments{attacher="other-attacher",storageclass="gold",state="detaching"} 0
+`
+	buf.Reset()
+	r.WriteText(buf)
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
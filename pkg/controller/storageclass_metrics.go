@@ -0,0 +1,84 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// StorageClassOther is the value of the "storageclass" label of metrics of
+// volumes whose StorageClass is not labeled separately.
+const StorageClassOther = "other"
+
+// StorageClassLabels limits the values of the "storageclass" label of
+// metrics, so clusters with many StorageClasses don't create too many time
+// series. A nil StorageClassLabels reports all volumes with an empty label.
+type StorageClassLabels struct {
+	allowed sets.String
+	max     int
+
+	lock sync.Mutex
+	seen sets.String
+}
+
+// NewStorageClassLabels returns StorageClassLabels that label volumes of
+// the allowed StorageClasses with the name of their StorageClass. When
+// allowed is empty, the first max StorageClasses seen are labeled instead.
+// Volumes of all other StorageClasses are labeled StorageClassOther.
+func NewStorageClassLabels(allowed []string, max int) *StorageClassLabels {
+	return &StorageClassLabels{
+		allowed: sets.NewString(allowed...),
+		max:     max,
+		seen:    sets.NewString(),
+	}
+}
+
+// Value returns the label value of StorageClass class. Volumes without a
+// StorageClass have an empty value.
+func (l *StorageClassLabels) Value(class string) string {
+	if l == nil || class == "" {
+		return ""
+	}
+	if l.allowed.Len() > 0 {
+		if l.allowed.Has(class) {
+			return class
+		}
+		return StorageClassOther
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.seen.Has(class) {
+		return class
+	}
+	if l.seen.Len() < l.max {
+		l.seen.Insert(class)
+		return class
+	}
+	return StorageClassOther
+}
+
+// pvValue returns the label value of the StorageClass of pv, which may be
+// nil for inline volumes.
+func (l *StorageClassLabels) pvValue(pv *v1.PersistentVolume) string {
+	if pv == nil {
+		return ""
+	}
+	return l.Value(pv.Spec.StorageClassName)
+}
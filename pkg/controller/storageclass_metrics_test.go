@@ -0,0 +1,88 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStorageClassLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   *StorageClassLabels
+		classes  []string
+		expected []string
+	}{
+		{
+			name:     "nil",
+			classes:  []string{"gold", ""},
+			expected: []string{"", ""},
+		},
+		{
+			name:     "allow-list",
+			labels:   NewStorageClassLabels([]string{"gold", "silver"}, 1),
+			classes:  []string{"bronze", "silver", "gold", ""},
+			expected: []string{StorageClassOther, "silver", "gold", ""},
+		},
+		{
+			name:     "max",
+			labels:   NewStorageClassLabels(nil, 2),
+			classes:  []string{"bronze", "silver", "gold", "bronze", ""},
+			expected: []string{"bronze", "silver", StorageClassOther, "bronze", ""},
+		},
+		{
+			name:     "zero max",
+			labels:   NewStorageClassLabels(nil, 0),
+			classes:  []string{"gold"},
+			expected: []string{StorageClassOther},
+		},
+	}
+	for _, test := range tests {
+		for i, class := range test.classes {
+			if value := test.labels.Value(class); value != test.expected[i] {
+				t.Errorf("%s: expected %q for %q, got %q", test.name, test.expected[i], class, value)
+			}
+		}
+	}
+}
+
+func TestObserveOperation(t *testing.T) {
+	h := &csiHandler{attacherName: "csi/observe", storageClassLabels: NewStorageClassLabels([]string{"gold"}, 0)}
+	gold := pv()
+	gold.Spec.StorageClassName = "gold"
+	silver := pv()
+	silver.Spec.StorageClassName = "silver"
+
+	h.observeOperation("attach", gold, 2*time.Second, nil)
+	h.observeOperation("attach", silver, time.Second, errors.New("mock error"))
+	h.observeOperation("detach", nil, time.Second, nil)
+
+	for _, labels := range [][]string{
+		{"csi/observe", "gold", "attach", "success"},
+		{"csi/observe", StorageClassOther, "attach", "error"},
+		{"csi/observe", "", "detach", "success"},
+	} {
+		if count := operationDuration.WithLabelValues(labels...).Count(); count != 1 {
+			t.Errorf("expected 1 observation with labels %v, got %d", labels, count)
+		}
+	}
+	if count := operationErrorsTotal.WithLabelValues("ControllerPublishVolume", "Unknown").Value(); count < 1 {
+		t.Errorf("expected the failed attach to be counted, got %v", count)
+	}
+}
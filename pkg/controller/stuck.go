@@ -0,0 +1,76 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog"
+)
+
+// AttachStuck is the reason of events on VolumeAttachments that wait for
+// attach longer than the stuck attach threshold.
+const AttachStuck = "AttachStuck"
+
+// maxStuckCheckInterval is the longest period of checking for stuck
+// VolumeAttachments.
+const maxStuckCheckInterval = time.Minute
+
+// stuckCheckInterval returns the period of checking for VolumeAttachments
+// stuck longer than threshold.
+func stuckCheckInterval(threshold time.Duration) time.Duration {
+	if threshold < maxStuckCheckInterval {
+		return threshold
+	}
+	return maxStuckCheckInterval
+}
+
+// checkStuck finds VolumeAttachments of the controller that are not attached
+// and not deleted longer than threshold after they were created. It emits an
+// AttachStuck event once for each newly stuck VolumeAttachment and sets the
+// stuck VolumeAttachments metric. It must not be called concurrently.
+func (ctrl *CSIAttachController) checkStuck(threshold time.Duration, now time.Time) {
+	vas, err := ctrl.vaLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list VolumeAttachments to check for stuck attachments: %s", err)
+		return
+	}
+	stuck := sets.NewString()
+	for _, va := range vas {
+		if va.Spec.Attacher != ctrl.attacherName || !ctrl.owns(va.Name) || !ctrl.selectsVA(va) {
+			continue
+		}
+		if va.Status.Attached || va.DeletionTimestamp != nil {
+			continue
+		}
+		pending := now.Sub(va.CreationTimestamp.Time)
+		if pending <= threshold {
+			continue
+		}
+		stuck.Insert(va.Name)
+		if ctrl.stuckVAs.Has(va.Name) {
+			continue
+		}
+		klog.Warningf("VolumeAttachment %q is waiting for attach to node %q for %s", va.Name, va.Spec.NodeName, pending.Round(time.Second))
+		ctrl.eventRecorder.Eventf(va, v1.EventTypeWarning, AttachStuck, "Volume has been waiting for attach to node %s for %s", va.Spec.NodeName, pending.Round(time.Second))
+	}
+	ctrl.stuckVAs = stuck
+	stuckVolumeAttachments.WithLabelValues(ctrl.attacherName).Set(float64(stuck.Len()))
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestCheckStuck(t *testing.T) {
+	now := time.Date(2019, 10, 14, 12, 0, 0, 0, time.UTC)
+	pendingVA := func(name, attacher string, age time.Duration, attached, deleted bool) *storage.VolumeAttachment {
+		va := &storage.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				CreationTimestamp: metav1.NewTime(now.Add(-age)),
+			},
+			Spec: storage.VolumeAttachmentSpec{
+				Attacher: attacher,
+				NodeName: "node1",
+			},
+			Status: storage.VolumeAttachmentStatus{Attached: attached},
+		}
+		if deleted {
+			deletionTime := metav1.NewTime(now)
+			va.DeletionTimestamp = &deletionTime
+		}
+		return va
+	}
+
+	client := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(client, 0)
+	store := factory.Storage().V1beta1().VolumeAttachments().Informer().GetStore()
+	for _, va := range []*storage.VolumeAttachment{
+		pendingVA("stuck", testAttacherName, 10*time.Minute, false, false),
+		pendingVA("new", testAttacherName, time.Minute, false, false),
+		pendingVA("attached", testAttacherName, 10*time.Minute, true, false),
+		pendingVA("deleted", testAttacherName, 10*time.Minute, false, true),
+		pendingVA("other", "other-attacher", 10*time.Minute, false, false),
+	} {
+		store.Add(va)
+	}
+	recorder := record.NewFakeRecorder(10)
+	ctrl := &CSIAttachController{
+		attacherName:  testAttacherName,
+		eventRecorder: recorder,
+		vaLister:      factory.Storage().V1beta1().VolumeAttachments().Lister(),
+	}
+	gauge := stuckVolumeAttachments.WithLabelValues(testAttacherName)
+
+	ctrl.checkStuck(5*time.Minute, now)
+	if gauge.Value() != 1 {
+		t.Errorf("expected 1 stuck VolumeAttachment, got %v", gauge.Value())
+	}
+	// The event is emitted only once.
+	ctrl.checkStuck(5*time.Minute, now.Add(time.Minute))
+	var events []string
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	expected := []string{"Warning AttachStuck Volume has been waiting for attach to node node1 for 10m0s"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected events %q, got %q", expected, events)
+	}
+
+	ctrl.checkStuck(5*time.Minute, now.Add(5*time.Minute))
+	if gauge.Value() != 2 {
+		t.Errorf("expected 2 stuck VolumeAttachments, got %v", gauge.Value())
+	}
+	store.Delete(pendingVA("stuck", testAttacherName, 0, false, false))
+	store.Delete(pendingVA("new", testAttacherName, 0, false, false))
+	ctrl.checkStuck(5*time.Minute, now.Add(5*time.Minute))
+	if gauge.Value() != 0 {
+		t.Errorf("expected no stuck VolumeAttachments, got %v", gauge.Value())
+	}
+	if ctrl.stuckVAs.Len() != 0 {
+		t.Errorf("expected no remembered VolumeAttachments, got %v", ctrl.stuckVAs.List())
+	}
+}
+
+func TestStuckCheckInterval(t *testing.T) {
+	if interval := stuckCheckInterval(10 * time.Second); interval != 10*time.Second {
+		t.Errorf("expected 10s, got %s", interval)
+	}
+	if interval := stuckCheckInterval(time.Hour); interval != time.Minute {
+		t.Errorf("expected 1m, got %s", interval)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+// syncHistoryLength is the number of recent syncs kept by syncHistory.
+const syncHistoryLength = 100
+
+// SyncRecord is one processing of a VolumeAttachment or PersistentVolume
+// by a worker.
+type SyncRecord struct {
+	Kind    string    `json:"kind"`
+	Name    string    `json:"name"`
+	Started time.Time `json:"started"`
+	// Finished is false while the sync runs, e.g. in a dump written after
+	// it panicked.
+	Finished   bool  `json:"finished"`
+	DurationMs int64 `json:"durationMs"`
+}
+
+// syncHistory keeps the most recent syncs of a controller.
+type syncHistory struct {
+	clock clock.Clock
+
+	lock    sync.Mutex
+	records []SyncRecord
+	// next is the index of the record overwritten by the next sync when
+	// records is full.
+	next int
+	// seq counts started syncs, it identifies records that are still in
+	// records when their sync finishes.
+	seq  uint64
+	seqs []uint64
+}
+
+func newSyncHistory(clock clock.Clock) *syncHistory {
+	return &syncHistory{clock: clock}
+}
+
+// start records the start of a sync and returns a function that records
+// its end.
+func (h *syncHistory) start(kind, name string) func() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	record := SyncRecord{Kind: kind, Name: name, Started: h.clock.Now()}
+	h.seq++
+	seq := h.seq
+	index := len(h.records)
+	if index < syncHistoryLength {
+		h.records = append(h.records, record)
+		h.seqs = append(h.seqs, seq)
+	} else {
+		index = h.next
+		h.records[index] = record
+		h.seqs[index] = seq
+		h.next = (h.next + 1) % syncHistoryLength
+	}
+	return func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		if h.seqs[index] != seq {
+			// Overwritten by newer syncs.
+			return
+		}
+		h.records[index].Finished = true
+		h.records[index].DurationMs = int64(h.clock.Since(record.Started) / time.Millisecond)
+	}
+}
+
+// list returns the recent syncs, the oldest first.
+func (h *syncHistory) list() []SyncRecord {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	list := make([]SyncRecord, 0, len(h.records))
+	list = append(list, h.records[h.next:]...)
+	return append(list, h.records[:h.next]...)
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+func TestSyncHistory(t *testing.T) {
+	now := time.Date(2019, 10, 14, 12, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(now)
+	h := newSyncHistory(fakeClock)
+
+	finish := h.start("VolumeAttachment", "va1")
+	running := h.start("PersistentVolume", "pv1")
+	fakeClock.Step(1500 * time.Millisecond)
+	finish()
+	list := h.list()
+	expected := []SyncRecord{
+		{Kind: "VolumeAttachment", Name: "va1", Started: now, Finished: true, DurationMs: 1500},
+		{Kind: "PersistentVolume", Name: "pv1", Started: now},
+	}
+	if fmt.Sprint(list) != fmt.Sprint(expected) {
+		t.Errorf("expected %+v, got %+v", expected, list)
+	}
+
+	// Old records are overwritten, the end of an overwritten sync is
+	// ignored.
+	for i := 0; i < syncHistoryLength; i++ {
+		h.start("VolumeAttachment", fmt.Sprintf("va-%d", i))()
+	}
+	running()
+	list = h.list()
+	if len(list) != syncHistoryLength {
+		t.Fatalf("expected %d records, got %d", syncHistoryLength, len(list))
+	}
+	if list[0].Name != "va-0" || list[len(list)-1].Name != fmt.Sprintf("va-%d", syncHistoryLength-1) {
+		t.Errorf("expected records from va-0 to va-%d, got %s to %s", syncHistoryLength-1, list[0].Name, list[len(list)-1].Name)
+	}
+	for _, record := range list {
+		if !record.Finished {
+			t.Errorf("expected finished record, got %+v", record)
+		}
+	}
+}
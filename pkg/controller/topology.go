@@ -0,0 +1,130 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/klog"
+)
+
+// checkNodeAffinity returns an error when the required node affinity of pv
+// does not match the node of va, so the driver can't attach the volume to the
+// node, e.g. because the volume is in a different zone. The scheduler does
+// not put pods of such volumes on the node, but pods with spec.nodeName and
+// VolumeAttachments created by hand would otherwise wait for a driver timeout
+// on each attempt.
+func (h *csiHandler) checkNodeAffinity(va *storage.VolumeAttachment, pv *v1.PersistentVolume) error {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return nil
+	}
+	node, err := h.nodeLister.Get(va.Spec.NodeName)
+	if err != nil {
+		// Finding the node ID reports missing nodes.
+		klog.V(4).Infof("Can't check node affinity of %q: %v", va.Name, err)
+		return nil
+	}
+	matches, err := matchesNodeSelector(pv.Spec.NodeAffinity.Required, node)
+	if err != nil {
+		return fmt.Errorf("invalid node affinity of PersistentVolume %s: %v", pv.Name, err)
+	}
+	if !matches {
+		return fmt.Errorf("volume is not accessible from node %s: node affinity of PersistentVolume %s does not match the node", node.Name, pv.Name)
+	}
+	return nil
+}
+
+// matchesNodeSelector returns true when node matches one of the terms of
+// selector. Like in the scheduler, a term matches when all its expressions
+// and fields match and a term without any requirements matches no node.
+func matchesNodeSelector(selector *v1.NodeSelector, node *v1.Node) (bool, error) {
+	for _, term := range selector.NodeSelectorTerms {
+		if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+			continue
+		}
+		matches, err := matchesNodeSelectorTerm(term, node)
+		if err != nil {
+			return false, err
+		}
+		if matches {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func matchesNodeSelectorTerm(term v1.NodeSelectorTerm, node *v1.Node) (bool, error) {
+	if len(term.MatchExpressions) > 0 {
+		selector := labels.NewSelector()
+		for _, expr := range term.MatchExpressions {
+			op, err := selectionOperator(expr.Operator)
+			if err != nil {
+				return false, err
+			}
+			requirement, err := labels.NewRequirement(expr.Key, op, expr.Values)
+			if err != nil {
+				return false, err
+			}
+			selector = selector.Add(*requirement)
+		}
+		if !selector.Matches(labels.Set(node.Labels)) {
+			return false, nil
+		}
+	}
+	for _, field := range term.MatchFields {
+		// metadata.name is the only field supported by the API server.
+		if field.Key != "metadata.name" || len(field.Values) != 1 {
+			return false, fmt.Errorf("unsupported field requirement %s %s %v", field.Key, field.Operator, field.Values)
+		}
+		switch field.Operator {
+		case v1.NodeSelectorOpIn:
+			if node.Name != field.Values[0] {
+				return false, nil
+			}
+		case v1.NodeSelectorOpNotIn:
+			if node.Name == field.Values[0] {
+				return false, nil
+			}
+		default:
+			return false, fmt.Errorf("unsupported operator %s of field %s", field.Operator, field.Key)
+		}
+	}
+	return true, nil
+}
+
+func selectionOperator(op v1.NodeSelectorOperator) (selection.Operator, error) {
+	switch op {
+	case v1.NodeSelectorOpIn:
+		return selection.In, nil
+	case v1.NodeSelectorOpNotIn:
+		return selection.NotIn, nil
+	case v1.NodeSelectorOpExists:
+		return selection.Exists, nil
+	case v1.NodeSelectorOpDoesNotExist:
+		return selection.DoesNotExist, nil
+	case v1.NodeSelectorOpGt:
+		return selection.GreaterThan, nil
+	case v1.NodeSelectorOpLt:
+		return selection.LessThan, nil
+	default:
+		return "", fmt.Errorf("unknown operator %q", op)
+	}
+}
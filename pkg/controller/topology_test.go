@@ -0,0 +1,175 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	core "k8s.io/client-go/testing"
+)
+
+func TestMatchesNodeSelector(t *testing.T) {
+	node := node()
+	node.Labels = map[string]string{"topology.kubernetes.io/zone": "zone-a", "disks": "4"}
+	expr := func(key string, op v1.NodeSelectorOperator, values ...string) v1.NodeSelectorRequirement {
+		return v1.NodeSelectorRequirement{Key: key, Operator: op, Values: values}
+	}
+
+	tests := []struct {
+		name      string
+		terms     []v1.NodeSelectorTerm
+		matches   bool
+		expectErr bool
+	}{
+		{
+			name:    "In",
+			terms:   []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{expr("topology.kubernetes.io/zone", v1.NodeSelectorOpIn, "zone-a", "zone-b")}}},
+			matches: true,
+		},
+		{
+			name:  "In other zone",
+			terms: []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{expr("topology.kubernetes.io/zone", v1.NodeSelectorOpIn, "zone-b")}}},
+		},
+		{
+			name: "all expressions of a term must match",
+			terms: []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{
+				expr("topology.kubernetes.io/zone", v1.NodeSelectorOpIn, "zone-a"),
+				expr("ssd", v1.NodeSelectorOpExists),
+			}}},
+		},
+		{
+			name: "one of the terms must match",
+			terms: []v1.NodeSelectorTerm{
+				{MatchExpressions: []v1.NodeSelectorRequirement{expr("ssd", v1.NodeSelectorOpExists)}},
+				{MatchExpressions: []v1.NodeSelectorRequirement{expr("disks", v1.NodeSelectorOpGt, "2")}},
+			},
+			matches: true,
+		},
+		{
+			name:    "DoesNotExist and Lt",
+			terms:   []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{expr("ssd", v1.NodeSelectorOpDoesNotExist), expr("disks", v1.NodeSelectorOpLt, "8")}}},
+			matches: true,
+		},
+		{
+			name:    "node name",
+			terms:   []v1.NodeSelectorTerm{{MatchFields: []v1.NodeSelectorRequirement{expr("metadata.name", v1.NodeSelectorOpIn, testNodeName)}}},
+			matches: true,
+		},
+		{
+			name:  "other node name",
+			terms: []v1.NodeSelectorTerm{{MatchFields: []v1.NodeSelectorRequirement{expr("metadata.name", v1.NodeSelectorOpIn, "node2")}}},
+		},
+		{
+			name:  "empty term",
+			terms: []v1.NodeSelectorTerm{{}},
+		},
+		{
+			name: "no terms",
+		},
+		{
+			name:      "unknown operator",
+			terms:     []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{expr("disks", "Near", "4")}}},
+			expectErr: true,
+		},
+		{
+			name:      "unsupported field",
+			terms:     []v1.NodeSelectorTerm{{MatchFields: []v1.NodeSelectorRequirement{expr("spec.unschedulable", v1.NodeSelectorOpIn, "true")}}},
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		matches, err := matchesNodeSelector(&v1.NodeSelector{NodeSelectorTerms: test.terms}, node)
+		if test.expectErr && err == nil {
+			t.Errorf("%s: expected error, got none", test.name)
+		}
+		if !test.expectErr && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if matches != test.matches {
+			t.Errorf("%s: expected match %v, got %v", test.name, test.matches, matches)
+		}
+	}
+}
+
+func pvWithZone(zone string) *v1.PersistentVolume {
+	pv := pvWithFinalizer()
+	pv.Spec.NodeAffinity = &v1.VolumeNodeAffinity{
+		Required: &v1.NodeSelector{
+			NodeSelectorTerms: []v1.NodeSelectorTerm{{
+				MatchExpressions: []v1.NodeSelectorRequirement{{Key: "topology.kubernetes.io/zone", Operator: v1.NodeSelectorOpIn, Values: []string{zone}}},
+			}},
+		},
+	}
+	return pv
+}
+
+func TestCSIHandlerNodeAffinity(t *testing.T) {
+	vaGroupResourceVersion := schema.GroupVersionResource{
+		Group:    storage.GroupName,
+		Version:  "v1beta1",
+		Resource: "volumeattachments",
+	}
+	var noMetadata map[string]string
+	var noAttrs map[string]string
+	var noSecrets map[string]string
+	var success error
+	var readWrite = false
+	var notDetached = false
+	zoneNode := node()
+	zoneNode.Labels = map[string]string{"topology.kubernetes.io/zone": "zone-a"}
+	notAccessible := "volume is not accessible from node node1: node affinity of PersistentVolume pv1 does not match the node"
+
+	tests := []testCase{
+		{
+			name:           "node affinity matches -> successful attachment",
+			initialObjects: []runtime.Object{pvWithZone("zone-a"), zoneNode},
+			addedVA:        va(false, "", nil),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false, "", nil),
+						va(false, fin, ann))),
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false, fin, ann),
+						va(true, fin, ann))),
+			},
+			expectedCSICalls: []csiCall{
+				{"attach", testVolumeHandle, testNodeID, noAttrs, noSecrets, readWrite, success, notDetached, noMetadata, 0},
+			},
+		},
+		{
+			name:           "node affinity does not match -> attach fails without CSI call",
+			initialObjects: []runtime.Object{pvWithZone("zone-b"), zoneNode},
+			addedVA:        va(false, "", nil),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(va(false, "", nil),
+						vaWithAttachError(va(false, "", nil), notAccessible))),
+			},
+			expectedEvents: []string{
+				"Normal AttachStarted Attaching volume to node node1",
+				"Warning AttachFailed Failed to attach volume to node node1: " + notAccessible,
+			},
+		},
+	}
+	runTests(t, csiHandlerFactory, tests)
+}
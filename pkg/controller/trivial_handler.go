@@ -19,6 +19,9 @@ package controller
 import (
 	"k8s.io/api/core/v1"
 	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog"
@@ -27,17 +30,20 @@ import (
 // trivialHandler is a handler that marks all VolumeAttachments as attached.
 // It's used for CSI drivers that don't support ControllerPulishVolume call.
 // It uses no finalizer, deletion of VolumeAttachment is instant (as there is
-// nothing to detach).
+// nothing to detach). With injected faults, it simulates latency and errors
+// of attach.
 type trivialHandler struct {
 	client           kubernetes.Interface
 	vaQueue, pvQueue workqueue.RateLimitingInterface
+	faults           *faultInjector
+	clock            clock.Clock
 }
 
 var _ Handler = &trivialHandler{}
 
 // NewTrivialHandler provides new Handler for Volumeattachments and PV object handling.
 func NewTrivialHandler(client kubernetes.Interface) Handler {
-	return &trivialHandler{client: client}
+	return &trivialHandler{client: client, clock: clock.RealClock{}}
 }
 
 func (h *trivialHandler) Init(vaQueue workqueue.RateLimitingInterface, pvQueue workqueue.RateLimitingInterface) {
@@ -48,8 +54,19 @@ func (h *trivialHandler) Init(vaQueue workqueue.RateLimitingInterface, pvQueue w
 func (h *trivialHandler) SyncNewOrUpdatedVolumeAttachment(va *storage.VolumeAttachment) {
 	klog.V(4).Infof("Trivial sync[%s] started", va.Name)
 	if !va.Status.Attached {
+		if err := h.faults.inject(); err != nil {
+			h.saveAttachError(va, err)
+			h.vaQueue.AddRateLimited(va.Name)
+			return
+		}
 		// mark as attached
-		if _, err := markAsAttached(h.client, va, nil); err != nil {
+		if _, err := markAsAttached(h.client, va, nil, nil); err != nil {
+			if delay, throttled := throttledByAPIServer(err); throttled {
+				klog.V(2).Infof("API server throttled saving VolumeAttachment %s as attached, retrying after %s", va.Name, delay)
+				apiThrottledTotal.WithLabelValues(resourceVolumeAttachments).Inc()
+				h.vaQueue.AddAfter(va.Name, delay)
+				return
+			}
 			klog.Warningf("Error saving VolumeAttachment %s as attached: %s", va.Name, err)
 			h.vaQueue.AddRateLimited(va.Name)
 			return
@@ -59,6 +76,24 @@ func (h *trivialHandler) SyncNewOrUpdatedVolumeAttachment(va *storage.VolumeAtta
 	h.vaQueue.Forget(va.Name)
 }
 
+// saveAttachError saves an injected attach error to va the same way as the
+// CSI handler saves errors of ControllerPublish.
+func (h *trivialHandler) saveAttachError(va *storage.VolumeAttachment, err error) {
+	klog.V(2).Infof("Simulated attach of VolumeAttachment %s failed: %s", va.Name, err)
+	clone := va.DeepCopy()
+	clone.Status.AttachError = &storage.VolumeError{
+		Message: err.Error(),
+		Time:    metav1.NewTime(h.clock.Now()),
+	}
+	patch, err := createMergePatch(va, clone)
+	if err == nil {
+		_, err = h.client.StorageV1beta1().VolumeAttachments().Patch(va.Name, types.MergePatchType, patch)
+	}
+	if err != nil {
+		klog.V(2).Infof("Failed to save attach error to %q: %s", va.Name, err)
+	}
+}
+
 func (h *trivialHandler) SyncNewOrUpdatedPersistentVolume(pv *v1.PersistentVolume) {
 	return
 }
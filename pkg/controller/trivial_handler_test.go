@@ -28,9 +28,12 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
 	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/util/workqueue"
 )
 
 func trivialHandlerFactory(client kubernetes.Interface, informerFactory informers.SharedInformerFactory, csi attacher.Attacher) Handler {
@@ -110,3 +113,28 @@ func TestTrivialHandler(t *testing.T) {
 
 	runTests(t, trivialHandlerFactory, tests)
 }
+
+func TestTrivialHandlerInjectedError(t *testing.T) {
+	obj := va(false, "", nil)
+	client := fake.NewSimpleClientset(obj)
+	handler := NewTrivialHandler(client)
+	handler.(*trivialHandler).faults = newFaultInjector(Faults{ErrorRate: 1}, clock.RealClock{}, 1)
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	handler.Init(queue, queue)
+
+	handler.SyncNewOrUpdatedVolumeAttachment(obj)
+	saved, err := client.StorageV1beta1().VolumeAttachments().Get(obj.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if saved.Status.Attached {
+		t.Errorf("expected VolumeAttachment not attached")
+	}
+	if saved.Status.AttachError == nil || saved.Status.AttachError.Message != errInjected.Error() {
+		t.Errorf("expected injected attach error, got %+v", saved.Status.AttachError)
+	}
+	if requeues := queue.NumRequeues(obj.Name); requeues != 1 {
+		t.Errorf("expected VolumeAttachment to be retried once, got %d", requeues)
+	}
+}
@@ -21,22 +21,32 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/evanphx/json-patch"
 	"k8s.io/api/core/v1"
 	storage "k8s.io/api/storage/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
 )
 
-func markAsAttached(client kubernetes.Interface, va *storage.VolumeAttachment, metadata map[string]string) (*storage.VolumeAttachment, error) {
+// markAsAttached saves the attached status of va. annotations are added to
+// va in the same patch.
+func markAsAttached(client kubernetes.Interface, va *storage.VolumeAttachment, metadata, annotations map[string]string) (*storage.VolumeAttachment, error) {
 	klog.V(4).Infof("Marking as attached %q", va.Name)
 	clone := va.DeepCopy()
 	clone.Status.Attached = true
 	clone.Status.AttachmentMetadata = metadata
 	clone.Status.AttachError = nil
+	if len(annotations) > 0 && clone.Annotations == nil {
+		clone.Annotations = map[string]string{}
+	}
+	for key, value := range annotations {
+		clone.Annotations[key] = value
+	}
 	patch, err := createMergePatch(va, clone)
 	if err != nil {
 		return va, err
@@ -114,6 +124,16 @@ func GetFinalizerName(driver string) string {
 	return "external-attacher/" + SanitizeDriverName(driver)
 }
 
+// hasFinalizer returns true if the finalizer is present in the list.
+func hasFinalizer(finalizers []string, finalizer string) bool {
+	for _, f := range finalizers {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
 // GetNodeIDFromNode returns nodeID string from node annotations.
 func GetNodeIDFromNode(driver string, node *v1.Node) (string, error) {
 	nodeIDJSON, ok := node.Annotations[nodeIDAnnotation]
@@ -145,6 +165,12 @@ func GetNodeIDFromCSINode(driver string, csiNode *storage.CSINode) (string, bool
 
 // GetVolumeCapabilities returns volumecapability from PV spec
 func GetVolumeCapabilities(pvSpec *v1.PersistentVolumeSpec) (*csi.VolumeCapability, error) {
+	return GetVolumeCapabilitiesWithPolicy(pvSpec, AccessModeStrict)
+}
+
+// GetVolumeCapabilitiesWithPolicy returns volumecapability from PV spec,
+// translating its access modes with policy.
+func GetVolumeCapabilitiesWithPolicy(pvSpec *v1.PersistentVolumeSpec, policy AccessModePolicy) (*csi.VolumeCapability, error) {
 	m := map[v1.PersistentVolumeAccessMode]bool{}
 	for _, mode := range pvSpec.AccessModes {
 		m[mode] = true
@@ -187,8 +213,12 @@ func GetVolumeCapabilities(pvSpec *v1.PersistentVolumeSpec) (*csi.VolumeCapabili
 		cap.AccessMode.Mode = csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
 
 	case m[v1.ReadOnlyMany] && m[v1.ReadWriteOnce]:
-		// This is no way how to translate this to CSI...
-		return nil, fmt.Errorf("CSI does not support ReadOnlyMany and ReadWriteOnce on the same PersistentVolume")
+		if policy != AccessModeMostPermissive {
+			// This is no way how to translate this to CSI...
+			return nil, fmt.Errorf("CSI does not support ReadOnlyMany and ReadWriteOnce on the same PersistentVolume")
+		}
+		// Readers on any node and a writer on one of them.
+		cap.AccessMode.Mode = csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER
 
 	case m[v1.ReadOnlyMany]:
 		// There is only ReadOnlyMany set
@@ -236,3 +266,86 @@ func createMergePatch(original, new interface{}) ([]byte, error) {
 	}
 	return patch, nil
 }
+
+// deferredError is returned when an operation was postponed, e.g. by the
+// policy webhook or while a volume is still in use. The operation is retried
+// after the given delay and it is not reported as attach / detach failure.
+type deferredError struct {
+	msg        string
+	retryAfter time.Duration
+}
+
+func (e *deferredError) Error() string {
+	return e.msg
+}
+
+// getDeferral returns the delay after which a deferred operation should be
+// retried.
+func getDeferral(err error) (time.Duration, bool) {
+	for _, e := range errorChain(err) {
+		if d, ok := e.(*deferredError); ok {
+			return d.retryAfter, true
+		}
+	}
+	return 0, false
+}
+
+// contextError adds context to an error. It keeps the original error as its
+// cause, so the type of the cause and its gRPC status are not lost.
+type contextError struct {
+	msg   string
+	cause error
+}
+
+func (e *contextError) Error() string {
+	return e.msg
+}
+
+// Cause returns the error that e adds context to.
+func (e *contextError) Cause() error {
+	return e.cause
+}
+
+// wrapError adds context to given error.
+func wrapError(context string, err error) error {
+	return &contextError{msg: fmt.Sprintf("%s: %s", context, err), cause: err}
+}
+
+// errorChain returns err followed by its causes, outermost first.
+func errorChain(err error) []error {
+	var chain []error
+	for err != nil {
+		chain = append(chain, err)
+		c, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = c.Cause()
+	}
+	return chain
+}
+
+// throttledByAPIServer returns the delay requested by the API server when err
+// is 429 Too Many Requests with Retry-After.
+func throttledByAPIServer(err error) (time.Duration, bool) {
+	if !apierrs.IsTooManyRequests(err) {
+		return 0, false
+	}
+	seconds, ok := apierrs.SuggestsClientDelay(err)
+	if !ok || seconds <= 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// getRetryAfter returns the delay after which an operation that failed with
+// given error should be retried, if the error was caused by API server
+// throttling.
+func getRetryAfter(err error) (time.Duration, bool) {
+	for _, e := range errorChain(err) {
+		if delay, ok := throttledByAPIServer(e); ok {
+			return delay, true
+		}
+	}
+	return 0, false
+}
@@ -16,11 +16,16 @@ limitations under the License.
 package controller
 
 import (
+	"errors"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -333,3 +338,65 @@ func TestGetVolumeHandle(t *testing.T) {
 		}
 	}
 }
+
+func TestGetRetryAfter(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		expectedDelay time.Duration
+		expectedOK    bool
+	}{
+		{
+			name:       "generic error",
+			err:        errors.New("mock error"),
+			expectedOK: false,
+		},
+		{
+			name:       "429 without Retry-After",
+			err:        apierrs.NewTooManyRequests("mock throttling", 0),
+			expectedOK: false,
+		},
+		{
+			name:          "429 with Retry-After",
+			err:           apierrs.NewTooManyRequests("mock throttling", 3),
+			expectedDelay: 3 * time.Second,
+			expectedOK:    true,
+		},
+		{
+			name:          "wrapped 429 with Retry-After",
+			err:           wrapError("failed to attach", wrapError("could not save VolumeAttachment", apierrs.NewTooManyRequests("mock throttling", 5))),
+			expectedDelay: 5 * time.Second,
+			expectedOK:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delay, ok := getRetryAfter(test.err)
+			if ok != test.expectedOK {
+				t.Errorf("expected ok %t, got %t", test.expectedOK, ok)
+			}
+			if delay != test.expectedDelay {
+				t.Errorf("expected delay %s, got %s", test.expectedDelay, delay)
+			}
+		})
+	}
+}
+
+func TestWrapErrorKeepsCause(t *testing.T) {
+	cause := status.Error(codes.FailedPrecondition, "mock error")
+	err := wrapError("failed to attach", wrapError("could not publish", cause))
+	if expected := "failed to attach: could not publish: rpc error: code = FailedPrecondition desc = mock error"; err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+	chain := errorChain(err)
+	if len(chain) != 3 || chain[2] != cause {
+		t.Fatalf("expected the gRPC error as the last cause, got %v", chain)
+	}
+	if code := status.Code(chain[2]); code != codes.FailedPrecondition {
+		t.Errorf("expected code FailedPrecondition, got %s", code)
+	}
+	if !isInvalidNodeID(wrapError("failed to attach", &invalidNodeIDError{msg: "mock error"})) {
+		t.Errorf("expected wrapped invalid node ID error")
+	}
+}
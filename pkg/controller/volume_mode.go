@@ -0,0 +1,67 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"strconv"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	"k8s.io/klog"
+)
+
+// PublishAsBlockAnnotation is the PersistentVolume annotation, "true" or
+// "false", that overrides Options.PublishAsBlock for the volume.
+const PublishAsBlockAnnotation = "csi.alpha.kubernetes.io/publish-as-block"
+
+// getPublishCapability returns the VolumeCapability of pvSpec sent to
+// ControllerPublish of va. Filesystem volumes are published with a block
+// capability, without fsType and mount flags, when publishAsBlock says so.
+// pv is nil for inline volumes.
+func (h *csiHandler) getPublishCapability(va *storage.VolumeAttachment, pv *v1.PersistentVolume, pvSpec *v1.PersistentVolumeSpec) (*csi.VolumeCapability, error) {
+	capability, err := GetVolumeCapabilitiesWithPolicy(pvSpec, h.accessModePolicy)
+	if err != nil {
+		return nil, err
+	}
+	if _, isBlock := capability.AccessType.(*csi.VolumeCapability_Block); isBlock || !h.publishAsBlock(pv) {
+		return capability, nil
+	}
+	klog.V(4).Infof("Publishing filesystem volume of %q as block volume", va.Name)
+	capability.AccessType = &csi.VolumeCapability_Block{
+		Block: &csi.VolumeCapability_BlockVolume{},
+	}
+	return capability, nil
+}
+
+// publishAsBlock returns true when filesystem volume pv is published as
+// block volume. PublishAsBlockAnnotation wins over the handler option.
+func (h *csiHandler) publishAsBlock(pv *v1.PersistentVolume) bool {
+	if pv == nil {
+		return h.forcePublishAsBlock
+	}
+	value, found := pv.Annotations[PublishAsBlockAnnotation]
+	if !found {
+		return h.forcePublishAsBlock
+	}
+	asBlock, err := strconv.ParseBool(value)
+	if err != nil {
+		klog.Warningf("Ignoring %s annotation %q of PersistentVolume %q, expected true or false", PublishAsBlockAnnotation, value, pv.Name)
+		return h.forcePublishAsBlock
+	}
+	return asBlock
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestGetPublishCapability(t *testing.T) {
+	block := v1.PersistentVolumeBlock
+	filesystem := v1.PersistentVolumeFilesystem
+	mountOptions := []string{"noatime"}
+	mountCapability := createMountCapability("xfs", csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, mountOptions)
+	blockCapability := createBlockCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)
+
+	tests := []struct {
+		name               string
+		volumeMode         *v1.PersistentVolumeMode
+		annotation         string
+		inline             bool
+		publishAsBlock     bool
+		expectedCapability *csi.VolumeCapability
+	}{
+		{
+			name:               "filesystem",
+			volumeMode:         &filesystem,
+			expectedCapability: mountCapability,
+		},
+		{
+			name:               "no volume mode",
+			expectedCapability: mountCapability,
+		},
+		{
+			name:               "block",
+			volumeMode:         &block,
+			expectedCapability: blockCapability,
+		},
+		{
+			name:               "filesystem published as block",
+			volumeMode:         &filesystem,
+			publishAsBlock:     true,
+			expectedCapability: blockCapability,
+		},
+		{
+			name:               "block published as block",
+			volumeMode:         &block,
+			publishAsBlock:     true,
+			expectedCapability: blockCapability,
+		},
+		{
+			name:               "annotation enables block",
+			volumeMode:         &filesystem,
+			annotation:         "true",
+			expectedCapability: blockCapability,
+		},
+		{
+			name:               "annotation disables block",
+			volumeMode:         &filesystem,
+			annotation:         "false",
+			publishAsBlock:     true,
+			expectedCapability: mountCapability,
+		},
+		{
+			name:               "annotation does not change block volumes",
+			volumeMode:         &block,
+			annotation:         "false",
+			expectedCapability: blockCapability,
+		},
+		{
+			name:               "invalid annotation",
+			volumeMode:         &filesystem,
+			annotation:         "yes",
+			publishAsBlock:     true,
+			expectedCapability: blockCapability,
+		},
+		{
+			name:               "inline volume published as block",
+			inline:             true,
+			publishAsBlock:     true,
+			expectedCapability: blockCapability,
+		},
+		{
+			name:               "inline volume",
+			inline:             true,
+			expectedCapability: mountCapability,
+		},
+	}
+	for _, test := range tests {
+		pv := pvWithFinalizer()
+		pv.Spec.VolumeMode = test.volumeMode
+		pv.Spec.CSI.FSType = "xfs"
+		pv.Spec.MountOptions = mountOptions
+		if test.annotation != "" {
+			pv.Annotations = map[string]string{PublishAsBlockAnnotation: test.annotation}
+		}
+		pvSpec := &pv.Spec
+		if test.inline {
+			pv = nil
+		}
+		h := &csiHandler{forcePublishAsBlock: test.publishAsBlock}
+		capability, err := h.getPublishCapability(va(false, "", nil), pv, pvSpec)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(capability, test.expectedCapability) {
+			t.Errorf("%s: expected capability %+v, got %+v", test.name, test.expectedCapability, capability)
+		}
+	}
+}
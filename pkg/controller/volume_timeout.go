@@ -0,0 +1,69 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// TimeoutAnnotation on a VolumeAttachment, PersistentVolume or StorageClass
+// overrides the timeout of ControllerPublish and ControllerUnpublish calls of
+// the volume, e.g. "10m" for very large volumes.
+const TimeoutAnnotation = "csi.alpha.kubernetes.io/timeout"
+
+// volumeTimeout returns the timeout of CSI calls for va: the value of
+// TimeoutAnnotation of va, of its PV or of the StorageClass of the PV, in this
+// order, or the timeout of the handler. pv is nil for inline volumes.
+func (h *csiHandler) volumeTimeout(va *storage.VolumeAttachment, pv *v1.PersistentVolume) time.Duration {
+	if !h.volumeTimeouts {
+		return h.getTimeout()
+	}
+	type annotated struct {
+		kind   string
+		object metav1.Object
+	}
+	objects := []annotated{{"VolumeAttachment", va}}
+	if pv != nil {
+		objects = append(objects, annotated{"PersistentVolume", pv})
+		if pv.Spec.StorageClassName != "" {
+			if class, err := h.scLister.Get(pv.Spec.StorageClassName); err == nil {
+				objects = append(objects, annotated{"StorageClass", class})
+			} else {
+				klog.V(4).Infof("Can't get StorageClass %q of %q: %v", pv.Spec.StorageClassName, va.Name, err)
+			}
+		}
+	}
+	for _, obj := range objects {
+		value, found := obj.object.GetAnnotations()[TimeoutAnnotation]
+		if !found {
+			continue
+		}
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			klog.Warningf("Ignoring %s annotation %q of %s %q, expected a positive duration", TimeoutAnnotation, value, obj.kind, obj.object.GetName())
+			continue
+		}
+		klog.V(4).Infof("Using timeout %s of %s %q for %q", timeout, obj.kind, obj.object.GetName(), va.Name)
+		return timeout
+	}
+	return h.getTimeout()
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestVolumeTimeout(t *testing.T) {
+	annotated := func(value string) map[string]string {
+		return map[string]string{TimeoutAnnotation: value}
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	indexer.Add(&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "large", Annotations: annotated("10m")}})
+	indexer.Add(&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "plain"}})
+	handlerTimeout := 15 * time.Second
+
+	tests := []struct {
+		name         string
+		disabled     bool
+		vaTimeout    string
+		pvTimeout    string
+		storageClass string
+		inline       bool
+		expected     time.Duration
+	}{
+		{
+			name:     "no annotations",
+			expected: handlerTimeout,
+		},
+		{
+			name:         "StorageClass",
+			storageClass: "large",
+			expected:     10 * time.Minute,
+		},
+		{
+			name:         "PV overrides StorageClass",
+			pvTimeout:    "5m",
+			storageClass: "large",
+			expected:     5 * time.Minute,
+		},
+		{
+			name:         "VolumeAttachment overrides PV",
+			vaTimeout:    "1m",
+			pvTimeout:    "5m",
+			storageClass: "large",
+			expected:     time.Minute,
+		},
+		{
+			name:      "invalid VolumeAttachment annotation is ignored",
+			vaTimeout: "soon",
+			pvTimeout: "5m",
+			expected:  5 * time.Minute,
+		},
+		{
+			name:      "negative timeout is ignored",
+			pvTimeout: "-5m",
+			expected:  handlerTimeout,
+		},
+		{
+			name:         "missing StorageClass",
+			storageClass: "missing",
+			expected:     handlerTimeout,
+		},
+		{
+			name:         "StorageClass without annotation",
+			storageClass: "plain",
+			expected:     handlerTimeout,
+		},
+		{
+			name:      "inline volume",
+			vaTimeout: "1m",
+			inline:    true,
+			expected:  time.Minute,
+		},
+		{
+			name:      "disabled",
+			disabled:  true,
+			vaTimeout: "1m",
+			expected:  handlerTimeout,
+		},
+	}
+	for _, test := range tests {
+		h := &csiHandler{
+			timeout:        int64(handlerTimeout),
+			volumeTimeouts: !test.disabled,
+			scLister:       storagelistersv1.NewStorageClassLister(indexer),
+		}
+		va := va(false, "", nil)
+		if test.vaTimeout != "" {
+			va.Annotations = annotated(test.vaTimeout)
+		}
+		var volume *v1.PersistentVolume
+		if !test.inline {
+			volume = pv()
+			volume.Spec.StorageClassName = test.storageClass
+			if test.pvTimeout != "" {
+				volume.Annotations = annotated(test.pvTimeout)
+			}
+		}
+		if timeout := h.volumeTimeout(va, volume); timeout != test.expected {
+			t.Errorf("%s: expected timeout %s, got %s", test.name, test.expected, timeout)
+		}
+	}
+}
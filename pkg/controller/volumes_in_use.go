@@ -0,0 +1,115 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/klog"
+)
+
+// ForceDetachAnnotation set to "true" on a VolumeAttachment skips the check
+// that its volume is no longer in use on the node.
+const ForceDetachAnnotation = "csi.alpha.kubernetes.io/force-detach"
+
+// unmountPollInterval is the delay before a detach of a volume in use is
+// checked again.
+const unmountPollInterval = 5 * time.Second
+
+// uniqueVolumeName returns the name of a CSI volume in volumesInUse of Node
+// status.
+func uniqueVolumeName(driver, volumeHandle string) v1.UniqueVolumeName {
+	return v1.UniqueVolumeName(fmt.Sprintf("kubernetes.io/csi/%s^%s", driver, volumeHandle))
+}
+
+// checkUnmounted returns deferredError when the volume of va is still
+// reported in volumesInUse of its node, i.e. kubelet did not unmount it yet.
+// The detach proceeds when the volume is unmounted, the node does not
+// exist, the node is fenced, NotReady for unreadyNodeGracePeriod or the
+// VolumeAttachment was deleted more than unmountWait ago.
+func (h *csiHandler) checkUnmounted(va *storage.VolumeAttachment, csiSource *v1.CSIPersistentVolumeSource) error {
+	if h.unmountWait <= 0 || va.DeletionTimestamp == nil {
+		return nil
+	}
+	if va.Annotations[ForceDetachAnnotation] == "true" {
+		klog.V(2).Infof("Not checking that %q is unmounted, it has annotation %s", va.Name, ForceDetachAnnotation)
+		return nil
+	}
+	node, err := h.nodeLister.Get(va.Spec.NodeName)
+	if err != nil {
+		if apierrs.IsNotFound(err) {
+			// Nothing is mounted on a deleted node.
+			return nil
+		}
+		return fmt.Errorf("failed to check that the volume is unmounted: %v", err)
+	}
+	name := uniqueVolumeName(csiSource.Driver, csiSource.VolumeHandle)
+	inUse := false
+	for _, volume := range node.Status.VolumesInUse {
+		if volume == name {
+			inUse = true
+			break
+		}
+	}
+	if !inUse {
+		return nil
+	}
+
+	if h.fencing != nil {
+		if reason, fenced := h.fencing.Fenced(node); fenced {
+			klog.Warningf("Node %q of %q is fenced by %s, detaching volume in use", va.Spec.NodeName, va.Name, reason)
+			h.recordEvent(va, v1.EventTypeWarning, ForceDetach, "Node %s is fenced by %s, detaching volume in use", va.Spec.NodeName, reason)
+			return nil
+		}
+	}
+	if notReady := h.notReadyFor(node); h.unreadyNodeGracePeriod > 0 && notReady >= h.unreadyNodeGracePeriod {
+		klog.Warningf("Node %q of %q is NotReady for %s, detaching volume in use", va.Spec.NodeName, va.Name, notReady.Round(time.Second))
+		h.recordEvent(va, v1.EventTypeWarning, ForceDetach, "Node %s is NotReady for %s, detaching volume in use", va.Spec.NodeName, notReady.Round(time.Second))
+		return nil
+	}
+
+	waiting := h.clock.Since(va.DeletionTimestamp.Time)
+	if waiting >= h.unmountWait {
+		klog.Warningf("Volume of %q is still in use on node %q after %s, detaching it", va.Name, va.Spec.NodeName, waiting.Round(time.Second))
+		h.recordEvent(va, v1.EventTypeWarning, DetachInUse, "Volume is still in use on node %s after %s, detaching it", va.Spec.NodeName, waiting.Round(time.Second))
+		return nil
+	}
+	return &deferredError{
+		msg:        fmt.Sprintf("volume is still in use on node %s, waiting up to %s for unmount", va.Spec.NodeName, h.unmountWait),
+		retryAfter: unmountPollInterval,
+	}
+}
+
+// notReadyFor returns how long the Ready condition of node is not True, 0
+// when it is Ready. A node without the condition has not been registered by
+// kubelet yet and is treated as Ready.
+func (h *csiHandler) notReadyFor(node *v1.Node) time.Duration {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type != v1.NodeReady {
+			continue
+		}
+		if condition.Status == v1.ConditionTrue {
+			return 0
+		}
+		return h.clock.Since(condition.LastTransitionTime.Time)
+	}
+	return 0
+}
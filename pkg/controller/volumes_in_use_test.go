@@ -0,0 +1,244 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
+	"github.com/kubernetes-csi/external-attacher/pkg/fencing"
+)
+
+func nodeWithVolumesInUse(volumes ...v1.UniqueVolumeName) *v1.Node {
+	n := node()
+	n.Status.VolumesInUse = volumes
+	return n
+}
+
+func withReadyCondition(node *v1.Node, status v1.ConditionStatus, since time.Time) *v1.Node {
+	node.Status.Conditions = []v1.NodeCondition{{
+		Type:               v1.NodeReady,
+		Status:             status,
+		LastTransitionTime: metav1.Time{Time: since},
+	}}
+	return node
+}
+
+// fakeFencing fences nodes by their names, the values are fencing reasons.
+type fakeFencing map[string]string
+
+func (f fakeFencing) Fenced(node *v1.Node) (string, bool) {
+	reason, fenced := f[node.Name]
+	return reason, fenced
+}
+
+func TestCheckUnmounted(t *testing.T) {
+	now := time.Now()
+	csiSource := pv().Spec.CSI
+	inUse := uniqueVolumeName(testAttacherName, testVolumeHandle)
+	deletedAt := func(va *storage.VolumeAttachment, ago time.Duration) *storage.VolumeAttachment {
+		va.DeletionTimestamp = &metav1.Time{Time: now.Add(-ago)}
+		return va
+	}
+	forced := deletedAt(va(true, fin, ann), time.Second)
+	forced.Annotations = map[string]string{ForceDetachAnnotation: "true"}
+
+	tests := []struct {
+		name          string
+		unmountWait   time.Duration
+		gracePeriod   time.Duration
+		fencing       fencing.Checker
+		va            *storage.VolumeAttachment
+		objects       []runtime.Object
+		expectDeferal bool
+		expectedEvent string
+	}{
+		{
+			name:        "disabled",
+			va:          deletedAt(va(true, fin, ann), time.Second),
+			objects:     []runtime.Object{nodeWithVolumesInUse(inUse)},
+			unmountWait: 0,
+		},
+		{
+			name:        "unmounted",
+			va:          deletedAt(va(true, fin, ann), time.Second),
+			objects:     []runtime.Object{nodeWithVolumesInUse("kubernetes.io/csi/csi/test^other")},
+			unmountWait: time.Minute,
+		},
+		{
+			name:          "in use",
+			va:            deletedAt(va(true, fin, ann), time.Second),
+			objects:       []runtime.Object{nodeWithVolumesInUse(inUse)},
+			unmountWait:   time.Minute,
+			expectDeferal: true,
+		},
+		{
+			name:          "in use longer than unmount wait",
+			va:            deletedAt(va(true, fin, ann), 2*time.Minute),
+			objects:       []runtime.Object{nodeWithVolumesInUse(inUse)},
+			unmountWait:   time.Minute,
+			expectedEvent: "Warning DetachInUse Volume is still in use on node node1 after 2m0s, detaching it",
+		},
+		{
+			name:          "NotReady longer than grace period",
+			va:            deletedAt(va(true, fin, ann), time.Second),
+			objects:       []runtime.Object{withReadyCondition(nodeWithVolumesInUse(inUse), v1.ConditionFalse, now.Add(-10*time.Minute))},
+			unmountWait:   time.Hour,
+			gracePeriod:   5 * time.Minute,
+			expectedEvent: "Warning ForceDetach Node node1 is NotReady for 10m0s, detaching volume in use",
+		},
+		{
+			name:          "unknown longer than grace period",
+			va:            deletedAt(va(true, fin, ann), time.Second),
+			objects:       []runtime.Object{withReadyCondition(nodeWithVolumesInUse(inUse), v1.ConditionUnknown, now.Add(-6*time.Minute))},
+			unmountWait:   time.Hour,
+			gracePeriod:   5 * time.Minute,
+			expectedEvent: "Warning ForceDetach Node node1 is NotReady for 6m0s, detaching volume in use",
+		},
+		{
+			name:          "NotReady shorter than grace period",
+			va:            deletedAt(va(true, fin, ann), time.Second),
+			objects:       []runtime.Object{withReadyCondition(nodeWithVolumesInUse(inUse), v1.ConditionFalse, now.Add(-time.Minute))},
+			unmountWait:   time.Hour,
+			gracePeriod:   5 * time.Minute,
+			expectDeferal: true,
+		},
+		{
+			name:          "Ready with grace period",
+			va:            deletedAt(va(true, fin, ann), time.Second),
+			objects:       []runtime.Object{withReadyCondition(nodeWithVolumesInUse(inUse), v1.ConditionTrue, now.Add(-time.Hour))},
+			unmountWait:   time.Hour,
+			gracePeriod:   5 * time.Minute,
+			expectDeferal: true,
+		},
+		{
+			name:          "NotReady without grace period",
+			va:            deletedAt(va(true, fin, ann), time.Second),
+			objects:       []runtime.Object{withReadyCondition(nodeWithVolumesInUse(inUse), v1.ConditionFalse, now.Add(-time.Hour))},
+			unmountWait:   time.Hour,
+			expectDeferal: true,
+		},
+		{
+			name:          "fenced",
+			va:            deletedAt(va(true, fin, ann), time.Second),
+			objects:       []runtime.Object{nodeWithVolumesInUse(inUse)},
+			unmountWait:   time.Hour,
+			fencing:       fakeFencing{testNodeName: "taint node.kubernetes.io/out-of-service"},
+			expectedEvent: "Warning ForceDetach Node node1 is fenced by taint node.kubernetes.io/out-of-service, detaching volume in use",
+		},
+		{
+			name:          "other node fenced",
+			va:            deletedAt(va(true, fin, ann), time.Second),
+			objects:       []runtime.Object{nodeWithVolumesInUse(inUse)},
+			unmountWait:   time.Hour,
+			fencing:       fakeFencing{"node2": "taint node.kubernetes.io/out-of-service"},
+			expectDeferal: true,
+		},
+		{
+			name:        "forced",
+			va:          forced,
+			objects:     []runtime.Object{nodeWithVolumesInUse(inUse)},
+			unmountWait: time.Minute,
+		},
+		{
+			name:        "deleted node",
+			va:          deletedAt(va(true, fin, ann), time.Second),
+			unmountWait: time.Minute,
+		},
+	}
+	for _, test := range tests {
+		recorder := newAnnotatedRecorder(10)
+		h := &csiHandler{
+			attacherName:           testAttacherName,
+			nodeLister:             &onDemandNodeLister{client: fake.NewSimpleClientset(test.objects...)},
+			unmountWait:            test.unmountWait,
+			unreadyNodeGracePeriod: test.gracePeriod,
+			fencing:                test.fencing,
+			eventRecorder:          recorder,
+			clock:                  clock.NewFakeClock(now),
+		}
+		err := h.checkUnmounted(test.va, csiSource)
+		delay, deferred := getDeferral(err)
+		if test.expectDeferal {
+			if !deferred || delay != unmountPollInterval {
+				t.Errorf("%s: expected deferral by %s, got %v", test.name, unmountPollInterval, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		close(recorder.Events)
+		event := <-recorder.Events
+		if event != test.expectedEvent {
+			t.Errorf("%s: expected event %q, got %q", test.name, test.expectedEvent, event)
+		}
+	}
+}
+
+func unmountWaitHandlerFactory(client kubernetes.Interface, informerFactory informers.SharedInformerFactory, csi attacher.Attacher) Handler {
+	handler := csiHandlerFactory(client, informerFactory, csi)
+	handler.(*csiHandler).unmountWait = time.Hour
+	return handler
+}
+
+func TestCSIHandlerUnmountWait(t *testing.T) {
+	vaGroupResourceVersion := schema.GroupVersionResource{
+		Group:    storage.GroupName,
+		Version:  "v1beta1",
+		Resource: "volumeattachments",
+	}
+	inUse := nodeWithVolumesInUse(uniqueVolumeName(testAttacherName, testVolumeHandle))
+	deletedAt := metav1.Now()
+	recentlyDeleted := func(va *storage.VolumeAttachment) *storage.VolumeAttachment {
+		va.DeletionTimestamp = &deletedAt
+		return va
+	}
+
+	runTests(t, unmountWaitHandlerFactory, []testCase{
+		{
+			name:             "volume in use -> detach waits without CSI call",
+			initialObjects:   []runtime.Object{pvWithFinalizer(), inUse},
+			addedVA:          recentlyDeleted(va(true, fin, ann)),
+			expectedActions:  []core.Action{},
+			expectedCSICalls: []csiCall{},
+		},
+		{
+			name:           "volume unmounted -> successful detach",
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			addedVA:        recentlyDeleted(va(true, fin, ann)),
+			expectedActions: []core.Action{
+				core.NewPatchAction(vaGroupResourceVersion, metav1.NamespaceNone, testPVName+"-"+testNodeName,
+					types.MergePatchType, patch(recentlyDeleted(va(true, fin, ann)), recentlyDeleted(va(false /*attached*/, "", ann)))),
+			},
+			expectedCSICalls: []csiCall{
+				{"detach", testVolumeHandle, testNodeID, nil, nil, false, nil, false, nil, 0},
+			},
+		},
+	})
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// workerScaleInterval is the period of adjusting the number of workers.
+const workerScaleInterval = 10 * time.Second
+
+// workerScaler limits the number of VolumeAttachment workers that process
+// objects at the same time. The limit grows while objects wait in the queue
+// and the driver is fast, it shrinks when CSI calls get slower than the
+// latency target or when the queue is empty. A nil scaler does not limit
+// the workers.
+type workerScaler struct {
+	driverName    string
+	max           int
+	latencyTarget time.Duration
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	min     int
+	limit   int
+	active  int
+	stopped bool
+	// Sum and number of durations of CSI calls since the last scale.
+	latencySum   time.Duration
+	latencyCount int
+}
+
+// newWorkerScaler returns a scaler of workers between min and max, nil when
+// max is not greater than min.
+func newWorkerScaler(driverName string, min, max int, latencyTarget time.Duration) *workerScaler {
+	if max <= min {
+		return nil
+	}
+	s := &workerScaler{
+		driverName:    driverName,
+		min:           min,
+		max:           max,
+		latencyTarget: latencyTarget,
+		limit:         min,
+	}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+// workers returns the number of workers to start for a controller run with
+// at least the given number of active workers.
+func (s *workerScaler) workers(workers int) int {
+	if s == nil || workers > s.max {
+		return workers
+	}
+	return s.max
+}
+
+// start prepares the scaler for a controller run with at least min active
+// workers.
+func (s *workerScaler) start(min int) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.min = min
+	s.limit = min
+	s.stopped = false
+	workerThreads.WithLabelValues(s.driverName).Set(float64(s.limit))
+}
+
+// acquire waits until a worker may process an object. It returns false when
+// the scaler was stopped.
+func (s *workerScaler) acquire() bool {
+	if s == nil {
+		return true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.active >= s.limit && !s.stopped {
+		s.cond.Wait()
+	}
+	if s.stopped {
+		return false
+	}
+	s.active++
+	return true
+}
+
+// release ends processing of an object started by a successful acquire.
+func (s *workerScaler) release() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.active--
+	s.cond.Signal()
+}
+
+// stop wakes up all workers waiting in acquire.
+func (s *workerScaler) stop() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stopped = true
+	s.cond.Broadcast()
+}
+
+// observe records the duration of a CSI call.
+func (s *workerScaler) observe(duration time.Duration) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.latencySum += duration
+	s.latencyCount++
+}
+
+// scale adjusts the limit of workers to the number of objects waiting in
+// the queue and to the mean duration of CSI calls since the last scale.
+func (s *workerScaler) scale(queueLength int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var latency time.Duration
+	if s.latencyCount > 0 {
+		latency = s.latencySum / time.Duration(s.latencyCount)
+	}
+	s.latencySum, s.latencyCount = 0, 0
+
+	limit := s.limit
+	switch {
+	case latency > s.latencyTarget:
+		// The driver is overloaded.
+		limit -= limit/4 + 1
+	case queueLength > 0:
+		limit *= 2
+	case s.active < limit:
+		// Idle workers.
+		limit--
+	}
+	if limit > s.max {
+		limit = s.max
+	}
+	if limit < s.min {
+		limit = s.min
+	}
+	if limit == s.limit {
+		return
+	}
+	klog.V(2).Infof("Scaling workers of %q from %d to %d: %d VolumeAttachments queued, mean CSI call latency %s", s.driverName, s.limit, limit, queueLength, latency)
+	s.limit = limit
+	workerThreads.WithLabelValues(s.driverName).Set(float64(limit))
+	s.cond.Broadcast()
+}
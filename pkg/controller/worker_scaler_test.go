@@ -0,0 +1,100 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWorkerScaler(t *testing.T) {
+	s := newWorkerScaler("csi/test", 2, 10, time.Second)
+	s.start(2)
+	expectLimit := func(expected int) {
+		t.Helper()
+		if s.limit != expected {
+			t.Errorf("expected limit %d, got %d", expected, s.limit)
+		}
+	}
+
+	// Queued objects double the workers up to the maximum.
+	s.scale(100)
+	expectLimit(4)
+	s.scale(100)
+	s.scale(100)
+	expectLimit(10)
+
+	// Slow CSI calls remove workers, also with queued objects.
+	s.observe(3 * time.Second)
+	s.observe(time.Second)
+	s.scale(100)
+	expectLimit(7)
+	// Latency is the mean since the last scale.
+	s.observe(500 * time.Millisecond)
+	s.scale(100)
+	expectLimit(10)
+
+	// Idle workers are removed one by one down to the minimum.
+	if !s.acquire() {
+		t.Fatalf("expected acquire to succeed")
+	}
+	s.scale(0)
+	expectLimit(9)
+	for i := 0; i < 10; i++ {
+		s.scale(0)
+	}
+	expectLimit(2)
+	s.release()
+
+	// A minimum above the maximum disables scaling.
+	s.start(12)
+	if workers := s.workers(12); workers != 12 {
+		t.Errorf("expected 12 workers, got %d", workers)
+	}
+	s.scale(100)
+	expectLimit(12)
+}
+
+func TestWorkerScalerAcquire(t *testing.T) {
+	s := newWorkerScaler("csi/test", 1, 2, time.Second)
+	s.start(1)
+	if !s.acquire() {
+		t.Fatalf("expected acquire to succeed")
+	}
+	acquired := make(chan bool)
+	go func() { acquired <- s.acquire() }()
+	select {
+	case <-acquired:
+		t.Fatalf("expected acquire to wait over the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	s.release()
+	if ok := <-acquired; !ok {
+		t.Errorf("expected acquire to succeed after release")
+	}
+
+	go func() { acquired <- s.acquire() }()
+	s.stop()
+	if ok := <-acquired; ok {
+		t.Errorf("expected acquire to fail after stop")
+	}
+
+	var disabled *workerScaler
+	if !disabled.acquire() || disabled.workers(3) != 3 {
+		t.Errorf("expected a nil scaler not to limit workers")
+	}
+}
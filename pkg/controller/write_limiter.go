@@ -0,0 +1,189 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"golang.org/x/time/rate"
+	"k8s.io/klog"
+)
+
+// AdaptiveWriteLimiter limits the rate of API server writes of all workers
+// together. The allowed rate is halved each time the API server looks
+// unhealthy (429, 5xx or a broken connection) and it slowly recovers back to
+// the maximum with each successful request (AIMD), so a recovering control
+// plane is not hammered by all workers retrying independently.
+//
+// It is used as http.RoundTripper wrapper of the client used by the
+// controller. All failed requests are counted by
+// csi_attacher_apiserver_request_errors_total metric.
+type AdaptiveWriteLimiter struct {
+	lock     sync.Mutex
+	limiter  *rate.Limiter
+	minQPS   float64
+	maxQPS   float64
+	current  float64
+	recovery float64
+}
+
+// NewAdaptiveWriteLimiter returns a new AdaptiveWriteLimiter that allows API
+// server writes between minQPS and maxQPS per second.
+func NewAdaptiveWriteLimiter(minQPS, maxQPS float64, burst int) *AdaptiveWriteLimiter {
+	if minQPS > maxQPS {
+		minQPS = maxQPS
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	l := &AdaptiveWriteLimiter{
+		limiter: rate.NewLimiter(rate.Limit(maxQPS), burst),
+		minQPS:  minQPS,
+		maxQPS:  maxQPS,
+		current: maxQPS,
+		// Get back to maxQPS in ~20 successful requests after the worst slowdown.
+		recovery: (maxQPS - minQPS) / 20,
+	}
+	apiWriteQPSLimit.WithLabelValues().Set(maxQPS)
+	return l
+}
+
+// WrapTransport returns RoundTripper that limits rate of write requests sent
+// through rt. It can be used as rest.Config.WrapTransport.
+func (l *AdaptiveWriteLimiter) WrapTransport(rt http.RoundTripper) http.RoundTripper {
+	return &limitedRoundTripper{limiter: l, rt: rt}
+}
+
+// SetLimits changes the minimum and maximum allowed writes per second. The
+// current limit is capped to the new range.
+func (l *AdaptiveWriteLimiter) SetLimits(minQPS, maxQPS float64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if minQPS > maxQPS {
+		minQPS = maxQPS
+	}
+	l.minQPS = minQPS
+	l.maxQPS = maxQPS
+	l.recovery = (maxQPS - minQPS) / 20
+	current := l.current
+	if current > maxQPS {
+		current = maxQPS
+	}
+	if current < minQPS {
+		current = minQPS
+	}
+	l.current = current
+	l.limiter.SetLimit(rate.Limit(current))
+	apiWriteQPSLimit.WithLabelValues().Set(current)
+}
+
+// CurrentQPS returns the current limit of writes per second.
+func (l *AdaptiveWriteLimiter) CurrentQPS() float64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.current
+}
+
+// observe adjusts the allowed rate based on result of a request.
+func (l *AdaptiveWriteLimiter) observe(healthy bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	next := l.current
+	if healthy {
+		next += l.recovery
+		if next > l.maxQPS {
+			next = l.maxQPS
+		}
+	} else {
+		next /= 2
+		if next < l.minQPS {
+			next = l.minQPS
+		}
+	}
+	if next == l.current {
+		return
+	}
+	if !healthy {
+		klog.V(2).Infof("API server looks unhealthy, slowing down writes to %.2f QPS", next)
+	} else if next == l.maxQPS {
+		klog.V(2).Infof("API server recovered, writes restored to %.2f QPS", next)
+	}
+	l.current = next
+	l.limiter.SetLimit(rate.Limit(next))
+	apiWriteQPSLimit.WithLabelValues().Set(next)
+}
+
+type limitedRoundTripper struct {
+	limiter *AdaptiveWriteLimiter
+	rt      http.RoundTripper
+}
+
+var _ http.RoundTripper = &limitedRoundTripper{}
+
+func (r *limitedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isWrite(req.Method) {
+		if err := r.limiter.limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := r.rt.RoundTrip(req)
+	if err != nil {
+		apiRequestErrorsTotal.WithLabelValues(req.Method, requestErrorCode(err)).Inc()
+		r.limiter.observe(false)
+		return resp, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		apiRequestErrorsTotal.WithLabelValues(req.Method, strconv.Itoa(resp.StatusCode)).Inc()
+	}
+	r.limiter.observe(!isUnhealthyStatus(resp.StatusCode))
+	return resp, nil
+}
+
+func (r *limitedRoundTripper) WrappedRoundTripper() http.RoundTripper {
+	return r.rt
+}
+
+// requestErrorCode returns the code label of a request that failed with err
+// without a response.
+func requestErrorCode(err error) string {
+	if netErr, ok := err.(net.Error); (ok && netErr.Timeout()) || err == context.DeadlineExceeded {
+		return "timeout"
+	}
+	return "error"
+}
+
+func isWrite(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isUnhealthyStatus returns true for HTTP status codes that indicate that the
+// API server is overloaded or unhealthy, as opposite to errors caused by the
+// request itself (404, 409, ...).
+func isUnhealthyStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
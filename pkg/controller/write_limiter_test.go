@@ -0,0 +1,123 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+type fakeRoundTripper struct {
+	code int
+	err  error
+}
+
+func (f *fakeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &http.Response{StatusCode: f.code, Request: req}, nil
+}
+
+func TestAdaptiveWriteLimiter(t *testing.T) {
+	limiter := NewAdaptiveWriteLimiter(1, 100, 100)
+	fake := &fakeRoundTripper{code: http.StatusOK}
+	rt := limiter.WrapTransport(fake)
+
+	send := func(method string) {
+		req, _ := http.NewRequest(method, "https://apiserver/api/v1/persistentvolumes/pv1", nil)
+		rt.RoundTrip(req)
+	}
+
+	send(http.MethodPatch)
+	if qps := limiter.CurrentQPS(); qps != 100 {
+		t.Errorf("expected 100 QPS after success, got %v", qps)
+	}
+
+	fake.code = http.StatusServiceUnavailable
+	send(http.MethodPatch)
+	if qps := limiter.CurrentQPS(); qps != 50 {
+		t.Errorf("expected 50 QPS after 503, got %v", qps)
+	}
+
+	fake.code = http.StatusTooManyRequests
+	send(http.MethodGet)
+	if qps := limiter.CurrentQPS(); qps != 25 {
+		t.Errorf("expected 25 QPS after 429, got %v", qps)
+	}
+
+	fake.code = 0
+	fake.err = errors.New("connection refused")
+	for i := 0; i < 10; i++ {
+		send(http.MethodGet)
+	}
+	if qps := limiter.CurrentQPS(); qps != 1 {
+		t.Errorf("expected minimal 1 QPS after many errors, got %v", qps)
+	}
+	if apiRequestErrorsTotal.WithLabelValues(http.MethodGet, "error").Value() < 10 {
+		t.Errorf("expected connection errors to be counted")
+	}
+
+	fake.err = context.DeadlineExceeded
+	timeouts := apiRequestErrorsTotal.WithLabelValues(http.MethodGet, "timeout").Value()
+	send(http.MethodGet)
+	if apiRequestErrorsTotal.WithLabelValues(http.MethodGet, "timeout").Value() != timeouts+1 {
+		t.Errorf("expected a timeout to be counted")
+	}
+
+	// Client errors do not indicate unhealthy API server.
+	fake.err = nil
+	fake.code = http.StatusNotFound
+	send(http.MethodGet)
+	if qps := limiter.CurrentQPS(); qps <= 1 {
+		t.Errorf("expected QPS to recover after 404, got %v", qps)
+	}
+
+	fake.code = http.StatusOK
+	for i := 0; i < 30; i++ {
+		send(http.MethodGet)
+	}
+	if qps := limiter.CurrentQPS(); qps != 100 {
+		t.Errorf("expected QPS to fully recover, got %v", qps)
+	}
+}
+
+func TestAdaptiveWriteLimiterSetLimits(t *testing.T) {
+	limiter := NewAdaptiveWriteLimiter(1, 100, 100)
+
+	limiter.SetLimits(1, 10)
+	if qps := limiter.CurrentQPS(); qps != 10 {
+		t.Errorf("expected QPS capped to the new maximum 10, got %v", qps)
+	}
+
+	limiter.SetLimits(20, 50)
+	if qps := limiter.CurrentQPS(); qps != 20 {
+		t.Errorf("expected QPS raised to the new minimum 20, got %v", qps)
+	}
+
+	fake := &fakeRoundTripper{code: http.StatusOK}
+	rt := limiter.WrapTransport(fake)
+	for i := 0; i < 30; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "https://apiserver/api/v1/persistentvolumes/pv1", nil)
+		rt.RoundTrip(req)
+	}
+	if qps := limiter.CurrentQPS(); qps != 50 {
+		t.Errorf("expected QPS to recover to the new maximum 50, got %v", qps)
+	}
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package csiproxy connects to a CSI driver over TCP through an
+// authenticated gRPC proxy, e.g. a connection broker or an appliance gateway
+// in front of the CSI controller service.
+package csiproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"k8s.io/klog"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
+)
+
+// Options are options of the connection to the proxy. The client
+// certificate is read again for each new connection and the token for each
+// call, so they can be rotated without a restart.
+type Options struct {
+	// CAFile is the CA bundle that verifies the proxy certificate. The
+	// system CAs are used when empty.
+	CAFile string
+	// CertFile and KeyFile are the client certificate and key for mutual
+	// TLS. Both or none must be set.
+	CertFile string
+	KeyFile  string
+	// TokenFile contains a bearer token sent with each call.
+	TokenFile string
+	// RedactPublishContextKeys are PublishContext keys whose values are not
+	// logged.
+	RedactPublishContextKeys []string
+}
+
+// Validate returns an error when the options can't be used.
+func (o Options) Validate() error {
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return errors.New("both client certificate and key must be set")
+	}
+	return nil
+}
+
+// Connect connects to the proxy at endpoint ("host:port") using TLS. It
+// blocks until the connection is established.
+func Connect(endpoint string, options Options) (*grpc.ClientConn, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	if _, _, err := net.SplitHostPort(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid CSI proxy endpoint %q: %v", endpoint, err)
+	}
+	tlsConfig, err := newTLSConfig(options)
+	if err != nil {
+		return nil, err
+	}
+
+	dialOptions := []grpc.DialOption{
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		grpc.WithBackoffMaxDelay(time.Second), // Retry every second after failure.
+		grpc.WithBlock(),                      // Block until connection succeeds.
+		grpc.WithUnaryInterceptor(attacher.LogGRPC(options.RedactPublishContextKeys)),
+	}
+	if options.TokenFile != "" {
+		dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(tokenCredentials{path: options.TokenFile}))
+	}
+
+	klog.Infof("Connecting to CSI proxy %s", endpoint)
+	return grpc.Dial(endpoint, dialOptions...)
+}
+
+func newTLSConfig(options Options) (*tls.Config, error) {
+	// gRPC verifies the host name of endpoint.
+	config := &tls.Config{}
+	if options.CAFile != "" {
+		pem, err := ioutil.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", options.CAFile)
+		}
+	}
+	if options.CertFile != "" {
+		// Check the files now, so misconfiguration is reported at startup
+		// and not as a failing handshake.
+		if _, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile); err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+			if err != nil {
+				klog.Errorf("Failed to load client certificate: %v", err)
+				return nil, err
+			}
+			return &cert, nil
+		}
+	}
+	return config, nil
+}
+
+// tokenCredentials sends the bearer token from a file with each call.
+type tokenCredentials struct {
+	path string
+}
+
+var _ credentials.PerRPCCredentials = tokenCredentials{}
+
+func (c tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token file: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return nil, fmt.Errorf("token file %s is empty", c.path)
+	}
+	return map[string]string{"authorization": "Bearer " + token}, nil
+}
+
+func (c tokenCredentials) RequireTransportSecurity() bool {
+	return true
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package discovery finds sockets of CSI drivers.
+package discovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+// SocketDir watches a directory for Unix domain sockets. Sockets directly in
+// the directory and in its subdirectories are found, so both
+// /run/csi/<driver>.sock and /run/csi/<driver>/csi.sock layouts work.
+type SocketDir struct {
+	dir      string
+	period   time.Duration
+	onAdd    func(path string)
+	onRemove func(path string)
+
+	// sockets are paths of sockets found by the last scan.
+	sockets map[string]bool
+}
+
+// NewSocketDir returns a new SocketDir that scans dir every period. onAdd is
+// called with path of each socket that appeared, onRemove with path of each
+// socket that disappeared.
+func NewSocketDir(dir string, period time.Duration, onAdd, onRemove func(path string)) *SocketDir {
+	return &SocketDir{
+		dir:      dir,
+		period:   period,
+		onAdd:    onAdd,
+		onRemove: onRemove,
+		sockets:  map[string]bool{},
+	}
+}
+
+// Run scans the directory until stopCh is closed. Then it calls onRemove for
+// all sockets found so far.
+func (d *SocketDir) Run(stopCh <-chan struct{}) {
+	klog.Infof("Watching %s for CSI driver sockets", d.dir)
+	wait.Until(d.scan, d.period, stopCh)
+
+	for _, path := range sortedKeys(d.sockets) {
+		delete(d.sockets, path)
+		d.onRemove(path)
+	}
+}
+
+func (d *SocketDir) scan() {
+	found, err := findSockets(d.dir)
+	if err != nil {
+		// Keep the known sockets, the directory may be temporarily
+		// unavailable.
+		klog.Errorf("Failed to find sockets in %s: %v", d.dir, err)
+		return
+	}
+	for _, path := range sortedKeys(d.sockets) {
+		if !found[path] {
+			klog.V(2).Infof("Socket %s disappeared", path)
+			delete(d.sockets, path)
+			d.onRemove(path)
+		}
+	}
+	for _, path := range sortedKeys(found) {
+		if !d.sockets[path] {
+			klog.V(2).Infof("Found socket %s", path)
+			d.sockets[path] = true
+			d.onAdd(path)
+		}
+	}
+}
+
+// findSockets returns paths of sockets in dir and in its subdirectories.
+func findSockets(dir string) (map[string]bool, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sockets := map[string]bool{}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.Mode()&os.ModeSocket != 0 {
+			sockets[path] = true
+			continue
+		}
+		if !entry.IsDir() {
+			continue
+		}
+		subEntries, err := ioutil.ReadDir(path)
+		if err != nil {
+			// The directory may have been removed together with its driver.
+			klog.V(4).Infof("Failed to read %s: %v", path, err)
+			continue
+		}
+		for _, subEntry := range subEntries {
+			if subEntry.Mode()&os.ModeSocket != 0 {
+				sockets[filepath.Join(path, subEntry.Name())] = true
+			}
+		}
+	}
+	return sockets, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSocketDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socket-dir-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	listen := func(path string) net.Listener {
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+
+	var events []string
+	d := NewSocketDir(dir, time.Second,
+		func(path string) { events = append(events, "add "+path) },
+		func(path string) { events = append(events, "remove "+path) })
+	expectEvents := func(step string, expected ...string) {
+		d.scan()
+		if !reflect.DeepEqual(events, expected) {
+			t.Errorf("%s: expected events %v, got %v", step, expected, events)
+		}
+		events = nil
+	}
+
+	expectEvents("empty directory")
+
+	a := filepath.Join(dir, "a.sock")
+	la := listen(a)
+	if err := os.Mkdir(filepath.Join(dir, "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	b := filepath.Join(dir, "b", "csi.sock")
+	lb := listen(b)
+	defer lb.Close()
+	// Regular files are ignored.
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectEvents("new sockets", "add "+a, "add "+b)
+	expectEvents("no change")
+
+	la.Close()
+	expectEvents("removed socket", "remove "+a)
+
+	stopCh := make(chan struct{})
+	close(stopCh)
+	d.Run(stopCh)
+	if !reflect.DeepEqual(events, []string{"remove " + b}) {
+		t.Errorf("stop: expected removal of %s, got %v", b, events)
+	}
+}
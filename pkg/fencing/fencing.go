@@ -0,0 +1,231 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fencing finds nodes that are fenced by fencing or maintenance
+// operators, so that volumes in use on them can be detached without waiting
+// for unmount.
+package fencing
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/runtime/serializer/json"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// OutOfServiceTaint is the taint of nodes that are shut down and can't
+// access their volumes anymore, see non-graceful node shutdown.
+const OutOfServiceTaint = "node.kubernetes.io/out-of-service"
+
+// nodeIndex indexes fencing objects by name of the fenced node.
+const nodeIndex = "node"
+
+// Resource is a custom resource whose objects fence nodes. An object fences
+// the node whose name is in its NodeNameField.
+type Resource struct {
+	Group    string
+	Version  string
+	Resource string
+	// NodeNameField is the path of the field with the node name, e.g.
+	// spec.nodeName.
+	NodeNameField []string
+}
+
+// NodeMaintenance is the resource of the Medik8s node maintenance operator.
+var NodeMaintenance = Resource{
+	Group:         "nodemaintenance.medik8s.io",
+	Version:       "v1beta1",
+	Resource:      "nodemaintenances",
+	NodeNameField: []string{"spec", "nodeName"},
+}
+
+// wellKnown are resources that can be given by name to ParseResource.
+var wellKnown = map[string]Resource{
+	"nodemaintenance": NodeMaintenance,
+}
+
+func (r Resource) String() string {
+	return r.Resource + "." + r.Group
+}
+
+// ParseResource parses a well-known resource name, e.g. "nodemaintenance",
+// or "<resource>.<group>/<version>=<field path>", e.g.
+// "nodemaintenances.nodemaintenance.medik8s.io/v1beta1=spec.nodeName".
+func ParseResource(value string) (Resource, error) {
+	if resource, ok := wellKnown[value]; ok {
+		return resource, nil
+	}
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return Resource{}, fmt.Errorf("invalid fencing resource %q: expected <resource>.<group>/<version>=<field path> or one of %s", value, wellKnownNames())
+	}
+	groupVersion := strings.SplitN(parts[0], "/", 2)
+	nameGroup := strings.SplitN(groupVersion[0], ".", 2)
+	if len(groupVersion) != 2 || groupVersion[1] == "" || len(nameGroup) != 2 || nameGroup[0] == "" || nameGroup[1] == "" {
+		return Resource{}, fmt.Errorf("invalid fencing resource %q: expected <resource>.<group>/<version>=<field path>", value)
+	}
+	field := strings.Split(parts[1], ".")
+	for _, name := range field {
+		if name == "" {
+			return Resource{}, fmt.Errorf("invalid fencing resource %q: invalid field path %q", value, parts[1])
+		}
+	}
+	return Resource{
+		Group:         nameGroup[1],
+		Version:       groupVersion[1],
+		Resource:      nameGroup[0],
+		NodeNameField: field,
+	}, nil
+}
+
+func wellKnownNames() string {
+	var names []string
+	for name := range wellKnown {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Checker tells whether a node is fenced.
+type Checker interface {
+	// Fenced returns true and what fences the node when the node is fenced.
+	Fenced(node *v1.Node) (reason string, fenced bool)
+}
+
+// NewListWatch returns ListerWatcher of all objects of resource.
+func NewListWatch(config *rest.Config, resource Resource) (cache.ListerWatcher, error) {
+	// Watch events are decoded as metav1.WatchEvent, objects in them and
+	// lists as unstructured.
+	scheme := runtime.NewScheme()
+	metav1.AddToGroupVersion(scheme, schema.GroupVersion{Version: "v1"})
+	watchSerializer := json.NewSerializer(json.DefaultMetaFactory, scheme, scheme, false)
+
+	config = rest.CopyConfig(config)
+	config.GroupVersion = &schema.GroupVersion{Group: resource.Group, Version: resource.Version}
+	config.APIPath = "/apis"
+	config.ContentType = runtime.ContentTypeJSON
+	config.NegotiatedSerializer = serializer.NegotiatedSerializerWrapper(runtime.SerializerInfo{
+		MediaType:     runtime.ContentTypeJSON,
+		EncodesAsText: true,
+		Serializer:    unstructured.UnstructuredJSONScheme,
+		StreamSerializer: &runtime.StreamSerializerInfo{
+			EncodesAsText: true,
+			Serializer:    watchSerializer,
+			Framer:        json.Framer,
+		},
+	})
+	client, err := rest.RESTClientFor(config)
+	if err != nil {
+		return nil, err
+	}
+	return cache.NewListWatchFromClient(client, resource.Resource, metav1.NamespaceAll, fields.Everything()), nil
+}
+
+// Watcher watches objects of fencing resources and checks the out of
+// service taint of nodes.
+type Watcher struct {
+	outOfServiceTaint bool
+	resources         []Resource
+	informers         []cache.SharedIndexInformer
+}
+
+var _ Checker = &Watcher{}
+
+// NewWatcher returns a new Watcher. With outOfServiceTaint, nodes with
+// OutOfServiceTaint are fenced.
+func NewWatcher(outOfServiceTaint bool) *Watcher {
+	return &Watcher{outOfServiceTaint: outOfServiceTaint}
+}
+
+// AddResource watches objects of resource listed by lw. It must be called
+// before Run.
+func (w *Watcher) AddResource(resource Resource, lw cache.ListerWatcher, resync time.Duration) {
+	field := resource.NodeNameField
+	informer := cache.NewSharedIndexInformer(lw, &unstructured.Unstructured{}, resync, cache.Indexers{
+		nodeIndex: func(obj interface{}) ([]string, error) {
+			u, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				return nil, nil
+			}
+			name, found, err := unstructured.NestedString(u.Object, field...)
+			if err != nil || !found || name == "" {
+				return nil, nil
+			}
+			return []string{name}, nil
+		},
+	})
+	w.resources = append(w.resources, resource)
+	w.informers = append(w.informers, informer)
+}
+
+// Run runs the informers of fencing resources until stopCh is closed.
+func (w *Watcher) Run(stopCh <-chan struct{}) {
+	for _, informer := range w.informers {
+		go informer.Run(stopCh)
+	}
+	<-stopCh
+}
+
+// HasSynced returns true when the informer caches are synced.
+func (w *Watcher) HasSynced() bool {
+	for _, informer := range w.informers {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// Fenced returns true when node has OutOfServiceTaint or an object of a
+// fencing resource refers to it.
+func (w *Watcher) Fenced(node *v1.Node) (string, bool) {
+	if w.outOfServiceTaint {
+		for _, taint := range node.Spec.Taints {
+			if taint.Key == OutOfServiceTaint {
+				return "taint " + OutOfServiceTaint, true
+			}
+		}
+	}
+	for i, informer := range w.informers {
+		objs, err := informer.GetIndexer().ByIndex(nodeIndex, node.Name)
+		if err != nil {
+			klog.Errorf("Failed to find %s of node %q: %v", w.resources[i], node.Name, err)
+			continue
+		}
+		if len(objs) > 0 {
+			u := objs[0].(*unstructured.Unstructured)
+			name := u.GetName()
+			if u.GetNamespace() != "" {
+				name = u.GetNamespace() + "/" + name
+			}
+			return fmt.Sprintf("%s %s", w.resources[i], name), true
+		}
+	}
+	return "", false
+}
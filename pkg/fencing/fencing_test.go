@@ -0,0 +1,223 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fencing
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestParseResource(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected Resource
+		err      bool
+	}{
+		{
+			value:    "nodemaintenance",
+			expected: NodeMaintenance,
+		},
+		{
+			value: "fences.example.com/v1=spec.target.node",
+			expected: Resource{
+				Group:         "example.com",
+				Version:       "v1",
+				Resource:      "fences",
+				NodeNameField: []string{"spec", "target", "node"},
+			},
+		},
+		{value: "fences.example.com/v1", err: true},
+		{value: "fences.example.com=spec.nodeName", err: true},
+		{value: "fences/v1=spec.nodeName", err: true},
+		{value: "fences.example.com/v1=spec..nodeName", err: true},
+		{value: "", err: true},
+	}
+	for _, test := range tests {
+		resource, err := ParseResource(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected error, got %+v", test.value, resource)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.value, err)
+		}
+		if !reflect.DeepEqual(resource, test.expected) {
+			t.Errorf("%q: expected %+v, got %+v", test.value, test.expected, resource)
+		}
+	}
+}
+
+func maintenance(namespace, name, nodeName string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "nodemaintenance.medik8s.io/v1beta1",
+		"kind":       "NodeMaintenance",
+		"metadata": map[string]interface{}{
+			"name":            name,
+			"resourceVersion": "1",
+		},
+		"spec": map[string]interface{}{
+			"nodeName": nodeName,
+		},
+	}}
+	if namespace != "" {
+		u.SetNamespace(namespace)
+	}
+	return u
+}
+
+func fakeListWatch(objs ...*unstructured.Unstructured) cache.ListerWatcher {
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			list := &unstructured.UnstructuredList{}
+			list.SetResourceVersion("1")
+			for _, obj := range objs {
+				list.Items = append(list.Items, *obj)
+			}
+			return list, nil
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return watch.NewFake(), nil
+		},
+	}
+}
+
+func fencingNode(name string, taints ...v1.Taint) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       v1.NodeSpec{Taints: taints},
+	}
+}
+
+func TestWatcherFenced(t *testing.T) {
+	outOfService := v1.Taint{Key: OutOfServiceTaint, Value: "nodeshutdown", Effect: v1.TaintEffectNoExecute}
+	tests := []struct {
+		name              string
+		outOfServiceTaint bool
+		objects           []*unstructured.Unstructured
+		node              *v1.Node
+		expectedReason    string
+	}{
+		{
+			name: "not fenced",
+			node: fencingNode("node1"),
+		},
+		{
+			name:              "out of service",
+			outOfServiceTaint: true,
+			node:              fencingNode("node1", outOfService),
+			expectedReason:    "taint node.kubernetes.io/out-of-service",
+		},
+		{
+			name: "out of service taint ignored",
+			node: fencingNode("node1", outOfService),
+		},
+		{
+			name:           "node maintenance",
+			objects:        []*unstructured.Unstructured{maintenance("", "maintenance-1", "node1")},
+			node:           fencingNode("node1"),
+			expectedReason: "nodemaintenances.nodemaintenance.medik8s.io maintenance-1",
+		},
+		{
+			name:           "namespaced object",
+			objects:        []*unstructured.Unstructured{maintenance("ops", "maintenance-1", "node1")},
+			node:           fencingNode("node1"),
+			expectedReason: "nodemaintenances.nodemaintenance.medik8s.io ops/maintenance-1",
+		},
+		{
+			name:    "node maintenance of another node",
+			objects: []*unstructured.Unstructured{maintenance("", "maintenance-1", "node2")},
+			node:    fencingNode("node1"),
+		},
+	}
+	for _, test := range tests {
+		func() {
+			w := NewWatcher(test.outOfServiceTaint)
+			w.AddResource(NodeMaintenance, fakeListWatch(test.objects...), 0)
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			go w.Run(stopCh)
+			if !cache.WaitForCacheSync(stopCh, w.HasSynced) {
+				t.Fatalf("%s: informer did not sync", test.name)
+			}
+
+			reason, fenced := w.Fenced(test.node)
+			if fenced != (test.expectedReason != "") || reason != test.expectedReason {
+				t.Errorf("%s: expected reason %q, got %q (fenced %v)", test.name, test.expectedReason, reason, fenced)
+			}
+		}()
+	}
+}
+
+func TestNewListWatch(t *testing.T) {
+	obj := maintenance("", "maintenance-1", "node1")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/nodemaintenance.medik8s.io/v1beta1/nodemaintenances" {
+			http.NotFound(w, r)
+			return
+		}
+		data, _ := obj.MarshalJSON()
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("watch") == "true" {
+			fmt.Fprintf(w, `{"type":"ADDED","object":%s}`+"\n", data)
+			return
+		}
+		fmt.Fprintf(w, `{"apiVersion":"nodemaintenance.medik8s.io/v1beta1","kind":"NodeMaintenanceList","metadata":{"resourceVersion":"1"},"items":[%s]}`, data)
+	}))
+	defer server.Close()
+
+	lw, err := NewListWatch(&rest.Config{Host: server.URL}, NodeMaintenance)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	list, err := lw.List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	items := list.(*unstructured.UnstructuredList).Items
+	if len(items) != 1 || items[0].GetName() != "maintenance-1" {
+		t.Errorf("expected maintenance-1 in the list, got %+v", items)
+	}
+
+	watcher, err := lw.Watch(metav1.ListOptions{ResourceVersion: "1"})
+	if err != nil {
+		t.Fatalf("watch failed: %v", err)
+	}
+	defer watcher.Stop()
+	select {
+	case event := <-watcher.ResultChan():
+		u, ok := event.Object.(*unstructured.Unstructured)
+		if event.Type != watch.Added || !ok || u.GetName() != "maintenance-1" {
+			t.Errorf("expected ADDED maintenance-1, got %s %+v", event.Type, event.Object)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no watch event")
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package healthz implements HTTP handlers that aggregate results of named
+// health checks, suitable for Kubernetes liveness and readiness probes.
+package healthz
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Checker returns nil when the checked component is healthy.
+type Checker func() error
+
+// Handler is http.Handler that runs all registered checks. It responds with
+// 200 when all checks pass and with 503 listing the failed checks otherwise.
+type Handler struct {
+	lock   sync.RWMutex
+	checks map[string]Checker
+}
+
+var _ http.Handler = &Handler{}
+
+// NewHandler returns a new Handler without any checks, i.e. always healthy.
+func NewHandler() *Handler {
+	return &Handler{checks: map[string]Checker{}}
+}
+
+// AddCheck registers a named check. An existing check with the same name is replaced.
+func (h *Handler) AddCheck(name string, check Checker) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.checks[name] = check
+}
+
+// RemoveCheck unregisters a named check.
+func (h *Handler) RemoveCheck(name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.checks, name)
+}
+
+// Check runs all registered checks and returns error describing the failed
+// ones, if any.
+func (h *Handler) Check() error {
+	_, err := h.run()
+	return err
+}
+
+func (h *Handler) run() (string, error) {
+	h.lock.RLock()
+	names := make([]string, 0, len(h.checks))
+	for name := range h.checks {
+		names = append(names, name)
+	}
+	checks := make([]Checker, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		checks = append(checks, h.checks[name])
+	}
+	h.lock.RUnlock()
+
+	output := &bytes.Buffer{}
+	var failed []string
+	for i, check := range checks {
+		if err := check(); err != nil {
+			fmt.Fprintf(output, "[-]%s failed: %s\n", names[i], err)
+			failed = append(failed, names[i])
+		} else {
+			fmt.Fprintf(output, "[+]%s ok\n", names[i])
+		}
+	}
+	if len(failed) > 0 {
+		return output.String(), fmt.Errorf("checks failed: %v", failed)
+	}
+	return output.String(), nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	output, err := h.run()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, output)
+		return
+	}
+	if _, verbose := req.URL.Query()["verbose"]; verbose {
+		fmt.Fprint(w, output)
+	}
+	fmt.Fprint(w, "ok\n")
+}
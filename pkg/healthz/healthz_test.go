@@ -0,0 +1,52 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package healthz
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	h := NewHandler()
+
+	get := func(url string) (int, string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	if code, body := get("/readyz"); code != http.StatusOK || body != "ok\n" {
+		t.Errorf("expected 200 ok without checks, got %d %q", code, body)
+	}
+
+	h.AddCheck("foo", func() error { return nil })
+	h.AddCheck("bar", func() error { return errors.New("mock error") })
+	if code, body := get("/readyz"); code != http.StatusServiceUnavailable || body != "[-]bar failed: mock error\n[+]foo ok\n" {
+		t.Errorf("expected 503 with failed check, got %d %q", code, body)
+	}
+	if err := h.Check(); err == nil {
+		t.Errorf("expected Check() error")
+	}
+
+	h.RemoveCheck("bar")
+	if code, body := get("/readyz?verbose"); code != http.StatusOK || body != "[+]foo ok\nok\n" {
+		t.Errorf("expected verbose 200, got %d %q", code, body)
+	}
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package hooks runs commands of integrators before volumes are attached
+// and after they are detached, e.g. to update SAN zoning or a CMDB.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/metrics"
+)
+
+// Hooks.
+const (
+	// PreAttach runs before ControllerPublish. The attach fails when the
+	// hook fails.
+	PreAttach = "pre-attach"
+	// PostDetach runs after a successful ControllerUnpublish. Its failures
+	// are only reported.
+	PostDetach = "post-detach"
+)
+
+// maxOutput is the length of the end of stderr that is added to errors of
+// failed hooks.
+const maxOutput = 512
+
+var executionsTotal = metrics.NewCounterVec(
+	metrics.Namespace+"_hook_executions_total",
+	"Number of executed hook commands, partitioned by hook (\"pre-attach\" or \"post-detach\") and result (\"success\" or \"failure\").",
+	"hook", "result")
+
+func init() {
+	metrics.MustRegister(executionsTotal)
+}
+
+// Event is the context of an executed hook. The command gets it as JSON on
+// stdin and as CSI_ATTACHER_* environment variables.
+type Event struct {
+	Hook             string `json:"hook"`
+	Driver           string `json:"driver"`
+	VolumeAttachment string `json:"volumeAttachment"`
+	// PersistentVolume is empty for inline volumes.
+	PersistentVolume string            `json:"persistentVolume,omitempty"`
+	VolumeHandle     string            `json:"volumeHandle"`
+	ReadOnly         bool              `json:"readOnly"`
+	VolumeAttributes map[string]string `json:"volumeAttributes,omitempty"`
+	Node             string            `json:"node"`
+	NodeID           string            `json:"nodeID"`
+}
+
+// env returns environment variables with the fields of e.
+func (e *Event) env() []string {
+	return []string{
+		"CSI_ATTACHER_HOOK=" + e.Hook,
+		"CSI_ATTACHER_DRIVER=" + e.Driver,
+		"CSI_ATTACHER_VOLUME_ATTACHMENT=" + e.VolumeAttachment,
+		"CSI_ATTACHER_PERSISTENT_VOLUME=" + e.PersistentVolume,
+		"CSI_ATTACHER_VOLUME_HANDLE=" + e.VolumeHandle,
+		"CSI_ATTACHER_READ_ONLY=" + strconv.FormatBool(e.ReadOnly),
+		"CSI_ATTACHER_NODE=" + e.Node,
+		"CSI_ATTACHER_NODE_ID=" + e.NodeID,
+	}
+}
+
+// Runner runs hooks.
+type Runner interface {
+	// Run runs the command of event.Hook. It returns an error when the
+	// command fails or does not finish in time.
+	Run(event *Event) error
+}
+
+// Commands runs executables as hooks. Commands have no arguments, wrap them
+// in a script to pass some.
+type Commands struct {
+	// PreAttach and PostDetach are paths of the executables, empty skips
+	// the hook.
+	PreAttach  string
+	PostDetach string
+	// Timeout is how long a command may run before it's killed.
+	Timeout time.Duration
+}
+
+var _ Runner = &Commands{}
+
+// Validate checks that the commands are executable files.
+func (c *Commands) Validate() error {
+	for _, path := range []string{c.PreAttach, c.PostDetach} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("invalid hook command: %v", err)
+		}
+		if info.IsDir() || info.Mode()&0111 == 0 {
+			return fmt.Errorf("invalid hook command %s: not an executable file", path)
+		}
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("timeout of hooks must be positive, got %s", c.Timeout)
+	}
+	return nil
+}
+
+// IsEmpty returns true when no hook is configured.
+func (c *Commands) IsEmpty() bool {
+	return c.PreAttach == "" && c.PostDetach == ""
+}
+
+func (c *Commands) Run(event *Event) error {
+	path := c.PreAttach
+	if event.Hook == PostDetach {
+		path = c.PostDetach
+	}
+	if path == "" {
+		return nil
+	}
+
+	err := c.run(path, event)
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	executionsTotal.WithLabelValues(event.Hook, result).Inc()
+	return err
+}
+
+func (c *Commands) run(path string, event *Event) error {
+	input, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Env = append(os.Environ(), event.env()...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	err = cmd.Run()
+	klog.V(4).Infof("Hook %s %s of %q finished after %s: %v, stdout: %q, stderr: %q", event.Hook, path, event.VolumeAttachment, time.Since(start), err, stdout.String(), stderr.String())
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s hook timed out after %s", event.Hook, c.Timeout)
+	}
+	if err != nil {
+		if output := tail(stderr.String()); output != "" {
+			return fmt.Errorf("%s hook failed: %v: %s", event.Hook, err, output)
+		}
+		return fmt.Errorf("%s hook failed: %v", event.Hook, err)
+	}
+	return nil
+}
+
+// tail returns the end of output without surrounding whitespace.
+func tail(output string) string {
+	output = strings.TrimSpace(output)
+	if len(output) > maxOutput {
+		output = "..." + output[len(output)-maxOutput:]
+	}
+	return output
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hooks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeScript writes an executable shell script to dir.
+func writeScript(t *testing.T, dir, name, script string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "external-attacher-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stdinFile := filepath.Join(dir, "stdin")
+	envFile := filepath.Join(dir, "env")
+	record := writeScript(t, dir, "record", "cat > "+stdinFile+"\nenv | grep ^CSI_ATTACHER_ | sort > "+envFile+"\n")
+	fail := writeScript(t, dir, "fail", "echo zoning failed >&2\nexit 3\n")
+	hang := writeScript(t, dir, "hang", "exec sleep 10\n")
+
+	event := &Event{
+		Hook:             PreAttach,
+		Driver:           "csi/test",
+		VolumeAttachment: "va1",
+		PersistentVolume: "pv1",
+		VolumeHandle:     "vol-1",
+		VolumeAttributes: map[string]string{"pool": "a"},
+		Node:             "node1",
+		NodeID:           "node1-id",
+	}
+
+	commands := &Commands{PreAttach: record, PostDetach: fail, Timeout: 10 * time.Second}
+	if err := commands.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := commands.Run(event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stdin, err := ioutil.ReadFile(stdinFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := &Event{}
+	if err := json.Unmarshal(stdin, received); err != nil {
+		t.Fatalf("invalid stdin %q: %v", stdin, err)
+	}
+	if received.VolumeAttachment != "va1" || received.VolumeAttributes["pool"] != "a" || received.NodeID != "node1-id" {
+		t.Errorf("unexpected stdin %+v", received)
+	}
+	env, err := ioutil.ReadFile(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedEnv := `CSI_ATTACHER_DRIVER=csi/test
+CSI_ATTACHER_HOOK=pre-attach
+CSI_ATTACHER_NODE=node1
+CSI_ATTACHER_NODE_ID=node1-id
+CSI_ATTACHER_PERSISTENT_VOLUME=pv1
+CSI_ATTACHER_READ_ONLY=false
+CSI_ATTACHER_VOLUME_ATTACHMENT=va1
+CSI_ATTACHER_VOLUME_HANDLE=vol-1
+`
+	if string(env) != expectedEnv {
+		t.Errorf("expected environment\n%s\ngot\n%s", expectedEnv, env)
+	}
+
+	event.Hook = PostDetach
+	err = commands.Run(event)
+	expected := "post-detach hook failed: exit status 3: zoning failed"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+
+	commands = &Commands{PreAttach: hang, Timeout: 100 * time.Millisecond}
+	event.Hook = PreAttach
+	if err := commands.Run(event); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected timeout, got %v", err)
+	}
+	// Hooks without command are skipped.
+	event.Hook = PostDetach
+	if err := commands.Run(event); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCommandsValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "external-attacher-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := writeScript(t, dir, "hook", "exit 0\n")
+	notExecutable := filepath.Join(dir, "data")
+	if err := ioutil.WriteFile(notExecutable, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		commands Commands
+		valid    bool
+	}{
+		{
+			name:     "valid",
+			commands: Commands{PreAttach: script, Timeout: time.Second},
+			valid:    true,
+		},
+		{
+			name:     "missing",
+			commands: Commands{PostDetach: filepath.Join(dir, "missing"), Timeout: time.Second},
+		},
+		{
+			name:     "not executable",
+			commands: Commands{PreAttach: notExecutable, Timeout: time.Second},
+		},
+		{
+			name:     "directory",
+			commands: Commands{PreAttach: dir, Timeout: time.Second},
+		},
+		{
+			name:     "zero timeout",
+			commands: Commands{PreAttach: script},
+		},
+	}
+	for _, test := range tests {
+		err := test.commands.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected error, got none", test.name)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package inspect lists VolumeAttachments of CSI drivers and reconstructs
+// their timelines from the API objects, for attacherctl.
+package inspect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/controller"
+)
+
+// Attachment is a VolumeAttachment in the list of attachments.
+type Attachment struct {
+	Name string
+	// PV is the name of the PersistentVolume, empty for inline volumes.
+	PV    string
+	Node  string
+	Age   time.Duration
+	State string
+	// ErrorClass is the gRPC code of the current attach or detach error,
+	// empty when there is no error.
+	ErrorClass string
+	// Retries is the number of errors in a row with the current error, as
+	// counted by the last error annotation. It is 0 when there is no error
+	// or the attacher does not save the annotation.
+	Retries int
+}
+
+// ListAttachments returns VolumeAttachments of the driver sorted by name. An
+// empty driver lists VolumeAttachments of all drivers.
+func ListAttachments(client kubernetes.Interface, driver string, now time.Time) ([]Attachment, error) {
+	vas, err := client.StorageV1beta1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list VolumeAttachments: %v", err)
+	}
+	var attachments []Attachment
+	for i := range vas.Items {
+		va := &vas.Items[i]
+		if driver != "" && va.Spec.Attacher != driver {
+			continue
+		}
+		attachment := Attachment{
+			Name:  va.Name,
+			Node:  va.Spec.NodeName,
+			Age:   now.Sub(va.CreationTimestamp.Time),
+			State: controller.VolumeAttachmentState(va),
+		}
+		if va.Spec.Source.PersistentVolumeName != nil {
+			attachment.PV = *va.Spec.Source.PersistentVolumeName
+		}
+		if vaErr := currentError(va); vaErr != nil {
+			attachment.ErrorClass = controller.ErrorClass(vaErr.Message)
+			if lastError, found := lastError(va); found {
+				attachment.Retries = lastError.Count
+			}
+		}
+		attachments = append(attachments, attachment)
+	}
+	sort.Slice(attachments, func(i, j int) bool { return attachments[i].Name < attachments[j].Name })
+	return attachments, nil
+}
+
+// currentError returns the error in the status of va that belongs to its
+// current state.
+func currentError(va *storage.VolumeAttachment) *storage.VolumeError {
+	if va.DeletionTimestamp != nil {
+		return va.Status.DetachError
+	}
+	if va.Status.Attached {
+		return nil
+	}
+	return va.Status.AttachError
+}
+
+func lastError(va *storage.VolumeAttachment) (controller.LastError, bool) {
+	var lastError controller.LastError
+	value, found := va.Annotations[controller.LastErrorAnnotation]
+	if !found {
+		return lastError, false
+	}
+	if err := json.Unmarshal([]byte(value), &lastError); err != nil {
+		return lastError, false
+	}
+	return lastError, true
+}
+
+// PrintAttachments writes attachments as a table.
+func PrintAttachments(out io.Writer, attachments []Attachment) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPV\tNODE\tAGE\tSTATE\tERROR\tRETRIES")
+	for _, a := range attachments {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\n", a.Name, orNone(a.PV), a.Node, a.Age.Round(time.Second), a.State, orNone(a.ErrorClass), a.Retries)
+	}
+	return w.Flush()
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
+
+// Entry is one point in the timeline of a VolumeAttachment.
+type Entry struct {
+	Time    time.Time
+	Message string
+}
+
+// Timeline reconstructs the history of a VolumeAttachment from its
+// timestamps, its status, annotations saved by the attacher and its events,
+// the oldest entry first. Events may be missing when they expired.
+func Timeline(client kubernetes.Interface, name string) ([]Entry, error) {
+	va, err := client.StorageV1beta1().VolumeAttachments().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get VolumeAttachment %q: %v", name, err)
+	}
+	selector := fields.Set{
+		"involvedObject.kind": "VolumeAttachment",
+		"involvedObject.name": name,
+	}.AsSelector().String()
+	events, err := client.CoreV1().Events(metav1.NamespaceAll).List(metav1.ListOptions{FieldSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list events of VolumeAttachment %q: %v", name, err)
+	}
+
+	entries := []Entry{{va.CreationTimestamp.Time, fmt.Sprintf("Created for %s on node %s", source(va), va.Spec.NodeName)}}
+	progress := []struct {
+		annotation string
+		message    string
+	}{
+		{controller.QueuedAtAnnotation, "Queued by the attacher"},
+		{controller.PublishStartedAtAnnotation, "Attach started"},
+		{controller.PublishFinishedAtAnnotation, "ControllerPublish finished"},
+		{controller.StatusUpdatedAtAnnotation, "Attached status saved"},
+	}
+	for _, p := range progress {
+		if value, found := va.Annotations[p.annotation]; found {
+			if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+				entries = append(entries, Entry{t, p.message})
+			}
+		}
+	}
+	if lastError, found := lastError(va); found {
+		entries = append(entries, Entry{lastError.FirstSeen.Time, fmt.Sprintf("First of %d %s errors in a row with code %s", lastError.Count, lastError.Operation, lastError.Code)})
+		if lastError.Count > 1 {
+			entries = append(entries, Entry{lastError.LastSeen.Time, fmt.Sprintf("Last %s error with code %s", lastError.Operation, lastError.Code)})
+		}
+	}
+	if vaErr := va.Status.AttachError; vaErr != nil {
+		entries = append(entries, Entry{vaErr.Time.Time, "Attach error saved: " + vaErr.Message})
+	}
+	if vaErr := va.Status.DetachError; vaErr != nil {
+		entries = append(entries, Entry{vaErr.Time.Time, "Detach error saved: " + vaErr.Message})
+	}
+	for _, event := range events.Items {
+		if event.InvolvedObject.Kind != "VolumeAttachment" || event.InvolvedObject.Name != name {
+			continue
+		}
+		entries = append(entries, eventEntry(&event))
+	}
+	if va.DeletionTimestamp != nil {
+		entries = append(entries, Entry{va.DeletionTimestamp.Time, "Deletion requested"})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return entries, nil
+}
+
+func source(va *storage.VolumeAttachment) string {
+	if va.Spec.Source.PersistentVolumeName != nil {
+		return "PV " + *va.Spec.Source.PersistentVolumeName
+	}
+	return "inline volume"
+}
+
+func eventEntry(event *v1.Event) Entry {
+	message := fmt.Sprintf("%s %s: %s", event.Type, event.Reason, event.Message)
+	if event.Count > 1 {
+		message += fmt.Sprintf(" (x%d since %s)", event.Count, event.FirstTimestamp.UTC().Format(time.RFC3339))
+	}
+	t := event.LastTimestamp.Time
+	if t.IsZero() {
+		t = event.EventTime.Time
+	}
+	return Entry{t, message}
+}
+
+// PrintTimeline writes entries, one per line.
+func PrintTimeline(out io.Writer, entries []Entry) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tEVENT")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\n", e.Time.UTC().Format(time.RFC3339Nano), e.Message)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inspect
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/controller"
+)
+
+var created = time.Date(2019, 10, 14, 12, 0, 0, 0, time.UTC)
+
+func testVA(name, driver string, modify func(va *storage.VolumeAttachment)) *storage.VolumeAttachment {
+	pv := name + "-pv"
+	va := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			CreationTimestamp: metav1.NewTime(created),
+		},
+		Spec: storage.VolumeAttachmentSpec{
+			Attacher: driver,
+			NodeName: "node1",
+			Source:   storage.VolumeAttachmentSource{PersistentVolumeName: &pv},
+		},
+	}
+	if modify != nil {
+		modify(va)
+	}
+	return va
+}
+
+func TestListAttachments(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		testVA("va2", "csi.example.com", func(va *storage.VolumeAttachment) {
+			va.Status.AttachError = &storage.VolumeError{Message: "rpc error: code = DeadlineExceeded desc = timeout"}
+			va.Annotations = map[string]string{controller.LastErrorAnnotation: `{"operation":"attach","code":"DeadlineExceeded","count":3}`}
+		}),
+		testVA("va1", "csi.example.com", func(va *storage.VolumeAttachment) {
+			va.Status.Attached = true
+			// A stale error is not reported.
+			va.Status.DetachError = &storage.VolumeError{Message: "rpc error: code = Internal desc = failed"}
+		}),
+		testVA("va3", "other.example.com", nil),
+	)
+
+	attachments, err := ListAttachments(client, "csi.example.com", created.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []Attachment{
+		{Name: "va1", PV: "va1-pv", Node: "node1", Age: time.Hour, State: "attached"},
+		{Name: "va2", PV: "va2-pv", Node: "node1", Age: time.Hour, State: "attach_error", ErrorClass: "DeadlineExceeded", Retries: 3},
+	}
+	if !reflect.DeepEqual(attachments, expected) {
+		t.Errorf("expected %+v, got %+v", expected, attachments)
+	}
+
+	var out bytes.Buffer
+	if err := PrintAttachments(&out, attachments); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedOut := `NAME  PV      NODE   AGE     STATE         ERROR             RETRIES
+va1   va1-pv  node1  1h0m0s  attached      <none>            0
+va2   va2-pv  node1  1h0m0s  attach_error  DeadlineExceeded  3
+`
+	if out.String() != expectedOut {
+		t.Errorf("expected output\n%s\ngot\n%s", expectedOut, out.String())
+	}
+
+	all, err := ListAttachments(client, "", created.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(all) != 3 {
+		t.Errorf("expected 3 attachments of all drivers, got %d", len(all))
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	at := func(d time.Duration) metav1.Time { return metav1.NewTime(created.Add(d)) }
+	va := testVA("va1", "csi.example.com", func(va *storage.VolumeAttachment) {
+		va.Annotations = map[string]string{
+			controller.QueuedAtAnnotation:          "2019-10-14T12:00:01Z",
+			controller.PublishStartedAtAnnotation:  "2019-10-14T12:00:30Z",
+			controller.PublishFinishedAtAnnotation: "2019-10-14T12:00:40.5Z",
+			controller.StatusUpdatedAtAnnotation:   "2019-10-14T12:00:41Z",
+			controller.LastErrorAnnotation:         `{"operation":"attach","code":"DeadlineExceeded","firstSeen":"2019-10-14T12:00:02Z","lastSeen":"2019-10-14T12:00:15Z","count":2}`,
+		}
+		va.Status.Attached = true
+	})
+	client := fake.NewSimpleClientset(va,
+		&v1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Namespace: "default", Name: "e1"},
+			InvolvedObject: v1.ObjectReference{Kind: "VolumeAttachment", Name: "va1"},
+			Type:           v1.EventTypeWarning,
+			Reason:         controller.AttachFailed,
+			Message:        "Failed to attach volume",
+			Count:          2,
+			FirstTimestamp: at(2 * time.Second),
+			LastTimestamp:  at(15 * time.Second),
+		},
+		&v1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Namespace: "default", Name: "e2"},
+			InvolvedObject: v1.ObjectReference{Kind: "VolumeAttachment", Name: "other"},
+			Reason:         controller.AttachFailed,
+			LastTimestamp:  at(time.Second),
+		},
+	)
+
+	entries, err := Timeline(client, "va1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var messages []string
+	for _, e := range entries {
+		messages = append(messages, e.Time.Sub(created).String()+" "+e.Message)
+	}
+	expected := []string{
+		"0s Created for PV va1-pv on node node1",
+		"1s Queued by the attacher",
+		"2s First of 2 attach errors in a row with code DeadlineExceeded",
+		"15s Last attach error with code DeadlineExceeded",
+		"15s Warning AttachFailed: Failed to attach volume (x2 since 2019-10-14T12:00:02Z)",
+		"30s Attach started",
+		"40.5s ControllerPublish finished",
+		"41s Attached status saved",
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("expected timeline\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(messages, "\n"))
+	}
+
+	if _, err := Timeline(client, "missing"); err == nil {
+		t.Errorf("expected error for a missing VolumeAttachment")
+	}
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package leaderelection is a wrapper around client-go leader election,
+// based on github.com/kubernetes-csi/csi-lib-utils/leaderelection. In
+// addition, it releases the lock when the leader shuts down gracefully.
+package leaderelection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+)
+
+const (
+	// configMapsLeasesResourceLock holds both ConfigMap and Lease locks.
+	configMapsLeasesResourceLock = "configmapsleases"
+
+	defaultLeaseDuration = 15 * time.Second
+	defaultRenewDeadline = 10 * time.Second
+	defaultRetryPeriod   = 5 * time.Second
+)
+
+// ErrLeadershipLost is returned by Run when the leadership was lost before
+// the context was cancelled.
+var ErrLeadershipLost = errors.New("leadership lost")
+
+// leaderElection is a convenience wrapper around client-go's leader election library.
+type leaderElection struct {
+	runFunc func(ctx context.Context)
+
+	// the lockName identifies the leader election config and should be shared across all members
+	lockName string
+	// the identity is the unique identity of the currently running member
+	identity string
+	// the namespace to store the lock resource
+	namespace string
+	// resourceLock defines the type of leaderelection that should be used
+	// valid options are resourcelock.LeasesResourceLock, resourcelock.ConfigMapsResourceLock
+	// and configMapsLeasesResourceLock
+	resourceLock string
+
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+
+	clientset kubernetes.Interface
+}
+
+// NewLeaderElection returns the default & preferred leader election type
+func NewLeaderElection(clientset kubernetes.Interface, lockName string, runFunc func(ctx context.Context)) *leaderElection {
+	return NewLeaderElectionWithLeases(clientset, lockName, runFunc)
+}
+
+// NewLeaderElectionWithLeases returns an implementation of leader election using Leases
+func NewLeaderElectionWithLeases(clientset kubernetes.Interface, lockName string, runFunc func(ctx context.Context)) *leaderElection {
+	return newLeaderElection(clientset, resourcelock.LeasesResourceLock, lockName, runFunc)
+}
+
+// NewLeaderElectionWithConfigMaps returns an implementation of leader election using ConfigMaps
+func NewLeaderElectionWithConfigMaps(clientset kubernetes.Interface, lockName string, runFunc func(ctx context.Context)) *leaderElection {
+	return newLeaderElection(clientset, resourcelock.ConfigMapsResourceLock, lockName, runFunc)
+}
+
+// NewLeaderElectionWithConfigMapsAndLeases returns an implementation of leader
+// election that holds both ConfigMap and Lease locks. It allows rolling update
+// from members that use ConfigMaps to members that use Leases without two
+// leaders running at the same time.
+func NewLeaderElectionWithConfigMapsAndLeases(clientset kubernetes.Interface, lockName string, runFunc func(ctx context.Context)) *leaderElection {
+	return newLeaderElection(clientset, configMapsLeasesResourceLock, lockName, runFunc)
+}
+
+func newLeaderElection(clientset kubernetes.Interface, resourceLock, lockName string, runFunc func(ctx context.Context)) *leaderElection {
+	return &leaderElection{
+		runFunc:       runFunc,
+		lockName:      lockName,
+		resourceLock:  resourceLock,
+		leaseDuration: defaultLeaseDuration,
+		renewDeadline: defaultRenewDeadline,
+		retryPeriod:   defaultRetryPeriod,
+		clientset:     clientset,
+	}
+}
+
+func (l *leaderElection) WithIdentity(identity string) {
+	l.identity = identity
+}
+
+func (l *leaderElection) WithNamespace(namespace string) {
+	l.namespace = namespace
+}
+
+func (l *leaderElection) WithLeaseDuration(leaseDuration time.Duration) {
+	l.leaseDuration = leaseDuration
+}
+
+func (l *leaderElection) WithRenewDeadline(renewDeadline time.Duration) {
+	l.renewDeadline = renewDeadline
+}
+
+func (l *leaderElection) WithRetryPeriod(retryPeriod time.Duration) {
+	l.retryPeriod = retryPeriod
+}
+
+// Run runs leader election until ctx is cancelled. runFunc is called when
+// this member becomes the leader and its context is cancelled either when the
+// leadership is lost or when ctx is cancelled. In the latter case the lock is
+// released only after runFunc returns, so a standby member can take over
+// immediately (and not after the lease expires), while the leader has time to
+// finish its current work.
+//
+// Losing the leadership in any other way is reported as ErrLeadershipLost.
+func (l *leaderElection) Run(ctx context.Context) error {
+	if l.identity == "" {
+		id, err := defaultLeaderElectionIdentity()
+		if err != nil {
+			return fmt.Errorf("error getting the default leader identity: %v", err)
+		}
+
+		l.identity = id
+	}
+
+	if l.namespace == "" {
+		l.namespace = InClusterNamespace()
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&corev1.EventSinkImpl{Interface: l.clientset.CoreV1().Events(l.namespace)})
+	eventRecorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: fmt.Sprintf("%s/%s", l.lockName, string(l.identity))})
+
+	rlConfig := resourcelock.ResourceLockConfig{
+		Identity:      sanitizeName(l.identity),
+		EventRecorder: eventRecorder,
+	}
+
+	lock, err := l.newResourceLock(rlConfig)
+	if err != nil {
+		return err
+	}
+	lock = &instrumentedLock{Interface: lock, lockName: l.lockName}
+	transitions := &transitionCounter{lockName: l.lockName}
+
+	// electorCtx outlives ctx until runFunc finishes, so the lease can be
+	// renewed while the leader is shutting down.
+	electorCtx, cancelElector := context.WithCancel(context.Background())
+	defer cancelElector()
+	var leading, lost int32
+
+	leaderConfig := leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   l.leaseDuration,
+		RenewDeadline:   l.renewDeadline,
+		RetryPeriod:     l.retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            l.lockName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) {
+				atomic.StoreInt32(&leading, 1)
+				setLeading(true)
+				klog.V(2).Info("became leader, starting")
+				runCtx, cancel := context.WithCancel(leaderCtx)
+				go func() {
+					select {
+					case <-ctx.Done():
+						cancel()
+					case <-runCtx.Done():
+					}
+				}()
+				l.runFunc(runCtx)
+				cancel()
+				// Release the lock.
+				cancelElector()
+			},
+			OnStoppedLeading: func() {
+				setLeading(false)
+				if ctx.Err() != nil {
+					klog.V(2).Info("stopped leading on shutdown")
+					return
+				}
+				klog.Error("stopped leading")
+				atomic.StoreInt32(&lost, 1)
+			},
+			OnNewLeader: func(identity string) {
+				transitions.observe(identity)
+				klog.V(3).Infof("new leader detected, current leader: %s", identity)
+			},
+		},
+	}
+
+	le, err := leaderelection.NewLeaderElector(leaderConfig)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			if atomic.LoadInt32(&leading) == 0 {
+				// Stop waiting for the lock. When it is being acquired just
+				// now, runFunc gets a cancelled context and releases it.
+				cancelElector()
+			}
+		case <-electorCtx.Done():
+		}
+	}()
+
+	le.Run(electorCtx)
+	if atomic.LoadInt32(&lost) != 0 {
+		return ErrLeadershipLost
+	}
+	return nil
+}
+
+func (l *leaderElection) newResourceLock(rlConfig resourcelock.ResourceLockConfig) (resourcelock.Interface, error) {
+	name := sanitizeName(l.lockName)
+	if l.resourceLock != configMapsLeasesResourceLock {
+		return resourcelock.New(l.resourceLock, l.namespace, name, l.clientset.CoreV1(), l.clientset.CoordinationV1(), rlConfig)
+	}
+
+	primary, err := resourcelock.New(resourcelock.ConfigMapsResourceLock, l.namespace, name, l.clientset.CoreV1(), l.clientset.CoordinationV1(), rlConfig)
+	if err != nil {
+		return nil, err
+	}
+	secondary, err := resourcelock.New(resourcelock.LeasesResourceLock, l.namespace, name, l.clientset.CoreV1(), l.clientset.CoordinationV1(), rlConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &multiLock{primary: primary, secondary: secondary}, nil
+}
+
+func defaultLeaderElectionIdentity() (string, error) {
+	return os.Hostname()
+}
+
+// sanitizeName sanitizes the provided string so it can be consumed by leader election library
+func sanitizeName(name string) string {
+	re := regexp.MustCompile("[^a-zA-Z0-9-]")
+	name = re.ReplaceAllString(name, "-")
+	if name[len(name)-1] == '-' {
+		// name must not end with '-'
+		name = name + "X"
+	}
+	return name
+}
+
+// InClusterNamespace returns the namespace in which the pod is running in by checking
+// the env var POD_NAMESPACE, then the file /var/run/secrets/kubernetes.io/serviceaccount/namespace.
+// if neither returns a valid namespace, the "default" namespace is returned
+func InClusterNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+
+	if data, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
+		if ns := strings.TrimSpace(string(data)); len(ns) > 0 {
+			return ns
+		}
+	}
+
+	return "default"
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package leaderelection
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testNamespace = "default"
+
+func newTestLeaderElection(client kubernetes.Interface, runFunc func(ctx context.Context)) *leaderElection {
+	le := NewLeaderElection(client, "test-lock", runFunc)
+	le.WithIdentity("test-identity")
+	le.WithNamespace(testNamespace)
+	le.WithLeaseDuration(2 * time.Second)
+	le.WithRenewDeadline(time.Second)
+	le.WithRetryPeriod(100 * time.Millisecond)
+	return le
+}
+
+func getHolder(t *testing.T, client kubernetes.Interface) string {
+	lease, err := client.CoordinationV1().Leases(testNamespace).Get("test-lock", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get lease: %s", err)
+	}
+	if lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+func TestReleaseOnShutdown(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	holderWhileDraining := make(chan string, 1)
+
+	le := newTestLeaderElection(client, func(runCtx context.Context) {
+		close(started)
+		<-runCtx.Done()
+		holderWhileDraining <- getHolder(t, client)
+	})
+
+	finished := make(chan error)
+	go func() {
+		finished <- le.Run(ctx)
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for leadership")
+	}
+	cancel()
+
+	select {
+	case err := <-finished:
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for Run to finish")
+	}
+
+	if holder := <-holderWhileDraining; holder != "test-identity" {
+		t.Errorf("expected the lock to be held while draining, got holder %q", holder)
+	}
+	if holder := getHolder(t, client); holder != "" {
+		t.Errorf("expected the lock to be released, got holder %q", holder)
+	}
+}
+
+func TestShutdownWhileWaiting(t *testing.T) {
+	holder := "other-identity"
+	duration := int32(3600)
+	now := metav1.NewMicroTime(time.Now())
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-lock", Namespace: testNamespace},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &duration,
+			AcquireTime:          &now,
+			RenewTime:            &now,
+		},
+	}
+	client := fake.NewSimpleClientset(lease)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	le := newTestLeaderElection(client, func(runCtx context.Context) {
+		t.Errorf("unexpected leadership")
+	})
+
+	finished := make(chan error)
+	go func() {
+		finished <- le.Run(ctx)
+	}()
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-finished:
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for Run to finish")
+	}
+	if h := getHolder(t, client); h != holder {
+		t.Errorf("expected the lock to be still held by %q, got %q", holder, h)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package leaderelection
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/metrics"
+)
+
+var (
+	leaderTransitionsTotal = metrics.NewCounterVec(
+		metrics.Namespace+"_leader_election_transitions_total",
+		"Number of observed changes of the leader. Frequent changes typically indicate API server or clock issues.",
+		"lock")
+	renewErrorsTotal = metrics.NewCounterVec(
+		metrics.Namespace+"_leader_election_renew_errors_total",
+		"Number of failed attempts of the leader to renew its lease.",
+		"lock")
+	leadingDuration = metrics.NewGaugeFunc(
+		metrics.Namespace+"_leader_election_leading_seconds",
+		"Time since this replica acquired the leadership, 0 when it is not the leader.",
+		leadingSeconds)
+	isLeader = metrics.NewGaugeFunc(
+		metrics.Namespace+"_leader_election_is_leader",
+		"1 when this replica is the leader, 0 otherwise.",
+		func() float64 {
+			if isLeading() {
+				return 1
+			}
+			return 0
+		})
+
+	// leadingSince is the time when this process became the leader, in
+	// nanoseconds since epoch. 0 means it is not the leader.
+	leadingSince int64
+)
+
+func init() {
+	metrics.MustRegister(leaderTransitionsTotal, renewErrorsTotal, leadingDuration, isLeader)
+}
+
+func leadingSeconds() float64 {
+	since := atomic.LoadInt64(&leadingSince)
+	if since == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, since)).Seconds()
+}
+
+func setLeading(leading bool) {
+	var since int64
+	if leading {
+		since = time.Now().UnixNano()
+	}
+	atomic.StoreInt64(&leadingSince, since)
+}
+
+func isLeading() bool {
+	return atomic.LoadInt64(&leadingSince) != 0
+}
+
+// transitionCounter counts changes of the observed leader.
+type transitionCounter struct {
+	lockName string
+
+	lock       sync.Mutex
+	lastLeader string
+}
+
+func (c *transitionCounter) observe(identity string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// The first observed leader is not a transition.
+	if c.lastLeader != "" && c.lastLeader != identity {
+		leaderTransitionsTotal.WithLabelValues(c.lockName).Inc()
+	}
+	c.lastLeader = identity
+}
+
+// instrumentedLock counts errors of a leader that tries to renew its lease.
+type instrumentedLock struct {
+	resourcelock.Interface
+	lockName string
+}
+
+var _ resourcelock.Interface = &instrumentedLock{}
+
+func (l *instrumentedLock) Get() (*resourcelock.LeaderElectionRecord, error) {
+	record, err := l.Interface.Get()
+	l.observe(err)
+	return record, err
+}
+
+func (l *instrumentedLock) Update(ler resourcelock.LeaderElectionRecord) error {
+	err := l.Interface.Update(ler)
+	l.observe(err)
+	return err
+}
+
+func (l *instrumentedLock) observe(err error) {
+	if err != nil && isLeading() {
+		renewErrorsTotal.WithLabelValues(l.lockName).Inc()
+	}
+}
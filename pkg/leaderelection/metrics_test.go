@@ -0,0 +1,80 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package leaderelection
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+func TestTransitionCounter(t *testing.T) {
+	c := &transitionCounter{lockName: "test-transitions"}
+	for _, identity := range []string{"a", "a", "b", "a", "a"} {
+		c.observe(identity)
+	}
+	if got := leaderTransitionsTotal.WithLabelValues("test-transitions").Value(); got != 2 {
+		t.Errorf("expected 2 transitions, got %v", got)
+	}
+}
+
+type fakeLock struct {
+	resourcelock.Interface
+	err error
+}
+
+func (l *fakeLock) Get() (*resourcelock.LeaderElectionRecord, error) {
+	return &resourcelock.LeaderElectionRecord{}, l.err
+}
+
+func (l *fakeLock) Update(ler resourcelock.LeaderElectionRecord) error {
+	return l.err
+}
+
+func TestRenewErrors(t *testing.T) {
+	defer setLeading(false)
+	fake := &fakeLock{err: errors.New("mock error")}
+	lock := &instrumentedLock{Interface: fake, lockName: "test-renew"}
+
+	// Errors of a non-leader are not renew errors.
+	lock.Get()
+	lock.Update(resourcelock.LeaderElectionRecord{})
+
+	setLeading(true)
+	lock.Get()
+	lock.Update(resourcelock.LeaderElectionRecord{})
+	fake.err = nil
+	lock.Update(resourcelock.LeaderElectionRecord{})
+
+	if got := renewErrorsTotal.WithLabelValues("test-renew").Value(); got != 2 {
+		t.Errorf("expected 2 renew errors, got %v", got)
+	}
+}
+
+func TestLeadingDuration(t *testing.T) {
+	defer setLeading(false)
+	if got := leadingSeconds(); got != 0 {
+		t.Errorf("expected 0 when not leading, got %v", got)
+	}
+	setLeading(true)
+	time.Sleep(10 * time.Millisecond)
+	if got := leadingSeconds(); got <= 0 {
+		t.Errorf("expected positive duration when leading, got %v", got)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package leaderelection
+
+import (
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// unknownLeader is reported as the holder when the primary and the secondary
+// locks are held by different members. Nobody is the leader then and the
+// locks must expire before anyone can acquire them.
+const unknownLeader = "leaderelection.k8s.io/unknown"
+
+// multiLock holds two locks at the same time. It is used to migrate from one
+// lock type to another: old members that use only the primary lock and new
+// members that use both are never leaders at the same time.
+type multiLock struct {
+	primary   resourcelock.Interface
+	secondary resourcelock.Interface
+}
+
+var _ resourcelock.Interface = &multiLock{}
+
+func (ml *multiLock) Get() (*resourcelock.LeaderElectionRecord, error) {
+	primary, err := ml.primary.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	secondary, err := ml.secondary.Get()
+	if err != nil {
+		// The lock is held by an old member that does not know the secondary lock.
+		if apierrs.IsNotFound(err) && primary.HolderIdentity != ml.Identity() {
+			return primary, nil
+		}
+		return nil, err
+	}
+
+	if primary.HolderIdentity != secondary.HolderIdentity {
+		primary.HolderIdentity = unknownLeader
+	}
+	return primary, nil
+}
+
+func (ml *multiLock) Create(ler resourcelock.LeaderElectionRecord) error {
+	if err := ml.primary.Create(ler); err != nil {
+		return err
+	}
+	return ml.secondary.Create(ler)
+}
+
+func (ml *multiLock) Update(ler resourcelock.LeaderElectionRecord) error {
+	if err := ml.primary.Update(ler); err != nil {
+		return err
+	}
+	if _, err := ml.secondary.Get(); err != nil {
+		if apierrs.IsNotFound(err) {
+			return ml.secondary.Create(ler)
+		}
+		return err
+	}
+	return ml.secondary.Update(ler)
+}
+
+func (ml *multiLock) RecordEvent(s string) {
+	ml.primary.RecordEvent(s)
+	ml.secondary.RecordEvent(s)
+}
+
+func (ml *multiLock) Identity() string {
+	return ml.primary.Identity()
+}
+
+func (ml *multiLock) Describe() string {
+	return ml.primary.Describe() + " and " + ml.secondary.Describe()
+}
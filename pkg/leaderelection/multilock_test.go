@@ -0,0 +1,118 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package leaderelection
+
+import (
+	"testing"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+func newTestMultiLock(t *testing.T, client kubernetes.Interface, identity string) *multiLock {
+	le := NewLeaderElectionWithConfigMapsAndLeases(client, "test-lock", nil)
+	le.namespace = testNamespace
+	lock, err := le.newResourceLock(resourcelock.ResourceLockConfig{Identity: identity})
+	if err != nil {
+		t.Fatalf("failed to create lock: %s", err)
+	}
+	return lock.(*multiLock)
+}
+
+func newTestLock(t *testing.T, client kubernetes.Interface, lockType, identity string) resourcelock.Interface {
+	lock, err := resourcelock.New(lockType, testNamespace, "test-lock", client.CoreV1(), client.CoordinationV1(), resourcelock.ResourceLockConfig{Identity: identity})
+	if err != nil {
+		t.Fatalf("failed to create lock: %s", err)
+	}
+	return lock
+}
+
+func TestMultiLockCreate(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	ml := newTestMultiLock(t, client, "new")
+
+	if _, err := ml.Get(); err == nil {
+		t.Fatalf("expected error when no lock exists")
+	}
+	if err := ml.Create(resourcelock.LeaderElectionRecord{HolderIdentity: "new"}); err != nil {
+		t.Fatalf("failed to create lock: %s", err)
+	}
+	record, err := ml.Get()
+	if err != nil {
+		t.Fatalf("failed to get lock: %s", err)
+	}
+	if record.HolderIdentity != "new" {
+		t.Errorf("expected holder %q, got %q", "new", record.HolderIdentity)
+	}
+
+	// Old members see the ConfigMap lock as held.
+	old, err := newTestLock(t, client, resourcelock.ConfigMapsResourceLock, "old").Get()
+	if err != nil {
+		t.Fatalf("failed to get ConfigMap lock: %s", err)
+	}
+	if old.HolderIdentity != "new" {
+		t.Errorf("expected ConfigMap lock holder %q, got %q", "new", old.HolderIdentity)
+	}
+}
+
+func TestMultiLockHeldByOldMember(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	oldLock := newTestLock(t, client, resourcelock.ConfigMapsResourceLock, "old")
+	if err := oldLock.Create(resourcelock.LeaderElectionRecord{HolderIdentity: "old"}); err != nil {
+		t.Fatalf("failed to create ConfigMap lock: %s", err)
+	}
+
+	ml := newTestMultiLock(t, client, "new")
+	record, err := ml.Get()
+	if err != nil {
+		t.Fatalf("failed to get lock: %s", err)
+	}
+	if record.HolderIdentity != "old" {
+		t.Errorf("expected holder %q, got %q", "old", record.HolderIdentity)
+	}
+
+	// Take over after the old lock expired: the Lease is created on update.
+	if err := ml.Update(resourcelock.LeaderElectionRecord{HolderIdentity: "new"}); err != nil {
+		t.Fatalf("failed to update lock: %s", err)
+	}
+	lease, err := newTestLock(t, client, resourcelock.LeasesResourceLock, "other").Get()
+	if err != nil {
+		t.Fatalf("failed to get Lease lock: %s", err)
+	}
+	if lease.HolderIdentity != "new" {
+		t.Errorf("expected Lease holder %q, got %q", "new", lease.HolderIdentity)
+	}
+}
+
+func TestMultiLockMismatch(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	if err := newTestLock(t, client, resourcelock.ConfigMapsResourceLock, "a").Create(resourcelock.LeaderElectionRecord{HolderIdentity: "a"}); err != nil {
+		t.Fatalf("failed to create ConfigMap lock: %s", err)
+	}
+	if err := newTestLock(t, client, resourcelock.LeasesResourceLock, "b").Create(resourcelock.LeaderElectionRecord{HolderIdentity: "b"}); err != nil {
+		t.Fatalf("failed to create Lease lock: %s", err)
+	}
+
+	record, err := newTestMultiLock(t, client, "c").Get()
+	if err != nil {
+		t.Fatalf("failed to get lock: %s", err)
+	}
+	if record.HolderIdentity != unknownLeader {
+		t.Errorf("expected unknown holder, got %q", record.HolderIdentity)
+	}
+}
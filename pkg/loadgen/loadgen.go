@@ -0,0 +1,357 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package loadgen creates and deletes synthetic PersistentVolumes and
+// VolumeAttachments and measures how fast an attacher processes them.
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// RunLabel is the label of objects created by a load generator run, its
+// value is the run ID.
+const RunLabel = "loadgen.csi.k8s.io/run"
+
+// Config configures a load generator run.
+type Config struct {
+	// Driver is the name of the CSI driver of the PVs and VAs.
+	Driver string
+	// Nodes are the nodes to attach to, round robin.
+	Nodes []string
+	// Count is the number of VolumeAttachments to create.
+	Count int
+	// Rate is the number of VolumeAttachments created per second.
+	Rate float64
+	// Detach deletes each VolumeAttachment when it is attached and waits
+	// until it's detached.
+	Detach bool
+	// Timeout is how long to wait for the VolumeAttachments after the last
+	// one was created.
+	Timeout time.Duration
+	// RunID names the objects of the run. An ID from the current time is
+	// used when empty.
+	RunID string
+}
+
+// Validate returns an error when the configuration can't be used.
+func (c Config) Validate() error {
+	if c.Driver == "" {
+		return fmt.Errorf("driver name is required")
+	}
+	if len(c.Nodes) == 0 {
+		return fmt.Errorf("at least one node is required")
+	}
+	if c.Count <= 0 {
+		return fmt.Errorf("count must be greater than zero")
+	}
+	if c.Rate <= 0 {
+		return fmt.Errorf("rate must be greater than zero")
+	}
+	return nil
+}
+
+// Result are measurements of a run.
+type Result struct {
+	Created  int
+	Attached int
+	Detached int
+	// Duration is the time from the first creation until the last
+	// VolumeAttachment was processed or the timeout.
+	Duration time.Duration
+	// AttachLatencies are times from creation of each VolumeAttachment
+	// until it was attached, sorted.
+	AttachLatencies []time.Duration
+	// DetachLatencies are times from deletion of each VolumeAttachment
+	// until it was removed, sorted.
+	DetachLatencies []time.Duration
+}
+
+// tracker records when VolumeAttachments of a run change.
+type tracker struct {
+	client kubernetes.Interface
+	detach bool
+
+	lock     sync.Mutex
+	created  map[string]time.Time
+	deleted  map[string]time.Time
+	attached map[string]bool
+	result   Result
+	// done is signalled when a VolumeAttachment finished.
+	done chan struct{}
+}
+
+func (t *tracker) finished() int {
+	if t.detach {
+		return t.result.Detached
+	}
+	return t.result.Attached
+}
+
+func (t *tracker) vaUpdated(obj interface{}) {
+	va, ok := obj.(*storage.VolumeAttachment)
+	if !ok || !va.Status.Attached {
+		return
+	}
+	t.lock.Lock()
+	created, found := t.created[va.Name]
+	if !found || t.attached[va.Name] {
+		t.lock.Unlock()
+		return
+	}
+	now := time.Now()
+	t.attached[va.Name] = true
+	t.result.Attached++
+	t.result.AttachLatencies = append(t.result.AttachLatencies, now.Sub(created))
+	if t.detach {
+		t.deleted[va.Name] = now
+	}
+	t.lock.Unlock()
+
+	if t.detach {
+		if err := t.client.StorageV1beta1().VolumeAttachments().Delete(va.Name, &metav1.DeleteOptions{}); err != nil {
+			klog.Errorf("Failed to delete VolumeAttachment %s: %v", va.Name, err)
+		}
+	} else {
+		t.signal()
+	}
+}
+
+func (t *tracker) vaDeleted(obj interface{}) {
+	if unknown, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = unknown.Obj
+	}
+	va, ok := obj.(*storage.VolumeAttachment)
+	if !ok {
+		return
+	}
+	t.lock.Lock()
+	deleted, found := t.deleted[va.Name]
+	if found {
+		delete(t.deleted, va.Name)
+		t.result.Detached++
+		t.result.DetachLatencies = append(t.result.DetachLatencies, time.Since(deleted))
+	}
+	t.lock.Unlock()
+	if found {
+		t.signal()
+	}
+}
+
+func (t *tracker) signal() {
+	select {
+	case t.done <- struct{}{}:
+	default:
+	}
+}
+
+// Run creates PersistentVolumes and VolumeAttachments, waits for the
+// attacher to attach (and detach) them and deletes the objects it created.
+func Run(ctx context.Context, client kubernetes.Interface, config Config) (Result, error) {
+	if err := config.Validate(); err != nil {
+		return Result{}, err
+	}
+	if config.RunID == "" {
+		config.RunID = fmt.Sprintf("%d", time.Now().Unix())
+	}
+	t := &tracker{
+		client:   client,
+		detach:   config.Detach,
+		created:  map[string]time.Time{},
+		deleted:  map[string]time.Time{},
+		attached: map[string]bool{},
+		done:     make(chan struct{}, 1),
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.LabelSelector = RunLabel + "=" + config.RunID
+	}))
+	informer := factory.Storage().V1beta1().VolumeAttachments().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    t.vaUpdated,
+		UpdateFunc: func(old, new interface{}) { t.vaUpdated(new) },
+		DeleteFunc: t.vaDeleted,
+	})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	factory.Start(stopCh)
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return Result{}, ctx.Err()
+	}
+	defer cleanup(client, config.RunID)
+
+	limiter := rate.NewLimiter(rate.Limit(config.Rate), 1)
+	start := time.Now()
+	for i := 0; i < config.Count; i++ {
+		if err := limiter.Wait(ctx); err != nil {
+			break
+		}
+		name := fmt.Sprintf("loadgen-%s-%d", config.RunID, i)
+		if err := create(client, config, name, config.Nodes[i%len(config.Nodes)], t); err != nil {
+			klog.Errorf("Failed to create %s: %v", name, err)
+			continue
+		}
+	}
+
+	timeout := time.After(config.Timeout)
+	for {
+		t.lock.Lock()
+		finished, created := t.finished(), t.result.Created
+		t.lock.Unlock()
+		if finished >= created {
+			break
+		}
+		select {
+		case <-t.done:
+			continue
+		case <-timeout:
+			klog.Warningf("Timed out waiting for %d VolumeAttachments", created-finished)
+		case <-ctx.Done():
+		}
+		break
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	result := t.result
+	result.Duration = time.Since(start)
+	result.AttachLatencies = sortedCopy(result.AttachLatencies)
+	result.DetachLatencies = sortedCopy(result.DetachLatencies)
+	return result, nil
+}
+
+func sortedCopy(latencies []time.Duration) []time.Duration {
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// create creates a PV and a VA with given name.
+func create(client kubernetes.Interface, config Config, name, node string, t *tracker) error {
+	labels := map[string]string{RunLabel: config.RunID}
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity:                      v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+			AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimRetain,
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: config.Driver, VolumeHandle: name},
+			},
+		},
+	}
+	if _, err := client.CoreV1().PersistentVolumes().Create(pv); err != nil {
+		return err
+	}
+	va := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+		Spec: storage.VolumeAttachmentSpec{
+			Attacher: config.Driver,
+			NodeName: node,
+			Source:   storage.VolumeAttachmentSource{PersistentVolumeName: &name},
+		},
+	}
+	t.lock.Lock()
+	t.created[name] = time.Now()
+	t.result.Created++
+	t.lock.Unlock()
+	if _, err := client.StorageV1beta1().VolumeAttachments().Create(va); err != nil {
+		t.lock.Lock()
+		delete(t.created, name)
+		t.result.Created--
+		t.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// cleanup deletes all objects of the run.
+func cleanup(client kubernetes.Interface, runID string) {
+	options := metav1.ListOptions{LabelSelector: RunLabel + "=" + runID}
+	vas, err := client.StorageV1beta1().VolumeAttachments().List(options)
+	if err != nil {
+		klog.Errorf("Failed to list VolumeAttachments of run %s: %v", runID, err)
+	} else {
+		for _, va := range vas.Items {
+			if err := client.StorageV1beta1().VolumeAttachments().Delete(va.Name, &metav1.DeleteOptions{}); err != nil && !apierrs.IsNotFound(err) {
+				klog.Errorf("Failed to delete VolumeAttachment %s: %v", va.Name, err)
+			}
+		}
+	}
+	pvs, err := client.CoreV1().PersistentVolumes().List(options)
+	if err != nil {
+		klog.Errorf("Failed to list PersistentVolumes of run %s: %v", runID, err)
+		return
+	}
+	for _, pv := range pvs.Items {
+		if err := client.CoreV1().PersistentVolumes().Delete(pv.Name, &metav1.DeleteOptions{}); err != nil && !apierrs.IsNotFound(err) {
+			klog.Errorf("Failed to delete PersistentVolume %s: %v", pv.Name, err)
+		}
+	}
+}
+
+// Percentile returns the p-th percentile (0 to 100) of sorted latencies by
+// the nearest-rank method, 0 when there are none.
+func Percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// Print writes a summary of the result.
+func (r Result) Print(out io.Writer) {
+	seconds := r.Duration.Seconds()
+	fmt.Fprintf(out, "Created %d VolumeAttachments in %s\n", r.Created, r.Duration.Round(time.Millisecond))
+	printLatencies(out, "Attached", r.Attached, seconds, r.AttachLatencies)
+	if r.Detached > 0 || len(r.DetachLatencies) > 0 {
+		printLatencies(out, "Detached", r.Detached, seconds, r.DetachLatencies)
+	}
+}
+
+func printLatencies(out io.Writer, what string, count int, seconds float64, latencies []time.Duration) {
+	throughput := 0.0
+	if seconds > 0 {
+		throughput = float64(count) / seconds
+	}
+	fmt.Fprintf(out, "%s %d (%.2f/s), latency p50 %s, p90 %s, p99 %s, max %s\n", what, count, throughput,
+		Percentile(latencies, 50).Round(time.Millisecond),
+		Percentile(latencies, 90).Round(time.Millisecond),
+		Percentile(latencies, 99).Round(time.Millisecond),
+		Percentile(latencies, 100).Round(time.Millisecond))
+}
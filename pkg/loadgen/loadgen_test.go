@@ -0,0 +1,173 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeAttacher marks all created VolumeAttachments as attached.
+func fakeAttacher(t *testing.T, client *fake.Clientset, stopCh <-chan struct{}) {
+	w, err := client.StorageV1beta1().VolumeAttachments().Watch(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer w.Stop()
+		for {
+			select {
+			case event := <-w.ResultChan():
+				if event.Type != watch.Added {
+					continue
+				}
+				va := event.Object.(*storage.VolumeAttachment).DeepCopy()
+				va.Status.Attached = true
+				client.StorageV1beta1().VolumeAttachments().Update(va)
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func TestRun(t *testing.T) {
+	for _, detach := range []bool{false, true} {
+		client := fake.NewSimpleClientset()
+		stopCh := make(chan struct{})
+		fakeAttacher(t, client, stopCh)
+
+		result, err := Run(context.Background(), client, Config{
+			Driver:  "csi/test",
+			Nodes:   []string{"node1", "node2"},
+			Count:   5,
+			Rate:    100,
+			Detach:  detach,
+			Timeout: 10 * time.Second,
+			RunID:   "test",
+		})
+		close(stopCh)
+		if err != nil {
+			t.Fatalf("detach=%v: unexpected error: %v", detach, err)
+		}
+		if result.Created != 5 || result.Attached != 5 || len(result.AttachLatencies) != 5 {
+			t.Errorf("detach=%v: expected 5 created and attached VolumeAttachments, got %+v", detach, result)
+		}
+		expectedDetached := 0
+		if detach {
+			expectedDetached = 5
+		}
+		if result.Detached != expectedDetached || len(result.DetachLatencies) != expectedDetached {
+			t.Errorf("detach=%v: expected %d detached VolumeAttachments, got %+v", detach, expectedDetached, result)
+		}
+
+		// All objects are cleaned up.
+		vas, _ := client.StorageV1beta1().VolumeAttachments().List(metav1.ListOptions{})
+		pvs, _ := client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+		if len(vas.Items) != 0 || len(pvs.Items) != 0 {
+			t.Errorf("detach=%v: expected no objects left, got %d VolumeAttachments and %d PersistentVolumes", detach, len(vas.Items), len(pvs.Items))
+		}
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	result, err := Run(context.Background(), client, Config{
+		Driver:  "csi/test",
+		Nodes:   []string{"node1"},
+		Count:   2,
+		Rate:    100,
+		Timeout: 100 * time.Millisecond,
+		RunID:   "test",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Created != 2 || result.Attached != 0 {
+		t.Errorf("expected 2 created and no attached VolumeAttachments, got %+v", result)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := Config{Driver: "csi/test", Nodes: []string{"node1"}, Count: 1, Rate: 1}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+	}{
+		{"no driver", func(c *Config) { c.Driver = "" }},
+		{"no nodes", func(c *Config) { c.Nodes = nil }},
+		{"zero count", func(c *Config) { c.Count = 0 }},
+		{"zero rate", func(c *Config) { c.Rate = 0 }},
+	}
+	for _, test := range tests {
+		config := valid
+		test.modify(&config)
+		if err := config.Validate(); err == nil {
+			t.Errorf("%s: expected error, got none", test.name)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var latencies []time.Duration
+	for i := 1; i <= 100; i++ {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	tests := []struct {
+		p        float64
+		expected time.Duration
+	}{
+		{0, time.Millisecond},
+		{50, 50 * time.Millisecond},
+		{99, 99 * time.Millisecond},
+		{100, 100 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if got := Percentile(latencies, test.p); got != test.expected {
+			t.Errorf("p%v: expected %s, got %s", test.p, test.expected, got)
+		}
+	}
+	if got := Percentile(nil, 50); got != 0 {
+		t.Errorf("expected 0 without latencies, got %s", got)
+	}
+}
+
+func TestResultPrint(t *testing.T) {
+	result := Result{
+		Created:         2,
+		Attached:        2,
+		Duration:        2 * time.Second,
+		AttachLatencies: []time.Duration{100 * time.Millisecond, 300 * time.Millisecond},
+	}
+	var out bytes.Buffer
+	result.Print(&out)
+	expected := "Created 2 VolumeAttachments in 2s\n" +
+		"Attached 2 (1.00/s), latency p50 100ms, p90 300ms, p99 300ms, max 300ms\n"
+	if out.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out.String())
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package logging adds structured fields to klog messages and writes klog
+// output as JSON.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stable keys of structured fields.
+const (
+	KeyDriver           = "driver"
+	KeyVolumeAttachment = "volumeattachment"
+	KeyPV               = "pv"
+	KeyPVC              = "pvc"
+	KeyNode             = "node"
+	KeyOperation        = "op"
+	KeyDurationMs       = "durationMs"
+	KeyCorrelationID    = "correlationID"
+	KeyPhase            = "phase"
+)
+
+// Log formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// KV formats structured fields as " key=value" pairs that are appended to a
+// klog message. String values are quoted. The JSON writer turns fields with
+// the stable keys into JSON fields.
+func KV(keysAndValues ...interface{}) string {
+	var buf bytes.Buffer
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		buf.WriteByte(' ')
+		fmt.Fprint(&buf, keysAndValues[i])
+		buf.WriteByte('=')
+		switch v := keysAndValues[i+1].(type) {
+		case string:
+			buf.WriteString(strconv.Quote(v))
+		case time.Duration:
+			buf.WriteString(strconv.FormatInt(int64(v/time.Millisecond), 10))
+		default:
+			fmt.Fprint(&buf, v)
+		}
+	}
+	return buf.String()
+}
+
+var (
+	// header matches the klog header, e.g.
+	// "I1014 12:00:00.000000   12345 file.go:42] message".
+	header = regexp.MustCompile(`^([IWEF])\d{4} \d{2}:\d{2}:\d{2}\.\d{6}\s+\d+ ([^\]]+)\] `)
+	// field matches a field with a stable key formatted by KV.
+	field = regexp.MustCompile(` (` + strings.Join([]string{KeyDriver, KeyVolumeAttachment, KeyPV, KeyPVC, KeyNode, KeyOperation, KeyDurationMs, KeyCorrelationID, KeyPhase}, "|") + `)=("(?:[^"\\]|\\.)*"|[^ "]+)`)
+
+	levels = map[string]string{
+		"I": "info",
+		"W": "warning",
+		"E": "error",
+		"F": "fatal",
+	}
+)
+
+// jsonWriter converts lines written by klog to JSON objects.
+type jsonWriter struct {
+	lock sync.Mutex
+	out  io.Writer
+	now  func() time.Time
+}
+
+// NewJSONWriter returns a writer for klog.SetOutputBySeverity that writes
+// each klog line to out as JSON object with keys "ts", "level", "caller",
+// "msg" and the stable keys of fields formatted by KV. klog headers must be
+// enabled.
+func NewJSONWriter(out io.Writer) io.Writer {
+	return &jsonWriter{out: out, now: time.Now}
+}
+
+func (w *jsonWriter) Write(data []byte) (int, error) {
+	entry := map[string]interface{}{
+		"ts":    w.now().UTC().Format(time.RFC3339Nano),
+		"level": "info",
+	}
+	msg := strings.TrimSuffix(string(data), "\n")
+	if match := header.FindStringSubmatch(msg); match != nil {
+		entry["level"] = levels[match[1]]
+		entry["caller"] = match[2]
+		msg = msg[len(match[0]):]
+	}
+	for _, match := range field.FindAllStringSubmatch(msg, -1) {
+		key, value := match[1], match[2]
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			entry[key] = unquoted
+		} else if number, err := strconv.ParseFloat(value, 64); err == nil {
+			entry[key] = number
+		} else {
+			entry[key] = value
+		}
+	}
+	entry["msg"] = field.ReplaceAllString(msg, "")
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, err := w.out.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
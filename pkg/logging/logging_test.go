@@ -0,0 +1,75 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestKV(t *testing.T) {
+	kv := KV(KeyVolumeAttachment, "va-1", KeyNode, "node \"a\"", KeyDurationMs, 1500*time.Millisecond, "count", 3)
+	expected := ` volumeattachment="va-1" node="node \"a\"" durationMs=1500 count=3`
+	if kv != expected {
+		t.Errorf("expected %s, got %s", expected, kv)
+	}
+}
+
+func TestJSONWriter(t *testing.T) {
+	now := time.Date(2019, 10, 14, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		line     string
+		expected string
+	}{
+		{
+			name:     "plain message",
+			line:     "I1014 12:00:00.000000   12345 main.go:42] Version: v2.0.0\n",
+			expected: `{"caller":"main.go:42","level":"info","msg":"Version: v2.0.0","ts":"2019-10-14T12:00:00Z"}` + "\n",
+		},
+		{
+			name:     "fields",
+			line:     "E1014 12:00:00.000000   12345 csi_handler.go:10] Error processing \"va-1\": timeout" + KV(KeyDriver, "csi/test", KeyVolumeAttachment, "va-1", KeyPVC, "ns/claim", KeyOperation, "attach", KeyDurationMs, 15*time.Second) + "\n",
+			expected: `{"caller":"csi_handler.go:10","driver":"csi/test","durationMs":15000,"level":"error","msg":"Error processing \"va-1\": timeout","op":"attach","pvc":"ns/claim","ts":"2019-10-14T12:00:00Z","volumeattachment":"va-1"}` + "\n",
+		},
+		{
+			name:     "unknown key is kept in the message",
+			line:     "W1014 12:00:00.000000   12345 main.go:1] option -foo=bar" + KV(KeyNode, "node1") + "\n",
+			expected: `{"caller":"main.go:1","level":"warning","msg":"option -foo=bar","node":"node1","ts":"2019-10-14T12:00:00Z"}` + "\n",
+		},
+		{
+			name:     "no header",
+			line:     "goroutine 1 [running]:\n",
+			expected: `{"level":"info","msg":"goroutine 1 [running]:","ts":"2019-10-14T12:00:00Z"}` + "\n",
+		},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		w := &jsonWriter{out: &out, now: func() time.Time { return now }}
+		n, err := w.Write([]byte(test.line))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if n != len(test.line) {
+			t.Errorf("%s: expected %d bytes written, got %d", test.name, len(test.line), n)
+		}
+		if out.String() != test.expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.name, test.expected, out.String())
+		}
+	}
+}
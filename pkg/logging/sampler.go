@@ -0,0 +1,106 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// sampleEvery is the sampling rate of messages over the threshold: one of
+// sampleEvery messages is logged.
+const sampleEvery = 100
+
+// Sampler limits logging of messages of the same class, e.g. errors with the
+// same gRPC code, so a mass failure does not flood logs. In each window, the
+// first threshold messages of a class are logged and then only one of each
+// 100. The number of suppressed messages is logged when the window ends.
+// A nil Sampler allows all messages.
+type Sampler struct {
+	threshold int
+	window    time.Duration
+	now       func() time.Time
+
+	lock    sync.Mutex
+	classes map[string]*sampledClass
+}
+
+type sampledClass struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+// NewSampler returns a Sampler that logs up to threshold messages of a class
+// per window without sampling.
+func NewSampler(threshold int, window time.Duration) *Sampler {
+	return &Sampler{
+		threshold: threshold,
+		window:    window,
+		now:       time.Now,
+		classes:   map[string]*sampledClass{},
+	}
+}
+
+// Allow returns true when a message of the class should be logged.
+func (s *Sampler) Allow(class string) bool {
+	if s == nil {
+		return true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.now()
+	c := s.classes[class]
+	if c == nil || now.Sub(c.start) >= s.window {
+		if c != nil {
+			s.report(class, c)
+		}
+		c = &sampledClass{start: now}
+		s.classes[class] = c
+	}
+	c.count++
+	if c.count <= s.threshold || (c.count-s.threshold)%sampleEvery == 0 {
+		return true
+	}
+	c.suppressed++
+	return false
+}
+
+// Flush logs the number of suppressed messages of classes whose window has
+// ended. It should be called periodically, so the note is logged also when
+// no message of the class follows.
+func (s *Sampler) Flush() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.now()
+	for class, c := range s.classes {
+		if now.Sub(c.start) >= s.window {
+			s.report(class, c)
+			delete(s.classes, class)
+		}
+	}
+}
+
+func (s *Sampler) report(class string, c *sampledClass) {
+	if c.suppressed > 0 {
+		klog.Warningf("Suppressed %d similar messages with error class %s in %s", c.suppressed, class, s.window)
+	}
+}
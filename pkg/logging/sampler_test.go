@@ -0,0 +1,67 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSampler(t *testing.T) {
+	now := time.Date(2019, 10, 14, 12, 0, 0, 0, time.UTC)
+	s := NewSampler(3, time.Minute)
+	s.now = func() time.Time { return now }
+
+	allowed := 0
+	for i := 0; i < 3+2*sampleEvery; i++ {
+		if s.Allow("DeadlineExceeded") {
+			allowed++
+		}
+	}
+	// 3 messages under the threshold and 2 sampled.
+	if allowed != 5 {
+		t.Errorf("expected 5 allowed messages, got %d", allowed)
+	}
+	if c := s.classes["DeadlineExceeded"]; c.suppressed != 2*sampleEvery-2 {
+		t.Errorf("expected %d suppressed messages, got %d", 2*sampleEvery-2, c.suppressed)
+	}
+	// Other classes are counted separately.
+	if !s.Allow("Internal") {
+		t.Errorf("expected message of another class to be allowed")
+	}
+
+	// Flush keeps classes whose window has not ended.
+	s.Flush()
+	if len(s.classes) != 2 {
+		t.Errorf("expected 2 classes after Flush, got %d", len(s.classes))
+	}
+	now = now.Add(time.Minute)
+	s.Flush()
+	if len(s.classes) != 0 {
+		t.Errorf("expected no classes after the window, got %d", len(s.classes))
+	}
+	if !s.Allow("DeadlineExceeded") {
+		t.Errorf("expected message in a new window to be allowed")
+	}
+}
+
+func TestNilSampler(t *testing.T) {
+	var s *Sampler
+	if !s.Allow("Internal") {
+		t.Errorf("expected nil Sampler to allow all messages")
+	}
+}
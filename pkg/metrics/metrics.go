@@ -0,0 +1,527 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics implements a small set of Prometheus-compatible metric
+// types (counters, gauges and histograms, optionally with labels) and an
+// HTTP handler that exposes them in the Prometheus text format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Namespace is the common prefix of all metrics exported by the external-attacher.
+	Namespace = "csi_attacher"
+
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// DefBuckets are the default histogram buckets, in seconds. They are tailored
+// to the duration of CSI and API server calls.
+var DefBuckets = []float64{.1, .25, .5, 1, 2.5, 5, 10, 15, 25, 50, 120, 300, 600}
+
+// Collector is a metric that can be exposed by a Registry.
+type Collector interface {
+	// Name returns the fully qualified name of the metric.
+	Name() string
+	// write writes the metric in Prometheus text format.
+	write(w io.Writer)
+}
+
+// Registry is a set of metrics exposed together.
+type Registry struct {
+	lock       sync.RWMutex
+	collectors map[string]Collector
+}
+
+// NewRegistry returns a new, empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{collectors: map[string]Collector{}}
+}
+
+// DefaultRegistry is the registry used by all metrics of the external-attacher.
+var DefaultRegistry = NewRegistry()
+
+// Register adds a collector to the registry. It returns an error when a
+// collector with the same name is already registered.
+func (r *Registry) Register(c Collector) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, found := r.collectors[c.Name()]; found {
+		return fmt.Errorf("metric %q is already registered", c.Name())
+	}
+	r.collectors[c.Name()] = c
+	return nil
+}
+
+// MustRegister adds collectors to the registry and panics on error.
+func (r *Registry) MustRegister(cs ...Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// WriteText writes all registered metrics in Prometheus text format to w.
+func (r *Registry) WriteText(w io.Writer) {
+	r.lock.RLock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	collectors := make([]Collector, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		collectors = append(collectors, r.collectors[name])
+	}
+	r.lock.RUnlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// Handler returns http.Handler that serves the registry content.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		buf := &bytes.Buffer{}
+		r.WriteText(buf)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(buf.Bytes())
+	})
+}
+
+// MustRegister adds collectors to DefaultRegistry and panics on error.
+func MustRegister(cs ...Collector) {
+	DefaultRegistry.MustRegister(cs...)
+}
+
+// Handler returns http.Handler that serves DefaultRegistry.
+func Handler() http.Handler {
+	return DefaultRegistry.Handler()
+}
+
+// metricVec is the common part of all metrics with labels.
+type metricVec struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+
+	lock     sync.RWMutex
+	children map[string]*child
+	newValue func() value
+}
+
+type child struct {
+	labelValues []string
+	value       value
+}
+
+// value is the actual value of one metric with a given set of labels.
+type value interface {
+	// write writes the value in Prometheus text format, using given labels.
+	write(w io.Writer, name string, labels string)
+}
+
+func newMetricVec(name, help, typ string, labelNames []string, newValue func() value) *metricVec {
+	return &metricVec{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		children:   map[string]*child{},
+		newValue:   newValue,
+	}
+}
+
+func (v *metricVec) Name() string {
+	return v.name
+}
+
+func (v *metricVec) get(labelValues []string) value {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %q: expected %d label values, got %d", v.name, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	v.lock.RLock()
+	c, found := v.children[key]
+	v.lock.RUnlock()
+	if found {
+		return c.value
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if c, found = v.children[key]; found {
+		return c.value
+	}
+	c = &child{
+		labelValues: append([]string(nil), labelValues...),
+		value:       v.newValue(),
+	}
+	v.children[key] = c
+	return c.value
+}
+
+func (v *metricVec) delete(labelValues []string) bool {
+	key := strings.Join(labelValues, "\xff")
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	_, found := v.children[key]
+	delete(v.children, key)
+	return found
+}
+
+func (v *metricVec) reset() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.children = map[string]*child{}
+}
+
+func (v *metricVec) write(w io.Writer) {
+	v.lock.RLock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	children := make([]*child, 0, len(keys))
+	for _, key := range keys {
+		children = append(children, v.children[key])
+	}
+	v.lock.RUnlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.typ)
+	for _, c := range children {
+		c.value.write(w, v.name, formatLabels(v.labelNames, c.labelValues))
+	}
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	*metricVec
+}
+
+// NewCounterVec creates a new CounterVec.
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{newMetricVec(name, help, typeCounter, labelNames, func() value { return &Counter{} })}
+}
+
+// WithLabelValues returns the counter for given label values, creating it if necessary.
+func (v *CounterVec) WithLabelValues(labelValues ...string) *Counter {
+	return v.get(labelValues).(*Counter)
+}
+
+// Delete removes the counter with given label values.
+func (v *CounterVec) Delete(labelValues ...string) bool {
+	return v.delete(labelValues)
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	lock sync.Mutex
+	val  float64
+}
+
+// Inc increments the counter by 1.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds given non-negative value to the counter.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("counter cannot decrease")
+	}
+	c.lock.Lock()
+	c.val += v
+	c.lock.Unlock()
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.val
+}
+
+func (c *Counter) write(w io.Writer, name string, labels string) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(c.Value()))
+}
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct {
+	*metricVec
+}
+
+// NewGaugeVec creates a new GaugeVec.
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{newMetricVec(name, help, typeGauge, labelNames, func() value { return &Gauge{} })}
+}
+
+// WithLabelValues returns the gauge for given label values, creating it if necessary.
+func (v *GaugeVec) WithLabelValues(labelValues ...string) *Gauge {
+	return v.get(labelValues).(*Gauge)
+}
+
+// Delete removes the gauge with given label values.
+func (v *GaugeVec) Delete(labelValues ...string) bool {
+	return v.delete(labelValues)
+}
+
+// Reset removes all gauges.
+func (v *GaugeVec) Reset() {
+	v.reset()
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	lock sync.Mutex
+	val  float64
+}
+
+// Set sets the gauge to given value.
+func (g *Gauge) Set(v float64) {
+	g.lock.Lock()
+	g.val = v
+	g.lock.Unlock()
+}
+
+// Add adds given value (which may be negative) to the gauge.
+func (g *Gauge) Add(v float64) {
+	g.lock.Lock()
+	g.val += v
+	g.lock.Unlock()
+}
+
+// Inc increments the gauge by 1.
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+// Dec decrements the gauge by 1.
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() float64 {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.val
+}
+
+func (g *Gauge) write(w io.Writer, name string, labels string) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(g.Value()))
+}
+
+// GaugeFunc is a gauge without labels whose value is computed on each scrape.
+type GaugeFunc struct {
+	name string
+	help string
+	f    func() float64
+}
+
+// NewGaugeFunc creates a new GaugeFunc that reports value returned by f.
+func NewGaugeFunc(name, help string, f func() float64) *GaugeFunc {
+	return &GaugeFunc{name: name, help: help, f: f}
+}
+
+// Name returns the fully qualified name of the metric.
+func (g *GaugeFunc) Name() string {
+	return g.name
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", g.name, escapeHelp(g.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", g.name, typeGauge)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.f()))
+}
+
+// LabeledValue is a single value of GaugeVecFunc.
+type LabeledValue struct {
+	LabelValues []string
+	Value       float64
+}
+
+// GaugeVecFunc is a gauge partitioned by labels whose values are computed on
+// each scrape.
+type GaugeVecFunc struct {
+	name       string
+	help       string
+	labelNames []string
+	collect    func() []LabeledValue
+}
+
+// NewGaugeVecFunc creates a new GaugeVecFunc that reports values returned by
+// collect.
+func NewGaugeVecFunc(name, help string, collect func() []LabeledValue, labelNames ...string) *GaugeVecFunc {
+	return &GaugeVecFunc{name: name, help: help, labelNames: labelNames, collect: collect}
+}
+
+// Name returns the fully qualified name of the metric.
+func (g *GaugeVecFunc) Name() string {
+	return g.name
+}
+
+func (g *GaugeVecFunc) write(w io.Writer) {
+	values := g.collect()
+	lines := make([]string, 0, len(values))
+	for _, v := range values {
+		if len(v.LabelValues) != len(g.labelNames) {
+			panic(fmt.Sprintf("metric %q: expected %d label values, got %d", g.name, len(g.labelNames), len(v.LabelValues)))
+		}
+		lines = append(lines, fmt.Sprintf("%s%s %s\n", g.name, formatLabels(g.labelNames, v.LabelValues), formatFloat(v.Value)))
+	}
+	sort.Strings(lines)
+
+	fmt.Fprintf(w, "# HELP %s %s\n", g.name, escapeHelp(g.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", g.name, typeGauge)
+	for _, line := range lines {
+		io.WriteString(w, line)
+	}
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	*metricVec
+}
+
+// NewHistogramVec creates a new HistogramVec. DefBuckets are used when buckets is nil.
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &HistogramVec{newMetricVec(name, help, typeHistogram, labelNames, func() value {
+		return &Histogram{buckets: b, counts: make([]uint64, len(b))}
+	})}
+}
+
+// WithLabelValues returns the histogram for given label values, creating it if necessary.
+func (v *HistogramVec) WithLabelValues(labelValues ...string) *Histogram {
+	return v.get(labelValues).(*Histogram)
+}
+
+// Histogram counts observations in configurable buckets.
+type Histogram struct {
+	lock    sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// Observe adds a single observation to the histogram.
+func (h *Histogram) Observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.count
+}
+
+// Sum returns the sum of all observations.
+func (h *Histogram) Sum() float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.sum
+}
+
+func (h *Histogram) write(w io.Writer, name string, labels string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, appendLabel(labels, "le", formatFloat(upper)), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, appendLabel(labels, "le", "+Inf"), h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", names[i], escapeLabelValue(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func appendLabel(labels, name, value string) string {
+	pair := fmt.Sprintf("%s=%q", name, value)
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+// escapeLabelValue removes characters that %q would format differently than
+// the Prometheus text format expects.
+func escapeLabelValue(v string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\n' {
+			return -1
+		}
+		return r
+	}, v)
+}
+
+func escapeHelp(help string) string {
+	help = strings.Replace(help, `\`, `\\`, -1)
+	return strings.Replace(help, "\n", `\n`, -1)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
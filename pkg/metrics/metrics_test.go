@@ -0,0 +1,132 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	counter := NewCounterVec("test_total", "Test counter.", "code")
+	gauge := NewGaugeVec("test_gauge", "Test gauge.")
+	histogram := NewHistogramVec("test_seconds", "Test histogram.", []float64{1, 5}, "op")
+	r.MustRegister(counter, gauge, histogram)
+
+	counter.WithLabelValues("429").Inc()
+	counter.WithLabelValues("429").Add(2)
+	counter.WithLabelValues("500").Inc()
+	gauge.WithLabelValues().Set(5)
+	gauge.WithLabelValues().Dec()
+	histogram.WithLabelValues("attach").Observe(0.5)
+	histogram.WithLabelValues("attach").Observe(3)
+	histogram.WithLabelValues("attach").Observe(10)
+
+	expected := `# HELP test_gauge Test gauge.
+# TYPE test_gauge gauge
+test_gauge 4
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{op="attach",le="1"} 1
+test_seconds_bucket{op="attach",le="5"} 2
+test_seconds_bucket{op="attach",le="+Inf"} 3
+test_seconds_sum{op="attach"} 13.5
+test_seconds_count{op="attach"} 3
+# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{code="429"} 3
+test_total{code="500"} 1
+`
+	buf := &bytes.Buffer{}
+	r.WriteText(buf)
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Body.String() != expected {
+		t.Errorf("unexpected HTTP output:\n%s", rec.Body.String())
+	}
+}
+
+func TestRegisterDuplicate(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register(NewCounterVec("test_total", "Test counter.")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := r.Register(NewGaugeVec("test_total", "Test gauge.")); err == nil {
+		t.Errorf("expected error when registering a duplicate metric")
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	r := NewRegistry()
+	counter := NewCounterVec("test_total", "Test counter.", "message")
+	r.MustRegister(counter)
+	counter.WithLabelValues("say \"hi\"\n").Inc()
+
+	expected := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{message="say \"hi\"\n"} 1
+`
+	buf := &bytes.Buffer{}
+	r.WriteText(buf)
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	r := NewRegistry()
+	val := 1.0
+	r.MustRegister(NewGaugeFunc("test_func", "Test gauge func.", func() float64 { return val }))
+	val = 2.5
+
+	expected := `# HELP test_func Test gauge func.
+# TYPE test_func gauge
+test_func 2.5
+`
+	buf := &bytes.Buffer{}
+	r.WriteText(buf)
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestGaugeVecFunc(t *testing.T) {
+	r := NewRegistry()
+	r.MustRegister(NewGaugeVecFunc("test_vec_func", "Test gauge vec func.", func() []LabeledValue {
+		return []LabeledValue{
+			{LabelValues: []string{"pending"}, Value: 2},
+			{LabelValues: []string{"attached"}, Value: 5},
+		}
+	}, "state"))
+
+	expected := `# HELP test_vec_func Test gauge vec func.
+# TYPE test_vec_func gauge
+test_vec_func{state="attached"} 5
+test_vec_func{state="pending"} 2
+`
+	buf := &bytes.Buffer{}
+	r.WriteText(buf)
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
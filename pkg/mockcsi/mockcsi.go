@@ -0,0 +1,276 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mockcsi is an in-process CSI driver with ControllerPublish and
+// ControllerUnpublish, so the attacher can exercise its CSI handler in
+// end-to-end tests without a vendor driver.
+package mockcsi
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// DefaultName is the name of the mock driver when Options.Name is empty.
+const DefaultName = "mock.csi.k8s.io"
+
+// Options configure the behavior of the mock driver.
+type Options struct {
+	// Name is the driver name returned by GetPluginInfo.
+	Name string
+	// PublishContext is returned by each successful ControllerPublish.
+	PublishContext map[string]string
+	// ReadOnly advertises the PUBLISH_READONLY capability.
+	ReadOnly bool
+	// RequireSecrets fails ControllerPublish and ControllerUnpublish calls
+	// without secrets with InvalidArgument.
+	RequireSecrets bool
+	// Latency is added to each ControllerPublish and ControllerUnpublish.
+	Latency time.Duration
+	// ErrorRate is the probability from 0 to 1 that a ControllerPublish or
+	// ControllerUnpublish fails with Internal error.
+	ErrorRate float64
+}
+
+// Driver is the mock CSI driver. It implements the Identity and Controller
+// services, the Controller service supports only ControllerPublish and
+// ControllerUnpublish.
+type Driver struct {
+	options Options
+	server  *grpc.Server
+	address string
+
+	lock sync.Mutex
+	rand *rand.Rand
+	// published are nodes of each published volume.
+	published map[string]map[string]bool
+}
+
+var _ csi.IdentityServer = &Driver{}
+var _ csi.ControllerServer = &Driver{}
+
+// NewDriver returns a mock driver that is not serving yet.
+func NewDriver(options Options) *Driver {
+	if options.Name == "" {
+		options.Name = DefaultName
+	}
+	return &Driver{
+		options:   options,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		published: map[string]map[string]bool{},
+	}
+}
+
+// Start serves the driver on a UNIX domain socket at path. An existing socket
+// at path is removed.
+func (d *Driver) Start(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket %s: %v", path, err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", path, err)
+	}
+	d.server = grpc.NewServer()
+	csi.RegisterIdentityServer(d.server, d)
+	csi.RegisterControllerServer(d.server, d)
+	d.address = path
+	go func() {
+		if err := d.server.Serve(listener); err != nil {
+			klog.Errorf("Mock CSI driver stopped: %v", err)
+		}
+	}()
+	klog.Infof("Mock CSI driver %q listening on %s", d.options.Name, path)
+	return nil
+}
+
+// Stop stops serving the driver and removes its socket.
+func (d *Driver) Stop() {
+	if d.server != nil {
+		d.server.Stop()
+		os.Remove(d.address)
+	}
+}
+
+// Address returns the address of the socket of a started driver.
+func (d *Driver) Address() string {
+	return d.address
+}
+
+// Published returns sorted names of nodes where the volume is published.
+func (d *Driver) Published(volumeID string) []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var nodes []string
+	for node := range d.published[volumeID] {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func (d *Driver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{Name: d.options.Name, VendorVersion: "mock"}, nil
+}
+
+func (d *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	return &csi.GetPluginCapabilitiesResponse{
+		Capabilities: []*csi.PluginCapability{
+			{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{Type: csi.PluginCapability_Service_CONTROLLER_SERVICE},
+				},
+			},
+		},
+	}, nil
+}
+
+func (d *Driver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	return &csi.ProbeResponse{}, nil
+}
+
+func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	rpcs := []csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME}
+	if d.options.ReadOnly {
+		rpcs = append(rpcs, csi.ControllerServiceCapability_RPC_PUBLISH_READONLY)
+	}
+	rsp := &csi.ControllerGetCapabilitiesResponse{}
+	for _, rpc := range rpcs {
+		rsp.Capabilities = append(rsp.Capabilities, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{Type: rpc},
+			},
+		})
+	}
+	return rsp, nil
+}
+
+// behave applies the configured latency and errors of an operation.
+func (d *Driver) behave(ctx context.Context, secrets map[string]string) error {
+	if d.options.RequireSecrets && len(secrets) == 0 {
+		return status.Error(codes.InvalidArgument, "secrets are required")
+	}
+	if d.options.Latency > 0 {
+		select {
+		case <-ctx.Done():
+			return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+		case <-time.After(d.options.Latency):
+		}
+	}
+	d.lock.Lock()
+	fail := d.options.ErrorRate > 0 && d.rand.Float64() < d.options.ErrorRate
+	d.lock.Unlock()
+	if fail {
+		return status.Error(codes.Internal, "injected error")
+	}
+	return nil
+}
+
+func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	if req.VolumeId == "" || req.NodeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID and node ID are required")
+	}
+	if req.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability is required")
+	}
+	if req.Readonly && !d.options.ReadOnly {
+		return nil, status.Error(codes.InvalidArgument, "read-only publish is not supported")
+	}
+	if err := d.behave(ctx, req.Secrets); err != nil {
+		return nil, err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.published[req.VolumeId] == nil {
+		d.published[req.VolumeId] = map[string]bool{}
+	}
+	d.published[req.VolumeId][req.NodeId] = true
+	publishContext := map[string]string{}
+	for key, value := range d.options.PublishContext {
+		publishContext[key] = value
+	}
+	return &csi.ControllerPublishVolumeResponse{PublishContext: publishContext}, nil
+}
+
+func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+	if err := d.behave(ctx, req.Secrets); err != nil {
+		return nil, err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if req.NodeId == "" {
+		delete(d.published, req.VolumeId)
+	} else if nodes := d.published[req.VolumeId]; nodes != nil {
+		delete(nodes, req.NodeId)
+		if len(nodes) == 0 {
+			delete(d.published, req.VolumeId)
+		}
+	}
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mockcsi
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/connection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
+	"github.com/kubernetes-csi/external-attacher/pkg/controller"
+)
+
+func startDriver(t *testing.T, options Options) (*Driver, func()) {
+	dir, err := ioutil.TempDir("", "external-attacher-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDriver(options)
+	if err := d.Start(filepath.Join(dir, "csi.sock")); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return d, func() {
+		d.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDriver(t *testing.T) {
+	d, stop := startDriver(t, Options{
+		PublishContext: map[string]string{"devicePath": "/dev/mock"},
+		RequireSecrets: true,
+	})
+	defer stop()
+	conn, err := connection.Connect(d.Address())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// The driver gets the real CSI handler.
+	client := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(client, 0)
+	driver, err := controller.NewDriver(context.Background(), client, factory, conn, controller.DefaultOptions())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if driver.Name() != DefaultName {
+		t.Errorf("expected name %s, got %s", DefaultName, driver.Name())
+	}
+	if caps := driver.State().Capabilities; caps.Handler != "csi" || caps.PublishReadOnly {
+		t.Errorf("unexpected capabilities %+v", caps)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a := attacher.NewAttacher(conn)
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	if _, _, err := a.Attach(ctx, "vol1", false, "node1", capability, nil, nil); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument without secrets, got %v", err)
+	}
+	secrets := map[string]string{"password": "secret"}
+	publishContext, _, err := a.Attach(ctx, "vol1", false, "node1", capability, nil, secrets)
+	if err != nil {
+		t.Fatalf("unexpected attach error: %v", err)
+	}
+	if !reflect.DeepEqual(publishContext, map[string]string{"devicePath": "/dev/mock"}) {
+		t.Errorf("unexpected publish context %v", publishContext)
+	}
+	if nodes := d.Published("vol1"); !reflect.DeepEqual(nodes, []string{"node1"}) {
+		t.Errorf("expected vol1 published on node1, got %v", nodes)
+	}
+	if _, _, err := a.Attach(ctx, "vol1", true, "node1", capability, nil, secrets); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for read-only attach, got %v", err)
+	}
+	if err := a.Detach(ctx, "vol1", "node1", secrets); err != nil {
+		t.Fatalf("unexpected detach error: %v", err)
+	}
+	if nodes := d.Published("vol1"); len(nodes) != 0 {
+		t.Errorf("expected vol1 not published, got %v", nodes)
+	}
+}
+
+func TestDriverErrors(t *testing.T) {
+	d, stop := startDriver(t, Options{Name: "csi.example.com", ErrorRate: 1})
+	defer stop()
+	conn, err := connection.Connect(d.Address())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+	}
+	if _, _, err := attacher.NewAttacher(conn).Attach(ctx, "vol1", false, "node1", capability, nil, nil); status.Code(err) != codes.Internal {
+		t.Errorf("expected Internal error, got %v", err)
+	}
+	if nodes := d.Published("vol1"); len(nodes) != 0 {
+		t.Errorf("expected vol1 not published, got %v", nodes)
+	}
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package policy asks an external webhook whether an attach or detach may
+// proceed, so platform teams can enforce placement and compliance policies
+// at attach time.
+package policy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/metrics"
+)
+
+// Operations checked by the webhook.
+const (
+	OperationAttach = "attach"
+	OperationDetach = "detach"
+)
+
+// Decisions of the webhook.
+const (
+	// Allow lets the operation proceed.
+	Allow = "allow"
+	// Deny fails the operation, it is retried with exponential backoff.
+	Deny = "deny"
+	// Defer postpones the operation by RetryAfterSeconds without
+	// reporting a failure.
+	Defer = "defer"
+)
+
+// Failure policies, what happens when the webhook can't be called or its
+// response is invalid.
+const (
+	FailurePolicyFail   = "fail"
+	FailurePolicyIgnore = "ignore"
+)
+
+// defaultDeferral is the delay of deferred operations without
+// RetryAfterSeconds.
+const defaultDeferral = 30 * time.Second
+
+// Review is the body of a request to the webhook.
+type Review struct {
+	Operation        string            `json:"operation"`
+	Driver           string            `json:"driver"`
+	VolumeAttachment string            `json:"volumeAttachment"`
+	VolumeHandle     string            `json:"volumeHandle"`
+	ReadOnly         bool              `json:"readOnly"`
+	VolumeAttributes map[string]string `json:"volumeAttributes,omitempty"`
+	// PersistentVolume is nil for inline volumes.
+	PersistentVolume *PersistentVolume `json:"persistentVolume,omitempty"`
+	Node             Node              `json:"node"`
+}
+
+// PersistentVolume describes the PV of a reviewed operation.
+type PersistentVolume struct {
+	Name             string            `json:"name"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	StorageClassName string            `json:"storageClassName,omitempty"`
+	ClaimNamespace   string            `json:"claimNamespace,omitempty"`
+	ClaimName        string            `json:"claimName,omitempty"`
+}
+
+// Node describes the node of a reviewed operation. Labels are empty when
+// the Node object can't be read.
+type Node struct {
+	Name   string            `json:"name"`
+	ID     string            `json:"id"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Decision is the body of a response of the webhook.
+type Decision struct {
+	Decision          string `json:"decision"`
+	Reason            string `json:"reason,omitempty"`
+	RetryAfterSeconds int    `json:"retryAfterSeconds,omitempty"`
+}
+
+// RetryAfter returns the delay of a deferred operation.
+func (d *Decision) RetryAfter() time.Duration {
+	if d.RetryAfterSeconds <= 0 {
+		return defaultDeferral
+	}
+	return time.Duration(d.RetryAfterSeconds) * time.Second
+}
+
+// Checker decides whether an operation may proceed.
+type Checker interface {
+	Check(ctx context.Context, review *Review) (*Decision, error)
+}
+
+var decisionsTotal = metrics.NewCounterVec(
+	metrics.Namespace+"_policy_webhook_decisions_total",
+	"Number of decisions of the policy webhook, \"error\" when the webhook failed.",
+	"operation", "decision")
+
+func init() {
+	metrics.MustRegister(decisionsTotal)
+}
+
+// Options are options of the webhook client. The client certificate is
+// read again for each new connection, so it can be rotated without a
+// restart.
+type Options struct {
+	// URL of the webhook, it must use https.
+	URL string
+	// CAFile is the CA bundle that verifies the webhook certificate. The
+	// system CAs are used when empty.
+	CAFile string
+	// CertFile and KeyFile are the client certificate and key for mutual
+	// TLS. Both or none must be set.
+	CertFile string
+	KeyFile  string
+	// Timeout of each call.
+	Timeout time.Duration
+	// FailurePolicy is FailurePolicyFail or FailurePolicyIgnore.
+	FailurePolicy string
+}
+
+// Validate returns an error when the options can't be used.
+func (o Options) Validate() error {
+	u, err := url.Parse(o.URL)
+	if err != nil {
+		return fmt.Errorf("invalid policy webhook URL: %v", err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("policy webhook URL %q must be an https:// URL", o.URL)
+	}
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return errors.New("both client certificate and key of the policy webhook must be set")
+	}
+	if o.Timeout <= 0 {
+		return errors.New("policy webhook timeout must be greater than zero")
+	}
+	if o.FailurePolicy != FailurePolicyFail && o.FailurePolicy != FailurePolicyIgnore {
+		return fmt.Errorf("policy webhook failure policy must be %q or %q", FailurePolicyFail, FailurePolicyIgnore)
+	}
+	return nil
+}
+
+// Client calls the webhook.
+type Client struct {
+	url           string
+	client        *http.Client
+	failurePolicy string
+}
+
+var _ Checker = &Client{}
+
+// NewClient returns a client of the webhook.
+func NewClient(options Options) (*Client, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newTLSConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		url: options.URL,
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			Timeout:   options.Timeout,
+		},
+		failurePolicy: options.FailurePolicy,
+	}, nil
+}
+
+// Check asks the webhook for a decision about review. When the webhook
+// fails, an error is returned with FailurePolicyFail and the operation is
+// allowed with FailurePolicyIgnore.
+func (c *Client) Check(ctx context.Context, review *Review) (*Decision, error) {
+	decision, err := c.call(ctx, review)
+	if err != nil {
+		decisionsTotal.WithLabelValues(review.Operation, "error").Inc()
+		if c.failurePolicy == FailurePolicyIgnore {
+			klog.Warningf("Policy webhook failed, allowing %s of %q: %v", review.Operation, review.VolumeAttachment, err)
+			return &Decision{Decision: Allow, Reason: "policy webhook failed"}, nil
+		}
+		return nil, fmt.Errorf("policy webhook failed: %v", err)
+	}
+	decisionsTotal.WithLabelValues(review.Operation, decision.Decision).Inc()
+	klog.V(4).Infof("Policy webhook decided %s of %q: %s %s", review.Operation, review.VolumeAttachment, decision.Decision, decision.Reason)
+	return decision, nil
+}
+
+func (c *Client) call(ctx context.Context, review *Review) (*Decision, error) {
+	body, err := json.Marshal(review)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	decision := &Decision{}
+	if err := json.Unmarshal(data, decision); err != nil {
+		return nil, fmt.Errorf("invalid response: %v", err)
+	}
+	switch decision.Decision {
+	case Allow, Deny, Defer:
+	default:
+		return nil, fmt.Errorf("invalid decision %q", decision.Decision)
+	}
+	return decision, nil
+}
+
+func newTLSConfig(options Options) (*tls.Config, error) {
+	config := &tls.Config{}
+	if options.CAFile != "" {
+		pem, err := ioutil.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read policy webhook CA file: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", options.CAFile)
+		}
+	}
+	if options.CertFile != "" {
+		// Check the files now, so misconfiguration is reported at startup
+		// and not as a failing handshake.
+		if _, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile); err != nil {
+			return nil, fmt.Errorf("failed to load policy webhook client certificate: %v", err)
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+			if err != nil {
+				klog.Errorf("Failed to load policy webhook client certificate: %v", err)
+				return nil, err
+			}
+			return &cert, nil
+		}
+	}
+	return config, nil
+}
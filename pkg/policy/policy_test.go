@@ -0,0 +1,248 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert creates a certificate signed by parent (self-signed when nil)
+// and writes it with its key to dir.
+func writeCert(t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// startWebhook starts a webhook that requires client certificates signed by
+// the CA in dir and responds with respond.
+func startWebhook(t *testing.T, dir string, respond func(w http.ResponseWriter, review *Review)) *httptest.Server {
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	writeCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "server"},
+		NotAfter:     notAfter,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		review := &Review{}
+		if err := json.NewDecoder(req.Body).Decode(review); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		respond(w, review)
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.StartTLS()
+	return server
+}
+
+func TestClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "external-attacher-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := startWebhook(t, dir, func(w http.ResponseWriter, review *Review) {
+		switch review.Node.Name {
+		case "secure-node":
+			if review.VolumeAttributes["encrypted"] != "true" {
+				json.NewEncoder(w).Encode(Decision{Decision: Deny, Reason: "volumes on secure-node must be encrypted"})
+				return
+			}
+		case "draining-node":
+			json.NewEncoder(w).Encode(Decision{Decision: Defer, Reason: "node is draining", RetryAfterSeconds: 60})
+			return
+		case "broken-node":
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		case "invalid-node":
+			json.NewEncoder(w).Encode(Decision{Decision: "maybe"})
+			return
+		}
+		json.NewEncoder(w).Encode(Decision{Decision: Allow})
+	})
+	defer server.Close()
+
+	options := Options{
+		URL:           server.URL,
+		CAFile:        filepath.Join(dir, "ca.crt"),
+		CertFile:      filepath.Join(dir, "client.crt"),
+		KeyFile:       filepath.Join(dir, "client.key"),
+		Timeout:       10 * time.Second,
+		FailurePolicy: FailurePolicyFail,
+	}
+	client, err := NewClient(options)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		node       string
+		attributes map[string]string
+		expected   string
+		retryAfter time.Duration
+		expectErr  bool
+	}{
+		{node: "node1", expected: Allow},
+		{node: "secure-node", attributes: map[string]string{"encrypted": "true"}, expected: Allow},
+		{node: "secure-node", expected: Deny},
+		{node: "draining-node", expected: Defer, retryAfter: time.Minute},
+		{node: "broken-node", expectErr: true},
+		{node: "invalid-node", expectErr: true},
+	}
+	for _, test := range tests {
+		review := &Review{
+			Operation:        OperationAttach,
+			Driver:           "csi/test",
+			VolumeAttachment: "va1",
+			VolumeHandle:     "vol1",
+			VolumeAttributes: test.attributes,
+			Node:             Node{Name: test.node, ID: test.node + "-id"},
+		}
+		decision, err := client.Check(context.Background(), review)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got %+v", test.node, decision)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.node, err)
+			continue
+		}
+		if decision.Decision != test.expected {
+			t.Errorf("%s: expected %s, got %+v", test.node, test.expected, decision)
+		}
+		if test.retryAfter != 0 && decision.RetryAfter() != test.retryAfter {
+			t.Errorf("%s: expected retry after %s, got %s", test.node, test.retryAfter, decision.RetryAfter())
+		}
+	}
+
+	// Failures are ignored with FailurePolicyIgnore.
+	options.FailurePolicy = FailurePolicyIgnore
+	client, err = NewClient(options)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	decision, err := client.Check(context.Background(), &Review{Operation: OperationDetach, Node: Node{Name: "broken-node"}})
+	if err != nil || decision.Decision != Allow {
+		t.Errorf("expected allow with failure policy ignore, got %+v, %v", decision, err)
+	}
+
+	// The webhook requires a client certificate.
+	options.FailurePolicy = FailurePolicyFail
+	options.CertFile, options.KeyFile = "", ""
+	client, err = NewClient(options)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := client.Check(context.Background(), &Review{Operation: OperationAttach, Node: Node{Name: "node1"}}); err == nil {
+		t.Errorf("expected error without client certificate, got none")
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	valid := Options{URL: "https://policy.example.com/check", Timeout: time.Second, FailurePolicy: FailurePolicyFail}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	tests := []struct {
+		name   string
+		modify func(o *Options)
+	}{
+		{"http URL", func(o *Options) { o.URL = "http://policy.example.com/check" }},
+		{"no host", func(o *Options) { o.URL = "https:///check" }},
+		{"certificate without key", func(o *Options) { o.CertFile = "client.crt" }},
+		{"zero timeout", func(o *Options) { o.Timeout = 0 }},
+		{"invalid failure policy", func(o *Options) { o.FailurePolicy = "retry" }},
+	}
+	for _, test := range tests {
+		o := valid
+		test.modify(&o)
+		if err := o.Validate(); err == nil {
+			t.Errorf("%s: expected error, got none", test.name)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package replay records VolumeAttachment, PersistentVolume, Node and
+// CSINode events observed by the attacher and replays them against a fake
+// API server, so races seen in production can be reproduced in development.
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
+)
+
+// Kinds of recorded objects.
+const (
+	KindVolumeAttachment = "VolumeAttachment"
+	KindPersistentVolume = "PersistentVolume"
+	KindNode             = "Node"
+	KindCSINode          = "CSINode"
+)
+
+// Types of recorded events.
+const (
+	EventAdd    = "add"
+	EventUpdate = "update"
+	EventDelete = "delete"
+)
+
+// Event is one informer event. Events are saved as JSON lines.
+type Event struct {
+	Time   time.Time       `json:"time"`
+	Kind   string          `json:"kind"`
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+var resources = map[string]schema.GroupVersionResource{
+	KindVolumeAttachment: storage.SchemeGroupVersion.WithResource("volumeattachments"),
+	KindPersistentVolume: v1.SchemeGroupVersion.WithResource("persistentvolumes"),
+	KindNode:             v1.SchemeGroupVersion.WithResource("nodes"),
+	KindCSINode:          storage.SchemeGroupVersion.WithResource("csinodes"),
+}
+
+// Recorder writes events of informers to a file.
+type Recorder struct {
+	lock         sync.Mutex
+	out          io.Writer
+	redactedKeys []string
+	now          func() time.Time
+	failed       bool
+}
+
+// NewRecorder returns a Recorder that writes events to out. Values of
+// redactedKeys in attachment metadata of VolumeAttachments are replaced
+// like in logged PublishContext.
+func NewRecorder(out io.Writer, redactedKeys []string) *Recorder {
+	return &Recorder{out: out, redactedKeys: redactedKeys, now: time.Now}
+}
+
+// Register records events of VolumeAttachment, PersistentVolume, Node and
+// CSINode informers of factory. It must be called before the factory is
+// started.
+func (r *Recorder) Register(factory informers.SharedInformerFactory) {
+	r.register(KindVolumeAttachment, factory.Storage().V1beta1().VolumeAttachments().Informer())
+	r.register(KindPersistentVolume, factory.Core().V1().PersistentVolumes().Informer())
+	r.register(KindNode, factory.Core().V1().Nodes().Informer())
+	r.register(KindCSINode, factory.Storage().V1beta1().CSINodes().Informer())
+}
+
+func (r *Recorder) register(kind string, informer cache.SharedIndexInformer) {
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { r.record(kind, EventAdd, obj) },
+		UpdateFunc: func(old, new interface{}) { r.record(kind, EventUpdate, new) },
+		DeleteFunc: func(obj interface{}) {
+			if unknown, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = unknown.Obj
+			}
+			r.record(kind, EventDelete, obj)
+		},
+	})
+}
+
+func (r *Recorder) record(kind, eventType string, obj interface{}) {
+	if va, ok := obj.(*storage.VolumeAttachment); ok && len(r.redactedKeys) > 0 && len(va.Status.AttachmentMetadata) > 0 {
+		va = va.DeepCopy()
+		va.Status.AttachmentMetadata = attacher.RedactPublishContext(va.Status.AttachmentMetadata, r.redactedKeys)
+		obj = va
+	}
+	data, err := json.Marshal(obj)
+	if err == nil {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		var line []byte
+		line, err = json.Marshal(Event{Time: r.now(), Kind: kind, Type: eventType, Object: data})
+		if err == nil {
+			_, err = r.out.Write(append(line, '\n'))
+		}
+	}
+	if err != nil && !r.failed {
+		// Report only the first error, the output is probably broken.
+		r.failed = true
+		klog.Errorf("Failed to record %s event: %v", kind, err)
+	}
+}
+
+// ReadEvents reads events written by a Recorder.
+func ReadEvents(in io.Reader) ([]Event, error) {
+	var events []Event
+	decoder := json.NewDecoder(in)
+	for {
+		var event Event
+		if err := decoder.Decode(&event); err == io.EOF {
+			return events, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read event %d: %v", len(events)+1, err)
+		}
+		events = append(events, event)
+	}
+}
+
+// Decode returns the object of the event.
+func (e Event) Decode() (runtime.Object, error) {
+	var obj runtime.Object
+	switch e.Kind {
+	case KindVolumeAttachment:
+		obj = &storage.VolumeAttachment{}
+	case KindPersistentVolume:
+		obj = &v1.PersistentVolume{}
+	case KindNode:
+		obj = &v1.Node{}
+	case KindCSINode:
+		obj = &storage.CSINode{}
+	default:
+		return nil, fmt.Errorf("unknown kind %q", e.Kind)
+	}
+	if err := json.Unmarshal(e.Object, obj); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", e.Kind, err)
+	}
+	return obj, nil
+}
+
+// Cluster is a fake API server for replay. Writes of the controller are
+// recorded as actions of Client, events applied by Apply are not.
+type Cluster struct {
+	Client  *fake.Clientset
+	tracker core.ObjectTracker
+}
+
+// NewCluster returns an empty Cluster.
+func NewCluster() *Cluster {
+	tracker := core.NewObjectTracker(scheme.Scheme, scheme.Codecs.UniversalDecoder())
+	client := &fake.Clientset{}
+	client.AddReactor("*", "*", core.ObjectReaction(tracker))
+	client.AddWatchReactor("*", func(action core.Action) (bool, watch.Interface, error) {
+		w, err := tracker.Watch(action.GetResource(), action.GetNamespace())
+		if err != nil {
+			return false, nil, err
+		}
+		return true, w, nil
+	})
+	return &Cluster{Client: client, tracker: tracker}
+}
+
+// Apply changes objects in the cluster as described by the event. Added and
+// updated objects get the recorded state, also when they were changed by
+// the controller in the meantime.
+func (c *Cluster) Apply(e Event) error {
+	obj, err := e.Decode()
+	if err != nil {
+		return err
+	}
+	objMeta, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+	gvr := resources[e.Kind]
+	tracker := c.tracker
+	switch e.Type {
+	case EventAdd, EventUpdate:
+		err = tracker.Update(gvr, obj, "")
+		if apierrs.IsNotFound(err) {
+			err = tracker.Create(gvr, obj, "")
+		}
+	case EventDelete:
+		err = tracker.Delete(gvr, "", objMeta.GetName())
+		if apierrs.IsNotFound(err) {
+			err = nil
+		}
+	default:
+		err = fmt.Errorf("unknown event type %q", e.Type)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to %s %s %s: %v", e.Type, e.Kind, objMeta.GetName(), err)
+	}
+	return nil
+}
+
+// Replay applies events to the cluster one by one, waiting interval after
+// each of them so the controller processes it before the next one. It stops
+// when stopCh is closed.
+func (c *Cluster) Replay(events []Event, interval time.Duration, stopCh <-chan struct{}) error {
+	for i, event := range events {
+		klog.V(2).Infof("Replaying event %d/%d recorded at %s: %s %s", i+1, len(events), event.Time.Format(time.RFC3339Nano), event.Type, event.Kind)
+		if err := c.Apply(event); err != nil {
+			return err
+		}
+		select {
+		case <-stopCh:
+			return nil
+		case <-time.After(interval):
+		}
+	}
+	return nil
+}
+
+// Writes returns API writes of the controller to the cluster, in order.
+// Changes by Apply are not included.
+func (c *Cluster) Writes() []string {
+	var writes []string
+	for _, action := range c.Client.Actions() {
+		var name, detail string
+		switch a := action.(type) {
+		case core.CreateAction:
+			if objMeta, err := meta.Accessor(a.GetObject()); err == nil {
+				name = objMeta.GetName()
+			}
+		case core.UpdateAction:
+			if objMeta, err := meta.Accessor(a.GetObject()); err == nil {
+				name = objMeta.GetName()
+			}
+		case core.PatchAction:
+			name, detail = a.GetName(), " "+string(a.GetPatch())
+		case core.DeleteAction:
+			name = a.GetName()
+		default:
+			continue
+		}
+		resource := action.GetResource().Resource
+		if action.GetSubresource() != "" {
+			resource += "/" + action.GetSubresource()
+		}
+		writes = append(writes, fmt.Sprintf("%s %s %s%s", action.GetVerb(), resource, name, detail))
+	}
+	return writes
+}
+
+// PrintResult prints API writes of the controller and the final state of
+// VolumeAttachments in the cluster.
+func (c *Cluster) PrintResult(out io.Writer) error {
+	fmt.Fprintln(out, "Writes:")
+	for _, write := range c.Writes() {
+		fmt.Fprintf(out, "  %s\n", write)
+	}
+	vas, err := c.Client.StorageV1beta1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	sort.Slice(vas.Items, func(i, j int) bool { return vas.Items[i].Name < vas.Items[j].Name })
+	fmt.Fprintln(out, "VolumeAttachments:")
+	for _, va := range vas.Items {
+		state := "detached"
+		if va.Status.Attached {
+			state = "attached"
+		}
+		if va.DeletionTimestamp != nil {
+			state += ", deleted"
+		}
+		if va.Status.AttachError != nil {
+			state += ", attach error: " + va.Status.AttachError.Message
+		}
+		if va.Status.DetachError != nil {
+			state += ", detach error: " + va.Status.DetachError.Message
+		}
+		fmt.Fprintf(out, "  %s: %s, finalizers %v\n", va.Name, state, va.Finalizers)
+	}
+	return nil
+}
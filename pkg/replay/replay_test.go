@@ -0,0 +1,179 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	storage "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/attacher"
+	"github.com/kubernetes-csi/external-attacher/pkg/controller"
+)
+
+func newVA(name string) *storage.VolumeAttachment {
+	pvName := "pv1"
+	return &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: storage.VolumeAttachmentSpec{
+			Attacher: "csi/test",
+			NodeName: "node1",
+			Source:   storage.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+		},
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(data []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(data)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestRecorder(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(client, 0)
+	var out syncBuffer
+	now := time.Date(2019, 10, 14, 12, 0, 0, 0, time.UTC)
+	recorder := NewRecorder(&out, []string{"chap"})
+	recorder.now = func() time.Time { return now }
+	recorder.Register(factory)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	factory.Start(stopCh)
+	factory.WaitForCacheSync(stopCh)
+
+	vas := client.StorageV1beta1().VolumeAttachments()
+	va := newVA("va1")
+	vas.Create(va)
+	va = va.DeepCopy()
+	va.Status.Attached = true
+	va.Status.AttachmentMetadata = map[string]string{"iqn": "iqn.2019-10.com.example:target", "chap": "chap-secret"}
+	vas.Update(va)
+	vas.Delete(va.Name, nil)
+
+	var events []Event
+	err := wait.PollImmediate(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		var err error
+		events, err = ReadEvents(strings.NewReader(out.String()))
+		return len(events) == 3, err
+	})
+	if err != nil {
+		t.Fatalf("expected 3 events, got %d: %v", len(events), err)
+	}
+	var types []string
+	for _, event := range events {
+		if event.Kind != KindVolumeAttachment || !event.Time.Equal(now) {
+			t.Errorf("unexpected event %+v", event)
+		}
+		types = append(types, event.Type)
+	}
+	if expected := []string{EventAdd, EventUpdate, EventDelete}; !reflect.DeepEqual(types, expected) {
+		t.Errorf("expected events %v, got %v", expected, types)
+	}
+	obj, err := events[1].Decode()
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if decoded := obj.(*storage.VolumeAttachment); decoded.Name != "va1" || !decoded.Status.Attached {
+		t.Errorf("unexpected decoded object %+v", decoded)
+	}
+	expectedMetadata := map[string]string{"iqn": "iqn.2019-10.com.example:target", "chap": attacher.RedactedValue}
+	if metadata := obj.(*storage.VolumeAttachment).Status.AttachmentMetadata; !reflect.DeepEqual(metadata, expectedMetadata) {
+		t.Errorf("expected recorded metadata %v, got %v", expectedMetadata, metadata)
+	}
+	if strings.Contains(out.String(), "chap-secret") {
+		t.Errorf("redacted value found in recorded events")
+	}
+}
+
+func TestReadEventsInvalid(t *testing.T) {
+	if _, err := ReadEvents(strings.NewReader("{\"kind\": \"Node\"}\nnot json\n")); err == nil {
+		t.Errorf("expected error, got none")
+	}
+	if _, err := (Event{Kind: "Pod", Object: []byte("{}")}).Decode(); err == nil {
+		t.Errorf("expected error for unknown kind, got none")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	cluster := NewCluster()
+	factory := informers.NewSharedInformerFactory(cluster.Client, 0)
+	ctrl := controller.NewCSIAttachController(
+		cluster.Client,
+		"csi/test",
+		controller.NewTrivialHandler(cluster.Client),
+		factory.Storage().V1beta1().VolumeAttachments(),
+		factory.Core().V1().PersistentVolumes(),
+		workqueue.DefaultControllerRateLimiter(),
+		workqueue.DefaultControllerRateLimiter(),
+		0,
+		nil,
+	)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	factory.Start(stopCh)
+	go ctrl.Run(1, stopCh)
+
+	var recorded bytes.Buffer
+	recorder := NewRecorder(&recorded, nil)
+	recorder.record(KindVolumeAttachment, EventAdd, newVA("va1"))
+	events, err := ReadEvents(&recorded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cluster.Replay(events, 10*time.Millisecond, stopCh); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var out bytes.Buffer
+	err = wait.PollImmediate(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		out.Reset()
+		err := cluster.PrintResult(&out)
+		return strings.Contains(out.String(), "va1: attached"), err
+	})
+	if err != nil {
+		t.Fatalf("expected va1 to be attached, got:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "  patch volumeattachments va1 ") {
+		t.Errorf("expected a patch of va1 by the controller in writes, got:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), "create volumeattachments") {
+		t.Errorf("replayed events must not be in writes, got:\n%s", out.String())
+	}
+}
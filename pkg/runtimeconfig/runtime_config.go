@@ -0,0 +1,198 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package runtimeconfig watches a ConfigMap with configuration of the
+// external-attacher that is applied without a restart.
+package runtimeconfig
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// Keys of the ConfigMap.
+const (
+	LogLevelKey           = "logLevel"
+	RetryIntervalStartKey = "retryIntervalStart"
+	RetryIntervalMaxKey   = "retryIntervalMax"
+	MinWriteQPSKey        = "kubeAPIMinWriteQPS"
+	MaxWriteQPSKey        = "kubeAPIMaxWriteQPS"
+	MaintenanceKey        = "maintenance"
+)
+
+// Config is the runtime configuration. nil fields are not set in the
+// ConfigMap and values from the command line apply.
+type Config struct {
+	// LogLevel is klog verbosity.
+	LogLevel *int
+	// RetryIntervalStart overrides -retry-interval-start.
+	RetryIntervalStart *time.Duration
+	// RetryIntervalMax overrides -retry-interval-max.
+	RetryIntervalMax *time.Duration
+	// MinWriteQPS overrides -kube-api-min-write-qps.
+	MinWriteQPS *float64
+	// MaxWriteQPS limits writes to the API server below -kube-api-qps.
+	MaxWriteQPS *float64
+	// Maintenance pauses processing of VolumeAttachments and
+	// PersistentVolumes. Operations in progress are finished.
+	Maintenance bool
+}
+
+// Parse parses data of the ConfigMap. Invalid values are skipped and
+// returned as errors, the rest of the configuration is still valid.
+func Parse(data map[string]string) (Config, []error) {
+	var config Config
+	var errs []error
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := data[key]
+		switch key {
+		case LogLevelKey:
+			level, err := strconv.Atoi(value)
+			if err != nil || level < 0 {
+				errs = append(errs, fmt.Errorf("invalid %s %q: must be a non-negative integer", key, value))
+				continue
+			}
+			config.LogLevel = &level
+		case RetryIntervalStartKey, RetryIntervalMaxKey:
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				errs = append(errs, fmt.Errorf("invalid %s %q: must be a positive duration", key, value))
+				continue
+			}
+			if key == RetryIntervalStartKey {
+				config.RetryIntervalStart = &d
+			} else {
+				config.RetryIntervalMax = &d
+			}
+		case MinWriteQPSKey, MaxWriteQPSKey:
+			qps, err := strconv.ParseFloat(value, 64)
+			if err != nil || qps <= 0 {
+				errs = append(errs, fmt.Errorf("invalid %s %q: must be a positive number", key, value))
+				continue
+			}
+			if key == MinWriteQPSKey {
+				config.MinWriteQPS = &qps
+			} else {
+				config.MaxWriteQPS = &qps
+			}
+		case MaintenanceKey:
+			maintenance, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s %q: must be true or false", key, value))
+				continue
+			}
+			config.Maintenance = maintenance
+		default:
+			errs = append(errs, fmt.Errorf("unknown key %q", key))
+		}
+	}
+	return config, errs
+}
+
+// Watcher watches the ConfigMap with runtime configuration.
+type Watcher struct {
+	namespace     string
+	name          string
+	informer      cache.SharedIndexInformer
+	changeHandler []func(config Config)
+}
+
+// NewWatcher returns a new Watcher of ConfigMap namespace/name.
+func NewWatcher(client kubernetes.Interface, namespace, name string, resync time.Duration) *Watcher {
+	selector := fields.OneTermEqualSelector("metadata.name", name).String()
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return client.CoreV1().ConfigMaps(namespace).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return client.CoreV1().ConfigMaps(namespace).Watch(options)
+		},
+	}
+	w := &Watcher{
+		namespace: namespace,
+		name:      name,
+		informer:  cache.NewSharedIndexInformer(lw, &v1.ConfigMap{}, resync, cache.Indexers{}),
+	}
+	w.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    w.changed,
+		UpdateFunc: func(old, new interface{}) { w.changed(new) },
+		DeleteFunc: w.changed,
+	})
+	return w
+}
+
+// OnChange adds a function that is called with the new configuration when
+// the ConfigMap is created, updated or deleted. It must be called before Run.
+func (w *Watcher) OnChange(handler func(config Config)) {
+	w.changeHandler = append(w.changeHandler, handler)
+}
+
+// Run runs the informer of the ConfigMap until stopCh is closed.
+func (w *Watcher) Run(stopCh <-chan struct{}) {
+	w.informer.Run(stopCh)
+}
+
+// HasSynced returns true when the informer cache is synced.
+func (w *Watcher) HasSynced() bool {
+	return w.informer.HasSynced()
+}
+
+// Get returns the current configuration.
+func (w *Watcher) Get() Config {
+	obj, found, err := w.informer.GetStore().GetByKey(w.namespace + "/" + w.name)
+	if err != nil || !found {
+		return Config{}
+	}
+	config, errs := Parse(obj.(*v1.ConfigMap).Data)
+	for _, err := range errs {
+		klog.Errorf("ConfigMap %s/%s: %v", w.namespace, w.name, err)
+	}
+	return config
+}
+
+func (w *Watcher) changed(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	cm, ok := obj.(*v1.ConfigMap)
+	if !ok || cm.Namespace != w.namespace || cm.Name != w.name {
+		return
+	}
+	config := w.Get()
+	klog.Infof("Runtime configuration in ConfigMap %s/%s changed", w.namespace, w.name)
+	for _, handler := range w.changeHandler {
+		handler(config)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runtimeconfig
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestParse(t *testing.T) {
+	level := 5
+	start := 2 * time.Second
+	max := time.Minute
+	minQPS := 0.1
+	maxQPS := 2.5
+
+	tests := []struct {
+		name     string
+		data     map[string]string
+		expected Config
+		errors   int
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "all keys",
+			data: map[string]string{
+				LogLevelKey:           "5",
+				RetryIntervalStartKey: "2s",
+				RetryIntervalMaxKey:   "1m",
+				MinWriteQPSKey:        "0.1",
+				MaxWriteQPSKey:        "2.5",
+				MaintenanceKey:        "true",
+			},
+			expected: Config{
+				LogLevel:           &level,
+				RetryIntervalStart: &start,
+				RetryIntervalMax:   &max,
+				MinWriteQPS:        &minQPS,
+				MaxWriteQPS:        &maxQPS,
+				Maintenance:        true,
+			},
+		},
+		{
+			name: "invalid values",
+			data: map[string]string{
+				LogLevelKey:           "-1",
+				RetryIntervalStartKey: "2",
+				RetryIntervalMaxKey:   "1m",
+				MinWriteQPSKey:        "0",
+				MaintenanceKey:        "maybe",
+				"foo":                 "bar",
+			},
+			expected: Config{
+				RetryIntervalMax: &max,
+			},
+			errors: 5,
+		},
+	}
+	for _, test := range tests {
+		config, errs := Parse(test.data)
+		if !reflect.DeepEqual(config, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, config)
+		}
+		if len(errs) != test.errors {
+			t.Errorf("%s: expected %d errors, got %v", test.name, test.errors, errs)
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "ns"},
+		Data:       map[string]string{MaintenanceKey: "true"},
+	}
+	other := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "ns"},
+		Data:       map[string]string{MaintenanceKey: "true"},
+	}
+	client := fake.NewSimpleClientset(cm)
+	w := NewWatcher(client, "ns", "config", 0)
+	changes := make(chan Config, 10)
+	w.OnChange(func(config Config) {
+		changes <- config
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go w.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, w.HasSynced) {
+		t.Fatal("cache not synced")
+	}
+	expectChange := func(step string, maintenance bool) {
+		select {
+		case config := <-changes:
+			if config.Maintenance != maintenance {
+				t.Errorf("%s: expected maintenance %t, got %t", step, maintenance, config.Maintenance)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: timed out waiting for change", step)
+		}
+	}
+	expectChange("initial", true)
+	if !w.Get().Maintenance {
+		t.Errorf("expected maintenance in the current configuration")
+	}
+
+	// Other ConfigMaps are ignored, even when the API server does not
+	// filter them.
+	if _, err := client.CoreV1().ConfigMaps("ns").Create(other); err != nil {
+		t.Fatal(err)
+	}
+
+	cm = cm.DeepCopy()
+	cm.Data[MaintenanceKey] = "false"
+	if _, err := client.CoreV1().ConfigMaps("ns").Update(cm); err != nil {
+		t.Fatal(err)
+	}
+	expectChange("update", false)
+
+	cm.Data[MaintenanceKey] = "true"
+	if _, err := client.CoreV1().ConfigMaps("ns").Update(cm); err != nil {
+		t.Fatal(err)
+	}
+	expectChange("second update", true)
+
+	if err := client.CoreV1().ConfigMaps("ns").Delete("config", &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expectChange("delete", false)
+}
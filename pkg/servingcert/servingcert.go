@@ -0,0 +1,135 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package servingcert serves TLS with a certificate and key from files that
+// are loaded again when they change, e.g. when cert-manager or kubelet
+// rotates a mounted Secret.
+package servingcert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/metrics"
+)
+
+var certificateExpiry = metrics.NewGaugeVec(
+	metrics.Namespace+"_serving_certificate_expiration_timestamp_seconds",
+	"Time when the certificate of the HTTP endpoint expires, as Unix time.")
+
+func init() {
+	metrics.MustRegister(certificateExpiry)
+}
+
+// Reloader provides the certificate from certFile and keyFile to TLS
+// handshakes. The files are checked on each handshake and loaded again
+// when their modification time or size changes. When the new files can't
+// be loaded, e.g. because the certificate was written before the key, the
+// previous certificate is served until the next change.
+type Reloader struct {
+	certFile, keyFile string
+
+	lock  sync.Mutex
+	cert  *tls.Certificate
+	files [2]fileVersion
+}
+
+// fileVersion identifies the content of a file without reading it.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewReloader returns a Reloader of certFile and keyFile. It fails when
+// the files can't be loaded, so misconfiguration is reported at startup
+// and not as failing handshakes.
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	files, err := r.versions()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(files); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSConfig returns a server configuration that serves the certificate of
+// r.
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	files, err := r.versions()
+	if err != nil {
+		klog.Warningf("Failed to check serving certificate, using the previous one: %v", err)
+		return r.cert, nil
+	}
+	if files != r.files {
+		if err := r.load(files); err != nil {
+			klog.Warningf("Failed to load serving certificate, using the previous one: %v", err)
+		}
+	}
+	return r.cert, nil
+}
+
+// versions returns versions of the certificate and key files.
+func (r *Reloader) versions() ([2]fileVersion, error) {
+	var files [2]fileVersion
+	for i, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return files, err
+		}
+		files[i] = fileVersion{modTime: info.ModTime(), size: info.Size()}
+	}
+	return files, nil
+}
+
+// load loads the files with the given versions. The versions are saved
+// also on failure, so broken files are not loaded again on each handshake.
+func (r *Reloader) load(files [2]fileVersion) error {
+	r.files = files
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load serving certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse serving certificate: %v", err)
+	}
+	cert.Leaf = leaf
+	if r.cert != nil {
+		klog.Infof("Loaded new serving certificate, valid until %s", leaf.NotAfter)
+	}
+	r.cert = &cert
+	certificateExpiry.WithLabelValues().Set(float64(leaf.NotAfter.Unix()))
+	return nil
+}
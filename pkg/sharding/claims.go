@@ -0,0 +1,253 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// ClaimedObjectAnnotation is the annotation of a claim Lease with the name of
+// the claimed object.
+const ClaimedObjectAnnotation = "attacher.csi.storage.k8s.io/claimed-object"
+
+// Claims lets replicas claim individual objects using short-lived Lease
+// objects. A replica processes an object only while it holds its claim. The
+// claim is renewed while the object is being processed and released when the
+// object was not processed for idleTimeout, which must be longer than
+// processing of a single object. Claims of a crashed replica expire after
+// leaseDuration.
+type Claims struct {
+	client        kubernetes.Interface
+	namespace     string
+	group         string
+	identity      string
+	leaseDuration time.Duration
+	renewPeriod   time.Duration
+	idleTimeout   time.Duration
+	changeHandler []func()
+
+	lock sync.Mutex
+	// held are claims held by this replica, indexed by object name.
+	held map[string]*heldClaim
+	// contended are expiration times of claims held by other replicas,
+	// indexed by object name.
+	contended map[string]time.Time
+}
+
+type heldClaim struct {
+	lease    *coordinationv1.Lease
+	lastUsed time.Time
+}
+
+// NewClaims returns a new Claims. Claim Leases are stored in given namespace.
+func NewClaims(client kubernetes.Interface, namespace, group, identity string, leaseDuration, renewPeriod, idleTimeout time.Duration) *Claims {
+	return &Claims{
+		client:        client,
+		namespace:     namespace,
+		group:         group,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		renewPeriod:   renewPeriod,
+		idleTimeout:   idleTimeout,
+		held:          map[string]*heldClaim{},
+		contended:     map[string]time.Time{},
+	}
+}
+
+// OnChange adds a function that is called when a claim of another replica
+// expired. It must be called before Run.
+func (c *Claims) OnChange(handler func()) {
+	c.changeHandler = append(c.changeHandler, handler)
+}
+
+// Run renews held claims until ctx is cancelled. Then it releases all claims.
+func (c *Claims) Run(ctx context.Context) {
+	wait.Until(c.sync, c.renewPeriod, ctx.Done())
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for name := range c.held {
+		c.release(name)
+	}
+}
+
+// Owns returns true if this replica holds the claim of the object with given
+// name, claiming it if possible.
+func (c *Claims) Owns(name string) bool {
+	now := time.Now()
+	c.lock.Lock()
+	if claim, found := c.held[name]; found {
+		claim.lastUsed = now
+		c.lock.Unlock()
+		return true
+	}
+	if expiresAt, found := c.contended[name]; found && now.Before(expiresAt) {
+		c.lock.Unlock()
+		return false
+	}
+	c.lock.Unlock()
+
+	// Workers process different objects, there is no other Owns with the
+	// same name running in parallel.
+	lease, err := c.claim(name, now)
+	if err != nil {
+		klog.V(4).Infof("Failed to claim %q: %v", name, err)
+		return false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if holder := *lease.Spec.HolderIdentity; holder != c.identity {
+		klog.V(5).Infof("%q is claimed by %q", name, holder)
+		c.contended[name] = expirationOf(lease)
+		return false
+	}
+	delete(c.contended, name)
+	c.held[name] = &heldClaim{lease: lease, lastUsed: now}
+	return true
+}
+
+// claim returns the claim Lease of the object, claiming it when it's free.
+func (c *Claims) claim(name string, now time.Time) (*coordinationv1.Lease, error) {
+	leases := c.client.CoordinationV1().Leases(c.namespace)
+	duration := int32(c.leaseDuration / time.Second)
+	renewTime := metav1.NewMicroTime(now)
+
+	lease, err := leases.Get(c.leaseName(name), metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        c.leaseName(name),
+				Namespace:   c.namespace,
+				Labels:      map[string]string{GroupLabel: groupLabelValue(c.group)},
+				Annotations: map[string]string{ClaimedObjectAnnotation: name},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &c.identity,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &renewTime,
+				RenewTime:            &renewTime,
+			},
+		}
+		return leases.Create(lease)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity != c.identity && now.Before(expirationOf(lease)) {
+		return lease, nil
+	}
+
+	// The claim expired or it is ours from a previous run.
+	lease = lease.DeepCopy()
+	lease.Spec.HolderIdentity = &c.identity
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.AcquireTime = &renewTime
+	lease.Spec.RenewTime = &renewTime
+	return leases.Update(lease)
+}
+
+// sync renews used claims, releases unused ones and checks if claims of
+// other replicas expired.
+func (c *Claims) sync() {
+	now := time.Now()
+	expired := false
+
+	c.lock.Lock()
+	for name, claim := range c.held {
+		if now.Sub(claim.lastUsed) > c.idleTimeout {
+			c.release(name)
+			continue
+		}
+		lease := claim.lease.DeepCopy()
+		renewTime := metav1.NewMicroTime(now)
+		lease.Spec.RenewTime = &renewTime
+		updated, err := c.client.CoordinationV1().Leases(c.namespace).Update(lease)
+		if err != nil {
+			// The claim may have been taken over after we failed to renew it
+			// in time. Claim it again on the next Owns.
+			klog.Errorf("Failed to renew claim of %q: %v", name, err)
+			delete(c.held, name)
+			continue
+		}
+		claim.lease = updated
+	}
+
+	for name, expiresAt := range c.contended {
+		if now.Before(expiresAt) {
+			continue
+		}
+		lease, err := c.client.CoordinationV1().Leases(c.namespace).Get(c.leaseName(name), metav1.GetOptions{})
+		switch {
+		case apierrs.IsNotFound(err):
+			// Released by its holder after it finished processing.
+			delete(c.contended, name)
+		case err != nil:
+			klog.Errorf("Failed to get claim of %q: %v", name, err)
+		case now.Before(expirationOf(lease)):
+			c.contended[name] = expirationOf(lease)
+		default:
+			klog.V(2).Infof("Claim of %q by %q expired", name, *lease.Spec.HolderIdentity)
+			delete(c.contended, name)
+			expired = true
+		}
+	}
+	c.lock.Unlock()
+
+	if expired {
+		for _, handler := range c.changeHandler {
+			handler()
+		}
+	}
+}
+
+// release deletes a held claim. It must be called with c.lock held.
+func (c *Claims) release(name string) {
+	claim := c.held[name]
+	delete(c.held, name)
+	uid := claim.lease.UID
+	err := c.client.CoordinationV1().Leases(c.namespace).Delete(c.leaseName(name), &metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &uid},
+	})
+	if err != nil && !apierrs.IsNotFound(err) {
+		klog.Errorf("Failed to release claim of %q: %v", name, err)
+	}
+}
+
+func (c *Claims) leaseName(name string) string {
+	return sanitizeName(fmt.Sprintf("%s-%x", c.group, hash(name)))
+}
+
+// expirationOf returns the time when the claim expires if it is not renewed.
+// It compares clocks of different replicas, the lease duration must be much
+// longer than the expected clock skew.
+func expirationOf(lease *coordinationv1.Lease) time.Time {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return time.Time{}
+	}
+	return lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+}
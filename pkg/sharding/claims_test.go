@@ -0,0 +1,114 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharding
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestClaims(client kubernetes.Interface, identity string) *Claims {
+	return NewClaims(client, testNamespace, testGroup, identity, 10*time.Second, time.Second, time.Minute)
+}
+
+func countLeases(t *testing.T, client kubernetes.Interface) int {
+	leases, err := client.CoordinationV1().Leases(testNamespace).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list leases: %s", err)
+	}
+	return len(leases.Items)
+}
+
+func TestClaims(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	a := newTestClaims(client, "a")
+	b := newTestClaims(client, "b")
+	expired := 0
+	b.OnChange(func() { expired++ })
+
+	if !a.Owns("va1") {
+		t.Fatalf("expected a to claim free va1")
+	}
+	if !a.Owns("va1") {
+		t.Errorf("expected a to own va1")
+	}
+	if b.Owns("va1") {
+		t.Errorf("expected va1 to be claimed by a")
+	}
+	if !b.Owns("va2") {
+		t.Errorf("expected b to claim free va2")
+	}
+	a.sync()
+	b.sync()
+	if expired != 0 {
+		t.Errorf("unexpected expired claim")
+	}
+
+	// a crashes and its claim expires.
+	lease, err := client.CoordinationV1().Leases(testNamespace).Get(a.leaseName("va1"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get lease: %s", err)
+	}
+	if lease.Annotations[ClaimedObjectAnnotation] != "va1" {
+		t.Errorf("expected annotation with the claimed object, got %v", lease.Annotations)
+	}
+	old := metav1.NewMicroTime(time.Now().Add(-time.Minute))
+	lease.Spec.RenewTime = &old
+	if _, err := client.CoordinationV1().Leases(testNamespace).Update(lease); err != nil {
+		t.Fatalf("failed to update lease: %s", err)
+	}
+	b.contended["va1"] = time.Now().Add(-time.Second)
+	b.sync()
+	if expired != 1 {
+		t.Errorf("expected the expired claim to be reported")
+	}
+	if !b.Owns("va1") {
+		t.Errorf("expected b to claim expired va1")
+	}
+}
+
+func TestClaimsRelease(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	a := NewClaims(client, testNamespace, testGroup, "a", 10*time.Second, time.Second, 0)
+	a.Owns("va1")
+	a.Owns("va2")
+	if n := countLeases(t, client); n != 2 {
+		t.Fatalf("expected 2 claims, got %d", n)
+	}
+
+	// Claims not used for idleTimeout are released.
+	time.Sleep(time.Millisecond)
+	a.sync()
+	if n := countLeases(t, client); n != 0 {
+		t.Errorf("expected idle claims to be released, got %d", n)
+	}
+
+	// All claims are released on shutdown.
+	b := newTestClaims(client, "b")
+	b.Owns("va1")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.Run(ctx)
+	if n := countLeases(t, client); n != 0 {
+		t.Errorf("expected claims to be released on shutdown, got %d", n)
+	}
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sharding distributes objects among active replicas of the
+// external-attacher. Each replica heartbeats its own Lease object and objects
+// are assigned to the replicas using rendezvous (highest random weight)
+// hashing, so only objects of a joining or leaving replica move.
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// GroupLabel is the label of Lease objects of members of a group.
+const GroupLabel = "attacher.csi.storage.k8s.io/shard-group"
+
+// Membership tracks members of a group of replicas and assigns objects to
+// them.
+type Membership struct {
+	client        kubernetes.Interface
+	namespace     string
+	group         string
+	identity      string
+	leaseDuration time.Duration
+	renewPeriod   time.Duration
+	changeHandler []func()
+
+	lock sync.RWMutex
+	// members is sorted list of identities of live members.
+	members []string
+	// observed holds the last seen renew time of each member's Lease and
+	// when it was seen, in local time. Members are considered dead when their
+	// Lease was not renewed for leaseDuration of local time, so clock skew
+	// between nodes does not matter.
+	observed  map[string]observation
+	lastRenew time.Time
+}
+
+type observation struct {
+	renewTime  time.Time
+	observedAt time.Time
+}
+
+// NewMembership returns a new Membership. Its Lease is stored in given
+// namespace, other members of the group are found by GroupLabel.
+func NewMembership(client kubernetes.Interface, namespace, group, identity string, leaseDuration, renewPeriod time.Duration) *Membership {
+	return &Membership{
+		client:        client,
+		namespace:     namespace,
+		group:         group,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		renewPeriod:   renewPeriod,
+		observed:      map[string]observation{},
+	}
+}
+
+// OnChange adds a function that is called after the list of members changes.
+// It must be called before Run.
+func (m *Membership) OnChange(handler func()) {
+	m.changeHandler = append(m.changeHandler, handler)
+}
+
+// Run renews the member's Lease and refreshes the list of members until ctx
+// is cancelled. Then it deletes the Lease, so other members take over its
+// objects immediately.
+func (m *Membership) Run(ctx context.Context) {
+	klog.Infof("Joining shard group %q as %q", m.group, m.identity)
+	wait.Until(m.sync, m.renewPeriod, ctx.Done())
+
+	klog.Infof("Leaving shard group %q", m.group)
+	err := m.client.CoordinationV1().Leases(m.namespace).Delete(m.leaseName(), &metav1.DeleteOptions{})
+	if err != nil && !apierrs.IsNotFound(err) {
+		klog.Errorf("Failed to delete Lease %s/%s: %v", m.namespace, m.leaseName(), err)
+	}
+}
+
+// Owns returns true if the object with given name is assigned to this member.
+func (m *Membership) Owns(name string) bool {
+	return owner(m.Members(), name) == m.identity
+}
+
+// Members returns sorted identities of all live members.
+func (m *Membership) Members() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.members
+}
+
+func (m *Membership) sync() {
+	now := time.Now()
+	if err := m.renew(now); err != nil {
+		klog.Errorf("Failed to renew Lease %s/%s: %v", m.namespace, m.leaseName(), err)
+	} else {
+		m.lock.Lock()
+		m.lastRenew = now
+		m.lock.Unlock()
+	}
+
+	leases, err := m.client.CoordinationV1().Leases(m.namespace).List(metav1.ListOptions{
+		LabelSelector: GroupLabel + "=" + groupLabelValue(m.group),
+	})
+	if err != nil {
+		klog.Errorf("Failed to list members of shard group %q: %v", m.group, err)
+		return
+	}
+	m.updateMembers(leases.Items, now)
+}
+
+func (m *Membership) renew(now time.Time) error {
+	leases := m.client.CoordinationV1().Leases(m.namespace)
+	duration := int32(m.leaseDuration / time.Second)
+	renewTime := metav1.NewMicroTime(now)
+
+	lease, err := leases.Get(m.leaseName(), metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      m.leaseName(),
+				Namespace: m.namespace,
+				Labels:    map[string]string{GroupLabel: groupLabelValue(m.group)},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &m.identity,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &renewTime,
+				RenewTime:            &renewTime,
+			},
+		}
+		_, err = leases.Create(lease)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	lease = lease.DeepCopy()
+	lease.Spec.HolderIdentity = &m.identity
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &renewTime
+	_, err = leases.Update(lease)
+	return err
+}
+
+func (m *Membership) updateMembers(leases []coordinationv1.Lease, now time.Time) {
+	m.lock.Lock()
+	observed := map[string]observation{}
+	var members []string
+	for _, lease := range leases {
+		if lease.Spec.HolderIdentity == nil || lease.Spec.RenewTime == nil {
+			continue
+		}
+		identity := *lease.Spec.HolderIdentity
+		if identity == m.identity {
+			// Liveness of this member is decided by its own renewals below.
+			continue
+		}
+		o := observation{renewTime: lease.Spec.RenewTime.Time, observedAt: now}
+		if prev, found := m.observed[identity]; found && prev.renewTime.Equal(o.renewTime) {
+			o.observedAt = prev.observedAt
+		}
+		observed[identity] = o
+		if now.Sub(o.observedAt) < m.leaseDuration {
+			members = append(members, identity)
+		}
+	}
+	if now.Sub(m.lastRenew) < m.leaseDuration {
+		members = append(members, m.identity)
+	}
+	sort.Strings(members)
+	m.observed = observed
+
+	changed := !equal(members, m.members)
+	if changed {
+		klog.Infof("Members of shard group %q changed: %v", m.group, members)
+		m.members = members
+	}
+	m.lock.Unlock()
+
+	if changed {
+		for _, handler := range m.changeHandler {
+			handler()
+		}
+	}
+}
+
+func (m *Membership) leaseName() string {
+	return sanitizeName(m.group + "-" + m.identity)
+}
+
+// groupLabelValue returns the group name usable as a label value.
+func groupLabelValue(group string) string {
+	value := sanitizeName(group)
+	if len(value) > 63 {
+		return fmt.Sprintf("%x", hash(group))
+	}
+	return value
+}
+
+// owner returns the member the object with given name is assigned to.
+func owner(members []string, name string) string {
+	var best string
+	var bestWeight uint64
+	for _, member := range members {
+		weight := hash(member + "/" + name)
+		if best == "" || weight > bestWeight {
+			best = member
+			bestWeight = weight
+		}
+	}
+	return best
+}
+
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// FNV alone does not mix strings that differ only in few characters
+	// well enough for HRW, finalize it like MurmurHash3 does.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+var invalidNameChars = regexp.MustCompile("[^a-zA-Z0-9-]")
+
+// sanitizeName sanitizes the provided string so it can be used as a Lease name
+func sanitizeName(name string) string {
+	name = invalidNameChars.ReplaceAllString(name, "-")
+	if name[len(name)-1] == '-' {
+		// name must not end with '-'
+		name = name + "X"
+	}
+	return name
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	testNamespace = "default"
+	testGroup     = "external-attacher-csi-mock"
+)
+
+func newTestMembership(client kubernetes.Interface, identity string) *Membership {
+	return NewMembership(client, testNamespace, testGroup, identity, 10*time.Second, time.Second)
+}
+
+func TestMembers(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	a := newTestMembership(client, "a")
+	b := newTestMembership(client, "b")
+	changes := 0
+	a.OnChange(func() { changes++ })
+
+	a.sync()
+	if members := a.Members(); !reflect.DeepEqual(members, []string{"a"}) {
+		t.Errorf("expected members [a], got %v", members)
+	}
+	b.sync()
+	a.sync()
+	if members := a.Members(); !reflect.DeepEqual(members, []string{"a", "b"}) {
+		t.Errorf("expected members [a b], got %v", members)
+	}
+	if changes != 2 {
+		t.Errorf("expected 2 changes, got %d", changes)
+	}
+
+	// b stops renewing its Lease.
+	a.sync()
+	lease, err := client.CoordinationV1().Leases(testNamespace).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list leases: %s", err)
+	}
+	a.updateMembers(lease.Items, time.Now().Add(11*time.Second))
+	if members := a.Members(); len(members) != 0 {
+		// a did not renew its own lease in time either.
+		t.Errorf("expected no members, got %v", members)
+	}
+}
+
+func TestLeave(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	a := newTestMembership(client, "a")
+	b := newTestMembership(client, "b")
+	a.sync()
+	b.sync()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.Run(ctx)
+
+	a.sync()
+	if members := a.Members(); !reflect.DeepEqual(members, []string{"a"}) {
+		t.Errorf("expected members [a] after b left, got %v", members)
+	}
+}
+
+func TestOwner(t *testing.T) {
+	if o := owner(nil, "va"); o != "" {
+		t.Errorf("expected no owner without members, got %q", o)
+	}
+
+	members := []string{"a", "b", "c"}
+	owned := map[string]int{}
+	moved := 0
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("va-%d", i)
+		o := owner(members, name)
+		owned[o]++
+		// Removing a member moves only its objects.
+		if o != "c" && owner([]string{"a", "b"}, name) != o {
+			moved++
+		}
+	}
+	for _, m := range members {
+		if owned[m] < 50 {
+			t.Errorf("member %q owns only %d of 300 objects", m, owned[m])
+		}
+	}
+	if moved != 0 {
+		t.Errorf("%d objects of remaining members moved", moved)
+	}
+}
@@ -0,0 +1,322 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package watchdog samples the number of goroutines and the heap size of the
+// process, exports them with their trend as metrics and warns when their
+// sustained growth suggests a leak.
+package watchdog
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/klog"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/metrics"
+)
+
+// Resources watched by the watchdog, values of the "resource" label.
+const (
+	ResourceGoroutines = "goroutines"
+	ResourceHeap       = "heap"
+)
+
+// stackSummaryLength is the number of the most frequent goroutine stacks
+// logged with a goroutine leak warning.
+const stackSummaryLength = 5
+
+var (
+	goroutines = metrics.NewGaugeVec(
+		metrics.Namespace+"_goroutines",
+		"Number of goroutines at the last watchdog sample.")
+	heapBytes = metrics.NewGaugeVec(
+		metrics.Namespace+"_heap_alloc_bytes",
+		"Bytes of allocated heap objects at the last watchdog sample.")
+	goroutinesTrend = metrics.NewGaugeVec(
+		metrics.Namespace+"_goroutines_trend_per_hour",
+		"Growth of the number of goroutines per hour over the watchdog window, negative when it shrinks.")
+	heapBytesTrend = metrics.NewGaugeVec(
+		metrics.Namespace+"_heap_alloc_bytes_trend_per_hour",
+		"Growth of allocated heap bytes per hour over the watchdog window, negative when it shrinks.")
+	leakWarningsTotal = metrics.NewCounterVec(
+		metrics.Namespace+"_leak_warnings_total",
+		"Number of warnings about sustained growth of goroutines or heap.",
+		"resource")
+)
+
+func init() {
+	metrics.MustRegister(goroutines, heapBytes, goroutinesTrend, heapBytesTrend, leakWarningsTotal)
+}
+
+// Config configures a Watchdog.
+type Config struct {
+	// Interval is the period of samples.
+	Interval time.Duration
+	// Window is the time over which the trend and growth are computed.
+	Window time.Duration
+	// Growth is the relative growth over Window that is reported as a
+	// leak when it is sustained, e.g. 0.5 for 50%.
+	Growth float64
+}
+
+// Validate checks the configuration.
+func (c Config) Validate() error {
+	if c.Interval <= 0 {
+		return fmt.Errorf("interval must be positive, got %s", c.Interval)
+	}
+	if c.Window < 2*c.Interval {
+		return fmt.Errorf("window %s must be at least twice the interval %s", c.Window, c.Interval)
+	}
+	if c.Growth <= 0 {
+		return fmt.Errorf("growth must be positive, got %v", c.Growth)
+	}
+	return nil
+}
+
+// Watchdog samples goroutines and heap of the process.
+type Watchdog struct {
+	config       Config
+	clock        clock.Clock
+	numGoroutine func() int
+	heapAlloc    func() uint64
+	// stacks returns goroutine stacks in the format of the "goroutine"
+	// profile with debug=1.
+	stacks func() []byte
+
+	lock       sync.Mutex
+	goroutines *series
+	heap       *series
+}
+
+// New returns a Watchdog of the current process.
+func New(config Config) *Watchdog {
+	size := int(config.Window/config.Interval) + 1
+	return &Watchdog{
+		config:       config,
+		clock:        clock.RealClock{},
+		numGoroutine: runtime.NumGoroutine,
+		heapAlloc: func() uint64 {
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			return stats.HeapAlloc
+		},
+		stacks: func() []byte {
+			var buf bytes.Buffer
+			pprof.Lookup("goroutine").WriteTo(&buf, 1)
+			return buf.Bytes()
+		},
+		goroutines: newSeries(size),
+		heap:       newSeries(size),
+	}
+}
+
+// Run takes a sample each interval until stopCh is closed.
+func (w *Watchdog) Run(stopCh <-chan struct{}) {
+	ticker := w.clock.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+	w.sample()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C():
+			w.sample()
+		}
+	}
+}
+
+func (w *Watchdog) sample() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	now := w.clock.Now()
+
+	count := w.numGoroutine()
+	w.goroutines.add(now, float64(count))
+	goroutines.WithLabelValues().Set(float64(count))
+	goroutinesTrend.WithLabelValues().Set(w.goroutines.trendPerHour())
+	if w.goroutines.growing(w.config.Growth) {
+		leakWarningsTotal.WithLabelValues(ResourceGoroutines).Inc()
+		klog.Warningf("Number of goroutines grew from %.0f to %d in %s, possible goroutine leak. Most frequent stacks:\n%s",
+			w.goroutines.first(), count, w.config.Window, summarizeStacks(w.stacks(), stackSummaryLength))
+		w.goroutines.reset()
+	}
+
+	heap := w.heapAlloc()
+	w.heap.add(now, float64(heap))
+	heapBytes.WithLabelValues().Set(float64(heap))
+	heapBytesTrend.WithLabelValues().Set(w.heap.trendPerHour())
+	if w.heap.growing(w.config.Growth) {
+		leakWarningsTotal.WithLabelValues(ResourceHeap).Inc()
+		klog.Warningf("Allocated heap grew from %.0f to %d bytes in %s, possible memory leak. Goroutines: %d",
+			w.heap.first(), heap, w.config.Window, count)
+		w.heap.reset()
+	}
+}
+
+// sample is a value at a time.
+type sample struct {
+	time  time.Time
+	value float64
+}
+
+// series are the samples of one resource in the window.
+type series struct {
+	size    int
+	samples []sample
+}
+
+func newSeries(size int) *series {
+	return &series{size: size}
+}
+
+func (s *series) add(t time.Time, value float64) {
+	s.samples = append(s.samples, sample{time: t, value: value})
+	if len(s.samples) > s.size {
+		s.samples = s.samples[len(s.samples)-s.size:]
+	}
+}
+
+// reset starts a new window, so a leak is reported once per window.
+func (s *series) reset() {
+	s.samples = s.samples[len(s.samples)-1:]
+}
+
+func (s *series) first() float64 {
+	return s.samples[0].value
+}
+
+// trendPerHour is the slope of the least squares line through the samples.
+func (s *series) trendPerHour() float64 {
+	n := float64(len(s.samples))
+	if n < 2 {
+		return 0
+	}
+	var sumX, sumY, sumXY, sumXX float64
+	for _, sample := range s.samples {
+		x := sample.time.Sub(s.samples[0].time).Hours()
+		sumX += x
+		sumY += sample.value
+		sumXY += x * sample.value
+		sumXX += x * x
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
+
+// growing returns true when the window is full, the values grew by at least
+// growth relative to the first sample and the growth is sustained: all
+// samples in the second half of the window are higher than all samples in
+// the first half, so a temporary spike is not reported.
+func (s *series) growing(growth float64) bool {
+	if len(s.samples) < s.size {
+		return false
+	}
+	first, last := s.samples[0].value, s.samples[len(s.samples)-1].value
+	if last < first*(1+growth) {
+		return false
+	}
+	half := len(s.samples) / 2
+	max := s.samples[0].value
+	for _, sample := range s.samples[:half] {
+		if sample.value > max {
+			max = sample.value
+		}
+	}
+	for _, sample := range s.samples[half:] {
+		if sample.value <= max {
+			return false
+		}
+	}
+	return true
+}
+
+// stackGroup are goroutines with the same stack.
+type stackGroup struct {
+	count int
+	// function is the innermost function outside of the runtime.
+	function string
+	// entry is the function the goroutines were started with, the last
+	// frame of the stack.
+	entry string
+}
+
+// summarizeStacks returns the most frequent stacks of the debug=1 goroutine
+// profile, one line per stack.
+func summarizeStacks(profile []byte, length int) string {
+	var groups []stackGroup
+	var group *stackGroup
+	scanner := bufio.NewScanner(bytes.NewReader(profile))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.Contains(line, " @ "):
+			// "<count> @ 0x... 0x..." starts a stack.
+			count, err := strconv.Atoi(strings.Fields(line)[0])
+			if err != nil {
+				group = nil
+				continue
+			}
+			groups = append(groups, stackGroup{count: count})
+			group = &groups[len(groups)-1]
+		case group != nil && strings.HasPrefix(line, "#\t"):
+			// "#\t0x...\t<function>+0x...\t<file>:<line>"
+			fields := strings.Split(line, "\t")
+			if len(fields) < 4 {
+				continue
+			}
+			function := fields[2]
+			if i := strings.LastIndex(function, "+0x"); i >= 0 {
+				function = function[:i]
+			}
+			if group.function == "" && !isRuntime(function) {
+				group.function = function
+			}
+			group.entry = function
+		case line == "":
+			group = nil
+		}
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].count > groups[j].count })
+	if len(groups) > length {
+		groups = groups[:length]
+	}
+	var buf bytes.Buffer
+	for _, group := range groups {
+		fmt.Fprintf(&buf, "%6d %s (goroutine %s)\n", group.count, group.function, group.entry)
+	}
+	return buf.String()
+}
+
+func isRuntime(function string) bool {
+	for _, prefix := range []string{"runtime.", "runtime/", "sync.", "internal/"} {
+		if strings.HasPrefix(function, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package watchdog
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+// newTestWatchdog returns a watchdog that samples *count goroutines and
+// *heap bytes.
+func newTestWatchdog(count *int, heap *uint64) (*Watchdog, *clock.FakeClock) {
+	w := New(Config{Interval: time.Minute, Window: 10 * time.Minute, Growth: 0.5})
+	fakeClock := clock.NewFakeClock(time.Date(2019, 10, 14, 12, 0, 0, 0, time.UTC))
+	w.clock = fakeClock
+	w.numGoroutine = func() int { return *count }
+	w.heapAlloc = func() uint64 { return *heap }
+	w.stacks = func() []byte { return nil }
+	return w, fakeClock
+}
+
+func TestWatchdogLeak(t *testing.T) {
+	count, heap := 100, uint64(1000)
+	w, fakeClock := newTestWatchdog(&count, &heap)
+	warnings := leakWarningsTotal.WithLabelValues(ResourceGoroutines).Value()
+
+	// 10 goroutines leak each minute, the heap is stable.
+	for i := 0; i < 11; i++ {
+		w.sample()
+		count += 10
+		fakeClock.Step(time.Minute)
+	}
+	if got := leakWarningsTotal.WithLabelValues(ResourceGoroutines).Value() - warnings; got != 1 {
+		t.Errorf("expected 1 goroutine leak warning, got %v", got)
+	}
+	if got := goroutines.WithLabelValues().Value(); got != 200 {
+		t.Errorf("expected 200 goroutines, got %v", got)
+	}
+
+	// The next warning comes after another window.
+	w.sample()
+	if got := leakWarningsTotal.WithLabelValues(ResourceGoroutines).Value() - warnings; got != 1 {
+		t.Errorf("expected no new warning in the same window, got %v warnings", got)
+	}
+}
+
+func TestWatchdogTrend(t *testing.T) {
+	count, heap := 100, uint64(1000)
+	w, fakeClock := newTestWatchdog(&count, &heap)
+	for i := 0; i < 5; i++ {
+		w.sample()
+		heap += 100
+		fakeClock.Step(time.Minute)
+	}
+	// 100 bytes per minute.
+	if got := heapBytesTrend.WithLabelValues().Value(); math.Abs(got-6000) > 0.001 {
+		t.Errorf("expected heap trend 6000 bytes per hour, got %v", got)
+	}
+	if got := goroutinesTrend.WithLabelValues().Value(); got != 0 {
+		t.Errorf("expected goroutine trend 0, got %v", got)
+	}
+}
+
+func TestSeriesGrowing(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []float64
+		expected bool
+	}{
+		{
+			name:   "window not full",
+			values: []float64{10, 20, 30},
+		},
+		{
+			name:     "sustained growth",
+			values:   []float64{10, 11, 12, 13, 14, 16},
+			expected: true,
+		},
+		{
+			name:   "growth below threshold",
+			values: []float64{10, 11, 12, 13, 14, 14},
+		},
+		{
+			name:   "spike",
+			values: []float64{10, 30, 10, 10, 10, 20},
+		},
+	}
+	for _, test := range tests {
+		s := newSeries(6)
+		now := time.Now()
+		for i, value := range test.values {
+			s.add(now.Add(time.Duration(i)*time.Minute), value)
+		}
+		if got := s.growing(0.5); got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestSummarizeStacks(t *testing.T) {
+	profile := `goroutine profile: total 6
+1 @ 0x440e11 0x47cb9d
+#	0x4cc7d0	runtime/pprof.writeRuntimeProfile+0xb0	/usr/local/go/src/runtime/pprof/pprof.go:848
+#	0x4de7c5	main.main+0x65				/tmp/main.go:16
+#	0x44aa26	runtime.main+0x426			/usr/local/go/src/runtime/proc.go:302
+
+5 @ 0x47d82a 0x480925
+#	0x47d829	runtime.gopark+0x11			/usr/local/go/src/runtime/proc.go:302
+#	0x4de73c	example.com/pkg.(*Conn).wait+0x1c	/tmp/conn.go:9
+#	0x4de75c	example.com/pkg.(*Conn).Run+0x2c	/tmp/conn.go:20
+`
+	expected := "     5 example.com/pkg.(*Conn).wait (goroutine example.com/pkg.(*Conn).Run)\n" +
+		"     1 main.main (goroutine runtime.main)\n"
+	if got := summarizeStacks([]byte(profile), 5); got != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+	if got := summarizeStacks([]byte(profile), 1); got != expected[:len(expected)-len("     1 main.main (goroutine runtime.main)\n")] {
+		t.Errorf("expected only the most frequent stack, got\n%s", got)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := Config{Interval: time.Minute, Window: time.Hour, Growth: 0.5}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, config := range []Config{
+		{Interval: 0, Window: time.Hour, Growth: 0.5},
+		{Interval: time.Minute, Window: time.Minute, Growth: 0.5},
+		{Interval: time.Minute, Window: time.Hour, Growth: 0},
+	} {
+		if err := config.Validate(); err == nil {
+			t.Errorf("expected error for %+v, got none", config)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package e2e
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/controller"
+)
+
+func testOptions() controller.Options {
+	options := controller.DefaultOptions()
+	options.RetryIntervalStart = 10 * time.Millisecond
+	options.RetryIntervalMax = 100 * time.Millisecond
+	options.WorkerThreads = 1
+	return options
+}
+
+func attached(va *storage.VolumeAttachment) bool {
+	return va.Status.Attached
+}
+
+// calls records the sequence of CSI calls. The attacher may repeat
+// idempotent calls when it processes a VolumeAttachment again before its
+// informer saw the last update, so repeated calls are recorded once.
+type calls struct {
+	lock  sync.Mutex
+	calls []string
+}
+
+func (c *calls) add(call string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.calls) == 0 || c.calls[len(c.calls)-1] != call {
+		c.calls = append(c.calls, call)
+	}
+}
+
+func (c *calls) check(t *testing.T, expected ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !reflect.DeepEqual(c.calls, expected) {
+		t.Errorf("expected CSI calls %v, got %v", expected, c.calls)
+	}
+}
+
+func TestAttachDetach(t *testing.T) {
+	f := NewFramework(t)
+	defer f.Stop()
+
+	var sequence calls
+	publishContext := map[string]string{"device": "/dev/sdb"}
+	f.Controller.EXPECT().ControllerPublishVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+			if req.VolumeId != "vol-1" || req.NodeId != NodeID {
+				t.Errorf("unexpected ControllerPublishVolume request: %+v", req)
+			}
+			sequence.add("ControllerPublishVolume")
+			return &csi.ControllerPublishVolumeResponse{PublishContext: publishContext}, nil
+		}).MinTimes(1)
+	f.Controller.EXPECT().ControllerUnpublishVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+			if req.VolumeId != "vol-1" || req.NodeId != NodeID {
+				t.Errorf("unexpected ControllerUnpublishVolume request: %+v", req)
+			}
+			sequence.add("ControllerUnpublishVolume")
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
+		}).MinTimes(1)
+	f.Start(testOptions())
+	f.CreateNode()
+	f.CreatePV("pv-1", "vol-1")
+	f.CreateVA("va-1", "pv-1")
+
+	va := f.WaitForVA("va-1", attached)
+	if !HasFinalizer(va) {
+		t.Errorf("attached VolumeAttachment has no finalizer: %v", va.Finalizers)
+	}
+	if !reflect.DeepEqual(va.Status.AttachmentMetadata, publishContext) {
+		t.Errorf("expected attachment metadata %v, got %v", publishContext, va.Status.AttachmentMetadata)
+	}
+	f.WaitForPV("pv-1", func(pv *v1.PersistentVolume) bool { return HasFinalizer(pv) })
+
+	f.DeleteVA("va-1")
+	f.WaitForVADeleted("va-1")
+	// The PV finalizer is removed when the PV is deleted.
+	f.DeletePV("pv-1")
+	f.WaitForPVDeleted("pv-1")
+	sequence.check(t, "ControllerPublishVolume", "ControllerUnpublishVolume")
+}
+
+func TestAttachRetry(t *testing.T) {
+	f := NewFramework(t)
+	defer f.Stop()
+
+	// The retry waits until the test saw the error.
+	retry := make(chan struct{})
+	gomock.InOrder(
+		f.Controller.EXPECT().ControllerPublishVolume(gomock.Any(), gomock.Any()).Return(nil, status.Error(codes.Internal, "mock error")),
+		f.Controller.EXPECT().ControllerPublishVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(_ context.Context, _ *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+				<-retry
+				return &csi.ControllerPublishVolumeResponse{}, nil
+			}).MinTimes(1),
+	)
+	f.Start(testOptions())
+	f.CreateNode()
+	f.CreatePV("pv-1", "vol-1")
+	f.CreateVA("va-1", "pv-1")
+
+	va := f.WaitForVA("va-1", func(va *storage.VolumeAttachment) bool { return va.Status.AttachError != nil })
+	if msg := va.Status.AttachError.Message; !strings.Contains(msg, "mock error") {
+		t.Errorf("expected attach error with the CSI error, got %q", msg)
+	}
+	close(retry)
+	va = f.WaitForVA("va-1", attached)
+	if va.Status.AttachError != nil {
+		t.Errorf("expected attach error to be cleared, got %+v", va.Status.AttachError)
+	}
+}
+
+func TestDetachOfUnattachedVolume(t *testing.T) {
+	f := NewFramework(t)
+	defer f.Stop()
+
+	// The PV does not exist, so the attach fails without CSI calls and the
+	// VolumeAttachment is removed without ControllerUnpublishVolume.
+	f.Start(testOptions())
+	f.CreateNode()
+	f.CreateVA("va-1", "pv-1")
+	va := f.WaitForVA("va-1", func(va *storage.VolumeAttachment) bool { return va.Status.AttachError != nil })
+	if va.Status.Attached {
+		t.Errorf("expected VolumeAttachment without PV not to be attached")
+	}
+	f.DeleteVA("va-1")
+	f.WaitForVADeleted("va-1")
+}
@@ -0,0 +1,457 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package e2e runs the attach controller against a CSI driver mock and an
+// API server and checks finalizers, status and CSI calls.
+package e2e
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-csi/csi-lib-utils/connection"
+	"github.com/kubernetes-csi/csi-test/driver"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/controller"
+)
+
+const (
+	// DriverName is the name of the mock CSI driver.
+	DriverName = "e2e.csi.k8s.io"
+	// NodeName is the name of the node where volumes are attached.
+	NodeName = "e2e-node"
+	// NodeID is the ID of NodeName in the CSI driver.
+	NodeID = "e2e-node-id"
+
+	// kubeconfigEnv is the environment variable with kubeconfig of a real
+	// API server, e.g. an envtest or kind cluster without another attacher.
+	// A fake API server is used when it's not set.
+	kubeconfigEnv = "E2E_KUBECONFIG"
+
+	pollInterval = 10 * time.Millisecond
+	pollTimeout  = 30 * time.Second
+)
+
+// Framework runs the attacher of a mock CSI driver for one test.
+type Framework struct {
+	t *testing.T
+	// Client is the client of the API server.
+	Client kubernetes.Interface
+	// Identity and Controller are mocks of CSI services of the driver. Tests
+	// set expected calls before they create objects.
+	Identity   *driver.MockIdentityServer
+	Controller *driver.MockControllerServer
+
+	fakeAPIServer bool
+	mockCtrl      *gomock.Controller
+	csiDriver     *driver.MockCSIDriver
+	tmpDir        string
+	cancel        context.CancelFunc
+	done          chan struct{}
+	created       []func() error
+}
+
+// NewFramework starts the mock CSI driver. The attacher is started by Start,
+// after the test set expected CSI calls.
+func NewFramework(t *testing.T) *Framework {
+	f := &Framework{t: t, done: make(chan struct{})}
+	if kubeconfig := os.Getenv(kubeconfigEnv); kubeconfig != "" {
+		config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+		if err != nil {
+			t.Fatalf("failed to load %s: %v", kubeconfigEnv, err)
+		}
+		if f.Client, err = kubernetes.NewForConfig(config); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	} else {
+		f.Client = newFakeClient()
+		f.fakeAPIServer = true
+	}
+
+	tmpDir, err := ioutil.TempDir("", "external-attacher-e2e-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	f.tmpDir = tmpDir
+	f.mockCtrl = gomock.NewController(t)
+	f.Identity = driver.NewMockIdentityServer(f.mockCtrl)
+	f.Controller = driver.NewMockControllerServer(f.mockCtrl)
+	f.csiDriver = driver.NewMockCSIDriver(&driver.MockCSIDriverServers{
+		Identity:   f.Identity,
+		Controller: f.Controller,
+	})
+	if err := f.csiDriver.StartOnAddress("unix", filepath.Join(tmpDir, "csi.sock")); err != nil {
+		t.Fatalf("failed to start mock CSI driver: %v", err)
+	}
+
+	// The attacher asks for the name and capabilities when it starts.
+	f.Identity.EXPECT().GetPluginInfo(gomock.Any(), gomock.Any()).Return(&csi.GetPluginInfoResponse{Name: DriverName}, nil).AnyTimes()
+	f.Identity.EXPECT().GetPluginCapabilities(gomock.Any(), gomock.Any()).Return(&csi.GetPluginCapabilitiesResponse{
+		Capabilities: []*csi.PluginCapability{{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{Type: csi.PluginCapability_Service_CONTROLLER_SERVICE},
+			},
+		}},
+	}, nil).AnyTimes()
+	f.Controller.EXPECT().ControllerGetCapabilities(gomock.Any(), gomock.Any()).Return(&csi.ControllerGetCapabilitiesResponse{
+		Capabilities: []*csi.ControllerServiceCapability{{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{Type: csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME},
+			},
+		}},
+	}, nil).AnyTimes()
+	return f
+}
+
+// Start runs the attacher with given options until Stop.
+func (f *Framework) Start(options controller.Options) {
+	conn, err := connection.Connect(f.csiDriver.Address())
+	if err != nil {
+		f.t.Fatalf("failed to connect to mock CSI driver: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+	factory := informers.NewSharedInformerFactory(f.Client, 0)
+	d, err := controller.NewDriver(ctx, f.Client, factory, conn, options)
+	if err != nil {
+		f.t.Fatalf("failed to create attacher: %v", err)
+	}
+	factory.Start(ctx.Done())
+	go func() {
+		defer close(f.done)
+		defer conn.Close()
+		if err := d.Run(ctx); err != nil {
+			f.t.Errorf("attacher failed: %v", err)
+		}
+	}()
+	if f.fakeAPIServer {
+		go f.collectGarbage(ctx)
+	}
+}
+
+// Stop stops the attacher and the mock driver, deletes all objects created
+// by the test and checks that all expected CSI calls were made.
+func (f *Framework) Stop() {
+	if f.cancel != nil {
+		f.cancel()
+		<-f.done
+	}
+	for i := len(f.created) - 1; i >= 0; i-- {
+		if err := f.created[i](); err != nil && !apierrs.IsNotFound(err) {
+			f.t.Errorf("cleanup failed: %v", err)
+		}
+	}
+	f.csiDriver.Stop()
+	os.RemoveAll(f.tmpDir)
+	f.mockCtrl.Finish()
+}
+
+// CreateNode creates the node of the driver with its CSINode.
+func (f *Framework) CreateNode() {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: NodeName}}
+	if _, err := f.Client.CoreV1().Nodes().Create(node); err != nil {
+		f.t.Fatalf("failed to create Node: %v", err)
+	}
+	f.created = append(f.created, func() error { return f.Client.CoreV1().Nodes().Delete(NodeName, nil) })
+	csiNode := &storage.CSINode{
+		ObjectMeta: metav1.ObjectMeta{Name: NodeName},
+		Spec: storage.CSINodeSpec{
+			Drivers: []storage.CSINodeDriver{{Name: DriverName, NodeID: NodeID}},
+		},
+	}
+	if _, err := f.Client.StorageV1beta1().CSINodes().Create(csiNode); err != nil {
+		f.t.Fatalf("failed to create CSINode: %v", err)
+	}
+	f.created = append(f.created, func() error { return f.Client.StorageV1beta1().CSINodes().Delete(NodeName, nil) })
+}
+
+// CreatePV creates a PV of the driver with given volume handle.
+func (f *Framework) CreatePV(name, volumeHandle string) *v1.PersistentVolume {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity:                      v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+			AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimRetain,
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: DriverName, VolumeHandle: volumeHandle},
+			},
+		},
+	}
+	pv, err := f.Client.CoreV1().PersistentVolumes().Create(pv)
+	if err != nil {
+		f.t.Fatalf("failed to create PV: %v", err)
+	}
+	f.created = append(f.created, func() error { return f.forceDelete(pvObject(f.Client, name)) })
+	return pv
+}
+
+// CreateVA creates a VolumeAttachment of a PV to NodeName.
+func (f *Framework) CreateVA(name, pvName string) *storage.VolumeAttachment {
+	va := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: storage.VolumeAttachmentSpec{
+			Attacher: DriverName,
+			NodeName: NodeName,
+			Source:   storage.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+		},
+	}
+	va, err := f.Client.StorageV1beta1().VolumeAttachments().Create(va)
+	if err != nil {
+		f.t.Fatalf("failed to create VolumeAttachment: %v", err)
+	}
+	f.created = append(f.created, func() error { return f.forceDelete(vaObject(f.Client, name)) })
+	return va
+}
+
+// DeleteVA deletes a VolumeAttachment.
+func (f *Framework) DeleteVA(name string) {
+	if err := f.delete(vaObject(f.Client, name)); err != nil {
+		f.t.Fatalf("failed to delete VolumeAttachment: %v", err)
+	}
+}
+
+// DeletePV deletes a PV.
+func (f *Framework) DeletePV(name string) {
+	if err := f.delete(pvObject(f.Client, name)); err != nil {
+		f.t.Fatalf("failed to delete PV: %v", err)
+	}
+}
+
+// WaitForVA waits until condition is true for the VolumeAttachment and
+// returns it.
+func (f *Framework) WaitForVA(name string, condition func(va *storage.VolumeAttachment) bool) *storage.VolumeAttachment {
+	var va *storage.VolumeAttachment
+	err := wait.PollImmediate(pollInterval, pollTimeout, func() (bool, error) {
+		var err error
+		va, err = f.Client.StorageV1beta1().VolumeAttachments().Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false, nil
+		}
+		return condition(va), nil
+	})
+	if err != nil {
+		f.t.Fatalf("timed out waiting for VolumeAttachment %s, last state: %+v", name, va)
+	}
+	return va
+}
+
+// WaitForVADeleted waits until the VolumeAttachment is removed.
+func (f *Framework) WaitForVADeleted(name string) {
+	err := wait.PollImmediate(pollInterval, pollTimeout, func() (bool, error) {
+		_, err := f.Client.StorageV1beta1().VolumeAttachments().Get(name, metav1.GetOptions{})
+		return apierrs.IsNotFound(err), nil
+	})
+	if err != nil {
+		f.t.Fatalf("timed out waiting for deletion of VolumeAttachment %s", name)
+	}
+}
+
+// WaitForPVDeleted waits until the PV is removed.
+func (f *Framework) WaitForPVDeleted(name string) {
+	err := wait.PollImmediate(pollInterval, pollTimeout, func() (bool, error) {
+		_, err := f.Client.CoreV1().PersistentVolumes().Get(name, metav1.GetOptions{})
+		return apierrs.IsNotFound(err), nil
+	})
+	if err != nil {
+		f.t.Fatalf("timed out waiting for deletion of PV %s", name)
+	}
+}
+
+// WaitForPV waits until condition is true for the PV and returns it.
+func (f *Framework) WaitForPV(name string, condition func(pv *v1.PersistentVolume) bool) *v1.PersistentVolume {
+	var pv *v1.PersistentVolume
+	err := wait.PollImmediate(pollInterval, pollTimeout, func() (bool, error) {
+		var err error
+		pv, err = f.Client.CoreV1().PersistentVolumes().Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false, nil
+		}
+		return condition(pv), nil
+	})
+	if err != nil {
+		f.t.Fatalf("timed out waiting for PV %s, last state: %+v", name, pv)
+	}
+	return pv
+}
+
+// HasFinalizer returns true when the object has the finalizer of the
+// attacher.
+func HasFinalizer(obj metav1.Object) bool {
+	for _, finalizer := range obj.GetFinalizers() {
+		if finalizer == controller.GetFinalizerName(DriverName) {
+			return true
+		}
+	}
+	return false
+}
+
+// object is a cluster scoped object in the API server.
+type object struct {
+	kind   string
+	get    func() (metav1.Object, error)
+	update func(obj metav1.Object) error
+	delete func() error
+}
+
+func vaObject(client kubernetes.Interface, name string) object {
+	vas := client.StorageV1beta1().VolumeAttachments()
+	return object{
+		kind: "VolumeAttachment",
+		get:  func() (metav1.Object, error) { return vas.Get(name, metav1.GetOptions{}) },
+		update: func(obj metav1.Object) error {
+			_, err := vas.Update(obj.(*storage.VolumeAttachment))
+			return err
+		},
+		delete: func() error { return vas.Delete(name, nil) },
+	}
+}
+
+func pvObject(client kubernetes.Interface, name string) object {
+	pvs := client.CoreV1().PersistentVolumes()
+	return object{
+		kind: "PersistentVolume",
+		get:  func() (metav1.Object, error) { return pvs.Get(name, metav1.GetOptions{}) },
+		update: func(obj metav1.Object) error {
+			_, err := pvs.Update(obj.(*v1.PersistentVolume))
+			return err
+		},
+		delete: func() error { return pvs.Delete(name, nil) },
+	}
+}
+
+// delete deletes an object. The fake API server removes objects at once,
+// so objects with finalizers only get the deletion timestamp like in a real
+// API server and collectGarbage removes them when the finalizers are gone.
+func (f *Framework) delete(o object) error {
+	if !f.fakeAPIServer {
+		return o.delete()
+	}
+	obj, err := o.get()
+	if err != nil {
+		return err
+	}
+	if len(obj.GetFinalizers()) == 0 {
+		return o.delete()
+	}
+	now := metav1.Now()
+	obj.SetDeletionTimestamp(&now)
+	return o.update(obj)
+}
+
+// forceDelete removes finalizers of an object and deletes it.
+func (f *Framework) forceDelete(o object) error {
+	obj, err := o.get()
+	if err != nil {
+		return err
+	}
+	if len(obj.GetFinalizers()) > 0 {
+		obj.SetFinalizers(nil)
+		if err := o.update(obj); err != nil {
+			return fmt.Errorf("failed to remove finalizers of %s %s: %v", o.kind, obj.GetName(), err)
+		}
+	}
+	return o.delete()
+}
+
+// newFakeClient returns a fake API server client. Unlike the reaction of
+// the client-go fake, merge patches decode into an empty object, so fields
+// removed by a patch (e.g. the last finalizer) are removed.
+func newFakeClient() *fake.Clientset {
+	tracker := core.NewObjectTracker(scheme.Scheme, scheme.Codecs.UniversalDecoder())
+	client := &fake.Clientset{}
+	client.AddReactor("patch", "*", func(action core.Action) (bool, runtime.Object, error) {
+		patch := action.(core.PatchAction)
+		if patch.GetPatchType() != types.MergePatchType {
+			return false, nil, nil
+		}
+		obj, err := tracker.Get(patch.GetResource(), patch.GetNamespace(), patch.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		old, err := json.Marshal(obj)
+		if err != nil {
+			return true, nil, err
+		}
+		modified, err := jsonpatch.MergePatch(old, patch.GetPatch())
+		if err != nil {
+			return true, nil, err
+		}
+		obj = reflect.New(reflect.TypeOf(obj).Elem()).Interface().(runtime.Object)
+		if err := json.Unmarshal(modified, obj); err != nil {
+			return true, nil, err
+		}
+		if err := tracker.Update(patch.GetResource(), obj, patch.GetNamespace()); err != nil {
+			return true, nil, err
+		}
+		return true, obj, nil
+	})
+	client.AddReactor("*", "*", core.ObjectReaction(tracker))
+	client.AddWatchReactor("*", func(action core.Action) (bool, watch.Interface, error) {
+		w, err := tracker.Watch(action.GetResource(), action.GetNamespace())
+		if err != nil {
+			return false, nil, err
+		}
+		return true, w, nil
+	})
+	return client
+}
+
+// collectGarbage removes deleted VolumeAttachments and PVs without
+// finalizers from the fake API server.
+func (f *Framework) collectGarbage(ctx context.Context) {
+	wait.Until(func() {
+		if vas, err := f.Client.StorageV1beta1().VolumeAttachments().List(metav1.ListOptions{}); err == nil {
+			for _, va := range vas.Items {
+				if va.DeletionTimestamp != nil && len(va.Finalizers) == 0 {
+					f.Client.StorageV1beta1().VolumeAttachments().Delete(va.Name, nil)
+				}
+			}
+		}
+		if pvs, err := f.Client.CoreV1().PersistentVolumes().List(metav1.ListOptions{}); err == nil {
+			for _, pv := range pvs.Items {
+				if pv.DeletionTimestamp != nil && len(pv.Finalizers) == 0 {
+					f.Client.CoreV1().PersistentVolumes().Delete(pv.Name, nil)
+				}
+			}
+		}
+	}, pollInterval, ctx.Done())
+}